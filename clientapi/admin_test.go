@@ -3,6 +3,7 @@ package clientapi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ike20013/dendrite/federationapi"
 	"net/http"
@@ -21,6 +22,7 @@ import (
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/jetstream"
 	"github.com/ike20013/dendrite/syncapi"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
@@ -45,10 +47,10 @@ func TestAdminCreateToken(t *testing.T) {
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -196,10 +198,10 @@ func TestAdminListRegistrationTokens(t *testing.T) {
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -314,10 +316,10 @@ func TestAdminGetRegistrationToken(t *testing.T) {
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -415,10 +417,10 @@ func TestAdminDeleteRegistrationToken(t *testing.T) {
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -509,10 +511,10 @@ func TestAdminUpdateRegistrationToken(t *testing.T) {
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -692,12 +694,12 @@ func TestAdminResetPassword(t *testing.T) {
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		// Needed for changing the password/login
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		// We mostly need the userAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -787,7 +789,7 @@ func TestPurgeRoom(t *testing.T) {
 
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 
 		// this starts the JetStream consumers
 		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, rsAPI, caches, nil, true)
@@ -802,7 +804,7 @@ func TestPurgeRoom(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -859,7 +861,7 @@ func TestAdminEvacuateRoom(t *testing.T) {
 
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 
 		// this starts the JetStream consumers
 		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, rsAPI, caches, nil, true)
@@ -873,7 +875,7 @@ func TestAdminEvacuateRoom(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -960,7 +962,7 @@ func TestAdminEvacuateUser(t *testing.T) {
 
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 
 		// this starts the JetStream consumers
 		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, basepkg.CreateFederationClient(cfg, nil), rsAPI, caches, nil, true)
@@ -977,7 +979,7 @@ func TestAdminEvacuateUser(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -1042,6 +1044,108 @@ func TestAdminEvacuateUser(t *testing.T) {
 	})
 }
 
+func TestAdminRedactUser(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, aliceAdmin)
+
+	// Join Bob and let him send some messages
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+	room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "spam"})
+	room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "more spam"})
+	room.CreateAndInsert(t, aliceAdmin, "m.room.message", map[string]interface{}{"body": "not spam"})
+
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", api.DoNotSendToOtherServers, nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		accessTokens := map[*test.User]userDevice{
+			aliceAdmin: {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		t.Run("invalid userID is rejected", func(t *testing.T) {
+			req := test.NewRequest(t, http.MethodPost, "/_dendrite/admin/redactUser/!notauserid:test")
+			req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
+			rec := httptest.NewRecorder()
+			routers.DendriteAdmin.ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected http status %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+			}
+		})
+
+		t.Run("unknown job is not found", func(t *testing.T) {
+			req := test.NewRequest(t, http.MethodGet, "/_dendrite/admin/redactUserStatus/doesnotexist")
+			req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
+			rec := httptest.NewRecorder()
+			routers.DendriteAdmin.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("expected http status %d, got %d: %s", http.StatusNotFound, rec.Code, rec.Body.String())
+			}
+		})
+
+		t.Run("Can redact events of a user", func(t *testing.T) {
+			req := test.NewRequest(t, http.MethodPost, "/_dendrite/admin/redactUser/"+bob.ID, test.WithJSONBody(t, map[string]interface{}{
+				"rooms":  []string{room.ID},
+				"reason": "spam",
+			}))
+			req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
+			rec := httptest.NewRecorder()
+			routers.DendriteAdmin.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+			redactID := gjson.GetBytes(rec.Body.Bytes(), "redact_id").Str
+
+			timeout := time.After(5 * time.Second)
+			for {
+				req = test.NewRequest(t, http.MethodGet, "/_dendrite/admin/redactUserStatus/"+redactID)
+				req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
+				rec = httptest.NewRecorder()
+				routers.DendriteAdmin.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+				}
+				if status := gjson.GetBytes(rec.Body.Bytes(), "status").Str; status != api.AdminRedactUserJobActive {
+					if status != api.AdminRedactUserJobCompleted {
+						t.Fatalf("expected job to complete, got %s", rec.Body.String())
+					}
+					break
+				}
+				select {
+				case <-timeout:
+					t.Fatalf("redaction job didn't complete in time")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			// Bob's join and both messages, but not Alice's message
+			if redacted := gjson.GetBytes(rec.Body.Bytes(), "redacted").Int(); redacted != 3 {
+				t.Fatalf("expected 3 redacted events, got %s", rec.Body.String())
+			}
+		})
+	})
+}
+
 func TestAdminMarkAsStale(t *testing.T) {
 	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
 
@@ -1055,12 +1159,12 @@ func TestAdminMarkAsStale(t *testing.T) {
 
 		routers := httputil.NewRouters()
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -1136,7 +1240,7 @@ func TestAdminQueryEventReports(t *testing.T) {
 		defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
 
 		// Use an actual roomserver for this
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
@@ -1148,7 +1252,7 @@ func TestAdminQueryEventReports(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -1368,7 +1472,7 @@ func TestEventReportsGetDelete(t *testing.T) {
 		defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
 
 		// Use an actual roomserver for this
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
@@ -1377,7 +1481,7 @@ func TestEventReportsGetDelete(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -1473,3 +1577,654 @@ func TestEventReportsGetDelete(t *testing.T) {
 		})
 	})
 }
+
+func TestAdminRooms(t *testing.T) {
+	alice := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, spec.MRoomName, map[string]string{"name": "Testing"}, test.WithStateKey(""))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+		jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		accessTokens := map[*test.User]userDevice{
+			alice:   {},
+			bob:     {},
+			charlie: {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, processCtx.Context(), routers)
+
+		adminRequest := func(t *testing.T, method, path string, body string, wantCode int) gjson.Result {
+			t.Helper()
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+accessTokens[alice].accessToken)
+			rec := httptest.NewRecorder()
+			routers.SynapseAdmin.ServeHTTP(rec, req)
+			if rec.Code != wantCode {
+				t.Fatalf("expected HTTP %d, got %d: %s", wantCode, rec.Code, rec.Body.String())
+			}
+			return gjson.ParseBytes(rec.Body.Bytes())
+		}
+
+		t.Run("Can list rooms", func(t *testing.T) {
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms?search_term=test", "", http.StatusOK)
+			if res.Get("total_rooms").Int() != 1 {
+				t.Fatalf("expected one room, got %s", res.Raw)
+			}
+			if got := res.Get("rooms.0.room_id").Str; got != room.ID {
+				t.Fatalf("expected room %s, got %s", room.ID, got)
+			}
+			if got := res.Get("rooms.0.joined_members").Int(); got != 2 {
+				t.Fatalf("expected 2 joined members, got %d", got)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms?search_term=nothing", "", http.StatusOK)
+			if res.Get("total_rooms").Int() != 0 {
+				t.Fatalf("expected no rooms, got %s", res.Raw)
+			}
+			adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms?order_by=unknown", "", http.StatusBadRequest)
+		})
+
+		t.Run("Can get room details, members and state", func(t *testing.T) {
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+room.ID, "", http.StatusOK)
+			if res.Get("creator").Str != alice.ID || res.Get("name").Str != "Testing" {
+				t.Fatalf("unexpected room details: %s", res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+room.ID+"/members", "", http.StatusOK)
+			if res.Get("total").Int() != 2 {
+				t.Fatalf("expected 2 members, got %s", res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+room.ID+"/state", "", http.StatusOK)
+			if !res.Get(`state.#(type=="m.room.create")`).Exists() {
+				t.Fatalf("expected the create event in the state, got %s", res.Raw)
+			}
+			adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/!doesnotexist:test", "", http.StatusNotFound)
+		})
+
+		t.Run("Can block rooms", func(t *testing.T) {
+			adminRequest(t, http.MethodPut, "/_synapse/admin/v1/rooms/"+room.ID+"/block", `{"block":true}`, http.StatusOK)
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+room.ID+"/block", "", http.StatusOK)
+			if !res.Get("block").Bool() || res.Get("user_id").Str != alice.ID {
+				t.Fatalf("expected the room to be blocked by %s, got %s", alice.ID, res.Raw)
+			}
+			_, _, err := rsAPI.PerformJoin(processCtx.Context(), &api.PerformJoinRequest{RoomIDOrAlias: room.ID, UserID: charlie.ID})
+			var notAllowed api.ErrNotAllowed
+			if !errors.As(err, &notAllowed) {
+				t.Fatalf("expected joining a blocked room to be forbidden, got %v", err)
+			}
+			adminRequest(t, http.MethodPut, "/_synapse/admin/v1/rooms/"+room.ID+"/block", `{"block":false}`, http.StatusOK)
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+room.ID+"/block", "", http.StatusOK)
+			if res.Get("block").Bool() {
+				t.Fatalf("expected the room not to be blocked, got %s", res.Raw)
+			}
+		})
+
+		t.Run("Can make a user room admin", func(t *testing.T) {
+			adminRequest(t, http.MethodPost, "/_synapse/admin/v1/rooms/"+room.ID+"/make_room_admin", `{"user_id":"`+bob.ID+`"}`, http.StatusOK)
+			stateRes := &api.QueryCurrentStateResponse{}
+			if err := rsAPI.QueryCurrentState(processCtx.Context(), &api.QueryCurrentStateRequest{
+				RoomID:      room.ID,
+				StateTuples: []gomatrixserverlib.StateKeyTuple{{EventType: spec.MRoomPowerLevels}},
+			}, stateRes); err != nil {
+				t.Fatal(err)
+			}
+			plEvent := stateRes.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomPowerLevels}]
+			if plEvent == nil {
+				t.Fatalf("expected the room to have power levels")
+			}
+			if level := gjson.GetBytes(plEvent.Content(), "users."+strings.ReplaceAll(bob.ID, ".", "\\.")).Int(); level != 100 {
+				t.Fatalf("expected %s to have power level 100, got %d", bob.ID, level)
+			}
+		})
+
+		t.Run("Can delete rooms", func(t *testing.T) {
+			res := adminRequest(t, http.MethodDelete, "/_synapse/admin/v1/rooms/"+room.ID, `{"new_room_user_id":"`+alice.ID+`","block":true}`, http.StatusOK)
+			if len(res.Get("kicked_users").Array()) != 2 {
+				t.Fatalf("expected 2 kicked users, got %s", res.Raw)
+			}
+			newRoomID := res.Get("new_room_id").Str
+			if newRoomID == "" {
+				t.Fatalf("expected a new room, got %s", res.Raw)
+			}
+			adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+room.ID, "", http.StatusNotFound)
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+newRoomID+"/members", "", http.StatusOK)
+			if res.Get("total").Int() != 2 {
+				t.Fatalf("expected the users to be moved to the new room, got %s", res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v1/rooms/"+room.ID+"/block", "", http.StatusOK)
+			if !res.Get("block").Bool() {
+				t.Fatalf("expected the deleted room to stay blocked, got %s", res.Raw)
+			}
+		})
+	})
+}
+
+func TestAdminUsers(t *testing.T) {
+	alice := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+		jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+			bob:   {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, processCtx.Context(), routers)
+
+		request := func(t *testing.T, router http.Handler, accessToken, method, path string, body string, wantCode int) gjson.Result {
+			t.Helper()
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != wantCode {
+				t.Fatalf("%s %s: expected HTTP %d, got %d: %s", method, path, wantCode, rec.Code, rec.Body.String())
+			}
+			return gjson.ParseBytes(rec.Body.Bytes())
+		}
+		adminRequest := func(t *testing.T, method, path string, body string, wantCode int) gjson.Result {
+			t.Helper()
+			return request(t, routers.SynapseAdmin, accessTokens[alice].accessToken, method, path, body, wantCode)
+		}
+		newUserID := "@newuser:" + string(cfg.Global.ServerName)
+
+		t.Run("Non-admins are forbidden", func(t *testing.T) {
+			for _, tc := range []struct {
+				method, path string
+			}{
+				{http.MethodGet, "/_synapse/admin/v2/users"},
+				{http.MethodGet, "/_synapse/admin/v2/users/" + alice.ID},
+				{http.MethodPut, "/_synapse/admin/v2/users/" + bob.ID},
+				{http.MethodGet, "/_synapse/admin/v2/users/" + alice.ID + "/devices"},
+				{http.MethodGet, "/_synapse/admin/v1/users/" + alice.ID + "/joined_rooms"},
+			} {
+				request(t, routers.SynapseAdmin, accessTokens[bob].accessToken, tc.method, tc.path, `{"admin":true}`, http.StatusForbidden)
+			}
+			request(t, routers.DendriteAdmin, accessTokens[bob].accessToken, http.MethodPost, "/_dendrite/admin/logoutUser/"+alice.ID, "", http.StatusForbidden)
+		})
+
+		t.Run("Can list users", func(t *testing.T) {
+			// The server notices user is listed as well.
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users", "", http.StatusOK)
+			if res.Get("total").Int() != 3 {
+				t.Fatalf("expected 3 users, got %s", res.Raw)
+			}
+			if !res.Get(`users.#(name=="` + alice.ID + `").admin`).Bool() {
+				t.Fatalf("expected %s to be an admin, got %s", alice.ID, res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users?name="+bob.Localpart, "", http.StatusOK)
+			if res.Get("total").Int() != 1 || res.Get("users.0.name").Str != bob.ID {
+				t.Fatalf("expected to find %s, got %s", bob.ID, res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users?limit=1", "", http.StatusOK)
+			if len(res.Get("users").Array()) != 1 || res.Get("next_token").Str != "1" {
+				t.Fatalf("expected one user and a next token, got %s", res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users?from=2", "", http.StatusOK)
+			if len(res.Get("users").Array()) != 1 || res.Get("next_token").Exists() {
+				t.Fatalf("expected the last user without a next token, got %s", res.Raw)
+			}
+		})
+
+		t.Run("Can get a user", func(t *testing.T) {
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users/"+bob.ID, "", http.StatusOK)
+			if res.Get("name").Str != bob.ID || res.Get("admin").Bool() || res.Get("deactivated").Bool() {
+				t.Fatalf("unexpected user details: %s", res.Raw)
+			}
+			if !res.Get("threepids").IsArray() {
+				t.Fatalf("expected a list of 3PIDs, got %s", res.Raw)
+			}
+			adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users/@doesnotexist:"+string(cfg.Global.ServerName), "", http.StatusNotFound)
+			adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users/@bob:remote", "", http.StatusBadRequest)
+			adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users/notauserid", "", http.StatusBadRequest)
+		})
+
+		t.Run("Can create and modify users", func(t *testing.T) {
+			adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/"+newUserID, `{"deactivated":true}`, http.StatusBadRequest)
+			adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/"+newUserID, `{"password":"short"}`, http.StatusBadRequest)
+			adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/@newuser:remote", `{}`, http.StatusBadRequest)
+
+			res := adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/"+newUserID, `{"password":"newuserpassword","displayname":"New User"}`, http.StatusCreated)
+			if res.Get("name").Str != newUserID || res.Get("displayname").Str != "New User" || res.Get("admin").Bool() {
+				t.Fatalf("unexpected user details: %s", res.Raw)
+			}
+
+			res = adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/"+newUserID, `{"admin":true,"avatar_url":"mxc://test/avatar"}`, http.StatusOK)
+			if !res.Get("admin").Bool() || res.Get("avatar_url").Str != "mxc://test/avatar" || res.Get("displayname").Str != "New User" {
+				t.Fatalf("unexpected user details: %s", res.Raw)
+			}
+
+			adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/"+alice.ID, `{"admin":false}`, http.StatusBadRequest)
+		})
+
+		t.Run("Can deactivate and reactivate users", func(t *testing.T) {
+			res := adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/"+newUserID, `{"deactivated":true}`, http.StatusOK)
+			if !res.Get("deactivated").Bool() {
+				t.Fatalf("expected the user to be deactivated, got %s", res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users", "", http.StatusOK)
+			if res.Get(`users.#(name=="` + newUserID + `")`).Exists() {
+				t.Fatalf("expected deactivated users not to be listed, got %s", res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users?deactivated=true", "", http.StatusOK)
+			if !res.Get(`users.#(name=="` + newUserID + `")`).Exists() {
+				t.Fatalf("expected deactivated users to be listed, got %s", res.Raw)
+			}
+
+			res = adminRequest(t, http.MethodPut, "/_synapse/admin/v2/users/"+newUserID, `{"deactivated":false,"password":"anotherpassword"}`, http.StatusOK)
+			if res.Get("deactivated").Bool() {
+				t.Fatalf("expected the user to be reactivated, got %s", res.Raw)
+			}
+		})
+
+		t.Run("Can list the devices of a user", func(t *testing.T) {
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users/"+bob.ID+"/devices", "", http.StatusOK)
+			if res.Get("total").Int() != 1 || res.Get("devices.0.device_id").Str != accessTokens[bob].deviceID {
+				t.Fatalf("expected bob's device, got %s", res.Raw)
+			}
+			if res.Get("devices.0.user_id").Str != bob.ID {
+				t.Fatalf("expected the device to belong to %s, got %s", bob.ID, res.Raw)
+			}
+			adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users/@doesnotexist:"+string(cfg.Global.ServerName)+"/devices", "", http.StatusNotFound)
+		})
+
+		t.Run("Can list the joined rooms of a user", func(t *testing.T) {
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v1/users/"+bob.ID+"/joined_rooms", "", http.StatusOK)
+			if res.Get("total").Int() != 1 || res.Get("joined_rooms.0").Str != room.ID {
+				t.Fatalf("expected bob to be joined to %s, got %s", room.ID, res.Raw)
+			}
+			res = adminRequest(t, http.MethodGet, "/_synapse/admin/v1/users/"+newUserID+"/joined_rooms", "", http.StatusOK)
+			if res.Get("total").Int() != 0 {
+				t.Fatalf("expected no joined rooms, got %s", res.Raw)
+			}
+		})
+
+		t.Run("Can log out a user", func(t *testing.T) {
+			request(t, routers.DendriteAdmin, accessTokens[alice].accessToken, http.MethodPost, "/_dendrite/admin/logoutUser/@bob:remote", "", http.StatusBadRequest)
+			request(t, routers.DendriteAdmin, accessTokens[alice].accessToken, http.MethodPost, "/_dendrite/admin/logoutUser/"+bob.ID, "", http.StatusOK)
+			request(t, routers.Client, accessTokens[bob].accessToken, http.MethodGet, "/_matrix/client/v3/account/whoami", "", http.StatusUnauthorized)
+			res := adminRequest(t, http.MethodGet, "/_synapse/admin/v2/users/"+bob.ID+"/devices", "", http.StatusOK)
+			if res.Get("total").Int() != 0 {
+				t.Fatalf("expected bob to have no devices, got %s", res.Raw)
+			}
+		})
+	})
+}
+
+func TestAdminAccountValidity(t *testing.T) {
+	alice := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cfg.UserAPI.AccountValidity.Period = time.Hour
+		natsInstance := jetstream.NATSInstance{}
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+			bob:   {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		setValidity := func(t *testing.T, user *test.User, body map[string]interface{}) *httptest.ResponseRecorder {
+			t.Helper()
+			req := test.NewRequest(t, http.MethodPost, "/_synapse/admin/v1/account_validity/validity", test.WithJSONBody(t, body))
+			req.Header.Set("Authorization", "Bearer "+accessTokens[user].accessToken)
+			rec := httptest.NewRecorder()
+			routers.SynapseAdmin.ServeHTTP(rec, req)
+			return rec
+		}
+		whoami := func(t *testing.T, user *test.User) *httptest.ResponseRecorder {
+			t.Helper()
+			req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/account/whoami")
+			req.Header.Set("Authorization", "Bearer "+accessTokens[user].accessToken)
+			rec := httptest.NewRecorder()
+			routers.Client.ServeHTTP(rec, req)
+			return rec
+		}
+
+		if rec := setValidity(t, bob, map[string]interface{}{"user_id": bob.ID, "expiration_ts": 1}); rec.Code != http.StatusForbidden {
+			t.Fatalf("expected non-admins to be forbidden, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec := setValidity(t, alice, map[string]interface{}{"user_id": "@doesnotexist:test"}); rec.Code != http.StatusNotFound {
+			t.Fatalf("expected unknown users not to be found, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		// Accounts registered while accounts expire are valid for the configured period.
+		if rec := whoami(t, bob); rec.Code != http.StatusOK {
+			t.Fatalf("expected bob's account to be valid, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		rec := setValidity(t, alice, map[string]interface{}{"user_id": bob.ID, "expiration_ts": 1})
+		if rec.Code != http.StatusOK || gjson.GetBytes(rec.Body.Bytes(), "expiration_ts").Int() != 1 {
+			t.Fatalf("failed to set the expiry: %d %s", rec.Code, rec.Body.String())
+		}
+		rec = whoami(t, bob)
+		if rec.Code != http.StatusForbidden || gjson.GetBytes(rec.Body.Bytes(), "errcode").Str != "ORG_MATRIX_EXPIRED_ACCOUNT" {
+			t.Fatalf("expected bob's account to have expired, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		// Admins aren't locked out by an expiry, so that they can still renew accounts.
+		rec = setValidity(t, alice, map[string]interface{}{"user_id": alice.ID, "expiration_ts": 1})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("failed to set the expiry: %d %s", rec.Code, rec.Body.String())
+		}
+		if rec = whoami(t, alice); rec.Code != http.StatusOK {
+			t.Fatalf("expected alice's admin account not to expire, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		// Renewing without an expiry extends the account by the configured period.
+		before := time.Now()
+		rec = setValidity(t, alice, map[string]interface{}{"user_id": bob.ID})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("failed to renew the account: %d %s", rec.Code, rec.Body.String())
+		}
+		if expiry := gjson.GetBytes(rec.Body.Bytes(), "expiration_ts").Int(); expiry < before.Add(time.Hour).UnixMilli() {
+			t.Fatalf("expected the account to be renewed for an hour, got %d", expiry)
+		}
+		if rec = whoami(t, bob); rec.Code != http.StatusOK {
+			t.Fatalf("expected bob's account to be valid again, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestAdminFederationDestinations(t *testing.T) {
+	alice := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, rsAPI, caches, nil, true)
+		rsAPI.SetFederationAPI(fsAPI, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, fsAPI, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		do := func(t *testing.T, method, path string, router http.Handler) *httptest.ResponseRecorder {
+			t.Helper()
+			req := test.NewRequest(t, method, path)
+			req.Header.Set("Authorization", "Bearer "+accessTokens[alice].accessToken)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		rec := do(t, http.MethodGet, "/_synapse/admin/v1/federation/destinations/remote.test", routers.SynapseAdmin)
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected unknown destination to return %d, got %d: %s", http.StatusNotFound, rec.Code, rec.Body.String())
+		}
+
+		// Talking to the servers creates statistics for them.
+		for _, serverName := range []spec.ServerName{"remote.test", "other.test"} {
+			if _, err := fsAPI.IsBlacklistedOrBackingOff(serverName); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		rec = do(t, http.MethodGet, "/_synapse/admin/v1/federation/destinations?limit=1", routers.SynapseAdmin)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		body := gjson.ParseBytes(rec.Body.Bytes())
+		if total := body.Get("total").Int(); total != 2 {
+			t.Fatalf("expected 2 destinations, got %d: %s", total, rec.Body.String())
+		}
+		if destination := body.Get("destinations.0.destination").Str; destination != "other.test" {
+			t.Fatalf("expected destinations to be sorted, got %s first", destination)
+		}
+		if next := body.Get("next_token").Str; next != "1" {
+			t.Fatalf("expected next_token 1, got %q", next)
+		}
+
+		rec = do(t, http.MethodGet, "/_synapse/admin/v1/federation/destinations?destination=remote", routers.SynapseAdmin)
+		body = gjson.ParseBytes(rec.Body.Bytes())
+		if total := body.Get("total").Int(); total != 1 || body.Get("destinations.0.destination").Str != "remote.test" {
+			t.Fatalf("expected the filter to match remote.test, got %s", rec.Body.String())
+		}
+
+		rec = do(t, http.MethodGet, "/_synapse/admin/v1/federation/destinations/remote.test", routers.SynapseAdmin)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		body = gjson.ParseBytes(rec.Body.Bytes())
+		if body.Get("failure_count").Int() != 0 || body.Get("blacklisted").Bool() || body.Get("pending_pdus").Int() != 0 || body.Get("backoff_until").Type != gjson.Null {
+			t.Fatalf("unexpected destination: %s", rec.Body.String())
+		}
+
+		rec = do(t, http.MethodPost, "/_synapse/admin/v1/federation/destinations/remote.test/reset_connection", routers.SynapseAdmin)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		rec = do(t, http.MethodPost, "/_dendrite/admin/purgeFederationQueue/remote.test", routers.DendriteAdmin)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestAdminFederationDomains(t *testing.T) {
+	alice := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cfg.FederationAPI.DeniedServerNames = []string{"spam.test"}
+		natsInstance := jetstream.NATSInstance{}
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, rsAPI, caches, nil, true)
+		rsAPI.SetFederationAPI(fsAPI, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, fsAPI, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		do := func(t *testing.T, method string, opts ...test.HTTPRequestOpt) *httptest.ResponseRecorder {
+			t.Helper()
+			req := test.NewRequest(t, method, "/_dendrite/admin/federationDomains", opts...)
+			req.Header.Set("Authorization", "Bearer "+accessTokens[alice].accessToken)
+			rec := httptest.NewRecorder()
+			routers.DendriteAdmin.ServeHTTP(rec, req)
+			return rec
+		}
+
+		rec := do(t, http.MethodGet)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		if denied := gjson.GetBytes(rec.Body.Bytes(), "denied").Array(); len(denied) != 1 || denied[0].Str != "spam.test" {
+			t.Fatalf("expected the configured deny list, got %s", rec.Body.String())
+		}
+		if fsAPI.IsServerNameAllowed("spam.test") {
+			t.Fatalf("expected spam.test to be denied")
+		}
+
+		rec = do(t, http.MethodPut, test.WithJSONBody(t, map[string]interface{}{
+			"allowed": []string{"*.partner.test"},
+			"denied":  []string{},
+		}))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		if !fsAPI.IsServerNameAllowed("rooms.partner.test") || fsAPI.IsServerNameAllowed("spam.test") {
+			t.Fatalf("expected only partner servers to be allowed")
+		}
+
+		rec = do(t, http.MethodPut, test.WithJSONBody(t, map[string]interface{}{
+			"denied": []string{""},
+		}))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+		if !fsAPI.IsServerNameAllowed("rooms.partner.test") {
+			t.Fatalf("expected the lists to be unchanged")
+		}
+	})
+}
+
+func TestAdminServerKeys(t *testing.T) {
+	alice := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, rsAPI, caches, nil, true)
+		rsAPI.SetFederationAPI(fsAPI, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, fsAPI, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		do := func(t *testing.T, method, path string) *httptest.ResponseRecorder {
+			t.Helper()
+			req := test.NewRequest(t, method, path)
+			req.Header.Set("Authorization", "Bearer "+accessTokens[alice].accessToken)
+			rec := httptest.NewRecorder()
+			routers.DendriteAdmin.ServeHTTP(rec, req)
+			return rec
+		}
+
+		validUntil := spec.AsTimestamp(time.Now().Add(time.Hour))
+		keys := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			{ServerName: "remote.test", KeyID: "ed25519:new"}: {
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: spec.Base64Bytes("new key")},
+				ValidUntilTS: validUntil,
+			},
+			{ServerName: "remote.test", KeyID: "ed25519:old"}: {
+				VerifyKey: gomatrixserverlib.VerifyKey{Key: spec.Base64Bytes("old key")},
+				ExpiredTS: spec.AsTimestamp(time.Now().Add(-time.Hour)),
+			},
+			{ServerName: "other.test", KeyID: "ed25519:auto"}: {
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: spec.Base64Bytes("other key")},
+				ValidUntilTS: validUntil,
+			},
+		}
+		if err := fsAPI.StoreKeys(ctx, keys); err != nil {
+			t.Fatalf("failed to store keys: %v", err)
+		}
+
+		rec := do(t, http.MethodGet, "/_dendrite/admin/serverKeys?limit=1")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		body := gjson.ParseBytes(rec.Body.Bytes())
+		if total := body.Get("total").Int(); total != 2 {
+			t.Fatalf("expected 2 servers, got %d: %s", total, rec.Body.String())
+		}
+		if serverName := body.Get("servers.0.server_name").Str; serverName != "other.test" {
+			t.Fatalf("expected servers to be sorted, got %s first", serverName)
+		}
+
+		rec = do(t, http.MethodGet, "/_dendrite/admin/serverKeys/remote.test")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		body = gjson.ParseBytes(rec.Body.Bytes())
+		if body.Get("valid_until_ts").Int() != int64(validUntil) || len(body.Get("keys").Array()) != 2 {
+			t.Fatalf("unexpected server keys: %s", rec.Body.String())
+		}
+		if body.Get("keys.0.key_id").Str != "ed25519:new" || !body.Get("keys.0.valid").Bool() || body.Get("keys.1.valid").Bool() {
+			t.Fatalf("unexpected validity of server keys: %s", rec.Body.String())
+		}
+
+		rec = do(t, http.MethodDelete, "/_dendrite/admin/serverKeys/remote.test")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		rec = do(t, http.MethodGet, "/_dendrite/admin/serverKeys/remote.test")
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected evicted keys to return %d, got %d: %s", http.StatusNotFound, rec.Code, rec.Body.String())
+		}
+		// The keys must be gone from the cache as well as from the database.
+		cached, err := fsAPI.KeyRing().KeyDatabase.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{
+			{ServerName: "remote.test", KeyID: "ed25519:new"}: spec.AsTimestamp(time.Now()),
+		})
+		if err != nil || len(cached) != 0 {
+			t.Fatalf("expected evicted keys not to be found, got %v (err %v)", cached, err)
+		}
+		rec = do(t, http.MethodGet, "/_dendrite/admin/serverKeys/other.test")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected the keys of other servers to stay, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
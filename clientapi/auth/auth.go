@@ -37,6 +37,17 @@ type AccountDatabase interface {
 	GetAccountByPassword(ctx context.Context, localpart, password string) (*api.Account, error)
 }
 
+// softLogoutError is returned for expired access tokens, so that clients know
+// to refresh the token instead of logging the user out.
+// https://spec.matrix.org/v1.11/client-server-api/#soft-logout
+type softLogoutError struct {
+	spec.MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+// errorExpiredAccount is returned for requests made with accounts which have expired.
+const errorExpiredAccount spec.MatrixErrorCode = "ORG_MATRIX_EXPIRED_ACCOUNT"
+
 // VerifyUserFromRequest authenticates the HTTP request,
 // on success returns Device of the requester.
 // Finds local user or an application service user.
@@ -73,6 +84,21 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.Expired {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: softLogoutError{
+				MatrixError: spec.UnknownToken("Access token has expired"),
+				SoftLogout:  true,
+			},
+		}
+	}
+	if res.AccountExpired {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.MatrixError{ErrCode: errorExpiredAccount, Err: "User account has expired"},
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
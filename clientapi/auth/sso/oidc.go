@@ -0,0 +1,251 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sso
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// maxResponseSize limits how much is read from identity providers.
+const maxResponseSize = 1 << 20
+
+// oidcDiscovery is the part of the OpenID provider metadata that we need.
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// oidcTokenResponse is the response of the token endpoint.
+// https://openid.net/specs/openid-connect-core-1_0.html#TokenResponse
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+// oidcProvider talks to an OpenID Connect identity provider, using the authorization
+// code flow with PKCE.
+type oidcProvider struct {
+	cfg    *config.IdentityProvider
+	client *http.Client
+
+	discoveryMu sync.Mutex
+	discovery   *oidcDiscovery
+}
+
+func newOIDCProvider(cfg *config.IdentityProvider, client *http.Client) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+// discover returns the provider metadata, fetching it on first use. Failures are
+// not cached, so that an unavailable provider is retried on the next login.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.discoveryMu.Lock()
+	defer p.discoveryMu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	discoveryURL := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var discovery oidcDiscovery
+	if err = p.doJSON(req, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover OpenID configuration: %w", err)
+	}
+	if discovery.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("OpenID configuration is for issuer %q, not %q", discovery.Issuer, p.cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" {
+		return nil, fmt.Errorf("OpenID configuration is missing endpoints")
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// authorizationURL returns the URL which starts logging in at the provider.
+func (p *oidcProvider) authorizationURL(ctx context.Context, callbackURL, state, nonce, codeVerifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", callbackURL)
+	query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// exchangeCode swaps the authorization code for tokens, and returns the claims about
+// the user from the ID token and the userinfo endpoint.
+func (p *oidcProvider) exchangeCode(ctx context.Context, callbackURL, code, nonce, codeVerifier string) (map[string]interface{}, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {callbackURL},
+		"code_verifier": {codeVerifier},
+	}
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		// https://www.rfc-editor.org/rfc/rfc6749#section-2.3.1
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	var token oidcTokenResponse
+	if err = p.doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("identity provider didn't return an ID token")
+	}
+
+	claims, err := p.verifyIDToken(discovery, token.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.UserinfoEndpoint == "" || token.AccessToken == "" {
+		return claims, nil
+	}
+	userinfo, err := p.userinfo(ctx, discovery, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	// https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+	if userinfo["sub"] != claims["sub"] {
+		return nil, fmt.Errorf("userinfo is about a different subject than the ID token")
+	}
+	for k, v := range userinfo {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	return claims, nil
+}
+
+// verifyIDToken checks the claims of an ID token and returns them. The token comes
+// straight from the token endpoint over a connection we made, so the signature needn't
+// be checked, as allowed by
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (p *oidcProvider) verifyIDToken(discovery *oidcDiscovery, idToken, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token: %w", err)
+	}
+	var claims map[string]interface{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token: %w", err)
+	}
+	if claims["iss"] != discovery.Issuer {
+		return nil, fmt.Errorf("ID token was issued by %v", claims["iss"])
+	}
+	if !audienceContains(claims["aud"], p.cfg.ClientID) {
+		return nil, fmt.Errorf("ID token is not meant for this server")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("ID token has the wrong nonce")
+	}
+	return claims, nil
+}
+
+// audienceContains reports whether the "aud" claim, which is either a string or an
+// array of strings, contains the client ID.
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *oidcProvider) userinfo(ctx context.Context, discovery *oidcDiscovery, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	var userinfo map[string]interface{}
+	if err = p.doJSON(req, &userinfo); err != nil {
+		return nil, fmt.Errorf("failed to fetch userinfo: %w", err)
+	}
+	return userinfo, nil
+}
+
+// doJSON performs the request and decodes the JSON response into v.
+func (p *oidcProvider) doJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
+			return fmt.Errorf("HTTP %d: %s %s", resp.StatusCode, errResp.Error, errResp.ErrorDescription)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return json.Unmarshal(body, v)
+}
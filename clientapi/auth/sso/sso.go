@@ -0,0 +1,172 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package sso implements logging in through OpenID Connect identity providers.
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// sessionLifetime is how long users have to log in at the identity provider.
+const sessionLifetime = 10 * time.Minute
+
+var (
+	// ErrUnknownProvider is returned for identity provider IDs which aren't in the config.
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrUnknownSession is returned if a login was never started, has already been
+	// finished or took too long.
+	ErrUnknownSession = errors.New("unknown or expired login session")
+)
+
+// Identity is a user as identified by an identity provider.
+type Identity struct {
+	// The ID of the identity provider in the config
+	IDPID string
+	// The identifier of the user at the identity provider, which never changes
+	Subject string
+	// The localpart that the identity provider suggests for the user, which may be
+	// empty. It is not yet checked for validity.
+	Localpart string
+	// The display name that the identity provider suggests for the user, which may be empty
+	DisplayName string
+}
+
+// session is a login that was started, but hasn't come back from the identity provider yet.
+type session struct {
+	idpID        string
+	redirectURL  string
+	nonce        string
+	codeVerifier string
+	expires      time.Time
+}
+
+// Authenticator logs users in through the identity providers in the config.
+type Authenticator struct {
+	cfg       *config.SSO
+	providers map[string]*oidcProvider
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+}
+
+func NewAuthenticator(cfg *config.SSO, client *http.Client) *Authenticator {
+	a := &Authenticator{
+		cfg:       cfg,
+		providers: make(map[string]*oidcProvider, len(cfg.Providers)),
+		sessions:  map[string]*session{},
+	}
+	for i := range cfg.Providers {
+		p := &cfg.Providers[i]
+		a.providers[p.ID] = newOIDCProvider(p, client)
+	}
+	return a
+}
+
+// StartLogin begins logging a user in through the identity provider, who is sent
+// back to redirectURL in the end. Returns the URL to send the user to, and the state
+// which the login must be finished with. An empty ID picks the default provider.
+func (a *Authenticator) StartLogin(ctx context.Context, idpID, redirectURL string) (authURL, state string, err error) {
+	if idpID == "" {
+		idpID = a.cfg.DefaultProviderID
+	}
+	p, ok := a.providers[idpID]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+	s := &session{
+		idpID:       idpID,
+		redirectURL: redirectURL,
+		expires:     time.Now().Add(sessionLifetime),
+	}
+	if state, err = randomString(); err != nil {
+		return "", "", err
+	}
+	if s.nonce, err = randomString(); err != nil {
+		return "", "", err
+	}
+	if s.codeVerifier, err = randomString(); err != nil {
+		return "", "", err
+	}
+	authURL, err = p.authorizationURL(ctx, a.cfg.CallbackURL, state, s.nonce, s.codeVerifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	now := time.Now()
+	for k, v := range a.sessions {
+		if now.After(v.expires) {
+			delete(a.sessions, k)
+		}
+	}
+	a.sessions[state] = s
+	return authURL, state, nil
+}
+
+// FinishLogin completes the login with the state returned by StartLogin, once the
+// identity provider sent the user back with the given authorization code. Returns
+// who the user is, and the URL that the user wanted to be sent back to.
+func (a *Authenticator) FinishLogin(ctx context.Context, state, code string) (*Identity, string, error) {
+	a.sessionsMu.Lock()
+	s, ok := a.sessions[state]
+	delete(a.sessions, state)
+	a.sessionsMu.Unlock()
+	if !ok || time.Now().After(s.expires) {
+		return nil, "", ErrUnknownSession
+	}
+
+	p := a.providers[s.idpID]
+	claims, err := p.exchangeCode(ctx, a.cfg.CallbackURL, code, s.nonce, s.codeVerifier)
+	if err != nil {
+		return nil, "", err
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, "", fmt.Errorf("identity provider didn't return a subject")
+	}
+	localpart, _ := claims[p.cfg.LocalpartClaim].(string)
+	displayName, _ := claims[p.cfg.DisplayNameClaim].(string)
+	return &Identity{
+		IDPID:       s.idpID,
+		Subject:     subject,
+		Localpart:   MapLocalpart(localpart),
+		DisplayName: displayName,
+	}, s.redirectURL, nil
+}
+
+// MapLocalpart turns a username from an identity provider into a localpart, by
+// lowercasing it and escaping any characters which aren't allowed in user IDs.
+func MapLocalpart(username string) string {
+	var sb strings.Builder
+	for _, b := range []byte(strings.ToLower(username)) {
+		switch {
+		case b >= 'a' && b <= 'z', b >= '0' && b <= '9', strings.IndexByte("._-/+", b) >= 0:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "=%02x", b)
+		}
+	}
+	return sb.String()
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
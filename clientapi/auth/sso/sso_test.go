@@ -0,0 +1,241 @@
+package sso
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+const testCallbackURL = "https://localhost/_matrix/client/v3/login/sso/callback"
+
+// fakeProvider is a minimal OpenID Connect identity provider. Users are logged in
+// without being asked anything, as soon as the authorization URL is visited.
+type fakeProvider struct {
+	*httptest.Server
+	// claims to put in the ID token and to return from the userinfo endpoint
+	idTokenClaims map[string]interface{}
+	userinfo      map[string]interface{}
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorization request
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	p := &fakeProvider{
+		codes: map[string]url.Values{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "dendrite" || clientSecret != "secret" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+		p.mu.Lock()
+		authReq, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+		if !ok || r.PostFormValue("redirect_uri") != authReq.Get("redirect_uri") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(challenge[:]) != authReq.Get("code_challenge") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   p.URL,
+			"aud":   clientID,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": authReq.Get("nonce"),
+		}
+		for k, v := range p.idTokenClaims {
+			claims[k] = v
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"access_token": "access_token",
+			"token_type":   "Bearer",
+			"id_token":     makeIDToken(t, claims),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, p.userinfo)
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize logs the user in at the authorization URL, returning the state and code
+// which the user is sent back to the callback URL with.
+func (p *fakeProvider) authorize(t *testing.T, authURL string) (state, code string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL: %v", err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("redirect_uri") != testCallbackURL {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	code = "code" + query.Get("state")
+	p.mu.Lock()
+	p.codes[code] = query
+	p.mu.Unlock()
+	return query.Get("state"), code
+}
+
+func makeIDToken(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newTestAuthenticator(p *fakeProvider) *Authenticator {
+	cfg := &config.SSO{
+		Enabled:     true,
+		CallbackURL: testCallbackURL,
+		Providers: []config.IdentityProvider{{
+			ID:           "fake",
+			Issuer:       p.URL,
+			ClientID:     "dendrite",
+			ClientSecret: "secret",
+		}},
+	}
+	errs := &config.ConfigErrors{}
+	cfg.Verify(errs)
+	return NewAuthenticator(cfg, p.Client())
+}
+
+func TestLogin(t *testing.T) {
+	p := newFakeProvider(t)
+	p.idTokenClaims = map[string]interface{}{"sub": "1234"}
+	p.userinfo = map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "Alice",
+		"name":               "Alice Liddell",
+	}
+	a := newTestAuthenticator(p)
+	ctx := context.Background()
+
+	authURL, state, err := a.StartLogin(ctx, "", "https://client.example/done")
+	if err != nil {
+		t.Fatalf("failed to start login: %v", err)
+	}
+	gotState, code := p.authorize(t, authURL)
+	if gotState != state {
+		t.Fatalf("expected state %q, got %q", state, gotState)
+	}
+
+	identity, redirectURL, err := a.FinishLogin(ctx, state, code)
+	if err != nil {
+		t.Fatalf("failed to finish login: %v", err)
+	}
+	want := Identity{IDPID: "fake", Subject: "1234", Localpart: "alice", DisplayName: "Alice Liddell"}
+	if *identity != want {
+		t.Fatalf("expected identity %+v, got %+v", want, *identity)
+	}
+	if redirectURL != "https://client.example/done" {
+		t.Fatalf("unexpected redirect URL %q", redirectURL)
+	}
+
+	// The login can only be finished once.
+	if _, _, err = a.FinishLogin(ctx, state, code); !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession when finishing twice, got %v", err)
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	p := newFakeProvider(t)
+	p.idTokenClaims = map[string]interface{}{"sub": "1234", "preferred_username": "alice"}
+	a := newTestAuthenticator(p)
+	ctx := context.Background()
+
+	if _, _, err := a.StartLogin(ctx, "unknown", "https://client.example"); !errors.Is(err, ErrUnknownProvider) {
+		t.Fatalf("expected ErrUnknownProvider, got %v", err)
+	}
+	if _, _, err := a.FinishLogin(ctx, "unknown", "code"); !errors.Is(err, ErrUnknownSession) {
+		t.Fatalf("expected ErrUnknownSession, got %v", err)
+	}
+
+	// an ID token from another login session
+	p.idTokenClaims["nonce"] = "wrong"
+	authURL, state, err := a.StartLogin(ctx, "fake", "https://client.example")
+	if err != nil {
+		t.Fatalf("failed to start login: %v", err)
+	}
+	_, code := p.authorize(t, authURL)
+	if _, _, err = a.FinishLogin(ctx, state, code); err == nil {
+		t.Fatalf("expected an ID token with the wrong nonce to be rejected")
+	}
+	delete(p.idTokenClaims, "nonce")
+
+	// an ID token meant for somebody else
+	p.idTokenClaims["aud"] = "someone-else"
+	authURL, state, err = a.StartLogin(ctx, "fake", "https://client.example")
+	if err != nil {
+		t.Fatalf("failed to start login: %v", err)
+	}
+	_, code = p.authorize(t, authURL)
+	if _, _, err = a.FinishLogin(ctx, state, code); err == nil {
+		t.Fatalf("expected an ID token for another audience to be rejected")
+	}
+	delete(p.idTokenClaims, "aud")
+
+	// userinfo about a different user
+	p.userinfo = map[string]interface{}{"sub": "5678"}
+	authURL, state, err = a.StartLogin(ctx, "fake", "https://client.example")
+	if err != nil {
+		t.Fatalf("failed to start login: %v", err)
+	}
+	_, code = p.authorize(t, authURL)
+	if _, _, err = a.FinishLogin(ctx, state, code); err == nil {
+		t.Fatalf("expected userinfo about another subject to be rejected")
+	}
+}
+
+func TestMapLocalpart(t *testing.T) {
+	tests := map[string]string{
+		"alice":           "alice",
+		"Alice.Liddell":   "alice.liddell",
+		"alice@example":   "alice=40example",
+		"a b":             "a=20b",
+		"under_score-1/+": "under_score-1/+",
+		"ä":               "=c3=a4",
+	}
+	for username, want := range tests {
+		if got := MapLocalpart(username); got != want {
+			t.Errorf("MapLocalpart(%q): expected %q, got %q", username, want, got)
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/ike20013/dendrite/clientapi/api"
 	"github.com/ike20013/dendrite/clientapi/producers"
 	"github.com/ike20013/dendrite/clientapi/routing"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/transactions"
 	federationAPI "github.com/ike20013/dendrite/federationapi/api"
 	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
@@ -36,7 +37,8 @@ func AddPublicRoutes(
 	fsAPI federationAPI.ClientFederationAPI,
 	userAPI userapi.ClientUserAPI,
 	userDirectoryProvider userapi.QuerySearchProfilesAPI,
-	extRoomsProvider api.ExtraPublicRoomsProvider, enableMetrics bool,
+	extRoomsProvider api.ExtraPublicRoomsProvider,
+	spamChecker spamcheck.Checker, enableMetrics bool,
 ) {
 	js, natsClient := natsInstance.Prepare(processContext, &cfg.Global.JetStream)
 
@@ -51,10 +53,10 @@ func AddPublicRoutes(
 	}
 
 	routing.Setup(
-		routers,
+		processContext, routers,
 		cfg, rsAPI, asAPI,
 		userAPI, userDirectoryProvider, federation,
 		syncProducer, transactionsCache, fsAPI,
-		extRoomsProvider, natsClient, enableMetrics,
+		extRoomsProvider, spamChecker, natsClient, enableMetrics,
 	)
 }
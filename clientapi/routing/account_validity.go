@@ -0,0 +1,143 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	appserviceAPI "github.com/ike20013/dendrite/appservice/api"
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/setup/config"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+)
+
+// accountExpiryNoticeInterval is how often to look for accounts which are about to expire.
+const accountExpiryNoticeInterval = time.Hour
+
+// AdminSetAccountValidity implements POST /_synapse/admin/v1/account_validity/validity
+// https://element-hq.github.io/synapse/latest/admin_api/account_validity.html
+func AdminSetAccountValidity(req *http.Request, cfg *config.ClientAPI, cfgValidity *config.AccountValidity, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	if !cfgValidity.Enabled() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("Account validity is not enabled on this server"),
+		}
+	}
+	request := struct {
+		UserID       string `json:"user_id"`
+		ExpirationTS int64  `json:"expiration_ts"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	userID, resErr := localUserFromPath(cfg, request.UserID)
+	if resErr != nil {
+		return *resErr
+	}
+	if request.ExpirationTS < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("expiration_ts must not be negative"),
+		}
+	}
+	acc, err := getAdminAccount(req.Context(), userAPI, *userID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if acc == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("User not found"),
+		}
+	}
+
+	res := &userapi.PerformAccountValidityRenewalResponse{}
+	if err = userAPI.PerformAccountValidityRenewal(req.Context(), &userapi.PerformAccountValidityRenewalRequest{
+		Localpart:    userID.Local(),
+		ServerName:   userID.Domain(),
+		ExpirationTS: spec.Timestamp(request.ExpirationTS),
+	}, res); err != nil {
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]int64{
+			"expiration_ts": int64(res.ExpirationTS),
+		},
+	}
+}
+
+// sendAccountExpiryNotices periodically warns users with a server notice that their
+// account is about to expire. Each user is warned once per expiry.
+func sendAccountExpiryNotices(
+	ctx context.Context,
+	cfg *config.ClientAPI,
+	cfgValidity *config.AccountValidity,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+) {
+	for {
+		res := &userapi.QueryExpiringAccountsResponse{}
+		err := userAPI.QueryExpiringAccounts(ctx, &userapi.QueryExpiringAccountsRequest{
+			Before: spec.AsTimestamp(time.Now().Add(cfgValidity.RenewAt)),
+		}, res)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to query accounts which are about to expire")
+		}
+		for _, account := range res.Accounts {
+			if err = sendAccountExpiryNotice(ctx, cfg, cfgValidity, userAPI, rsAPI, asAPI, senderDevice, account); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"localpart":   account.Localpart,
+					"server_name": account.ServerName,
+				}).Error("Failed to warn user that their account is about to expire")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(accountExpiryNoticeInterval):
+		}
+	}
+}
+
+func sendAccountExpiryNotice(
+	ctx context.Context,
+	cfg *config.ClientAPI,
+	cfgValidity *config.AccountValidity,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+	account userapi.AccountValidity,
+) error {
+	userID, err := spec.NewUserID("@"+account.Localpart+":"+string(account.ServerName), true)
+	if err != nil {
+		return err
+	}
+	expiry := account.ExpirationTS.Time().UTC().Format("2 January 2006 15:04 MST")
+	body := strings.Replace(cfgValidity.NoticeMessage, "%s", expiry, 1)
+	if err = sendServerNoticeMessage(ctx, &cfg.Matrix.ServerNotices, cfg, userAPI, rsAPI, asAPI, senderDevice, *userID, body); err != nil {
+		return err
+	}
+	return userAPI.PerformAccountExpiryNoticeSent(ctx, &userapi.PerformAccountExpiryNoticeSentRequest{
+		Localpart:  account.Localpart,
+		ServerName: account.ServerName,
+	}, &struct{}{})
+}
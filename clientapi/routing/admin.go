@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -328,6 +329,127 @@ func AdminPurgeRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI)
 	}
 }
 
+// AdminRedactUser starts redacting the events sent by a user. The redactions
+// happen in the background, use AdminRedactUserStatus to follow the progress.
+func AdminRedactUser(req *http.Request, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID, err := spec.NewUserID(vars["userID"], true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	adminUserID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	request := struct {
+		Rooms   []string       `json:"rooms"`
+		Reason  string         `json:"reason"`
+		SinceTS spec.Timestamp `json:"since_ts"`
+		UntilTS spec.Timestamp `json:"until_ts"`
+	}{}
+	// The body is optional, without one all events of the user are redacted.
+	if req.Body != nil {
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil && err != io.EOF {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+			}
+		}
+	}
+	if request.UntilTS != 0 && request.UntilTS <= request.SinceTS {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("until_ts must be after since_ts"),
+		}
+	}
+	for _, roomID := range request.Rooms {
+		if _, err = spec.NewRoomID(roomID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(fmt.Sprintf("invalid room ID %q", roomID)),
+			}
+		}
+	}
+
+	redactID, err := rsAPI.PerformAdminRedactUser(req.Context(), &roomserverAPI.PerformAdminRedactUserRequest{
+		UserID:      *userID,
+		AdminUserID: *adminUserID,
+		RoomIDs:     request.Rooms,
+		Since:       request.SinceTS,
+		Until:       request.UntilTS,
+		Reason:      request.Reason,
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("userID", userID.String()).Error("Failed to redact user")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"redact_id": redactID,
+		},
+	}
+}
+
+// AdminRedactUserStatus returns the progress of a job started by AdminRedactUser.
+func AdminRedactUserStatus(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	job, err := rsAPI.QueryAdminRedactUserJob(req.Context(), vars["redactID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if job == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Redaction job not found"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: job,
+	}
+}
+
+// AdminPolicyRules lists the policy list rules which the server enforces, either
+// all of them or only those from the policy room in the URL.
+func AdminPolicyRules(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	rules, err := rsAPI.QueryPolicyRules(req.Context(), vars["roomID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Rules []roomserverAPI.PolicyRule `json:"rules"`
+		}{rules},
+	}
+}
+
 func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
 	if req.Body == nil {
 		return util.JSONResponse{
@@ -408,6 +530,58 @@ func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.De
 	}
 }
 
+// AdminShadowBanUser shadow-bans a local user with POST, and lifts the ban with DELETE.
+func AdminShadowBanUser(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID := vars["userID"]
+	localpart, serverName, err := cfg.Matrix.SplitLocalID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	accAvailableResp := &api.QueryAccountAvailabilityResponse{}
+	if err = userAPI.QueryAccountAvailability(req.Context(), &api.QueryAccountAvailabilityRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, accAvailableResp); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if accAvailableResp.Available {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.Unknown("User does not exist"),
+		}
+	}
+
+	shadowBanned := req.Method == http.MethodPost
+	if err = userAPI.PerformAccountShadowBan(req.Context(), &api.PerformAccountShadowBanRequest{
+		Localpart:    localpart,
+		ServerName:   serverName,
+		ShadowBanned: shadowBanned,
+	}, &struct{}{}); err != nil {
+		logrus.WithError(err).WithField("userID", userID).Error("Failed to update shadow-ban")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"shadow_banned": shadowBanned,
+		},
+	}
+}
+
 func AdminReindex(req *http.Request, cfg *config.ClientAPI, device *api.Device, natsClient *nats.Conn) util.JSONResponse {
 	_, err := natsClient.RequestMsg(nats.NewMsg(cfg.Matrix.JetStream.Prefixed(jetstream.InputFulltextReindex)), time.Second*10)
 	if err != nil {
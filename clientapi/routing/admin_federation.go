@@ -0,0 +1,360 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+
+	federationAPI "github.com/ike20013/dendrite/federationapi/api"
+)
+
+// adminDestination is a remote server as returned by the federation admin APIs.
+type adminDestination struct {
+	Destination         string            `json:"destination"`
+	FailureCount        uint32            `json:"failure_count"`
+	BackoffUntil        *spec.Timestamp   `json:"backoff_until"`
+	Blacklisted         bool              `json:"blacklisted"`
+	AssumedOffline      bool              `json:"assumed_offline"`
+	RelayServers        []spec.ServerName `json:"relay_servers"`
+	PendingPDUs         int64             `json:"pending_pdus"`
+	PendingEDUs         int64             `json:"pending_edus"`
+	RetryingTransaction bool              `json:"retrying_transaction"`
+}
+
+func toAdminDestination(d *federationAPI.FederationDestination) adminDestination {
+	destination := adminDestination{
+		Destination:         string(d.ServerName),
+		FailureCount:        d.FailureCount,
+		Blacklisted:         d.Blacklisted,
+		AssumedOffline:      d.AssumedOffline,
+		RelayServers:        d.RelayServers,
+		PendingPDUs:         d.PendingPDUs,
+		PendingEDUs:         d.PendingEDUs,
+		RetryingTransaction: d.RetryingTransaction,
+	}
+	if destination.RelayServers == nil {
+		destination.RelayServers = []spec.ServerName{}
+	}
+	if d.BackoffUntil != nil {
+		until := spec.AsTimestamp(*d.BackoffUntil)
+		destination.BackoffUntil = &until
+	}
+	return destination
+}
+
+// AdminListFederationDestinations lists the servers we have talked to or have
+// something queued for. They can be filtered by a part of the server name.
+func AdminListFederationDestinations(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+	from := parseUint64OrDefault(query.Get("from"), 0)
+	limit := parseUint64OrDefault(query.Get("limit"), 100)
+	dir := query.Get("dir")
+	if dir != "" && dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Unknown value for dir"),
+		}
+	}
+	filter := strings.ToLower(query.Get("destination"))
+
+	destinations, err := fsAPI.QueryFederationDestinations(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to get federation destinations")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	matching := make([]adminDestination, 0, len(destinations))
+	for i := range destinations {
+		if filter != "" && !strings.Contains(strings.ToLower(string(destinations[i].ServerName)), filter) {
+			continue
+		}
+		matching = append(matching, toAdminDestination(&destinations[i]))
+	}
+	if dir == "b" {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+	}
+
+	total := uint64(len(matching))
+	start := min(from, total)
+	end := min(start+limit, total)
+	res := map[string]interface{}{
+		"destinations": matching[start:end],
+		"total":        total,
+	}
+	if end < total {
+		res["next_token"] = strconv.FormatUint(end, 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetFederationDestination returns what we know about sending to a single server.
+func AdminGetFederationDestination(req *http.Request, fsAPI federationAPI.ClientFederationAPI, serverName string) util.JSONResponse {
+	ctx := req.Context()
+	destination, err := fsAPI.QueryFederationDestination(ctx, spec.ServerName(serverName))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("destination", serverName).Error("Failed to get federation destination")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if destination == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown destination"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: toAdminDestination(destination),
+	}
+}
+
+// AdminResetFederationDestination clears the backoff and blacklisting of a server,
+// so that we start sending to it again straight away.
+func AdminResetFederationDestination(req *http.Request, fsAPI federationAPI.ClientFederationAPI, serverName string) util.JSONResponse {
+	ctx := req.Context()
+	if err := fsAPI.PerformResetFederationDestination(ctx, spec.ServerName(serverName)); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("destination", serverName).Error("Failed to reset federation destination")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminPurgeFederationQueue drops everything waiting to be sent to a server. The
+// server may then miss events, so this is meant for servers which are gone for good.
+func AdminPurgeFederationQueue(req *http.Request, fsAPI federationAPI.ClientFederationAPI, serverName string) util.JSONResponse {
+	ctx := req.Context()
+	if err := fsAPI.PerformPurgeFederationQueue(ctx, spec.ServerName(serverName)); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("destination", serverName).Error("Failed to purge federation queue")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminGetFederationDomains returns the patterns of the server names we federate with or not.
+func AdminGetFederationDomains(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	ctx := req.Context()
+	lists, err := fsAPI.QueryFederationDomainLists(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to get federation domain lists")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: lists,
+	}
+}
+
+// AdminSetFederationDomains replaces the allowed and denied server name patterns.
+// The change takes effect immediately but isn't persisted, so the configuration
+// file should be updated as well.
+func AdminSetFederationDomains(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	ctx := req.Context()
+	var lists federationAPI.FederationDomainLists
+	if err := json.NewDecoder(req.Body).Decode(&lists); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	for _, pattern := range append(append([]string{}, lists.Allowed...), lists.Denied...) {
+		if strings.TrimSpace(pattern) == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("Server name patterns must not be empty"),
+			}
+		}
+	}
+	if lists.Allowed == nil {
+		lists.Allowed = []string{}
+	}
+	if lists.Denied == nil {
+		lists.Denied = []string{}
+	}
+	if err := fsAPI.PerformSetFederationDomainLists(ctx, &lists); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to set federation domain lists")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: lists,
+	}
+}
+
+// adminServerKey is a signing key of a remote server as returned by the server key admin APIs.
+type adminServerKey struct {
+	KeyID        gomatrixserverlib.KeyID `json:"key_id"`
+	PublicKey    spec.Base64Bytes        `json:"public_key"`
+	ValidUntilTS spec.Timestamp          `json:"valid_until_ts"`
+	ExpiredTS    spec.Timestamp          `json:"expired_ts,omitempty"`
+	Valid        bool                    `json:"valid"`
+}
+
+// adminServerKeys are the signing keys we hold for a remote server. ValidUntilTS
+// is the latest validity of any of them.
+type adminServerKeys struct {
+	ServerName   spec.ServerName  `json:"server_name"`
+	ValidUntilTS spec.Timestamp   `json:"valid_until_ts"`
+	Keys         []adminServerKey `json:"keys"`
+}
+
+// toAdminServerKeys groups the keys, which must be sorted by server name, by server.
+func toAdminServerKeys(keys []federationAPI.ServerSigningKey) []adminServerKeys {
+	now := spec.AsTimestamp(time.Now())
+	var servers []adminServerKeys
+	for _, key := range keys {
+		if len(servers) == 0 || servers[len(servers)-1].ServerName != key.ServerName {
+			servers = append(servers, adminServerKeys{ServerName: key.ServerName})
+		}
+		server := &servers[len(servers)-1]
+		server.Keys = append(server.Keys, adminServerKey{
+			KeyID:        key.KeyID,
+			PublicKey:    key.PublicKey,
+			ValidUntilTS: key.ValidUntilTS,
+			ExpiredTS:    key.ExpiredTS,
+			Valid:        key.ExpiredTS == 0 && key.ValidUntilTS > now,
+		})
+		server.ValidUntilTS = max(server.ValidUntilTS, key.ValidUntilTS)
+	}
+	return servers
+}
+
+// AdminListServerKeys lists the remote servers whose signing keys we hold, along
+// with the keys. They can be filtered by a part of the server name.
+func AdminListServerKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+	from := parseUint64OrDefault(query.Get("from"), 0)
+	limit := parseUint64OrDefault(query.Get("limit"), 100)
+	filter := strings.ToLower(query.Get("server_name"))
+
+	keys, err := fsAPI.QueryServerSigningKeys(ctx, "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to get server keys")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	servers := toAdminServerKeys(keys)
+	matching := make([]adminServerKeys, 0, len(servers))
+	for _, server := range servers {
+		if filter != "" && !strings.Contains(strings.ToLower(string(server.ServerName)), filter) {
+			continue
+		}
+		matching = append(matching, server)
+	}
+
+	total := uint64(len(matching))
+	start := min(from, total)
+	end := min(start+limit, total)
+	res := map[string]interface{}{
+		"servers": matching[start:end],
+		"total":   total,
+	}
+	if end < total {
+		res["next_token"] = strconv.FormatUint(end, 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetServerKeys returns the signing keys we hold for a remote server.
+func AdminGetServerKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI, serverName string) util.JSONResponse {
+	ctx := req.Context()
+	keys, err := fsAPI.QueryServerSigningKeys(ctx, spec.ServerName(serverName))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Error("Failed to get server keys")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return serverKeysResponse(keys)
+}
+
+// AdminEvictServerKeys forgets the signing keys of a remote server, so that they
+// are fetched again when they are next needed.
+func AdminEvictServerKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI, serverName string) util.JSONResponse {
+	ctx := req.Context()
+	if err := fsAPI.PerformEvictServerSigningKeys(ctx, spec.ServerName(serverName)); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Error("Failed to evict server keys")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminRefetchServerKeys fetches the signing keys we hold for a remote server
+// again, and returns them.
+func AdminRefetchServerKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI, serverName string) util.JSONResponse {
+	ctx := req.Context()
+	keys, err := fsAPI.PerformRefetchServerSigningKeys(ctx, spec.ServerName(serverName))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Error("Failed to refetch server keys")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown("Failed to fetch the keys of the server"),
+		}
+	}
+	return serverKeysResponse(keys)
+}
+
+func serverKeysResponse(keys []federationAPI.ServerSigningKey) util.JSONResponse {
+	servers := toAdminServerKeys(keys)
+	if len(servers) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("No keys held for the server"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: servers[0],
+	}
+}
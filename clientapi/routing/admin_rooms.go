@@ -0,0 +1,648 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	appserviceAPI "github.com/ike20013/dendrite/appservice/api"
+	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/syncapi/synctypes"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+)
+
+// adminRoom is a room as returned by the room admin APIs, using the same fields as Synapse.
+type adminRoom struct {
+	RoomID             string `json:"room_id"`
+	Name               string `json:"name"`
+	CanonicalAlias     string `json:"canonical_alias"`
+	JoinedMembers      int    `json:"joined_members"`
+	JoinedLocalMembers int    `json:"joined_local_members"`
+	Version            string `json:"version"`
+	Creator            string `json:"creator"`
+	Encryption         string `json:"encryption"`
+	Federatable        bool   `json:"federatable"`
+	Public             bool   `json:"public"`
+	JoinRules          string `json:"join_rules"`
+	GuestAccess        string `json:"guest_access"`
+	HistoryVisibility  string `json:"history_visibility"`
+}
+
+type adminRoomDetails struct {
+	adminRoom
+	Topic   string `json:"topic"`
+	Avatar  string `json:"avatar"`
+	Blocked bool   `json:"blocked"`
+}
+
+var adminRoomStateTuples = []gomatrixserverlib.StateKeyTuple{
+	{EventType: spec.MRoomCreate},
+	{EventType: spec.MRoomName},
+	{EventType: spec.MRoomCanonicalAlias},
+	{EventType: spec.MRoomJoinRules},
+	{EventType: spec.MRoomGuestAccess},
+	{EventType: spec.MRoomHistoryVisibility},
+	{EventType: spec.MRoomEncryption},
+	{EventType: spec.MRoomTopic},
+	{EventType: spec.MRoomAvatar},
+}
+
+// getAdminRoom returns the details of the room, or nil if the server doesn't know about it.
+func getAdminRoom(ctx context.Context, rsAPI roomserverAPI.ClientRoomserverAPI, roomID spec.RoomID) (*adminRoomDetails, error) {
+	roomInfo, err := rsAPI.QueryRoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, nil
+	}
+	stateRes := &roomserverAPI.QueryCurrentStateResponse{}
+	if err := rsAPI.QueryCurrentState(ctx, &roomserverAPI.QueryCurrentStateRequest{
+		RoomID:      roomID.String(),
+		StateTuples: adminRoomStateTuples,
+	}, stateRes); err != nil {
+		return nil, err
+	}
+	createEvent := stateRes.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomCreate}]
+	if createEvent == nil {
+		return nil, nil
+	}
+	contentString := func(eventType, path string) string {
+		event := stateRes.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: eventType}]
+		if event == nil {
+			return ""
+		}
+		return gjson.GetBytes(event.Content(), path).Str
+	}
+
+	room := &adminRoomDetails{
+		adminRoom: adminRoom{
+			RoomID:            roomID.String(),
+			Name:              contentString(spec.MRoomName, "name"),
+			CanonicalAlias:    contentString(spec.MRoomCanonicalAlias, "alias"),
+			Version:           string(createEvent.Version()),
+			Encryption:        contentString(spec.MRoomEncryption, "algorithm"),
+			Federatable:       true,
+			JoinRules:         contentString(spec.MRoomJoinRules, "join_rule"),
+			GuestAccess:       contentString(spec.MRoomGuestAccess, "guest_access"),
+			HistoryVisibility: contentString(spec.MRoomHistoryVisibility, "history_visibility"),
+		},
+		Topic:  contentString(spec.MRoomTopic, "topic"),
+		Avatar: contentString(spec.MRoomAvatar, "url"),
+	}
+	if federate := gjson.GetBytes(createEvent.Content(), "m\\.federate"); federate.Exists() {
+		room.Federatable = federate.Bool()
+	}
+	if creator, err := rsAPI.QueryUserIDForSender(ctx, roomID, createEvent.SenderID()); err == nil && creator != nil {
+		room.Creator = creator.String()
+	}
+
+	membersRes := &roomserverAPI.QueryMembershipsForRoomResponse{}
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &roomserverAPI.QueryMembershipsForRoomRequest{
+		RoomID:     roomID.String(),
+		JoinedOnly: true,
+	}, membersRes); err != nil {
+		return nil, err
+	}
+	room.JoinedMembers = len(membersRes.JoinEvents)
+	localMembersRes := &roomserverAPI.QueryMembershipsForRoomResponse{}
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &roomserverAPI.QueryMembershipsForRoomRequest{
+		RoomID:     roomID.String(),
+		JoinedOnly: true,
+		LocalOnly:  true,
+	}, localMembersRes); err != nil {
+		return nil, err
+	}
+	room.JoinedLocalMembers = len(localMembersRes.JoinEvents)
+
+	publishedRes := &roomserverAPI.QueryPublishedRoomsResponse{}
+	if err := rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{RoomID: roomID.String()}, publishedRes); err != nil {
+		return nil, err
+	}
+	room.Public = len(publishedRes.RoomIDs) > 0
+
+	if _, room.Blocked, err = rsAPI.QueryAdminRoomBlocked(ctx, roomID); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// adminRoomFromPath returns the room named in the request path, or an error response
+// if the room ID is invalid or the server doesn't know about the room.
+func adminRoomFromPath(ctx context.Context, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string) (*spec.RoomID, *adminRoomDetails, *util.JSONResponse) {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+	room, err := getAdminRoom(ctx, rsAPI, *validRoomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("Failed to get room details")
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if room == nil {
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Room not found"),
+		}
+	}
+	return validRoomID, room, nil
+}
+
+var adminRoomOrderings = map[string]func(a, b *adminRoomDetails) bool{
+	"name":                 func(a, b *adminRoomDetails) bool { return a.Name < b.Name },
+	"canonical_alias":      func(a, b *adminRoomDetails) bool { return a.CanonicalAlias < b.CanonicalAlias },
+	"joined_members":       func(a, b *adminRoomDetails) bool { return a.JoinedMembers > b.JoinedMembers },
+	"joined_local_members": func(a, b *adminRoomDetails) bool { return a.JoinedLocalMembers > b.JoinedLocalMembers },
+	"version":              func(a, b *adminRoomDetails) bool { return a.Version > b.Version },
+	"creator":              func(a, b *adminRoomDetails) bool { return a.Creator < b.Creator },
+	"encryption":           func(a, b *adminRoomDetails) bool { return a.Encryption < b.Encryption },
+	"federatable":          func(a, b *adminRoomDetails) bool { return a.Federatable && !b.Federatable },
+	"public":               func(a, b *adminRoomDetails) bool { return a.Public && !b.Public },
+	"join_rules":           func(a, b *adminRoomDetails) bool { return a.JoinRules < b.JoinRules },
+	"guest_access":         func(a, b *adminRoomDetails) bool { return a.GuestAccess < b.GuestAccess },
+	"history_visibility":   func(a, b *adminRoomDetails) bool { return a.HistoryVisibility < b.HistoryVisibility },
+}
+
+// AdminListRooms lists the rooms known to the server. Rooms can be filtered by a
+// search term matching the room ID, name or canonical alias, and ordered by most
+// of the returned fields, with the number-like fields ordered largest first.
+func AdminListRooms(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+	from := parseUint64OrDefault(query.Get("from"), 0)
+	limit := parseUint64OrDefault(query.Get("limit"), 100)
+	orderBy := query.Get("order_by")
+	if orderBy == "" {
+		orderBy = "name"
+	}
+	less, ok := adminRoomOrderings[orderBy]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Unknown value for order_by"),
+		}
+	}
+	dir := query.Get("dir")
+	if dir != "" && dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Unknown value for dir"),
+		}
+	}
+	searchTerm := strings.ToLower(query.Get("search_term"))
+
+	roomIDs, err := rsAPI.QueryAdminRoomIDs(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to get room IDs")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	rooms := make([]*adminRoomDetails, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		validRoomID, err := spec.NewRoomID(roomID)
+		if err != nil {
+			continue
+		}
+		room, err := getAdminRoom(ctx, rsAPI, *validRoomID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("Failed to get room details")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if room == nil {
+			continue
+		}
+		if searchTerm != "" &&
+			!strings.Contains(strings.ToLower(room.RoomID), searchTerm) &&
+			!strings.Contains(strings.ToLower(room.Name), searchTerm) &&
+			!strings.Contains(strings.ToLower(room.CanonicalAlias), searchTerm) {
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+
+	sort.SliceStable(rooms, func(i, j int) bool {
+		if dir == "b" {
+			i, j = j, i
+		}
+		if less(rooms[i], rooms[j]) {
+			return true
+		}
+		if less(rooms[j], rooms[i]) {
+			return false
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+
+	total := uint64(len(rooms))
+	start := min(from, total)
+	end := min(start+limit, total)
+	page := make([]adminRoom, 0, end-start)
+	for _, room := range rooms[start:end] {
+		page = append(page, room.adminRoom)
+	}
+	res := map[string]interface{}{
+		"rooms":       page,
+		"offset":      start,
+		"total_rooms": total,
+	}
+	if end < total {
+		res["next_batch"] = end
+	}
+	if start > 0 {
+		res["prev_batch"] = start - min(start, limit)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetRoom returns the details of a room.
+func AdminGetRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string) util.JSONResponse {
+	_, room, resErr := adminRoomFromPath(req.Context(), rsAPI, roomID)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: room,
+	}
+}
+
+// AdminGetRoomMembers returns the users who are joined to a room.
+func AdminGetRoomMembers(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string) util.JSONResponse {
+	ctx := req.Context()
+	validRoomID, _, resErr := adminRoomFromPath(ctx, rsAPI, roomID)
+	if resErr != nil {
+		return *resErr
+	}
+	membersRes := &roomserverAPI.QueryMembershipsForRoomResponse{}
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &roomserverAPI.QueryMembershipsForRoomRequest{
+		RoomID:     validRoomID.String(),
+		JoinedOnly: true,
+	}, membersRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to query room members")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	members := make([]string, 0, len(membersRes.JoinEvents))
+	for _, event := range membersRes.JoinEvents {
+		if event.StateKey != nil {
+			members = append(members, *event.StateKey)
+		}
+	}
+	sort.Strings(members)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"members": members,
+			"total":   len(members),
+		},
+	}
+}
+
+// AdminGetRoomState returns the current state events of a room.
+func AdminGetRoomState(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string) util.JSONResponse {
+	ctx := req.Context()
+	validRoomID, _, resErr := adminRoomFromPath(ctx, rsAPI, roomID)
+	if resErr != nil {
+		return *resErr
+	}
+	stateRes := &roomserverAPI.QueryLatestEventsAndStateResponse{}
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: validRoomID.String(),
+	}, stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to query room state")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	stateEvents := make([]gomatrixserverlib.PDU, 0, len(stateRes.StateEvents))
+	for _, event := range stateRes.StateEvents {
+		stateEvents = append(stateEvents, event.PDU)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"state": synctypes.ToClientEvents(stateEvents, synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+				return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+			}),
+		},
+	}
+}
+
+// AdminGetRoomBlock returns whether local users are blocked from joining a room.
+// Rooms can be blocked before the server knows about them.
+func AdminGetRoomBlock(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string) util.JSONResponse {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+	blockedBy, blocked, err := rsAPI.QueryAdminRoomBlocked(req.Context(), *validRoomID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	res := map[string]interface{}{
+		"block": blocked,
+	}
+	if blocked {
+		res["user_id"] = blockedBy
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminBlockRoom blocks or unblocks local users from joining a room.
+func AdminBlockRoom(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string) util.JSONResponse {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+	request := struct {
+		Block *bool `json:"block"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil || request.Block == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Expected a boolean 'block' in the request body"),
+		}
+	}
+	admin, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if err = rsAPI.PerformAdminBlockRoom(req.Context(), *validRoomID, *admin, *request.Block); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Error("Failed to block room")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"block": *request.Block,
+		},
+	}
+}
+
+// AdminMakeRoomAdmin gives a local user, by default the requesting admin, the highest
+// power level of the local members of a room, and invites them if they can't join it.
+func AdminMakeRoomAdmin(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string) util.JSONResponse {
+	ctx := req.Context()
+	validRoomID, room, resErr := adminRoomFromPath(ctx, rsAPI, roomID)
+	if resErr != nil {
+		return *resErr
+	}
+	request := struct {
+		UserID string `json:"user_id"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	if request.UserID == "" {
+		request.UserID = device.UserID
+	}
+	userID, err := spec.NewUserID(request.UserID, true)
+	if err != nil || !cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Only local users can be made room admins"),
+		}
+	}
+
+	granter, err := rsAPI.PerformAdminMakeRoomAdmin(ctx, *validRoomID, *userID)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Error("Failed to make user room admin")
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown(err.Error()),
+		}
+	}
+
+	// The user can join public rooms themselves, otherwise invite them.
+	if room.JoinRules != spec.Public && granter.String() != userID.String() {
+		membershipRes := &roomserverAPI.QueryMembershipForUserResponse{}
+		if err = rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+			RoomID: validRoomID.String(),
+			UserID: *userID,
+		}, membershipRes); err != nil {
+			return util.ErrorResponse(err)
+		}
+		if !membershipRes.IsInRoom && membershipRes.Membership != spec.Invite {
+			res, err := sendInvite(ctx, &userapi.Device{UserID: granter.String()}, validRoomID.String(), userID.String(), "", cfg, rsAPI, time.Now())
+			if err != nil {
+				return res
+			}
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminDeleteRoom shuts down a room: local users are removed from it and, if
+// requested, moved to a new room with an explanation, and the room is optionally
+// blocked and purged from the database.
+func AdminDeleteRoom(
+	req *http.Request, cfg *config.ClientAPI, device *userapi.Device,
+	rsAPI roomserverAPI.ClientRoomserverAPI, userAPI userapi.ClientUserAPI, asAPI appserviceAPI.AppServiceInternalAPI,
+	roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	validRoomID, _, resErr := adminRoomFromPath(ctx, rsAPI, roomID)
+	if resErr != nil {
+		return *resErr
+	}
+	request := struct {
+		NewRoomUserID string `json:"new_room_user_id"`
+		RoomName      string `json:"room_name"`
+		Message       string `json:"message"`
+		Block         bool   `json:"block"`
+		Purge         *bool  `json:"purge"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	logger := util.GetLogger(ctx).WithField("room_id", roomID)
+
+	var newRoomUser *userapi.Device
+	if request.NewRoomUserID != "" {
+		newRoomUserID, err := spec.NewUserID(request.NewRoomUserID, true)
+		if err != nil || !cfg.Matrix.IsLocalServerName(newRoomUserID.Domain()) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("new_room_user_id must be a local user"),
+			}
+		}
+		newRoomUser = &userapi.Device{UserID: newRoomUserID.String()}
+	}
+
+	if request.Block {
+		admin, err := spec.NewUserID(device.UserID, true)
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		if err = rsAPI.PerformAdminBlockRoom(ctx, *validRoomID, *admin, true); err != nil {
+			logger.WithError(err).Error("Failed to block room")
+			return util.ErrorResponse(err)
+		}
+	}
+
+	var newRoomID string
+	if newRoomUser != nil {
+		if request.RoomName == "" {
+			request.RoomName = "Content Violation Notification"
+		}
+		if request.Message == "" {
+			request.Message = "Sharing illegal content on this server is not permitted and rooms in violation will be blocked."
+		}
+		createRes := createRoom(ctx, createRoomRequest{
+			Name:                      request.RoomName,
+			Preset:                    spec.PresetPublicChat,
+			PowerLevelContentOverride: json.RawMessage(`{"users_default":-10}`),
+		}, newRoomUser, cfg, userAPI, rsAPI, asAPI, time.Now())
+		created, ok := createRes.JSON.(createRoomResponse)
+		if !ok {
+			return createRes
+		}
+		newRoomID = created.RoomID
+
+		event, errRes := generateSendEvent(ctx, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    request.Message,
+		}, newRoomUser, newRoomID, "m.room.message", nil, rsAPI, time.Now())
+		if errRes != nil {
+			return *errRes
+		}
+		if err := roomserverAPI.SendEvents(
+			ctx, rsAPI, roomserverAPI.KindNew,
+			[]*types.HeaderedEvent{{PDU: event}},
+			newRoomUser.UserDomain(), cfg.Matrix.ServerName, cfg.Matrix.ServerName,
+			nil, false,
+		); err != nil {
+			logger.WithError(err).Error("Failed to send shutdown message")
+			return util.ErrorResponse(err)
+		}
+	}
+
+	// Look up the users before they leave, in case the room uses pseudo IDs.
+	membersRes := &roomserverAPI.QueryMembershipsForRoomResponse{}
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &roomserverAPI.QueryMembershipsForRoomRequest{
+		RoomID:     validRoomID.String(),
+		JoinedOnly: true,
+		LocalOnly:  true,
+	}, membersRes); err != nil {
+		return util.ErrorResponse(err)
+	}
+	affected, err := rsAPI.PerformAdminEvacuateRoom(ctx, validRoomID.String())
+	if err != nil {
+		logger.WithError(err).Error("Failed to evacuate room")
+		return util.ErrorResponse(err)
+	}
+	kicked := make(map[string]struct{}, len(affected))
+	for _, senderID := range affected {
+		if userID, err := rsAPI.QueryUserIDForSender(ctx, *validRoomID, spec.SenderID(senderID)); err == nil && userID != nil {
+			kicked[userID.String()] = struct{}{}
+		}
+	}
+	kickedUsers := make([]string, 0, len(kicked))
+	failedToKickUsers := []string{}
+	for _, event := range membersRes.JoinEvents {
+		if event.StateKey == nil {
+			continue
+		}
+		if _, ok := kicked[*event.StateKey]; !ok {
+			failedToKickUsers = append(failedToKickUsers, *event.StateKey)
+			continue
+		}
+		kickedUsers = append(kickedUsers, *event.StateKey)
+		if newRoomID == "" {
+			continue
+		}
+		if _, _, err = rsAPI.PerformJoin(ctx, &roomserverAPI.PerformJoinRequest{
+			RoomIDOrAlias: newRoomID,
+			UserID:        *event.StateKey,
+			Content:       map[string]interface{}{},
+		}); err != nil {
+			logger.WithError(err).WithField("user_id", *event.StateKey).Warn("Failed to join user to the new room")
+		}
+	}
+
+	aliasesRes := &roomserverAPI.GetAliasesForRoomIDResponse{}
+	if err = rsAPI.GetAliasesForRoomID(ctx, &roomserverAPI.GetAliasesForRoomIDRequest{RoomID: validRoomID.String()}, aliasesRes); err != nil {
+		return util.ErrorResponse(err)
+	}
+	if err = rsAPI.PerformPublish(ctx, &roomserverAPI.PerformPublishRequest{
+		RoomID:     validRoomID.String(),
+		Visibility: "private",
+	}); err != nil {
+		logger.WithError(err).Error("Failed to remove room from the room directory")
+		return util.ErrorResponse(err)
+	}
+
+	if request.Purge == nil || *request.Purge {
+		if err = rsAPI.PerformAdminPurgeRoom(ctx, validRoomID.String()); err != nil {
+			logger.WithError(err).Error("Failed to purge room")
+			return util.ErrorResponse(err)
+		}
+	}
+
+	res := map[string]interface{}{
+		"kicked_users":         kickedUsers,
+		"failed_to_kick_users": failedToKickUsers,
+		"local_aliases":        aliasesRes.Aliases,
+		"new_room_id":          nil,
+	}
+	if newRoomID != "" {
+		res["new_room_id"] = newRoomID
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
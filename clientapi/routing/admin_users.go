@@ -0,0 +1,402 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+
+	"github.com/ike20013/dendrite/external"
+	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/setup/config"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+)
+
+// adminUser is an account as returned by the user admin APIs, using the same fields as Synapse.
+type adminUser struct {
+	Name         string  `json:"name"`
+	IsGuest      bool    `json:"is_guest"`
+	Admin        bool    `json:"admin"`
+	UserType     *string `json:"user_type"`
+	Deactivated  bool    `json:"deactivated"`
+	ShadowBanned bool    `json:"shadow_banned"`
+	DisplayName  string  `json:"displayname"`
+	AvatarURL    string  `json:"avatar_url"`
+	CreationTS   int64   `json:"creation_ts"`
+	AppServiceID string  `json:"appservice_id,omitempty"`
+}
+
+func newAdminUser(acc *userapi.AdminAccount) adminUser {
+	return adminUser{
+		Name:         acc.UserID,
+		IsGuest:      acc.AccountType == userapi.AccountTypeGuest,
+		Admin:        acc.AccountType == userapi.AccountTypeAdmin,
+		Deactivated:  acc.Deactivated,
+		ShadowBanned: acc.ShadowBanned,
+		DisplayName:  acc.DisplayName,
+		AvatarURL:    acc.AvatarURL,
+		CreationTS:   acc.CreatedTS,
+		AppServiceID: acc.AppServiceID,
+	}
+}
+
+type adminThreePID struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
+type adminUserDetails struct {
+	adminUser
+	ThreePIDs []adminThreePID `json:"threepids"`
+}
+
+// localUserFromPath returns the local user named in the request path, or an error
+// response if the user ID is invalid or belongs to another server.
+func localUserFromPath(cfg *config.ClientAPI, userID string) (*spec.UserID, *util.JSONResponse) {
+	validUserID, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid user ID"),
+		}
+	}
+	if !cfg.Matrix.IsLocalServerName(validUserID.Domain()) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Can only manage local users"),
+		}
+	}
+	return validUserID, nil
+}
+
+// getAdminAccount returns the account of the local user including deactivated
+// accounts, or nil if there is no such account.
+func getAdminAccount(ctx context.Context, userAPI userapi.ClientUserAPI, userID spec.UserID) (*userapi.AdminAccount, error) {
+	res := &userapi.QueryAdminAccountsResponse{}
+	if err := userAPI.QueryAdminAccounts(ctx, &userapi.QueryAdminAccountsRequest{
+		ServerName:         userID.Domain(),
+		Localpart:          userID.Local(),
+		IncludeDeactivated: true,
+		IncludeGuests:      true,
+		Limit:              1,
+	}, res); err != nil {
+		return nil, err
+	}
+	if len(res.Accounts) == 0 {
+		return nil, nil
+	}
+	return &res.Accounts[0], nil
+}
+
+func getAdminUserDetails(ctx context.Context, userAPI userapi.ClientUserAPI, userID spec.UserID) (*adminUserDetails, error) {
+	acc, err := getAdminAccount(ctx, userAPI, userID)
+	if err != nil || acc == nil {
+		return nil, err
+	}
+	threePIDsRes := &userapi.QueryThreePIDsForLocalpartResponse{}
+	if err = userAPI.QueryThreePIDsForLocalpart(ctx, &userapi.QueryThreePIDsForLocalpartRequest{
+		Localpart:  userID.Local(),
+		ServerName: userID.Domain(),
+	}, threePIDsRes); err != nil {
+		return nil, err
+	}
+	details := &adminUserDetails{
+		adminUser: newAdminUser(acc),
+		ThreePIDs: make([]adminThreePID, 0, len(threePIDsRes.ThreePIDs)),
+	}
+	for _, threePID := range threePIDsRes.ThreePIDs {
+		details.ThreePIDs = append(details.ThreePIDs, adminThreePID{Medium: threePID.Medium, Address: threePID.Address})
+	}
+	return details, nil
+}
+
+func queryBoolOrDefault(input string, defaultValue bool) bool {
+	v, err := strconv.ParseBool(input)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+// AdminListUsers lists the local accounts, optionally filtered by a search term
+// matching the localpart or the display name.
+func AdminListUsers(req *http.Request, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	query := req.URL.Query()
+	from := parseUint64OrDefault(query.Get("from"), 0)
+	limit := parseUint64OrDefault(query.Get("limit"), 100)
+	res := &userapi.QueryAdminAccountsResponse{}
+	if err := userAPI.QueryAdminAccounts(req.Context(), &userapi.QueryAdminAccountsRequest{
+		Search:             query.Get("name"),
+		IncludeDeactivated: queryBoolOrDefault(query.Get("deactivated"), false),
+		IncludeGuests:      queryBoolOrDefault(query.Get("guests"), true),
+		From:               int(from),
+		Limit:              int(limit),
+	}, res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to list users")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	users := make([]adminUser, 0, len(res.Accounts))
+	for i := range res.Accounts {
+		users = append(users, newAdminUser(&res.Accounts[i]))
+	}
+	resp := map[string]interface{}{
+		"users": users,
+		"total": res.Total,
+	}
+	if next := from + uint64(len(users)); len(users) > 0 && int64(next) < res.Total {
+		resp["next_token"] = strconv.FormatUint(next, 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resp,
+	}
+}
+
+// AdminGetUser returns the account, profile and 3PIDs of a local user.
+func AdminGetUser(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, userID string) util.JSONResponse {
+	validUserID, resErr := localUserFromPath(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	details, err := getAdminUserDetails(req.Context(), userAPI, *validUserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to get user")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if details == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("User not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: details,
+	}
+}
+
+// AdminPutUser creates a local user, or modifies their password, profile, admin flag
+// and whether they are deactivated. Fields which are left out are not changed.
+func AdminPutUser(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI, userID string) util.JSONResponse {
+	ctx := req.Context()
+	validUserID, resErr := localUserFromPath(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	request := struct {
+		Password      *string `json:"password"`
+		LogoutDevices *bool   `json:"logout_devices"`
+		DisplayName   *string `json:"displayname"`
+		AvatarURL     *string `json:"avatar_url"`
+		Admin         *bool   `json:"admin"`
+		Deactivated   *bool   `json:"deactivated"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	if request.Password != nil {
+		if err := external.ValidatePassword(*request.Password); err != nil {
+			return *external.PasswordResponse(err)
+		}
+	}
+	if request.Admin != nil && !*request.Admin && validUserID.String() == device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("You may not demote yourself"),
+		}
+	}
+
+	acc, err := getAdminAccount(ctx, userAPI, *validUserID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	localpart, serverName := validUserID.Local(), validUserID.Domain()
+	code := http.StatusOK
+	if acc == nil {
+		if request.Deactivated != nil && *request.Deactivated {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("Can't create a deactivated user"),
+			}
+		}
+		accountType := userapi.AccountTypeUser
+		if request.Admin != nil && *request.Admin {
+			accountType = userapi.AccountTypeAdmin
+		}
+		createReq := &userapi.PerformAccountCreationRequest{
+			AccountType: accountType,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			OnConflict:  userapi.ConflictAbort,
+		}
+		if request.Password != nil {
+			createReq.Password = *request.Password
+		}
+		if err = userAPI.PerformAccountCreation(ctx, createReq, &userapi.PerformAccountCreationResponse{}); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to create user")
+			return util.ErrorResponse(err)
+		}
+		code = http.StatusCreated
+	} else {
+		if request.Password != nil {
+			updateReq := &userapi.PerformPasswordUpdateRequest{
+				Localpart:     localpart,
+				ServerName:    serverName,
+				Password:      *request.Password,
+				LogoutDevices: request.LogoutDevices == nil || *request.LogoutDevices,
+			}
+			if err = userAPI.PerformPasswordUpdate(ctx, updateReq, &userapi.PerformPasswordUpdateResponse{}); err != nil {
+				return util.ErrorResponse(err)
+			}
+		}
+		updateReq := &userapi.PerformAdminAccountUpdateRequest{
+			Localpart:  localpart,
+			ServerName: serverName,
+			Reactivate: request.Deactivated != nil && !*request.Deactivated && acc.Deactivated,
+		}
+		if request.Admin != nil && acc.AccountType != userapi.AccountTypeAppService {
+			updateReq.AccountType = userapi.AccountTypeUser
+			if *request.Admin {
+				updateReq.AccountType = userapi.AccountTypeAdmin
+			}
+		}
+		if err = userAPI.PerformAdminAccountUpdate(ctx, updateReq, &struct{}{}); err != nil {
+			return util.ErrorResponse(err)
+		}
+		if request.Deactivated != nil && *request.Deactivated && !acc.Deactivated {
+			if err = userAPI.PerformAccountDeactivation(ctx, &userapi.PerformAccountDeactivationRequest{
+				Localpart:  localpart,
+				ServerName: serverName,
+			}, &userapi.PerformAccountDeactivationResponse{}); err != nil {
+				return util.ErrorResponse(err)
+			}
+		}
+	}
+
+	if request.DisplayName != nil {
+		if _, _, err = userAPI.SetDisplayName(ctx, localpart, serverName, *request.DisplayName); err != nil {
+			return util.ErrorResponse(err)
+		}
+	}
+	if request.AvatarURL != nil {
+		if _, _, err = userAPI.SetAvatarURL(ctx, localpart, serverName, *request.AvatarURL); err != nil {
+			return util.ErrorResponse(err)
+		}
+	}
+
+	details, err := getAdminUserDetails(ctx, userAPI, *validUserID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: code,
+		JSON: details,
+	}
+}
+
+type adminDevice struct {
+	DeviceID          string `json:"device_id"`
+	DisplayName       string `json:"display_name"`
+	LastSeenIP        string `json:"last_seen_ip"`
+	LastSeenTS        int64  `json:"last_seen_ts"`
+	LastSeenUserAgent string `json:"last_seen_user_agent"`
+	UserID            string `json:"user_id"`
+}
+
+// AdminGetUserDevices lists the devices of a local user with where they were last seen.
+func AdminGetUserDevices(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, userID string) util.JSONResponse {
+	validUserID, resErr := localUserFromPath(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	acc, err := getAdminAccount(req.Context(), userAPI, *validUserID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if acc == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("User not found"),
+		}
+	}
+	res := &userapi.QueryDevicesResponse{}
+	if err = userAPI.QueryDevices(req.Context(), &userapi.QueryDevicesRequest{UserID: validUserID.String()}, res); err != nil {
+		return util.ErrorResponse(err)
+	}
+	devices := make([]adminDevice, 0, len(res.Devices))
+	for _, dev := range res.Devices {
+		devices = append(devices, adminDevice{
+			DeviceID:          dev.ID,
+			DisplayName:       dev.DisplayName,
+			LastSeenIP:        dev.LastSeenIP,
+			LastSeenTS:        dev.LastSeenTS,
+			LastSeenUserAgent: dev.UserAgent,
+			UserID:            dev.UserID,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"devices": devices,
+			"total":   len(devices),
+		},
+	}
+}
+
+// AdminLogoutUser deletes all devices of a local user, invalidating their access tokens.
+func AdminLogoutUser(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, userID string) util.JSONResponse {
+	validUserID, resErr := localUserFromPath(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	if err := userAPI.PerformDeviceDeletion(req.Context(), &userapi.PerformDeviceDeletionRequest{
+		UserID: validUserID.String(),
+	}, &userapi.PerformDeviceDeletionResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to log out user")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminGetUserJoinedRooms lists the rooms which a local user is joined to.
+func AdminGetUserJoinedRooms(req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, userID string) util.JSONResponse {
+	validUserID, resErr := localUserFromPath(cfg, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	roomIDs, err := rsAPI.QueryRoomsForUser(req.Context(), *validUserID, spec.Join)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	joinedRooms := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		joinedRooms = append(joinedRooms, roomID.String())
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"joined_rooms": joinedRooms,
+			"total":        len(joinedRooms),
+		},
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib/spec"
 
 	"github.com/ike20013/dendrite/clientapi/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -105,6 +106,7 @@ func CreateRoom(
 	cfg *config.ClientAPI,
 	profileAPI api.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI,
 	asAPI appserviceAPI.AppServiceInternalAPI,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	var createRequest createRoomRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &createRequest)
@@ -121,6 +123,22 @@ func CreateRoom(
 			JSON: spec.InvalidParam(err.Error()),
 		}
 	}
+	if creator, creatorErr := spec.NewUserID(device.UserID, true); creatorErr == nil && spamChecker != nil {
+		if denied := spamChecker.UserMayCreateRoom(req.Context(), *creator); denied != nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: *denied,
+			}
+		}
+	}
+	if device.ShadowBanned {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: createRoomResponse{
+				RoomID: shadowBannedRoomID(device.UserDomain()),
+			},
+		}
+	}
 	return createRoom(req.Context(), createRequest, device, cfg, profileAPI, rsAPI, asAPI, evTime)
 }
 
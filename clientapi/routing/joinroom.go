@@ -8,6 +8,7 @@ package routing
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
@@ -103,6 +104,8 @@ func JoinRoomByIDOrAlias(
 			if device.AccountType == api.AccountTypeGuest {
 				jsonErr = spec.GuestAccessForbidden(e.Error())
 			}
+			// Keep the error code if the join was denied by the spam checker.
+			errors.As(e.Err, &jsonErr)
 			response = util.JSONResponse{
 				Code: http.StatusForbidden,
 				JSON: jsonErr,
@@ -0,0 +1,92 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ike20013/dendrite/clientapi/httputil"
+	"github.com/ike20013/dendrite/external/eventutil"
+	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+type knockRoomRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// KnockRoomByIDOrAlias implements POST /knock/{roomIDOrAlias}
+func KnockRoomByIDOrAlias(
+	req *http.Request,
+	device *api.Device,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	roomIDOrAlias string,
+) util.JSONResponse {
+	var body knockRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+
+	knockReq := roomserverAPI.PerformKnockRequest{
+		RoomIDOrAlias: roomIDOrAlias,
+		UserID:        device.UserID,
+		Reason:        body.Reason,
+	}
+
+	// Check to see if any ?via= or ?server_name= query parameters
+	// were given in the request.
+	if serverNames, ok := req.URL.Query()["via"]; ok {
+		for _, serverName := range serverNames {
+			knockReq.ServerNames = append(knockReq.ServerNames, spec.ServerName(serverName))
+		}
+	} else if serverNames, ok := req.URL.Query()["server_name"]; ok {
+		for _, serverName := range serverNames {
+			knockReq.ServerNames = append(knockReq.ServerNames, spec.ServerName(serverName))
+		}
+	}
+
+	roomID, err := rsAPI.PerformKnock(req.Context(), &knockReq)
+	switch e := err.(type) {
+	case nil:
+	case roomserverAPI.ErrInvalidID:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown(e.Error()),
+		}
+	case roomserverAPI.ErrNotAllowed:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(e.Error()),
+		}
+	case *gomatrix.HTTPError: // this ensures we proxy responses over federation to the client
+		return util.JSONResponse{
+			Code: e.Code,
+			JSON: json.RawMessage(e.Message),
+		}
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(e.Error()),
+		}
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformKnock failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			RoomID string `json:"room_id"`
+		}{roomID},
+	}
+}
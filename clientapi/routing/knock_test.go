@@ -0,0 +1,152 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/appservice"
+	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/roomserver"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/test"
+	"github.com/ike20013/dendrite/test/testrig"
+	"github.com/ike20013/dendrite/userapi"
+	uapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKnockRoomByIDOrAlias(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		asAPI := appservice.NewInternalAPI(processCtx, cfg, &natsInstance, userAPI, rsAPI)
+
+		// Create the users in the userapi
+		for _, u := range []*test.User{alice, bob, charlie} {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			userRes := &uapi.PerformAccountCreationResponse{}
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: u.AccountType,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    "someRandomPassword",
+			}, userRes); err != nil {
+				t.Errorf("failed to create account: %s", err)
+			}
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+		bobDev := &uapi.Device{UserID: bob.ID}
+		charlieDev := &uapi.Device{UserID: charlie.ID}
+
+		// create a room which can be knocked on
+		resp := createRoom(ctx, createRoomRequest{
+			Name:          "knocking",
+			Preset:        spec.PresetPrivateChat,
+			RoomAliasName: "knock",
+			InitialState: []gomatrixserverlib.FledglingEvent{{
+				Type:    spec.MRoomJoinRules,
+				Content: map[string]interface{}{"join_rule": spec.Knock},
+			}},
+		}, aliceDev, &cfg.ClientAPI, userAPI, rsAPI, asAPI, time.Now())
+		knockResp, ok := resp.JSON.(createRoomResponse)
+		if !ok {
+			t.Fatalf("response is not a createRoomResponse: %+v", resp)
+		}
+
+		// create a public room, which can be joined but not knocked on
+		resp = createRoom(ctx, createRoomRequest{
+			Name:   "public",
+			Preset: spec.PresetPublicChat,
+		}, aliceDev, &cfg.ClientAPI, userAPI, rsAPI, asAPI, time.Now())
+		publicResp, ok := resp.JSON.(createRoomResponse)
+		if !ok {
+			t.Fatalf("response is not a createRoomResponse: %+v", resp)
+		}
+
+		testCases := []struct {
+			name     string
+			device   *uapi.Device
+			roomID   string
+			wantCode int
+		}{
+			{
+				name:     "User can knock successfully by roomID",
+				device:   bobDev,
+				roomID:   knockResp.RoomID,
+				wantCode: http.StatusOK,
+			},
+			{
+				name:     "User can knock successfully by alias",
+				device:   charlieDev,
+				roomID:   knockResp.RoomAlias,
+				wantCode: http.StatusOK,
+			},
+			{
+				name:     "knock is forbidden if the join rule isn't knock",
+				device:   bobDev,
+				roomID:   publicResp.RoomID,
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "knock is forbidden if the user is already joined",
+				device:   aliceDev,
+				roomID:   knockResp.RoomID,
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "room does not exist",
+				device:   bobDev,
+				roomID:   "!doesnotexist:test",
+				wantCode: http.StatusNotFound,
+			},
+			{
+				name:     "user from different server",
+				device:   &uapi.Device{UserID: "@wrong:server"},
+				roomID:   knockResp.RoomID,
+				wantCode: http.StatusBadRequest,
+			},
+			{
+				name:     "invalid room ID",
+				device:   bobDev,
+				roomID:   "invalidRoomID",
+				wantCode: http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(`{"reason":"let me in"}`))
+				if err != nil {
+					t.Fatal(err)
+				}
+				knockRes := KnockRoomByIDOrAlias(req, tc.device, rsAPI, tc.roomID)
+				assert.Equal(t, tc.wantCode, knockRes.Code, "%+v", knockRes.JSON)
+				if tc.wantCode == http.StatusOK {
+					body, err := json.Marshal(knockRes.JSON)
+					assert.NoError(t, err)
+					assert.JSONEq(t, `{"room_id":"`+knockResp.RoomID+`"}`, string(body))
+				}
+			})
+		}
+	})
+}
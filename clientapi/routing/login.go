@@ -20,9 +20,11 @@ import (
 )
 
 type loginResponse struct {
-	UserID      string `json:"user_id"`
-	AccessToken string `json:"access_token"`
-	DeviceID    string `json:"device_id"`
+	UserID       string `json:"user_id"`
+	AccessToken  string `json:"access_token"`
+	DeviceID     string `json:"device_id"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 type flows struct {
@@ -30,7 +32,16 @@ type flows struct {
 }
 
 type flow struct {
-	Type string `json:"type"`
+	Type              string             `json:"type"`
+	IdentityProviders []identityProvider `json:"identity_providers,omitempty"`
+}
+
+// identityProvider defines the format of SSO identity providers in the login flows
+// https://spec.matrix.org/v1.7/client-server-api/#definition-mloginsso-flow-schema
+type identityProvider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Icon string `json:"icon,omitempty"`
 }
 
 // Login implements GET and POST /login
@@ -43,7 +54,19 @@ func Login(
 		if len(cfg.Derived.ApplicationServices) > 0 {
 			loginFlows = append(loginFlows, flow{Type: authtypes.LoginTypeApplicationService})
 		}
-		// TODO: support other forms of login, depending on config options
+		if cfg.Login.SSO.Enabled {
+			ssoFlow := flow{Type: authtypes.LoginTypeSSO}
+			for _, p := range cfg.Login.SSO.Providers {
+				ssoFlow.IdentityProviders = append(ssoFlow.IdentityProviders, identityProvider{
+					ID:   p.ID,
+					Name: p.Name,
+					Icon: p.Icon,
+				})
+			}
+			// Logins through SSO are finished with the login token that the client
+			// is sent back with.
+			loginFlows = append(loginFlows, ssoFlow, flow{Type: authtypes.LoginTypeToken})
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: flows{
@@ -97,6 +120,7 @@ func completeAuth(
 		ServerName:        serverName,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		RefreshToken:      login.RefreshToken,
 	}, &performRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -108,9 +132,11 @@ func completeAuth(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      performRes.Device.UserID,
-			AccessToken: performRes.Device.AccessToken,
-			DeviceID:    performRes.Device.ID,
+			UserID:       performRes.Device.UserID,
+			AccessToken:  performRes.Device.AccessToken,
+			DeviceID:     performRes.Device.ID,
+			RefreshToken: performRes.RefreshToken,
+			ExpiresInMS:  performRes.ExpiresInMS,
 		},
 	}
 }
@@ -9,6 +9,7 @@ package routing
 import (
 	"context"
 	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -94,6 +95,14 @@ func sendMembership(ctx context.Context, profileAPI userapi.ClientUserAPI, devic
 	roomID, membership, reason string, cfg *config.ClientAPI, targetUserID string, evTime time.Time,
 	rsAPI roomserverAPI.ClientRoomserverAPI, asAPI appserviceAPI.AppServiceInternalAPI) util.JSONResponse {
 
+	// Shadow-banned users can still leave rooms, but not change the membership of others.
+	if device.ShadowBanned && targetUserID != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	event, err := buildMembershipEvent(
 		ctx, targetUserID, reason, profileAPI, device, membership,
 		roomID, false, cfg, evTime, rsAPI, asAPI,
@@ -278,6 +287,14 @@ func SendInvite(
 		return *reqErr
 	}
 
+	// Don't let shadow-banned users invite anyone, neither by user ID nor by 3PID.
+	if device.ShadowBanned {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	inviteStored, jsonErrResp := checkAndProcessThreepid(
 		req, device, body, cfg, rsAPI, profileAPI, roomID, evTime,
 	)
@@ -380,9 +397,12 @@ func sendInvite(
 			JSON: spec.Unknown(e.Error()),
 		}, e
 	case roomserverAPI.ErrNotAllowed:
+		jsonErr := spec.Forbidden(e.Error())
+		// Keep the error code if the invite was denied by the spam checker.
+		errors.As(e.Err, &jsonErr)
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
-			JSON: spec.Forbidden(e.Error()),
+			JSON: jsonErr,
 		}, e
 	case nil:
 	default:
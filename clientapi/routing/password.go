@@ -6,6 +6,8 @@ import (
 	"github.com/ike20013/dendrite/clientapi/auth"
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
 	"github.com/ike20013/dendrite/clientapi/httputil"
+	"github.com/ike20013/dendrite/clientapi/threepid"
+	"github.com/ike20013/dendrite/clientapi/userutil"
 	"github.com/ike20013/dendrite/external"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/userapi/api"
@@ -25,6 +27,8 @@ type newPasswordAuth struct {
 	Type    string `json:"type"`
 	Session string `json:"session"`
 	auth.PasswordRequest
+	// When resetting the password via email
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
 }
 
 func Password(
@@ -155,3 +159,143 @@ func Password(
 		JSON: struct{}{},
 	}
 }
+
+// ResetPassword implements POST /account/password without an access token,
+// where the user proves they own an email address associated with the account
+// instead of knowing the old password.
+func ResetPassword(
+	req *http.Request,
+	userAPI api.ClientUserAPI,
+	validator *threepid.LocalValidator,
+) util.JSONResponse {
+	var r newPasswordRequest
+	r.LogoutDevices = true
+
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+
+	sessionID := r.Auth.Session
+	if sessionID == "" {
+		sessionID = util.RandomString(sessionIDLength)
+	}
+
+	// Require the email address to have been validated.
+	if r.Auth.Type != authtypes.LoginTypeEmail {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: newUserInteractiveResponse(
+				sessionID,
+				[]authtypes.Flow{
+					{
+						Stages: []authtypes.LoginType{authtypes.LoginTypeEmail},
+					},
+				},
+				nil,
+			),
+		}
+	}
+	creds := r.Auth.ThreePIDCreds
+	address, err := validator.ValidatedAddress(creds.SID, creds.Secret)
+	switch err {
+	case nil:
+	case threepid.ErrSessionNotValidated:
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorSessionNotValidated,
+				Err:     err.Error(),
+			},
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDAuthFailed,
+				Err:     err.Error(),
+			},
+		}
+	}
+	sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
+	// Check the new password strength.
+	if err = external.ValidatePassword(r.NewPassword); err != nil {
+		return *external.PasswordResponse(err)
+	}
+
+	// Find the account the email address belongs to.
+	res := &api.QueryLocalpartForThreePIDResponse{}
+	if err = userAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
+		ThreePID: address,
+		Medium:   "email",
+	}, res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryLocalpartForThreePID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.Localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{
+				ErrCode: errorThreePIDNotFound,
+				Err:     "Email address is not associated with an account",
+			},
+		}
+	}
+
+	passwordRes := &api.PerformPasswordUpdateResponse{}
+	if err = userAPI.PerformPasswordUpdate(req.Context(), &api.PerformPasswordUpdateRequest{
+		Localpart:  res.Localpart,
+		ServerName: res.ServerName,
+		Password:   r.NewPassword,
+	}, passwordRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("PerformPasswordUpdate failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !passwordRes.PasswordUpdated {
+		util.GetLogger(req.Context()).Error("Expected password to have been updated but wasn't")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	validator.Forget(creds.SID)
+	sessions.deleteSession(sessionID)
+
+	// The user has no device making this request, so log out all of them.
+	if r.LogoutDevices {
+		logoutReq := &api.PerformDeviceDeletionRequest{
+			UserID: userutil.MakeUserID(res.Localpart, res.ServerName),
+		}
+		if err = userAPI.PerformDeviceDeletion(req.Context(), logoutReq, &api.PerformDeviceDeletionResponse{}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("PerformDeviceDeletion failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+
+		pushersReq := &api.PerformPusherDeletionRequest{
+			Localpart:  res.Localpart,
+			ServerName: res.ServerName,
+		}
+		if err = userAPI.PerformPusherDeletion(req.Context(), pushersReq, &struct{}{}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("PerformPusherDeletion failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
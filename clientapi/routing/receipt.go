@@ -9,7 +9,9 @@ package routing
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/ike20013/dendrite/clientapi/producers"
@@ -20,19 +22,66 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func SetReceipt(req *http.Request, userAPI userapi.ClientUserAPI, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID string) util.JSONResponse {
+// mainThreadID is the thread ID of receipts for events which aren't in a thread.
+const mainThreadID = "main"
+
+type receiptRequest struct {
+	ThreadID string `json:"thread_id"`
+}
+
+// PostReceipt implements POST /rooms/{roomId}/receipt/{receiptType}/{eventId}.
+func PostReceipt(req *http.Request, userAPI userapi.ClientUserAPI, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID string) util.JSONResponse {
+	// The request body is optional, as clients which don't support threads
+	// may not send one.
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	var r receiptRequest
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &r); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
+	if r.ThreadID != "" {
+		if receiptType == "m.fully_read" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("thread_id is not allowed for m.fully_read"),
+			}
+		}
+		if r.ThreadID != mainThreadID && !strings.HasPrefix(r.ThreadID, "$") {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("thread_id must be either 'main' or an event ID"),
+			}
+		}
+	}
+	return SetReceipt(req, userAPI, syncProducer, device, roomID, receiptType, eventID, r.ThreadID)
+}
+
+// SetReceipt sets a receipt for the user. Read receipts are only for the given
+// thread if the thread ID isn't empty.
+func SetReceipt(req *http.Request, userAPI userapi.ClientUserAPI, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID, threadID string) util.JSONResponse {
 	timestamp := spec.AsTimestamp(time.Now())
 	logrus.WithFields(logrus.Fields{
 		"roomID":      roomID,
 		"receiptType": receiptType,
 		"eventID":     eventID,
+		"threadID":    threadID,
 		"userId":      device.UserID,
 		"timestamp":   timestamp,
 	}).Debug("Setting receipt")
 
 	switch receiptType {
 	case "m.read", "m.read.private":
-		if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, timestamp); err != nil {
+		if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, threadID, timestamp); err != nil {
 			return util.ErrorResponse(err)
 		}
 
@@ -137,6 +137,19 @@ func SendRedaction(
 		return *resErr
 	}
 
+	// Pretend that the event was redacted. The transaction is still recorded so
+	// that retries get the same event ID back.
+	if device.ShadowBanned {
+		res := util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: redactionResponse{EventID: shadowBannedEventID()},
+		}
+		if txnID != nil {
+			txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
+		}
+		return res
+	}
+
 	// create the new event and set all the fields we can
 	proto := gomatrixserverlib.ProtoEvent{
 		SenderID: string(*senderID),
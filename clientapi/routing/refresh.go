@@ -0,0 +1,77 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/ike20013/dendrite/clientapi/auth"
+	"github.com/ike20013/dendrite/clientapi/httputil"
+	"github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms"`
+}
+
+// Refresh implements POST /refresh, which replaces the access token of a device
+// using its refresh token.
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3refresh
+func Refresh(req *http.Request, userAPI api.ClientUserAPI) util.JSONResponse {
+	var r refreshRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Missing refresh_token"),
+		}
+	}
+
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var res api.PerformTokenRefreshResponse
+	if err = userAPI.PerformTokenRefresh(req.Context(), &api.PerformTokenRefreshRequest{
+		RefreshToken: r.RefreshToken,
+		AccessToken:  accessToken,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformTokenRefresh failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: spec.UnknownToken("Unknown refresh token"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: refreshResponse{
+			AccessToken:  accessToken,
+			RefreshToken: res.RefreshToken,
+			ExpiresInMS:  res.ExpiresInMS,
+		},
+	}
+}
@@ -0,0 +1,195 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
+	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/roomserver"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ike20013/dendrite/test"
+	"github.com/ike20013/dendrite/test/testrig"
+	"github.com/ike20013/dendrite/userapi"
+	uapi "github.com/ike20013/dendrite/userapi/api"
+)
+
+func TestRefresh(t *testing.T) {
+	alice := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cfg.ClientAPI.RateLimiting.Enabled = false
+		natsInstance := jetstream.NATSInstance{}
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		routers := httputil.NewRouters()
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		Setup(processCtx, routers, cfg, nil, nil, userAPI, nil, nil, nil, nil, nil, nil, nil, nil, caching.DisableMetrics)
+
+		password := util.RandomString(8)
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    password,
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		login := func(t *testing.T, refreshToken bool) loginResponse {
+			t.Helper()
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/login", test.WithJSONBody(t, map[string]interface{}{
+				"type": authtypes.LoginTypePassword,
+				"identifier": map[string]interface{}{
+					"type": "m.id.user",
+					"user": alice.ID,
+				},
+				"password":      password,
+				"refresh_token": refreshToken,
+			}))
+			rec := httptest.NewRecorder()
+			routers.Client.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("failed to login: %s", rec.Body.String())
+			}
+			resp := loginResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+		refresh := func(t *testing.T, refreshToken string) (int, refreshResponse, map[string]interface{}) {
+			t.Helper()
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/refresh", test.WithJSONBody(t, map[string]interface{}{
+				"refresh_token": refreshToken,
+			}))
+			rec := httptest.NewRecorder()
+			routers.Client.ServeHTTP(rec, req)
+			resp := refreshResponse{}
+			body := map[string]interface{}{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			return rec.Code, resp, body
+		}
+		whoami := func(t *testing.T, accessToken string) (int, map[string]interface{}) {
+			t.Helper()
+			req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/account/whoami", test.WithQueryParams(map[string]string{
+				"access_token": accessToken,
+			}))
+			rec := httptest.NewRecorder()
+			routers.Client.ServeHTTP(rec, req)
+			body := map[string]interface{}{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			return rec.Code, body
+		}
+
+		t.Run("login without a refresh token", func(t *testing.T) {
+			resp := login(t, false)
+			assert.Empty(t, resp.RefreshToken)
+			assert.Zero(t, resp.ExpiresInMS)
+		})
+
+		t.Run("refreshing rotates the tokens", func(t *testing.T) {
+			resp := login(t, true)
+			assert.NotEmpty(t, resp.RefreshToken)
+			assert.Equal(t, cfg.UserAPI.AccessTokenLifetimeMS, resp.ExpiresInMS)
+
+			code, refreshed, _ := refresh(t, resp.RefreshToken)
+			assert.Equal(t, http.StatusOK, code)
+			assert.NotEmpty(t, refreshed.AccessToken)
+			assert.NotEqual(t, resp.AccessToken, refreshed.AccessToken)
+			assert.NotEmpty(t, refreshed.RefreshToken)
+			assert.NotEqual(t, resp.RefreshToken, refreshed.RefreshToken)
+			assert.Equal(t, cfg.UserAPI.AccessTokenLifetimeMS, refreshed.ExpiresInMS)
+
+			// The old access token is replaced by the new one.
+			code, body := whoami(t, resp.AccessToken)
+			assert.Equal(t, http.StatusUnauthorized, code)
+			assert.Equal(t, string(spec.ErrorUnknownToken), body["errcode"])
+			code, body = whoami(t, refreshed.AccessToken)
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, alice.ID, body["user_id"])
+			assert.Equal(t, resp.DeviceID, body["device_id"])
+
+			t.Run("the old refresh token can't be reused", func(t *testing.T) {
+				code, _, body := refresh(t, resp.RefreshToken)
+				assert.Equal(t, http.StatusUnauthorized, code)
+				assert.Equal(t, string(spec.ErrorUnknownToken), body["errcode"])
+			})
+		})
+
+		t.Run("logging out revokes the refresh token", func(t *testing.T) {
+			for _, path := range []string{"/_matrix/client/v3/logout", "/_matrix/client/v3/logout/all"} {
+				resp := login(t, true)
+				req := test.NewRequest(t, http.MethodPost, path, test.WithQueryParams(map[string]string{
+					"access_token": resp.AccessToken,
+				}))
+				rec := httptest.NewRecorder()
+				routers.Client.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to log out: %s", rec.Body.String())
+				}
+
+				code, _, body := refresh(t, resp.RefreshToken)
+				assert.Equal(t, http.StatusUnauthorized, code, path)
+				assert.Equal(t, string(spec.ErrorUnknownToken), body["errcode"], path)
+			}
+		})
+
+		t.Run("unknown refresh token", func(t *testing.T) {
+			code, _, body := refresh(t, "unknown")
+			assert.Equal(t, http.StatusUnauthorized, code)
+			assert.Equal(t, string(spec.ErrorUnknownToken), body["errcode"])
+		})
+
+		t.Run("missing refresh token", func(t *testing.T) {
+			code, _, body := refresh(t, "")
+			assert.Equal(t, http.StatusBadRequest, code)
+			assert.Equal(t, string(spec.ErrorMissingParam), body["errcode"])
+		})
+
+		t.Run("expired access tokens are soft logged out", func(t *testing.T) {
+			lifetime := cfg.UserAPI.AccessTokenLifetimeMS
+			cfg.UserAPI.AccessTokenLifetimeMS = 1
+			defer func() { cfg.UserAPI.AccessTokenLifetimeMS = lifetime }()
+
+			resp := login(t, true)
+			time.Sleep(time.Millisecond * 10)
+			code, body := whoami(t, resp.AccessToken)
+			assert.Equal(t, http.StatusUnauthorized, code)
+			assert.Equal(t, string(spec.ErrorUnknownToken), body["errcode"])
+			assert.Equal(t, true, body["soft_logout"])
+
+			// The refresh token still works, giving a new access token.
+			cfg.UserAPI.AccessTokenLifetimeMS = lifetime
+			code, refreshed, _ := refresh(t, resp.RefreshToken)
+			assert.Equal(t, http.StatusOK, code)
+			code, _ = whoami(t, refreshed.AccessToken)
+			assert.Equal(t, http.StatusOK, code)
+		})
+	})
+}
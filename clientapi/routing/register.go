@@ -38,8 +38,10 @@ import (
 	"github.com/ike20013/dendrite/clientapi/auth"
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
 	"github.com/ike20013/dendrite/clientapi/httputil"
+	"github.com/ike20013/dendrite/clientapi/threepid"
 	"github.com/ike20013/dendrite/clientapi/userutil"
 	userapi "github.com/ike20013/dendrite/userapi/api"
+	userdb "github.com/ike20013/dendrite/userapi/storage"
 )
 
 var (
@@ -66,6 +68,8 @@ type sessionsDict struct {
 	// If a UIA session is started by trying to delete device1, and then UIA is completed by deleting device2,
 	// the delete request will fail for device2 since the UIA was initiated by trying to delete device1.
 	deleteSessionToDeviceID map[string]string
+	// emails holds the validated email address of sessions which completed the email stage.
+	emails map[string]string
 }
 
 // defaultTimeout is the timeout used to clean up sessions
@@ -107,6 +111,7 @@ func (d *sessionsDict) deleteSession(sessionID string) {
 	delete(d.sessions, sessionID)
 	delete(d.deleteSessionToDeviceID, sessionID)
 	delete(d.sessionCompletedResult, sessionID)
+	delete(d.emails, sessionID)
 	// stop the timer, e.g. because the registration was completed
 	if t, ok := d.timer[sessionID]; ok {
 		if !t.Stop() {
@@ -126,6 +131,7 @@ func newSessionsDict() *sessionsDict {
 		params:                  make(map[string]registerRequest),
 		timer:                   make(map[string]*time.Timer),
 		deleteSessionToDeviceID: make(map[string]string),
+		emails:                  make(map[string]string),
 	}
 }
 
@@ -179,6 +185,23 @@ func (d *sessionsDict) getCompletedRegistration(sessionID string) (registerRespo
 	return result, ok
 }
 
+func (d *sessionsDict) addValidatedEmail(sessionID, address string) {
+	d.startTimer(defaultTimeOut, sessionID)
+	d.Lock()
+	defer d.Unlock()
+	d.emails[sessionID] = address
+}
+
+// takeValidatedEmail returns the validated email address of the session, and
+// forgets it so that it's only associated with an account once.
+func (d *sessionsDict) takeValidatedEmail(sessionID string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	address, ok := d.emails[sessionID]
+	delete(d.emails, sessionID)
+	return address, ok
+}
+
 func (d *sessionsDict) getDeviceToDelete(sessionID string) (string, bool) {
 	d.RLock()
 	defer d.RUnlock()
@@ -213,6 +236,10 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client supports refresh tokens, in which case the access
+	// token expires.
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
@@ -225,6 +252,8 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Email
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -250,9 +279,11 @@ func newUserInteractiveResponse(
 
 // https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3register
 type registerResponse struct {
-	UserID      string `json:"user_id"`
-	AccessToken string `json:"access_token,omitempty"`
-	DeviceID    string `json:"device_id,omitempty"`
+	UserID       string `json:"user_id"`
+	AccessToken  string `json:"access_token,omitempty"`
+	DeviceID     string `json:"device_id,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -459,6 +490,7 @@ func Register(
 	req *http.Request,
 	userAPI userapi.ClientUserAPI,
 	cfg *config.ClientAPI,
+	validator *threepid.LocalValidator,
 ) util.JSONResponse {
 	defer req.Body.Close() // nolint: errcheck
 	reqBody, err := io.ReadAll(req.Body)
@@ -566,7 +598,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accessToken, accessTokenErr)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, validator, accessToken, accessTokenErr)
 }
 
 func handleGuestRegistration(
@@ -623,6 +655,7 @@ func handleGuestRegistration(
 		IPAddr:            req.RemoteAddr,
 		UserAgent:         req.UserAgent(),
 		FromRegistration:  true,
+		RefreshToken:      r.RefreshToken,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -633,9 +666,11 @@ func handleGuestRegistration(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: devRes.RefreshToken,
+			ExpiresInMS:  devRes.ExpiresInMS,
 		},
 	}
 }
@@ -659,6 +694,7 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.ClientUserAPI,
+	validator *threepid.LocalValidator,
 	accessToken string,
 	accessTokenErr error,
 ) util.JSONResponse {
@@ -668,7 +704,7 @@ func handleRegistrationFlow(
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn auth types.
+	// TODO: msisdn auth type.
 
 	// Appservices are special and are not affected by disabled
 	// registration or user exclusivity. We'll go onto the appservice
@@ -730,6 +766,49 @@ func handleRegistrationFlow(
 		// Add Dummy to the list of completed registration stages
 		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
 
+	case authtypes.LoginTypeEmail:
+		if validator == nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Unknown("email validation is not enabled on this server"),
+			}
+		}
+		// Check that the email address has been validated
+		address, err := validator.ValidatedAddress(r.Auth.ThreePIDCreds.SID, r.Auth.ThreePIDCreds.Secret)
+		switch err {
+		case nil:
+		case threepid.ErrSessionNotValidated:
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: spec.MatrixError{ErrCode: spec.ErrorSessionNotValidated, Err: err.Error()},
+			}
+		default:
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: spec.MatrixError{ErrCode: spec.ErrorThreePIDAuthFailed, Err: err.Error()},
+			}
+		}
+		// It may have been associated with another account since the token was requested
+		res := &userapi.QueryLocalpartForThreePIDResponse{}
+		if err = userAPI.QueryLocalpartForThreePID(req.Context(), &userapi.QueryLocalpartForThreePIDRequest{
+			ThreePID: address,
+			Medium:   "email",
+		}, res); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryLocalpartForThreePID failed")
+			return util.JSONResponse{Code: http.StatusInternalServerError, JSON: spec.InternalServerError{}}
+		}
+		if res.Localpart != "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MatrixError{ErrCode: spec.ErrorThreePIDInUse, Err: userdb.Err3PIDInUse.Error()},
+			}
+		}
+		validator.Forget(r.Auth.ThreePIDCreds.SID)
+
+		// Add Email to the list of completed registration stages
+		sessions.addValidatedEmail(sessionID, address)
+		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
 	case "":
 		// An empty auth type means that we want to fetch the available
 		// flows. It can also mean that we want to register as an appservice
@@ -787,7 +866,7 @@ func handleApplicationServiceRegistration(
 	// application service registration is entirely separate.
 	return completeRegistration(
 		req.Context(), userAPI, r.Username, r.ServerName, "", "", appserviceID, req.RemoteAddr,
-		req.UserAgent(), r.Auth.Session, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		req.UserAgent(), r.Auth.Session, r.InhibitLogin, r.InitialDisplayName, r.DeviceID, r.RefreshToken,
 		userapi.AccountTypeAppService,
 	)
 }
@@ -805,11 +884,21 @@ func checkAndCompleteFlow(
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
+		res := completeRegistration(
 			req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", req.RemoteAddr,
-			req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID, r.RefreshToken,
 			userapi.AccountTypeUser,
 		)
+		// Associate the email address validated during registration with the account
+		if res.Code != http.StatusOK {
+			return res
+		}
+		if address, ok := sessions.takeValidatedEmail(sessionID); ok {
+			if resErr := save3PIDAssociation(req, userAPI, userutil.MakeUserID(r.Username, r.ServerName), address, "email"); resErr != nil {
+				return *resErr
+			}
+		}
+		return res
 	}
 	sessions.addParams(sessionID, r)
 	// There are still more stages to complete.
@@ -833,7 +922,7 @@ func completeRegistration(
 	username string, serverName spec.ServerName, displayName string,
 	password, appserviceID, ipAddr, userAgent, sessionID string,
 	inhibitLogin eventutil.WeakBoolean,
-	deviceDisplayName, deviceID *string,
+	deviceDisplayName, deviceID *string, refreshToken bool,
 	accType userapi.AccountType,
 ) util.JSONResponse {
 	if username == "" {
@@ -913,6 +1002,7 @@ func completeRegistration(
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
 		FromRegistration:  true,
+		RefreshToken:      refreshToken,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -922,9 +1012,11 @@ func completeRegistration(
 	}
 
 	result := registerResponse{
-		UserID:      devRes.Device.UserID,
-		AccessToken: devRes.Device.AccessToken,
-		DeviceID:    devRes.Device.ID,
+		UserID:       devRes.Device.UserID,
+		AccessToken:  devRes.Device.AccessToken,
+		DeviceID:     devRes.Device.ID,
+		RefreshToken: devRes.RefreshToken,
+		ExpiresInMS:  devRes.ExpiresInMS,
 	}
 	sessions.addCompletedRegistration(sessionID, result)
 
@@ -1094,5 +1186,5 @@ func handleSharedSecretRegistration(cfg *config.ClientAPI, userAPI userapi.Clien
 	if ssrr.Admin {
 		accType = userapi.AccountTypeAdmin
 	}
-	return completeRegistration(req.Context(), userAPI, ssrr.User, cfg.Matrix.ServerName, ssrr.DisplayName, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), "", false, &ssrr.User, &deviceID, accType)
+	return completeRegistration(req.Context(), userAPI, ssrr.User, cfg.Matrix.ServerName, ssrr.DisplayName, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), "", false, &ssrr.User, &deviceID, false, accType)
 }
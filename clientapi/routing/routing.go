@@ -10,6 +10,7 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -26,14 +27,19 @@ import (
 	appserviceAPI "github.com/ike20013/dendrite/appservice/api"
 	"github.com/ike20013/dendrite/clientapi/api"
 	"github.com/ike20013/dendrite/clientapi/auth"
+	"github.com/ike20013/dendrite/clientapi/auth/sso"
 	clientutil "github.com/ike20013/dendrite/clientapi/httputil"
 	"github.com/ike20013/dendrite/clientapi/producers"
+	"github.com/ike20013/dendrite/clientapi/threepid"
+	"github.com/ike20013/dendrite/external/email"
 	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/transactions"
 	federationAPI "github.com/ike20013/dendrite/federationapi/api"
 	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/setup/process"
 )
 
 type WellKnownClientHomeserver struct {
@@ -56,6 +62,7 @@ type WellKnownClientResponse struct {
 // applied:
 // nolint: gocyclo
 func Setup(
+	processContext *process.ProcessContext,
 	routers httputil.Routers,
 	dendriteCfg *config.Dendrite,
 	rsAPI roomserverAPI.ClientRoomserverAPI,
@@ -67,6 +74,7 @@ func Setup(
 	transactionsCache *transactions.Cache,
 	federationSender federationAPI.ClientFederationAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
+	spamChecker spamcheck.Checker,
 	natsClient *nats.Conn, enableMetrics bool,
 ) {
 	cfg := &dendriteCfg.ClientAPI
@@ -87,6 +95,8 @@ func Setup(
 		"org.matrix.e2e_cross_signing": true,
 		"org.matrix.msc2285.stable":    true,
 		"org.matrix.msc3916.stable":    true,
+		// Native simplified sliding sync in the sync API
+		"org.matrix.simplified_msc3575": true,
 	}
 	for _, msc := range cfg.MSCs.MSCs {
 		unstableFeatures["org.matrix."+msc] = true
@@ -100,6 +110,16 @@ func Setup(
 	// 		 possibly other ways that can result in a stat reset.
 	sf := singleflight.Group{}
 
+	// emailValidator sends the emails validating email addresses, unless
+	// that's left to identity servers.
+	var emailValidator *threepid.LocalValidator
+	if cfg.Email.Enabled {
+		var err error
+		if emailValidator, err = threepid.NewLocalValidator(&cfg.Email); err != nil {
+			logrus.WithError(err).Fatal("unable to set up sending emails")
+		}
+	}
+
 	if cfg.Matrix.WellKnownClientName != "" {
 		logrus.Infof("Setting m.homeserver base_url as %s at /.well-known/matrix/client", cfg.Matrix.WellKnownClientName)
 		if cfg.Matrix.WellKnownSlidingSyncProxy != "" {
@@ -219,12 +239,52 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/redactUser/{userID}",
+		httputil.MakeAdminAPI("admin_redact_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRedactUser(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/redactUserStatus/{redactID}",
+		httputil.MakeAdminAPI("admin_redact_user_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRedactUserStatus(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/policyRules",
+		httputil.MakeAdminAPI("admin_policy_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPolicyRules(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/policyRules/{roomID}",
+		httputil.MakeAdminAPI("admin_policy_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPolicyRules(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/resetPassword/{userID}",
 		httputil.MakeAdminAPI("admin_reset_password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminResetPassword(req, cfg, device, userAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/logoutUser/{userID}",
+		httputil.MakeAdminAPI("admin_logout_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminLogoutUser(req, cfg, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/shadowBan/{userID}",
+		httputil.MakeAdminAPI("admin_shadow_ban", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminShadowBanUser(req, cfg, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/downloadState/{serverName}/{roomID}",
 		httputil.MakeAdminAPI("admin_download_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminDownloadState(req, device, rsAPI)
@@ -286,6 +346,10 @@ func Setup(
 				)
 			}),
 		).Methods(http.MethodPost, http.MethodOptions)
+
+		if validity := &dendriteCfg.UserAPI.AccountValidity; validity.Enabled() && validity.RenewAt > 0 {
+			go sendAccountExpiryNotices(processContext.Context(), cfg, validity, userAPI, rsAPI, asAPI, serverNotificationSender)
+		}
 	}
 
 	// You can't just do PathPrefix("/(r0|v3)") because regexps only apply when inside named path variables.
@@ -302,7 +366,7 @@ func Setup(
 
 	v3mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI)
+			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI, spamChecker)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/join/{roomIDOrAlias}",
@@ -328,6 +392,21 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/knock/{roomIDOrAlias}",
+		httputil.MakeAuthAPI(spec.Knock, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return KnockRoomByIDOrAlias(
+				req, device, rsAPI, vars["roomIDOrAlias"],
+			)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	if mscCfg.Enabled("msc2753") {
 		v3mux.Handle("/peek/{roomIDOrAlias}",
 			httputil.MakeAuthAPI(spec.Peek, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -441,7 +520,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
@@ -452,7 +531,7 @@ func Setup(
 			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, transactionsCache)
+				nil, cfg, rsAPI, transactionsCache, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -500,7 +579,7 @@ func Setup(
 			}
 			emptyString := ""
 			eventType := strings.TrimSuffix(vars["eventType"], "/")
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -511,7 +590,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil, spamChecker)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -528,11 +607,21 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	v1mux.Handle("/rooms/{roomID}/timestamp_to_event",
+		httputil.MakeAuthAPI("timestamp_to_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return TimestampToEvent(req, device, vars["roomID"], rsAPI, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
 		if r := rateLimits.Limit(req, nil); r != nil {
 			return *r
 		}
-		return Register(req, userAPI, cfg)
+		return Register(req, userAPI, cfg, emailValidator)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v3mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
@@ -695,12 +784,27 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	changePassword := httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		if r := rateLimits.Limit(req, device); r != nil {
+			return *r
+		}
+		return Password(req, userAPI, device, cfg)
+	})
+	resetPassword := httputil.MakeExternalAPI("reset_password", func(req *http.Request) util.JSONResponse {
+		if r := rateLimits.Limit(req, nil); r != nil {
+			return *r
+		}
+		return ResetPassword(req, userAPI, emailValidator)
+	})
 	v3mux.Handle("/account/password",
-		httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req, device); r != nil {
-				return *r
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Users who forgot their password have no access token, and can
+			// reset it if they prove they own their email address instead.
+			if _, err := auth.ExtractAccessToken(req); err != nil && emailValidator != nil {
+				resetPassword.ServeHTTP(w, req)
+				return
 			}
-			return Password(req, userAPI, device, cfg)
+			changePassword.ServeHTTP(w, req)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -724,6 +828,35 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/refresh",
+		httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return Refresh(req, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	if cfg.Login.SSO.Enabled {
+		authenticator := sso.NewAuthenticator(&cfg.Login.SSO, &http.Client{Timeout: 30 * time.Second})
+		ssoRedirect := httputil.MakeExternalAPI("login_sso_redirect", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return SSORedirect(req, cfg, authenticator, mux.Vars(req)["idpID"])
+		})
+		v3mux.Handle("/login/sso/redirect", ssoRedirect).Methods(http.MethodGet, http.MethodOptions)
+		v3mux.Handle("/login/sso/redirect/{idpID}", ssoRedirect).Methods(http.MethodGet, http.MethodOptions)
+		v3mux.Handle("/login/sso/callback",
+			httputil.MakeExternalAPI("login_sso_callback", func(req *http.Request) util.JSONResponse {
+				if r := rateLimits.Limit(req, nil); r != nil {
+					return *r
+				}
+				return SSOCallback(req, cfg, userAPI, authenticator)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
+
 	v3mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTTPAPI("auth_fallback", userAPI, enableMetrics, func(w http.ResponseWriter, req *http.Request) {
 			vars := mux.Vars(req)
@@ -939,7 +1072,7 @@ func Setup(
 
 	v3mux.Handle("/account/3pid",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CheckAndSave3PIDAssociation(req, userAPI, device, cfg, threePIDClient)
+			return CheckAndSave3PIDAssociation(req, userAPI, device, cfg, threePIDClient, emailValidator)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -949,12 +1082,39 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	v3mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
+	v3mux.Handle("/{path:(?:account/3pid|register|account/password)}/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
-			return RequestEmailToken(req, userAPI, cfg, threePIDClient)
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			tmpl := email.TemplateAddThreePID
+			switch mux.Vars(req)["path"] {
+			case "register":
+				tmpl = email.TemplateRegistration
+			case "account/password":
+				tmpl = email.TemplatePasswordReset
+			}
+			return RequestEmailToken(req, userAPI, cfg, threePIDClient, emailValidator, tmpl)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	if emailValidator != nil {
+		v3mux.Handle("/email/submit_token",
+			httputil.MakeHTTPAPI("email_submit_token_link", userAPI, enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+				SubmitEmailTokenLink(w, req, emailValidator)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+
+		v3mux.Handle("/email/submit_token",
+			httputil.MakeExternalAPI("email_submit_token", func(req *http.Request) util.JSONResponse {
+				if r := rateLimits.Limit(req, nil); r != nil {
+					return *r
+				}
+				return SubmitEmailToken(req, emailValidator)
+			}),
+		).Methods(http.MethodPost)
+	}
+
 	v3mux.Handle("/voip/turnServer",
 		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			if r := rateLimits.Limit(req, device); r != nil {
@@ -1107,6 +1267,7 @@ func Setup(
 				postContent.Limit,
 				federation,
 				cfg.Matrix.ServerName,
+				spamChecker,
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -1485,7 +1646,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 
-			return SetReceipt(req, userAPI, syncProducer, device, vars["roomId"], vars["receiptType"], vars["eventId"])
+			return PostReceipt(req, userAPI, syncProducer, device, vars["roomId"], vars["receiptType"], vars["eventId"])
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/presence/{userId}/status",
@@ -1560,4 +1721,192 @@ func Setup(
 			return DeleteEventReport(req, rsAPI, vars["reportID"])
 		}),
 	).Methods(http.MethodDelete, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v2/users",
+		httputil.MakeAdminAPI("admin_list_users", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListUsers(req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v2/users/{userID}",
+		httputil.MakeAdminAPI("admin_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if req.Method == http.MethodPut {
+				return AdminPutUser(req, cfg, device, userAPI, vars["userID"])
+			}
+			return AdminGetUser(req, cfg, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v2/users/{userID}/devices",
+		httputil.MakeAdminAPI("admin_user_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminGetUserDevices(req, cfg, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/users/{userID}/joined_rooms",
+		httputil.MakeAdminAPI("admin_user_joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminGetUserJoinedRooms(req, cfg, rsAPI, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/account_validity/validity",
+		httputil.MakeAdminAPI("admin_account_validity", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminSetAccountValidity(req, cfg, &dendriteCfg.UserAPI.AccountValidity, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/rooms",
+		httputil.MakeAdminAPI("admin_list_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListRooms(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/rooms/{roomID}",
+		httputil.MakeAdminAPI("admin_get_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminGetRoom(req, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/rooms/{roomID}",
+		httputil.MakeAdminAPI("admin_delete_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminDeleteRoom(req, cfg, device, rsAPI, userAPI, asAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/rooms/{roomID}/members",
+		httputil.MakeAdminAPI("admin_get_room_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminGetRoomMembers(req, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/rooms/{roomID}/state",
+		httputil.MakeAdminAPI("admin_get_room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminGetRoomState(req, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/rooms/{roomID}/block",
+		httputil.MakeAdminAPI("admin_room_block", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if req.Method == http.MethodPut {
+				return AdminBlockRoom(req, device, rsAPI, vars["roomID"])
+			}
+			return AdminGetRoomBlock(req, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/rooms/{roomID}/make_room_admin",
+		httputil.MakeAdminAPI("admin_make_room_admin", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminMakeRoomAdmin(req, cfg, device, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/federation/destinations",
+		httputil.MakeAdminAPI("admin_list_destinations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListFederationDestinations(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/federation/destinations/{destination}",
+		httputil.MakeAdminAPI("admin_get_destination", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminGetFederationDestination(req, federationSender, vars["destination"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	synapseAdminRouter.Handle("/admin/v1/federation/destinations/{destination}/reset_connection",
+		httputil.MakeAdminAPI("admin_reset_destination", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminResetFederationDestination(req, federationSender, vars["destination"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/purgeFederationQueue/{serverName}",
+		httputil.MakeAdminAPI("admin_purge_federation_queue", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminPurgeFederationQueue(req, federationSender, vars["serverName"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federationDomains",
+		httputil.MakeAdminAPI("admin_federation_domains", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if req.Method == http.MethodPut {
+				return AdminSetFederationDomains(req, federationSender)
+			}
+			return AdminGetFederationDomains(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/serverKeys",
+		httputil.MakeAdminAPI("admin_list_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListServerKeys(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/serverKeys/{serverName}",
+		httputil.MakeAdminAPI("admin_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if req.Method == http.MethodDelete {
+				return AdminEvictServerKeys(req, federationSender, vars["serverName"])
+			}
+			return AdminGetServerKeys(req, federationSender, vars["serverName"])
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/serverKeys/{serverName}/refetch",
+		httputil.MakeAdminAPI("admin_refetch_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminRefetchServerKeys(req, federationSender, vars["serverName"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 }
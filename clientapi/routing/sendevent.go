@@ -17,6 +17,7 @@ import (
 
 	"github.com/ike20013/dendrite/clientapi/httputil"
 	"github.com/ike20013/dendrite/external/eventutil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/transactions"
 	"github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/roomserver/types"
@@ -69,6 +70,7 @@ func SendEvent(
 	cfg *config.ClientAPI,
 	rsAPI api.ClientRoomserverAPI,
 	txnCache *transactions.Cache,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(req.Context(), roomID)
 	if err != nil {
@@ -164,6 +166,15 @@ func SendEvent(
 	}
 	timeToGenerateEvent := time.Since(startedGeneratingEvent)
 
+	if sender, senderErr := spec.NewUserID(userID, true); senderErr == nil && spamChecker != nil {
+		if denied := spamChecker.CheckEventForSpam(req.Context(), e, *sender); denied != nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: *denied,
+			}
+		}
+	}
+
 	// validate that the aliases exists
 	if eventType == spec.MRoomCanonicalAlias && stateKey != nil && *stateKey == "" {
 		aliasReq := api.AliasEvent{}
@@ -201,6 +212,19 @@ func SendEvent(
 		}
 	}
 
+	// Pretend that the event was sent. The transaction is still recorded so that
+	// retries get the same event ID back.
+	if device.ShadowBanned {
+		res := util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: sendEventResponse{shadowBannedEventID()},
+		}
+		if txnID != nil {
+			txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
+		}
+		return res
+	}
+
 	var txnAndSessionID *api.TransactionID
 	if txnID != nil {
 		txnAndSessionID = &api.TransactionID{
@@ -189,7 +189,7 @@ func Test_SendEvent_PseudoIDStateKeys(t *testing.T) {
 
 		cfg := &config.ClientAPI{}
 
-		resp := SendEvent(req, device, roomIDStr, eventType, nil, &senderUserID, cfg, rsAPI, nil)
+		resp := SendEvent(req, device, roomIDStr, eventType, nil, &senderUserID, cfg, rsAPI, nil, nil)
 
 		if resp.Code != http.StatusOK {
 			t.Fatalf("non-200 HTTP code returned: %v\nfull response: %v", resp.Code, resp)
@@ -235,7 +235,7 @@ func Test_SendEvent_PseudoIDStateKeys(t *testing.T) {
 
 		cfg := &config.ClientAPI{}
 
-		resp := SendEvent(req, device, roomIDStr, eventType, nil, &senderUserID, cfg, rsAPI, nil)
+		resp := SendEvent(req, device, roomIDStr, eventType, nil, &senderUserID, cfg, rsAPI, nil, nil)
 
 		if resp.Code != http.StatusOK {
 			t.Fatalf("non-200 HTTP code returned: %v\nfull response: %v", resp.Code, resp)
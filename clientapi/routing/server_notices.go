@@ -94,124 +94,9 @@ func SendServerNotice(
 		}
 	}
 
-	// get rooms for specified user
-	allUserRooms := []spec.RoomID{}
-	// Get rooms the user is either joined, invited or has left.
-	for _, membership := range []string{"join", "invite", "leave"} {
-		userRooms, queryErr := rsAPI.QueryRoomsForUser(ctx, *userID, membership)
-		if queryErr != nil {
-			return util.ErrorResponse(err)
-		}
-		allUserRooms = append(allUserRooms, userRooms...)
-	}
-
-	// get rooms of the sender
-	senderUserID, err := spec.NewUserID(fmt.Sprintf("@%s:%s", cfgNotices.LocalPart, cfgClient.Matrix.ServerName), true)
-	if err != nil {
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.Unknown("external server error"),
-		}
-	}
-	senderRooms, err := rsAPI.QueryRoomsForUser(ctx, *senderUserID, "join")
-	if err != nil {
-		return util.ErrorResponse(err)
-	}
-
-	// check if we have rooms in common
-	commonRooms := []spec.RoomID{}
-	for _, userRoomID := range allUserRooms {
-		for _, senderRoomID := range senderRooms {
-			if userRoomID == senderRoomID {
-				commonRooms = append(commonRooms, senderRoomID)
-			}
-		}
-	}
-
-	if len(commonRooms) > 1 {
-		return util.ErrorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
-	}
-
-	var (
-		roomID      string
-		roomVersion = rsAPI.DefaultRoomVersion()
-	)
-
-	// create a new room for the user
-	if len(commonRooms) == 0 {
-		powerLevelContent := eventutil.InitialPowerLevelsContent(senderUserID.String())
-		powerLevelContent.Users[r.UserID] = -10 // taken from Synapse
-		pl, err := json.Marshal(powerLevelContent)
-		if err != nil {
-			return util.ErrorResponse(err)
-		}
-		createContent := map[string]interface{}{}
-		createContent["m.federate"] = false
-		cc, err := json.Marshal(createContent)
-		if err != nil {
-			return util.ErrorResponse(err)
-		}
-		crReq := createRoomRequest{
-			Invite:                    []string{r.UserID},
-			Name:                      cfgNotices.RoomName,
-			Visibility:                "private",
-			Preset:                    spec.PresetPrivateChat,
-			CreationContent:           cc,
-			RoomVersion:               roomVersion,
-			PowerLevelContentOverride: pl,
-		}
-
-		roomRes := createRoom(ctx, crReq, senderDevice, cfgClient, userAPI, rsAPI, asAPI, time.Now())
-
-		switch data := roomRes.JSON.(type) {
-		case createRoomResponse:
-			roomID = data.RoomID
-
-			// tag the room, so we can later check if the user tries to reject an invite
-			serverAlertTag := gomatrix.TagContent{Tags: map[string]gomatrix.TagProperties{
-				"m.server_notice": {
-					Order: 1.0,
-				},
-			}}
-			if err = saveTagData(req, r.UserID, roomID, userAPI, serverAlertTag); err != nil {
-				util.GetLogger(ctx).WithError(err).Error("saveTagData failed")
-				return util.JSONResponse{
-					Code: http.StatusInternalServerError,
-					JSON: spec.InternalServerError{},
-				}
-			}
-
-		default:
-			// if we didn't get a createRoomResponse, we probably received an error, so return that.
-			return roomRes
-		}
-	} else {
-		// we've found a room in common, check the membership
-		deviceUserID, err := spec.NewUserID(r.UserID, true)
-		if err != nil {
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: spec.Forbidden("userID doesn't have power level to change visibility"),
-			}
-		}
-
-		roomID = commonRooms[0].String()
-		membershipRes := api.QueryMembershipForUserResponse{}
-		err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: *deviceUserID, RoomID: roomID}, &membershipRes)
-		if err != nil {
-			util.GetLogger(ctx).WithError(err).Error("unable to query membership for user")
-			return util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.InternalServerError{},
-			}
-		}
-		if !membershipRes.IsInRoom {
-			// re-invite the user
-			res, err := sendInvite(ctx, senderDevice, roomID, r.UserID, "Server notice room", cfgClient, rsAPI, time.Now())
-			if err != nil {
-				return res
-			}
-		}
+	roomID, resErr := getServerNoticeRoom(ctx, cfgNotices, cfgClient, userAPI, rsAPI, asAPI, senderDevice, *userID)
+	if resErr != nil {
+		return *resErr
 	}
 
 	startedGeneratingEvent := time.Now()
@@ -257,9 +142,8 @@ func SendServerNotice(
 		}
 	}
 	util.GetLogger(ctx).WithFields(logrus.Fields{
-		"event_id":     e.EventID(),
-		"room_id":      roomID,
-		"room_version": roomVersion,
+		"event_id": e.EventID(),
+		"room_id":  roomID,
 	}).Info("Sent event to roomserver")
 	timeToSubmitEvent := time.Since(startedSubmittingEvent)
 
@@ -280,6 +164,167 @@ func SendServerNotice(
 	return res
 }
 
+// getServerNoticeRoom returns the server notices room of the user, making sure
+// that they are in it. The room is created if they don't have one yet.
+func getServerNoticeRoom(
+	ctx context.Context,
+	cfgNotices *config.ServerNotices,
+	cfgClient *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+	userID spec.UserID,
+) (string, *util.JSONResponse) {
+	// get rooms for specified user
+	allUserRooms := []spec.RoomID{}
+	// Get rooms the user is either joined, invited or has left.
+	for _, membership := range []string{"join", "invite", "leave"} {
+		userRooms, queryErr := rsAPI.QueryRoomsForUser(ctx, userID, membership)
+		if queryErr != nil {
+			resErr := util.ErrorResponse(queryErr)
+			return "", &resErr
+		}
+		allUserRooms = append(allUserRooms, userRooms...)
+	}
+
+	// get rooms of the sender
+	senderUserID, err := spec.NewUserID(fmt.Sprintf("@%s:%s", cfgNotices.LocalPart, cfgClient.Matrix.ServerName), true)
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.Unknown("external server error"),
+		}
+	}
+	senderRooms, err := rsAPI.QueryRoomsForUser(ctx, *senderUserID, "join")
+	if err != nil {
+		resErr := util.ErrorResponse(err)
+		return "", &resErr
+	}
+
+	// check if we have rooms in common
+	commonRooms := []spec.RoomID{}
+	for _, userRoomID := range allUserRooms {
+		for _, senderRoomID := range senderRooms {
+			if userRoomID == senderRoomID {
+				commonRooms = append(commonRooms, senderRoomID)
+			}
+		}
+	}
+
+	if len(commonRooms) > 1 {
+		resErr := util.ErrorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
+		return "", &resErr
+	}
+
+	// we've found a room in common, check the membership
+	if len(commonRooms) == 1 {
+		roomID := commonRooms[0].String()
+		membershipRes := api.QueryMembershipForUserResponse{}
+		err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: userID, RoomID: roomID}, &membershipRes)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("unable to query membership for user")
+			return "", &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if !membershipRes.IsInRoom {
+			// re-invite the user
+			res, err := sendInvite(ctx, senderDevice, roomID, userID.String(), "Server notice room", cfgClient, rsAPI, time.Now())
+			if err != nil {
+				return "", &res
+			}
+		}
+		return roomID, nil
+	}
+
+	// create a new room for the user
+	powerLevelContent := eventutil.InitialPowerLevelsContent(senderUserID.String())
+	powerLevelContent.Users[userID.String()] = -10 // taken from Synapse
+	pl, err := json.Marshal(powerLevelContent)
+	if err != nil {
+		resErr := util.ErrorResponse(err)
+		return "", &resErr
+	}
+	createContent := map[string]interface{}{}
+	createContent["m.federate"] = false
+	cc, err := json.Marshal(createContent)
+	if err != nil {
+		resErr := util.ErrorResponse(err)
+		return "", &resErr
+	}
+	crReq := createRoomRequest{
+		Invite:                    []string{userID.String()},
+		Name:                      cfgNotices.RoomName,
+		Visibility:                "private",
+		Preset:                    spec.PresetPrivateChat,
+		CreationContent:           cc,
+		RoomVersion:               rsAPI.DefaultRoomVersion(),
+		PowerLevelContentOverride: pl,
+	}
+
+	roomRes := createRoom(ctx, crReq, senderDevice, cfgClient, userAPI, rsAPI, asAPI, time.Now())
+	data, ok := roomRes.JSON.(createRoomResponse)
+	if !ok {
+		// if we didn't get a createRoomResponse, we probably received an error, so return that.
+		return "", &roomRes
+	}
+
+	// tag the room, so we can later check if the user tries to reject an invite
+	serverAlertTag := gomatrix.TagContent{Tags: map[string]gomatrix.TagProperties{
+		"m.server_notice": {
+			Order: 1.0,
+		},
+	}}
+	if err = saveTagData(ctx, userID.String(), data.RoomID, userAPI, serverAlertTag); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("saveTagData failed")
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return data.RoomID, nil
+}
+
+// sendServerNoticeMessage sends a text message to the user in their server notices room.
+func sendServerNoticeMessage(
+	ctx context.Context,
+	cfgNotices *config.ServerNotices,
+	cfgClient *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+	userID spec.UserID,
+	body string,
+) error {
+	roomID, resErr := getServerNoticeRoom(ctx, cfgNotices, cfgClient, userAPI, rsAPI, asAPI, senderDevice, userID)
+	if resErr != nil {
+		return fmt.Errorf("failed to get server notices room: %+v", resErr.JSON)
+	}
+	request := map[string]interface{}{
+		"body":    body,
+		"msgtype": "m.text",
+	}
+	e, resErr := generateSendEvent(ctx, request, senderDevice, roomID, "m.room.message", nil, rsAPI, time.Now())
+	if resErr != nil {
+		return fmt.Errorf("failed to generate server notice: %+v", resErr.JSON)
+	}
+	return api.SendEvents(
+		ctx, rsAPI,
+		api.KindNew,
+		[]*types.HeaderedEvent{
+			{PDU: e},
+		},
+		senderDevice.UserDomain(),
+		cfgClient.Matrix.ServerName,
+		cfgClient.Matrix.ServerName,
+		nil,
+		false,
+	)
+}
+
 func (r sendServerNoticeRequest) valid() (ok bool) {
 	if r.UserID == "" {
 		return false
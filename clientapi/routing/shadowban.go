@@ -0,0 +1,28 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// Shadow-banned users get successful responses for the events they send, but
+// the events are dropped before they reach the roomserver, so they are never
+// stored or sent to other servers. The IDs in those responses are made up, and
+// look like the real ones so that the user can't tell they are banned.
+
+// shadowBannedEventID returns an ID for an event which was dropped because the
+// sender is shadow-banned, in the format of room version 4 and later.
+func shadowBannedEventID() string {
+	return "$" + util.RandomString(43)
+}
+
+// shadowBannedRoomID returns an ID for a room which was not created because the
+// creator is shadow-banned.
+func shadowBannedRoomID(serverName spec.ServerName) string {
+	return "!" + util.RandomString(18) + ":" + string(serverName)
+}
@@ -0,0 +1,249 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ike20013/dendrite/clientapi/auth/sso"
+	"github.com/ike20013/dendrite/clientapi/userutil"
+	"github.com/ike20013/dendrite/external"
+	"github.com/ike20013/dendrite/setup/config"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// ssoSessionCookie ties the browser which started an SSO login to the callback from
+// the identity provider, so that a login can't be finished in somebody else's browser.
+const ssoSessionCookie = "dendrite_sso_session"
+
+// SSORedirect implements GET /login/sso/redirect and /login/sso/redirect/{idpId}
+// https://spec.matrix.org/v1.7/client-server-api/#get_matrixclientv3loginssoredirect
+func SSORedirect(
+	req *http.Request, cfg *config.ClientAPI, authenticator *sso.Authenticator, idpID string,
+) util.JSONResponse {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if redirectURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("redirectUrl parameter missing"),
+		}
+	}
+	if u, err := url.Parse(redirectURL); err != nil || !u.IsAbs() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("redirectUrl must be an absolute URL"),
+		}
+	} else if !cfg.Login.SSO.IsClientRedirectAllowed(u) {
+		// Otherwise anybody could get a login token for a user who follows their link.
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("redirectUrl is not an allowed client"),
+		}
+	}
+
+	authURL, state, err := authenticator.StartLogin(req.Context(), idpID, redirectURL)
+	if errors.Is(err, sso.ErrUnknownProvider) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown identity provider"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("idp_id", idpID).Error("Failed to start SSO login")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown("Failed to contact the identity provider"),
+		}
+	}
+
+	cookie := &http.Cookie{
+		Name:     ssoSessionCookie,
+		Value:    state,
+		Path:     "/_matrix/client/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.Login.SSO.CallbackURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	return util.JSONResponse{
+		Code: http.StatusFound,
+		JSON: struct{}{},
+		Headers: map[string]string{
+			"Location":   authURL,
+			"Set-Cookie": cookie.String(),
+		},
+	}
+}
+
+// SSOCallback implements GET /login/sso/callback, where the identity provider sends
+// the user back to. Logs the user in, registering them on their first login, and
+// sends them back to the client with a login token for m.login.token.
+func SSOCallback(
+	req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, authenticator *sso.Authenticator,
+) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	query := req.URL.Query()
+	if idpErr := query.Get("error"); idpErr != "" {
+		logger.WithField("error", idpErr).WithField("error_description", query.Get("error_description")).Warn("Identity provider returned an error")
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: spec.Forbidden("The identity provider didn't log you in: " + idpErr),
+		}
+	}
+	state, code := query.Get("state"), query.Get("code")
+	if state == "" || code == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("state and code parameters are required"),
+		}
+	}
+	if cookie, err := req.Cookie(ssoSessionCookie); err != nil || cookie.Value != state {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Forbidden("The login was started in a different browser"),
+		}
+	}
+
+	identity, redirectURL, err := authenticator.FinishLogin(req.Context(), state, code)
+	if errors.Is(err, sso.ErrUnknownSession) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Forbidden("The login has expired, please try again"),
+		}
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to finish SSO login")
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: spec.Forbidden("The identity provider didn't log you in"),
+		}
+	}
+
+	userID, resErr := ssoAccount(req, cfg, userAPI, identity)
+	if resErr != nil {
+		return *resErr
+	}
+
+	var tokenRes userapi.PerformLoginTokenCreationResponse
+	if err = userAPI.PerformLoginTokenCreation(req.Context(), &userapi.PerformLoginTokenCreationRequest{
+		Data: userapi.LoginTokenData{UserID: userID},
+	}, &tokenRes); err != nil {
+		logger.WithError(err).Error("userAPI.PerformLoginTokenCreation failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// The redirect URL was checked against the allowed clients in SSORedirect.
+	u, _ := url.Parse(redirectURL)
+	q := u.Query()
+	q.Set("loginToken", tokenRes.Metadata.Token)
+	u.RawQuery = q.Encode()
+	cookie := &http.Cookie{
+		Name:   ssoSessionCookie,
+		Path:   "/_matrix/client/",
+		MaxAge: -1,
+	}
+	return util.JSONResponse{
+		Code: http.StatusFound,
+		JSON: struct{}{},
+		Headers: map[string]string{
+			"Location":   u.String(),
+			"Set-Cookie": cookie.String(),
+		},
+	}
+}
+
+// ssoAccount returns the user ID of the account which the identity belongs to. On the
+// first login, a new account is registered, unless the provider is allowed to log
+// in to existing accounts with the same localpart.
+func ssoAccount(
+	req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, identity *sso.Identity,
+) (string, *util.JSONResponse) {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("idp_id", identity.IDPID)
+
+	var queryRes userapi.QueryLocalpartForSSOResponse
+	if err := userAPI.QueryLocalpartForSSO(ctx, &userapi.QueryLocalpartForSSORequest{
+		IDPID:   identity.IDPID,
+		Subject: identity.Subject,
+	}, &queryRes); err != nil {
+		logger.WithError(err).Error("userAPI.QueryLocalpartForSSO failed")
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if queryRes.Localpart != "" {
+		return userutil.MakeUserID(queryRes.Localpart, queryRes.ServerName), nil
+	}
+
+	if identity.Localpart == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("The identity provider didn't provide a username"),
+		}
+	}
+	serverName := cfg.Matrix.ServerName
+	if err := external.ValidateUsername(identity.Localpart, serverName); err != nil {
+		return "", external.UsernameResponse(err)
+	}
+
+	var accRes userapi.PerformAccountCreationResponse
+	err := userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
+		AccountType: userapi.AccountTypeUser,
+		Localpart:   identity.Localpart,
+		ServerName:  serverName,
+		OnConflict:  userapi.ConflictAbort,
+	}, &accRes)
+	var conflict *userapi.ErrorConflict
+	switch {
+	case errors.As(err, &conflict):
+		if !ssoProviderAllowsExistingUsers(cfg, identity.IDPID) {
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.UserInUse("Desired user ID is already taken."),
+			}
+		}
+	case err != nil:
+		logger.WithError(err).Error("userAPI.PerformAccountCreation failed")
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	case identity.DisplayName != "":
+		if _, _, err = userAPI.SetDisplayName(ctx, identity.Localpart, serverName, identity.DisplayName); err != nil {
+			logger.WithError(err).Warn("Failed to set display name from identity provider")
+		}
+	}
+
+	if err = userAPI.PerformSaveSSOAssociation(ctx, &userapi.PerformSaveSSOAssociationRequest{
+		IDPID:      identity.IDPID,
+		Subject:    identity.Subject,
+		Localpart:  identity.Localpart,
+		ServerName: serverName,
+	}, &struct{}{}); err != nil {
+		logger.WithError(err).Error("userAPI.PerformSaveSSOAssociation failed")
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return userutil.MakeUserID(identity.Localpart, serverName), nil
+}
+
+func ssoProviderAllowsExistingUsers(cfg *config.ClientAPI, idpID string) bool {
+	for _, p := range cfg.Login.SSO.Providers {
+		if p.ID == idpID {
+			return p.AllowExistingUsers
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ike20013/dendrite/clientapi/auth/sso"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestSSORedirect(t *testing.T) {
+	// The identity provider only needs to be discovered to start a login.
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+		})
+	}))
+	defer provider.Close()
+
+	cfg := &config.ClientAPI{}
+	cfg.Login.SSO = config.SSO{
+		Enabled:            true,
+		CallbackURL:        "https://localhost/_matrix/client/v3/login/sso/callback",
+		ClientRedirectURLs: []string{"https://app.example.com/client/"},
+		Providers: []config.IdentityProvider{{
+			ID:       "example",
+			Issuer:   provider.URL,
+			ClientID: "dendrite",
+		}},
+	}
+	configErrs := &config.ConfigErrors{}
+	cfg.Login.SSO.Verify(configErrs)
+	if len(*configErrs) > 0 {
+		t.Fatalf("invalid config: %v", *configErrs)
+	}
+	authenticator := sso.NewAuthenticator(&cfg.Login.SSO, provider.Client())
+
+	testCases := []struct {
+		name        string
+		redirectURL string
+		wantCode    int
+		wantErrCode spec.MatrixErrorCode
+	}{
+		{name: "allowed client", redirectURL: "https://app.example.com/client/#/home", wantCode: http.StatusFound},
+		{name: "unlisted host", redirectURL: "https://evil.example.com/client/", wantCode: http.StatusBadRequest, wantErrCode: spec.ErrorInvalidParam},
+		{name: "host with an allowed prefix", redirectURL: "https://app.example.com.evil.example.com/client/", wantCode: http.StatusBadRequest, wantErrCode: spec.ErrorInvalidParam},
+		{name: "unlisted path", redirectURL: "https://app.example.com/other/", wantCode: http.StatusBadRequest, wantErrCode: spec.ErrorInvalidParam},
+		{name: "unlisted scheme", redirectURL: "http://app.example.com/client/", wantCode: http.StatusBadRequest, wantErrCode: spec.ErrorInvalidParam},
+		{name: "relative URL", redirectURL: "/client/", wantCode: http.StatusBadRequest, wantErrCode: spec.ErrorInvalidParam},
+		{name: "missing URL", wantCode: http.StatusBadRequest, wantErrCode: spec.ErrorMissingParam},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v3/login/sso/redirect?redirectUrl="+url.QueryEscape(tc.redirectURL), nil)
+			res := SSORedirect(req, cfg, authenticator, "")
+			if res.Code != tc.wantCode {
+				t.Fatalf("expected HTTP %d, got %d: %+v", tc.wantCode, res.Code, res.JSON)
+			}
+			if tc.wantErrCode != "" {
+				matrixErr, ok := res.JSON.(spec.MatrixError)
+				if !ok || matrixErr.ErrCode != tc.wantErrCode {
+					t.Fatalf("expected %s, got %+v", tc.wantErrCode, res.JSON)
+				}
+			}
+		})
+	}
+}
@@ -7,11 +7,14 @@
 package routing
 
 import (
+	"errors"
 	"net/http"
+	"net/mail"
 
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
 	"github.com/ike20013/dendrite/clientapi/httputil"
 	"github.com/ike20013/dendrite/clientapi/threepid"
+	"github.com/ike20013/dendrite/external/email"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/userapi/api"
 	userdb "github.com/ike20013/dendrite/userapi/storage"
@@ -22,8 +25,19 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// errorThreePIDNotFound is returned when resetting the password for an email
+// address which isn't associated with any account.
+const errorThreePIDNotFound spec.MatrixErrorCode = "M_THREEPID_NOT_FOUND"
+
 type reqTokenResponse struct {
-	SID string `json:"sid"`
+	SID       string `json:"sid"`
+	SubmitURL string `json:"submit_url,omitempty"`
+}
+
+type submitTokenRequest struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
 }
 
 type ThreePIDsResponse struct {
@@ -34,7 +48,14 @@ type ThreePIDsResponse struct {
 //
 //	POST /account/3pid/email/requestToken
 //	POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *config.ClientAPI, client *fclient.Client) util.JSONResponse {
+//	POST /account/password/email/requestToken
+//
+// If the server sends emails itself, the validator is non-nil and sends the
+// email using the template. Otherwise the identity server in the request does.
+func RequestEmailToken(
+	req *http.Request, threePIDAPI api.ClientUserAPI, cfg *config.ClientAPI, client *fclient.Client,
+	validator *threepid.LocalValidator, tmpl email.Template,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
@@ -58,7 +79,25 @@ func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *co
 		}
 	}
 
-	if len(res.Localpart) > 0 {
+	if tmpl == email.TemplatePasswordReset {
+		// Only the server can tell whether the address belongs to an account,
+		// so password resets can't be delegated to an identity server.
+		if validator == nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("Password resets via email are not enabled on this server"),
+			}
+		}
+		if len(res.Localpart) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MatrixError{
+					ErrCode: errorThreePIDNotFound,
+					Err:     "Email address is not associated with an account",
+				},
+			}
+		}
+	} else if len(res.Localpart) > 0 {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: spec.MatrixError{
@@ -68,6 +107,34 @@ func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *co
 		}
 	}
 
+	if validator != nil {
+		if body.Secret == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MissingParam("Missing client_secret"),
+			}
+		}
+		if _, err = mail.ParseAddress(body.Email); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("Invalid email address"),
+			}
+		}
+		resp.SID, err = validator.RequestToken(req.Context(), body, tmpl)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("validator.RequestToken failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		resp.SubmitURL = validator.SubmitURL()
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: resp,
+		}
+	}
+
 	resp.SID, err = threepid.CreateSession(req.Context(), body, cfg, client)
 	switch err.(type) {
 	case nil:
@@ -94,13 +161,36 @@ func RequestEmailToken(req *http.Request, threePIDAPI api.ClientUserAPI, cfg *co
 // CheckAndSave3PIDAssociation implements POST /account/3pid
 func CheckAndSave3PIDAssociation(
 	req *http.Request, threePIDAPI api.ClientUserAPI, device *api.Device,
-	cfg *config.ClientAPI, client *fclient.Client,
+	cfg *config.ClientAPI, client *fclient.Client, validator *threepid.LocalValidator,
 ) util.JSONResponse {
 	var body threepid.EmailAssociationCheckRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
+	// Sessions created by this server are checked locally, and can't be
+	// published on an identity server.
+	if validator != nil && body.Creds.IDServer == "" {
+		address, err := validator.ValidatedAddress(body.Creds.SID, body.Creds.Secret)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MatrixError{
+					ErrCode: spec.ErrorThreePIDAuthFailed,
+					Err:     "Failed to auth 3pid: " + err.Error(),
+				},
+			}
+		}
+		if resErr := save3PIDAssociation(req, threePIDAPI, device.UserID, address, "email"); resErr != nil {
+			return *resErr
+		}
+		validator.Forget(body.Creds.SID)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	// Check if the association has been validated
 	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg, client)
 	switch err.(type) {
@@ -141,11 +231,24 @@ func CheckAndSave3PIDAssociation(
 		}
 	}
 
-	// Save the association in the database
-	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if resErr := save3PIDAssociation(req, threePIDAPI, device.UserID, address, medium); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// save3PIDAssociation saves the association of the 3PID with the user in the database.
+func save3PIDAssociation(
+	req *http.Request, threePIDAPI api.ClientUserAPI, userID, address, medium string,
+) *util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
-		return util.JSONResponse{
+		return &util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: spec.InternalServerError{},
 		}
@@ -156,17 +259,70 @@ func CheckAndSave3PIDAssociation(
 		Localpart:  localpart,
 		ServerName: domain,
 		Medium:     medium,
-	}, &struct{}{}); err != nil {
+	}, &struct{}{}); errors.Is(err, userdb.Err3PIDInUse) {
+		// The address was associated with another account after the token was requested.
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDInUse,
+				Err:     userdb.Err3PIDInUse.Error(),
+			},
+		}
+	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformSaveThreePIDAssociation failed")
-		return util.JSONResponse{
+		return &util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: spec.InternalServerError{},
 		}
 	}
+	return nil
+}
 
+// SubmitEmailToken implements POST /email/submit_token, which clients can use
+// to submit the token from a validation email.
+func SubmitEmailToken(req *http.Request, validator *threepid.LocalValidator) util.JSONResponse {
+	var body submitTokenRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if err := validator.SubmitToken(body.SID, body.ClientSecret, body.Token); err != nil {
+		if errors.Is(err, threepid.ErrSessionNotFound) || errors.Is(err, threepid.ErrInvalidToken) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MatrixError{
+					ErrCode: spec.ErrorThreePIDAuthFailed,
+					Err:     err.Error(),
+				},
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("validator.SubmitToken failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: map[string]bool{"success": true},
+	}
+}
+
+// SubmitEmailTokenLink implements GET /email/submit_token, which is where the
+// links in validation emails lead to.
+func SubmitEmailTokenLink(w http.ResponseWriter, req *http.Request, validator *threepid.LocalValidator) {
+	query := req.URL.Query()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	err := validator.SubmitToken(query.Get("sid"), query.Get("client_secret"), query.Get("token"))
+	switch {
+	case err == nil:
+		writeHTTPMessage(w, req, "Your email address has been validated. You can return to your client to continue.", http.StatusOK)
+	case errors.Is(err, threepid.ErrSessionNotFound):
+		writeHTTPMessage(w, req, "This link has expired or is invalid. Please request a new email.", http.StatusBadRequest)
+	case errors.Is(err, threepid.ErrInvalidToken):
+		writeHTTPMessage(w, req, "This link is invalid. Please request a new email.", http.StatusBadRequest)
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("validator.SubmitToken failed")
+		writeHTTPMessage(w, req, "Failed to validate your email address.", http.StatusInternalServerError)
 	}
 }
 
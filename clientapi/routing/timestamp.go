@@ -0,0 +1,143 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	federationAPI "github.com/ike20013/dendrite/federationapi/api"
+	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// TimestampToEvent implements GET /rooms/{roomID}/timestamp_to_event, which finds
+// the event closest to a timestamp. If we might be missing events around the one
+// we know of, the other servers in the room are asked whether they know of a
+// closer one.
+func TimestampToEvent(
+	req *http.Request, device *userapi.Device, roomIDStr string,
+	rsAPI roomserverAPI.ClientRoomserverAPI, fsAPI federationAPI.ClientFederationAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	roomID, err := spec.NewRoomID(roomIDStr)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+	parsedTS, err := strconv.ParseUint(req.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("ts must be a timestamp in milliseconds"),
+		}
+	}
+	ts := spec.Timestamp(parsedTS)
+	dir := req.URL.Query().Get("dir")
+	if dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("dir must be either 'f' or 'b'"),
+		}
+	}
+	backwards := dir == "b"
+
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Device UserID is invalid"),
+		}
+	}
+	if resErr := checkMemberInRoom(ctx, rsAPI, *userID, roomID.String()); resErr != nil {
+		return *resErr
+	}
+
+	logger := util.GetLogger(ctx).WithField("room_id", roomID.String())
+	local, err := rsAPI.QueryTimestampToEvent(ctx, *roomID, ts, backwards)
+	if err != nil {
+		logger.WithError(err).Error("rsAPI.QueryTimestampToEvent failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	var res *federationAPI.TimestampToEventResponse
+	if local != nil {
+		res = &federationAPI.TimestampToEventResponse{
+			EventID:        local.EventID,
+			OriginServerTS: local.OriginServerTS,
+		}
+	}
+	if local == nil || local.NextToGap {
+		if remote := timestampToEventOverFederation(req, device, *roomID, ts, backwards, rsAPI, fsAPI); remote != nil {
+			if res == nil || timestampDistance(ts, remote.OriginServerTS) < timestampDistance(ts, res.OriginServerTS) {
+				res = remote
+			}
+		}
+	}
+
+	if res == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unable to find an event in the given direction"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// timestampToEventOverFederation asks the servers in the room for the event closest
+// to the timestamp, returning the answer of the first one which has one.
+func timestampToEventOverFederation(
+	req *http.Request, device *userapi.Device, roomID spec.RoomID, ts spec.Timestamp, backwards bool,
+	rsAPI roomserverAPI.ClientRoomserverAPI, fsAPI federationAPI.ClientFederationAPI,
+) *federationAPI.TimestampToEventResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("room_id", roomID.String())
+	roomVersion, err := rsAPI.QueryRoomVersionForRoom(ctx, roomID.String())
+	if err != nil {
+		logger.WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
+		return nil
+	}
+	var hostsRes federationAPI.QueryJoinedHostServerNamesInRoomResponse
+	if err = fsAPI.QueryJoinedHostServerNamesInRoom(ctx, &federationAPI.QueryJoinedHostServerNamesInRoomRequest{
+		RoomID:             roomID.String(),
+		ExcludeSelf:        true,
+		ExcludeBlacklisted: true,
+	}, &hostsRes); err != nil {
+		logger.WithError(err).Error("fsAPI.QueryJoinedHostServerNamesInRoom failed")
+		return nil
+	}
+	for _, serverName := range hostsRes.ServerNames {
+		event, err := fsAPI.TimestampToEvent(ctx, device.UserDomain(), serverName, roomID, roomVersion, ts, backwards)
+		if err != nil {
+			logger.WithError(err).WithField("server_name", serverName).Warn("Failed to ask server for event closest to timestamp")
+			continue
+		}
+		if event != nil {
+			return &federationAPI.TimestampToEventResponse{
+				EventID:        event.EventID(),
+				OriginServerTS: event.OriginServerTS(),
+			}
+		}
+	}
+	return nil
+}
+
+func timestampDistance(a, b spec.Timestamp) spec.Timestamp {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
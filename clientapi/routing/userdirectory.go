@@ -14,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/roomserver/api"
 	userapi "github.com/ike20013/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrix"
@@ -37,6 +38,7 @@ func SearchUserDirectory(
 	limit int,
 	federation fclient.FederationClient,
 	localServerName spec.ServerName,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	if limit < 10 {
 		limit = 10
@@ -121,6 +123,13 @@ knownUsersLoop:
 	}
 
 	for _, result := range results {
+		if spamChecker != nil && spamChecker.CheckUsernameForSpam(ctx, spamcheck.UserProfile{
+			UserID:      result.UserID,
+			DisplayName: result.DisplayName,
+			AvatarURL:   result.AvatarURL,
+		}) != nil {
+			continue
+		}
 		response.Results = append(response.Results, result)
 	}
 
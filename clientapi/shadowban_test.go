@@ -0,0 +1,194 @@
+package clientapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/nats-io/nats.go"
+	"github.com/tidwall/gjson"
+
+	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/eventutil"
+	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/external/transactions"
+	"github.com/ike20013/dendrite/roomserver"
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/test"
+	"github.com/ike20013/dendrite/test/testrig"
+	"github.com/ike20013/dendrite/userapi"
+	uapi "github.com/ike20013/dendrite/userapi/api"
+)
+
+func TestShadowBan(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	room := test.NewRoom(t, aliceAdmin)
+	// Bob may send state events, so that only the shadow-ban stops them.
+	powerLevels := eventutil.InitialPowerLevelsContent(aliceAdmin.ID)
+	powerLevels.Users[bob.ID] = 50
+	room.CreateAndInsert(t, aliceAdmin, spec.MRoomPowerLevels, powerLevels, test.WithStateKey(""))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, transactions.New(), nil, userAPI, nil, nil, nil, caching.DisableMetrics)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", api.DoNotSendToOtherServers, nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		accessTokens := map[*test.User]userDevice{
+			aliceAdmin: {},
+			bob:        {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		do := func(router http.Handler, user *test.User, method, path, body string) *httptest.ResponseRecorder {
+			t.Helper()
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+accessTokens[user].accessToken)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s %s: expected http status %d, got %d: %s", method, path, http.StatusOK, rec.Code, rec.Body.String())
+			}
+			return rec
+		}
+
+		rec := do(routers.DendriteAdmin, aliceAdmin, http.MethodPost, "/_dendrite/admin/shadowBan/"+bob.ID, "")
+		if !gjson.GetBytes(rec.Body.Bytes(), "shadow_banned").Bool() {
+			t.Fatalf("expected bob to be shadow-banned: %s", rec.Body.String())
+		}
+
+		// Everything that is sent to the roomserver, or to the sync API and federation
+		// as typing notifications, goes through these subjects.
+		_, natsClient := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+		msgs := make(chan *nats.Msg, 64)
+		for _, subj := range []string{
+			cfg.Global.JetStream.Prefixed(jetstream.InputRoomEvent) + ".>",
+			cfg.Global.JetStream.Prefixed(jetstream.OutputTypingEvent),
+		} {
+			sub, err := natsClient.ChanSubscribe(subj, msgs)
+			if err != nil {
+				t.Fatalf("failed to subscribe to %s: %v", subj, err)
+			}
+			defer sub.Unsubscribe() // nolint: errcheck
+		}
+		assertNoMessages := func(t *testing.T) {
+			t.Helper()
+			if err := natsClient.Flush(); err != nil {
+				t.Fatalf("failed to flush: %v", err)
+			}
+			if len(msgs) > 0 {
+				t.Fatalf("expected nothing to be sent, got %d messages, the first on %s", len(msgs), (<-msgs).Subject)
+			}
+		}
+
+		t.Run("messages are dropped", func(t *testing.T) {
+			path := "/_matrix/client/v3/rooms/" + room.ID + "/send/m.room.message/txn1"
+			rec := do(routers.Client, bob, http.MethodPut, path, `{"msgtype":"m.text","body":"spam"}`)
+			eventID := gjson.GetBytes(rec.Body.Bytes(), "event_id").Str
+			if !strings.HasPrefix(eventID, "$") {
+				t.Fatalf("expected an event ID, got %s", rec.Body.String())
+			}
+			// Retrying the transaction returns the same event ID.
+			rec = do(routers.Client, bob, http.MethodPut, path, `{"msgtype":"m.text","body":"spam"}`)
+			if retryEventID := gjson.GetBytes(rec.Body.Bytes(), "event_id").Str; retryEventID != eventID {
+				t.Fatalf("expected event ID %s for the retried transaction, got %s", eventID, retryEventID)
+			}
+			assertNoMessages(t)
+		})
+
+		t.Run("state events are dropped", func(t *testing.T) {
+			rec := do(routers.Client, bob, http.MethodPut, "/_matrix/client/v3/rooms/"+room.ID+"/state/m.room.topic/", `{"topic":"spam"}`)
+			if !strings.HasPrefix(gjson.GetBytes(rec.Body.Bytes(), "event_id").Str, "$") {
+				t.Fatalf("expected an event ID, got %s", rec.Body.String())
+			}
+			assertNoMessages(t)
+		})
+
+		t.Run("typing notifications are dropped", func(t *testing.T) {
+			do(routers.Client, bob, http.MethodPut, "/_matrix/client/v3/rooms/"+room.ID+"/typing/"+bob.ID, `{"typing":true,"timeout":30000}`)
+			assertNoMessages(t)
+		})
+
+		t.Run("invites are dropped", func(t *testing.T) {
+			do(routers.Client, bob, http.MethodPost, "/_matrix/client/v3/rooms/"+room.ID+"/invite", `{"user_id":"`+charlie.ID+`"}`)
+			assertNoMessages(t)
+
+			res := &api.QueryMembershipForUserResponse{}
+			if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+				RoomID: room.ID,
+				UserID: spec.NewUserIDOrPanic(charlie.ID, true),
+			}, res); err != nil {
+				t.Fatalf("failed to query membership: %v", err)
+			}
+			if res.Membership == spec.Invite {
+				t.Fatalf("expected charlie not to be invited")
+			}
+		})
+
+		t.Run("rooms are not created", func(t *testing.T) {
+			rec := do(routers.Client, bob, http.MethodPost, "/_matrix/client/v3/createRoom", `{"name":"spam"}`)
+			roomID := gjson.GetBytes(rec.Body.Bytes(), "room_id").Str
+			if _, err := spec.NewRoomID(roomID); err != nil {
+				t.Fatalf("expected a room ID, got %s", rec.Body.String())
+			}
+			assertNoMessages(t)
+			if _, err := rsAPI.QueryRoomVersionForRoom(ctx, roomID); err == nil {
+				t.Fatalf("expected room %s not to exist", roomID)
+			}
+		})
+
+		t.Run("redactions are dropped", func(t *testing.T) {
+			bobJoin := room.Events()[len(room.Events())-1]
+			path := "/_matrix/client/v3/rooms/" + room.ID + "/redact/" + bobJoin.EventID() + "/txn3"
+			rec := do(routers.Client, bob, http.MethodPut, path, `{"reason":"spam"}`)
+			eventID := gjson.GetBytes(rec.Body.Bytes(), "event_id").Str
+			if !strings.HasPrefix(eventID, "$") {
+				t.Fatalf("expected an event ID, got %s", rec.Body.String())
+			}
+			// Retrying the transaction returns the same event ID.
+			rec = do(routers.Client, bob, http.MethodPut, path, `{"reason":"spam"}`)
+			if retryEventID := gjson.GetBytes(rec.Body.Bytes(), "event_id").Str; retryEventID != eventID {
+				t.Fatalf("expected event ID %s for the retried transaction, got %s", eventID, retryEventID)
+			}
+			assertNoMessages(t)
+		})
+
+		t.Run("events are sent once the ban is lifted", func(t *testing.T) {
+			rec := do(routers.DendriteAdmin, aliceAdmin, http.MethodDelete, "/_dendrite/admin/shadowBan/"+bob.ID, "")
+			if gjson.GetBytes(rec.Body.Bytes(), "shadow_banned").Bool() {
+				t.Fatalf("expected bob not to be shadow-banned: %s", rec.Body.String())
+			}
+			do(routers.Client, bob, http.MethodPut, "/_matrix/client/v3/rooms/"+room.ID+"/send/m.room.message/txn2", `{"msgtype":"m.text","body":"hello"}`)
+			if err := natsClient.Flush(); err != nil {
+				t.Fatalf("failed to flush: %v", err)
+			}
+			if len(msgs) == 0 {
+				t.Fatalf("expected the event to be sent to the roomserver")
+			}
+		})
+	})
+}
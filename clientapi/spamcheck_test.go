@@ -0,0 +1,96 @@
+package clientapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/external/transactions"
+	"github.com/ike20013/dendrite/roomserver"
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/test"
+	"github.com/ike20013/dendrite/test/testrig"
+	"github.com/ike20013/dendrite/userapi"
+)
+
+func TestSpamChecker(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	checker, err := spamcheck.New(&config.SpamChecker{
+		Enabled:           true,
+		BlockedUsers:      []string{"^" + bob.ID + "$"},
+		EventBodyPatterns: []string{"(?i)buy cheap"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create the spam checker: %v", err)
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, checker, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		rsAPI.SetUserAPI(userAPI)
+		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, transactions.New(), nil, userAPI, nil, nil, checker, caching.DisableMetrics)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", api.DoNotSendToOtherServers, nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+			bob:   {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		do := func(t *testing.T, user *test.User, method, path, body string, wantCode int) *httptest.ResponseRecorder {
+			t.Helper()
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+accessTokens[user].accessToken)
+			rec := httptest.NewRecorder()
+			routers.Client.ServeHTTP(rec, req)
+			if rec.Code != wantCode {
+				t.Fatalf("%s %s: expected http status %d, got %d: %s", method, path, wantCode, rec.Code, rec.Body.String())
+			}
+			return rec
+		}
+
+		t.Run("messages are checked", func(t *testing.T) {
+			path := "/_matrix/client/v3/rooms/" + room.ID + "/send/m.room.message/"
+			do(t, alice, http.MethodPut, path+"txn1", `{"msgtype":"m.text","body":"hello"}`, http.StatusOK)
+			rec := do(t, alice, http.MethodPut, path+"txn2", `{"msgtype":"m.text","body":"Buy cheap watches"}`, http.StatusForbidden)
+			if gjson.GetBytes(rec.Body.Bytes(), "errcode").Str != "M_FORBIDDEN" {
+				t.Fatalf("expected M_FORBIDDEN, got %s", rec.Body.String())
+			}
+		})
+
+		t.Run("room creation is checked", func(t *testing.T) {
+			do(t, alice, http.MethodPost, "/_matrix/client/v3/createRoom", `{}`, http.StatusOK)
+			do(t, bob, http.MethodPost, "/_matrix/client/v3/createRoom", `{}`, http.StatusForbidden)
+		})
+
+		t.Run("joins are checked", func(t *testing.T) {
+			do(t, bob, http.MethodPost, "/_matrix/client/v3/rooms/"+room.ID+"/join", `{}`, http.StatusForbidden)
+		})
+	})
+}
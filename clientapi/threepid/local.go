@@ -0,0 +1,195 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package threepid
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ike20013/dendrite/external/email"
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// SubmitTokenPath is where the links in validation emails lead to, relative to
+// the client base URL.
+const SubmitTokenPath = "/_matrix/client/v3/email/submit_token"
+
+var (
+	// ErrSessionNotFound is returned for unknown or expired sessions, or if the
+	// client secret doesn't match.
+	ErrSessionNotFound = errors.New("validation session not found")
+	// ErrSessionNotValidated is returned if the user hasn't followed the link yet.
+	ErrSessionNotValidated = errors.New("email address has not been validated")
+	// ErrInvalidToken is returned if the token doesn't match the session.
+	ErrInvalidToken = errors.New("invalid validation token")
+)
+
+// LocalValidator validates email addresses by sending emails with tokens
+// itself, rather than delegating that to an identity server. Sessions are
+// kept in memory, so they don't survive restarts.
+type LocalValidator struct {
+	cfg    *config.Email
+	mailer *email.Mailer
+
+	mu       sync.Mutex
+	sessions map[string]*localSession // sid -> session
+}
+
+type localSession struct {
+	clientSecret string
+	address      string
+	token        string
+	sendAttempt  int
+	validated    bool
+	expires      time.Time
+}
+
+// NewLocalValidator returns a validator sending emails through the configured SMTP server.
+func NewLocalValidator(cfg *config.Email) (*LocalValidator, error) {
+	mailer, err := email.NewMailer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalValidator{
+		cfg:      cfg,
+		mailer:   mailer,
+		sessions: map[string]*localSession{},
+	}, nil
+}
+
+// SubmitURL is where clients can submit the token instead of users following the link.
+func (v *LocalValidator) SubmitURL() string {
+	return strings.TrimSuffix(v.cfg.ClientBaseURL, "/") + SubmitTokenPath
+}
+
+// RequestToken starts validating the email address and sends the email, unless
+// the client already asked for one with the same client secret and a send
+// attempt at least as high. Returns the ID of the session.
+func (v *LocalValidator) RequestToken(ctx context.Context, req EmailAssociationRequest, tmpl email.Template) (string, error) {
+	v.mu.Lock()
+	v.removeExpired()
+	for sid, session := range v.sessions {
+		if session.clientSecret != req.Secret || session.address != req.Email {
+			continue
+		}
+		if req.SendAttempt <= session.sendAttempt {
+			v.mu.Unlock()
+			return sid, nil
+		}
+		session.sendAttempt = req.SendAttempt
+		token := session.token
+		v.mu.Unlock()
+		return sid, v.send(ctx, sid, req, token, tmpl)
+	}
+	sid, err := randomString(16)
+	if err != nil {
+		v.mu.Unlock()
+		return "", err
+	}
+	token, err := randomString(32)
+	if err != nil {
+		v.mu.Unlock()
+		return "", err
+	}
+	v.sessions[sid] = &localSession{
+		clientSecret: req.Secret,
+		address:      req.Email,
+		token:        token,
+		sendAttempt:  req.SendAttempt,
+		expires:      time.Now().Add(v.cfg.ValidationTokenLifetime),
+	}
+	v.mu.Unlock()
+
+	if err = v.send(ctx, sid, req, token, tmpl); err != nil {
+		v.Forget(sid)
+		return "", err
+	}
+	return sid, nil
+}
+
+func (v *LocalValidator) send(ctx context.Context, sid string, req EmailAssociationRequest, token string, tmpl email.Template) error {
+	query := url.Values{}
+	query.Set("sid", sid)
+	query.Set("client_secret", req.Secret)
+	query.Set("token", token)
+	return v.mailer.Send(ctx, req.Email, tmpl, email.TemplateData{
+		Address: req.Email,
+		Link:    v.SubmitURL() + "?" + query.Encode(),
+	})
+}
+
+// SubmitToken marks the email address of the session as validated if the token matches.
+func (v *LocalValidator) SubmitToken(sid, clientSecret, token string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	session, err := v.session(sid, clientSecret)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(session.token), []byte(token)) != 1 {
+		return ErrInvalidToken
+	}
+	session.validated = true
+	return nil
+}
+
+// ValidatedAddress returns the email address of the session if it has been validated.
+func (v *LocalValidator) ValidatedAddress(sid, clientSecret string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	session, err := v.session(sid, clientSecret)
+	if err != nil {
+		return "", err
+	}
+	if !session.validated {
+		return "", ErrSessionNotValidated
+	}
+	return session.address, nil
+}
+
+// Forget removes the session, e.g. once the validated address has been used.
+func (v *LocalValidator) Forget(sid string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.sessions, sid)
+}
+
+// session returns the session if it exists and hasn't expired. The lock must be held.
+func (v *LocalValidator) session(sid, clientSecret string) (*localSession, error) {
+	session, ok := v.sessions[sid]
+	if !ok || time.Now().After(session.expires) {
+		return nil, ErrSessionNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(session.clientSecret), []byte(clientSecret)) != 1 {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// removeExpired removes the sessions which expired. The lock must be held.
+func (v *LocalValidator) removeExpired() {
+	now := time.Now()
+	for sid, session := range v.sessions {
+		if now.After(session.expires) {
+			delete(v.sessions, sid)
+		}
+	}
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
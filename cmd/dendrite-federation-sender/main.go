@@ -0,0 +1,73 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package main
+
+import (
+	"flag"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/external"
+	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/federationapi"
+	"github.com/ike20013/dendrite/setup"
+	basepkg "github.com/ike20013/dendrite/setup/base"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/setup/process"
+)
+
+var shardIndex = flag.Int("shard-index", -1, "The federation sender shard to run, overriding federation_api.sender_sharding.index")
+
+// dendrite-federation-sender sends federation traffic for one shard of the remote
+// servers, alongside a Dendrite process running everything else. Both must share
+// the configuration file, the NATS server and the federation API database.
+func main() {
+	cfg := setup.ParseFlags(true)
+	if *shardIndex >= 0 {
+		cfg.FederationAPI.SenderSharding.Index = *shardIndex
+	}
+
+	configErrors := &config.ConfigErrors{}
+	cfg.Verify(configErrors)
+	if cfg.FederationAPI.SenderSharding.Shards < 2 {
+		configErrors.Add("federation_api.sender_sharding.shards must be at least 2 to run a separate federation sender")
+	}
+	if len(*configErrors) > 0 {
+		for _, err := range *configErrors {
+			logrus.Errorf("Configuration error: %s", err)
+		}
+		logrus.Fatalf("Failed to start due to configuration errors")
+	}
+	processCtx := process.NewProcessContext()
+
+	external.SetupStdLogging()
+	external.SetupHookLogging(cfg.Logging)
+
+	basepkg.PlatformSanityChecks()
+
+	logrus.Infof("Dendrite federation sender version %s", external.VersionString())
+
+	var dnsCache *fclient.DNSCache
+	if cfg.Global.DNSCache.Enabled {
+		dnsCache = fclient.NewDNSCache(
+			cfg.Global.DNSCache.CacheSize,
+			cfg.Global.DNSCache.CacheLifetime,
+			cfg.FederationAPI.AllowNetworkCIDRs,
+			cfg.FederationAPI.DenyNetworkCIDRs,
+		)
+	}
+	federationClient := basepkg.CreateFederationClient(cfg, dnsCache)
+
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, caching.EnableMetrics)
+	natsInstance := jetstream.NATSInstance{}
+	federationapi.NewFederationSender(processCtx, cfg, cm, &natsInstance, federationClient, caches)
+
+	basepkg.WaitForShutdown(processCtx)
+}
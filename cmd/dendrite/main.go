@@ -15,6 +15,7 @@ import (
 	"github.com/ike20013/dendrite/external"
 	"github.com/ike20013/dendrite/external/caching"
 	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/setup/jetstream"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -135,6 +136,11 @@ func main() {
 		}()
 	}
 
+	spamChecker, err := spamcheck.New(&cfg.Global.SpamChecker)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to set up the spam checker")
+	}
+
 	federationClient := basepkg.CreateFederationClient(cfg, dnsCache)
 	httpClient := basepkg.CreateClient(cfg, dnsCache)
 
@@ -144,7 +150,7 @@ func main() {
 
 	caches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, caching.EnableMetrics)
 	natsInstance := jetstream.NATSInstance{}
-	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.EnableMetrics)
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, spamChecker, caching.EnableMetrics)
 	fsAPI := federationapi.NewInternalAPI(
 		processCtx, cfg, cm, &natsInstance, federationClient, rsAPI, caches, nil, false,
 	)
@@ -174,6 +180,7 @@ func main() {
 		FederationAPI: fsAPI,
 		RoomserverAPI: rsAPI,
 		UserAPI:       userAPI,
+		SpamChecker:   spamChecker,
 	}
 	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
 
@@ -78,6 +78,9 @@ func main() {
 			// don't hit matrix.org when running tests!!!
 			cfg.FederationAPI.KeyPerspectives = config.KeyPerspectives{}
 			cfg.MediaAPI.BasePath = config.Path(filepath.Join(*dirPath, "media"))
+			cfg.MediaAPI.URLPreviews.Enabled = true
+			cfg.MediaAPI.URLPreviews.DenyNetworkCIDRs = []string{}
+			cfg.MediaAPI.URLPreviews.AllowNetworkCIDRs = []string{}
 			cfg.MSCs.MSCs = []string{"msc2836", "msc2444", "msc2753"}
 			cfg.Logging[0].Level = "trace"
 			cfg.Logging[0].Type = "std"
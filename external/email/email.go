@@ -0,0 +1,192 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package email sends emails rendered from templates through an SMTP server.
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// defaultTimeout limits how long sending an email may take if the context
+// has no deadline.
+const defaultTimeout = 30 * time.Second
+
+// Mailer sends emails through the configured SMTP server.
+type Mailer struct {
+	cfg       *config.Email
+	from      *mail.Address
+	templates map[Template]*templateSet
+}
+
+// NewMailer parses the templates and the sender address. No connection is made
+// to the SMTP server until an email is sent.
+func NewMailer(cfg *config.Email) (*Mailer, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+	templates, err := loadTemplates(cfg.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Mailer{
+		cfg:       cfg,
+		from:      from,
+		templates: templates,
+	}, nil
+}
+
+// Send renders the template with the data and sends the result to the address.
+func (m *Mailer) Send(ctx context.Context, to string, tmpl Template, data TemplateData) error {
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+	set, ok := m.templates[tmpl]
+	if !ok {
+		return fmt.Errorf("unknown email template %q", tmpl)
+	}
+	data.AppName = m.cfg.AppName
+	subject, text, html, err := set.render(data)
+	if err != nil {
+		return fmt.Errorf("failed to render email template %q: %w", tmpl, err)
+	}
+	msg, err := m.buildMessage(toAddr, subject, text, html)
+	if err != nil {
+		return err
+	}
+	return m.send(ctx, toAddr.Address, msg)
+}
+
+// buildMessage returns a multipart/alternative message with the text and HTML bodies.
+func (m *Mailer) buildMessage(to *mail.Address, subject string, text, html []byte) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=UTF-8", text},
+		{"text/html; charset=UTF-8", html},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err = qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	messageID := make([]byte, 16)
+	if _, err := rand.Read(messageID); err != nil {
+		return nil, err
+	}
+	domain := m.from.Address[strings.LastIndex(m.from.Address, "@")+1:]
+
+	var msg bytes.Buffer
+	for _, header := range []struct{ key, value string }{
+		{"From", m.from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("UTF-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(messageID) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + strconv.Quote(mw.Boundary())},
+	} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header.key, header.value)
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// send delivers the message to the SMTP server, upgrading the connection with
+// StartTLS if the server supports it.
+func (m *Mailer) send(ctx context.Context, to string, msg []byte) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	addr := net.JoinHostPort(m.cfg.SMTPHost, strconv.Itoa(m.cfg.SMTPPort))
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, m.cfg.SMTPHost)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	defer c.Close() // nolint: errcheck
+
+	if ok, _ = c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: m.cfg.SMTPHost}); err != nil {
+			return fmt.Errorf("StartTLS failed: %w", err)
+		}
+	} else if m.cfg.RequireTransportSecurity {
+		return errors.New("SMTP server doesn't support StartTLS")
+	}
+	if m.cfg.SMTPUser != "" {
+		if ok, _ = c.Extension("AUTH"); !ok {
+			return errors.New("SMTP server doesn't support authentication")
+		}
+		if err = c.Auth(smtp.PlainAuth("", m.cfg.SMTPUser, m.cfg.SMTPPassword, m.cfg.SMTPHost)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err = c.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,116 @@
+package email
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/test"
+)
+
+func TestSend(t *testing.T) {
+	srv := test.NewSMTPServer(t)
+
+	// Replace one of the built-in templates.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "password_reset.txt"), []byte(`{{define "subject"}}Reset for {{.AppName}}{{end}}Go to {{.Link}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Email{
+		SMTPHost:    srv.Host,
+		SMTPPort:    srv.Port,
+		From:        "Test Server <noreply@test>",
+		AppName:     "Test",
+		TemplateDir: dir,
+	}
+	m, err := NewMailer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := "https://matrix.test/_matrix/client/v3/email/submit_token?sid=1&token=a&client_secret=b"
+	data := TemplateData{Address: "alice@example.com", Link: link}
+	if err = m.Send(context.Background(), "alice@example.com", TemplateRegistration, data); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Send(context.Background(), "Bob <bob@example.com>", TemplatePasswordReset, data); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	wantRecipients := []string{"alice@example.com", "bob@example.com"}
+	wantSubjects := []string{"[Test] Validate your email address", "Reset for Test"}
+	for i, received := range messages {
+		if received.From != "noreply@test" {
+			t.Errorf("unexpected sender %q", received.From)
+		}
+		if len(received.To) != 1 || received.To[0] != wantRecipients[i] {
+			t.Errorf("expected recipient %s, got %v", wantRecipients[i], received.To)
+		}
+
+		msg, err := mail.ReadMessage(strings.NewReader(received.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject := msg.Header.Get("Subject"); subject != wantSubjects[i] {
+			t.Errorf("expected subject %q, got %q", wantSubjects[i], subject)
+		}
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("unexpected content type %q: %v", mediaType, err)
+		}
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		var types []string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, part.Header.Get("Content-Type"))
+			// The HTML template escapes the ampersands in the link.
+			if !strings.Contains(string(body), link) && !strings.Contains(string(body), strings.ReplaceAll(link, "&", "&amp;")) {
+				t.Errorf("expected the link in the %s part, got %s", part.Header.Get("Content-Type"), body)
+			}
+		}
+		if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+			t.Errorf("expected text and HTML parts, got %v", types)
+		}
+	}
+}
+
+func TestSendRequireTransportSecurity(t *testing.T) {
+	srv := test.NewSMTPServer(t)
+
+	m, err := NewMailer(&config.Email{
+		SMTPHost:                 srv.Host,
+		SMTPPort:                 srv.Port,
+		From:                     "noreply@test",
+		RequireTransportSecurity: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Send(context.Background(), "alice@example.com", TemplateAddThreePID, TemplateData{}); err == nil {
+		t.Fatal("expected sending to fail without StartTLS")
+	}
+	if len(srv.Messages()) != 0 {
+		t.Fatal("expected no messages to be sent")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package email
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Template is the name of a kind of email. Each one has a <name>.txt template,
+// which also defines the "subject" template, and a <name>.html template.
+type Template string
+
+const (
+	// TemplateRegistration validates the email address of a user who is registering.
+	TemplateRegistration Template = "registration"
+	// TemplateAddThreePID validates an email address being added to an account.
+	TemplateAddThreePID Template = "add_threepid"
+	// TemplatePasswordReset validates the email address of a user resetting their password.
+	TemplatePasswordReset Template = "password_reset"
+)
+
+var allTemplates = []Template{TemplateRegistration, TemplateAddThreePID, TemplatePasswordReset}
+
+// TemplateData is available to the templates.
+type TemplateData struct {
+	// The app_name from the config
+	AppName string
+	// The email address the email is sent to
+	Address string
+	// The link that validates the email address
+	Link string
+}
+
+//go:embed templates
+var builtinTemplates embed.FS
+
+type templateSet struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+func (s *templateSet) render(data TemplateData) (subject string, text, html []byte, err error) {
+	var subjectBuf, textBuf, htmlBuf bytes.Buffer
+	if err = s.text.ExecuteTemplate(&subjectBuf, "subject", data); err != nil {
+		return
+	}
+	if err = s.text.Execute(&textBuf, data); err != nil {
+		return
+	}
+	if err = s.html.Execute(&htmlBuf, data); err != nil {
+		return
+	}
+	// Subjects must fit on one line.
+	subject = strings.Join(strings.Fields(subjectBuf.String()), " ")
+	return subject, textBuf.Bytes(), htmlBuf.Bytes(), nil
+}
+
+// loadTemplates parses the built-in templates, except those which exist in the
+// directory, if one is given.
+func loadTemplates(dir string) (map[Template]*templateSet, error) {
+	readFile := func(name string) ([]byte, error) {
+		if dir != "" {
+			content, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil || !os.IsNotExist(err) {
+				return content, err
+			}
+		}
+		return fs.ReadFile(builtinTemplates, "templates/"+name)
+	}
+
+	templates := make(map[Template]*templateSet, len(allTemplates))
+	for _, name := range allTemplates {
+		textContent, err := readFile(string(name) + ".txt")
+		if err != nil {
+			return nil, err
+		}
+		htmlContent, err := readFile(string(name) + ".html")
+		if err != nil {
+			return nil, err
+		}
+		set := &templateSet{}
+		if set.text, err = texttemplate.New(string(name) + ".txt").Parse(string(textContent)); err != nil {
+			return nil, err
+		}
+		if set.text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("template %s.txt doesn't define a subject", name)
+		}
+		if set.html, err = htmltemplate.New(string(name) + ".html").Parse(string(htmlContent)); err != nil {
+			return nil, err
+		}
+		templates[name] = set
+	}
+	return templates, nil
+}
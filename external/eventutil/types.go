@@ -41,6 +41,16 @@ type NotificationData struct {
 	// UnreadNotificationCount is the total number of unread
 	// notifications.
 	UnreadNotificationCount int `json:"unread_notification_count"`
+
+	// UnreadThreadNotifications are the unread notifications in each
+	// thread, by thread root event ID. They are included in the totals.
+	UnreadThreadNotifications map[string]ThreadNotificationData `json:"unread_thread_notifications,omitempty"`
+}
+
+// ThreadNotificationData is the number of unread notifications in a thread.
+type ThreadNotificationData struct {
+	UnreadHighlightCount    int `json:"unread_highlight_count"`
+	UnreadNotificationCount int `json:"unread_notification_count"`
 }
 
 // UserProfile is a struct containing all known user profile data
@@ -0,0 +1,156 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package spamcheck
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// Builtin is a Checker driven by the block lists and regular expressions in
+// the spam_checker section of the config.
+type Builtin struct {
+	blockedUsers      []*regexp.Regexp
+	blockedRooms      map[string]struct{}
+	eventBodies       []*regexp.Regexp
+	usernames         []*regexp.Regexp
+	blockedMediaTypes []string
+	mediaFilenames    []*regexp.Regexp
+}
+
+func NewBuiltin(cfg *config.SpamChecker) (*Builtin, error) {
+	b := &Builtin{
+		blockedRooms: make(map[string]struct{}, len(cfg.BlockedRooms)),
+	}
+	var err error
+	if b.blockedUsers, err = compileAll(cfg.BlockedUsers); err != nil {
+		return nil, err
+	}
+	if b.eventBodies, err = compileAll(cfg.EventBodyPatterns); err != nil {
+		return nil, err
+	}
+	if b.usernames, err = compileAll(cfg.UsernamePatterns); err != nil {
+		return nil, err
+	}
+	if b.mediaFilenames, err = compileAll(cfg.MediaFilenamePatterns); err != nil {
+		return nil, err
+	}
+	for _, roomID := range cfg.BlockedRooms {
+		b.blockedRooms[roomID] = struct{}{}
+	}
+	for _, contentType := range cfg.BlockedMediaTypes {
+		b.blockedMediaTypes = append(b.blockedMediaTypes, strings.ToLower(contentType))
+	}
+	return b, nil
+}
+
+func compileAll(patterns []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+func matchesAny(regexps []*regexp.Regexp, s string) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Builtin) userBlocked(userID spec.UserID) *spec.MatrixError {
+	if matchesAny(b.blockedUsers, userID.String()) {
+		denied := spec.Forbidden("You are not allowed to do this")
+		return &denied
+	}
+	return nil
+}
+
+func (b *Builtin) roomBlocked(roomID spec.RoomID) *spec.MatrixError {
+	if _, ok := b.blockedRooms[roomID.String()]; ok {
+		denied := spec.Forbidden("This room has been blocked on this server")
+		return &denied
+	}
+	return nil
+}
+
+func (b *Builtin) CheckEventForSpam(ctx context.Context, event gomatrixserverlib.PDU, sender spec.UserID) *spec.MatrixError {
+	// Let blocked users leave rooms. Joins and invites have their own checks.
+	if event.Type() != spec.MRoomMember {
+		if denied := b.userBlocked(sender); denied != nil {
+			return denied
+		}
+	}
+	if body := gjson.GetBytes(event.Content(), "body"); body.Type == gjson.String && matchesAny(b.eventBodies, body.Str) {
+		denied := spec.Forbidden("This message has been rejected as probable spam")
+		return &denied
+	}
+	return nil
+}
+
+func (b *Builtin) UserMayInvite(ctx context.Context, inviter, invitee spec.UserID, roomID spec.RoomID) *spec.MatrixError {
+	if denied := b.userBlocked(inviter); denied != nil {
+		return denied
+	}
+	return b.roomBlocked(roomID)
+}
+
+func (b *Builtin) UserMayJoinRoom(ctx context.Context, userID spec.UserID, roomID spec.RoomID, isInvited bool) *spec.MatrixError {
+	if denied := b.userBlocked(userID); denied != nil {
+		return denied
+	}
+	return b.roomBlocked(roomID)
+}
+
+func (b *Builtin) UserMayCreateRoom(ctx context.Context, userID spec.UserID) *spec.MatrixError {
+	return b.userBlocked(userID)
+}
+
+func (b *Builtin) CheckUsernameForSpam(ctx context.Context, profile UserProfile) *spec.MatrixError {
+	if matchesAny(b.usernames, profile.UserID) || matchesAny(b.usernames, profile.DisplayName) {
+		denied := spec.Forbidden("This user is hidden from the user directory")
+		return &denied
+	}
+	return nil
+}
+
+func (b *Builtin) CheckMediaFileForSpam(ctx context.Context, uploader spec.UserID, file MediaFile) *spec.MatrixError {
+	if denied := b.userBlocked(uploader); denied != nil {
+		return denied
+	}
+	contentType := strings.ToLower(file.ContentType)
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	for _, blocked := range b.blockedMediaTypes {
+		prefix, wildcard := strings.CutSuffix(blocked, "/*")
+		if contentType == blocked || (wildcard && strings.HasPrefix(contentType, prefix+"/")) {
+			denied := spec.Forbidden(fmt.Sprintf("Uploading files of type %s is not allowed", contentType))
+			return &denied
+		}
+	}
+	if matchesAny(b.mediaFilenames, file.Filename) {
+		denied := spec.Forbidden("Uploading this file is not allowed")
+		return &denied
+	}
+	return nil
+}
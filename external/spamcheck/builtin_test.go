@@ -0,0 +1,182 @@
+package spamcheck
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/test"
+)
+
+func mustNewBuiltin(t *testing.T, cfg *config.SpamChecker) *Builtin {
+	t.Helper()
+	b, err := NewBuiltin(cfg)
+	if err != nil {
+		t.Fatalf("failed to create checker: %v", err)
+	}
+	return b
+}
+
+func assertDenied(t *testing.T, wantDenied bool, denied *spec.MatrixError) {
+	t.Helper()
+	if wantDenied && denied == nil {
+		t.Fatalf("expected to be denied")
+	}
+	if !wantDenied && denied != nil {
+		t.Fatalf("expected to be allowed, got %v", denied)
+	}
+}
+
+func TestNewBuiltinInvalidRegexp(t *testing.T) {
+	if _, err := NewBuiltin(&config.SpamChecker{EventBodyPatterns: []string{"("}}); err == nil {
+		t.Fatalf("expected an error for an invalid regular expression")
+	}
+}
+
+func TestBuiltinCheckEventForSpam(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Join,
+	}, test.WithStateKey(bob.ID))
+	b := mustNewBuiltin(t, &config.SpamChecker{
+		BlockedUsers:      []string{"^" + bob.ID + "$"},
+		EventBodyPatterns: []string{`(?i)buy cheap`},
+	})
+
+	tests := []struct {
+		name     string
+		user     *test.User
+		evType   string
+		content  map[string]interface{}
+		stateKey *string
+		denied   bool
+	}{
+		{
+			name:    "normal message is allowed",
+			user:    alice,
+			evType:  "m.room.message",
+			content: map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+		},
+		{
+			name:    "message matching a pattern is denied",
+			user:    alice,
+			evType:  "m.room.message",
+			content: map[string]interface{}{"msgtype": "m.text", "body": "BUY CHEAP watches"},
+			denied:  true,
+		},
+		{
+			name:    "message from a blocked user is denied",
+			user:    bob,
+			evType:  "m.room.message",
+			content: map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+			denied:  true,
+		},
+		{
+			name:     "blocked user can leave",
+			user:     bob,
+			evType:   spec.MRoomMember,
+			content:  map[string]interface{}{"membership": spec.Leave},
+			stateKey: &bob.ID,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var ev *types.HeaderedEvent
+			if tc.stateKey != nil {
+				ev = room.CreateEvent(t, tc.user, tc.evType, tc.content, test.WithStateKey(*tc.stateKey))
+			} else {
+				ev = room.CreateEvent(t, tc.user, tc.evType, tc.content)
+			}
+			sender := spec.NewUserIDOrPanic(tc.user.ID, true)
+			assertDenied(t, tc.denied, b.CheckEventForSpam(ctx, ev, sender))
+		})
+	}
+}
+
+func TestBuiltinRoomsAndUsers(t *testing.T) {
+	ctx := context.Background()
+	alice := spec.NewUserIDOrPanic("@alice:test", true)
+	spammer := spec.NewUserIDOrPanic("@spammer123:evil.example", true)
+	room, err := spec.NewRoomID("!room:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockedRoom, err := spec.NewRoomID("!blocked:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := mustNewBuiltin(t, &config.SpamChecker{
+		BlockedUsers: []string{`:evil\.example$`},
+		BlockedRooms: []string{blockedRoom.String()},
+	})
+
+	assertDenied(t, false, b.UserMayInvite(ctx, alice, spammer, *room))
+	assertDenied(t, true, b.UserMayInvite(ctx, spammer, alice, *room))
+	assertDenied(t, true, b.UserMayInvite(ctx, alice, spammer, *blockedRoom))
+
+	assertDenied(t, false, b.UserMayJoinRoom(ctx, alice, *room, false))
+	assertDenied(t, true, b.UserMayJoinRoom(ctx, alice, *blockedRoom, true))
+	assertDenied(t, true, b.UserMayJoinRoom(ctx, spammer, *room, true))
+
+	assertDenied(t, false, b.UserMayCreateRoom(ctx, alice))
+	assertDenied(t, true, b.UserMayCreateRoom(ctx, spammer))
+}
+
+func TestBuiltinCheckUsernameForSpam(t *testing.T) {
+	ctx := context.Background()
+	b := mustNewBuiltin(t, &config.SpamChecker{
+		UsernamePatterns: []string{`(?i)crypto`, `^@bot`},
+	})
+
+	assertDenied(t, false, b.CheckUsernameForSpam(ctx, UserProfile{UserID: "@alice:test", DisplayName: "Alice"}))
+	assertDenied(t, true, b.CheckUsernameForSpam(ctx, UserProfile{UserID: "@alice:test", DisplayName: "Free Crypto"}))
+	assertDenied(t, true, b.CheckUsernameForSpam(ctx, UserProfile{UserID: "@bot1:test"}))
+}
+
+func TestBuiltinCheckMediaFileForSpam(t *testing.T) {
+	ctx := context.Background()
+	alice := spec.NewUserIDOrPanic("@alice:test", true)
+	b := mustNewBuiltin(t, &config.SpamChecker{
+		BlockedMediaTypes:     []string{"application/x-msdownload", "video/*"},
+		MediaFilenamePatterns: []string{`\.scr$`},
+	})
+
+	tests := []struct {
+		name   string
+		file   MediaFile
+		denied bool
+	}{
+		{name: "image", file: MediaFile{ContentType: "image/png", Filename: "cat.png"}},
+		{name: "blocked type", file: MediaFile{ContentType: "application/x-msdownload", Filename: "setup"}, denied: true},
+		{name: "blocked type with parameters", file: MediaFile{ContentType: "Application/X-MSDownload; charset=binary"}, denied: true},
+		{name: "wildcard type", file: MediaFile{ContentType: "video/mp4", Filename: "cat.mp4"}, denied: true},
+		{name: "wildcard does not match prefix", file: MediaFile{ContentType: "videos/mp4"}},
+		{name: "blocked file name", file: MediaFile{ContentType: "application/octet-stream", Filename: "screensaver.scr"}, denied: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assertDenied(t, tc.denied, b.CheckMediaFileForSpam(ctx, alice, tc.file))
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	checker, err := New(&config.SpamChecker{Enabled: false, BlockedUsers: []string{".*"}})
+	if err != nil || checker != nil {
+		t.Fatalf("expected no checker when disabled, got %v, %v", checker, err)
+	}
+	checker, err = New(&config.SpamChecker{Enabled: true, BlockedUsers: []string{".*"}})
+	if err != nil || checker == nil {
+		t.Fatalf("expected a checker when enabled, got %v, %v", checker, err)
+	}
+	assertDenied(t, true, checker.UserMayCreateRoom(context.Background(), spec.NewUserIDOrPanic("@alice:test", true)))
+	if _, err = New(&config.SpamChecker{Enabled: true, BlockedUsers: []string{"("}}); err == nil {
+		t.Fatalf("expected an error for an invalid regular expression")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package spamcheck lets moderation modules deny what users do on the server,
+// such as sending events, inviting users or uploading media.
+//
+// The checker is passed to the client API, roomserver, federation API and media
+// API when they are set up, which consult it if it isn't nil. New returns the
+// checker configured in the spam_checker section of the config.
+package spamcheck
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// Checker decides whether users may do things. Each method returns nil to allow
+// the action, or the error to send to the client to deny it, e.g.
+// spec.Forbidden("...") or a custom error code.
+type Checker interface {
+	// CheckEventForSpam is called with events sent by local users before they
+	// are sent to the roomserver, and with all new events in the roomserver,
+	// including those received over federation. Denied events from other
+	// servers are soft-failed.
+	CheckEventForSpam(ctx context.Context, event gomatrixserverlib.PDU, sender spec.UserID) *spec.MatrixError
+	// UserMayInvite is called when a local user invites someone, and when a
+	// local user is invited over federation.
+	UserMayInvite(ctx context.Context, inviter, invitee spec.UserID, roomID spec.RoomID) *spec.MatrixError
+	// UserMayJoinRoom is called when a local user joins a room.
+	UserMayJoinRoom(ctx context.Context, userID spec.UserID, roomID spec.RoomID, isInvited bool) *spec.MatrixError
+	// UserMayCreateRoom is called when a local user creates a room.
+	UserMayCreateRoom(ctx context.Context, userID spec.UserID) *spec.MatrixError
+	// CheckUsernameForSpam is called for each user in user directory search
+	// results. Denied users are left out of the results.
+	CheckUsernameForSpam(ctx context.Context, profile UserProfile) *spec.MatrixError
+	// CheckMediaFileForSpam is called when a local user uploads media, before
+	// the file is stored.
+	CheckMediaFileForSpam(ctx context.Context, uploader spec.UserID, file MediaFile) *spec.MatrixError
+}
+
+// UserProfile is a user found by a user directory search.
+type UserProfile struct {
+	UserID      string
+	DisplayName string
+	AvatarURL   string
+}
+
+// MediaFile is a file being uploaded to the media repository.
+type MediaFile struct {
+	ContentType string
+	Filename    string
+	Size        int64
+	// Path is where the uploaded file can be read from while it is checked.
+	Path string
+}
+
+// New returns the checker configured in the spam_checker section of the config,
+// or nil if it is disabled.
+func New(cfg *config.SpamChecker) (Checker, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	builtin, err := NewBuiltin(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return builtin, nil
+}
@@ -47,6 +47,35 @@ type ClientFederationAPI interface {
 	// containing only the server names (without information for membership events).
 	// The response will include this server if they are joined to the room.
 	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	// TimestampToEvent asks a remote server for the event in the room closest to the timestamp, at or
+	// after it, or at or before it if backwards is true. The event is fetched and its signatures are
+	// checked, but it isn't stored. Returns nil if the remote server doesn't know of such an event.
+	TimestampToEvent(ctx context.Context, origin, s spec.ServerName, roomID spec.RoomID, roomVersion gomatrixserverlib.RoomVersion, ts spec.Timestamp, backwards bool) (gomatrixserverlib.PDU, error)
+
+	// QueryFederationDestinations returns the state of the servers we have talked to or have
+	// something queued for, sorted by server name.
+	QueryFederationDestinations(ctx context.Context) ([]FederationDestination, error)
+	// QueryFederationDestination returns the state of a single server, or nil if we know nothing about it.
+	QueryFederationDestination(ctx context.Context, s spec.ServerName) (*FederationDestination, error)
+	// PerformResetFederationDestination forgets about previous failures to reach the server,
+	// removes it from the blacklist and retries sending to it straight away.
+	PerformResetFederationDestination(ctx context.Context, s spec.ServerName) error
+	// PerformPurgeFederationQueue drops all PDUs and EDUs waiting to be sent to the server.
+	PerformPurgeFederationQueue(ctx context.Context, s spec.ServerName) error
+	// QueryFederationDomainLists returns the server name patterns we federate with or not.
+	QueryFederationDomainLists(ctx context.Context) (*FederationDomainLists, error)
+	// PerformSetFederationDomainLists replaces the server name patterns until the next restart.
+	PerformSetFederationDomainLists(ctx context.Context, lists *FederationDomainLists) error
+
+	// QueryServerSigningKeys returns the signing keys we hold for the server, or for all servers
+	// if the server name is empty, sorted by server name and key ID.
+	QueryServerSigningKeys(ctx context.Context, s spec.ServerName) ([]ServerSigningKey, error)
+	// PerformEvictServerSigningKeys forgets the signing keys of the server, so that they are
+	// fetched again when they are next needed.
+	PerformEvictServerSigningKeys(ctx context.Context, s spec.ServerName) error
+	// PerformRefetchServerSigningKeys fetches the keys we hold for the server and its current keys
+	// again, and returns the keys we hold afterwards. Returns an error if no keys were fetched.
+	PerformRefetchServerSigningKeys(ctx context.Context, s spec.ServerName) ([]ServerSigningKey, error)
 }
 
 type RoomserverFederationAPI interface {
@@ -58,6 +87,8 @@ type RoomserverFederationAPI interface {
 	PerformDirectoryLookup(ctx context.Context, request *PerformDirectoryLookupRequest, response *PerformDirectoryLookupResponse) error
 	// Handle an instruction to make_join & send_join with a remote server.
 	PerformJoin(ctx context.Context, request *PerformJoinRequest, response *PerformJoinResponse)
+	// Handle an instruction to make_knock & send_knock with a remote server.
+	PerformKnock(ctx context.Context, request *PerformKnockRequest, response *PerformKnockResponse) error
 	// Handle an instruction to make_leave & send_leave with a remote server.
 	PerformLeave(ctx context.Context, request *PerformLeaveRequest, response *PerformLeaveResponse) error
 	// Handle sending an invite to a remote server.
@@ -183,6 +214,21 @@ type PerformOutboundPeekResponse struct {
 	LastError *gomatrix.HTTPError
 }
 
+type PerformKnockRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+	// The sorted list of servers to try. Servers will be tried sequentially, after de-duplication.
+	ServerNames types.ServerNames `json:"server_names"`
+}
+
+type PerformKnockResponse struct {
+	KnockedVia     spec.ServerName
+	Event          *rstypes.HeaderedEvent
+	KnockRoomState []gomatrixserverlib.InviteStrippedState
+	LastError      *gomatrix.HTTPError
+}
+
 type PerformLeaveRequest struct {
 	RoomID      string            `json:"room_id"`
 	UserID      string            `json:"user_id"`
@@ -190,6 +236,8 @@ type PerformLeaveRequest struct {
 }
 
 type PerformLeaveResponse struct {
+	// The leave event that was sent to the remote server.
+	Event *rstypes.HeaderedEvent
 }
 
 type PerformInviteRequest struct {
@@ -214,6 +262,48 @@ type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []spec.ServerName `json:"server_names"`
 }
 
+// TimestampToEventResponse is the response of the client and federation
+// /timestamp_to_event endpoints.
+type TimestampToEventResponse struct {
+	EventID        string         `json:"event_id"`
+	OriginServerTS spec.Timestamp `json:"origin_server_ts"`
+}
+
+// FederationDestination is what we know about sending to a remote server.
+type FederationDestination struct {
+	ServerName spec.ServerName
+	// The number of consecutive failures to reach the server
+	FailureCount uint32
+	// When the current backoff interval ends, if we are backing off
+	BackoffUntil *time.Time
+	Blacklisted  bool
+	// Whether the server is assumed offline, so that relay servers are used
+	AssumedOffline bool
+	RelayServers   []spec.ServerName
+	PendingPDUs    int64
+	PendingEDUs    int64
+	// Whether the last transaction failed and will be retried with the same ID
+	RetryingTransaction bool
+}
+
+// FederationDomainLists are the patterns of the server names we federate with,
+// if any are allowed, and of those we never federate with.
+type FederationDomainLists struct {
+	Allowed []string `json:"allowed"`
+	Denied  []string `json:"denied"`
+}
+
+// ServerSigningKey is a signing key of a remote server which we hold.
+type ServerSigningKey struct {
+	ServerName spec.ServerName
+	KeyID      gomatrixserverlib.KeyID
+	PublicKey  spec.Base64Bytes
+	// When the key is valid until, or 0 if the key has expired
+	ValidUntilTS spec.Timestamp
+	// When the key expired, or 0 if it hasn't
+	ExpiredTS spec.Timestamp
+}
+
 type PerformBroadcastEDURequest struct {
 }
 
@@ -237,7 +237,8 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent, rew
 
 	// TODO: implement query to let the fedapi check whether a given peek is live or not
 
-	// Send the event.
+	// Send the event. If federation sending is sharded, this only queues it for
+	// the destinations owned by our shard and hands the rest over to their senders.
 	return s.queues.SendEvent(
 		ore.Event, spec.ServerName(ore.SendAsServer), joinedHostsAtEvent,
 	)
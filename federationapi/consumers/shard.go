@@ -0,0 +1,88 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/federationapi/queue"
+	"github.com/ike20013/dendrite/federationapi/sharding"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/setup/process"
+)
+
+// OutputShardConsumer consumes the PDUs and EDUs which other federation senders
+// hand over to this one, because it owns their destinations, and the changes
+// made through the federation API of another process.
+type OutputShardConsumer struct {
+	ctx       context.Context
+	jetstream nats.JetStreamContext
+	durable   string
+	queues    *queue.OutgoingQueues
+	shard     sharding.Shard
+	topic     string
+}
+
+// NewOutputShardConsumer creates a new OutputShardConsumer. Call Start() to begin consuming.
+func NewOutputShardConsumer(
+	process *process.ProcessContext,
+	cfg *config.FederationAPI,
+	js nats.JetStreamContext,
+	queues *queue.OutgoingQueues,
+	shard sharding.Shard,
+) *OutputShardConsumer {
+	return &OutputShardConsumer{
+		ctx:       process.Context(),
+		jetstream: js,
+		queues:    queues,
+		shard:     shard,
+		durable:   cfg.Matrix.JetStream.Durable(fmt.Sprintf("FederationAPIShard%dConsumer", shard.Index)),
+		topic:     sharding.Subject(cfg.Matrix.JetStream.Prefixed(jetstream.OutputFederationShard), shard.Index),
+	}
+}
+
+// Start consuming from the other federation senders
+func (s *OutputShardConsumer) Start() error {
+	return jetstream.JetStreamConsumer(
+		s.ctx, s.jetstream, s.topic, s.durable, 1, s.onMessage,
+		nats.DeliverAll(), nats.ManualAck(),
+	)
+}
+
+// onMessage is called when another federation sender hands a PDU, an EDU or a change over.
+func (s *OutputShardConsumer) onMessage(ctx context.Context, msgs []*nats.Msg) bool {
+	msg := msgs[0] // Guaranteed to exist if onMessage is called
+	var handedOver sharding.Message
+	if err := json.Unmarshal(msg.Data, &handedOver); err != nil {
+		log.WithError(err).WithField("shard", s.shard.String()).Error("federation shard: message parse failure")
+		return true
+	}
+
+	var err error
+	switch {
+	case handedOver.PDU != nil:
+		err = s.queues.SendShardEvent(handedOver.PDU, handedOver.Origin, handedOver.Destinations)
+	case handedOver.EDU != nil:
+		err = s.queues.SendShardEDU(handedOver.EDU, handedOver.Origin, handedOver.Destinations)
+	case handedOver.Control != nil:
+		err = s.queues.ApplyShardControl(ctx, handedOver.Control)
+	default:
+		log.WithField("shard", s.shard.String()).Warn("federation shard: message without PDU, EDU or change")
+		return true
+	}
+	if err != nil {
+		// Retry later rather than lose what was handed over to us.
+		log.WithError(err).WithField("shard", s.shard.String()).Error("federation shard: failed to queue")
+		return false
+	}
+	return true
+}
@@ -12,10 +12,12 @@ import (
 	"time"
 
 	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 
 	"github.com/ike20013/dendrite/external/caching"
@@ -23,6 +25,8 @@ import (
 	"github.com/ike20013/dendrite/federationapi/consumers"
 	"github.com/ike20013/dendrite/federationapi/producers"
 	"github.com/ike20013/dendrite/federationapi/queue"
+	"github.com/ike20013/dendrite/federationapi/serverfilter"
+	"github.com/ike20013/dendrite/federationapi/sharding"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/setup/jetstream"
@@ -44,6 +48,7 @@ func AddPublicRoutes(
 	keyRing gomatrixserverlib.JSONVerifier,
 	rsAPI roomserverAPI.FederationRoomserverAPI,
 	fedAPI federationAPI.FederationInternalAPI,
+	spamChecker spamcheck.Checker,
 	enableMetrics bool,
 ) {
 	cfg := &dendriteConfig.FederationAPI
@@ -77,7 +82,7 @@ func AddPublicRoutes(
 		dendriteConfig,
 		rsAPI, f, keyRing,
 		federation, userAPI, mscCfg,
-		producer, enableMetrics,
+		producer, spamChecker, enableMetrics,
 	)
 }
 
@@ -109,14 +114,12 @@ func NewInternalAPI(
 
 	js, nats := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
 
-	signingInfo := dendriteCfg.Global.SigningIdentities()
+	filter, err := serverfilter.New(cfg.AllowedServerNames, cfg.DeniedServerNames)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to parse the allowed and denied server names")
+	}
 
-	queues := queue.NewOutgoingQueues(
-		federationDB, processContext,
-		cfg.Matrix.DisableFederation,
-		cfg.Matrix.ServerName, federation, &stats,
-		signingInfo,
-	)
+	queues := newOutgoingQueues(processContext, dendriteCfg, js, federationDB, federation, &stats, filter)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
 		processContext, cfg, js, nats, queues,
@@ -167,5 +170,82 @@ func NewInternalAPI(
 	}
 	time.AfterFunc(time.Minute, cleanExpiredEDUs)
 
-	return external.NewFederationInternalAPI(federationDB, cfg, rsAPI, federation, &stats, caches, queues, keyRing)
+	return external.NewFederationInternalAPI(federationDB, cfg, rsAPI, federation, &stats, caches, queues, filter, keyRing)
+}
+
+// NewFederationSender sends to the servers owned by the shard in federation_api.sender_sharding.index,
+// without the rest of the federation API. The process running the federation API hands the events
+// for those servers over to it, so they must share the NATS server and the federation API database.
+func NewFederationSender(
+	processContext *process.ProcessContext,
+	dendriteCfg *config.Dendrite,
+	cm *sqlutil.Connections,
+	natsInstance *jetstream.NATSInstance,
+	federation fclient.FederationClient,
+	caches *caching.Caches,
+) *queue.OutgoingQueues {
+	cfg := &dendriteCfg.FederationAPI
+
+	federationDB, err := storage.NewDatabase(processContext.Context(), cm, &cfg.Database, caches, dendriteCfg.Global.IsLocalServerName)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to connect to federation sender db")
+	}
+
+	stats := statistics.NewStatistics(federationDB, cfg.FederationMaxRetries+1, cfg.P2PFederationRetriesUntilAssumedOffline+1, cfg.EnableRelays)
+
+	js, _ := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
+
+	filter, err := serverfilter.New(cfg.AllowedServerNames, cfg.DeniedServerNames)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to parse the allowed and denied server names")
+	}
+
+	return newOutgoingQueues(processContext, dendriteCfg, js, federationDB, federation, &stats, filter)
+}
+
+// newOutgoingQueues creates the queues for the servers owned by the shard of this process.
+// If sharding is enabled, it also starts consuming what other processes hand over to the shard.
+func newOutgoingQueues(
+	processContext *process.ProcessContext,
+	dendriteCfg *config.Dendrite,
+	js nats.JetStreamContext,
+	federationDB storage.Database,
+	federation fclient.FederationClient,
+	stats *statistics.Statistics,
+	filter *serverfilter.Filter,
+) *queue.OutgoingQueues {
+	cfg := &dendriteCfg.FederationAPI
+	shard := sharding.Shard{
+		Index: cfg.SenderSharding.Index,
+		Total: cfg.SenderSharding.Shards,
+	}
+	var producer *sharding.Producer
+	if shard.Enabled() {
+		producer = &sharding.Producer{
+			Topic:     cfg.Matrix.JetStream.Prefixed(jetstream.OutputFederationShard),
+			JetStream: js,
+		}
+	}
+
+	queues, err := queue.NewOutgoingQueues(
+		federationDB, processContext,
+		cfg.Matrix.DisableFederation,
+		cfg.Matrix.ServerName, federation, stats,
+		dendriteCfg.Global.SigningIdentities(), filter,
+		shard, producer, cfg.DestinationQueue,
+	)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to create the federation sender queues")
+	}
+
+	if shard.Enabled() {
+		logrus.Infof("Sending federation traffic for shard %s", shard)
+		shardConsumer := consumers.NewOutputShardConsumer(
+			processContext, cfg, js, queues, shard,
+		)
+		if err := shardConsumer.Start(); err != nil {
+			logrus.WithError(err).Panic("failed to start federation shard consumer")
+		}
+	}
+	return queues
 }
@@ -121,6 +121,11 @@ func (f *fedClient) GetServerKeys(ctx context.Context, matrixServer spec.ServerN
 	return keys, nil
 }
 
+// The test servers don't act as notaries for each other.
+func (f *fedClient) LookupServerKeys(ctx context.Context, s spec.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp) ([]gomatrixserverlib.ServerKeys, error) {
+	return nil, nil
+}
+
 func (f *fedClient) MakeJoin(ctx context.Context, origin, s spec.ServerName, roomID, userID string) (res fclient.RespMakeJoin, err error) {
 	f.fedClientMutex.Lock()
 	defer f.fedClientMutex.Unlock()
@@ -332,7 +337,7 @@ func TestRoomsV3URLEscapeDoNot404(t *testing.T) {
 	natsInstance := jetstream.NATSInstance{}
 	// TODO: This is pretty fragile, as if anything calls anything on these nils this test will break.
 	// Unfortunately, it makes little sense to instantiate these dependencies when we just want to test routing.
-	federationapi.AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, nil, keyRing, nil, &internal.FederationInternalAPI{}, caching.DisableMetrics)
+	federationapi.AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, nil, keyRing, nil, &internal.FederationInternalAPI{}, nil, caching.DisableMetrics)
 	baseURL, cancel := test.ListenAndServe(t, routers.Federation, true)
 	defer cancel()
 	serverName := spec.ServerName(strings.TrimPrefix(baseURL, "https://"))
@@ -491,3 +496,102 @@ func TestNotaryServer(t *testing.T) {
 
 	})
 }
+
+func TestNotaryServerRestrictions(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		fc := &fedClient{
+			keys: map[spec.ServerName]struct {
+				key   ed25519.PrivateKey
+				keyID gomatrixserverlib.KeyID
+			}{
+				"servera": {key: test.PrivateKeyA, keyID: "ed25519:someID"},
+				"serverb": {key: test.PrivateKeyB, keyID: "ed25519:someID"},
+			},
+		}
+		cfg.FederationAPI.Notary.DeniedServerNames = []string{"serverb"}
+		fedAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, fc, nil, caches, nil, true)
+
+		notaryServers := func(t *testing.T) []string {
+			t.Helper()
+			body := `{"server_keys":{"servera":{},"serverb":{}}}`
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			req.Host = string(cfg.Global.ServerName)
+			resp := routing.NotaryKeys(req, &cfg.FederationAPI, fedAPI, nil)
+			assert.Equal(t, http.StatusOK, resp.Code)
+			nk, ok := resp.JSON.(routing.NotaryKeysResponse)
+			assert.True(t, ok)
+			var serverNames []string
+			for _, js := range nk.ServerKeys {
+				serverNames = append(serverNames, gjson.GetBytes(js, "server_name").Str)
+			}
+			return serverNames
+		}
+
+		assert.Equal(t, []string{"servera"}, notaryServers(t))
+
+		cfg.FederationAPI.Notary.Enabled = false
+		assert.Empty(t, notaryServers(t))
+	})
+}
+
+func TestRefetchServerSigningKeys(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		fc := &fedClient{
+			keys: map[spec.ServerName]struct {
+				key   ed25519.PrivateKey
+				keyID gomatrixserverlib.KeyID
+			}{
+				"servera": {key: test.PrivateKeyA, keyID: "ed25519:someID"},
+			},
+		}
+		// Only fetch the keys directly from the test server.
+		cfg.FederationAPI.KeyPerspectives = nil
+		fedAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, fc, nil, caches, nil, true)
+		ctx := context.Background()
+
+		// No fetcher knows the keys of this server.
+		_, err := fedAPI.PerformRefetchServerSigningKeys(ctx, "serverc")
+		assert.Error(t, err)
+
+		// The current keys are fetched even if we don't hold any keys for the server.
+		keys, err := fedAPI.PerformRefetchServerSigningKeys(ctx, "servera")
+		assert.NoError(t, err)
+		if assert.Len(t, keys, 1) {
+			assert.Equal(t, gomatrixserverlib.KeyID("ed25519:someID"), keys[0].KeyID)
+		}
+		assert.NoError(t, fedAPI.PerformEvictServerSigningKeys(ctx, "servera"))
+
+		// Hold a key which is about to expire, as if it was fetched a while ago.
+		req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "servera", KeyID: "ed25519:someID"}
+		soon := spec.AsTimestamp(time.Now().Add(time.Minute))
+		err = fedAPI.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			req: {
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: spec.Base64Bytes(test.PrivateKeyA.Public().(ed25519.PublicKey))},
+				ValidUntilTS: soon,
+			},
+		})
+		assert.NoError(t, err)
+
+		keys, err = fedAPI.PerformRefetchServerSigningKeys(ctx, "servera")
+		assert.NoError(t, err)
+		if assert.Len(t, keys, 1) {
+			assert.Equal(t, req.KeyID, keys[0].KeyID)
+			assert.Greater(t, keys[0].ValidUntilTS, soon, "expected the refetched key to be valid for longer")
+		}
+
+		assert.NoError(t, fedAPI.PerformEvictServerSigningKeys(ctx, "servera"))
+		keys, err = fedAPI.QueryServerSigningKeys(ctx, "")
+		assert.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+}
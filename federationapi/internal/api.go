@@ -12,6 +12,7 @@ import (
 
 	"github.com/ike20013/dendrite/federationapi/api"
 	"github.com/ike20013/dendrite/federationapi/queue"
+	"github.com/ike20013/dendrite/federationapi/serverfilter"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	"github.com/ike20013/dendrite/federationapi/storage"
 	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
@@ -32,7 +33,10 @@ type FederationInternalAPI struct {
 	federation fclient.FederationClient
 	keyRing    *gomatrixserverlib.KeyRing
 	queues     *queue.OutgoingQueues
-	joins      sync.Map // joins currently in progress
+	filter     *serverfilter.Filter
+	notary     *serverfilter.Filter   // the servers we vouch for as a notary
+	keyCache   caching.ServerKeyCache // nil if the keys aren't cached in memory
+	joins      sync.Map               // joins currently in progress
 }
 
 func NewFederationInternalAPI(
@@ -42,6 +46,7 @@ func NewFederationInternalAPI(
 	statistics *statistics.Statistics,
 	caches *caching.Caches,
 	queues *queue.OutgoingQueues,
+	filter *serverfilter.Filter,
 	keyRing *gomatrixserverlib.KeyRing,
 ) *FederationInternalAPI {
 	serverKeyDB, err := cache.NewKeyDatabase(db, caches)
@@ -49,6 +54,11 @@ func NewFederationInternalAPI(
 		logrus.WithError(err).Panicf("failed to set up caching wrapper for server key database")
 	}
 
+	notary, err := serverfilter.New(cfg.Notary.AllowedServerNames, cfg.Notary.DeniedServerNames)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to parse the server names to vouch for as a notary")
+	}
+
 	if keyRing == nil {
 		keyRing = &gomatrixserverlib.KeyRing{
 			KeyFetchers: []gomatrixserverlib.KeyFetcher{},
@@ -59,10 +69,13 @@ func NewFederationInternalAPI(
 		addDirectFetcher := func() {
 			keyRing.KeyFetchers = append(
 				keyRing.KeyFetchers,
-				&gomatrixserverlib.DirectKeyFetcher{
-					Client:            federation,
-					IsLocalServerName: cfg.Matrix.IsLocalServerName,
-					LocalPublicKey:    []byte(pubKey),
+				&filteredKeyFetcher{
+					KeyFetcher: &gomatrixserverlib.DirectKeyFetcher{
+						Client:            federation,
+						IsLocalServerName: cfg.Matrix.IsLocalServerName,
+						LocalPublicKey:    []byte(pubKey),
+					},
+					filter: filter,
 				},
 			)
 		}
@@ -93,7 +106,11 @@ func NewFederationInternalAPI(
 				perspective.PerspectiveServerKeys[key.KeyID] = rawkey
 			}
 
-			keyRing.KeyFetchers = append(keyRing.KeyFetchers, perspective)
+			keyRing.KeyFetchers = append(keyRing.KeyFetchers, &filteredKeyFetcher{
+				KeyFetcher: perspective,
+				filter:     filter,
+				notary:     ps.ServerName,
+			})
 
 			logrus.WithFields(logrus.Fields{
 				"server_name":     ps.ServerName,
@@ -102,7 +119,7 @@ func NewFederationInternalAPI(
 		}
 	}
 
-	return &FederationInternalAPI{
+	a := &FederationInternalAPI{
 		db:         db,
 		cfg:        cfg,
 		rsAPI:      rsAPI,
@@ -110,11 +127,29 @@ func NewFederationInternalAPI(
 		federation: federation,
 		statistics: statistics,
 		queues:     queues,
+		filter:     filter,
+		notary:     notary,
+	}
+	if caches != nil {
+		a.keyCache = caches
 	}
+	return a
+}
+
+// IsServerNameAllowed returns true if we may federate with the server
+// according to the allowed and denied server names.
+func (a *FederationInternalAPI) IsServerNameAllowed(s spec.ServerName) bool {
+	return a.filter.IsAllowed(s)
 }
 
 func (a *FederationInternalAPI) IsBlacklistedOrBackingOff(s spec.ServerName) (*statistics.ServerStatistics, error) {
 	stats := a.statistics.ForServer(s)
+	if !a.filter.IsAllowed(s) {
+		return stats, &api.FederationClientError{
+			Err:         fmt.Sprintf("federation with %q is not allowed", s),
+			Blacklisted: true,
+		}
+	}
 	if stats.Blacklisted() {
 		return stats, &api.FederationClientError{
 			Blacklisted: true,
@@ -178,6 +213,12 @@ func (a *FederationInternalAPI) doRequestIfNotBlacklisted(
 	s spec.ServerName, request func() (interface{}, error),
 ) (interface{}, error) {
 	stats := a.statistics.ForServer(s)
+	if !a.filter.IsAllowed(s) {
+		return stats, &api.FederationClientError{
+			Err:         fmt.Sprintf("federation with %q is not allowed", s),
+			Blacklisted: true,
+		}
+	}
 	if blacklisted := stats.Blacklisted(); blacklisted {
 		return stats, &api.FederationClientError{
 			Err:         fmt.Sprintf("server %q is blacklisted", s),
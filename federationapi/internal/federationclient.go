@@ -2,8 +2,15 @@ package external
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/ike20013/dendrite/federationapi/api"
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -207,3 +214,75 @@ func (a *FederationInternalAPI) RoomHierarchies(
 	}
 	return ires.(fclient.RoomHierarchyResponse), nil
 }
+
+func (a *FederationInternalAPI) TimestampToEvent(
+	ctx context.Context, origin, s spec.ServerName, roomID spec.RoomID,
+	roomVersion gomatrixserverlib.RoomVersion, ts spec.Timestamp, backwards bool,
+) (gomatrixserverlib.PDU, error) {
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := a.cfg.Matrix.SigningIdentityFor(origin)
+	if err != nil {
+		return nil, err
+	}
+	dir := "f"
+	if backwards {
+		dir = "b"
+	}
+	query := url.Values{}
+	query.Set("ts", strconv.FormatUint(uint64(ts), 10))
+	query.Set("dir", dir)
+	path := "/_matrix/federation/v1/timestamp_to_event/" + url.PathEscape(roomID.String()) + "?" + query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	ires, err := a.doRequestIfNotBlacklisted(s, func() (interface{}, error) {
+		req := fclient.NewFederationRequest("GET", origin, s, path)
+		if err := req.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+			return nil, err
+		}
+		httpReq, err := req.HTTPRequest()
+		if err != nil {
+			return nil, err
+		}
+		var res api.TimestampToEventResponse
+		err = a.federation.DoRequestAndParseResponse(ctx, httpReq, &res)
+		return res, err
+	})
+	if err != nil {
+		var httpErr gomatrix.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	res := ires.(api.TimestampToEventResponse)
+	if (backwards && res.OriginServerTS > ts) || (!backwards && res.OriginServerTS < ts) {
+		return nil, fmt.Errorf("server %s returned an event on the wrong side of the timestamp", s)
+	}
+
+	// Fetch the event itself, as the remote server could have lied about
+	// which room it is in or when it was sent.
+	txn, err := a.GetEvent(ctx, origin, s, res.EventID)
+	if err != nil {
+		return nil, err
+	}
+	if len(txn.PDUs) != 1 {
+		return nil, fmt.Errorf("server %s returned %d events for event %s", s, len(txn.PDUs), res.EventID)
+	}
+	event, err := verImpl.NewEventFromUntrustedJSON(txn.PDUs[0])
+	if err != nil {
+		return nil, err
+	}
+	if event.EventID() != res.EventID || event.RoomID().String() != roomID.String() || event.OriginServerTS() != res.OriginServerTS {
+		return nil, fmt.Errorf("server %s returned an event which doesn't match its /timestamp_to_event response", s)
+	}
+	if err = gomatrixserverlib.VerifyEventSignatures(ctx, event, a.keyRing, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return a.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to verify signatures of event %s: %w", res.EventID, err)
+	}
+	return event, nil
+}
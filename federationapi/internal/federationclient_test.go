@@ -12,6 +12,7 @@ import (
 	"testing"
 
 	"github.com/ike20013/dendrite/federationapi/queue"
+	"github.com/ike20013/dendrite/federationapi/sharding"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/process"
@@ -54,12 +55,13 @@ func TestFederationClientQueryKeys(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
 		cfg:        &cfg,
@@ -67,7 +69,7 @@ func TestFederationClientQueryKeys(t *testing.T) {
 		federation: fedClient,
 		queues:     queues,
 	}
-	_, err := fedapi.QueryKeys(context.Background(), "origin", "server", nil)
+	_, err = fedapi.QueryKeys(context.Background(), "origin", "server", nil)
 	assert.Nil(t, err)
 	assert.True(t, fedClient.queryKeysCalled)
 }
@@ -85,12 +87,13 @@ func TestFederationClientQueryKeysBlacklisted(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
 		cfg:        &cfg,
@@ -98,7 +101,7 @@ func TestFederationClientQueryKeysBlacklisted(t *testing.T) {
 		federation: fedClient,
 		queues:     queues,
 	}
-	_, err := fedapi.QueryKeys(context.Background(), "origin", "server", nil)
+	_, err = fedapi.QueryKeys(context.Background(), "origin", "server", nil)
 	assert.NotNil(t, err)
 	assert.False(t, fedClient.queryKeysCalled)
 }
@@ -115,12 +118,13 @@ func TestFederationClientQueryKeysFailure(t *testing.T) {
 	}
 	fedClient := &testFedClient{shouldFail: true}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
 		cfg:        &cfg,
@@ -128,7 +132,7 @@ func TestFederationClientQueryKeysFailure(t *testing.T) {
 		federation: fedClient,
 		queues:     queues,
 	}
-	_, err := fedapi.QueryKeys(context.Background(), "origin", "server", nil)
+	_, err = fedapi.QueryKeys(context.Background(), "origin", "server", nil)
 	assert.NotNil(t, err)
 	assert.True(t, fedClient.queryKeysCalled)
 }
@@ -145,12 +149,13 @@ func TestFederationClientClaimKeys(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
 		cfg:        &cfg,
@@ -158,7 +163,7 @@ func TestFederationClientClaimKeys(t *testing.T) {
 		federation: fedClient,
 		queues:     queues,
 	}
-	_, err := fedapi.ClaimKeys(context.Background(), "origin", "server", nil)
+	_, err = fedapi.ClaimKeys(context.Background(), "origin", "server", nil)
 	assert.Nil(t, err)
 	assert.True(t, fedClient.claimKeysCalled)
 }
@@ -176,12 +181,13 @@ func TestFederationClientClaimKeysBlacklisted(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedapi := FederationInternalAPI{
 		db:         testDB,
 		cfg:        &cfg,
@@ -189,7 +195,7 @@ func TestFederationClientClaimKeysBlacklisted(t *testing.T) {
 		federation: fedClient,
 		queues:     queues,
 	}
-	_, err := fedapi.ClaimKeys(context.Background(), "origin", "server", nil)
+	_, err = fedapi.ClaimKeys(context.Background(), "origin", "server", nil)
 	assert.NotNil(t, err)
 	assert.False(t, fedClient.claimKeysCalled)
 }
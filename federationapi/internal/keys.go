@@ -6,11 +6,83 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/ike20013/dendrite/federationapi/serverfilter"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+func init() {
+	prometheus.MustRegister(keyFetchesTotal, keyFetchDuration)
+}
+
+var keyFetchesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "key_fetches_total",
+		Help:      "How many times server keys were fetched, directly or from a perspective server, and whether all, some or none of the keys were returned",
+	},
+	[]string{"fetcher", "outcome"},
+)
+
+var keyFetchDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "key_fetch_duration_seconds",
+		Help:      "How long it took to fetch server keys, directly or from a perspective server",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"fetcher"},
+)
+
+// fetcherKind returns whether the fetcher asks the servers for their keys
+// directly or asks a perspective server for them.
+func fetcherKind(fetcher gomatrixserverlib.KeyFetcher) string {
+	switch f := fetcher.(type) {
+	case *filteredKeyFetcher:
+		if f.notary != "" {
+			return "perspective"
+		}
+		return fetcherKind(f.KeyFetcher)
+	case *gomatrixserverlib.DirectKeyFetcher:
+		return "direct"
+	case *gomatrixserverlib.PerspectiveKeyFetcher:
+		return "perspective"
+	default:
+		return "other"
+	}
+}
+
+// filteredKeyFetcher doesn't fetch the keys of servers we aren't allowed to
+// federate with, and doesn't fetch anything if the notary it asks isn't allowed.
+type filteredKeyFetcher struct {
+	gomatrixserverlib.KeyFetcher
+	filter *serverfilter.Filter
+	notary spec.ServerName // empty if the keys are fetched directly
+}
+
+func (f *filteredKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	if f.notary != "" && !f.filter.IsAllowed(f.notary) {
+		return nil, fmt.Errorf("federation with %q is not allowed", f.notary)
+	}
+	allowed := make(map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp, len(requests))
+	for req, ts := range requests {
+		if f.filter.IsAllowed(req.ServerName) {
+			allowed[req] = ts
+		}
+	}
+	if len(allowed) == 0 {
+		return map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}, nil
+	}
+	return f.KeyFetcher.FetchKeys(ctx, allowed)
+}
+
 func (s *FederationInternalAPI) KeyRing() *gomatrixserverlib.KeyRing {
 	// Return a keyring that forces requests to be proxied through the
 	// below functions. That way we can enforce things like validity
@@ -195,8 +267,13 @@ func (s *FederationInternalAPI) handleFetcherKeys(
 	defer fetcherCancel()
 
 	// Try to fetch the keys.
+	kind := fetcherKind(fetcher)
+	requested := len(requests)
+	started := time.Now()
 	fetcherResults, err := fetcher.FetchKeys(fetcherCtx, requests)
+	keyFetchDuration.WithLabelValues(kind).Observe(time.Since(started).Seconds())
 	if err != nil {
+		keyFetchesTotal.WithLabelValues(kind, "failure").Inc()
 		return fmt.Errorf("fetcher.FetchKeys: %w", err)
 	}
 
@@ -230,6 +307,15 @@ func (s *FederationInternalAPI) handleFetcherKeys(
 		delete(requests, req)
 	}
 
+	switch {
+	case len(requests) == 0:
+		keyFetchesTotal.WithLabelValues(kind, "success").Inc()
+	case len(requests) < requested:
+		keyFetchesTotal.WithLabelValues(kind, "partial").Inc()
+	default:
+		keyFetchesTotal.WithLabelValues(kind, "failure").Inc()
+	}
+
 	// Store the keys from our store map.
 	if err = s.keyRing.KeyDatabase.StoreKeys(context.Background(), storeResults); err != nil {
 		logrus.WithError(err).WithFields(logrus.Fields{
@@ -17,6 +17,7 @@ import (
 
 	"github.com/ike20013/dendrite/federationapi/api"
 	"github.com/ike20013/dendrite/federationapi/consumers"
+	"github.com/ike20013/dendrite/federationapi/sharding"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	roomserverAPI "github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/roomserver/types"
@@ -80,15 +81,29 @@ func (r *FederationInternalAPI) PerformJoin(
 	// to respond.
 	seenSet := make(map[spec.ServerName]bool)
 	var uniqueList []spec.ServerName
+	denied := 0
 	for _, srv := range request.ServerNames {
 		if seenSet[srv] || r.cfg.Matrix.IsLocalServerName(srv) {
 			continue
 		}
 		seenSet[srv] = true
+		if !r.filter.IsAllowed(srv) {
+			denied++
+			continue
+		}
 		uniqueList = append(uniqueList, srv)
 	}
 	request.ServerNames = uniqueList
 
+	// Don't try to join if federation with all of the servers is denied.
+	if len(uniqueList) == 0 && denied > 0 {
+		response.LastError = &gomatrix.HTTPError{
+			Code:    403,
+			Message: `{"errcode": "M_FORBIDDEN", "error": "Federation with the servers of this room is not allowed."}`,
+		}
+		return
+	}
+
 	// Try each server that we were provided until we land on one that
 	// successfully completes the make-join send-join dance.
 	var lastErr error
@@ -532,6 +547,7 @@ func (r *FederationInternalAPI) PerformLeave(
 		}
 
 		r.statistics.ForServer(serverName).Success(statistics.SendDirect)
+		response.Event = &types.HeaderedEvent{PDU: event}
 		return nil
 	}
 
@@ -542,6 +558,165 @@ func (r *FederationInternalAPI) PerformLeave(
 	)
 }
 
+// PerformKnock implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformKnock(
+	ctx context.Context,
+	request *api.PerformKnockRequest,
+	response *api.PerformKnockResponse,
+) error {
+	userID, err := spec.NewUserID(request.UserID, true)
+	if err != nil {
+		return err
+	}
+	if _, err = spec.NewRoomID(request.RoomID); err != nil {
+		return err
+	}
+
+	// Look up the supported room versions.
+	var supportedVersions []gomatrixserverlib.RoomVersion
+	for version := range version.SupportedRoomVersions() {
+		supportedVersions = append(supportedVersions, version)
+	}
+
+	// Deduplicate the server names we were provided but keep the ordering
+	// as this encodes useful information about which servers are most likely
+	// to respond.
+	seenSet := make(map[spec.ServerName]bool)
+	var uniqueList []spec.ServerName
+	for _, srv := range request.ServerNames {
+		if seenSet[srv] || r.cfg.Matrix.IsLocalServerName(srv) {
+			continue
+		}
+		seenSet[srv] = true
+		uniqueList = append(uniqueList, srv)
+	}
+	request.ServerNames = uniqueList
+
+	// Try each server that we were provided until we land on one that
+	// successfully completes the make-knock send-knock dance.
+	var lastErr error
+	for _, serverName := range request.ServerNames {
+		if !r.shouldAttemptDirectFederation(serverName) {
+			continue
+		}
+		if lastErr = r.performKnockUsingServer(
+			ctx, request, response, *userID, serverName, supportedVersions,
+		); lastErr != nil {
+			logrus.WithError(lastErr).WithFields(logrus.Fields{
+				"server_name": serverName,
+				"room_id":     request.RoomID,
+			}).Warnf("Failed to knock on room through server")
+			continue
+		}
+
+		response.KnockedVia = serverName
+		return nil
+	}
+
+	// If we reach here then we didn't complete a knock for some reason.
+	var httpErr gomatrix.HTTPError
+	if ok := errors.As(lastErr, &httpErr); ok {
+		httpErr.Message = string(httpErr.Contents)
+		response.LastError = &httpErr
+	} else {
+		response.LastError = &gomatrix.HTTPError{
+			Code:    0,
+			Message: "Unknown HTTP error",
+		}
+		if lastErr != nil {
+			response.LastError.Message = lastErr.Error()
+		}
+	}
+	return fmt.Errorf(
+		"failed to knock on room %q through %d server(s): last error %s",
+		request.RoomID, len(request.ServerNames), lastErr,
+	)
+}
+
+func (r *FederationInternalAPI) performKnockUsingServer(
+	ctx context.Context,
+	request *api.PerformKnockRequest,
+	response *api.PerformKnockResponse,
+	userID spec.UserID,
+	serverName spec.ServerName,
+	supportedVersions []gomatrixserverlib.RoomVersion,
+) error {
+	respMakeKnock, err := r.federation.MakeKnock(
+		ctx,
+		userID.Domain(),
+		serverName,
+		request.RoomID,
+		request.UserID,
+		supportedVersions,
+	)
+	if err != nil {
+		r.statistics.ForServer(serverName).Failure()
+		return fmt.Errorf("r.federation.MakeKnock: %w", err)
+	}
+
+	// Work out if we support the room version that has been supplied in
+	// the make_knock response.
+	verImpl, err := gomatrixserverlib.GetRoomVersion(respMakeKnock.RoomVersion)
+	if err != nil {
+		return err
+	}
+	if respMakeKnock.RoomVersion == gomatrixserverlib.RoomVersionPseudoIDs {
+		return fmt.Errorf("knocking is not supported in room version %q", respMakeKnock.RoomVersion)
+	}
+
+	// Set all the fields to be what they should be, this should be a no-op
+	// but it's possible that the remote server returned us something "odd"
+	senderIDString := userID.String()
+	respMakeKnock.KnockEvent.Type = spec.MRoomMember
+	respMakeKnock.KnockEvent.SenderID = senderIDString
+	respMakeKnock.KnockEvent.StateKey = &senderIDString
+	respMakeKnock.KnockEvent.RoomID = request.RoomID
+	respMakeKnock.KnockEvent.Redacts = ""
+	content := gomatrixserverlib.MemberContent{
+		Membership: spec.Knock,
+		Reason:     request.Reason,
+	}
+	if err = respMakeKnock.KnockEvent.SetContent(content); err != nil {
+		return fmt.Errorf("respMakeKnock.KnockEvent.SetContent: %w", err)
+	}
+	if err = respMakeKnock.KnockEvent.SetUnsigned(struct{}{}); err != nil {
+		return fmt.Errorf("respMakeKnock.KnockEvent.SetUnsigned: %w", err)
+	}
+
+	identity, err := r.cfg.Matrix.SigningIdentityFor(userID.Domain())
+	if err != nil {
+		return err
+	}
+
+	// Build the knock event.
+	event, err := verImpl.NewEventBuilderFromProtoEvent(&respMakeKnock.KnockEvent).Build(
+		time.Now(),
+		identity.ServerName,
+		identity.KeyID,
+		identity.PrivateKey,
+	)
+	if err != nil {
+		return fmt.Errorf("respMakeKnock.KnockEvent.Build: %w", err)
+	}
+
+	// Try to perform a send_knock using the newly built event.
+	respSendKnock, err := r.federation.SendKnock(
+		ctx,
+		userID.Domain(),
+		serverName,
+		event,
+	)
+	if err != nil {
+		r.statistics.ForServer(serverName).Failure()
+		return fmt.Errorf("r.federation.SendKnock: %w", err)
+	}
+	r.statistics.ForServer(serverName).Success(statistics.SendDirect)
+
+	response.Event = &types.HeaderedEvent{PDU: event}
+	response.KnockRoomState = respSendKnock.KnockRoomState
+	return nil
+}
+
 // SendInvite implements api.FederationInternalAPI
 func (r *FederationInternalAPI) SendInvite(
 	ctx context.Context,
@@ -694,6 +869,94 @@ func (r *FederationInternalAPI) MarkServersAlive(destinations []spec.ServerName)
 	}
 }
 
+// PerformResetFederationDestination implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformResetFederationDestination(ctx context.Context, s spec.ServerName) error {
+	return r.queues.Control(ctx, &sharding.Control{ResetServer: s})
+}
+
+// PerformPurgeFederationQueue implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformPurgeFederationQueue(ctx context.Context, s spec.ServerName) error {
+	return r.queues.Control(ctx, &sharding.Control{PurgeServer: s})
+}
+
+// PerformSetFederationDomainLists implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformSetFederationDomainLists(ctx context.Context, lists *api.FederationDomainLists) error {
+	if r.filter == nil {
+		return fmt.Errorf("federation domain lists are not supported")
+	}
+	if err := r.queues.Control(ctx, &sharding.Control{
+		DomainLists: &sharding.DomainLists{Allowed: lists.Allowed, Denied: lists.Denied},
+	}); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"allowed": lists.Allowed,
+		"denied":  lists.Denied,
+	}).Info("Updated federation domain lists")
+	return nil
+}
+
+// PerformEvictServerSigningKeys implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformEvictServerSigningKeys(ctx context.Context, s spec.ServerName) error {
+	keys, err := r.db.GetServerSigningKeys(ctx, s)
+	if err != nil {
+		return fmt.Errorf("r.db.GetServerSigningKeys: %w", err)
+	}
+	if err = r.db.DeleteServerSigningKeys(ctx, s); err != nil {
+		return fmt.Errorf("r.db.DeleteServerSigningKeys: %w", err)
+	}
+	if r.keyCache != nil {
+		for req := range keys {
+			r.keyCache.EvictServerKey(req)
+		}
+	}
+	return nil
+}
+
+// PerformRefetchServerSigningKeys implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformRefetchServerSigningKeys(ctx context.Context, s spec.ServerName) ([]api.ServerSigningKey, error) {
+	keys, err := r.db.GetServerSigningKeys(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("r.db.GetServerSigningKeys: %w", err)
+	}
+	held := len(keys)
+
+	// Ask the fetchers in turn, as when verifying an event, for the keys we
+	// hold and for all current keys of the server, which an empty key ID
+	// asks for. Keys which come back with a later validity than the ones we
+	// hold replace them.
+	now := spec.AsTimestamp(time.Now())
+	allKeys := gomatrixserverlib.PublicKeyLookupRequest{ServerName: s}
+	requests := make(map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp, held+1)
+	requests[allKeys] = now
+	for req := range keys {
+		requests[req] = now
+	}
+	requested := len(requests)
+	fetched := false
+	for _, fetcher := range r.keyRing.KeyFetchers {
+		if len(requests) == 0 {
+			break
+		}
+		if err = r.handleFetcherKeys(ctx, now, fetcher, requests, keys); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"fetcher_name": fetcher.FetcherName(),
+				"server_name":  s,
+			}).Warn("Failed to refetch server keys")
+		}
+		// Fetched keys are either ones we hold, which are no longer requested,
+		// or new ones, which are added to the keys.
+		if len(requests) < requested || len(keys) > held {
+			fetched = true
+			delete(requests, allKeys)
+		}
+	}
+	if !fetched {
+		return nil, fmt.Errorf("none of the key fetchers returned keys for %q", s)
+	}
+	return r.QueryServerSigningKeys(ctx, s)
+}
+
 func checkEventsContainCreateEvent(events []gomatrixserverlib.PDU) error {
 	// sanity check we have a create event and it has a known room version
 	for _, ev := range events {
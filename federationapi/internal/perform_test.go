@@ -13,6 +13,8 @@ import (
 
 	"github.com/ike20013/dendrite/federationapi/api"
 	"github.com/ike20013/dendrite/federationapi/queue"
+	"github.com/ike20013/dendrite/federationapi/serverfilter"
+	"github.com/ike20013/dendrite/federationapi/sharding"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/process"
@@ -59,14 +61,15 @@ func TestPerformWakeupServers(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil, nil,
 	)
 
 	req := api.PerformWakeupServersRequest{
@@ -105,14 +108,15 @@ func TestQueryRelayServers(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil, nil,
 	)
 
 	req := api.P2PQueryRelayServersRequest{
@@ -146,14 +150,15 @@ func TestRemoveRelayServers(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil, nil,
 	)
 
 	req := api.P2PRemoveRelayServersRequest{
@@ -186,14 +191,15 @@ func TestPerformDirectoryLookup(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil, nil,
 	)
 
 	req := api.PerformDirectoryLookupRequest{
@@ -225,14 +231,15 @@ func TestPerformDirectoryLookupRelaying(t *testing.T) {
 	}
 	fedClient := &testFedClient{}
 	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
-	queues := queue.NewOutgoingQueues(
+	queues, err := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, nil, sharding.Shard{}, nil, config.DestinationQueue{},
 	)
+	assert.NoError(t, err)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil, nil,
 	)
 
 	req := api.PerformDirectoryLookupRequest{
@@ -243,3 +250,50 @@ func TestPerformDirectoryLookupRelaying(t *testing.T) {
 	err = fedAPI.PerformDirectoryLookup(context.Background(), &req, &res)
 	assert.Error(t, err)
 }
+
+func TestPerformJoinDeniedServer(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	cfg := config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "local",
+				KeyID:      "ed25519:1",
+				PrivateKey: key,
+			},
+		},
+	}
+	filter, err := serverfilter.New(nil, []string{"*.evil"})
+	assert.NoError(t, err)
+	// The embedded federation client is nil, so contacting the server would panic.
+	fedClient := &testFedClient{}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	queues, err := queue.NewOutgoingQueues(
+		testDB, process.NewProcessContext(),
+		false,
+		cfg.Matrix.ServerName, fedClient, &stats,
+		nil, filter, sharding.Shard{}, nil, config.DestinationQueue{},
+	)
+	assert.NoError(t, err)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, filter, nil,
+	)
+
+	req := api.PerformJoinRequest{
+		RoomID:      "!room:spam.evil",
+		UserID:      "@alice:local",
+		ServerNames: []spec.ServerName{"spam.evil", "other.evil:8448"},
+	}
+	res := api.PerformJoinResponse{}
+	fedAPI.PerformJoin(context.Background(), &req, &res)
+	if assert.NotNil(t, res.LastError) {
+		assert.Equal(t, 403, res.LastError.Code)
+	}
+
+	_, err = fedAPI.IsBlacklistedOrBackingOff("spam.evil")
+	assert.Error(t, err)
+	assert.False(t, fedAPI.IsServerNameAllowed("other.evil:8448"))
+	assert.True(t, fedAPI.IsServerNameAllowed("good.example"))
+}
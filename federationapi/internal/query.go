@@ -3,6 +3,7 @@ package external
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/ike20013/dendrite/federationapi/api"
@@ -77,6 +78,14 @@ func (a *FederationInternalAPI) fetchServerKeysFromCache(
 func (a *FederationInternalAPI) QueryServerKeys(
 	ctx context.Context, req *api.QueryServerKeysRequest, res *api.QueryServerKeysResponse,
 ) error {
+	// Our own keys are always served, other servers' only if we vouch for them.
+	if !a.cfg.Matrix.IsLocalServerName(req.ServerName) {
+		if !a.cfg.Notary.Enabled || !a.notary.IsAllowed(req.ServerName) || !a.filter.IsAllowed(req.ServerName) {
+			util.GetLogger(ctx).WithField("server", req.ServerName).Debug("notary: not vouching for the keys of server")
+			return nil
+		}
+	}
+
 	// attempt to satisfy the entire request from the cache first
 	results, err := a.fetchServerKeysFromCache(ctx, req)
 	if err == nil {
@@ -105,3 +114,125 @@ func (a *FederationInternalAPI) QueryServerKeys(
 	res.ServerKeys = []gomatrixserverlib.ServerKeys{*serverKeys}
 	return nil
 }
+
+// QueryFederationDestinations implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryFederationDestinations(ctx context.Context) ([]api.FederationDestination, error) {
+	serverNames := map[spec.ServerName]struct{}{}
+	for _, serverName := range f.statistics.Servers() {
+		serverNames[serverName] = struct{}{}
+	}
+	pduServerNames, err := f.db.GetPendingPDUServerNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetPendingPDUServerNames: %w", err)
+	}
+	eduServerNames, err := f.db.GetPendingEDUServerNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetPendingEDUServerNames: %w", err)
+	}
+	for _, serverName := range append(pduServerNames, eduServerNames...) {
+		serverNames[serverName] = struct{}{}
+	}
+
+	destinations := make([]api.FederationDestination, 0, len(serverNames))
+	for serverName := range serverNames {
+		destination, err := f.federationDestination(ctx, serverName)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, *destination)
+	}
+	sort.Slice(destinations, func(i, j int) bool {
+		return destinations[i].ServerName < destinations[j].ServerName
+	})
+	return destinations, nil
+}
+
+// QueryFederationDestination implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryFederationDestination(ctx context.Context, s spec.ServerName) (*api.FederationDestination, error) {
+	known := false
+	for _, serverName := range f.statistics.Servers() {
+		if serverName == s {
+			known = true
+			break
+		}
+	}
+	if !known {
+		// Avoid creating statistics for servers we have never heard of.
+		blacklisted, err := f.db.IsServerBlacklisted(s)
+		if err != nil {
+			return nil, fmt.Errorf("f.db.IsServerBlacklisted: %w", err)
+		}
+		pendingPDUs, err := f.db.GetPendingPDUCount(ctx, s)
+		if err != nil {
+			return nil, fmt.Errorf("f.db.GetPendingPDUCount: %w", err)
+		}
+		pendingEDUs, err := f.db.GetPendingEDUCount(ctx, s)
+		if err != nil {
+			return nil, fmt.Errorf("f.db.GetPendingEDUCount: %w", err)
+		}
+		if !blacklisted && pendingPDUs == 0 && pendingEDUs == 0 {
+			return nil, nil
+		}
+	}
+	return f.federationDestination(ctx, s)
+}
+
+func (f *FederationInternalAPI) federationDestination(ctx context.Context, s spec.ServerName) (*api.FederationDestination, error) {
+	pendingPDUs, err := f.db.GetPendingPDUCount(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetPendingPDUCount: %w", err)
+	}
+	pendingEDUs, err := f.db.GetPendingEDUCount(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("f.db.GetPendingEDUCount: %w", err)
+	}
+	stats := f.statistics.ForServer(s)
+	destination := &api.FederationDestination{
+		ServerName:          s,
+		FailureCount:        stats.FailureCount(),
+		Blacklisted:         stats.Blacklisted(),
+		AssumedOffline:      stats.AssumedOffline(),
+		RelayServers:        stats.KnownRelayServers(),
+		PendingPDUs:         pendingPDUs,
+		PendingEDUs:         pendingEDUs,
+		RetryingTransaction: f.queues.RetryingTransaction(s),
+	}
+	if until := stats.BackoffInfo(); stats.BackingOff() && until != nil && !until.IsZero() {
+		destination.BackoffUntil = until
+	}
+	return destination, nil
+}
+
+// QueryFederationDomainLists implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryFederationDomainLists(ctx context.Context) (*api.FederationDomainLists, error) {
+	allowed, denied := f.filter.Lists()
+	return &api.FederationDomainLists{
+		Allowed: allowed,
+		Denied:  denied,
+	}, nil
+}
+
+// QueryServerSigningKeys implements api.FederationInternalAPI
+func (a *FederationInternalAPI) QueryServerSigningKeys(ctx context.Context, s spec.ServerName) ([]api.ServerSigningKey, error) {
+	keys, err := a.db.GetServerSigningKeys(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("a.db.GetServerSigningKeys: %w", err)
+	}
+	signingKeys := make([]api.ServerSigningKey, 0, len(keys))
+	for req, res := range keys {
+		signingKeys = append(signingKeys, api.ServerSigningKey{
+			ServerName:   req.ServerName,
+			KeyID:        req.KeyID,
+			PublicKey:    res.Key,
+			ValidUntilTS: res.ValidUntilTS,
+			ExpiredTS:    res.ExpiredTS,
+		})
+	}
+	sort.Slice(signingKeys, func(i, j int) bool {
+		if signingKeys[i].ServerName != signingKeys[j].ServerName {
+			return signingKeys[i].ServerName < signingKeys[j].ServerName
+		}
+		return signingKeys[i].KeyID < signingKeys[j].KeyID
+	})
+	return signingKeys, nil
+}
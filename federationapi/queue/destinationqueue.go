@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,17 +25,37 @@ import (
 	"github.com/ike20013/dendrite/federationapi/storage"
 	"github.com/ike20013/dendrite/federationapi/storage/shared/receipt"
 	"github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/process"
 )
 
 const (
-	maxPDUsPerTransaction = 50
+	maxPDUsPerTransaction = 50 // the most the spec allows, and the default
 	maxEDUsPerTransaction = 100
-	maxPDUsInMemory       = 128
-	maxEDUsInMemory       = 128
+	defaultPDUsInMemory   = 128
+	defaultEDUsInMemory   = 128
 	queueIdleTimeout      = time.Second * 30
 )
 
+// withDefaults returns the limits, using the defaults for those which aren't set.
+func withDefaults(limits config.DestinationQueue) config.DestinationQueue {
+	if limits.MaxPDUsPerTransaction <= 0 || limits.MaxPDUsPerTransaction > maxPDUsPerTransaction {
+		limits.MaxPDUsPerTransaction = maxPDUsPerTransaction
+	}
+	if limits.MaxEDUsPerTransaction <= 0 || limits.MaxEDUsPerTransaction > maxEDUsPerTransaction {
+		limits.MaxEDUsPerTransaction = maxEDUsPerTransaction
+	}
+	if limits.MaxPDUsInMemory <= 0 {
+		limits.MaxPDUsInMemory = defaultPDUsInMemory
+	}
+	if limits.MaxEDUsInMemory <= 0 {
+		limits.MaxEDUsInMemory = defaultEDUsInMemory
+	}
+	limits.MaxPDUsInMemory = max(limits.MaxPDUsInMemory, limits.MaxPDUsPerTransaction)
+	limits.MaxEDUsInMemory = max(limits.MaxEDUsInMemory, limits.MaxEDUsPerTransaction)
+	return limits
+}
+
 // destinationQueue is a queue of events for a single destination.
 // It is responsible for sending the events to the destination and
 // ensures that only one request is in flight to a given destination
@@ -44,18 +65,19 @@ type destinationQueue struct {
 	db                 storage.Database
 	process            *process.ProcessContext
 	signing            map[spec.ServerName]*fclient.SigningIdentity
+	limits             config.DestinationQueue
 	client             fclient.FederationClient        // federation client
 	origin             spec.ServerName                 // origin of requests
 	destination        spec.ServerName                 // destination of requests
 	running            atomic.Bool                     // is the queue worker running?
 	backingOff         atomic.Bool                     // true if we're backing off
-	overflowed         atomic.Bool                     // the queues exceed maxPDUsInMemory/maxEDUsInMemory, so we should consult the database for more
+	overflowed         atomic.Bool                     // the queues exceed the limits in memory, so we should consult the database for more
 	statistics         *statistics.ServerStatistics    // statistics about this remote server
 	transactionIDMutex sync.Mutex                      // protects transactionID
 	transactionID      gomatrixserverlib.TransactionID // last transaction ID if retrying, or "" if last txn was successful
 	notify             chan struct{}                   // interrupts idle wait pending PDUs/EDUs
 	pendingPDUs        []*queuedPDU                    // PDUs waiting to be sent
-	pendingEDUs        []*queuedEDU                    // EDUs waiting to be sent
+	pendingEDUs        [eduClassCount][]*queuedEDU     // EDUs waiting to be sent, by class and then age
 	pendingMutex       sync.RWMutex                    // protects pendingPDUs and pendingEDUs
 }
 
@@ -74,11 +96,13 @@ func (oq *destinationQueue) sendEvent(event *types.HeaderedEvent, dbReceipt *rec
 		// If there's room in memory to hold the event then add it to the
 		// list.
 		oq.pendingMutex.Lock()
-		if len(oq.pendingPDUs) < maxPDUsInMemory {
+		if len(oq.pendingPDUs) < oq.limits.MaxPDUsInMemory {
 			oq.pendingPDUs = append(oq.pendingPDUs, &queuedPDU{
 				pdu:       event,
 				dbReceipt: dbReceipt,
+				queued:    time.Now(),
 			})
+			oq.updateDepthMetrics()
 		} else {
 			oq.overflowed.Store(true)
 		}
@@ -103,17 +127,18 @@ func (oq *destinationQueue) sendEDU(event *gomatrixserverlib.EDU, dbReceipt *rec
 	// up the queue.
 	if !oq.statistics.Blacklisted() {
 		// If there's room in memory to hold the event then add it to the
-		// list.
+		// list, dropping older EDUs which it supersedes.
 		oq.pendingMutex.Lock()
-		if len(oq.pendingEDUs) < maxEDUsInMemory {
-			oq.pendingEDUs = append(oq.pendingEDUs, &queuedEDU{
-				edu:       event,
-				dbReceipt: dbReceipt,
-			})
+		var superseded []*receipt.Receipt
+		if oq.makeRoomForEDU(classifyEDU(event.Type)) {
+			oq.addEDU(newQueuedEDU(event, dbReceipt, time.Now()))
+			superseded = oq.coalesceEDUs()
+			oq.updateDepthMetrics()
 		} else {
 			oq.overflowed.Store(true)
 		}
 		oq.pendingMutex.Unlock()
+		oq.cleanSupersededEDUs(superseded)
 
 		if !oq.backingOff.Load() {
 			oq.wakeQueueAndNotify()
@@ -140,7 +165,7 @@ func (oq *destinationQueue) wakeQueueIfEventsPending(forceWakeup bool) {
 	eventsPending := func() bool {
 		oq.pendingMutex.Lock()
 		defer oq.pendingMutex.Unlock()
-		return len(oq.pendingPDUs) > 0 || len(oq.pendingEDUs) > 0
+		return len(oq.pendingPDUs) > 0 || oq.pendingEDUCount() > 0
 	}
 
 	// NOTE : Only wakeup and notify the queue if there are pending events
@@ -193,7 +218,6 @@ func (oq *destinationQueue) getPendingFromDatabase() {
 	retrieved := false
 	ctx := oq.process.Context()
 	oq.pendingMutex.Lock()
-	defer oq.pendingMutex.Unlock()
 
 	// Take a note of all of the PDUs and EDUs that we already
 	// have cached. We will index them based on the receipt,
@@ -204,59 +228,87 @@ func (oq *destinationQueue) getPendingFromDatabase() {
 	for _, pdu := range oq.pendingPDUs {
 		gotPDUs[pdu.dbReceipt.String()] = struct{}{}
 	}
-	for _, edu := range oq.pendingEDUs {
-		gotEDUs[edu.dbReceipt.String()] = struct{}{}
+	for _, edus := range oq.pendingEDUs {
+		for _, edu := range edus {
+			gotEDUs[edu.dbReceipt.String()] = struct{}{}
+		}
 	}
 
 	overflowed := false
-	if pduCapacity := maxPDUsInMemory - len(oq.pendingPDUs); pduCapacity > 0 {
+	maxPDUs, maxEDUs := oq.limits.MaxPDUsInMemory, oq.limits.MaxEDUsInMemory
+	if pduCapacity := maxPDUs - len(oq.pendingPDUs); pduCapacity > 0 {
 		// We have room in memory for some PDUs - let's request no more than that.
-		if pdus, err := oq.db.GetPendingPDUs(ctx, oq.destination, maxPDUsInMemory); err == nil {
-			if len(pdus) == maxPDUsInMemory {
+		if pdus, err := oq.db.GetPendingPDUs(ctx, oq.destination, maxPDUs); err == nil {
+			if len(pdus) == maxPDUs {
 				overflowed = true
 			}
+			retrievedPDUs := make([]*queuedPDU, 0, len(pdus))
 			for receipt, pdu := range pdus {
 				if _, ok := gotPDUs[receipt.String()]; ok {
 					continue
 				}
-				oq.pendingPDUs = append(oq.pendingPDUs, &queuedPDU{receipt, pdu})
-				retrieved = true
-				if len(oq.pendingPDUs) == maxPDUsInMemory {
-					break
-				}
+				retrievedPDUs = append(retrievedPDUs, &queuedPDU{dbReceipt: receipt, pdu: pdu, queued: time.Now()})
+			}
+			// Send the oldest first. Those we already hold are older still, and
+			// one of them may be part of a transaction which is being retried.
+			sort.Slice(retrievedPDUs, func(i, j int) bool {
+				return retrievedPDUs[i].dbReceipt.GetNID() < retrievedPDUs[j].dbReceipt.GetNID()
+			})
+			if len(retrievedPDUs) > pduCapacity {
+				retrievedPDUs = retrievedPDUs[:pduCapacity]
 			}
+			oq.pendingPDUs = append(oq.pendingPDUs, retrievedPDUs...)
+			retrieved = retrieved || len(retrievedPDUs) > 0
 		} else {
 			logrus.WithError(err).Errorf("Failed to get pending PDUs for %q", oq.destination)
 		}
 	}
 
-	if eduCapacity := maxEDUsInMemory - len(oq.pendingEDUs); eduCapacity > 0 {
+	if eduCapacity := maxEDUs - oq.pendingEDUCount(); eduCapacity > 0 {
 		// We have room in memory for some EDUs - let's request no more than that.
-		if edus, err := oq.db.GetPendingEDUs(ctx, oq.destination, maxEDUsInMemory); err == nil {
-			if len(edus) == maxEDUsInMemory {
+		if edus, err := oq.db.GetPendingEDUs(ctx, oq.destination, maxEDUs); err == nil {
+			if len(edus) == maxEDUs {
 				overflowed = true
 			}
+			now := time.Now()
+			retrievedEDUs := make([]*queuedEDU, 0, len(edus))
 			for receipt, edu := range edus {
 				if _, ok := gotEDUs[receipt.String()]; ok {
 					continue
 				}
-				oq.pendingEDUs = append(oq.pendingEDUs, &queuedEDU{receipt, edu})
-				retrieved = true
-				if len(oq.pendingEDUs) == maxEDUsInMemory {
-					break
+				retrievedEDUs = append(retrievedEDUs, newQueuedEDU(edu, receipt, now))
+			}
+			// If there isn't room for all of them then keep the most important.
+			sort.Slice(retrievedEDUs, func(i, j int) bool {
+				if retrievedEDUs[i].class != retrievedEDUs[j].class {
+					return retrievedEDUs[i].class < retrievedEDUs[j].class
 				}
+				return retrievedEDUs[i].dbReceipt.GetNID() < retrievedEDUs[j].dbReceipt.GetNID()
+			})
+			if len(retrievedEDUs) > eduCapacity {
+				retrievedEDUs = retrievedEDUs[:eduCapacity]
 			}
+			for _, edu := range retrievedEDUs {
+				oq.addEDU(edu)
+			}
+			retrieved = retrieved || len(retrievedEDUs) > 0
 		} else {
 			logrus.WithError(err).Errorf("Failed to get pending EDUs for %q", oq.destination)
 		}
 	}
 
+	// Whatever we retrieved may have been superseded by newer EDUs since.
+	superseded := oq.coalesceEDUs()
+	oq.updateDepthMetrics()
+
 	// If we've retrieved all of the events from the database with room to spare
 	// in memory then we'll no longer consider this queue to be overflowed.
 	if !overflowed {
 		oq.overflowed.Store(false)
-	} else {
 	}
+	oq.pendingMutex.Unlock()
+	oq.cleanSupersededEDUs(superseded)
+
 	// If we've retrieved some events then notify the destination queue goroutine.
 	if retrieved {
 		select {
@@ -346,29 +398,29 @@ func (oq *destinationQueue) backgroundSend() {
 		}
 
 		// Work out which PDUs/EDUs to include in the next transaction.
-		oq.pendingMutex.RLock()
-		pduCount := len(oq.pendingPDUs)
-		eduCount := len(oq.pendingEDUs)
-		if pduCount > maxPDUsPerTransaction {
-			pduCount = maxPDUsPerTransaction
-		}
-		if eduCount > maxEDUsPerTransaction {
-			eduCount = maxEDUsPerTransaction
-		}
-		toSendPDUs := oq.pendingPDUs[:pduCount]
-		toSendEDUs := oq.pendingEDUs[:eduCount]
-		oq.pendingMutex.RUnlock()
+		toSendPDUs, toSendEDUs := oq.nextBatch()
 
 		// If we didn't get anything from the database and there are no
 		// pending EDUs then there's nothing to do - stop here.
-		if pduCount == 0 && eduCount == 0 {
+		if len(toSendPDUs) == 0 && len(toSendEDUs) == 0 {
 			continue
 		}
 
+		// Stop if the server has been denied since the queue was started.
+		// Whatever is pending stays in the database, so it will be sent if
+		// the server is allowed again.
+		if !oq.queues.filter.IsAllowed(oq.destination) {
+			oq.finishSending(toSendEDUs)
+			return
+		}
+
 		// If we have pending PDUs or EDUs then construct a transaction.
 		// Try sending the next transaction and see what happens.
 		terr, sendMethod := oq.nextTransaction(toSendPDUs, toSendEDUs)
 		if terr != nil {
+			// The EDUs may be superseded while we back off.
+			oq.finishSending(toSendEDUs)
+
 			// We failed to send the transaction. Mark it as a failure.
 			_, blacklisted := oq.statistics.Failure()
 			if !blacklisted {
@@ -384,7 +436,7 @@ func (oq *destinationQueue) backgroundSend() {
 				return
 			}
 		} else {
-			oq.handleTransactionSuccess(pduCount, eduCount, sendMethod)
+			oq.handleTransactionSuccess(toSendPDUs, toSendEDUs, sendMethod)
 		}
 	}
 }
@@ -554,14 +606,7 @@ func (oq *destinationQueue) blacklistDestination() {
 	logrus.Warnf("Blacklisting %q due to exceeding backoff threshold", oq.destination)
 
 	oq.pendingMutex.Lock()
-	for i := range oq.pendingPDUs {
-		oq.pendingPDUs[i] = nil
-	}
-	for i := range oq.pendingEDUs {
-		oq.pendingEDUs[i] = nil
-	}
-	oq.pendingPDUs = nil
-	oq.pendingEDUs = nil
+	oq.clearPending()
 	oq.pendingMutex.Unlock()
 
 	// Delete this queue as no more messages will be sent to this
@@ -570,9 +615,37 @@ func (oq *destinationQueue) blacklistDestination() {
 	oq.queues.clearQueue(oq)
 }
 
+// purge drops the pending PDUs and EDUs held in memory, and forgets the ID of
+// a failed transaction so that a new one is sent next time.
+func (oq *destinationQueue) purge() {
+	oq.pendingMutex.Lock()
+	oq.clearPending()
+	oq.updateDepthMetrics()
+	oq.overflowed.Store(false)
+	oq.pendingMutex.Unlock()
+
+	oq.transactionIDMutex.Lock()
+	oq.transactionID = ""
+	oq.transactionIDMutex.Unlock()
+}
+
+// clearPending drops the pending PDUs and EDUs held in memory. The lock must be held.
+func (oq *destinationQueue) clearPending() {
+	for i := range oq.pendingPDUs {
+		oq.pendingPDUs[i] = nil
+	}
+	oq.pendingPDUs = nil
+	for class := range oq.pendingEDUs {
+		for i := range oq.pendingEDUs[class] {
+			oq.pendingEDUs[class][i] = nil
+		}
+		oq.pendingEDUs[class] = nil
+	}
+}
+
 // handleTransactionSuccess updates the cached event queues as well as the success and
 // backoff information for this server.
-func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int, sendMethod statistics.SendMethod) {
+func (oq *destinationQueue) handleTransactionSuccess(pdus []*queuedPDU, edus []*queuedEDU, sendMethod statistics.SendMethod) {
 	// If we successfully sent the transaction then clear out
 	// the pending events and EDUs, and wipe our transaction ID.
 
@@ -580,16 +653,37 @@ func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int,
 	oq.pendingMutex.Lock()
 	defer oq.pendingMutex.Unlock()
 
+	// The sent PDUs are at the front of the queue, unless the queue was
+	// purged while the transaction was in flight.
+	pduCount := min(len(pdus), len(oq.pendingPDUs))
+	now := time.Now()
 	for i := range oq.pendingPDUs[:pduCount] {
+		observeTimeInQueue(oq.destination, "pdu", now.Sub(oq.pendingPDUs[i].queued))
 		oq.pendingPDUs[i] = nil
 	}
-	for i := range oq.pendingEDUs[:eduCount] {
-		oq.pendingEDUs[i] = nil
-	}
 	oq.pendingPDUs = oq.pendingPDUs[pduCount:]
-	oq.pendingEDUs = oq.pendingEDUs[eduCount:]
 
-	if len(oq.pendingPDUs) > 0 || len(oq.pendingEDUs) > 0 {
+	sent := make(map[*queuedEDU]struct{}, len(edus))
+	for _, edu := range edus {
+		sent[edu] = struct{}{}
+	}
+	for class, pending := range oq.pendingEDUs {
+		remaining := pending[:0]
+		for _, edu := range pending {
+			if _, ok := sent[edu]; ok {
+				observeTimeInQueue(oq.destination, edu.class.String(), now.Sub(edu.queued))
+				continue
+			}
+			remaining = append(remaining, edu)
+		}
+		for i := len(remaining); i < len(pending); i++ {
+			pending[i] = nil
+		}
+		oq.pendingEDUs[class] = remaining
+	}
+	oq.updateDepthMetrics()
+
+	if len(oq.pendingPDUs) > 0 || oq.pendingEDUCount() > 0 {
 		select {
 		case oq.notify <- struct{}{}:
 		default:
@@ -0,0 +1,230 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package queue
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/federationapi/storage/shared/receipt"
+	"github.com/ike20013/dendrite/federationapi/types"
+)
+
+// eduClass is the priority of an EDU when filling transactions. Lower classes
+// are sent first, and make way for each other when memory is short.
+type eduClass int
+
+const (
+	eduClassToDevice  eduClass = iota // to-device messages, device list and signing key updates
+	eduClassReceipt                   // read receipts, and EDUs of unknown types
+	eduClassEphemeral                 // presence and typing, which are superseded quickly
+	eduClassCount
+)
+
+func (c eduClass) String() string {
+	switch c {
+	case eduClassToDevice:
+		return "to_device"
+	case eduClassReceipt:
+		return "receipt"
+	case eduClassEphemeral:
+		return "ephemeral"
+	default:
+		return "unknown"
+	}
+}
+
+func classifyEDU(eduType string) eduClass {
+	switch eduType {
+	case spec.MDirectToDevice, spec.MDeviceListUpdate, types.MSigningKeyUpdate:
+		return eduClassToDevice
+	case spec.MTyping, spec.MPresence:
+		return eduClassEphemeral
+	default:
+		return eduClassReceipt
+	}
+}
+
+// supersedeKeys returns what the EDU updates, such that a newer EDU with the
+// same keys makes it obsolete: the typing state of a user in a room, or the
+// presence of users. Returns nil if the EDU can't be superseded.
+func supersedeKeys(edu *gomatrixserverlib.EDU) []string {
+	switch edu.Type {
+	case spec.MTyping:
+		var content struct {
+			RoomID string `json:"room_id"`
+			UserID string `json:"user_id"`
+		}
+		if err := json.Unmarshal(edu.Content, &content); err != nil || content.RoomID == "" || content.UserID == "" {
+			return nil
+		}
+		return []string{edu.Type + "\x00" + content.RoomID + "\x00" + content.UserID}
+	case spec.MPresence:
+		var content types.Presence
+		if err := json.Unmarshal(edu.Content, &content); err != nil || len(content.Push) == 0 {
+			return nil
+		}
+		keys := make([]string, 0, len(content.Push))
+		for _, presence := range content.Push {
+			if presence.UserID == "" {
+				return nil
+			}
+			keys = append(keys, edu.Type+"\x00"+presence.UserID)
+		}
+		return keys
+	default:
+		return nil
+	}
+}
+
+func newQueuedEDU(edu *gomatrixserverlib.EDU, dbReceipt *receipt.Receipt, queued time.Time) *queuedEDU {
+	return &queuedEDU{
+		dbReceipt: dbReceipt,
+		edu:       edu,
+		queued:    queued,
+		class:     classifyEDU(edu.Type),
+		keys:      supersedeKeys(edu),
+	}
+}
+
+// pendingEDUCount returns how many EDUs are held in memory. The lock must be held.
+func (oq *destinationQueue) pendingEDUCount() int {
+	count := 0
+	for _, edus := range oq.pendingEDUs {
+		count += len(edus)
+	}
+	return count
+}
+
+// addEDU adds the EDU to its class, keeping the class in the order the EDUs
+// were stored in the database. The lock must be held.
+func (oq *destinationQueue) addEDU(edu *queuedEDU) {
+	pending := oq.pendingEDUs[edu.class]
+	nid := edu.dbReceipt.GetNID()
+	i := sort.Search(len(pending), func(i int) bool {
+		return pending[i].dbReceipt.GetNID() > nid
+	})
+	pending = append(pending, nil)
+	copy(pending[i+1:], pending[i:])
+	pending[i] = edu
+	oq.pendingEDUs[edu.class] = pending
+}
+
+// makeRoomForEDU returns true if an EDU of the class can be held in memory,
+// evicting the newest EDU of a less important class if memory is full. The
+// evicted EDU stays in the database. The lock must be held.
+func (oq *destinationQueue) makeRoomForEDU(class eduClass) bool {
+	if oq.pendingEDUCount() < oq.limits.MaxEDUsInMemory {
+		return true
+	}
+	for evict := eduClassCount - 1; evict > class; evict-- {
+		pending := oq.pendingEDUs[evict]
+		for i := len(pending) - 1; i >= 0; i-- {
+			if pending[i].sending {
+				continue
+			}
+			copy(pending[i:], pending[i+1:])
+			pending[len(pending)-1] = nil
+			oq.pendingEDUs[evict] = pending[:len(pending)-1]
+			oq.overflowed.Store(true)
+			return true
+		}
+	}
+	return false
+}
+
+// coalesceEDUs drops the EDUs whose updates have all been superseded by newer
+// EDUs, like typing notifications followed by another one for the same user
+// and room. EDUs which are being sent are left alone. Returns the receipts of
+// the dropped EDUs, which should be cleaned from the database. The lock must
+// be held.
+func (oq *destinationQueue) coalesceEDUs() []*receipt.Receipt {
+	var superseded []*receipt.Receipt
+	for class, pending := range oq.pendingEDUs {
+		seen := map[string]struct{}{}
+		kept := len(pending)
+		for i := len(pending) - 1; i >= 0; i-- {
+			edu := pending[i]
+			if len(edu.keys) == 0 {
+				kept--
+				pending[kept] = edu
+				continue
+			}
+			obsolete := !edu.sending
+			for _, key := range edu.keys {
+				if _, ok := seen[key]; !ok {
+					obsolete = false
+					seen[key] = struct{}{}
+				}
+			}
+			if obsolete {
+				superseded = append(superseded, edu.dbReceipt)
+				continue
+			}
+			kept--
+			pending[kept] = edu
+		}
+		if kept == 0 {
+			continue
+		}
+		remaining := append(pending[:0], pending[kept:]...)
+		for i := len(remaining); i < len(pending); i++ {
+			pending[i] = nil
+		}
+		oq.pendingEDUs[class] = remaining
+	}
+	if len(superseded) > 0 {
+		destinationQueueCoalescedEDUs.Add(float64(len(superseded)))
+	}
+	return superseded
+}
+
+// cleanSupersededEDUs removes the superseded EDUs for this destination from
+// the database, so that they aren't retrieved again.
+func (oq *destinationQueue) cleanSupersededEDUs(superseded []*receipt.Receipt) {
+	if len(superseded) == 0 {
+		return
+	}
+	if err := oq.db.CleanEDUs(oq.process.Context(), oq.destination, superseded); err != nil {
+		logrus.WithError(err).Errorf("Failed to clean superseded EDUs for server %q", oq.destination)
+	}
+}
+
+// nextBatch returns the PDUs and EDUs for the next transaction: the oldest
+// PDUs, and the EDUs in order of their class. The EDUs are marked as being
+// sent until finishSending or handleTransactionSuccess is called.
+func (oq *destinationQueue) nextBatch() ([]*queuedPDU, []*queuedEDU) {
+	oq.pendingMutex.Lock()
+	defer oq.pendingMutex.Unlock()
+	pduCount := min(len(oq.pendingPDUs), oq.limits.MaxPDUsPerTransaction)
+	pdus := append([]*queuedPDU(nil), oq.pendingPDUs[:pduCount]...)
+	edus := make([]*queuedEDU, 0, min(oq.pendingEDUCount(), oq.limits.MaxEDUsPerTransaction))
+	for _, pending := range oq.pendingEDUs {
+		for _, edu := range pending {
+			if len(edus) == oq.limits.MaxEDUsPerTransaction {
+				return pdus, edus
+			}
+			edu.sending = true
+			edus = append(edus, edu)
+		}
+	}
+	return pdus, edus
+}
+
+// finishSending marks the EDUs as no longer being sent, after the transaction
+// failed.
+func (oq *destinationQueue) finishSending(edus []*queuedEDU) {
+	oq.pendingMutex.Lock()
+	defer oq.pendingMutex.Unlock()
+	for _, edu := range edus {
+		edu.sending = false
+	}
+}
@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ike20013/dendrite/federationapi/storage/shared/receipt"
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+func typingEDU(roomID, userID string) *gomatrixserverlib.EDU {
+	return &gomatrixserverlib.EDU{
+		Type:    spec.MTyping,
+		Content: []byte(fmt.Sprintf(`{"room_id":%q,"user_id":%q,"typing":true}`, roomID, userID)),
+	}
+}
+
+func presenceEDU(userIDs ...string) *gomatrixserverlib.EDU {
+	content := `{"push":[`
+	for i, userID := range userIDs {
+		if i > 0 {
+			content += ","
+		}
+		content += fmt.Sprintf(`{"user_id":%q,"presence":"online"}`, userID)
+	}
+	return &gomatrixserverlib.EDU{Type: spec.MPresence, Content: []byte(content + `]}`)}
+}
+
+// queueEDUs adds the EDUs to the queue as sendEDU would, numbering them in order.
+func queueEDUs(oq *destinationQueue, edus ...*gomatrixserverlib.EDU) []*receipt.Receipt {
+	var superseded []*receipt.Receipt
+	for _, edu := range edus {
+		nid := receipt.NewReceipt(int64(oq.pendingEDUCount() + len(superseded) + 1))
+		if oq.makeRoomForEDU(classifyEDU(edu.Type)) {
+			oq.addEDU(newQueuedEDU(edu, &nid, time.Now()))
+			superseded = append(superseded, oq.coalesceEDUs()...)
+		}
+	}
+	return superseded
+}
+
+func TestClassifyEDU(t *testing.T) {
+	assert.Equal(t, eduClassToDevice, classifyEDU(spec.MDirectToDevice))
+	assert.Equal(t, eduClassToDevice, classifyEDU(spec.MDeviceListUpdate))
+	assert.Equal(t, eduClassReceipt, classifyEDU(spec.MReceipt))
+	assert.Equal(t, eduClassReceipt, classifyEDU("org.example.unknown"))
+	assert.Equal(t, eduClassEphemeral, classifyEDU(spec.MTyping))
+	assert.Equal(t, eduClassEphemeral, classifyEDU(spec.MPresence))
+}
+
+func TestCoalesceTypingEDUs(t *testing.T) {
+	oq := &destinationQueue{limits: withDefaults(config.DestinationQueue{})}
+	superseded := queueEDUs(oq,
+		typingEDU("!a:test", "@alice:test"),
+		typingEDU("!a:test", "@bob:test"),
+		typingEDU("!b:test", "@alice:test"),
+		typingEDU("!a:test", "@alice:test"),
+		&gomatrixserverlib.EDU{Type: spec.MTyping},
+	)
+
+	// Only the first typing EDU for alice in !a is superseded. The one without
+	// content can't be coalesced, so it's kept.
+	assert.Len(t, superseded, 1)
+	assert.Equal(t, int64(1), superseded[0].GetNID())
+	pending := oq.pendingEDUs[eduClassEphemeral]
+	assert.Len(t, pending, 4)
+	for i := 1; i < len(pending); i++ {
+		assert.Less(t, pending[i-1].dbReceipt.GetNID(), pending[i].dbReceipt.GetNID(), "EDUs are out of order")
+	}
+}
+
+func TestCoalescePresenceEDUs(t *testing.T) {
+	oq := &destinationQueue{limits: withDefaults(config.DestinationQueue{})}
+	superseded := queueEDUs(oq,
+		presenceEDU("@alice:test", "@bob:test"),
+		presenceEDU("@alice:test"),
+		presenceEDU("@bob:test"),
+	)
+
+	// The first EDU is only superseded once both users have newer presence.
+	assert.Len(t, superseded, 1)
+	assert.Len(t, oq.pendingEDUs[eduClassEphemeral], 2)
+}
+
+func TestCoalesceSkipsEDUsBeingSent(t *testing.T) {
+	oq := &destinationQueue{limits: withDefaults(config.DestinationQueue{})}
+	queueEDUs(oq, typingEDU("!a:test", "@alice:test"))
+	_, sending := oq.nextBatch()
+	assert.Len(t, sending, 1)
+
+	superseded := queueEDUs(oq, typingEDU("!a:test", "@alice:test"))
+	assert.Empty(t, superseded)
+	assert.Len(t, oq.pendingEDUs[eduClassEphemeral], 2)
+}
+
+func TestEDUPriority(t *testing.T) {
+	oq := &destinationQueue{limits: withDefaults(config.DestinationQueue{
+		MaxEDUsPerTransaction: 2,
+		MaxEDUsInMemory:       3,
+	})}
+	queueEDUs(oq,
+		typingEDU("!a:test", "@alice:test"),
+		typingEDU("!a:test", "@bob:test"),
+		&gomatrixserverlib.EDU{Type: spec.MReceipt},
+		&gomatrixserverlib.EDU{Type: spec.MDirectToDevice},
+	)
+
+	// Memory is full, so the newest typing EDU made way for the to-device
+	// message, and the queue will consult the database for it later.
+	assert.True(t, oq.overflowed.Load())
+	assert.Len(t, oq.pendingEDUs[eduClassEphemeral], 1)
+
+	_, edus := oq.nextBatch()
+	assert.Len(t, edus, 2)
+	assert.Equal(t, spec.MDirectToDevice, edus[0].edu.Type)
+	assert.Equal(t, spec.MReceipt, edus[1].edu.Type)
+
+	// Nothing of a more important class can be evicted for a typing EDU.
+	assert.False(t, oq.makeRoomForEDU(eduClassEphemeral))
+}
+
+func TestDestinationQueueLimitsDefaults(t *testing.T) {
+	limits := withDefaults(config.DestinationQueue{MaxPDUsPerTransaction: 500, MaxEDUsInMemory: 10})
+	assert.Equal(t, maxPDUsPerTransaction, limits.MaxPDUsPerTransaction)
+	assert.Equal(t, maxEDUsPerTransaction, limits.MaxEDUsPerTransaction)
+	assert.Equal(t, defaultPDUsInMemory, limits.MaxPDUsInMemory)
+	assert.Equal(t, maxEDUsPerTransaction, limits.MaxEDUsInMemory)
+}
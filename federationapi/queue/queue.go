@@ -7,6 +7,7 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -20,10 +21,13 @@ import (
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ike20013/dendrite/federationapi/serverfilter"
+	"github.com/ike20013/dendrite/federationapi/sharding"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	"github.com/ike20013/dendrite/federationapi/storage"
 	"github.com/ike20013/dendrite/federationapi/storage/shared/receipt"
 	"github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/process"
 )
 
@@ -36,6 +40,10 @@ type OutgoingQueues struct {
 	origin      spec.ServerName
 	client      fclient.FederationClient
 	statistics  *statistics.Statistics
+	filter      *serverfilter.Filter
+	shard       sharding.Shard
+	producer    *sharding.Producer
+	limits      config.DestinationQueue
 	signing     map[spec.ServerName]*fclient.SigningIdentity
 	queuesMutex sync.Mutex // protects the below
 	queues      map[spec.ServerName]*destinationQueue
@@ -44,7 +52,8 @@ type OutgoingQueues struct {
 func init() {
 	prometheus.MustRegister(
 		destinationQueueTotal, destinationQueueRunning,
-		destinationQueueBackingOff,
+		destinationQueueBackingOff, destinationQueueDepth,
+		destinationQueueTimeInQueue, destinationQueueCoalescedEDUs,
 	)
 }
 
@@ -72,7 +81,51 @@ var destinationQueueBackingOff = prometheus.NewGauge(
 	},
 )
 
-// NewOutgoingQueues makes a new OutgoingQueues
+var destinationQueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "destination_queue_depth",
+		Help:      "How many PDUs and EDUs of each class are held in memory for a given destination",
+	},
+	[]string{"destination", "class"},
+)
+
+var destinationQueueTimeInQueue = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "destination_queue_time_in_queue_seconds",
+		Help:      "How long PDUs and EDUs of each class waited in memory before being sent to a given destination",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 60, 300, 1800, 3600, 21600},
+	},
+	[]string{"destination", "class"},
+)
+
+var destinationQueueCoalescedEDUs = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "destination_queue_coalesced_edus_total",
+		Help:      "How many EDUs were dropped because newer EDUs superseded them",
+	},
+)
+
+func observeTimeInQueue(destination spec.ServerName, class string, waited time.Duration) {
+	destinationQueueTimeInQueue.WithLabelValues(string(destination), class).Observe(waited.Seconds())
+}
+
+// updateDepthMetrics reports how much is held in memory for the destination.
+// The lock must be held.
+func (oq *destinationQueue) updateDepthMetrics() {
+	destinationQueueDepth.WithLabelValues(string(oq.destination), "pdu").Set(float64(len(oq.pendingPDUs)))
+	for class, edus := range oq.pendingEDUs {
+		destinationQueueDepth.WithLabelValues(string(oq.destination), eduClass(class).String()).Set(float64(len(edus)))
+	}
+}
+
+// NewOutgoingQueues makes a new OutgoingQueues. If sharding is enabled, the
+// producer is used to hand destinations over to the other federation senders.
 func NewOutgoingQueues(
 	db storage.Database,
 	process *process.ProcessContext,
@@ -81,7 +134,14 @@ func NewOutgoingQueues(
 	client fclient.FederationClient,
 	statistics *statistics.Statistics,
 	signing []*fclient.SigningIdentity,
-) *OutgoingQueues {
+	filter *serverfilter.Filter,
+	shard sharding.Shard,
+	producer *sharding.Producer,
+	limits config.DestinationQueue,
+) (*OutgoingQueues, error) {
+	if shard.Enabled() && producer == nil {
+		return nil, fmt.Errorf("federation sender shard %s needs a producer to hand destinations over", shard)
+	}
 	queues := &OutgoingQueues{
 		disabled:   disabled,
 		process:    process,
@@ -89,6 +149,10 @@ func NewOutgoingQueues(
 		origin:     origin,
 		client:     client,
 		statistics: statistics,
+		filter:     filter,
+		shard:      shard,
+		producer:   producer,
+		limits:     withDefaults(limits),
 		signing:    map[spec.ServerName]*fclient.SigningIdentity{},
 		queues:     map[spec.ServerName]*destinationQueue{},
 	}
@@ -123,20 +187,28 @@ func NewOutgoingQueues(
 			}
 		}
 	}
-	return queues
+	return queues, nil
 }
 
 type queuedPDU struct {
 	dbReceipt *receipt.Receipt
 	pdu       *types.HeaderedEvent
+	queued    time.Time // when it was queued, or retrieved from the database
 }
 
 type queuedEDU struct {
 	dbReceipt *receipt.Receipt
 	edu       *gomatrixserverlib.EDU
+	queued    time.Time // when it was queued, or retrieved from the database
+	class     eduClass
+	keys      []string // what it updates, if newer EDUs can supersede it
+	sending   bool     // true if it's part of the transaction being sent
 }
 
 func (oqs *OutgoingQueues) getQueue(destination spec.ServerName) *destinationQueue {
+	if !oqs.shard.Owns(destination) || !oqs.filter.IsAllowed(destination) {
+		return nil
+	}
 	if oqs.statistics.ForServer(destination).Blacklisted() {
 		return nil
 	}
@@ -155,6 +227,7 @@ func (oqs *OutgoingQueues) getQueue(destination spec.ServerName) *destinationQue
 			statistics:  oqs.statistics.ForServer(destination),
 			notify:      make(chan struct{}, 1),
 			signing:     oqs.signing,
+			limits:      oqs.limits,
 		}
 		oq.statistics.AssignBackoffNotifier(oq.handleBackoffNotifier)
 		oqs.queues[destination] = oq
@@ -170,12 +243,31 @@ func (oqs *OutgoingQueues) clearQueue(oq *destinationQueue) {
 
 	delete(oqs.queues, oq.destination)
 	destinationQueueTotal.Dec()
+	destinationQueueDepth.DeletePartialMatch(prometheus.Labels{"destination": string(oq.destination)})
+	destinationQueueTimeInQueue.DeletePartialMatch(prometheus.Labels{"destination": string(oq.destination)})
 }
 
-// SendEvent sends an event to the destinations
+// SendEvent sends an event to the destinations. Destinations owned by other
+// federation senders are handed over to them.
 func (oqs *OutgoingQueues) SendEvent(
 	ev *types.HeaderedEvent, origin spec.ServerName,
 	destinations []spec.ServerName,
+) error {
+	return oqs.sendEvent(ev, origin, destinations, true)
+}
+
+// SendShardEvent sends an event handed over by another federation sender to the
+// destinations owned by this one.
+func (oqs *OutgoingQueues) SendShardEvent(
+	ev *types.HeaderedEvent, origin spec.ServerName,
+	destinations []spec.ServerName,
+) error {
+	return oqs.sendEvent(ev, origin, destinations, false)
+}
+
+func (oqs *OutgoingQueues) sendEvent(
+	ev *types.HeaderedEvent, origin spec.ServerName,
+	destinations []spec.ServerName, handOver bool,
 ) error {
 	if oqs.disabled {
 		log.Trace("Federation is disabled, not sending event")
@@ -198,6 +290,9 @@ func (oqs *OutgoingQueues) SendEvent(
 	for local := range oqs.signing {
 		delete(destmap, local)
 	}
+	if err := oqs.handOver(&sharding.Message{Origin: origin, PDU: ev}, destmap, handOver); err != nil {
+		return fmt.Errorf("sendevent: %w", err)
+	}
 
 	// If there are no remaining destinations then give up.
 	if len(destmap) == 0 {
@@ -250,10 +345,57 @@ func (oqs *OutgoingQueues) SendEvent(
 	return nil
 }
 
-// SendEDU sends an EDU event to the destinations.
+// handOver removes the destinations owned by other federation senders from
+// destmap. If send is true, the message is published for those senders, else
+// the destinations are dropped as they were handed over to us by mistake.
+func (oqs *OutgoingQueues) handOver(msg *sharding.Message, destmap map[spec.ServerName]struct{}, send bool) error {
+	if !oqs.shard.Enabled() {
+		return nil
+	}
+	destinations := make([]spec.ServerName, 0, len(destmap))
+	for destination := range destmap {
+		destinations = append(destinations, destination)
+	}
+	_, others := oqs.shard.Split(destinations)
+	for index, serverNames := range others {
+		for _, serverName := range serverNames {
+			delete(destmap, serverName)
+		}
+		if !send {
+			log.WithFields(log.Fields{
+				"shard": oqs.shard.String(), "owner": index, "destinations": serverNames,
+			}).Warn("Dropping destinations owned by another federation sender")
+			continue
+		}
+		msg.Destinations = serverNames
+		if err := oqs.producer.Send(oqs.process.Context(), index, msg); err != nil {
+			return fmt.Errorf("failed to hand over to federation sender %d: %w", index, err)
+		}
+	}
+	return nil
+}
+
+// SendEDU sends an EDU event to the destinations. Destinations owned by other
+// federation senders are handed over to them.
 func (oqs *OutgoingQueues) SendEDU(
 	e *gomatrixserverlib.EDU, origin spec.ServerName,
 	destinations []spec.ServerName,
+) error {
+	return oqs.sendEDU(e, origin, destinations, true)
+}
+
+// SendShardEDU sends an EDU handed over by another federation sender to the
+// destinations owned by this one.
+func (oqs *OutgoingQueues) SendShardEDU(
+	e *gomatrixserverlib.EDU, origin spec.ServerName,
+	destinations []spec.ServerName,
+) error {
+	return oqs.sendEDU(e, origin, destinations, false)
+}
+
+func (oqs *OutgoingQueues) sendEDU(
+	e *gomatrixserverlib.EDU, origin spec.ServerName,
+	destinations []spec.ServerName, handOver bool,
 ) error {
 	if oqs.disabled {
 		log.Trace("Federation is disabled, not sending EDU")
@@ -276,6 +418,9 @@ func (oqs *OutgoingQueues) SendEDU(
 	for local := range oqs.signing {
 		delete(destmap, local)
 	}
+	if err := oqs.handOver(&sharding.Message{Origin: origin, EDU: e}, destmap, handOver); err != nil {
+		return fmt.Errorf("sendedu: %w", err)
+	}
 
 	// If there are no remaining destinations then give up.
 	if len(destmap) == 0 {
@@ -332,6 +477,99 @@ func (oqs *OutgoingQueues) SendEDU(
 	return nil
 }
 
+// RetryingTransaction returns true if the last transaction to the given server
+// failed and will be retried.
+func (oqs *OutgoingQueues) RetryingTransaction(srv spec.ServerName) bool {
+	oqs.queuesMutex.Lock()
+	oq, ok := oqs.queues[srv]
+	oqs.queuesMutex.Unlock()
+	if !ok || oq == nil {
+		return false
+	}
+	oq.transactionIDMutex.Lock()
+	defer oq.transactionIDMutex.Unlock()
+	return oq.transactionID != ""
+}
+
+// PurgeQueue drops everything waiting to be sent to the given server, both
+// from memory and from the database.
+func (oqs *OutgoingQueues) PurgeQueue(ctx context.Context, srv spec.ServerName) error {
+	oqs.queuesMutex.Lock()
+	oq, ok := oqs.queues[srv]
+	oqs.queuesMutex.Unlock()
+	if ok && oq != nil {
+		oq.purge()
+	}
+	return oqs.db.PurgeDestinationQueue(ctx, srv)
+}
+
+// RetryAllowedServers wakes the existing queues of the servers which are
+// allowed, in case they stopped while the server was denied.
+func (oqs *OutgoingQueues) RetryAllowedServers() {
+	if oqs.disabled {
+		return
+	}
+	oqs.queuesMutex.Lock()
+	queues := make([]*destinationQueue, 0, len(oqs.queues))
+	for destination, oq := range oqs.queues {
+		if oq != nil && oqs.filter.IsAllowed(destination) {
+			queues = append(queues, oq)
+		}
+	}
+	oqs.queuesMutex.Unlock()
+	for _, oq := range queues {
+		oq.wakeQueueIfEventsPending(false)
+	}
+}
+
+// Control applies a change made through the federation API. If sharding is enabled,
+// the change is also handed over to the federation senders of the other shards.
+func (oqs *OutgoingQueues) Control(ctx context.Context, c *sharding.Control) error {
+	if err := oqs.ApplyShardControl(ctx, c); err != nil {
+		return err
+	}
+	if !oqs.shard.Enabled() {
+		return nil
+	}
+	server := c.Server()
+	msg := &sharding.Message{Origin: oqs.origin, Control: c}
+	for index := 0; index < oqs.shard.Total; index++ {
+		if index == oqs.shard.Index || (server != "" && sharding.For(server, oqs.shard.Total) != index) {
+			continue
+		}
+		if err := oqs.producer.Send(ctx, index, msg); err != nil {
+			return fmt.Errorf("failed to hand over to federation sender %d: %w", index, err)
+		}
+	}
+	return nil
+}
+
+// ApplyShardControl applies a change made through the federation API to this
+// federation sender only.
+func (oqs *OutgoingQueues) ApplyShardControl(ctx context.Context, c *sharding.Control) error {
+	switch {
+	case c.DomainLists != nil:
+		if oqs.filter == nil {
+			return fmt.Errorf("federation domain lists are not supported")
+		}
+		if err := oqs.filter.Update(c.DomainLists.Allowed, c.DomainLists.Denied); err != nil {
+			return err
+		}
+		// Resume sending to servers which may have been allowed again.
+		oqs.RetryAllowedServers()
+	case c.ResetServer != "":
+		stats := oqs.statistics.ForServer(c.ResetServer)
+		stats.ResetBackoff()
+		stats.MarkServerAlive()
+		// Wake the queue even if nothing is pending in memory, since there may
+		// be PDUs and EDUs waiting in the database.
+		oqs.RetryServer(c.ResetServer, true)
+	case c.PurgeServer != "":
+		return oqs.PurgeQueue(ctx, c.PurgeServer)
+	}
+	return nil
+}
+
 // RetryServer attempts to resend events to the given server if we had given up.
 func (oqs *OutgoingQueues) RetryServer(srv spec.ServerName, wasBlacklisted bool) {
 	if oqs.disabled {
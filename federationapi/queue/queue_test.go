@@ -24,6 +24,8 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/ike20013/dendrite/federationapi/serverfilter"
+	"github.com/ike20013/dendrite/federationapi/sharding"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	"github.com/ike20013/dendrite/federationapi/storage"
 	"github.com/ike20013/dendrite/roomserver/types"
@@ -117,7 +119,10 @@ func testSetup(failuresUntilBlacklist uint32, failuresUntilAssumedOffline uint32
 			ServerName: "localhost",
 		},
 	}
-	queues := NewOutgoingQueues(db, processContext, false, "localhost", fc, &stats, signingInfo)
+	queues, err := NewOutgoingQueues(db, processContext, false, "localhost", fc, &stats, signingInfo, nil, sharding.Shard{}, nil, config.DestinationQueue{})
+	if err != nil {
+		t.Fatalf("failed to create queues: %s", err)
+	}
 
 	return db, fc, queues, processContext, close
 }
@@ -210,6 +215,42 @@ func TestSendPDUOnFailStoredInDB(t *testing.T) {
 	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
 }
 
+func TestSendPDUToDeniedServerDropped(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	allowed := spec.ServerName("remotehost")
+	denied := spec.ServerName("denied.remotehost")
+	db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, failuresUntilBlacklist+1, true, false, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+	filter, err := serverfilter.New(nil, []string{"denied.*"})
+	assert.NoError(t, err)
+	queues.filter = filter
+
+	ev := mustCreatePDU(t)
+	err = queues.SendEvent(ev, "localhost", []spec.ServerName{allowed, denied})
+	assert.NoError(t, err)
+
+	check := func(log poll.LogT) poll.Result {
+		if fc.txCount.Load() == 1 {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for the event to be sent. Currently %d", fc.txCount.Load())
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+
+	data, dbErr := db.GetPendingPDUs(pc.Context(), denied, 100)
+	assert.NoError(t, dbErr)
+	assert.Empty(t, data)
+	queues.queuesMutex.Lock()
+	_, ok := queues.queues[denied]
+	queues.queuesMutex.Unlock()
+	assert.False(t, ok)
+}
+
 func TestSendEDUOnFailStoredInDB(t *testing.T) {
 	t.Parallel()
 	failuresUntilBlacklist := uint32(16)
@@ -664,6 +705,46 @@ func TestSendEDUBatches(t *testing.T) {
 	// })
 }
 
+func TestSendEDUBatchesWithConfiguredLimits(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("remotehost")
+
+	db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, failuresUntilBlacklist+1, true, false, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+	queues.limits = withDefaults(config.DestinationQueue{MaxEDUsPerTransaction: 10, MaxEDUsInMemory: 20})
+
+	destinations := map[spec.ServerName]struct{}{destination: {}}
+	for i := 0; i < 30; i++ {
+		ev := mustCreateEDU(t)
+		ephemeralJSON, _ := json.Marshal(ev)
+		nid, _ := db.StoreJSON(pc.Context(), string(ephemeralJSON))
+		err := db.AssociateEDUWithDestinations(pc.Context(), destinations, nid, ev.Type, nil)
+		assert.NoError(t, err, "failed to associate EDU with destinations")
+	}
+
+	ev := mustCreateEDU(t)
+	err := queues.SendEDU(ev, "localhost", []spec.ServerName{destination})
+	assert.NoError(t, err)
+
+	check := func(log poll.LogT) poll.Result {
+		if fc.txCount.Load() == 4 { // 31 EDUs, 10 at a time
+			data, dbErr := db.GetPendingEDUs(pc.Context(), destination, 200)
+			assert.NoError(t, dbErr)
+			if len(data) == 0 {
+				return poll.Success()
+			}
+			return poll.Continue("waiting for all events to be removed from database. Currently present EDU: %d", len(data))
+		}
+		return poll.Continue("waiting for the right amount of send attempts before checking database. Currently %d", fc.txCount.Load())
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+}
+
 func TestSendPDUAndEDUBatches(t *testing.T) {
 	t.Parallel()
 	failuresUntilBlacklist := uint32(16)
@@ -964,3 +1045,8 @@ func TestSendEDUOnRelaySuccessRemovedFromDB(t *testing.T) {
 	assumedOffline, _ := db.IsServerAssumedOffline(context.Background(), destination)
 	assert.Equal(t, true, assumedOffline)
 }
+
+func TestShardingRequiresProducer(t *testing.T) {
+	_, err := NewOutgoingQueues(nil, process.NewProcessContext(), false, "localhost", nil, nil, nil, nil, sharding.Shard{Index: 0, Total: 2}, nil, config.DestinationQueue{})
+	assert.Error(t, err)
+}
@@ -10,9 +10,11 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/roomserver/types"
 	"github.com/ike20013/dendrite/setup/config"
@@ -31,6 +33,7 @@ func InviteV3(
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	inviteReq := fclient.InviteV3Request{}
 	err := json.Unmarshal(request.Content(), &inviteReq)
@@ -79,7 +82,7 @@ func InviteV3(
 			return spec.SenderIDFromPseudoIDKey(key), key, nil
 		},
 	}
-	event, jsonErr := handleInviteV3(httpReq.Context(), input, rsAPI)
+	event, jsonErr := handleInviteV3(httpReq.Context(), input, rsAPI, spamChecker)
 	if jsonErr != nil {
 		return *jsonErr
 	}
@@ -98,6 +101,7 @@ func InviteV2(
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	inviteReq := fclient.InviteV2Request{}
 	err := json.Unmarshal(request.Content(), &inviteReq)
@@ -159,7 +163,7 @@ func InviteV2(
 				return rsAPI.QueryUserIDForSender(httpReq.Context(), roomID, senderID)
 			},
 		}
-		event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI)
+		event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI, spamChecker)
 		if jsonErr != nil {
 			return *jsonErr
 		}
@@ -184,6 +188,7 @@ func InviteV1(
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	spamChecker spamcheck.Checker,
 ) util.JSONResponse {
 	roomVer := gomatrixserverlib.RoomVersionV1
 	body := request.Content()
@@ -252,7 +257,7 @@ func InviteV1(
 			return rsAPI.QueryUserIDForSender(httpReq.Context(), roomID, senderID)
 		},
 	}
-	event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI)
+	event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI, spamChecker)
 	if jsonErr != nil {
 		return *jsonErr
 	}
@@ -262,17 +267,17 @@ func InviteV1(
 	}
 }
 
-func handleInvite(ctx context.Context, input gomatrixserverlib.HandleInviteInput, rsAPI api.FederationRoomserverAPI) (gomatrixserverlib.PDU, *util.JSONResponse) {
+func handleInvite(ctx context.Context, input gomatrixserverlib.HandleInviteInput, rsAPI api.FederationRoomserverAPI, spamChecker spamcheck.Checker) (gomatrixserverlib.PDU, *util.JSONResponse) {
 	inviteEvent, err := gomatrixserverlib.HandleInvite(ctx, input)
-	return handleInviteResult(ctx, inviteEvent, err, rsAPI)
+	return handleInviteResult(ctx, inviteEvent, err, rsAPI, spamChecker)
 }
 
-func handleInviteV3(ctx context.Context, input gomatrixserverlib.HandleInviteV3Input, rsAPI api.FederationRoomserverAPI) (gomatrixserverlib.PDU, *util.JSONResponse) {
+func handleInviteV3(ctx context.Context, input gomatrixserverlib.HandleInviteV3Input, rsAPI api.FederationRoomserverAPI, spamChecker spamcheck.Checker) (gomatrixserverlib.PDU, *util.JSONResponse) {
 	inviteEvent, err := gomatrixserverlib.HandleInviteV3(ctx, input)
-	return handleInviteResult(ctx, inviteEvent, err, rsAPI)
+	return handleInviteResult(ctx, inviteEvent, err, rsAPI, spamChecker)
 }
 
-func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU, err error, rsAPI api.FederationRoomserverAPI) (gomatrixserverlib.PDU, *util.JSONResponse) {
+func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU, err error, rsAPI api.FederationRoomserverAPI, spamChecker spamcheck.Checker) (gomatrixserverlib.PDU, *util.JSONResponse) {
 	switch e := err.(type) {
 	case nil:
 	case spec.InternalServerError:
@@ -305,8 +310,22 @@ func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU,
 		}
 	}
 
+	if denied := checkInviteForSpam(ctx, inviteEvent, rsAPI, spamChecker); denied != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: *denied,
+		}
+	}
+
 	headeredInvite := &types.HeaderedEvent{PDU: inviteEvent}
 	if err = rsAPI.HandleInvite(ctx, headeredInvite); err != nil {
+		var notAllowed api.ErrNotAllowed
+		if errors.As(err, &notAllowed) {
+			return nil, &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden(notAllowed.Error()),
+			}
+		}
 		util.GetLogger(ctx).WithError(err).Error("HandleInvite failed")
 		return nil, &util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -316,3 +335,22 @@ func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU,
 	return inviteEvent, nil
 
 }
+
+// checkInviteForSpam asks the spam checker whether the invite may be passed on
+// to the invited local user.
+func checkInviteForSpam(ctx context.Context, inviteEvent gomatrixserverlib.PDU, rsAPI api.FederationRoomserverAPI, spamChecker spamcheck.Checker) *spec.MatrixError {
+	if spamChecker == nil || inviteEvent.StateKey() == nil {
+		return nil
+	}
+	inviter, err := rsAPI.QueryUserIDForSender(ctx, inviteEvent.RoomID(), inviteEvent.SenderID())
+	if err != nil || inviter == nil {
+		util.GetLogger(ctx).WithError(err).Warn("unable to find the user ID of the inviter")
+		return nil
+	}
+	invitee, err := rsAPI.QueryUserIDForSender(ctx, inviteEvent.RoomID(), spec.SenderID(*inviteEvent.StateKey()))
+	if err != nil || invitee == nil {
+		util.GetLogger(ctx).WithError(err).Warn("unable to find the user ID of the invitee")
+		return nil
+	}
+	return spamChecker.UserMayInvite(ctx, *inviter, *invitee, inviteEvent.RoomID())
+}
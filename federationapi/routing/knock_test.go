@@ -0,0 +1,175 @@
+package routing_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/federationapi/routing"
+	"github.com/ike20013/dendrite/roomserver"
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/test"
+	"github.com/ike20013/dendrite/test/testrig"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	knockServer = spec.ServerName("remote")
+	knockKeyID  = gomatrixserverlib.KeyID("ed25519:remote")
+)
+
+// knockVerifier verifies signatures with the key of the knocking server.
+type knockVerifier struct{}
+
+func (v *knockVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		results[i].Error = gomatrixserverlib.VerifyJSON(
+			string(req.ServerName), knockKeyID, test.PrivateKeyA.Public().(ed25519.PublicKey), req.Message,
+		)
+	}
+	return results, nil
+}
+
+// buildKnock builds a knock on the room without checking that the room allows it.
+func buildKnock(t *testing.T, room *test.Room, userID string, key ed25519.PrivateKey) gomatrixserverlib.PDU {
+	t.Helper()
+	proto := gomatrixserverlib.ProtoEvent{
+		SenderID:   userID,
+		RoomID:     room.ID,
+		Type:       spec.MRoomMember,
+		StateKey:   &userID,
+		Depth:      int64(len(room.Events()) + 1),
+		PrevEvents: room.ForwardExtremities(),
+	}
+	if err := proto.SetContent(gomatrixserverlib.MemberContent{Membership: spec.Knock}); err != nil {
+		t.Fatal(err)
+	}
+	needed, err := gomatrixserverlib.StateNeededForProtoEvent(&proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto.AuthEvents = room.MustGetAuthEventRefsForEvent(t, needed)
+	ev, err := gomatrixserverlib.MustGetRoomVersion(room.Version).NewEventBuilderFromProtoEvent(&proto).Build(
+		time.Now(), knockServer, knockKeyID, key,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestKnock(t *testing.T) {
+	alice := test.NewUser(t)
+	charlie := test.NewUser(t, test.WithSigningServer(knockServer, knockKeyID, test.PrivateKeyA))
+	charlieID, err := spec.NewUserID(charlie.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knockRoom := test.NewRoom(t, alice)
+	knockRoom.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": spec.Knock,
+	}, test.WithStateKey(""))
+	publicRoom := test.NewRoom(t, alice)
+	knockRoomID, err := spec.NewRoomID(knockRoom.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicRoomID, err := spec.NewRoomID(publicRoom.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownRoomID, err := spec.NewRoomID("!unknown:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		for _, room := range []*test.Room{knockRoom, publicRoom} {
+			if err = api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		makeKnock := func(origin spec.ServerName, roomID spec.RoomID, versions ...gomatrixserverlib.RoomVersion) int {
+			fedReq := fclient.NewFederationRequest(http.MethodGet, origin, "test", "/make_knock/"+roomID.String()+"/"+charlie.ID)
+			httpReq := httptest.NewRequest(http.MethodGet, "/make_knock", nil)
+			return routing.MakeKnock(httpReq, &fedReq, &cfg.FederationAPI, rsAPI, roomID, *charlieID, versions).Code
+		}
+		sendKnock := func(origin spec.ServerName, roomID spec.RoomID, ev gomatrixserverlib.PDU) int {
+			fedReq := fclient.NewFederationRequest(http.MethodPut, origin, "test", "/send_knock/"+roomID.String()+"/"+ev.EventID())
+			if err := fedReq.SetContent(json.RawMessage(ev.JSON())); err != nil {
+				t.Fatal(err)
+			}
+			httpReq := httptest.NewRequest(http.MethodPut, "/send_knock", nil)
+			return routing.SendKnock(httpReq, &fedReq, &cfg.FederationAPI, rsAPI, &knockVerifier{}, roomID, ev.EventID()).Code
+		}
+
+		t.Run("make_knock", func(t *testing.T) {
+			testCases := []struct {
+				name     string
+				origin   spec.ServerName
+				roomID   spec.RoomID
+				versions []gomatrixserverlib.RoomVersion
+				want     int
+			}{
+				{name: "unsupported room version", origin: knockServer, roomID: *knockRoomID, versions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV6}, want: http.StatusBadRequest},
+				{name: "origin doesn't match the user", origin: "other", roomID: *knockRoomID, versions: []gomatrixserverlib.RoomVersion{knockRoom.Version}, want: http.StatusForbidden},
+				{name: "join rule isn't knock", origin: knockServer, roomID: *publicRoomID, versions: []gomatrixserverlib.RoomVersion{publicRoom.Version}, want: http.StatusForbidden},
+				{name: "allowed", origin: knockServer, roomID: *knockRoomID, versions: []gomatrixserverlib.RoomVersion{knockRoom.Version}, want: http.StatusOK},
+			}
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					assert.Equal(t, tc.want, makeKnock(tc.origin, tc.roomID, tc.versions...))
+				})
+			}
+		})
+
+		t.Run("send_knock", func(t *testing.T) {
+			testCases := []struct {
+				name   string
+				origin spec.ServerName
+				roomID spec.RoomID
+				event  gomatrixserverlib.PDU
+				want   int
+			}{
+				{name: "unknown room", origin: knockServer, roomID: *unknownRoomID, event: buildKnock(t, knockRoom, charlie.ID, test.PrivateKeyA), want: http.StatusBadRequest},
+				{name: "origin doesn't match the sender", origin: "other", roomID: *knockRoomID, event: buildKnock(t, knockRoom, charlie.ID, test.PrivateKeyA), want: http.StatusForbidden},
+				{name: "bad signature", origin: knockServer, roomID: *knockRoomID, event: buildKnock(t, knockRoom, charlie.ID, test.PrivateKeyB), want: http.StatusForbidden},
+				{name: "join rule isn't knock", origin: knockServer, roomID: *publicRoomID, event: buildKnock(t, publicRoom, charlie.ID, test.PrivateKeyA), want: http.StatusForbidden},
+				{name: "allowed", origin: knockServer, roomID: *knockRoomID, event: buildKnock(t, knockRoom, charlie.ID, test.PrivateKeyA), want: http.StatusOK},
+			}
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					assert.Equal(t, tc.want, sendKnock(tc.origin, tc.roomID, tc.event))
+				})
+			}
+		})
+
+		membership := api.QueryMembershipForUserResponse{}
+		err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+			RoomID: knockRoom.ID,
+			UserID: *charlieID,
+		}, &membership)
+		assert.NoError(t, err)
+		assert.Equal(t, spec.Knock, membership.Membership)
+	})
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/ike20013/dendrite/external"
 	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	fedInternal "github.com/ike20013/dendrite/federationapi/internal"
 	"github.com/ike20013/dendrite/federationapi/producers"
 	"github.com/ike20013/dendrite/roomserver/api"
@@ -55,7 +56,8 @@ func Setup(
 	federation fclient.FederationClient,
 	userAPI userapi.FederationUserAPI,
 	mscCfg *config.MSCs,
-	producer *producers.SyncAPIProducer, enableMetrics bool,
+	producer *producers.SyncAPIProducer,
+	spamChecker spamcheck.Checker, enableMetrics bool,
 ) {
 	fedMux := routers.Federation
 	keyMux := routers.Keys
@@ -128,7 +130,7 @@ func Setup(
 
 	mu := external.NewMutexByRoom()
 	v1fedmux.Handle("/send/{txnID}", MakeFedAPI(
-		"federation_send", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_send", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
@@ -138,7 +140,7 @@ func Setup(
 	)).Methods(http.MethodPut, http.MethodOptions).Name(SendRouteName)
 
 	v1fedmux.Handle("/invite/{roomID}/{eventID}", MakeFedAPI(
-		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -156,13 +158,13 @@ func Setup(
 			}
 			return InviteV1(
 				httpReq, request, *roomID, vars["eventID"],
-				cfg, rsAPI, keys,
+				cfg, rsAPI, keys, spamChecker,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v2fedmux.Handle("/invite/{roomID}/{eventID}", MakeFedAPI(
-		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -180,13 +182,13 @@ func Setup(
 			}
 			return InviteV2(
 				httpReq, request, *roomID, vars["eventID"],
-				cfg, rsAPI, keys,
+				cfg, rsAPI, keys, spamChecker,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v3fedmux.Handle("/invite/{roomID}/{userID}", MakeFedAPI(
-		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -211,7 +213,7 @@ func Setup(
 			}
 			return InviteV3(
 				httpReq, request, *roomID, *userID,
-				cfg, rsAPI, keys,
+				cfg, rsAPI, keys, spamChecker,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -223,7 +225,7 @@ func Setup(
 	)).Methods(http.MethodPost, http.MethodOptions)
 
 	v1fedmux.Handle("/exchange_third_party_invite/{roomID}", MakeFedAPI(
-		"exchange_third_party_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"exchange_third_party_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return ExchangeThirdPartyInvite(
 				httpReq, request, vars["roomID"], rsAPI, cfg, federation,
@@ -232,7 +234,7 @@ func Setup(
 	)).Methods(http.MethodPut, http.MethodOptions)
 
 	v1fedmux.Handle("/event/{eventID}", MakeFedAPI(
-		"federation_get_event", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_get_event", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetEvent(
 				httpReq.Context(), request, rsAPI, vars["eventID"], cfg.Matrix.ServerName,
@@ -241,7 +243,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/state/{roomID}", MakeFedAPI(
-		"federation_get_state", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_get_state", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -256,7 +258,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/state_ids/{roomID}", MakeFedAPI(
-		"federation_get_state_ids", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_get_state_ids", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -270,8 +272,21 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
+	v1fedmux.Handle("/timestamp_to_event/{roomID}", MakeFedAPI(
+		"federation_timestamp_to_event", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
+		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			return TimestampToEvent(httpReq, request, rsAPI, vars["roomID"])
+		},
+	)).Methods(http.MethodGet)
+
 	v1fedmux.Handle("/event_auth/{roomID}/{eventID}", MakeFedAPI(
-		"federation_get_event_auth", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_get_event_auth", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -286,7 +301,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/query/directory", MakeFedAPI(
-		"federation_query_room_alias", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_query_room_alias", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return RoomAliasToID(
 				httpReq, federation, cfg, rsAPI, fsAPI,
@@ -295,7 +310,7 @@ func Setup(
 	)).Methods(http.MethodGet).Name(QueryDirectoryRouteName)
 
 	v1fedmux.Handle("/query/profile", MakeFedAPI(
-		"federation_query_profile", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_query_profile", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetProfile(
 				httpReq, userAPI, cfg,
@@ -304,7 +319,7 @@ func Setup(
 	)).Methods(http.MethodGet).Name(QueryProfileRouteName)
 
 	v1fedmux.Handle("/user/devices/{userID}", MakeFedAPI(
-		"federation_user_devices", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_user_devices", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetUserDevices(
 				httpReq, userAPI, vars["userID"],
@@ -314,7 +329,7 @@ func Setup(
 
 	if mscCfg.Enabled("msc2444") {
 		v1fedmux.Handle("/peek/{roomID}/{peekID}", MakeFedAPI(
-			"federation_peek", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+			"federation_peek", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 			func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 				if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 					return util.JSONResponse{
@@ -345,7 +360,7 @@ func Setup(
 	}
 
 	v1fedmux.Handle("/make_join/{roomID}/{userID}", MakeFedAPI(
-		"federation_make_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_make_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -391,7 +406,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/send_join/{roomID}/{eventID}", MakeFedAPI(
-		"federation_send_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_send_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -430,7 +445,7 @@ func Setup(
 	)).Methods(http.MethodPut)
 
 	v2fedmux.Handle("/send_join/{roomID}/{eventID}", MakeFedAPI(
-		"federation_send_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_send_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -454,7 +469,7 @@ func Setup(
 	)).Methods(http.MethodPut)
 
 	v1fedmux.Handle("/make_leave/{roomID}/{userID}", MakeFedAPI(
-		"federation_make_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_make_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -483,7 +498,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/send_leave/{roomID}/{eventID}", MakeFedAPI(
-		"federation_send_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_send_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -515,7 +530,7 @@ func Setup(
 	)).Methods(http.MethodPut)
 
 	v2fedmux.Handle("/send_leave/{roomID}/{eventID}", MakeFedAPI(
-		"federation_send_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_send_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -531,6 +546,70 @@ func Setup(
 		},
 	)).Methods(http.MethodPut)
 
+	v1fedmux.Handle("/make_knock/{roomID}/{userID}", MakeFedAPI(
+		"federation_make_knock", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
+		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			// Unlike make_join, the ?ver= parameter is required for make_knock
+			// since knocking isn't supported by room version 1.
+			vers := httpReq.URL.Query()["ver"]
+			if len(vers) == 0 {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.MissingParam("The ver parameter is required"),
+				}
+			}
+			remoteVersions := make([]gomatrixserverlib.RoomVersion, 0, len(vers))
+			for _, v := range vers {
+				remoteVersions = append(remoteVersions, gomatrixserverlib.RoomVersion(v))
+			}
+			roomID, err := spec.NewRoomID(vars["roomID"])
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam("Invalid RoomID"),
+				}
+			}
+			userID, err := spec.NewUserID(vars["userID"], true)
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam("Invalid UserID"),
+				}
+			}
+			return MakeKnock(
+				httpReq, request, cfg, rsAPI, *roomID, *userID, remoteVersions,
+			)
+		},
+	)).Methods(http.MethodGet)
+
+	v1fedmux.Handle("/send_knock/{roomID}/{eventID}", MakeFedAPI(
+		"federation_send_knock", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
+		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			roomID, err := spec.NewRoomID(vars["roomID"])
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam("Invalid RoomID"),
+				}
+			}
+			return SendKnock(
+				httpReq, request, cfg, rsAPI, keys, *roomID, vars["eventID"],
+			)
+		},
+	)).Methods(http.MethodPut)
+
 	v1fedmux.Handle("/version", httputil.MakeExternalAPI(
 		"federation_version",
 		func(httpReq *http.Request) util.JSONResponse {
@@ -539,7 +618,7 @@ func Setup(
 	)).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/get_missing_events/{roomID}", MakeFedAPI(
-		"federation_get_missing_events", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_get_missing_events", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -552,7 +631,7 @@ func Setup(
 	)).Methods(http.MethodPost)
 
 	v1fedmux.Handle("/backfill/{roomID}", MakeFedAPI(
-		"federation_backfill", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_backfill", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
 				return util.JSONResponse{
@@ -571,14 +650,14 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodPost)
 
 	v1fedmux.Handle("/user/keys/claim", MakeFedAPI(
-		"federation_keys_claim", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_keys_claim", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return ClaimOneTimeKeys(httpReq, request, userAPI, cfg.Matrix.ServerName)
 		},
 	)).Methods(http.MethodPost)
 
 	v1fedmux.Handle("/user/keys/query", MakeFedAPI(
-		"federation_keys_query", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_keys_query", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return QueryDeviceKeys(httpReq, request, userAPI, cfg.Matrix.ServerName)
 		},
@@ -591,7 +670,7 @@ func Setup(
 	).Methods(http.MethodGet)
 
 	v1fedmux.Handle("/hierarchy/{roomID}", MakeFedAPI(
-		"federation_room_hierarchy", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		"federation_room_hierarchy", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, fsAPI.IsServerNameAllowed, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return QueryRoomHierarchy(httpReq, request, vars["roomID"], rsAPI)
 		},
@@ -626,6 +705,7 @@ func ErrorIfLocalServerNotInRoom(
 func MakeFedAPI(
 	metricsName string, serverName spec.ServerName,
 	isLocalServerName func(spec.ServerName) bool,
+	isAllowedServerName func(spec.ServerName) bool,
 	keyRing gomatrixserverlib.JSONVerifier,
 	wakeup *FederationWakeups,
 	f func(*http.Request, *fclient.FederationRequest, map[string]string) util.JSONResponse,
@@ -637,6 +717,12 @@ func MakeFedAPI(
 		if fedReq == nil {
 			return errResp
 		}
+		if !isAllowedServerName(fedReq.Origin()) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("Federation with this server is not allowed"),
+			}
+		}
 		// add the user to Sentry, if enabled
 		hub := sentry.GetHubFromContext(req.Context())
 		if hub != nil {
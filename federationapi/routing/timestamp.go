@@ -0,0 +1,79 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	federationAPI "github.com/ike20013/dendrite/federationapi/api"
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// TimestampToEvent implements GET /_matrix/federation/v1/timestamp_to_event/{roomID},
+// returning the event in the room closest to the given timestamp.
+func TimestampToEvent(
+	httpReq *http.Request,
+	request *fclient.FederationRequest,
+	rsAPI api.FederationRoomserverAPI,
+	roomIDStr string,
+) util.JSONResponse {
+	ctx := httpReq.Context()
+	roomID, err := spec.NewRoomID(roomIDStr)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID"),
+		}
+	}
+	ts, err := strconv.ParseUint(httpReq.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("ts must be a timestamp in milliseconds"),
+		}
+	}
+	dir := httpReq.URL.Query().Get("dir")
+	if dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("dir must be either 'f' or 'b'"),
+		}
+	}
+
+	if resErr := ErrorIfLocalServerNotInRoom(ctx, rsAPI, roomID.String()); resErr != nil {
+		return *resErr
+	}
+
+	res, err := rsAPI.QueryTimestampToEvent(ctx, *roomID, spec.Timestamp(ts), dir == "b")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryTimestampToEvent failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unable to find an event in the given direction"),
+		}
+	}
+	if resErr := allowedToSeeEvent(ctx, request.Origin(), rsAPI, res.EventID, roomID.String()); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationAPI.TimestampToEventResponse{
+			EventID:        res.EventID,
+			OriginServerTS: res.OriginServerTS,
+		},
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package serverfilter decides which servers we federate with, based on
+// lists of allowed and denied server names.
+package serverfilter
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// Filter holds the allowed and denied server name patterns. Patterns may
+// contain * (zero or more characters) and ? (exactly one character) wildcards,
+// and are matched against the hostname without the port, like server ACLs.
+// A nil Filter allows every server.
+type Filter struct {
+	mu      sync.RWMutex
+	allowed []string
+	denied  []string
+	allowRE []*regexp.Regexp
+	denyRE  []*regexp.Regexp
+}
+
+// New returns a filter with the given lists. If the allow list is empty, all
+// servers which aren't denied are allowed.
+func New(allowed, denied []string) (*Filter, error) {
+	f := &Filter{}
+	if err := f.Update(allowed, denied); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Update replaces both lists. The old lists are kept if a pattern is invalid.
+func (f *Filter) Update(allowed, denied []string) error {
+	allowRE, err := compilePatterns(allowed)
+	if err != nil {
+		return err
+	}
+	denyRE, err := compilePatterns(denied)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allowed = append([]string{}, allowed...)
+	f.denied = append([]string{}, denied...)
+	f.allowRE = allowRE
+	f.denyRE = denyRE
+	return nil
+}
+
+// Lists returns copies of the allowed and denied patterns.
+func (f *Filter) Lists() (allowed, denied []string) {
+	if f == nil {
+		return []string{}, []string{}
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]string{}, f.allowed...), append([]string{}, f.denied...)
+}
+
+// IsAllowed returns true if we may federate with the server: it must not
+// match a denied pattern and, if there are allowed patterns, must match one.
+func (f *Filter) IsAllowed(serverName spec.ServerName) bool {
+	if f == nil {
+		return true
+	}
+	host := string(serverName)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, re := range f.denyRE {
+		if re.MatchString(host) {
+			return false
+		}
+	}
+	if len(f.allowRE) == 0 {
+		return true
+	}
+	for _, re := range f.allowRE {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("empty server name pattern")
+		}
+		escaped := regexp.QuoteMeta(strings.ToLower(pattern))
+		escaped = strings.ReplaceAll(escaped, "\\?", ".")
+		escaped = strings.ReplaceAll(escaped, "\\*", ".*")
+		re, err := regexp.Compile("^" + escaped + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid server name pattern %q: %w", pattern, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
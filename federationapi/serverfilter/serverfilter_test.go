@@ -0,0 +1,62 @@
+package serverfilter
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestFilter(t *testing.T) {
+	var nilFilter *Filter
+	if !nilFilter.IsAllowed("example.com") {
+		t.Fatalf("expected a nil filter to allow everything")
+	}
+
+	f, err := New(nil, []string{"*.evil.com", "spam?.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for serverName, want := range map[spec.ServerName]bool{
+		"example.com":        true,
+		"evil.com":           true,
+		"a.evil.com":         false,
+		"A.EVIL.COM:8448":    false,
+		"spam1.org":          false,
+		"spam12.org":         true,
+		"[::1]:8448":         true,
+		"notevil.com.au":     true,
+		"sub.a.evil.com:443": false,
+	} {
+		if got := f.IsAllowed(serverName); got != want {
+			t.Errorf("IsAllowed(%q) = %v, want %v", serverName, got, want)
+		}
+	}
+
+	// The allow list restricts federation to the matching servers, but the
+	// deny list still wins.
+	if err = f.Update([]string{"partner.org", "*.partner.org"}, []string{"bad.partner.org"}); err != nil {
+		t.Fatal(err)
+	}
+	for serverName, want := range map[spec.ServerName]bool{
+		"partner.org":       true,
+		"rooms.partner.org": true,
+		"bad.partner.org":   false,
+		"example.com":       false,
+	} {
+		if got := f.IsAllowed(serverName); got != want {
+			t.Errorf("IsAllowed(%q) = %v, want %v", serverName, got, want)
+		}
+	}
+	allowed, denied := f.Lists()
+	if len(allowed) != 2 || len(denied) != 1 {
+		t.Fatalf("unexpected lists %v %v", allowed, denied)
+	}
+
+	// Invalid patterns leave the lists untouched.
+	if err = f.Update(nil, []string{" "}); err == nil {
+		t.Fatalf("expected an empty pattern to be rejected")
+	}
+	if f.IsAllowed("example.com") {
+		t.Fatalf("expected the previous lists to still apply")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package sharding splits the servers we send to between federation senders.
+package sharding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/nats-io/nats.go"
+
+	"github.com/ike20013/dendrite/roomserver/types"
+)
+
+// Shard is the part of the remote servers a federation sender is responsible for.
+// The zero value owns every server, as does any shard of a total of one.
+type Shard struct {
+	Index int
+	Total int
+}
+
+// Enabled returns true if the servers are split between several senders.
+func (s Shard) Enabled() bool {
+	return s.Total > 1
+}
+
+// Owns returns true if the federation sender for this shard sends to the server.
+func (s Shard) Owns(serverName spec.ServerName) bool {
+	return !s.Enabled() || For(serverName, s.Total) == s.Index
+}
+
+// Split returns the servers owned by this shard, and the others grouped by the
+// shard owning them.
+func (s Shard) Split(serverNames []spec.ServerName) (owned []spec.ServerName, others map[int][]spec.ServerName) {
+	if !s.Enabled() {
+		return serverNames, nil
+	}
+	others = map[int][]spec.ServerName{}
+	for _, serverName := range serverNames {
+		if index := For(serverName, s.Total); index == s.Index {
+			owned = append(owned, serverName)
+		} else {
+			others[index] = append(others[index], serverName)
+		}
+	}
+	return owned, others
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.Index, s.Total)
+}
+
+// For returns the shard owning the server, out of a total number of shards.
+// Server names are hashed without regard to case, and with a jump consistent
+// hash, so that adding a shard only moves the servers which the new shard owns.
+func For(serverName spec.ServerName, total int) int {
+	if total <= 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strings.ToLower(string(serverName))))
+	key := h.Sum64()
+
+	// See "A Fast, Minimal Memory, Consistent Hash Algorithm" by Lamping and Veach.
+	b, j := int64(-1), int64(0)
+	for j < int64(total) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Message hands a PDU or an EDU over to the federation sender owning the destinations,
+// or a change made through the federation API over to the other federation senders.
+type Message struct {
+	Origin       spec.ServerName        `json:"origin"`
+	Destinations []spec.ServerName      `json:"destinations"`
+	PDU          *types.HeaderedEvent   `json:"pdu,omitempty"`
+	EDU          *gomatrixserverlib.EDU `json:"edu,omitempty"`
+	Control      *Control               `json:"control,omitempty"`
+}
+
+// Control is a change made through the federation API. Changes to the domain lists
+// go to every federation sender, and changes to a server to the one owning it.
+type Control struct {
+	// DomainLists replaces the allowed and denied server names, if set.
+	DomainLists *DomainLists `json:"domain_lists,omitempty"`
+	// ResetServer forgets about previous failures to reach the server, if set.
+	ResetServer spec.ServerName `json:"reset_server,omitempty"`
+	// PurgeServer drops everything waiting to be sent to the server, if set.
+	PurgeServer spec.ServerName `json:"purge_server,omitempty"`
+}
+
+// DomainLists are the server names we federate with, or not.
+type DomainLists struct {
+	Allowed []string `json:"allowed"`
+	Denied  []string `json:"denied"`
+}
+
+// Server returns the server the change is about, or "" if it's for every server.
+func (c *Control) Server() spec.ServerName {
+	if c.ResetServer != "" {
+		return c.ResetServer
+	}
+	return c.PurgeServer
+}
+
+// Subject returns the NATS subject of the messages for the shard, below the topic.
+func Subject(topic string, index int) string {
+	return fmt.Sprintf("%s.%d", topic, index)
+}
+
+// Producer hands messages over to the federation senders through NATS JetStream.
+type Producer struct {
+	Topic     string
+	JetStream nats.JetStreamContext
+}
+
+// Send publishes the message for the federation sender of the shard.
+func (p *Producer) Send(ctx context.Context, index int, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	_, err = p.JetStream.PublishMsg(&nats.Msg{
+		Subject: Subject(p.Topic, index),
+		Header:  nats.Header{},
+		Data:    data,
+	}, nats.Context(ctx))
+	return err
+}
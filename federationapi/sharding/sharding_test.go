@@ -0,0 +1,93 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestOwnsOnlyOneShard(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		serverName := spec.ServerName(fmt.Sprintf("server%d.test", i))
+		owners := 0
+		for index := 0; index < 4; index++ {
+			if (Shard{Index: index, Total: 4}).Owns(serverName) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			t.Fatalf("%s is owned by %d shards", serverName, owners)
+		}
+	}
+}
+
+func TestDisabledOwnsEverything(t *testing.T) {
+	for _, shard := range []Shard{{}, {Index: 0, Total: 1}} {
+		if shard.Enabled() {
+			t.Fatalf("shard %s should not be enabled", shard)
+		}
+		if !shard.Owns("server.test") {
+			t.Fatalf("shard %s should own every server", shard)
+		}
+	}
+}
+
+func TestForIgnoresCase(t *testing.T) {
+	if For("Server.Test", 8) != For("server.test", 8) {
+		t.Fatal("expected the shard not to depend on the case of the server name")
+	}
+}
+
+func TestForSpreadsAndMovesLittle(t *testing.T) {
+	const servers = 10000
+	counts := make([]int, 4)
+	moved := 0
+	for i := 0; i < servers; i++ {
+		serverName := spec.ServerName(fmt.Sprintf("server%d.test", i))
+		before := For(serverName, 4)
+		counts[before]++
+		if after := For(serverName, 5); after != before && after != 4 {
+			t.Fatalf("%s moved from shard %d to %d instead of the new shard", serverName, before, after)
+		} else if after != before {
+			moved++
+		}
+	}
+	for index, count := range counts {
+		if count < servers/4*9/10 || count > servers/4*11/10 {
+			t.Errorf("shard %d owns %d servers out of %d", index, count, servers)
+		}
+	}
+	if moved < servers/5*9/10 || moved > servers/5*11/10 {
+		t.Errorf("adding a fifth shard moved %d servers out of %d", moved, servers)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	shard := Shard{Index: 1, Total: 3}
+	serverNames := make([]spec.ServerName, 0, 30)
+	for i := 0; i < 30; i++ {
+		serverNames = append(serverNames, spec.ServerName(fmt.Sprintf("server%d.test", i)))
+	}
+	owned, others := shard.Split(serverNames)
+	if _, ok := others[shard.Index]; ok {
+		t.Fatal("servers owned by the shard should not be handed over")
+	}
+	total := len(owned)
+	for _, serverName := range owned {
+		if !shard.Owns(serverName) {
+			t.Fatalf("%s is not owned by shard %s", serverName, shard)
+		}
+	}
+	for index, names := range others {
+		total += len(names)
+		for _, serverName := range names {
+			if For(serverName, 3) != index {
+				t.Fatalf("%s was grouped with shard %d", serverName, index)
+			}
+		}
+	}
+	if total != len(serverNames) {
+		t.Fatalf("expected %d servers after splitting, got %d", len(serverNames), total)
+	}
+}
@@ -0,0 +1,235 @@
+package federationapi_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/ike20013/dendrite/federationapi"
+	"github.com/ike20013/dendrite/federationapi/queue"
+	"github.com/ike20013/dendrite/federationapi/sharding"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/jetstream"
+	"github.com/ike20013/dendrite/setup/process"
+	"github.com/ike20013/dendrite/test"
+	"github.com/ike20013/dendrite/test/testrig"
+)
+
+// shardClient records the transactions sent by the federation sender of one shard.
+type shardClient struct {
+	fclient.FederationClient
+	mu   sync.Mutex
+	pdus map[spec.ServerName]int
+	edus map[spec.ServerName]int
+}
+
+func (c *shardClient) SendTransaction(ctx context.Context, t gomatrixserverlib.Transaction) (res fclient.RespSend, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pdus[t.Destination] += len(t.PDUs)
+	c.edus[t.Destination] += len(t.EDUs)
+	return
+}
+
+func (c *shardClient) counts(destination spec.ServerName) (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pdus[destination], c.edus[destination]
+}
+
+// shardRig runs the federation senders of the shards in-process. They share the
+// NATS server and the database, as separate processes would.
+type shardRig struct {
+	cfg          *config.Dendrite
+	processCtx   *process.ProcessContext
+	cm           *sqlutil.Connections
+	caches       *caching.Caches
+	natsInstance jetstream.NATSInstance
+	queues       []*queue.OutgoingQueues
+	clients      []*shardClient
+	close        func()
+}
+
+func newShardRig(t *testing.T, dbType test.DBType, shards int) *shardRig {
+	cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+	cfg.FederationAPI.SenderSharding.Shards = shards
+	r := &shardRig{
+		cfg:        cfg,
+		processCtx: processCtx,
+		cm:         sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions),
+		caches:     caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics),
+		queues:     make([]*queue.OutgoingQueues, shards),
+		clients:    make([]*shardClient, shards),
+	}
+	jsctx, _ := r.natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	r.close = func() {
+		jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+		closeDB()
+	}
+	return r
+}
+
+// start starts the federation sender of a shard.
+func (r *shardRig) start(index int) {
+	r.cfg.FederationAPI.SenderSharding.Index = index
+	r.clients[index] = &shardClient{
+		pdus: map[spec.ServerName]int{},
+		edus: map[spec.ServerName]int{},
+	}
+	r.queues[index] = federationapi.NewFederationSender(r.processCtx, r.cfg, r.cm, &r.natsInstance, r.clients[index], r.caches)
+}
+
+// startShards starts the federation senders of all the shards.
+func startShards(t *testing.T, dbType test.DBType, shards int) ([]*queue.OutgoingQueues, []*shardClient, func()) {
+	r := newShardRig(t, dbType, shards)
+	for i := 0; i < shards; i++ {
+		r.start(i)
+	}
+	return r.queues, r.clients, r.close
+}
+
+func TestShardedFederationSenders(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		const shards = 3
+		queues, clients, closeShards := startShards(t, dbType, shards)
+		defer closeShards()
+
+		destinations := make([]spec.ServerName, 0, 20)
+		owned := make([]int, shards)
+		for i := 0; i < 20; i++ {
+			destination := spec.ServerName(fmt.Sprintf("server%d.test", i))
+			destinations = append(destinations, destination)
+			owned[sharding.For(destination, shards)]++
+		}
+		for index, count := range owned {
+			if count == 0 {
+				t.Fatalf("shard %d owns none of the destinations", index)
+			}
+		}
+
+		// Everything is sent through the first shard, like the consumers of the
+		// process running the federation API do.
+		room := test.NewRoom(t, test.NewUser(t))
+		ev := room.Events()[0]
+		if err := queues[0].SendEvent(ev, "test", destinations); err != nil {
+			t.Fatalf("failed to send event: %s", err)
+		}
+		edu := &gomatrixserverlib.EDU{Type: spec.MTyping, Origin: "test", Content: []byte(`{}`)}
+		if err := queues[0].SendEDU(edu, "test", destinations); err != nil {
+			t.Fatalf("failed to send EDU: %s", err)
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for _, destination := range destinations {
+			owner := sharding.For(destination, shards)
+			for {
+				pdus, edus := clients[owner].counts(destination)
+				if pdus == 1 && edus == 1 {
+					break
+				}
+				if pdus > 1 || edus > 1 {
+					t.Fatalf("%s got %d PDUs and %d EDUs, expected one of each", destination, pdus, edus)
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for shard %d to send to %s", owner, destination)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			for index, client := range clients {
+				if index == owner {
+					continue
+				}
+				if pdus, edus := client.counts(destination); pdus != 0 || edus != 0 {
+					t.Fatalf("shard %d sent to %s, which is owned by shard %d", index, destination, owner)
+				}
+			}
+		}
+	})
+}
+
+func TestShardHandOverBeforeSenderStarts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		r := newShardRig(t, dbType, 2)
+		defer r.close()
+		r.start(0)
+
+		var destination spec.ServerName
+		for i := 0; destination == ""; i++ {
+			if serverName := spec.ServerName(fmt.Sprintf("server%d.test", i)); sharding.For(serverName, 2) == 1 {
+				destination = serverName
+			}
+		}
+		room := test.NewRoom(t, test.NewUser(t))
+		if err := r.queues[0].SendEvent(room.Events()[0], "test", []spec.ServerName{destination}); err != nil {
+			t.Fatalf("failed to send event: %s", err)
+		}
+
+		// What was handed over is kept until the federation sender of the shard starts.
+		r.start(1)
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if pdus, _ := r.clients[1].counts(destination); pdus == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for shard 1 to send to %s", destination)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if pdus, _ := r.clients[0].counts(destination); pdus != 0 {
+			t.Fatalf("shard 0 sent to %s, which is owned by shard 1", destination)
+		}
+	})
+}
+
+func TestShardDomainLists(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		queues, clients, closeShards := startShards(t, dbType, 2)
+		defer closeShards()
+
+		var destinations []spec.ServerName
+		for i := 0; len(destinations) < 2; i++ {
+			if serverName := spec.ServerName(fmt.Sprintf("server%d.test", i)); sharding.For(serverName, 2) == 1 {
+				destinations = append(destinations, serverName)
+			}
+		}
+		denied, allowed := destinations[0], destinations[1]
+
+		// The lists are changed through the first shard, like the federation API does.
+		if err := queues[0].Control(context.Background(), &sharding.Control{
+			DomainLists: &sharding.DomainLists{Denied: []string{string(denied)}},
+		}); err != nil {
+			t.Fatalf("failed to set the domain lists: %s", err)
+		}
+		room := test.NewRoom(t, test.NewUser(t))
+		if err := queues[0].SendEvent(room.Events()[0], "test", destinations); err != nil {
+			t.Fatalf("failed to send event: %s", err)
+		}
+
+		// The change is handed over before the event, so once the event reaches
+		// the allowed server the denied one must have been skipped.
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if pdus, _ := clients[1].counts(allowed); pdus == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for shard 1 to send to %s", allowed)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for index, client := range clients {
+			if pdus, _ := client.counts(denied); pdus != 0 {
+				t.Fatalf("shard %d sent to %s, which is denied", index, denied)
+			}
+		}
+	})
+}
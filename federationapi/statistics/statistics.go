@@ -103,6 +103,17 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 	return server
 }
 
+// Servers returns the names of all servers there are statistics for.
+func (s *Statistics) Servers() []spec.ServerName {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	servers := make([]spec.ServerName, 0, len(s.servers))
+	for serverName := range s.servers {
+		servers = append(servers, serverName)
+	}
+	return servers
+}
+
 type SendMethod uint8
 
 const (
@@ -253,6 +264,14 @@ func (s *ServerStatistics) ClearBackoff() {
 	s.backoffStarted.Store(false)
 }
 
+// ResetBackoff forgets about previous failures, so that the next failure
+// starts with the shortest backoff interval again.
+func (s *ServerStatistics) ResetBackoff() {
+	s.backoffCount.Store(0)
+	s.backoffUntil.Store(time.Time{})
+	s.ClearBackoff()
+}
+
 // backoffFinished will clear the previous backoff and notify the destination queue.
 func (s *ServerStatistics) backoffFinished() {
 	s.ClearBackoff()
@@ -275,6 +294,18 @@ func (s *ServerStatistics) BackoffInfo() *time.Time {
 	return nil
 }
 
+// BackingOff returns true if we are waiting for a backoff interval to end
+// before trying the server again.
+func (s *ServerStatistics) BackingOff() bool {
+	return s.backoffStarted.Load()
+}
+
+// FailureCount returns the number of consecutive failures, which determines
+// how long the backoff is.
+func (s *ServerStatistics) FailureCount() uint32 {
+	return s.backoffCount.Load()
+}
+
 // Blacklisted returns true if the server is blacklisted and false
 // otherwise.
 func (s *ServerStatistics) Blacklisted() bool {
@@ -115,3 +115,30 @@ func TestRelayServersListing(t *testing.T) {
 	relayServers = server.KnownRelayServers()
 	assert.Equal(t, []spec.ServerName{"relay1", "relay2"}, relayServers)
 }
+
+func TestResetBackoff(t *testing.T) {
+	stats := NewStatistics(test.NewInMemoryFederationDatabase(), FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	server := stats.ForServer("test.com")
+
+	until, blacklisted := server.Failure()
+	if blacklisted {
+		t.Fatalf("Expected the server not to be blacklisted")
+	}
+	if !server.BackingOff() || server.FailureCount() != 1 {
+		t.Fatalf("Expected to be backing off after one failure, got %v and %d", server.BackingOff(), server.FailureCount())
+	}
+	if info := server.BackoffInfo(); info == nil || !info.Equal(until) {
+		t.Fatalf("Expected backoff until %s, got %v", until, info)
+	}
+	if servers := stats.Servers(); len(servers) != 1 || servers[0] != "test.com" {
+		t.Fatalf("Expected statistics for test.com, got %v", servers)
+	}
+
+	server.ResetBackoff()
+	if server.BackingOff() || server.FailureCount() != 0 {
+		t.Fatalf("Expected the backoff to be reset, got %v and %d", server.BackingOff(), server.FailureCount())
+	}
+	if info := server.BackoffInfo(); info == nil || !info.IsZero() {
+		t.Fatalf("Expected no backoff, got %v", info)
+	}
+}
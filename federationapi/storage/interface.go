@@ -43,6 +43,12 @@ type Database interface {
 	GetPendingPDUServerNames(ctx context.Context) ([]spec.ServerName, error)
 	GetPendingEDUServerNames(ctx context.Context) ([]spec.ServerName, error)
 
+	// GetPendingPDUCount and GetPendingEDUCount return how many PDUs or EDUs are waiting to be sent to the server.
+	GetPendingPDUCount(ctx context.Context, serverName spec.ServerName) (int64, error)
+	GetPendingEDUCount(ctx context.Context, serverName spec.ServerName) (int64, error)
+	// PurgeDestinationQueue removes everything waiting to be sent to the server.
+	PurgeDestinationQueue(ctx context.Context, serverName spec.ServerName) error
+
 	// these don't have contexts passed in as we want things to happen regardless of the request context
 	AddServerToBlacklist(serverName spec.ServerName) error
 	RemoveServerFromBlacklist(serverName spec.ServerName) error
@@ -76,6 +82,10 @@ type Database interface {
 	// Query the notary for the server keys for the given server. If `optKeyIDs` is not empty, multiple server keys may be returned (between 1 - len(optKeyIDs))
 	// such that the combination of all server keys will include all the `optKeyIDs`.
 	GetNotaryKeys(ctx context.Context, serverName spec.ServerName, optKeyIDs []gomatrixserverlib.KeyID) ([]gomatrixserverlib.ServerKeys, error)
+	// GetServerSigningKeys returns the signing keys we hold for the server, or for all servers if the server name is empty.
+	GetServerSigningKeys(ctx context.Context, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	// DeleteServerSigningKeys forgets the signing keys of the server, including the responses we vouch for as a notary.
+	DeleteServerSigningKeys(ctx context.Context, serverName spec.ServerName) error
 	// DeleteExpiredEDUs cleans up expired EDUs
 	DeleteExpiredEDUs(ctx context.Context) error
 
@@ -63,6 +63,10 @@ const selectExpiredEDUsSQL = "" +
 const deleteExpiredEDUsSQL = "" +
 	"DELETE FROM federationsender_queue_edus WHERE expires_at > 0 AND expires_at <= $1"
 
+const selectQueueEDUCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_edus" +
+	" WHERE server_name = $1"
+
 type queueEDUsStatements struct {
 	db                                   *sql.DB
 	insertQueueEDUStmt                   *sql.Stmt
@@ -70,6 +74,7 @@ type queueEDUsStatements struct {
 	selectQueueEDUStmt                   *sql.Stmt
 	selectQueueEDUReferenceJSONCountStmt *sql.Stmt
 	selectQueueEDUServerNamesStmt        *sql.Stmt
+	selectQueueEDUCountStmt              *sql.Stmt
 	selectExpiredEDUsStmt                *sql.Stmt
 	deleteExpiredEDUsStmt                *sql.Stmt
 }
@@ -104,6 +109,7 @@ func (s *queueEDUsStatements) Prepare() error {
 		{&s.selectQueueEDUStmt, selectQueueEDUSQL},
 		{&s.selectQueueEDUReferenceJSONCountStmt, selectQueueEDUReferenceJSONCountSQL},
 		{&s.selectQueueEDUServerNamesStmt, selectQueueServerNamesSQL},
+		{&s.selectQueueEDUCountStmt, selectQueueEDUCountSQL},
 		{&s.selectExpiredEDUsStmt, selectExpiredEDUsSQL},
 		{&s.deleteExpiredEDUsStmt, deleteExpiredEDUsSQL},
 	}.Prepare(s.db)
@@ -222,3 +228,12 @@ func (s *queueEDUsStatements) DeleteExpiredEDUs(
 	_, err := stmt.ExecContext(ctx, expiredBefore)
 	return err
 }
+
+func (s *queueEDUsStatements) SelectQueueEDUCount(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (int64, error) {
+	var count int64
+	stmt := sqlutil.TxStmt(txn, s.selectQueueEDUCountStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&count)
+	return count, err
+}
@@ -54,6 +54,10 @@ const selectQueuePDUReferenceJSONCountSQL = "" +
 const selectQueuePDUServerNamesSQL = "" +
 	"SELECT DISTINCT server_name FROM federationsender_queue_pdus"
 
+const selectQueuePDUCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_pdus" +
+	" WHERE server_name = $1"
+
 type queuePDUsStatements struct {
 	db                                   *sql.DB
 	insertQueuePDUStmt                   *sql.Stmt
@@ -61,6 +65,7 @@ type queuePDUsStatements struct {
 	selectQueuePDUsStmt                  *sql.Stmt
 	selectQueuePDUReferenceJSONCountStmt *sql.Stmt
 	selectQueuePDUServerNamesStmt        *sql.Stmt
+	selectQueuePDUCountStmt              *sql.Stmt
 }
 
 func NewPostgresQueuePDUsTable(db *sql.DB) (s *queuePDUsStatements, err error) {
@@ -77,6 +82,7 @@ func NewPostgresQueuePDUsTable(db *sql.DB) (s *queuePDUsStatements, err error) {
 		{&s.selectQueuePDUsStmt, selectQueuePDUsSQL},
 		{&s.selectQueuePDUReferenceJSONCountStmt, selectQueuePDUReferenceJSONCountSQL},
 		{&s.selectQueuePDUServerNamesStmt, selectQueuePDUServerNamesSQL},
+		{&s.selectQueuePDUCountStmt, selectQueuePDUCountSQL},
 	}.Prepare(db)
 }
 
@@ -165,3 +171,12 @@ func (s *queuePDUsStatements) SelectQueuePDUServerNames(
 
 	return result, rows.Err()
 }
+
+func (s *queuePDUsStatements) SelectQueuePDUCount(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (int64, error) {
+	var count int64
+	stmt := sqlutil.TxStmt(txn, s.selectQueuePDUCountStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&count)
+	return count, err
+}
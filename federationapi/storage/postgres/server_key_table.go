@@ -54,9 +54,24 @@ const upsertServerSigningKeysSQL = "" +
 	" ON CONFLICT ON CONSTRAINT keydb_server_keys_unique" +
 	" DO UPDATE SET valid_until_ts = $4, expired_ts = $5, server_key = $6"
 
+const selectServerSigningKeysSQL = "" +
+	"SELECT server_name, server_key_id, valid_until_ts, expired_ts," +
+	" server_key FROM keydb_server_keys" +
+	" WHERE server_name = $1"
+
+const selectAllServerSigningKeysSQL = "" +
+	"SELECT server_name, server_key_id, valid_until_ts, expired_ts," +
+	" server_key FROM keydb_server_keys"
+
+const deleteServerSigningKeysSQL = "" +
+	"DELETE FROM keydb_server_keys WHERE server_name = $1"
+
 type serverSigningKeyStatements struct {
 	bulkSelectServerKeysStmt *sql.Stmt
 	upsertServerKeysStmt     *sql.Stmt
+	selectServerKeysStmt     *sql.Stmt
+	selectAllServerKeysStmt  *sql.Stmt
+	deleteServerKeysStmt     *sql.Stmt
 }
 
 func NewPostgresServerSigningKeysTable(db *sql.DB) (s *serverSigningKeyStatements, err error) {
@@ -68,6 +83,9 @@ func NewPostgresServerSigningKeysTable(db *sql.DB) (s *serverSigningKeyStatement
 	return s, sqlutil.StatementList{
 		{&s.bulkSelectServerKeysStmt, bulkSelectServerSigningKeysSQL},
 		{&s.upsertServerKeysStmt, upsertServerSigningKeysSQL},
+		{&s.selectServerKeysStmt, selectServerSigningKeysSQL},
+		{&s.selectAllServerKeysStmt, selectAllServerSigningKeysSQL},
+		{&s.deleteServerKeysStmt, deleteServerSigningKeysSQL},
 	}.Prepare(db)
 }
 
@@ -132,6 +150,55 @@ func (s *serverSigningKeyStatements) UpsertServerKeys(
 	return err
 }
 
+func (s *serverSigningKeyStatements) SelectServerKeys(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	var rows *sql.Rows
+	var err error
+	if serverName == "" {
+		rows, err = sqlutil.TxStmt(txn, s.selectAllServerKeysStmt).QueryContext(ctx)
+	} else {
+		rows, err = sqlutil.TxStmt(txn, s.selectServerKeysStmt).QueryContext(ctx, string(serverName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "selectServerKeys: rows.close() failed")
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+
+	var name string
+	var keyID string
+	var key string
+	var validUntilTS int64
+	var expiredTS int64
+	for rows.Next() {
+		if err = rows.Scan(&name, &keyID, &validUntilTS, &expiredTS, &key); err != nil {
+			return nil, err
+		}
+		var vk gomatrixserverlib.VerifyKey
+		if err = vk.Key.Decode(key); err != nil {
+			return nil, err
+		}
+		r := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: spec.ServerName(name),
+			KeyID:      gomatrixserverlib.KeyID(keyID),
+		}
+		results[r] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    vk,
+			ValidUntilTS: spec.Timestamp(validUntilTS),
+			ExpiredTS:    spec.Timestamp(expiredTS),
+		}
+	}
+	return results, rows.Err()
+}
+
+func (s *serverSigningKeyStatements) DeleteServerKeys(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteServerKeysStmt).ExecContext(ctx, string(serverName))
+	return err
+}
+
 func nameAndKeyID(request gomatrixserverlib.PublicKeyLookupRequest) string {
 	return string(request.ServerName) + "\x1F" + string(request.KeyID)
 }
@@ -382,3 +382,64 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 		return nil
 	})
 }
+
+// purgeQueueBatchSize is how many queued PDUs and EDUs are removed at a time
+// by PurgeDestinationQueue.
+const purgeQueueBatchSize = 500
+
+// PurgeDestinationQueue removes all PDUs and EDUs waiting to be sent to the
+// server, along with their JSON unless they are waiting to be sent elsewhere.
+func (d *Database) PurgeDestinationQueue(ctx context.Context, serverName spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for {
+			pduNIDs, err := d.FederationQueuePDUs.SelectQueuePDUs(ctx, txn, serverName, purgeQueueBatchSize)
+			if err != nil {
+				return fmt.Errorf("SelectQueuePDUs: %w", err)
+			}
+			eduNIDs, err := d.FederationQueueEDUs.SelectQueueEDUs(ctx, txn, serverName, purgeQueueBatchSize)
+			if err != nil {
+				return fmt.Errorf("SelectQueueEDUs: %w", err)
+			}
+			if len(pduNIDs) == 0 && len(eduNIDs) == 0 {
+				return nil
+			}
+
+			var deleteNIDs []int64
+			if len(pduNIDs) > 0 {
+				if err = d.FederationQueuePDUs.DeleteQueuePDUs(ctx, txn, serverName, pduNIDs); err != nil {
+					return fmt.Errorf("DeleteQueuePDUs: %w", err)
+				}
+				for _, nid := range pduNIDs {
+					count, err := d.FederationQueuePDUs.SelectQueuePDUReferenceJSONCount(ctx, txn, nid)
+					if err != nil {
+						return fmt.Errorf("SelectQueuePDUReferenceJSONCount: %w", err)
+					}
+					if count <= 0 {
+						deleteNIDs = append(deleteNIDs, nid)
+						d.Cache.EvictFederationQueuedPDU(nid)
+					}
+				}
+			}
+			if len(eduNIDs) > 0 {
+				if err = d.FederationQueueEDUs.DeleteQueueEDUs(ctx, txn, serverName, eduNIDs); err != nil {
+					return fmt.Errorf("DeleteQueueEDUs: %w", err)
+				}
+				for _, nid := range eduNIDs {
+					count, err := d.FederationQueueEDUs.SelectQueueEDUReferenceJSONCount(ctx, txn, nid)
+					if err != nil {
+						return fmt.Errorf("SelectQueueEDUReferenceJSONCount: %w", err)
+					}
+					if count <= 0 {
+						deleteNIDs = append(deleteNIDs, nid)
+						d.Cache.EvictFederationQueuedEDU(nid)
+					}
+				}
+			}
+			if len(deleteNIDs) > 0 {
+				if err = d.FederationQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
+					return fmt.Errorf("DeleteQueueJSON: %w", err)
+				}
+			}
+		}
+	})
+}
@@ -166,6 +166,14 @@ func (d *Database) GetPendingEDUServerNames(
 	return d.FederationQueueEDUs.SelectQueueEDUServerNames(ctx, nil)
 }
 
+// GetPendingEDUCount returns how many EDUs are waiting to be sent to the server.
+func (d *Database) GetPendingEDUCount(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (int64, error) {
+	return d.FederationQueueEDUs.SelectQueueEDUCount(ctx, nil, serverName)
+}
+
 // DeleteExpiredEDUs deletes expired EDUs and evicts them from the cache.
 func (d *Database) DeleteExpiredEDUs(ctx context.Context) error {
 	var jsonNIDs []int64
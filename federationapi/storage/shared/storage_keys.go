@@ -10,6 +10,7 @@ package shared
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -50,3 +51,25 @@ func (d *Database) StoreKeys(
 		return lastErr
 	})
 }
+
+// GetServerSigningKeys returns the signing keys we hold for the server, or
+// for all servers if the server name is empty.
+func (d *Database) GetServerSigningKeys(
+	ctx context.Context, serverName spec.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return d.ServerSigningKeys.SelectServerKeys(ctx, nil, serverName)
+}
+
+// DeleteServerSigningKeys forgets the signing keys of the server, along with
+// the responses we keep to vouch for them as a notary.
+func (d *Database) DeleteServerSigningKeys(ctx context.Context, serverName spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.ServerSigningKeys.DeleteServerKeys(ctx, txn, serverName); err != nil {
+			return fmt.Errorf("DeleteServerKeys: %w", err)
+		}
+		if err := d.NotaryServerKeysMetadata.DeleteKeys(ctx, txn, serverName); err != nil {
+			return fmt.Errorf("DeleteKeys: %w", err)
+		}
+		return d.NotaryServerKeysMetadata.DeleteOldJSONResponses(ctx, txn)
+	})
+}
@@ -144,3 +144,11 @@ func (d *Database) GetPendingPDUServerNames(
 ) ([]spec.ServerName, error) {
 	return d.FederationQueuePDUs.SelectQueuePDUServerNames(ctx, nil)
 }
+
+// GetPendingPDUCount returns how many PDUs are waiting to be sent to the server.
+func (d *Database) GetPendingPDUCount(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (int64, error) {
+	return d.FederationQueuePDUs.SelectQueuePDUCount(ctx, nil, serverName)
+}
@@ -61,6 +61,9 @@ const selectNotaryKeyResponsesWithKeyIDsSQL = `
 	GROUP BY federationsender_notary_server_keys_json.notary_id
 `
 
+const deleteNotaryKeysSQL = "" +
+	"DELETE FROM federationsender_notary_server_keys_metadata WHERE server_name = $1"
+
 // JOINs with the metadata table
 const deleteUnusedServerKeysJSONSQL = `
 	DELETE FROM federationsender_notary_server_keys_json WHERE federationsender_notary_server_keys_json.notary_id NOT IN (
@@ -74,6 +77,7 @@ type notaryServerKeysMetadataStatements struct {
 	selectNotaryKeyResponsesStmt   *sql.Stmt
 	selectNotaryKeyMetadataStmt    *sql.Stmt
 	deleteUnusedServerKeysJSONStmt *sql.Stmt
+	deleteNotaryKeysStmt           *sql.Stmt
 }
 
 func NewSQLiteNotaryServerKeysMetadataTable(db *sql.DB) (s *notaryServerKeysMetadataStatements, err error) {
@@ -90,6 +94,7 @@ func NewSQLiteNotaryServerKeysMetadataTable(db *sql.DB) (s *notaryServerKeysMeta
 		{&s.selectNotaryKeyResponsesStmt, selectNotaryKeyResponsesSQL},
 		{&s.selectNotaryKeyMetadataStmt, selectNotaryKeyMetadataSQL},
 		{&s.deleteUnusedServerKeysJSONStmt, deleteUnusedServerKeysJSONSQL},
+		{&s.deleteNotaryKeysStmt, deleteNotaryKeysSQL},
 	}.Prepare(db)
 }
 
@@ -153,3 +158,8 @@ func (s *notaryServerKeysMetadataStatements) DeleteOldJSONResponses(ctx context.
 	_, err := txn.Stmt(s.deleteUnusedServerKeysJSONStmt).ExecContext(ctx)
 	return err
 }
+
+func (s *notaryServerKeysMetadataStatements) DeleteKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteNotaryKeysStmt).ExecContext(ctx, string(serverName))
+	return err
+}
@@ -23,6 +23,7 @@ type FederationQueuePDUs interface {
 	SelectQueuePDUReferenceJSONCount(ctx context.Context, txn *sql.Tx, jsonNID int64) (int64, error)
 	SelectQueuePDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, limit int) ([]int64, error)
 	SelectQueuePDUServerNames(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
+	SelectQueuePDUCount(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (int64, error)
 }
 
 type FederationQueueEDUs interface {
@@ -31,6 +32,7 @@ type FederationQueueEDUs interface {
 	SelectQueueEDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, limit int) ([]int64, error)
 	SelectQueueEDUReferenceJSONCount(ctx context.Context, txn *sql.Tx, jsonNID int64) (int64, error)
 	SelectQueueEDUServerNames(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
+	SelectQueueEDUCount(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (int64, error)
 	SelectExpiredEDUs(ctx context.Context, txn *sql.Tx, expiredBefore spec.Timestamp) ([]int64, error)
 	DeleteExpiredEDUs(ctx context.Context, txn *sql.Tx, expiredBefore spec.Timestamp) error
 	Prepare() error
@@ -124,9 +126,14 @@ type FederationNotaryServerKeysMetadata interface {
 	SelectKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, keyIDs []gomatrixserverlib.KeyID) ([]gomatrixserverlib.ServerKeys, error)
 	// DeleteOldJSONResponses removes all responses which are not referenced in FederationNotaryServerKeysMetadata
 	DeleteOldJSONResponses(ctx context.Context, txn *sql.Tx) error
+	// DeleteKeys removes the (server_name, key_id) tuples of the server. Call DeleteOldJSONResponses afterwards to remove the responses.
+	DeleteKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 }
 
 type FederationServerSigningKeys interface {
 	BulkSelectServerKeys(ctx context.Context, txn *sql.Tx, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
 	UpsertServerKeys(ctx context.Context, txn *sql.Tx, request gomatrixserverlib.PublicKeyLookupRequest, key gomatrixserverlib.PublicKeyLookupResult) error
+	// SelectServerKeys returns all of the keys of the server, or of all servers if the server name is empty.
+	SelectServerKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	DeleteServerKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 }
@@ -112,5 +112,21 @@ func TestServerKeysTable(t *testing.T) {
 		assert.Equal(t, 2, len(gotKeys))
 		assert.Equal(t, res2, gotKeys[req2])
 		assert.Equal(t, res, gotKeys[req])
+
+		// Select the keys of a single server, and of all servers
+		gotKeys, err = tab.SelectServerKeys(ctx, nil, req2.ServerName)
+		assert.NoError(t, err)
+		assert.Equal(t, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{req2: res2}, gotKeys)
+		gotKeys, err = tab.SelectServerKeys(ctx, nil, "")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(gotKeys))
+
+		// Delete the keys of one server, the other's stay
+		err = tab.DeleteServerKeys(ctx, nil, req2.ServerName)
+		assert.NoError(t, err)
+		gotKeys, err = tab.BulkSelectServerKeys(ctx, nil, selectKeys)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(gotKeys))
+		assert.Equal(t, res, gotKeys[req])
 	})
 }
@@ -10,10 +10,15 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
+	"github.com/ike20013/dendrite/mediaapi/retention"
 	"github.com/ike20013/dendrite/mediaapi/routing"
 	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
 	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/process"
 	userapi "github.com/ike20013/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -21,6 +26,7 @@ import (
 
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
+	processCtx *process.ProcessContext,
 	routers httputil.Routers,
 	cm *sqlutil.Connections,
 	cfg *config.Dendrite,
@@ -28,13 +34,26 @@ func AddPublicRoutes(
 	client *fclient.Client,
 	fedClient fclient.FederationClient,
 	keyRing gomatrixserverlib.JSONVerifier,
+	spamChecker spamcheck.Checker,
 ) {
 	mediaDB, err := storage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	mediaStore, err := mediastore.NewStore(&cfg.MediaAPI)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up media store")
+	}
+
+	activeFileHashes := &types.ActiveFileHashes{
+		HashToLock: map[types.Base64Hash]*types.FileHashLock{},
+	}
+
+	purger := retention.NewPurger(&cfg.MediaAPI, mediaDB, mediaStore, activeFileHashes)
+	purger.Start(processCtx)
+
 	routing.Setup(
-		routers, cfg, mediaDB, userAPI, client, fedClient, keyRing,
+		routers, cfg, mediaDB, mediaStore, activeFileHashes, purger, userAPI, client, fedClient, keyRing, spamChecker,
 	)
 }
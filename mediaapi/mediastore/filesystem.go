@@ -0,0 +1,137 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package mediastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// FilesystemStore keeps media in a directory on the local filesystem, using
+// the keys as paths relative to that directory.
+type FilesystemStore struct {
+	absBasePath config.Path
+}
+
+func NewFilesystemStore(absBasePath config.Path) *FilesystemStore {
+	return &FilesystemStore{
+		absBasePath: absBasePath,
+	}
+}
+
+// path returns the absolute path of the given key, making sure that it is
+// within the base path.
+func (s *FilesystemStore) path(key string) (string, error) {
+	filePath, err := filepath.Abs(filepath.Join(string(s.absBasePath), filepath.FromSlash(key)))
+	if err != nil {
+		return "", fmt.Errorf("unable to construct path: %w", err)
+	}
+	// check if the absolute absBasePath is a prefix of the absolute filePath
+	// if so, no directory escape has occurred and the filePath is valid
+	// Note: absBasePath is already absolute
+	if !strings.HasPrefix(filePath, string(s.absBasePath)) {
+		return "", fmt.Errorf("invalid path (not within absBasePath %v): %v", s.absBasePath, filePath)
+	}
+	return filePath, nil
+}
+
+func (s *FilesystemStore) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		return fmt.Errorf("failed to make directory: %w", err)
+	}
+	// Write to a temporary file first and then move it into place, so that
+	// nothing ever sees a partially written file.
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name()) // nolint: errcheck
+	written, err := io.Copy(tmpFile, content)
+	if err != nil {
+		_ = tmpFile.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if written != size {
+		return fmt.Errorf("wrote %d bytes but expected %d", written, size)
+	}
+	if err = os.Rename(tmpFile.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	return nil
+}
+
+func (s *FilesystemStore) Open(ctx context.Context, key string) (Object, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("file.Stat: %w", err)
+	}
+	return &fileObject{File: file, size: stat.Size()}, nil
+}
+
+func (s *FilesystemStore) Stat(ctx context.Context, key string) (int64, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("os.Stat: %w", err)
+	}
+	return stat.Size(), nil
+}
+
+// DeleteAll removes the files below the given prefix. Prefixes are expected
+// to name a directory, such as those returned by DirKey.
+func (s *FilesystemStore) DeleteAll(ctx context.Context, prefix string) error {
+	dirPath, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	if dirPath == string(s.absBasePath) {
+		return fmt.Errorf("refusing to delete the whole media store")
+	}
+	if err = os.RemoveAll(dirPath); err != nil {
+		return fmt.Errorf("os.RemoveAll: %w", err)
+	}
+	return nil
+}
+
+type fileObject struct {
+	*os.File
+	size int64
+}
+
+func (o *fileObject) Size() int64 {
+	return o.size
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package mediastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// ErrNotFound is returned when there is no object stored under a key.
+var ErrNotFound = errors.New("media not found in store")
+
+// Store holds the content of media files and their thumbnails. Objects are
+// addressed by slash-separated keys, see FileKey and ThumbnailKey.
+type Store interface {
+	// Put stores size bytes read from content under the given key, replacing
+	// any existing object.
+	Put(ctx context.Context, key string, content io.Reader, size int64) error
+	// Open opens the object stored under the given key for reading. Returns
+	// ErrNotFound if there is no such object.
+	Open(ctx context.Context, key string) (Object, error)
+	// Stat returns the size of the object stored under the given key. Returns
+	// ErrNotFound if there is no such object.
+	Stat(ctx context.Context, key string) (int64, error)
+	// DeleteAll removes all objects with keys starting with the given prefix.
+	DeleteAll(ctx context.Context, prefix string) error
+}
+
+// Object is a stored object which has been opened for reading. Seeking is
+// supported so that byte ranges of the object can be served.
+type Object interface {
+	io.ReadSeekCloser
+	// Size returns the size of the object in bytes.
+	Size() int64
+}
+
+// NewStore returns the store configured for the media API.
+func NewStore(cfg *config.MediaAPI) (Store, error) {
+	switch cfg.Storage.Backend {
+	case config.MediaStorageFilesystem:
+		return NewFilesystemStore(cfg.AbsBasePath), nil
+	case config.MediaStorageS3:
+		return NewS3Store(&cfg.Storage.S3)
+	default:
+		return nil, fmt.Errorf("unknown media storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+// FileKey returns the key of a media file from its Base64Hash.
+// 3 levels are used for more manageable browsing, with the remainder as the directory name.
+// For example, if Base64Hash is 'qwerty', the key will be 'q/w/erty/file'.
+func FileKey(base64Hash types.Base64Hash) (string, error) {
+	dir, err := DirKey(base64Hash)
+	if err != nil {
+		return "", err
+	}
+	return dir + "file", nil
+}
+
+// ThumbnailKey returns the key of a thumbnail of a media file. Thumbnails are
+// stored next to the file that they were generated from.
+func ThumbnailKey(fileKey string, size types.ThumbnailSize) string {
+	return path.Join(
+		path.Dir(fileKey),
+		fmt.Sprintf("thumbnail-%vx%v-%v", size.Width, size.Height, size.ResizeMethod),
+	)
+}
+
+// DirKey returns the prefix shared by the keys of a media file and its
+// thumbnails, including the trailing slash.
+func DirKey(base64Hash types.Base64Hash) (string, error) {
+	if len(base64Hash) < 3 {
+		return "", fmt.Errorf("invalid key (Base64Hash too short - min 3 characters): %q", base64Hash)
+	}
+	if len(base64Hash) > 255 {
+		return "", fmt.Errorf("invalid key (Base64Hash too long - max 255 characters): %q", base64Hash)
+	}
+	return path.Join(
+		string(base64Hash[0:1]),
+		string(base64Hash[1:2]),
+		string(base64Hash[2:]),
+	) + "/", nil
+}
@@ -0,0 +1,263 @@
+package mediastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal in-memory implementation of the S3 API, enough for S3Store.
+// Object lists are returned one key at a time to exercise pagination.
+type fakeS3 struct {
+	t       *testing.T
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name, ok := strings.CutPrefix(req.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case req.Method == http.MethodGet && req.URL.Query().Get("list-type") == "2":
+		f.list(w, req)
+	case req.Method == http.MethodPut:
+		if req.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		data, err := io.ReadAll(req.Body)
+		if err == nil && strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data, err = decodeAWSChunked(data)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = data
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		data, ok := f.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, req, "", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(data))
+	case req.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeAWSChunked decodes the body of a streaming upload, which is split into
+// chunks of the form "<hex size>;chunk-signature=<signature>\r\n<data>\r\n".
+func decodeAWSChunked(body []byte) ([]byte, error) {
+	var data []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, errors.New("missing chunk header")
+		}
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || int64(len(rest)) < size+2 {
+			return nil, errors.New("invalid chunk size")
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, rest[:size]...)
+		body = rest[size+2:]
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, req *http.Request) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, req.URL.Query().Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start := 0
+	if token := req.URL.Query().Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	type content struct {
+		Key string `xml:"Key"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+	if start < len(keys) {
+		result.Contents = []content{{Key: keys[start]}}
+	}
+	if start+1 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 1)
+	}
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		f.t.Errorf("failed to encode list: %v", err)
+	}
+}
+
+func newFakeS3Store(t *testing.T, prefix string) *S3Store {
+	fake := &fakeS3{t: t, bucket: "media", objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	store, err := NewS3Store(&config.S3MediaStorage{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "media",
+		Prefix:          prefix,
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		ForcePathStyle:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create S3 store: %v", err)
+	}
+	return store
+}
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"filesystem": func(t *testing.T) Store {
+			return NewFilesystemStore(config.Path(t.TempDir()))
+		},
+		"s3": func(t *testing.T) Store {
+			return newFakeS3Store(t, "")
+		},
+		"s3 with prefix": func(t *testing.T) Store {
+			return newFakeS3Store(t, "/dendrite/")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, newStore(t))
+		})
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	content := []byte("0123456789abcdefghij")
+	fileKey, err := FileKey("qwerty")
+	assert.NoError(t, err)
+	thumbnailKey := ThumbnailKey(fileKey, types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop})
+	otherKey, err := FileKey("qwertz")
+	assert.NoError(t, err)
+
+	_, err = store.Stat(ctx, fileKey)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Open(ctx, fileKey)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	for _, key := range []string{fileKey, thumbnailKey, otherKey} {
+		assert.NoError(t, store.Put(ctx, key, bytes.NewReader(content), int64(len(content))))
+	}
+	size, err := store.Stat(ctx, fileKey)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	t.Run("reads objects", func(t *testing.T) {
+		object, err := store.Open(ctx, fileKey)
+		assert.NoError(t, err)
+		defer object.Close() // nolint: errcheck
+		assert.Equal(t, int64(len(content)), object.Size())
+		got, err := io.ReadAll(object)
+		assert.NoError(t, err)
+		assert.Equal(t, content, got)
+	})
+
+	t.Run("seeks within objects", func(t *testing.T) {
+		object, err := store.Open(ctx, fileKey)
+		assert.NoError(t, err)
+		defer object.Close() // nolint: errcheck
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(object, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "01234", string(buf))
+		_, err = object.Seek(10, io.SeekStart)
+		assert.NoError(t, err)
+		_, err = io.ReadFull(object, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "abcde", string(buf))
+		_, err = object.Seek(-3, io.SeekEnd)
+		assert.NoError(t, err)
+		got, err := io.ReadAll(object)
+		assert.NoError(t, err)
+		assert.Equal(t, "hij", string(got))
+	})
+
+	t.Run("serves byte ranges", func(t *testing.T) {
+		object, err := store.Open(ctx, fileKey)
+		assert.NoError(t, err)
+		defer object.Close() // nolint: errcheck
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", "bytes=5-9")
+		rec := httptest.NewRecorder()
+		http.ServeContent(rec, req, "", time.Time{}, object)
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "bytes 5-9/20", rec.Header().Get("Content-Range"))
+		assert.Equal(t, "56789", rec.Body.String())
+	})
+
+	t.Run("replaces objects", func(t *testing.T) {
+		replacement := []byte("replaced")
+		assert.NoError(t, store.Put(ctx, otherKey, bytes.NewReader(replacement), int64(len(replacement))))
+		size, err := store.Stat(ctx, otherKey)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(replacement)), size)
+	})
+
+	t.Run("deletes a file with its thumbnails", func(t *testing.T) {
+		dirKey, err := DirKey("qwerty")
+		assert.NoError(t, err)
+		assert.NoError(t, store.DeleteAll(ctx, dirKey))
+		_, err = store.Stat(ctx, fileKey)
+		assert.True(t, errors.Is(err, ErrNotFound), "file should be deleted")
+		_, err = store.Stat(ctx, thumbnailKey)
+		assert.True(t, errors.Is(err, ErrNotFound), "thumbnail should be deleted")
+		_, err = store.Stat(ctx, otherKey)
+		assert.NoError(t, err, "other files should be kept")
+	})
+}
+
+func TestFileKey(t *testing.T) {
+	key, err := FileKey("qwerty")
+	assert.NoError(t, err)
+	assert.Equal(t, "q/w/erty/file", key)
+	assert.Equal(t, "q/w/erty/thumbnail-96x64-scale", ThumbnailKey(key, types.ThumbnailSize{Width: 96, Height: 64, ResizeMethod: types.Scale}))
+	_, err = FileKey("qw")
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package mediastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Store keeps media in a bucket of an S3-compatible object store, such as
+// AWS, MinIO or Ceph. Failed requests are retried by the client.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Store(cfg *config.S3MediaStorage) (*S3Store, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	// Without credentials in the config file, fall back to the ones used by
+	// other S3 tooling: the AWS environment variables, the shared credentials
+	// file and then the instance or container role.
+	creds := credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken)
+	if cfg.AccessKeyID == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+	// Virtual-hosted style addressing is used for endpoints which are known
+	// to support it, unless path style is forced.
+	bucketLookup := minio.BucketLookupAuto
+	if cfg.ForcePathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.Scheme == "https",
+		Region:       cfg.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Store{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: prefix,
+	}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, content, size, minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("s3: failed to put %q: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (Object, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.objectError(err, key)
+	}
+	// The object is only requested once it is used, so stat it first to
+	// find out whether it exists.
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, s.objectError(err, key)
+	}
+	return &s3Object{Object: obj, size: info.Size}, nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (int64, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, s.objectError(err, key)
+	}
+	return info.Size, nil
+}
+
+func (s *S3Store) DeleteAll(ctx context.Context, prefix string) error {
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return fmt.Errorf("s3: failed to list %q: %w", prefix, object.Err)
+		}
+		if err := s.client.RemoveObject(ctx, s.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("s3: failed to delete %q: %w", object.Key, err)
+		}
+	}
+	return nil
+}
+
+// objectError returns ErrNotFound if the object doesn't exist, or otherwise
+// wraps the error with the key of the object.
+func (s *S3Store) objectError(err error, key string) error {
+	if resp := minio.ToErrorResponse(err); resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return fmt.Errorf("s3: failed to get %q: %w", key, err)
+}
+
+// s3Object reads an object with ranged GET requests, which are made by the
+// client whenever the reader is moved to a different offset.
+type s3Object struct {
+	*minio.Object
+	size int64
+}
+
+func (o *s3Object) Size() int64 {
+	return o.size
+}
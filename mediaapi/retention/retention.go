@@ -0,0 +1,137 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package retention
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ike20013/dendrite/mediaapi/fileutils"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
+	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// Purger removes media, along with its thumbnails, from both the database and
+// the media store.
+type Purger struct {
+	cfg              *config.MediaAPI
+	db               storage.Database
+	store            mediastore.Store
+	activeFileHashes *types.ActiveFileHashes
+}
+
+func NewPurger(cfg *config.MediaAPI, db storage.Database, store mediastore.Store, activeFileHashes *types.ActiveFileHashes) *Purger {
+	return &Purger{
+		cfg:              cfg,
+		db:               db,
+		store:            store,
+		activeFileHashes: activeFileHashes,
+	}
+}
+
+// Start periodically purges media that is older than the configured retention
+// policies allow, until the process is shut down. Does nothing if no policies
+// are configured.
+func (p *Purger) Start(processCtx *process.ProcessContext) {
+	retention := p.cfg.Retention
+	if retention.LocalMediaMaxAge <= 0 && retention.RemoteMediaMaxAge <= 0 {
+		return
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"local_media_max_age":  retention.LocalMediaMaxAge,
+		"remote_media_max_age": retention.RemoteMediaMaxAge,
+	})
+	logger.Info("Media retention enabled")
+
+	go func() {
+		ticker := time.NewTicker(retention.PurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-processCtx.WaitForShutdown():
+				return
+			case <-ticker.C:
+			}
+			ctx := processCtx.Context()
+			now := time.Now()
+			if retention.LocalMediaMaxAge > 0 {
+				count, err := p.PurgeMediaLastAccessedBefore(ctx, spec.AsTimestamp(now.Add(-retention.LocalMediaMaxAge)), true)
+				if err != nil {
+					logger.WithError(err).Error("Failed to purge local media")
+				} else if count > 0 {
+					logger.Infof("Purged %d local media files", count)
+				}
+			}
+			if retention.RemoteMediaMaxAge > 0 {
+				count, err := p.PurgeMediaLastAccessedBefore(ctx, spec.AsTimestamp(now.Add(-retention.RemoteMediaMaxAge)), false)
+				if err != nil {
+					logger.WithError(err).Error("Failed to purge remote media")
+				} else if count > 0 {
+					logger.Infof("Purged %d remote media files", count)
+				}
+			}
+		}
+	}()
+}
+
+// PurgeMediaLastAccessedBefore purges either the local or the remote media which
+// hasn't been downloaded since the given time. Returns how many were purged.
+func (p *Purger) PurgeMediaLastAccessedBefore(ctx context.Context, before spec.Timestamp, local bool) (int, error) {
+	localOrigins := []spec.ServerName{p.cfg.Matrix.ServerName}
+	for _, host := range p.cfg.Matrix.VirtualHosts {
+		localOrigins = append(localOrigins, host.ServerName)
+	}
+	media, err := p.db.GetMediaLastAccessedBefore(ctx, before, localOrigins, local)
+	if err != nil {
+		return 0, fmt.Errorf("p.db.GetMediaLastAccessedBefore: %w", err)
+	}
+	purged := 0
+	for _, metadata := range media {
+		if err = p.PurgeMedia(ctx, metadata); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// PurgeMedia removes the media and its thumbnails from the database. The file
+// and its thumbnails are removed from the media store too, unless other media
+// refers to the same file.
+func (p *Purger) PurgeMedia(ctx context.Context, metadata *types.MediaMetadata) error {
+	// Uploads and downloads of the same file hold the lock from storing the file
+	// until its metadata is stored, so they can't refer to the file once counted.
+	unlock := fileutils.LockFileHash(p.activeFileHashes, metadata.Base64Hash)
+	defer unlock()
+
+	if err := p.db.DeleteMedia(ctx, metadata.MediaID, metadata.Origin); err != nil {
+		return fmt.Errorf("p.db.DeleteMedia: %w", err)
+	}
+	// Uploads of the same file share the file in the media store, so we can
+	// only remove it once nothing else refers to it.
+	count, err := p.db.CountMediaByHash(ctx, metadata.Base64Hash)
+	if err != nil {
+		return fmt.Errorf("p.db.CountMediaByHash: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	dirKey, err := mediastore.DirKey(metadata.Base64Hash)
+	if err != nil {
+		return fmt.Errorf("mediastore.DirKey: %w", err)
+	}
+	// Thumbnails are stored next to the file, so this removes them too.
+	if err = p.store.DeleteAll(ctx, dirKey); err != nil {
+		return fmt.Errorf("p.store.DeleteAll: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/mediaapi/fileutils"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
+	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func mustStoreFile(t *testing.T, store mediastore.Store, hash types.Base64Hash) string {
+	t.Helper()
+	fileKey, err := mediastore.FileKey(hash)
+	if err != nil {
+		t.Fatalf("unable to get file key: %v", err)
+	}
+	if err = store.Put(context.Background(), fileKey, strings.NewReader(string(hash)), int64(len(hash))); err != nil {
+		t.Fatalf("unable to store media file: %v", err)
+	}
+	return fileKey
+}
+
+func TestPurgeMediaLastAccessedBefore(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		cfg := &config.MediaAPI{
+			Matrix: &config.Global{
+				SigningIdentity: fclient.SigningIdentity{
+					ServerName: "localhost",
+				},
+			},
+		}
+		store := test.NewInMemoryMediaStore()
+		ctx := context.Background()
+
+		media := []*types.MediaMetadata{
+			{MediaID: "local", Origin: "localhost", Base64Hash: "bG9jYWw="},
+			{MediaID: "remote", Origin: "remote", Base64Hash: "c2hhcmVk"},
+			{MediaID: "remote2", Origin: "remote", Base64Hash: "c2hhcmVk"},
+			{MediaID: "recent", Origin: "remote", Base64Hash: "cmVjZW50"},
+		}
+		files := map[types.MediaID]string{}
+		for _, metadata := range media {
+			if err = db.StoreMediaMetadata(ctx, metadata); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+			files[metadata.MediaID] = mustStoreFile(t, store, metadata.Base64Hash)
+		}
+		old := spec.AsTimestamp(time.Now().Add(-time.Hour))
+		for _, mediaID := range []types.MediaID{"local", "remote"} {
+			origin := spec.ServerName("remote")
+			if mediaID == "local" {
+				origin = "localhost"
+			}
+			if err = db.UpdateMediaLastAccess(ctx, mediaID, origin, old); err != nil {
+				t.Fatalf("unable to update last access: %v", err)
+			}
+		}
+
+		activeFileHashes := &types.ActiveFileHashes{
+			HashToLock: map[types.Base64Hash]*types.FileHashLock{},
+		}
+		purger := NewPurger(cfg, db, store, activeFileHashes)
+		before := spec.AsTimestamp(time.Now().Add(-time.Minute))
+		purged, err := purger.PurgeMediaLastAccessedBefore(ctx, before, false)
+		if err != nil {
+			t.Fatalf("unable to purge remote media: %v", err)
+		}
+		if purged != 1 {
+			t.Fatalf("expected 1 remote media to be purged, got %d", purged)
+		}
+		if metadata, _ := db.GetMediaMetadata(ctx, "remote", "remote"); metadata != nil {
+			t.Fatalf("expected purged media to be deleted")
+		}
+		// The file is still used by other media, so it must not be removed.
+		if _, err = store.Stat(ctx, files["remote"]); err != nil {
+			t.Fatalf("expected shared file to be kept: %v", err)
+		}
+		if metadata, _ := db.GetMediaMetadata(ctx, "local", "localhost"); metadata == nil {
+			t.Fatalf("expected local media to be kept")
+		}
+
+		purged, err = purger.PurgeMediaLastAccessedBefore(ctx, before, true)
+		if err != nil {
+			t.Fatalf("unable to purge local media: %v", err)
+		}
+		if purged != 1 {
+			t.Fatalf("expected 1 local media to be purged, got %d", purged)
+		}
+		if _, err = store.Stat(ctx, files["local"]); !errors.Is(err, mediastore.ErrNotFound) {
+			t.Fatalf("expected local media file to be removed, got %v", err)
+		}
+		if _, err = store.Stat(ctx, files["recent"]); err != nil {
+			t.Fatalf("expected recently accessed file to be kept: %v", err)
+		}
+
+		// An upload of the same file holds the lock until its metadata is stored,
+		// so the purge must then see that the file is still used.
+		recent, err := db.GetMediaMetadata(ctx, "recent", "remote")
+		if err != nil || recent == nil {
+			t.Fatalf("unable to get recent media: %v", err)
+		}
+		unlock := fileutils.LockFileHash(activeFileHashes, recent.Base64Hash)
+		purgeErr := make(chan error, 1)
+		go func() {
+			purgeErr <- purger.PurgeMedia(ctx, recent)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID: "upload", Origin: "localhost", Base64Hash: recent.Base64Hash,
+		}); err != nil {
+			t.Fatalf("unable to store media metadata: %v", err)
+		}
+		unlock()
+		if err = <-purgeErr; err != nil {
+			t.Fatalf("unable to purge media: %v", err)
+		}
+		if _, err = store.Stat(ctx, files["recent"]); err != nil {
+			t.Fatalf("expected file stored while purging to be kept: %v", err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ike20013/dendrite/mediaapi/retention"
+	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// adminMediaResponse is the representation of media returned by the admin endpoints.
+type adminMediaResponse struct {
+	MediaID      types.MediaID       `json:"media_id"`
+	Origin       spec.ServerName     `json:"media_origin"`
+	ContentType  types.ContentType   `json:"media_type"`
+	Length       types.FileSizeBytes `json:"media_length"`
+	UploadName   types.Filename      `json:"upload_name"`
+	CreatedTS    spec.Timestamp      `json:"created_ts"`
+	LastAccessTS spec.Timestamp      `json:"last_access_ts"`
+	Quarantined  bool                `json:"quarantined"`
+}
+
+// AdminPurgeRemoteMedia implements POST /_dendrite/admin/purgeRemoteMedia?days=N
+// It removes all media cached from other servers that hasn't been downloaded in the last N days.
+func AdminPurgeRemoteMedia(req *http.Request, purger *retention.Purger) util.JSONResponse {
+	days, err := strconv.Atoi(req.URL.Query().Get("days"))
+	if err != nil || days < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("days must be a non-negative integer"),
+		}
+	}
+	before := spec.AsTimestamp(time.Now().AddDate(0, 0, -days))
+	purged, err := purger.PurgeMediaLastAccessedBefore(req.Context(), before, false)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to purge remote media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"deleted": purged,
+		},
+	}
+}
+
+// AdminQuarantineMedia implements POST and DELETE /_dendrite/admin/quarantineMedia/{serverName}/{mediaID}
+// Quarantined media can no longer be downloaded, but isn't removed so that it can be inspected.
+func AdminQuarantineMedia(
+	req *http.Request,
+	db storage.Database,
+	serverName spec.ServerName,
+	mediaID types.MediaID,
+	quarantined bool,
+) util.JSONResponse {
+	metadata, err := db.GetMediaMetadata(req.Context(), mediaID, serverName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetMediaMetadata failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if metadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Media not found"),
+		}
+	}
+	if err = db.SetMediaQuarantined(req.Context(), mediaID, serverName, quarantined); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SetMediaQuarantined failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminListUserMedia implements GET /_dendrite/admin/userMedia/{userID}?from=N&limit=N
+// Media is listed newest first.
+func AdminListUserMedia(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	userID string,
+) util.JSONResponse {
+	parsedUserID, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid user ID"),
+		}
+	}
+	if !cfg.Matrix.IsLocalServerName(parsedUserID.Domain()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Can only list media of local users"),
+		}
+	}
+	from, limit := 0, 100
+	if v := req.URL.Query().Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("from must be a non-negative integer"),
+			}
+		}
+	}
+	if v := req.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+
+	// Ask for one more than we need, so we know whether there's another page.
+	media, err := db.GetMediaByUserID(req.Context(), types.MatrixUserID(parsedUserID.String()), from, limit+1)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetMediaByUserID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	resp := map[string]interface{}{}
+	if len(media) > limit {
+		media = media[:limit]
+		resp["next_token"] = from + limit
+	}
+	result := make([]adminMediaResponse, 0, len(media))
+	for _, metadata := range media {
+		result = append(result, adminMediaResponse{
+			MediaID:      metadata.MediaID,
+			Origin:       metadata.Origin,
+			ContentType:  metadata.ContentType,
+			Length:       metadata.FileSizeBytes,
+			UploadName:   metadata.UploadName,
+			CreatedTS:    metadata.CreationTimestamp,
+			LastAccessTS: metadata.LastAccessTimestamp,
+			Quarantined:  metadata.Quarantined,
+		})
+	}
+	resp["media"] = result
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resp,
+	}
+}
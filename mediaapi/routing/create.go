@@ -0,0 +1,255 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ike20013/dendrite/external/spamcheck"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
+	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// errorNotYetUploaded is returned when downloading media which was created with
+	// /create, but hasn't been uploaded before the download timed out.
+	errorNotYetUploaded spec.MatrixErrorCode = "M_NOT_YET_UPLOADED"
+	// errorCannotOverwriteMedia is returned when uploading to a media ID that
+	// already has content.
+	errorCannotOverwriteMedia spec.MatrixErrorCode = "M_CANNOT_OVERWRITE_MEDIA"
+)
+
+// defaultDownloadWait is how long downloads wait for media that hasn't been
+// uploaded yet if the client doesn't specify a timeout_ms.
+const defaultDownloadWait = 20 * time.Second
+
+// errNotYetUploaded is returned by doDownload if the media was not uploaded in time.
+var errNotYetUploaded = fmt.Errorf("media has not been uploaded yet")
+
+// createResponse defines the format of the JSON response
+// https://spec.matrix.org/v1.7/client-server-api/#post_matrixmediav1create
+type createResponse struct {
+	ContentURI      string         `json:"content_uri"`
+	UnusedExpiresAt spec.Timestamp `json:"unused_expires_at"`
+}
+
+// CreateMedia implements POST /create, which creates a media ID whose content the
+// user can upload later on with PUT /upload/{serverName}/{mediaId}.
+func CreateMedia(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database) util.JSONResponse {
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin: cfg.Matrix.ServerName,
+			UserID: types.MatrixUserID(dev.UserID),
+		},
+		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
+	}
+	mediaID, err := r.generateMediaID(req.Context(), db)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to generate media ID for pending upload")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	now := time.Now()
+	pending := &types.PendingMedia{
+		MediaID:           mediaID,
+		Origin:            cfg.Matrix.ServerName,
+		UserID:            types.MatrixUserID(dev.UserID),
+		CreationTimestamp: spec.AsTimestamp(now),
+		ExpiresTimestamp:  spec.AsTimestamp(now.Add(cfg.AsyncUploads.PendingExpiry)),
+	}
+	stored, err := db.StorePendingMedia(req.Context(), pending, cfg.AsyncUploads.MaxPendingPerUser)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to store pending media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !stored {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded("Too many media IDs are waiting for their content to be uploaded", 0),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: createResponse{
+			ContentURI:      fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, mediaID),
+			UnusedExpiresAt: pending.ExpiresTimestamp,
+		},
+	}
+}
+
+// UploadPendingMedia implements PUT /upload/{serverName}/{mediaId}, which uploads
+// the content of a media ID that was created with POST /create.
+func UploadPendingMedia(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
+	serverName spec.ServerName,
+	mediaID types.MediaID,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	activePendingUploads *types.ActivePendingUploads,
+	spamChecker spamcheck.Checker,
+) util.JSONResponse {
+	if serverName != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown media ID"),
+		}
+	}
+	r, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		return *resErr
+	}
+	r.MediaMetadata.MediaID = mediaID
+	r.Logger = r.Logger.WithField("media_id", mediaID)
+
+	existingMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, serverName)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to look up media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if existingMetadata != nil {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: spec.MatrixError{ErrCode: errorCannotOverwriteMedia, Err: "Media has already been uploaded"},
+		}
+	}
+
+	pending, err := db.GetPendingMedia(req.Context(), mediaID, serverName)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to look up pending media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if pending == nil || pending.ExpiresTimestamp.Time().Before(time.Now()) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown media ID"),
+		}
+	}
+	if pending.UserID != types.MatrixUserID(dev.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("Media was created by another user"),
+		}
+	}
+
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, activeFileHashes, activeThumbnailGeneration, spamChecker); resErr != nil {
+		return *resErr
+	}
+	notifyUploaded(activePendingUploads, mediaID)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// downloadWait returns how long a download should wait for media that hasn't been
+// uploaded yet, which is the timeout_ms requested by the client if it is within
+// the configured limit.
+func downloadWait(req *http.Request, cfg *config.MediaAPI) time.Duration {
+	wait := defaultDownloadWait
+	if timeoutMS, err := strconv.ParseInt(req.URL.Query().Get("timeout_ms"), 10, 64); err == nil && timeoutMS >= 0 {
+		wait = time.Duration(min(timeoutMS, cfg.AsyncUploads.MaxDownloadWait.Milliseconds())) * time.Millisecond
+	}
+	return min(wait, cfg.AsyncUploads.MaxDownloadWait)
+}
+
+// waitForPendingMedia waits for media that was created with /create to be uploaded.
+// Returns nil if there is no such media, or errNotYetUploaded if it wasn't uploaded
+// within the given time.
+func waitForPendingMedia(
+	ctx context.Context,
+	mediaID types.MediaID,
+	mediaOrigin spec.ServerName,
+	wait time.Duration,
+	db storage.Database,
+	activePendingUploads *types.ActivePendingUploads,
+) (*types.MediaMetadata, error) {
+	pending, err := db.GetPendingMedia(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return nil, fmt.Errorf("db.GetPendingMedia: %w", err)
+	}
+	if pending == nil || pending.ExpiresTimestamp.Time().Before(time.Now()) {
+		return nil, nil
+	}
+
+	uploaded, stopWaiting := waitForUpload(activePendingUploads, mediaID)
+	defer stopWaiting()
+	// The upload may have finished before we started waiting for it.
+	mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil || mediaMetadata != nil {
+		return mediaMetadata, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-uploaded:
+		return db.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	case <-timer.C:
+		return nil, errNotYetUploaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waitForUpload returns a channel which is closed once the media has been uploaded.
+// The returned function must be called once the caller no longer waits on the channel.
+func waitForUpload(activePendingUploads *types.ActivePendingUploads, mediaID types.MediaID) (<-chan struct{}, func()) {
+	activePendingUploads.Lock()
+	defer activePendingUploads.Unlock()
+	result, ok := activePendingUploads.MediaIDToResult[mediaID]
+	if !ok {
+		result = &types.PendingUploadResult{
+			Done: make(chan struct{}),
+		}
+		activePendingUploads.MediaIDToResult[mediaID] = result
+	}
+	result.Waiters++
+	return result.Done, func() {
+		activePendingUploads.Lock()
+		defer activePendingUploads.Unlock()
+		result.Waiters--
+		if result.Waiters == 0 && activePendingUploads.MediaIDToResult[mediaID] == result {
+			delete(activePendingUploads.MediaIDToResult, mediaID)
+		}
+	}
+}
+
+// notifyUploaded wakes up the downloads waiting for the media to be uploaded.
+func notifyUploaded(activePendingUploads *types.ActivePendingUploads, mediaID types.MediaID) {
+	activePendingUploads.Lock()
+	defer activePendingUploads.Unlock()
+	if result, ok := activePendingUploads.MediaIDToResult[mediaID]; ok {
+		close(result.Done)
+		delete(activePendingUploads.MediaIDToResult, mediaID)
+	}
+}
@@ -0,0 +1,148 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/test"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestAsyncUpload(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		basePath := config.Path(t.TempDir())
+		cfg := &config.MediaAPI{
+			Matrix: &config.Global{
+				SigningIdentity: fclient.SigningIdentity{
+					ServerName: "localhost",
+				},
+			},
+			BasePath:         basePath,
+			AbsBasePath:      basePath,
+			MaxFileSizeBytes: config.DefaultMaxFileSizeBytes,
+			AsyncUploads: config.AsyncUploads{
+				PendingExpiry:     time.Hour,
+				MaxPendingPerUser: 2,
+				MaxDownloadWait:   10 * time.Second,
+			},
+		}
+		store := test.NewInMemoryMediaStore()
+		activeFileHashes := &types.ActiveFileHashes{
+			HashToLock: map[types.Base64Hash]*types.FileHashLock{},
+		}
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+		activePendingUploads := &types.ActivePendingUploads{
+			MediaIDToResult: map[types.MediaID]*types.PendingUploadResult{},
+		}
+		alice := &userapi.Device{UserID: "@alice:localhost"}
+		bob := &userapi.Device{UserID: "@bob:localhost"}
+
+		create := func(dev *userapi.Device) (int, types.MediaID) {
+			req := httptest.NewRequest(http.MethodPost, "/_matrix/media/v1/create", nil)
+			res := CreateMedia(req, cfg, dev, db)
+			if res.Code != http.StatusOK {
+				return res.Code, ""
+			}
+			contentURI := res.JSON.(createResponse).ContentURI
+			mediaID, ok := strings.CutPrefix(contentURI, "mxc://localhost/")
+			if !ok {
+				t.Fatalf("unexpected content URI %q", contentURI)
+			}
+			return res.Code, types.MediaID(mediaID)
+		}
+		upload := func(dev *userapi.Device, mediaID types.MediaID, content string) int {
+			req := httptest.NewRequest(http.MethodPut, "/_matrix/media/v3/upload/localhost/"+string(mediaID), strings.NewReader(content))
+			req.Header.Set("Content-Type", "text/plain")
+			return UploadPendingMedia(
+				req, cfg, dev, db, store, activeFileHashes, "localhost", mediaID,
+				activeThumbnailGeneration, activePendingUploads, nil,
+			).Code
+		}
+		download := func(mediaID types.MediaID, timeoutMS string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/_matrix/media/v3/download/localhost/"+string(mediaID)+"?timeout_ms="+timeoutMS, nil)
+			rec := httptest.NewRecorder()
+			Download(
+				rec, req, "localhost", mediaID, cfg, db, store, activeFileHashes, nil, nil,
+				&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+				activeThumbnailGeneration, activePendingUploads, false, "", false,
+			)
+			return rec
+		}
+
+		code, mediaID := create(alice)
+		if code != http.StatusOK {
+			t.Fatalf("expected media ID to be created, got HTTP %d", code)
+		}
+
+		rec := download(mediaID, "0")
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("expected HTTP 504 for media that hasn't been uploaded, got %d", rec.Code)
+		}
+		var matrixErr spec.MatrixError
+		if err = json.Unmarshal(rec.Body.Bytes(), &matrixErr); err != nil || matrixErr.ErrCode != errorNotYetUploaded {
+			t.Fatalf("expected %s, got %s", errorNotYetUploaded, rec.Body.String())
+		}
+
+		downloaded := make(chan *httptest.ResponseRecorder)
+		go func() {
+			downloaded <- download(mediaID, "10000")
+		}()
+		// Give the download a moment to start waiting.
+		time.Sleep(100 * time.Millisecond)
+
+		if code = upload(bob, mediaID, "hello"); code != http.StatusForbidden {
+			t.Fatalf("expected HTTP 403 for upload by another user, got %d", code)
+		}
+		if code = upload(alice, mediaID, "hello"); code != http.StatusOK {
+			t.Fatalf("expected upload to succeed, got HTTP %d", code)
+		}
+		select {
+		case rec = <-downloaded:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("download wasn't woken up by the upload")
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+			t.Fatalf("expected the uploaded media to be downloaded, got HTTP %d: %s", rec.Code, rec.Body.String())
+		}
+
+		if code = upload(alice, mediaID, "again"); code != http.StatusConflict {
+			t.Fatalf("expected HTTP 409 when uploading twice, got %d", code)
+		}
+		if code = upload(alice, "unknown", "hello"); code != http.StatusNotFound {
+			t.Fatalf("expected HTTP 404 for unknown media ID, got %d", code)
+		}
+
+		for i := 0; i < cfg.AsyncUploads.MaxPendingPerUser; i++ {
+			if code, _ = create(alice); code != http.StatusOK {
+				t.Fatalf("expected media ID to be created, got HTTP %d", code)
+			}
+		}
+		if code, _ = create(alice); code != http.StatusTooManyRequests {
+			t.Fatalf("expected HTTP 429 over the pending limit, got %d", code)
+		}
+		if code, _ = create(bob); code != http.StatusOK {
+			t.Fatalf("expected the limit to be per user, got HTTP %d", code)
+		}
+	})
+}
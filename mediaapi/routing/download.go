@@ -17,15 +17,15 @@ import (
 	"net/http"
 	"net/textproto"
 	"net/url"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/ike20013/dendrite/mediaapi/fileutils"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
 	"github.com/ike20013/dendrite/mediaapi/storage"
 	"github.com/ike20013/dendrite/mediaapi/thumbnailer"
 	"github.com/ike20013/dendrite/mediaapi/types"
@@ -107,10 +107,13 @@ func Download(
 	mediaID types.MediaID,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
 	client *fclient.Client,
 	fedClient fclient.FederationClient,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	activePendingUploads *types.ActivePendingUploads,
 	isThumbnailRequest bool,
 	customFilename string,
 	federationRequest bool,
@@ -163,14 +166,23 @@ func Download(
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
-		activeRemoteRequests, activeThumbnailGeneration,
+		req, w, cfg, db, store, activeFileHashes, client,
+		activeRemoteRequests, activeThumbnailGeneration, activePendingUploads,
 	)
+	if errors.Is(err, errNotYetUploaded) {
+		// The media may still arrive, so this mustn't be cached.
+		w.Header().Del("Cache-Control")
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: spec.MatrixError{ErrCode: errorNotYetUploaded, Err: "Media has not been uploaded yet"},
+		})
+		return
+	}
 	if err != nil {
 		// If we bubbled up a os.PathError, e.g. no such file or directory, don't send
 		// it to the client, be more generic.
 		var perr *fs.PathError
-		if errors.As(err, &perr) {
+		if errors.As(err, &perr) || errors.Is(err, mediastore.ErrNotFound) {
 			dReq.Logger.WithError(err).Error("failed to open file")
 			dReq.jsonErrorResponse(w, util.JSONResponse{
 				Code: http.StatusNotFound,
@@ -253,14 +265,18 @@ func (r *downloadRequest) Validate() *util.JSONResponse {
 }
 
 func (r *downloadRequest) doDownload(
-	ctx context.Context,
+	req *http.Request,
 	w http.ResponseWriter,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
 	client *fclient.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	activePendingUploads *types.ActivePendingUploads,
 ) (*types.MediaMetadata, error) {
+	ctx := req.Context()
 	// check if we have a record of the media in our database
 	mediaMetadata, err := db.GetMediaMetadata(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
@@ -268,68 +284,104 @@ func (r *downloadRequest) doDownload(
 	if err != nil {
 		return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
 	}
-	if mediaMetadata == nil {
-		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
+	if mediaMetadata == nil && r.MediaMetadata.Origin == cfg.Matrix.ServerName {
+		// The media ID may have been created with /create, in which case we
+		// give the client a chance to finish uploading it.
+		mediaMetadata, err = waitForPendingMedia(
+			ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
+			downloadWait(req, cfg), db, activePendingUploads,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if mediaMetadata == nil {
 			// If we do not have a record and the origin is local, the file is not found
 			return nil, nil
 		}
+	}
+	if mediaMetadata == nil {
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, client, cfg, db, store, activeFileHashes, activeRemoteRequests, activeThumbnailGeneration,
 		)
 		if resErr != nil {
 			return nil, resErr
 		}
 	} else {
-		// If we have a record, we can respond from the local file
+		// If we have a record, we can respond from the stored file
 		r.MediaMetadata = mediaMetadata
 	}
-	return r.respondFromLocalFile(
-		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
+	// Quarantined media is treated as if it doesn't exist.
+	if r.MediaMetadata.Quarantined {
+		return nil, nil
+	}
+	metadata, err := r.respondFromStore(
+		req, w, store, activeThumbnailGeneration,
 		cfg.MaxThumbnailGenerators, db,
 		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
 	)
+	if err == nil && metadata != nil {
+		r.updateLastAccess(ctx, db)
+	}
+	return metadata, err
+}
+
+// lastAccessGranularity is how stale the last access time of media may get
+// before it is updated, so that popular media doesn't cause a write on every
+// download.
+const lastAccessGranularity = 10 * time.Minute
+
+// updateLastAccess records that the media was downloaded, so that media
+// retention doesn't purge media that is still in use.
+func (r *downloadRequest) updateLastAccess(ctx context.Context, db storage.Database) {
+	now := time.Now()
+	if now.Sub(r.MediaMetadata.LastAccessTimestamp.Time()) < lastAccessGranularity {
+		return
+	}
+	ts := spec.AsTimestamp(now)
+	if err := db.UpdateMediaLastAccess(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin, ts); err != nil {
+		r.Logger.WithError(err).Warn("Failed to update media last access time")
+		return
+	}
+	r.MediaMetadata.LastAccessTimestamp = ts
 }
 
-// respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
+// respondFromStore reads a file from the media store and writes it to the http.ResponseWriter
 // If no file was found then returns nil, nil
-func (r *downloadRequest) respondFromLocalFile(
-	ctx context.Context,
+func (r *downloadRequest) respondFromStore(
+	req *http.Request,
 	w http.ResponseWriter,
-	absBasePath config.Path,
+	store mediastore.Store,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
 ) (*types.MediaMetadata, error) {
-	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
+	ctx := req.Context()
+	fileKey, err := mediastore.FileKey(r.MediaMetadata.Base64Hash)
 	if err != nil {
-		return nil, fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
+		return nil, fmt.Errorf("mediastore.FileKey: %w", err)
 	}
-	file, err := os.Open(filePath)
-	defer file.Close() // nolint: errcheck, staticcheck, megacheck
+	file, err := store.Open(ctx, fileKey)
 	if err != nil {
-		return nil, fmt.Errorf("os.Open: %w", err)
-	}
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("file.Stat: %w", err)
+		return nil, fmt.Errorf("store.Open: %w", err)
 	}
+	defer file.Close() // nolint: errcheck
 
-	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != stat.Size() {
+	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != file.Size() {
 		r.Logger.WithFields(log.Fields{
 			"fileSizeDatabase": r.MediaMetadata.FileSizeBytes,
-			"fileSizeDisk":     stat.Size(),
-		}).Warn("File size in database and on-disk differ.")
-		return nil, errors.New("file size in database and on-disk differ")
+			"fileSizeStore":    file.Size(),
+		}).Warn("File size in database and media store differ.")
+		return nil, errors.New("file size in database and media store differ")
 	}
 
-	var responseFile *os.File
+	var responseFile mediastore.Object
 	var responseMetadata *types.MediaMetadata
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
+			ctx, store, fileKey, activeThumbnailGeneration, maxThumbnailGenerators,
 			db, dynamicThumbnails, thumbnailSizes,
 		)
 		if thumbFile != nil {
@@ -367,7 +419,6 @@ func (r *downloadRequest) respondFromLocalFile(
 	}
 
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
@@ -376,9 +427,9 @@ func (r *downloadRequest) respondFromLocalFile(
 
 	if !r.multipartResponse {
 		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
-		if _, err = io.Copy(w, responseFile); err != nil {
-			return nil, fmt.Errorf("io.Copy: %w", err)
-		}
+		// ServeContent sets the Content-Length and handles Range requests, so that
+		// clients can resume downloads or seek within media.
+		http.ServeContent(w, req, "", time.Time{}, responseFile)
 	} else {
 		var written int64
 		written, err = multipartResponse(w, r, string(responseMetadata.ContentType), responseFile)
@@ -489,19 +540,20 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
 	ctx context.Context,
-	filePath types.Path,
+	store mediastore.Store,
+	fileKey string,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+) (mediastore.Object, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
 	if dynamicThumbnails {
 		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+			ctx, store, fileKey, r.ThumbnailSize, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
 		)
 		if err != nil {
@@ -532,7 +584,7 @@ func (r *downloadRequest) getThumbnailFile(
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Debug("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
+				ctx, store, fileKey, *thumbnailSize, activeThumbnailGeneration,
 				maxThumbnailGenerators, db,
 			)
 			if err != nil {
@@ -550,27 +602,21 @@ func (r *downloadRequest) getThumbnailFile(
 		"FileSizeBytes": thumbnail.MediaMetadata.FileSizeBytes,
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
-	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
-	thumbFile, err := os.Open(string(thumbPath))
+	thumbFile, err := store.Open(ctx, mediastore.ThumbnailKey(fileKey, thumbnail.ThumbnailSize))
 	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("os.Open: %w", err)
+		return nil, nil, fmt.Errorf("store.Open: %w", err)
 	}
-	thumbStat, err := thumbFile.Stat()
-	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("thumbFile.Stat: %w", err)
-	}
-	if types.FileSizeBytes(thumbStat.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
+	if types.FileSizeBytes(thumbFile.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
 		thumbFile.Close() // nolint: errcheck
-		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
+		return nil, nil, errors.New("thumbnail file sizes in media store and in database differ")
 	}
 	return thumbFile, thumbnail, nil
 }
 
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
-	filePath types.Path,
+	store mediastore.Store,
+	fileKey string,
 	thumbnailSize types.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -582,7 +628,7 @@ func (r *downloadRequest) generateThumbnail(
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
 	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
+		ctx, store, fileKey, thumbnailSize, r.MediaMetadata,
 		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 	)
 	if err != nil {
@@ -611,6 +657,8 @@ func (r *downloadRequest) getRemoteFile(
 	client *fclient.Client,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
@@ -644,7 +692,7 @@ func (r *downloadRequest) getRemoteFile(
 		if mediaMetadata == nil {
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
-				ctx, client,
+				ctx, client, store, activeFileHashes,
 				cfg.AbsBasePath, cfg.MaxFileSizeBytes, db,
 				cfg.ThumbnailSizes, activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
@@ -711,6 +759,8 @@ func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.Act
 func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	ctx context.Context,
 	client *fclient.Client,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
 	db storage.Database,
@@ -718,13 +768,27 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) error {
-	finalPath, duplicate, err := r.fetchRemoteFile(
+	tmpDir, err := r.fetchRemoteFile(
 		ctx, client, absBasePath, maxFileSizeBytes,
 	)
 	if err != nil {
 		return err
 	}
 
+	// The file mustn't be purged before the metadata referring to it is stored.
+	unlock := fileutils.LockFileHash(activeFileHashes, r.MediaMetadata.Base64Hash)
+	defer unlock()
+
+	// The database is the source of truth so we need to have moved the file first
+	fileKey, duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, r.MediaMetadata, store, r.Logger)
+	if err != nil {
+		return fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
+	}
+	if duplicate {
+		r.Logger.WithField("dst", fileKey).Trace("File was stored previously - discarding duplicate")
+		// Continue on to store the metadata in the database
+	}
+
 	r.Logger.WithFields(log.Fields{
 		"Base64Hash":    r.MediaMetadata.Base64Hash,
 		"UploadName":    r.MediaMetadata.UploadName,
@@ -738,8 +802,7 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			finalDir := filepath.Dir(string(finalPath))
-			fileutils.RemoveDir(types.Path(finalDir), r.Logger)
+			removeStoredFile(ctx, store, r.MediaMetadata.Base64Hash, r.Logger)
 		}
 		// NOTE: It should really not be possible to fail the uniqueness test here so
 		// there is no need to handle that separately
@@ -748,7 +811,7 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, fileKey, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -815,7 +878,7 @@ func (r *downloadRequest) fetchRemoteFile(
 	client *fclient.Client,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
-) (types.Path, bool, error) {
+) (types.Path, error) {
 	r.Logger.Debug("Fetching remote file")
 
 	// Attempt to download via authenticated media endpoint
@@ -828,9 +891,9 @@ func (r *downloadRequest) fetchRemoteFile(
 		resp, err = client.CreateMediaDownloadRequest(ctx, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
 		if err != nil || (resp != nil && resp.StatusCode != http.StatusOK) {
 			if resp != nil && resp.StatusCode == http.StatusNotFound {
-				return "", false, fmt.Errorf("File with media ID %q does not exist on %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+				return "", fmt.Errorf("File with media ID %q does not exist on %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
 			}
-			return "", false, fmt.Errorf("file with media ID %q could not be downloaded from %s: %w", r.MediaMetadata.MediaID, r.MediaMetadata.Origin, err)
+			return "", fmt.Errorf("file with media ID %q could not be downloaded from %s: %w", r.MediaMetadata.MediaID, r.MediaMetadata.Origin, err)
 		}
 	}
 	defer resp.Body.Close() // nolint: errcheck
@@ -851,12 +914,12 @@ func (r *downloadRequest) fetchRemoteFile(
 	}
 
 	if parseErr != nil {
-		return "", false, parseErr
+		return "", parseErr
 	}
 
 	if maxFileSizeBytes > 0 && contentLength > int64(maxFileSizeBytes) {
 		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
+		return "", fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
 	}
 
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
@@ -889,7 +952,7 @@ func (r *downloadRequest) fetchRemoteFile(
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while downloading file from remote server")
-		return "", false, errors.New("file could not be downloaded from remote server")
+		return "", errors.New("file could not be downloaded from remote server")
 	}
 
 	r.Logger.Trace("Remote file transferred")
@@ -900,17 +963,7 @@ func (r *downloadRequest) fetchRemoteFile(
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(bytesWritten)
 	r.MediaMetadata.Base64Hash = hash
 
-	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
-	if err != nil {
-		return "", false, fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
-	}
-	if duplicate {
-		r.Logger.WithField("dst", finalPath).Trace("File was stored previously - discarding duplicate")
-		// Continue on to store the metadata in the database
-	}
-
-	return types.Path(finalPath), duplicate, nil
+	return tmpDir, nil
 }
 
 func parseMultipartResponse(r *downloadRequest, resp *http.Response, maxFileSizeBytes config.FileSizeBytes) (int64, io.Reader, error) {
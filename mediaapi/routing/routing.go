@@ -14,6 +14,9 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
+	"github.com/ike20013/dendrite/mediaapi/retention"
 	"github.com/ike20013/dendrite/mediaapi/storage"
 	"github.com/ike20013/dendrite/mediaapi/types"
 	"github.com/ike20013/dendrite/setup/config"
@@ -42,10 +45,14 @@ func Setup(
 	routers httputil.Routers,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
+	purger *retention.Purger,
 	userAPI userapi.MediaUserAPI,
 	client *fclient.Client,
 	federationClient fclient.FederationClient,
 	keyRing gomatrixserverlib.JSONVerifier,
+	spamChecker spamcheck.Checker,
 ) {
 	rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting)
 
@@ -63,7 +70,7 @@ func Setup(
 			if r := rateLimits.Limit(req, dev); r != nil {
 				return *r
 			}
-			return Upload(req, &cfg.MediaAPI, dev, db, activeThumbnailGeneration)
+			return Upload(req, &cfg.MediaAPI, dev, db, store, activeFileHashes, activeThumbnailGeneration, spamChecker)
 		},
 	)
 
@@ -82,37 +89,102 @@ func Setup(
 	})
 
 	v3mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
+
+	activePendingUploads := &types.ActivePendingUploads{
+		MediaIDToResult: map[types.MediaID]*types.PendingUploadResult{},
+	}
+
+	v3mux.Handle("/create", httputil.MakeAuthAPI("create", userAPI, func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+		if r := rateLimits.Limit(req, dev); r != nil {
+			return *r
+		}
+		return CreateMedia(req, &cfg.MediaAPI, dev, db)
+	})).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/upload/{serverName}/{mediaId}", httputil.MakeAuthAPI("upload_pending", userAPI, func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+		if r := rateLimits.Limit(req, dev); r != nil {
+			return *r
+		}
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return UploadPendingMedia(
+			req, &cfg.MediaAPI, dev, db, store, activeFileHashes,
+			spec.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			activeThumbnailGeneration, activePendingUploads, spamChecker,
+		)
+	})).Methods(http.MethodPut, http.MethodOptions)
+
+	if cfg.MediaAPI.URLPreviews.Enabled {
+		urlPreviewClient := newURLPreviewClient(&cfg.MediaAPI.URLPreviews)
+		previewURLHandler := httputil.MakeAuthAPI("preview_url", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return PreviewURL(req, &cfg.MediaAPI, device, db, store, activeFileHashes, urlPreviewClient, activeThumbnailGeneration)
+		})
+		v3mux.Handle("/preview_url", previewURLHandler).Methods(http.MethodGet, http.MethodOptions)
+		v1mux.Handle("/preview_url", previewURLHandler).Methods(http.MethodGet, http.MethodOptions)
+	}
 	v3mux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
 
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download_unauthed", &cfg.MediaAPI, rateLimits, db, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, false)
+	downloadHandler := makeDownloadAPI("download_unauthed", &cfg.MediaAPI, rateLimits, db, store, activeFileHashes, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, activePendingUploads, false)
 	v3mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v3mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 
 	v3mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail_unauthed", &cfg.MediaAPI, rateLimits, db, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, false),
+		makeDownloadAPI("thumbnail_unauthed", &cfg.MediaAPI, rateLimits, db, store, activeFileHashes, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, activePendingUploads, false),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	// v1 client endpoints requiring auth
-	downloadHandlerAuthed := httputil.MakeHTTPAPI("download", userAPI, cfg.Global.Metrics.Enabled, makeDownloadAPI("download_authed_client", &cfg.MediaAPI, rateLimits, db, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, false), httputil.WithAuth())
+	downloadHandlerAuthed := httputil.MakeHTTPAPI("download", userAPI, cfg.Global.Metrics.Enabled, makeDownloadAPI("download_authed_client", &cfg.MediaAPI, rateLimits, db, store, activeFileHashes, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, activePendingUploads, false), httputil.WithAuth())
 	v1mux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
 	v1mux.Handle("/download/{serverName}/{mediaId}", downloadHandlerAuthed).Methods(http.MethodGet, http.MethodOptions)
 	v1mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandlerAuthed).Methods(http.MethodGet, http.MethodOptions)
 
 	v1mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		httputil.MakeHTTPAPI("thumbnail", userAPI, cfg.Global.Metrics.Enabled, makeDownloadAPI("thumbnail_authed_client", &cfg.MediaAPI, rateLimits, db, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, false), httputil.WithAuth()),
+		httputil.MakeHTTPAPI("thumbnail", userAPI, cfg.Global.Metrics.Enabled, makeDownloadAPI("thumbnail_authed_client", &cfg.MediaAPI, rateLimits, db, store, activeFileHashes, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, activePendingUploads, false), httputil.WithAuth()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	// same, but for federation
 	v1fedMux.Handle("/download/{mediaId}", routing.MakeFedHTTPAPI(cfg.Global.ServerName, cfg.Global.IsLocalServerName, keyRing,
-		makeDownloadAPI("download_authed_federation", &cfg.MediaAPI, rateLimits, db, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, true),
+		makeDownloadAPI("download_authed_federation", &cfg.MediaAPI, rateLimits, db, store, activeFileHashes, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, activePendingUploads, true),
 	)).Methods(http.MethodGet, http.MethodOptions)
 	v1fedMux.Handle("/thumbnail/{mediaId}", routing.MakeFedHTTPAPI(cfg.Global.ServerName, cfg.Global.IsLocalServerName, keyRing,
-		makeDownloadAPI("thumbnail_authed_federation", &cfg.MediaAPI, rateLimits, db, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, true),
+		makeDownloadAPI("thumbnail_authed_federation", &cfg.MediaAPI, rateLimits, db, store, activeFileHashes, client, federationClient, activeRemoteRequests, activeThumbnailGeneration, activePendingUploads, true),
 	)).Methods(http.MethodGet, http.MethodOptions)
+
+	routers.DendriteAdmin.Handle("/admin/purgeRemoteMedia",
+		httputil.MakeAdminAPI("admin_purge_remote_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeRemoteMedia(req, purger)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	routers.DendriteAdmin.Handle("/admin/quarantineMedia/{serverName}/{mediaId}",
+		httputil.MakeAdminAPI("admin_quarantine_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			quarantined := req.Method != http.MethodDelete
+			return AdminQuarantineMedia(req, db, spec.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]), quarantined)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	routers.DendriteAdmin.Handle("/admin/userMedia/{userID}",
+		httputil.MakeAdminAPI("admin_user_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminListUserMedia(req, &cfg.MediaAPI, db, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
 }
 
 var thumbnailCounter = promauto.NewCounterVec(
@@ -162,10 +234,13 @@ func makeDownloadAPI(
 	cfg *config.MediaAPI,
 	rateLimits *httputil.RateLimits,
 	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
 	client *fclient.Client,
 	fedClient fclient.FederationClient,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	activePendingUploads *types.ActivePendingUploads,
 	forFederation bool,
 ) http.HandlerFunc {
 	var counterVec *prometheus.CounterVec
@@ -231,10 +306,13 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			store,
+			activeFileHashes,
 			client,
 			fedClient,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
+			activePendingUploads,
 			strings.HasPrefix(name, "thumbnail"),
 			vars["downloadName"],
 			forFederation,
@@ -14,11 +14,12 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/mediaapi/fileutils"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
 	"github.com/ike20013/dendrite/mediaapi/storage"
 	"github.com/ike20013/dendrite/mediaapi/thumbnailer"
 	"github.com/ike20013/dendrite/mediaapi/types"
@@ -49,13 +50,13 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, store mediastore.Store, activeFileHashes *types.ActiveFileHashes, activeThumbnailGeneration *types.ActiveThumbnailGeneration, spamChecker spamcheck.Checker) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, activeFileHashes, activeThumbnailGeneration, spamChecker); resErr != nil {
 		return *resErr
 	}
 
@@ -111,6 +112,15 @@ func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database
 			// and generate a new one instead.
 			continue
 		}
+		// The media ID might also have been handed out by /create
+		// without having been uploaded to yet.
+		pending, err := db.GetPendingMedia(ctx, mediaID, r.MediaMetadata.Origin)
+		if err != nil {
+			return "", fmt.Errorf("db.GetPendingMedia: %w", err)
+		}
+		if pending != nil {
+			continue
+		}
 		// The media ID was not already used - let's return that.
 		return mediaID, nil
 	}
@@ -121,7 +131,10 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	spamChecker spamcheck.Checker,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
 		"UploadName":    r.MediaMetadata.UploadName,
@@ -167,6 +180,21 @@ func (r *uploadRequest) doUpload(
 		return requestEntityTooLargeJSONResponse(cfg.MaxFileSizeBytes)
 	}
 
+	if uploader, uploaderErr := spec.NewUserID(string(r.MediaMetadata.UserID), true); uploaderErr == nil && spamChecker != nil {
+		if denied := spamChecker.CheckMediaFileForSpam(ctx, *uploader, spamcheck.MediaFile{
+			ContentType: string(r.MediaMetadata.ContentType),
+			Filename:    string(r.MediaMetadata.UploadName),
+			Size:        int64(bytesWritten),
+			Path:        filepath.Join(string(tmpDir), "content"),
+		}); denied != nil {
+			fileutils.RemoveDir(tmpDir, r.Logger)
+			return &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: *denied,
+			}
+		}
+	}
+
 	// Look up the media by the file hash. If we already have the file but under a
 	// different media ID then we won't upload the file again - instead we'll just
 	// add a new metadata entry that refers to the same file.
@@ -184,13 +212,18 @@ func (r *uploadRequest) doUpload(
 	if existingMetadata != nil {
 		// The file already exists, delete the uploaded temporary file.
 		defer fileutils.RemoveDir(tmpDir, r.Logger)
-		// The file already exists. Make a new media ID up for it.
-		mediaID, merr := r.generateMediaID(ctx, db)
-		if merr != nil {
-			r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
-			return &util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.InternalServerError{},
+		// The file already exists. Make a new media ID up for it, unless the
+		// media ID was created before the upload.
+		mediaID := r.MediaMetadata.MediaID
+		if mediaID == "" {
+			var merr error
+			mediaID, merr = r.generateMediaID(ctx, db)
+			if merr != nil {
+				r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
+				return &util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
 			}
 		}
 
@@ -199,7 +232,7 @@ func (r *uploadRequest) doUpload(
 			MediaID:           mediaID,
 			Origin:            r.MediaMetadata.Origin,
 			ContentType:       r.MediaMetadata.ContentType,
-			FileSizeBytes:     r.MediaMetadata.FileSizeBytes,
+			FileSizeBytes:     bytesWritten,
 			CreationTimestamp: r.MediaMetadata.CreationTimestamp,
 			UploadName:        r.MediaMetadata.UploadName,
 			Base64Hash:        hash,
@@ -209,13 +242,15 @@ func (r *uploadRequest) doUpload(
 		// The file doesn't exist. Update the request metadata.
 		r.MediaMetadata.FileSizeBytes = bytesWritten
 		r.MediaMetadata.Base64Hash = hash
-		r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
-		if err != nil {
-			fileutils.RemoveDir(tmpDir, r.Logger)
-			r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
-			return &util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.InternalServerError{},
+		if r.MediaMetadata.MediaID == "" {
+			r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
+			if err != nil {
+				fileutils.RemoveDir(tmpDir, r.Logger)
+				r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
+				return &util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
 			}
 		}
 	}
@@ -229,7 +264,7 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, store, activeFileHashes, db, cfg.ThumbnailSizes,
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
@@ -269,21 +304,25 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
-// storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
-// See getPathFromMediaMetadata in fileutils for details of the final path.
+// storeFileAndMetadata moves the temporary file into the media store based on metadata and stores the metadata in the database
+// See FileKey in mediastore for details of where the file is stored.
 // The order of operations is important as it avoids metadata entering the database before the file
 // is ready, and if we fail to move the file, it never gets added to the database.
 // Returns a util.JSONResponse error and cleans up directories in case of error.
 func (r *uploadRequest) storeFileAndMetadata(
 	ctx context.Context,
 	tmpDir types.Path,
-	absBasePath config.Path,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	// The file mustn't be purged before the metadata referring to it is stored.
+	unlock := fileutils.LockFileHash(activeFileHashes, r.MediaMetadata.Base64Hash)
+	defer unlock()
+	fileKey, duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, r.MediaMetadata, store, r.Logger)
 	if err != nil {
 		r.Logger.WithError(err).Error("Failed to move file.")
 		return &util.JSONResponse{
@@ -292,7 +331,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 		}
 	}
 	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+		r.Logger.WithField("dst", fileKey).Info("File was stored previously - discarding duplicate")
 	}
 
 	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
@@ -301,7 +340,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+			removeStoredFile(ctx, store, r.MediaMetadata.Base64Hash, r.Logger)
 		}
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -310,7 +349,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 	}
 
 	go func() {
-		file, err := os.Open(string(finalPath))
+		file, err := store.Open(context.Background(), fileKey)
 		if err != nil {
 			r.Logger.WithError(err).Error("unable to open file")
 			return
@@ -331,7 +370,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 		}
 
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, fileKey, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -344,3 +383,15 @@ func (r *uploadRequest) storeFileAndMetadata(
 
 	return nil
 }
+
+// removeStoredFile removes a file and any thumbnails of it from the media store,
+// logging a warning in case of errors.
+func removeStoredFile(ctx context.Context, store mediastore.Store, base64Hash types.Base64Hash, logger *log.Entry) {
+	dirKey, err := mediastore.DirKey(base64Hash)
+	if err == nil {
+		err = store.DeleteAll(ctx, dirKey)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("hash", base64Hash).Warn("failed to remove file from media store")
+	}
+}
@@ -3,17 +3,24 @@ package routing
 import (
 	"context"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/mediaapi/fileutils"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
 	"github.com/ike20013/dendrite/mediaapi/storage"
 	"github.com/ike20013/dendrite/mediaapi/types"
 	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/test"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -28,6 +35,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 		reqReader                 io.Reader
 		cfg                       *config.MediaAPI
 		db                        storage.Database
+		store                     mediastore.Store
 		activeThumbnailGeneration *types.ActiveThumbnailGeneration
 	}
 
@@ -60,6 +68,10 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 	if err != nil {
 		t.Errorf("error opening mediaapi database: %v", err)
 	}
+	store := mediastore.NewFilesystemStore(config.Path(testdataPath))
+	activeFileHashes := &types.ActiveFileHashes{
+		HashToLock: map[types.Base64Hash]*types.FileHashLock{},
+	}
 
 	tests := []struct {
 		name   string
@@ -74,6 +86,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("test"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -91,6 +104,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("testtest"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -108,6 +122,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("test test test"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -129,7 +144,8 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 					AbsBasePath:       config.Path(testdataPath),
 					DynamicThumbnails: false,
 				},
-				db: db,
+				db:    db,
+				store: store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -146,9 +162,74 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				MediaMetadata: tt.fields.MediaMetadata,
 				Logger:        tt.fields.Logger,
 			}
-			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.activeThumbnailGeneration); !reflect.DeepEqual(got, tt.want) {
+			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.store, activeFileHashes, tt.args.activeThumbnailGeneration, nil); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("doUpload() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestUploadSpamChecker(t *testing.T) {
+	checker, err := spamcheck.New(&config.SpamChecker{
+		Enabled:           true,
+		BlockedUsers:      []string{"^@bob:localhost$"},
+		BlockedMediaTypes: []string{"application/x-msdownload"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create the spam checker: %v", err)
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		basePath := config.Path(t.TempDir())
+		cfg := &config.MediaAPI{
+			Matrix: &config.Global{
+				SigningIdentity: fclient.SigningIdentity{
+					ServerName: "localhost",
+				},
+			},
+			BasePath:         basePath,
+			AbsBasePath:      basePath,
+			MaxFileSizeBytes: config.DefaultMaxFileSizeBytes,
+		}
+		store := test.NewInMemoryMediaStore()
+		activeFileHashes := &types.ActiveFileHashes{
+			HashToLock: map[types.Base64Hash]*types.FileHashLock{},
+		}
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+		alice := &userapi.Device{UserID: "@alice:localhost"}
+		bob := &userapi.Device{UserID: "@bob:localhost"}
+
+		testCases := []struct {
+			name        string
+			dev         *userapi.Device
+			contentType string
+			content     string
+			wantCode    int
+		}{
+			{name: "allowed", dev: alice, contentType: "text/plain", content: "hello", wantCode: http.StatusOK},
+			{name: "blocked media type", dev: alice, contentType: "application/x-msdownload", content: "MZ", wantCode: http.StatusForbidden},
+			{name: "blocked user", dev: bob, contentType: "text/plain", content: "hello from bob", wantCode: http.StatusForbidden},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodPost, "/_matrix/media/v3/upload", strings.NewReader(tc.content))
+				req.Header.Set("Content-Type", tc.contentType)
+				res := Upload(req, cfg, tc.dev, db, store, activeFileHashes, activeThumbnailGeneration, checker)
+				if res.Code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %+v", tc.wantCode, res.Code, res.JSON)
+				}
+			})
+		}
+	})
+}
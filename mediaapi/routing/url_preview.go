@@ -0,0 +1,387 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register the GIF decoder for image.DecodeConfig
+	_ "image/jpeg" // Register the JPEG decoder for image.DecodeConfig
+	_ "image/png"  // Register the PNG decoder for image.DecodeConfig
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ike20013/dendrite/external"
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
+	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// How many host names the URL preview client keeps resolved, and for how long.
+const (
+	urlPreviewDNSCacheSize     = 256
+	urlPreviewDNSCacheLifetime = time.Minute * 5
+)
+
+// newURLPreviewClient creates the HTTP client used to fetch pages and images
+// for URL previews. Connections are made through the same allow/deny network
+// checks as federation requests, which apply once the host name has been
+// resolved, so that redirects and DNS tricks can't be used to reach hosts on
+// internal networks.
+func newURLPreviewClient(cfg *config.URLPreviews) *http.Client {
+	// An empty allow list means that everything which isn't denied is allowed.
+	allowNetworks := cfg.AllowNetworkCIDRs
+	if len(allowNetworks) == 0 {
+		allowNetworks = []string{"0.0.0.0/0", "::/0"}
+	}
+	dialer := fclient.NewDNSCache(urlPreviewDNSCacheSize, urlPreviewDNSCacheLifetime, allowNetworks, cfg.DenyNetworkCIDRs)
+	return &http.Client{
+		Timeout: time.Second * 30,
+		Transport: &http.Transport{
+			// No proxy is configured on purpose: requests must be dialled by
+			// us for the network checks above to apply.
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: time.Second * 10,
+			MaxIdleConns:        16,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
+
+// PreviewURL implements GET /preview_url
+// The page is fetched by this server and the OpenGraph metadata found in it is returned to the client.
+// If the page has a preview image, or the URL is an image itself, then the image is stored in the media
+// repository in the same way as an upload, and the client is given its MXC URI instead.
+// Previews are cached for the configured lifetime, so that we don't fetch the same page over and over.
+func PreviewURL(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) util.JSONResponse {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx)
+
+	rawURL := req.URL.Query().Get("url")
+	if rawURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Missing url parameter"),
+		}
+	}
+	pageURL, err := url.Parse(rawURL)
+	if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("url must be an absolute http or https URL"),
+		}
+	}
+	logger = logger.WithField("url", rawURL)
+
+	now := time.Now()
+	cached, err := db.GetURLPreview(ctx, rawURL, spec.AsTimestamp(now))
+	if err != nil {
+		logger.WithError(err).Error("Failed to query the URL preview cache")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if cached != nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: json.RawMessage(cached.Preview),
+		}
+	}
+
+	// Destinations on denied networks fail to connect, so they are reported
+	// as failed fetches like any other unreachable host.
+	preview, err := fetchURLPreview(ctx, pageURL, cfg, dev, db, store, activeFileHashes, client, activeThumbnailGeneration)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to generate URL preview")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown("Failed to fetch URL preview"),
+		}
+	}
+
+	previewJSON, err := json.Marshal(preview)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal URL preview")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if err = db.StoreURLPreview(ctx, &types.URLPreview{
+		URL:               rawURL,
+		Preview:           previewJSON,
+		CreationTimestamp: spec.AsTimestamp(now),
+		ExpiresTimestamp:  spec.AsTimestamp(now.Add(cfg.URLPreviews.CacheLifetime)),
+	}); err != nil {
+		// The preview is still good, we'll just have to generate it again next time.
+		logger.WithError(err).Warn("Failed to cache URL preview")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: json.RawMessage(previewJSON),
+	}
+}
+
+// fetchURLPreview fetches the page at the given URL and builds the preview for it.
+func fetchURLPreview(
+	ctx context.Context,
+	pageURL *url.URL,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) (map[string]interface{}, error) {
+	resp, err := getForURLPreview(ctx, client, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	preview := map[string]interface{}{}
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		err = storeURLPreviewImage(ctx, preview, resp, cfg, dev, db, store, activeFileHashes, activeThumbnailGeneration)
+		if err != nil {
+			return nil, err
+		}
+
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		// Pages larger than the limit are truncated rather than rejected, as
+		// the OpenGraph metadata normally lives near the start of the page.
+		body := io.LimitReader(resp.Body, int64(cfg.URLPreviews.MaxPageSizeBytes))
+		reader, err := charset.NewReader(body, contentType)
+		if err != nil {
+			return nil, fmt.Errorf("charset.NewReader: %w", err)
+		}
+		og := parseOpenGraph(reader)
+		for key, value := range og {
+			// We'll fill in the image properties ourselves once we've fetched
+			// the image, since clients can't fetch it from the page directly.
+			if !strings.HasPrefix(key, "og:image") {
+				preview[key] = value
+			}
+		}
+		if og["og:image"] != "" {
+			fetchURLPreviewPageImage(ctx, preview, resp.Request.URL, og["og:image"], cfg, dev, db, store, activeFileHashes, client, activeThumbnailGeneration)
+		}
+	}
+	return preview, nil
+}
+
+// fetchURLPreviewPageImage fetches the preview image of a page and adds it to the preview.
+// Failing to fetch the image doesn't fail the preview, it will just be left without an image.
+func fetchURLPreviewPageImage(
+	ctx context.Context,
+	preview map[string]interface{},
+	pageURL *url.URL,
+	rawImageURL string,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) {
+	logger := util.GetLogger(ctx).WithField("image_url", rawImageURL)
+	// The image URL may be relative to the page that it was found on.
+	imageURL, err := pageURL.Parse(rawImageURL)
+	if err != nil || (imageURL.Scheme != "http" && imageURL.Scheme != "https") {
+		logger.Debug("Ignoring invalid URL preview image")
+		return
+	}
+	resp, err := getForURLPreview(ctx, client, imageURL)
+	if err != nil {
+		logger.WithError(err).Debug("Failed to fetch URL preview image")
+		return
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if err = storeURLPreviewImage(ctx, preview, resp, cfg, dev, db, store, activeFileHashes, activeThumbnailGeneration); err != nil {
+		logger.WithError(err).Debug("Failed to store URL preview image")
+	}
+}
+
+// storeURLPreviewImage stores the image in the response body in the media repository, as if it
+// had been uploaded by the user that requested the preview, and adds it to the preview.
+func storeURLPreviewImage(
+	ctx context.Context,
+	preview map[string]interface{},
+	resp *http.Response,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store mediastore.Store,
+	activeFileHashes *types.ActiveFileHashes,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "image/") {
+		return fmt.Errorf("unexpected content type %q", mediaType)
+	}
+	maxSize := int64(cfg.URLPreviews.MaxPageSizeBytes)
+	if resp.ContentLength > maxSize {
+		return fmt.Errorf("image is too large (%d bytes)", resp.ContentLength)
+	}
+
+	uploadName := path.Base(resp.Request.URL.Path)
+	if uploadName == "/" || uploadName == "." {
+		uploadName = ""
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:      cfg.Matrix.ServerName,
+			ContentType: types.ContentType(mediaType),
+			UploadName:  types.Filename(url.PathEscape(uploadName)),
+			UserID:      types.MatrixUserID(dev.UserID),
+		},
+		Logger: util.GetLogger(ctx).WithField("Origin", cfg.Matrix.ServerName),
+	}
+	// Unlike pages, a truncated image is no use to anyone, so reading past
+	// the limit is an error rather than silently stopping.
+	body := http.MaxBytesReader(nil, resp.Body, maxSize)
+	// The image is fetched by the server rather than uploaded by the user, so
+	// it isn't given to the spam checker.
+	if resErr := r.doUpload(ctx, body, cfg, db, store, activeFileHashes, activeThumbnailGeneration, nil); resErr != nil {
+		return fmt.Errorf("failed to store image: %d %+v", resErr.Code, resErr.JSON)
+	}
+
+	preview["og:image"] = fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	preview["og:image:type"] = mediaType
+	preview["matrix:image:size"] = r.MediaMetadata.FileSizeBytes
+	if imageConfig, err := decodeImageConfig(ctx, store, r.MediaMetadata.Base64Hash); err == nil {
+		preview["og:image:width"] = imageConfig.Width
+		preview["og:image:height"] = imageConfig.Height
+	}
+	return nil
+}
+
+func decodeImageConfig(ctx context.Context, store mediastore.Store, hash types.Base64Hash) (image.Config, error) {
+	fileKey, err := mediastore.FileKey(hash)
+	if err != nil {
+		return image.Config{}, err
+	}
+	file, err := store.Open(ctx, fileKey)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer file.Close() // nolint: errcheck
+	imageConfig, _, err := image.DecodeConfig(file)
+	return imageConfig, err
+}
+
+func getForURLPreview(ctx context.Context, client *http.Client, target *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("Dendrite/%s (URL preview)", external.VersionString()))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// parseOpenGraph extracts the OpenGraph properties from an HTML page. The page
+// title and description are used if the page doesn't give OpenGraph ones.
+// See https://ogp.me/
+func parseOpenGraph(r io.Reader) map[string]string {
+	og := map[string]string{}
+	var title, description string
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// Either the end of the page or something we can't parse, so
+			// use whatever we've found so far.
+			if _, ok := og["og:title"]; !ok && title != "" {
+				og["og:title"] = title
+			}
+			if _, ok := og["og:description"]; !ok && description != "" {
+				og["og:description"] = description
+			}
+			return og
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.Title:
+				inTitle = title == ""
+			case atom.Meta:
+				var property, name, content string
+				for _, attr := range token.Attr {
+					switch strings.ToLower(attr.Key) {
+					case "property":
+						property = attr.Val
+					case "name":
+						name = attr.Val
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				// Some pages wrongly use name instead of property for OpenGraph tags.
+				if property == "" && strings.HasPrefix(name, "og:") {
+					property = name
+				}
+				if strings.HasPrefix(property, "og:") {
+					if _, ok := og[property]; !ok && content != "" {
+						og[property] = content
+					}
+				} else if strings.EqualFold(name, "description") && description == "" {
+					description = content
+				}
+			}
+
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); atom.Lookup(name) == atom.Title && inTitle {
+				inTitle = false
+				title = strings.TrimSpace(title)
+			}
+		}
+	}
+}
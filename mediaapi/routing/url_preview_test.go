@@ -0,0 +1,223 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/mediaapi/storage"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/test"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseOpenGraph(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want map[string]string
+	}{
+		{
+			name: "opengraph properties",
+			page: `<html><head>
+				<title>Ignored title</title>
+				<meta property="og:title" content="OpenGraph title">
+				<meta property="og:description" content="OpenGraph description" />
+				<meta property="og:image" content="/image.png">
+				<meta name="description" content="Ignored description">
+			</head><body></body></html>`,
+			want: map[string]string{
+				"og:title":       "OpenGraph title",
+				"og:description": "OpenGraph description",
+				"og:image":       "/image.png",
+			},
+		},
+		{
+			name: "falls back to title and description",
+			page: `<html><head>
+				<title> Page &amp; title </title>
+				<meta name="description" content="Page description">
+			</head><body><title>Not the title</title></body></html>`,
+			want: map[string]string{
+				"og:title":       "Page & title",
+				"og:description": "Page description",
+			},
+		},
+		{
+			name: "opengraph in name attribute",
+			page: `<meta name="og:title" content="Named title"><meta property="og:title" content="Second title">`,
+			want: map[string]string{
+				"og:title": "Named title",
+			},
+		},
+		{
+			name: "no metadata",
+			page: `<html><body>Hello world</body></html>`,
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseOpenGraph(strings.NewReader(tt.page)))
+		})
+	}
+}
+
+func TestPreviewURL(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	var imageData bytes.Buffer
+	if err := png.Encode(&imageData, img); err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head>
+			<title>Test page</title>
+			<meta property="og:description" content="A page for testing">
+			<meta property="og:image" content="/image.png">
+			<meta property="og:image:width" content="1000">
+		</head></html>`))
+	})
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(imageData.Bytes())
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := &config.MediaAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "localhost",
+			},
+		},
+		AbsBasePath:      config.Path(t.TempDir()),
+		MaxFileSizeBytes: config.DefaultMaxFileSizeBytes,
+	}
+	cfg.URLPreviews.Defaults()
+	cfg.URLPreviews.Enabled = true
+
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:?cache=shared",
+		MaxOpenConnections:     100,
+		MaxIdleConnections:     2,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("error opening mediaapi database: %v", err)
+	}
+
+	store := test.NewInMemoryMediaStore()
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+	activeFileHashes := &types.ActiveFileHashes{
+		HashToLock: map[types.Base64Hash]*types.FileHashLock{},
+	}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	previewURL := func(client *http.Client, target string) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/preview_url?url="+url.QueryEscape(target), nil)
+		res := PreviewURL(req, cfg, dev, db, store, activeFileHashes, client, activeThumbnailGeneration)
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %v", err)
+		}
+		preview := map[string]interface{}{}
+		if err = json.Unmarshal(body, &preview); err != nil {
+			t.Fatalf("failed to unmarshal response %s: %v", body, err)
+		}
+		return res.Code, preview
+	}
+
+	t.Run("loopback addresses are denied by default", func(t *testing.T) {
+		code, _ := previewURL(newURLPreviewClient(&cfg.URLPreviews), srv.URL+"/page")
+		assert.Equal(t, http.StatusBadGateway, code)
+	})
+
+	t.Run("denied networks are denied with an empty allow list", func(t *testing.T) {
+		code, _ := previewURL(newURLPreviewClient(&config.URLPreviews{
+			DenyNetworkCIDRs: []string{"127.0.0.0/8"},
+		}), srv.URL+"/page")
+		assert.Equal(t, http.StatusBadGateway, code)
+	})
+
+	// An empty allow list allows everything that isn't denied, so the test
+	// server can be reached from here on.
+	client := newURLPreviewClient(&config.URLPreviews{
+		DenyNetworkCIDRs: []string{"10.0.0.0/8"},
+	})
+
+	t.Run("invalid urls are rejected", func(t *testing.T) {
+		for _, target := range []string{"", "/page", "ftp://localhost/page"} {
+			code, _ := previewURL(client, target)
+			assert.Equal(t, http.StatusBadRequest, code, target)
+		}
+	})
+
+	t.Run("failed fetches are reported", func(t *testing.T) {
+		code, _ := previewURL(client, srv.URL+"/missing")
+		assert.Equal(t, http.StatusBadGateway, code)
+	})
+
+	t.Run("page preview includes the stored image", func(t *testing.T) {
+		code, preview := previewURL(client, srv.URL+"/page")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "Test page", preview["og:title"])
+		assert.Equal(t, "A page for testing", preview["og:description"])
+		assert.Equal(t, "image/png", preview["og:image:type"])
+		assert.Equal(t, float64(4), preview["og:image:width"])
+		assert.Equal(t, float64(3), preview["og:image:height"])
+		assert.Equal(t, float64(imageData.Len()), preview["matrix:image:size"])
+
+		mxc, _ := preview["og:image"].(string)
+		if !strings.HasPrefix(mxc, "mxc://localhost/") {
+			t.Fatalf("expected og:image to be a local MXC URI, got %q", mxc)
+		}
+		metadata, err := db.GetMediaMetadata(context.Background(), types.MediaID(strings.TrimPrefix(mxc, "mxc://localhost/")), "localhost")
+		if err != nil || metadata == nil {
+			t.Fatalf("expected preview image to be stored, got %+v, %v", metadata, err)
+		}
+		assert.Equal(t, types.ContentType("image/png"), metadata.ContentType)
+		assert.Equal(t, types.MatrixUserID(dev.UserID), metadata.UserID)
+	})
+
+	t.Run("image preview", func(t *testing.T) {
+		code, preview := previewURL(client, srv.URL+"/image.png")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "image/png", preview["og:image:type"])
+		assert.Equal(t, float64(imageData.Len()), preview["matrix:image:size"])
+	})
+
+	t.Run("previews are served from the cache", func(t *testing.T) {
+		_, want := previewURL(client, srv.URL+"/page")
+		srv.Close()
+		code, got := previewURL(client, srv.URL+"/page")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, want, got)
+
+		cached, err := db.GetURLPreview(context.Background(), srv.URL+"/page", spec.AsTimestamp(time.Now()))
+		if err != nil || cached == nil {
+			t.Fatalf("expected preview to be cached, got %+v, %v", cached, err)
+		}
+	})
+}
@@ -16,12 +16,20 @@ import (
 type Database interface {
 	MediaRepository
 	Thumbnails
+	URLPreviews
+	PendingMedia
 }
 
 type MediaRepository interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
+	CountMediaByHash(ctx context.Context, mediaHash types.Base64Hash) (int, error)
+	GetMediaLastAccessedBefore(ctx context.Context, ts spec.Timestamp, localOrigins []spec.ServerName, local bool) ([]*types.MediaMetadata, error)
+	GetMediaByUserID(ctx context.Context, userID types.MatrixUserID, from, limit int) ([]*types.MediaMetadata, error)
+	UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, ts spec.Timestamp) error
+	SetMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool) error
+	DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) error
 }
 
 type Thumbnails interface {
@@ -29,3 +37,13 @@ type Thumbnails interface {
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) ([]*types.ThumbnailMetadata, error)
 }
+
+type URLPreviews interface {
+	StoreURLPreview(ctx context.Context, preview *types.URLPreview) error
+	GetURLPreview(ctx context.Context, url string, ts spec.Timestamp) (*types.URLPreview, error)
+}
+
+type PendingMedia interface {
+	StorePendingMedia(ctx context.Context, pending *types.PendingMedia, maxPerUser int) (bool, error)
+	GetPendingMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.PendingMedia, error)
+}
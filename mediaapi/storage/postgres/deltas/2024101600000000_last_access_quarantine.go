@@ -0,0 +1,26 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddLastAccessAndQuarantine adds the columns needed for media retention and
+// quarantine. Existing media is treated as last accessed when it was created.
+func UpAddLastAccessAndQuarantine(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE mediaapi_media_repository ADD COLUMN IF NOT EXISTS last_access_ts BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE mediaapi_media_repository ADD COLUMN IF NOT EXISTS quarantined BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE mediaapi_media_repository SET last_access_ts = creation_ts WHERE last_access_ts = 0;
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_last_access_ts_idx ON mediaapi_media_repository (last_access_ts);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -12,9 +12,12 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/ike20013/dendrite/external"
 	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/mediaapi/storage/postgres/deltas"
 	"github.com/ike20013/dendrite/mediaapi/storage/tables"
 	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/lib/pq"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
@@ -39,28 +42,66 @@ CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
     -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
     base64hash TEXT NOT NULL,
     -- The user who uploaded the file. Should be a Matrix user ID.
-    user_id TEXT NOT NULL
+    user_id TEXT NOT NULL,
+    -- When the media was last downloaded in UNIX epoch ms.
+    last_access_ts BIGINT NOT NULL DEFAULT 0,
+    -- Whether a server admin has quarantined the media, so that it can no longer be downloaded.
+    quarantined BOOLEAN NOT NULL DEFAULT FALSE
 );
 CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_repository_index ON mediaapi_media_repository (media_id, media_origin);
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_user_id_idx ON mediaapi_media_repository (user_id);
 `
 
 const insertMediaSQL = `
-INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 `
 
 const selectMediaSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts, quarantined FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
 const selectMediaByHashSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id, last_access_ts, quarantined FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+`
+
+const selectMediaCountByHashSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1
+`
+
+const selectMediaLastAccessedBeforeSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts, quarantined FROM mediaapi_media_repository
+    WHERE last_access_ts < $1 AND (media_origin = ANY($2)) = $3 ORDER BY last_access_ts ASC
+`
+
+const selectMediaByUserIDSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts, quarantined FROM mediaapi_media_repository
+    WHERE user_id = $1 ORDER BY creation_ts DESC, media_id ASC LIMIT $2 OFFSET $3
+`
+
+const updateMediaLastAccessSQL = `
+UPDATE mediaapi_media_repository SET last_access_ts = $3 WHERE media_id = $1 AND media_origin = $2
+`
+
+const updateMediaQuarantinedSQL = `
+UPDATE mediaapi_media_repository SET quarantined = $3 WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
 type mediaStatements struct {
 	insertMediaStmt       *sql.Stmt
 	selectMediaStmt       *sql.Stmt
 	selectMediaByHashStmt *sql.Stmt
+
+	selectMediaCountByHashStmt        *sql.Stmt
+	selectMediaLastAccessedBeforeStmt *sql.Stmt
+	selectMediaByUserIDStmt           *sql.Stmt
+	updateMediaLastAccessStmt         *sql.Stmt
+	updateMediaQuarantinedStmt        *sql.Stmt
+	deleteMediaStmt                   *sql.Stmt
 }
 
 func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error) {
@@ -69,11 +110,25 @@ func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error)
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "mediaapi: add last access and quarantine columns",
+		Up:      deltas.UpAddLastAccessAndQuarantine,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 
 	return s, sqlutil.StatementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.selectMediaCountByHashStmt, selectMediaCountByHashSQL},
+		{&s.selectMediaLastAccessedBeforeStmt, selectMediaLastAccessedBeforeSQL},
+		{&s.selectMediaByUserIDStmt, selectMediaByUserIDSQL},
+		{&s.updateMediaLastAccessStmt, updateMediaLastAccessSQL},
+		{&s.updateMediaQuarantinedStmt, updateMediaQuarantinedSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
 	}.Prepare(db)
 }
 
@@ -81,6 +136,7 @@ func (s *mediaStatements) InsertMedia(
 	ctx context.Context, txn *sql.Tx, mediaMetadata *types.MediaMetadata,
 ) error {
 	mediaMetadata.CreationTimestamp = spec.AsTimestamp(time.Now())
+	mediaMetadata.LastAccessTimestamp = mediaMetadata.CreationTimestamp
 	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertMediaStmt).ExecContext(
 		ctx,
 		mediaMetadata.MediaID,
@@ -91,6 +147,7 @@ func (s *mediaStatements) InsertMedia(
 		mediaMetadata.UploadName,
 		mediaMetadata.Base64Hash,
 		mediaMetadata.UserID,
+		mediaMetadata.LastAccessTimestamp,
 	)
 	return err
 }
@@ -111,6 +168,8 @@ func (s *mediaStatements) SelectMedia(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.Base64Hash,
 		&mediaMetadata.UserID,
+		&mediaMetadata.LastAccessTimestamp,
+		&mediaMetadata.Quarantined,
 	)
 	return &mediaMetadata, err
 }
@@ -131,6 +190,93 @@ func (s *mediaStatements) SelectMediaByHash(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.MediaID,
 		&mediaMetadata.UserID,
+		&mediaMetadata.LastAccessTimestamp,
+		&mediaMetadata.Quarantined,
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) SelectMediaCountByHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (count int, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectMediaCountByHashStmt).QueryRowContext(
+		ctx, mediaHash,
+	).Scan(&count)
+	return
+}
+
+func (s *mediaStatements) SelectMediaLastAccessedBefore(
+	ctx context.Context, txn *sql.Tx, ts spec.Timestamp, localOrigins []spec.ServerName, local bool,
+) ([]*types.MediaMetadata, error) {
+	origins := make([]string, 0, len(localOrigins))
+	for _, origin := range localOrigins {
+		origins = append(origins, string(origin))
+	}
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectMediaLastAccessedBeforeStmt).QueryContext(ctx, ts, pq.StringArray(origins), local)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "selectMediaLastAccessedBefore: rows.close() failed")
+	return scanMediaMetadata(rows)
+}
+
+func (s *mediaStatements) SelectMediaByUserID(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, from, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectMediaByUserIDStmt).QueryContext(ctx, userID, limit, from)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "selectMediaByUserID: rows.close() failed")
+	return scanMediaMetadata(rows)
+}
+
+func scanMediaMetadata(rows *sql.Rows) ([]*types.MediaMetadata, error) {
+	var result []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		if err := rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+			&mediaMetadata.LastAccessTimestamp,
+			&mediaMetadata.Quarantined,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, &mediaMetadata)
+	}
+	return result, rows.Err()
+}
+
+func (s *mediaStatements) UpdateMediaLastAccess(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, ts spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.updateMediaLastAccessStmt).ExecContext(
+		ctx, mediaID, mediaOrigin, ts,
+	)
+	return err
+}
+
+func (s *mediaStatements) UpdateMediaQuarantined(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.updateMediaQuarantinedStmt).ExecContext(
+		ctx, mediaID, mediaOrigin, quarantined,
+	)
+	return err
+}
+
+func (s *mediaStatements) DeleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteMediaStmt).ExecContext(
+		ctx, mediaID, mediaOrigin,
+	)
+	return err
+}
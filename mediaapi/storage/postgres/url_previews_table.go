@@ -0,0 +1,90 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/mediaapi/storage/tables"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const urlPreviewsSchema = `
+-- The mediaapi_url_previews table caches the previews generated for URLs requested
+-- through /preview_url, so that we don't fetch the same page over and over again.
+CREATE TABLE IF NOT EXISTS mediaapi_url_previews (
+    -- The URL that was previewed.
+    url TEXT NOT NULL PRIMARY KEY,
+    -- The JSON-encoded OpenGraph data returned to clients.
+    preview_json TEXT NOT NULL,
+    -- When the preview was generated in UNIX epoch ms.
+    creation_ts BIGINT NOT NULL,
+    -- When the preview should be regenerated in UNIX epoch ms.
+    expires_ts BIGINT NOT NULL
+);
+`
+
+const upsertURLPreviewSQL = `
+INSERT INTO mediaapi_url_previews (url, preview_json, creation_ts, expires_ts)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (url) DO UPDATE SET preview_json = $2, creation_ts = $3, expires_ts = $4
+`
+
+const selectURLPreviewSQL = `
+SELECT preview_json, creation_ts, expires_ts FROM mediaapi_url_previews WHERE url = $1 AND expires_ts > $2
+`
+
+type urlPreviewsStatements struct {
+	upsertURLPreviewStmt *sql.Stmt
+	selectURLPreviewStmt *sql.Stmt
+}
+
+func NewPostgresURLPreviewsTable(db *sql.DB) (tables.URLPreviews, error) {
+	s := &urlPreviewsStatements{}
+	_, err := db.Exec(urlPreviewsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertURLPreviewStmt, upsertURLPreviewSQL},
+		{&s.selectURLPreviewStmt, selectURLPreviewSQL},
+	}.Prepare(db)
+}
+
+func (s *urlPreviewsStatements) UpsertURLPreview(
+	ctx context.Context, txn *sql.Tx, preview *types.URLPreview,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.upsertURLPreviewStmt).ExecContext(
+		ctx,
+		preview.URL,
+		string(preview.Preview),
+		preview.CreationTimestamp,
+		preview.ExpiresTimestamp,
+	)
+	return err
+}
+
+func (s *urlPreviewsStatements) SelectURLPreview(
+	ctx context.Context, txn *sql.Tx, url string, ts spec.Timestamp,
+) (*types.URLPreview, error) {
+	preview := types.URLPreview{
+		URL: url,
+	}
+	var previewJSON string
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectURLPreviewStmt).QueryRowContext(
+		ctx, url, ts,
+	).Scan(
+		&previewJSON,
+		&preview.CreationTimestamp,
+		&preview.ExpiresTimestamp,
+	)
+	preview.Preview = []byte(previewJSON)
+	return &preview, err
+}
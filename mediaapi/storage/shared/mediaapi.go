@@ -22,13 +22,19 @@ type Database struct {
 	Writer          sqlutil.Writer
 	MediaRepository tables.MediaRepository
 	Thumbnails      tables.Thumbnails
+	URLPreviews     tables.URLPreviews
+	PendingMedia    tables.PendingMedia
 }
 
 // StoreMediaMetadata inserts the metadata about the uploaded media into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
+// If the media ID was created for an upload later on, it is no longer pending afterwards.
 func (d *Database) StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata)
+		if err := d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata); err != nil {
+			return err
+		}
+		return d.PendingMedia.DeletePendingMedia(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin)
 	})
 }
 
@@ -54,6 +60,47 @@ func (d *Database) GetMediaMetadataByHash(ctx context.Context, mediaHash types.B
 	return mediaMetadata, err
 }
 
+// CountMediaByHash returns how many media entries, from any origin, refer to the file with the given hash.
+func (d *Database) CountMediaByHash(ctx context.Context, mediaHash types.Base64Hash) (int, error) {
+	return d.MediaRepository.SelectMediaCountByHash(ctx, nil, mediaHash)
+}
+
+// GetMediaLastAccessedBefore returns metadata about either the local or the remote media that hasn't been
+// downloaded since the given time. Media is local if its origin is one of localOrigins.
+func (d *Database) GetMediaLastAccessedBefore(ctx context.Context, ts spec.Timestamp, localOrigins []spec.ServerName, local bool) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectMediaLastAccessedBefore(ctx, nil, ts, localOrigins, local)
+}
+
+// GetMediaByUserID returns metadata about the media uploaded by the given user, newest first.
+func (d *Database) GetMediaByUserID(ctx context.Context, userID types.MatrixUserID, from, limit int) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectMediaByUserID(ctx, nil, userID, from, limit)
+}
+
+// UpdateMediaLastAccess records that the media was downloaded at the given time.
+func (d *Database) UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, ts spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.MediaRepository.UpdateMediaLastAccess(ctx, txn, mediaID, mediaOrigin, ts)
+	})
+}
+
+// SetMediaQuarantined quarantines the media, or lifts the quarantine from it.
+func (d *Database) SetMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.MediaRepository.UpdateMediaQuarantined(ctx, txn, mediaID, mediaOrigin, quarantined)
+	})
+}
+
+// DeleteMedia removes the metadata about the media and all of its thumbnails from the database.
+// The files themselves are left alone, as other media may refer to the same file.
+func (d *Database) DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.Thumbnails.DeleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		return d.MediaRepository.DeleteMedia(ctx, txn, mediaID, mediaOrigin)
+	})
+}
+
 // StoreThumbnail inserts the metadata about the thumbnail into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d *Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
@@ -83,3 +130,56 @@ func (d *Database) GetThumbnails(ctx context.Context, mediaID types.MediaID, med
 	}
 	return metadatas, err
 }
+
+// StoreURLPreview caches a preview of a URL, replacing any earlier preview of the same URL.
+func (d *Database) StoreURLPreview(ctx context.Context, preview *types.URLPreview) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.URLPreviews.UpsertURLPreview(ctx, txn, preview)
+	})
+}
+
+// GetURLPreview returns the cached preview of a URL, if it has not expired by the given time.
+// Returns nil if there is no such preview.
+func (d *Database) GetURLPreview(ctx context.Context, url string, ts spec.Timestamp) (*types.URLPreview, error) {
+	preview, err := d.URLPreviews.SelectURLPreview(ctx, nil, url, ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return preview, err
+}
+
+// StorePendingMedia records a media ID whose content will be uploaded later on, removing
+// any expired media IDs first. If maxPerUser is greater than 0 and the user already has
+// that many unexpired media IDs waiting for uploads, nothing is stored and false is returned.
+func (d *Database) StorePendingMedia(ctx context.Context, pending *types.PendingMedia, maxPerUser int) (stored bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.PendingMedia.DeletePendingMediaExpiredBefore(ctx, txn, pending.CreationTimestamp); err != nil {
+			return err
+		}
+		if maxPerUser > 0 {
+			count, err := d.PendingMedia.SelectPendingMediaCountByUser(ctx, txn, pending.UserID, pending.CreationTimestamp)
+			if err != nil {
+				return err
+			}
+			if count >= maxPerUser {
+				return nil
+			}
+		}
+		if err := d.PendingMedia.InsertPendingMedia(ctx, txn, pending); err != nil {
+			return err
+		}
+		stored = true
+		return nil
+	})
+	return
+}
+
+// GetPendingMedia returns the media ID if it is waiting for its content to be uploaded,
+// even if it has expired. Returns nil if there is no such media ID.
+func (d *Database) GetPendingMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.PendingMedia, error) {
+	pending, err := d.PendingMedia.SelectPendingMedia(ctx, nil, mediaID, mediaOrigin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return pending, err
+}
@@ -28,9 +28,19 @@ func NewDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOptio
 	if err != nil {
 		return nil, err
 	}
+	urlPreviews, err := NewSQLiteURLPreviewsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	pendingMedia, err := NewSQLitePendingMediaTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
 		MediaRepository: mediaRepo,
 		Thumbnails:      thumbnails,
+		URLPreviews:     urlPreviews,
+		PendingMedia:    pendingMedia,
 		DB:              db,
 		Writer:          writer,
 	}, nil
@@ -0,0 +1,129 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/mediaapi/storage/tables"
+	"github.com/ike20013/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const pendingMediaSchema = `
+-- The mediaapi_pending_media table holds the media IDs which have been created
+-- through /create, but whose content hasn't been uploaded yet.
+CREATE TABLE IF NOT EXISTS mediaapi_pending_media (
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    creation_ts INTEGER NOT NULL,
+    expires_ts INTEGER NOT NULL,
+    PRIMARY KEY (media_id, media_origin)
+);
+CREATE INDEX IF NOT EXISTS mediaapi_pending_media_user_id_idx ON mediaapi_pending_media (user_id, expires_ts);
+`
+
+const insertPendingMediaSQL = `
+INSERT INTO mediaapi_pending_media (media_id, media_origin, user_id, creation_ts, expires_ts)
+    VALUES ($1, $2, $3, $4, $5)
+`
+
+const selectPendingMediaSQL = `
+SELECT user_id, creation_ts, expires_ts FROM mediaapi_pending_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectPendingMediaCountByUserSQL = `
+SELECT COUNT(*) FROM mediaapi_pending_media WHERE user_id = $1 AND expires_ts > $2
+`
+
+const deletePendingMediaSQL = `
+DELETE FROM mediaapi_pending_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const deletePendingMediaExpiredBeforeSQL = `
+DELETE FROM mediaapi_pending_media WHERE expires_ts <= $1
+`
+
+type pendingMediaStatements struct {
+	insertPendingMediaStmt              *sql.Stmt
+	selectPendingMediaStmt              *sql.Stmt
+	selectPendingMediaCountByUserStmt   *sql.Stmt
+	deletePendingMediaStmt              *sql.Stmt
+	deletePendingMediaExpiredBeforeStmt *sql.Stmt
+}
+
+func NewSQLitePendingMediaTable(db *sql.DB) (tables.PendingMedia, error) {
+	s := &pendingMediaStatements{}
+	_, err := db.Exec(pendingMediaSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertPendingMediaStmt, insertPendingMediaSQL},
+		{&s.selectPendingMediaStmt, selectPendingMediaSQL},
+		{&s.selectPendingMediaCountByUserStmt, selectPendingMediaCountByUserSQL},
+		{&s.deletePendingMediaStmt, deletePendingMediaSQL},
+		{&s.deletePendingMediaExpiredBeforeStmt, deletePendingMediaExpiredBeforeSQL},
+	}.Prepare(db)
+}
+
+func (s *pendingMediaStatements) InsertPendingMedia(
+	ctx context.Context, txn *sql.Tx, pending *types.PendingMedia,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertPendingMediaStmt).ExecContext(
+		ctx,
+		pending.MediaID,
+		pending.Origin,
+		pending.UserID,
+		pending.CreationTimestamp,
+		pending.ExpiresTimestamp,
+	)
+	return err
+}
+
+func (s *pendingMediaStatements) SelectPendingMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) (*types.PendingMedia, error) {
+	pending := types.PendingMedia{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectPendingMediaStmt).QueryRowContext(
+		ctx, mediaID, mediaOrigin,
+	).Scan(
+		&pending.UserID,
+		&pending.CreationTimestamp,
+		&pending.ExpiresTimestamp,
+	)
+	return &pending, err
+}
+
+func (s *pendingMediaStatements) SelectPendingMediaCountByUser(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, ts spec.Timestamp,
+) (count int, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectPendingMediaCountByUserStmt).QueryRowContext(
+		ctx, userID, ts,
+	).Scan(&count)
+	return
+}
+
+func (s *pendingMediaStatements) DeletePendingMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deletePendingMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *pendingMediaStatements) DeletePendingMediaExpiredBefore(
+	ctx context.Context, txn *sql.Tx, ts spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deletePendingMediaExpiredBeforeStmt).ExecContext(ctx, ts)
+	return err
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/ike20013/dendrite/mediaapi/types"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
@@ -143,3 +144,251 @@ func TestThumbnailsStorage(t *testing.T) {
 		})
 	})
 }
+
+func TestURLPreviewsStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("can insert, replace & query url previews", func(t *testing.T) {
+			preview := &types.URLPreview{
+				URL:               "https://example.com/",
+				Preview:           []byte(`{"og:title":"Example"}`),
+				CreationTimestamp: 1000,
+				ExpiresTimestamp:  2000,
+			}
+			if err := db.StoreURLPreview(ctx, preview); err != nil {
+				t.Fatalf("unable to store url preview: %v", err)
+			}
+			gotPreview, err := db.GetURLPreview(ctx, preview.URL, 1500)
+			if err != nil {
+				t.Fatalf("unable to query url preview: %v", err)
+			}
+			if !reflect.DeepEqual(preview, gotPreview) {
+				t.Fatalf("expected preview %+v, got %+v", preview, gotPreview)
+			}
+			// expired previews must not be returned
+			gotPreview, err = db.GetURLPreview(ctx, preview.URL, 2000)
+			if err != nil {
+				t.Fatalf("unable to query url preview: %v", err)
+			}
+			if gotPreview != nil {
+				t.Fatalf("expected no preview after expiry, got %+v", gotPreview)
+			}
+			// refreshing the preview replaces the old one
+			preview.Preview = []byte(`{"og:title":"Example 2"}`)
+			preview.CreationTimestamp = 2500
+			preview.ExpiresTimestamp = 3000
+			if err = db.StoreURLPreview(ctx, preview); err != nil {
+				t.Fatalf("unable to replace url preview: %v", err)
+			}
+			gotPreview, err = db.GetURLPreview(ctx, preview.URL, 2500)
+			if err != nil {
+				t.Fatalf("unable to query url preview: %v", err)
+			}
+			if !reflect.DeepEqual(preview, gotPreview) {
+				t.Fatalf("expected preview %+v, got %+v", preview, gotPreview)
+			}
+		})
+	})
+}
+
+func TestMediaRetentionStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		media := []*types.MediaMetadata{
+			{MediaID: "first", Origin: "localhost", Base64Hash: "c2hhcmVk", UserID: "@alice:localhost"},
+			{MediaID: "second", Origin: "remote", Base64Hash: "c2hhcmVk"},
+			{MediaID: "third", Origin: "localhost", Base64Hash: "dW5pcXVl", UserID: "@alice:localhost"},
+		}
+		for _, metadata := range media {
+			if err := db.StoreMediaMetadata(ctx, metadata); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+		}
+
+		t.Run("can count media by hash", func(t *testing.T) {
+			count, err := db.CountMediaByHash(ctx, "c2hhcmVk")
+			if err != nil {
+				t.Fatalf("unable to count media: %v", err)
+			}
+			if count != 2 {
+				t.Fatalf("expected 2 media with the same hash, got %d", count)
+			}
+		})
+
+		t.Run("can update last access time", func(t *testing.T) {
+			if err := db.UpdateMediaLastAccess(ctx, "first", "localhost", 1); err != nil {
+				t.Fatalf("unable to update last access: %v", err)
+			}
+			if err := db.UpdateMediaLastAccess(ctx, "second", "remote", 1); err != nil {
+				t.Fatalf("unable to update last access: %v", err)
+			}
+			localOrigins := []spec.ServerName{"localhost", "other.localhost"}
+			got, err := db.GetMediaLastAccessedBefore(ctx, 2, localOrigins, true)
+			if err != nil {
+				t.Fatalf("unable to query media by last access: %v", err)
+			}
+			if len(got) != 1 || got[0].MediaID != "first" || got[0].LastAccessTimestamp != 1 {
+				t.Fatalf("expected only the first media to be returned, got %+v", got)
+			}
+			got, err = db.GetMediaLastAccessedBefore(ctx, 2, localOrigins, false)
+			if err != nil {
+				t.Fatalf("unable to query media by last access: %v", err)
+			}
+			if len(got) != 1 || got[0].MediaID != "second" {
+				t.Fatalf("expected only the second media to be returned, got %+v", got)
+			}
+		})
+
+		t.Run("can quarantine media", func(t *testing.T) {
+			if err := db.SetMediaQuarantined(ctx, "second", "remote", true); err != nil {
+				t.Fatalf("unable to quarantine media: %v", err)
+			}
+			got, err := db.GetMediaMetadata(ctx, "second", "remote")
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if !got.Quarantined {
+				t.Fatalf("expected media to be quarantined")
+			}
+			if err = db.SetMediaQuarantined(ctx, "second", "remote", false); err != nil {
+				t.Fatalf("unable to lift quarantine: %v", err)
+			}
+			got, err = db.GetMediaMetadata(ctx, "second", "remote")
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if got.Quarantined {
+				t.Fatalf("expected media not to be quarantined")
+			}
+		})
+
+		t.Run("can list media by user", func(t *testing.T) {
+			got, err := db.GetMediaByUserID(ctx, "@alice:localhost", 0, 10)
+			if err != nil {
+				t.Fatalf("unable to query media by user: %v", err)
+			}
+			if len(got) != 2 {
+				t.Fatalf("expected 2 media for user, got %d", len(got))
+			}
+			got, err = db.GetMediaByUserID(ctx, "@alice:localhost", 1, 10)
+			if err != nil {
+				t.Fatalf("unable to query media by user: %v", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 media for user after offset, got %d", len(got))
+			}
+		})
+
+		t.Run("can delete media and thumbnails", func(t *testing.T) {
+			thumbnail := &types.ThumbnailMetadata{
+				MediaMetadata: &types.MediaMetadata{MediaID: "first", Origin: "localhost", ContentType: "image/png"},
+				ThumbnailSize: types.ThumbnailSize{Width: 1, Height: 1, ResizeMethod: types.Scale},
+			}
+			if err := db.StoreThumbnail(ctx, thumbnail); err != nil {
+				t.Fatalf("unable to store thumbnail: %v", err)
+			}
+			if err := db.DeleteMedia(ctx, "first", "localhost"); err != nil {
+				t.Fatalf("unable to delete media: %v", err)
+			}
+			got, err := db.GetMediaMetadata(ctx, "first", "localhost")
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if got != nil {
+				t.Fatalf("expected media to be deleted, got %+v", got)
+			}
+			thumbnails, err := db.GetThumbnails(ctx, "first", "localhost")
+			if err != nil {
+				t.Fatalf("unable to query thumbnails: %v", err)
+			}
+			if len(thumbnails) != 0 {
+				t.Fatalf("expected thumbnails to be deleted, got %d", len(thumbnails))
+			}
+			count, err := db.CountMediaByHash(ctx, "c2hhcmVk")
+			if err != nil {
+				t.Fatalf("unable to count media: %v", err)
+			}
+			if count != 1 {
+				t.Fatalf("expected 1 media with the same hash, got %d", count)
+			}
+		})
+	})
+}
+
+func TestPendingMediaStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		pending := func(mediaID types.MediaID, creationTS, expiresTS spec.Timestamp) *types.PendingMedia {
+			return &types.PendingMedia{
+				MediaID:           mediaID,
+				Origin:            "localhost",
+				UserID:            "@alice:localhost",
+				CreationTimestamp: creationTS,
+				ExpiresTimestamp:  expiresTS,
+			}
+		}
+
+		t.Run("can store and query pending media", func(t *testing.T) {
+			want := pending("first", 1000, 2000)
+			stored, err := db.StorePendingMedia(ctx, want, 2)
+			if err != nil {
+				t.Fatalf("unable to store pending media: %v", err)
+			}
+			if !stored {
+				t.Fatalf("expected pending media to be stored")
+			}
+			got, err := db.GetPendingMedia(ctx, "first", "localhost")
+			if err != nil {
+				t.Fatalf("unable to query pending media: %v", err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("expected pending media %+v, got %+v", want, got)
+			}
+		})
+
+		t.Run("enforces the limit per user", func(t *testing.T) {
+			stored, err := db.StorePendingMedia(ctx, pending("second", 1500, 2500), 2)
+			if err != nil || !stored {
+				t.Fatalf("expected pending media to be stored: %v", err)
+			}
+			stored, err = db.StorePendingMedia(ctx, pending("third", 1500, 2500), 2)
+			if err != nil {
+				t.Fatalf("unable to store pending media: %v", err)
+			}
+			if stored {
+				t.Fatalf("expected pending media over the limit not to be stored")
+			}
+			// Once the first media ID expires, there is room for another one.
+			stored, err = db.StorePendingMedia(ctx, pending("third", 2000, 3000), 2)
+			if err != nil || !stored {
+				t.Fatalf("expected pending media to be stored after expiry: %v", err)
+			}
+			if got, _ := db.GetPendingMedia(ctx, "first", "localhost"); got != nil {
+				t.Fatalf("expected expired pending media to be removed")
+			}
+		})
+
+		t.Run("storing media completes pending media", func(t *testing.T) {
+			err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+				MediaID:    "second",
+				Origin:     "localhost",
+				Base64Hash: "c2Vjb25k",
+				UserID:     "@alice:localhost",
+			})
+			if err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+			if got, _ := db.GetPendingMedia(ctx, "second", "localhost"); got != nil {
+				t.Fatalf("expected uploaded media to no longer be pending")
+			}
+		})
+	})
+}
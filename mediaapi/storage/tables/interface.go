@@ -26,6 +26,7 @@ type Thumbnails interface {
 		ctx context.Context, txn *sql.Tx, mediaID types.MediaID,
 		mediaOrigin spec.ServerName,
 	) ([]*types.ThumbnailMetadata, error)
+	DeleteThumbnails(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
 }
 
 type MediaRepository interface {
@@ -35,4 +36,23 @@ type MediaRepository interface {
 		ctx context.Context, txn *sql.Tx,
 		mediaHash types.Base64Hash, mediaOrigin spec.ServerName,
 	) (*types.MediaMetadata, error)
+	SelectMediaCountByHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (int, error)
+	SelectMediaLastAccessedBefore(ctx context.Context, txn *sql.Tx, ts spec.Timestamp, localOrigins []spec.ServerName, local bool) ([]*types.MediaMetadata, error)
+	SelectMediaByUserID(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, from, limit int) ([]*types.MediaMetadata, error)
+	UpdateMediaLastAccess(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, ts spec.Timestamp) error
+	UpdateMediaQuarantined(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool) error
+	DeleteMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+}
+
+type URLPreviews interface {
+	UpsertURLPreview(ctx context.Context, txn *sql.Tx, preview *types.URLPreview) error
+	SelectURLPreview(ctx context.Context, txn *sql.Tx, url string, ts spec.Timestamp) (*types.URLPreview, error)
+}
+
+type PendingMedia interface {
+	InsertPendingMedia(ctx context.Context, txn *sql.Tx, pending *types.PendingMedia) error
+	SelectPendingMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.PendingMedia, error)
+	SelectPendingMediaCountByUser(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, ts spec.Timestamp) (int, error)
+	DeletePendingMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	DeletePendingMediaExpiredBefore(ctx context.Context, txn *sql.Tx, ts spec.Timestamp) error
 }
@@ -8,14 +8,13 @@ package thumbnailer
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"math"
-	"os"
-	"path/filepath"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
 	"github.com/ike20013/dendrite/mediaapi/storage"
 	"github.com/ike20013/dendrite/mediaapi/types"
 	"github.com/ike20013/dendrite/setup/config"
@@ -29,18 +28,6 @@ type thumbnailFitness struct {
 	fileSize       types.FileSizeBytes
 }
 
-// thumbnailTemplate is the filename template for thumbnails
-const thumbnailTemplate = "thumbnail-%vx%v-%v"
-
-// GetThumbnailPath returns the path to a thumbnail given the absolute src path and thumbnail size configuration
-func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
-	srcDir := filepath.Dir(string(src))
-	return types.Path(filepath.Join(
-		srcDir,
-		fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod),
-	))
-}
-
 // SelectThumbnail compares the (potentially) available thumbnails with the desired thumbnail and returns the best match
 // The algorithm is very similar to what was implemented in Synapse
 // In order of priority unless absolute, the following metrics are compared; the image is:
@@ -82,11 +69,11 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 }
 
 // getActiveThumbnailGeneration checks for active thumbnail generation
-func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
+func getActiveThumbnailGeneration(dst string, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
 	// Check if there is active thumbnail generation.
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
+	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[dst]; ok {
 		logger.Debugf("Waiting for another goroutine to generate the thumbnail %q", dst)
 
 		// NOTE: Wait unlocks and locks again internally. There is still a deferred Unlock() that will unlock this.
@@ -103,7 +90,7 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 	}
 
 	// No active thumbnail generation so create one
-	activeThumbnailGeneration.PathToResult[string(dst)] = &types.ThumbnailGenerationResult{
+	activeThumbnailGeneration.PathToResult[dst] = &types.ThumbnailGenerationResult{
 		Cond: &sync.Cond{L: activeThumbnailGeneration},
 	}
 
@@ -112,21 +99,22 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 
 // broadcastGeneration broadcasts that thumbnail generation completed and the error to all waiting goroutines
 // Note: This should only be called by the owner of the activeThumbnailGenerationResult
-func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
+func broadcastGeneration(dst string, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
+	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[dst]; ok {
 		logger.Debugf("Signalling other goroutines waiting for this goroutine to generate the thumbnail %q", dst)
 		// Note: errorReturn is a named return value error that is signalled from here to waiting goroutines
 		activeThumbnailGenerationResult.Err = errorReturn
 		activeThumbnailGenerationResult.Cond.Broadcast()
 	}
-	delete(activeThumbnailGeneration.PathToResult, string(dst))
+	delete(activeThumbnailGeneration.PathToResult, dst)
 }
 
 func isThumbnailExists(
 	ctx context.Context,
-	dst types.Path,
+	store mediastore.Store,
+	dst string,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	db storage.Database,
@@ -143,11 +131,12 @@ func isThumbnailExists(
 	if thumbnailMetadata != nil {
 		return true, nil
 	}
-	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
-	// The functions are error checkers to be used in different cases.
-	if _, err = os.Stat(string(dst)); !os.IsNotExist(err) {
+	if _, err = store.Stat(ctx, dst); err == nil {
 		// Thumbnail exists
 		return true, nil
+	} else if !errors.Is(err, mediastore.ErrNotFound) {
+		logger.Errorf("Failed to query media store for thumbnail %q", dst)
+		return false, err
 	}
 	return false, nil
 }
@@ -7,6 +7,7 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
 	"image"
 	"image/draw"
@@ -17,7 +18,6 @@ import (
 
 	// Imported for png codec
 	_ "image/png"
-	"os"
 	"time"
 
 	// Imported for webp codec
@@ -26,6 +26,7 @@ import (
 	"github.com/nfnt/resize"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
 	"github.com/ike20013/dendrite/mediaapi/storage"
 	"github.com/ike20013/dendrite/mediaapi/types"
 	"github.com/ike20013/dendrite/setup/config"
@@ -34,7 +35,8 @@ import (
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.Store,
+	src string,
 	configs []config.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -42,7 +44,7 @@ func GenerateThumbnails(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	img, err := readFile(ctx, store, src)
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
@@ -50,7 +52,7 @@ func GenerateThumbnails(
 	for _, singleConfig := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
+			ctx, store, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
 		)
 		if err != nil {
@@ -67,7 +69,8 @@ func GenerateThumbnails(
 // GenerateThumbnail generates the configured thumbnail size for the source file
 func GenerateThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.Store,
+	src string,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -75,7 +78,7 @@ func GenerateThumbnail(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	img, err := readFile(ctx, store, src)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -84,7 +87,7 @@ func GenerateThumbnail(
 	}
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
+		ctx, store, src, img, config, mediaMetadata, activeThumbnailGeneration,
 		maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
@@ -99,8 +102,8 @@ func GenerateThumbnail(
 	return false, nil
 }
 
-func readFile(src string) (image.Image, error) {
-	file, err := os.Open(src)
+func readFile(ctx context.Context, store mediastore.Store, src string) (image.Image, error) {
+	file, err := store.Open(ctx, src)
 	if err != nil {
 		return nil, err
 	}
@@ -114,23 +117,22 @@ func readFile(src string) (image.Image, error) {
 	return img, nil
 }
 
-func writeFile(img image.Image, dst string) (err error) {
-	out, err := os.Create(dst)
-	if err != nil {
+func writeFile(ctx context.Context, store mediastore.Store, img image.Image, dst string) error {
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{
+		Quality: 85,
+	}); err != nil {
 		return err
 	}
-	defer (func() { err = out.Close() })()
-
-	return jpeg.Encode(out, img, &jpeg.Options{
-		Quality: 85,
-	})
+	return store.Put(ctx, dst, &out, int64(out.Len()))
 }
 
 // createThumbnail checks if the thumbnail exists, and if not, generates it
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.Store,
+	src string,
 	img image.Image,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
@@ -150,7 +152,7 @@ func createThumbnail(
 		return false, nil
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst := mediastore.ThumbnailKey(src, config)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
 	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
@@ -174,13 +176,13 @@ func createThumbnail(
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, store, dst, config, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	width, height, err := adjustSize(ctx, store, dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
 	if err != nil {
 		return false, err
 	}
@@ -190,7 +192,7 @@ func createThumbnail(
 		"processTime":  time.Since(start),
 	}).Debugf("Generated thumbnail %q", dst)
 
-	stat, err := os.Stat(string(dst))
+	size, err := store.Stat(ctx, dst)
 	if err != nil {
 		return false, err
 	}
@@ -201,7 +203,7 @@ func createThumbnail(
 			Origin:  mediaMetadata.Origin,
 			// Note: the code currently always creates a JPEG thumbnail
 			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			FileSizeBytes: types.FileSizeBytes(size),
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
@@ -225,7 +227,7 @@ func createThumbnail(
 // adjustSize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func adjustSize(ctx context.Context, store mediastore.Store, dst string, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
 	var out image.Image
 	var err error
 	if crop {
@@ -256,7 +258,7 @@ func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *lo
 		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
 	}
 
-	if err = writeFile(out, string(dst)); err != nil {
+	if err = writeFile(ctx, store, out, dst); err != nil {
 		logger.WithError(err).Error("Failed to encode and write image")
 		return -1, -1, err
 	}
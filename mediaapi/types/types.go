@@ -47,6 +47,10 @@ type MediaMetadata struct {
 	UploadName        Filename
 	Base64Hash        Base64Hash
 	UserID            MatrixUserID
+	// When the media was last downloaded, used for enforcing retention
+	LastAccessTimestamp spec.Timestamp
+	// Whether the media was quarantined by a server admin
+	Quarantined bool
 }
 
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
@@ -92,6 +96,60 @@ type ActiveThumbnailGeneration struct {
 	PathToResult map[string]*ThumbnailGenerationResult
 }
 
+// URLPreview is a cached preview of a URL, as returned by /preview_url
+type URLPreview struct {
+	URL string
+	// The JSON-encoded OpenGraph data for the URL
+	Preview []byte
+	// When the preview was generated, in UNIX epoch ms
+	CreationTimestamp spec.Timestamp
+	// When the preview should no longer be served from the cache, in UNIX epoch ms
+	ExpiresTimestamp spec.Timestamp
+}
+
+// PendingMedia is a media ID which was handed out by /create, but whose content
+// hasn't been uploaded yet
+type PendingMedia struct {
+	MediaID MediaID
+	Origin  spec.ServerName
+	// The user who created the media ID, who is the only one allowed to upload to it
+	UserID MatrixUserID
+	// When the media ID was created, in UNIX epoch ms
+	CreationTimestamp spec.Timestamp
+	// When the media ID can no longer be uploaded to, in UNIX epoch ms
+	ExpiresTimestamp spec.Timestamp
+}
+
+// PendingUploadResult is used for telling the downloads waiting on pending media that it was uploaded
+type PendingUploadResult struct {
+	// Closed once the media has been uploaded
+	Done chan struct{}
+	// The number of downloads waiting on the media
+	Waiters int
+}
+
+// ActivePendingUploads is a lockable map of media IDs which downloads are
+// waiting on to be uploaded.
+type ActivePendingUploads struct {
+	sync.Mutex
+	MediaIDToResult map[MediaID]*PendingUploadResult
+}
+
+// FileHashLock is held while a file is stored in or removed from the media store
+type FileHashLock struct {
+	sync.Mutex
+	// The number of routines holding or waiting for the lock
+	Waiters int
+}
+
+// ActiveFileHashes is a lockable map of the hashes of files being stored in or
+// removed from the media store. It is used to ensure a file isn't removed while
+// new media referring to it is stored.
+type ActiveFileHashes struct {
+	sync.Mutex
+	HashToLock map[Base64Hash]*FileHashLock
+}
+
 // Crop indicates we should crop the thumbnail on resize
 const Crop = "crop"
 
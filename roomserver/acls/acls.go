@@ -31,11 +31,17 @@ type ServerACLDatabase interface {
 	GetBulkStateACLs(ctx context.Context, roomIDs []string) ([]tables.StrippedEvent, error)
 }
 
+// ServerBans bans servers from all rooms, on top of the server ACLs of each room.
+type ServerBans interface {
+	IsServerBanned(serverName spec.ServerName) bool
+}
+
 type ServerACLs struct {
 	acls               map[string]*serverACL      // room ID -> ACL
 	aclsMutex          sync.RWMutex               // protects the above
 	aclRegexCache      map[string]**regexp.Regexp // Cache from "serverName" -> pointer to a regex
 	aclRegexCacheMutex sync.RWMutex               // protects the above
+	serverBans         ServerBans
 }
 
 func NewServerACLs(db ServerACLDatabase) *ServerACLs {
@@ -160,7 +166,15 @@ func (s *ServerACLs) OnServerACLUpdate(strippedEvent tables.StrippedEvent) {
 	s.acls[strippedEvent.RoomID] = acls
 }
 
+// SetServerBans makes IsServerBannedFromRoom consult the given bans too.
+func (s *ServerACLs) SetServerBans(serverBans ServerBans) {
+	s.serverBans = serverBans
+}
+
 func (s *ServerACLs) IsServerBannedFromRoom(serverName spec.ServerName, roomID string) bool {
+	if s.serverBans != nil && s.serverBans.IsServerBanned(serverName) {
+		return true
+	}
 	s.aclsMutex.RLock()
 	// First of all check if we have an ACL for this room. If we don't then
 	// no servers are banned from the room.
@@ -142,3 +142,24 @@ func TestCachedRegex(t *testing.T) {
 	banned = acls.IsServerBannedFromRoom("matrix."+wantBannedServer, "2")
 	assert.True(t, banned)
 }
+
+type dummyServerBans map[spec.ServerName]bool
+
+func (d dummyServerBans) IsServerBanned(serverName spec.ServerName) bool {
+	return d[serverName]
+}
+
+func TestServerBans(t *testing.T) {
+	acls := ServerACLs{
+		acls: make(map[string]*serverACL),
+	}
+	acls.SetServerBans(dummyServerBans{"evil.com": true})
+
+	// Server bans apply to rooms without ACLs too.
+	if !acls.IsServerBannedFromRoom("evil.com", "!test:test.com") {
+		t.Fatal("Expected evil.com to be banned but wasn't")
+	}
+	if acls.IsServerBannedFromRoom("good.com", "!test:test.com") {
+		t.Fatal("Expected good.com to be allowed but wasn't")
+	}
+}
@@ -149,6 +149,12 @@ type QueryRoomHierarchyAPI interface {
 	)
 }
 
+type QueryTimestampToEventAPI interface {
+	// QueryTimestampToEvent returns the event in the room which is closest to the timestamp, at or
+	// after it, or at or before it if backwards is true. Returns nil if there is no such event.
+	QueryTimestampToEvent(ctx context.Context, roomID spec.RoomID, ts spec.Timestamp, backwards bool) (*QueryTimestampToEventResponse, error)
+}
+
 type QueryMembershipAPI interface {
 	QueryMembershipForSenderID(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID, res *QueryMembershipForUserResponse) error
 	QueryMembershipForUser(ctx context.Context, req *QueryMembershipForUserRequest, res *QueryMembershipForUserResponse) error
@@ -227,6 +233,7 @@ type ClientRoomserverAPI interface {
 	QuerySenderIDAPI
 	UserRoomPrivateKeyCreator
 	QueryRoomHierarchyAPI
+	QueryTimestampToEventAPI
 	DefaultRoomVersionAPI
 
 	QueryMembershipForUser(ctx context.Context, req *QueryMembershipForUserRequest, res *QueryMembershipForUserResponse) error
@@ -236,6 +243,7 @@ type ClientRoomserverAPI interface {
 	// QueryKnownUsers returns a list of users that we know about from our joined rooms.
 	QueryKnownUsers(ctx context.Context, req *QueryKnownUsersRequest, res *QueryKnownUsersResponse) error
 	QueryRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error)
+	QueryRoomInfo(ctx context.Context, roomID spec.RoomID) (*types.RoomInfo, error)
 	QueryPublishedRooms(ctx context.Context, req *QueryPublishedRoomsRequest, res *QueryPublishedRoomsResponse) error
 
 	GetRoomIDForAlias(ctx context.Context, req *GetRoomIDForAliasRequest, res *GetRoomIDForAliasResponse) error
@@ -248,10 +256,31 @@ type ClientRoomserverAPI interface {
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
 	PerformAdminPurgeRoom(ctx context.Context, roomID string) error
 	PerformAdminDownloadState(ctx context.Context, roomID, userID string, serverName spec.ServerName) error
+	// PerformAdminRedactUser starts a background job which redacts the events sent by a user,
+	// and returns the ID of the job.
+	PerformAdminRedactUser(ctx context.Context, req *PerformAdminRedactUserRequest) (jobID string, err error)
+	// QueryAdminRedactUserJob returns the progress of a job started by PerformAdminRedactUser,
+	// or nil if there is no such job.
+	QueryAdminRedactUserJob(ctx context.Context, jobID string) (*AdminRedactUserJob, error)
+	// QueryAdminRoomIDs returns the IDs of all the rooms known to the server.
+	QueryAdminRoomIDs(ctx context.Context) ([]string, error)
+	// PerformAdminBlockRoom blocks or unblocks local users from joining the room.
+	PerformAdminBlockRoom(ctx context.Context, roomID spec.RoomID, blockedBy spec.UserID, block bool) error
+	// QueryAdminRoomBlocked returns whether local users are blocked from joining the room.
+	QueryAdminRoomBlocked(ctx context.Context, roomID spec.RoomID) (blockedBy string, blocked bool, err error)
+	// PerformAdminMakeRoomAdmin gives the local user the highest power level held by a local
+	// member of the room, and returns the member who granted it.
+	PerformAdminMakeRoomAdmin(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (granter *spec.UserID, err error)
+	// QueryPolicyRules returns the policy list rules which the server enforces,
+	// optionally only those from the given policy room.
+	QueryPolicyRules(ctx context.Context, policyRoomID string) ([]PolicyRule, error)
 	PerformPeek(ctx context.Context, req *PerformPeekRequest) (roomID string, err error)
 	PerformUnpeek(ctx context.Context, roomID, userID, deviceID string) error
 	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
+	// PerformKnock sends a knock for the given user, either locally or via
+	// federation, and returns the room ID that was knocked upon.
+	PerformKnock(ctx context.Context, req *PerformKnockRequest) (roomID string, err error)
 	PerformLeave(ctx context.Context, req *PerformLeaveRequest, res *PerformLeaveResponse) error
 	PerformPublish(ctx context.Context, req *PerformPublishRequest) error
 	// PerformForget forgets a rooms history for a specific user
@@ -299,6 +328,7 @@ type FederationRoomserverAPI interface {
 	QueryBulkStateContentAPI
 	QuerySenderIDAPI
 	QueryRoomHierarchyAPI
+	QueryTimestampToEventAPI
 	QueryMembershipAPI
 	UserRoomPrivateKeyCreator
 	AssignRoomNID(ctx context.Context, roomID spec.RoomID, roomVersion gomatrixserverlib.RoomVersion) (roomNID types.RoomNID, err error)
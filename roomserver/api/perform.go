@@ -39,6 +39,13 @@ type PerformJoinRequest struct {
 	Unsigned      map[string]interface{} `json:"unsigned"`
 }
 
+type PerformKnockRequest struct {
+	RoomIDOrAlias string            `json:"room_id_or_alias"`
+	UserID        string            `json:"user_id"`
+	Reason        string            `json:"reason"`
+	ServerNames   []spec.ServerName `json:"server_names"`
+}
+
 type PerformLeaveRequest struct {
 	RoomID string
 	Leaver spec.UserID
@@ -171,3 +178,38 @@ type PerformForgetRequest struct {
 }
 
 type PerformForgetResponse struct{}
+
+// PerformAdminRedactUserRequest is a request to redact the events sent by a user.
+type PerformAdminRedactUserRequest struct {
+	// The user whose events are redacted
+	UserID spec.UserID
+	// The admin who asked for the redactions. They send the redactions in the rooms
+	// where they are joined and have enough power to, otherwise the local user with
+	// the highest power level in the room does.
+	AdminUserID spec.UserID
+	// Only redact events in these rooms, or in all the rooms the user has been in if empty
+	RoomIDs []string
+	// Only redact events sent at or after Since and before Until, where a zero Until means no limit
+	Since spec.Timestamp
+	Until spec.Timestamp
+	// The reason given in the redactions, if any
+	Reason string
+}
+
+const (
+	AdminRedactUserJobActive    = "active"
+	AdminRedactUserJobCompleted = "completed"
+	AdminRedactUserJobFailed    = "failed"
+)
+
+// AdminRedactUserJob is the progress of a job started by PerformAdminRedactUser.
+type AdminRedactUserJob struct {
+	// One of "active", "completed" or "failed"
+	Status string `json:"status"`
+	// How many events have been redacted so far
+	Redacted int `json:"redacted"`
+	// The events which couldn't be redacted, mapped to the reason why
+	FailedRedactions map[string]string `json:"failed_redactions"`
+	// Why the job failed, if it did
+	Error string `json:"error,omitempty"`
+}
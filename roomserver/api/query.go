@@ -338,6 +338,27 @@ type QueryServerBannedFromRoomResponse struct {
 	Banned bool `json:"banned"`
 }
 
+// PolicyRule is a ban rule from a moderation policy list which the server enforces.
+type PolicyRule struct {
+	// The policy room which the rule came from
+	PolicyRoomID string `json:"policy_room_id"`
+	// One of m.policy.rule.user, m.policy.rule.room or m.policy.rule.server
+	Type     string `json:"type"`
+	StateKey string `json:"state_key"`
+	// The user ID, room ID or server name which is banned, possibly with * and ? wildcards
+	Entity         string `json:"entity"`
+	Recommendation string `json:"recommendation"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+type QueryTimestampToEventResponse struct {
+	EventID        string         `json:"event_id"`
+	OriginServerTS spec.Timestamp `json:"origin_server_ts"`
+	// NextToGap is true if we might be missing events between the timestamp
+	// and the event, so other servers in the room may know of a closer one.
+	NextToGap bool `json:"-"`
+}
+
 type QueryAdminEventReportsResponse struct {
 	ID               int64                  `json:"id"`
 	Score            int64                  `json:"score"`
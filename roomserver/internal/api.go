@@ -14,12 +14,14 @@ import (
 
 	asAPI "github.com/ike20013/dendrite/appservice/api"
 	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	fsAPI "github.com/ike20013/dendrite/federationapi/api"
 	"github.com/ike20013/dendrite/roomserver/acls"
 	"github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/roomserver/internal/input"
 	"github.com/ike20013/dendrite/roomserver/internal/perform"
 	"github.com/ike20013/dendrite/roomserver/internal/query"
+	"github.com/ike20013/dendrite/roomserver/policy"
 	"github.com/ike20013/dendrite/roomserver/producers"
 	"github.com/ike20013/dendrite/roomserver/storage"
 	"github.com/ike20013/dendrite/roomserver/types"
@@ -35,6 +37,7 @@ type RoomserverInternalAPI struct {
 	*query.Queryer
 	*perform.Inviter
 	*perform.Joiner
+	*perform.Knocker
 	*perform.Peeker
 	*perform.InboundPeeker
 	*perform.Unpeeker
@@ -52,6 +55,8 @@ type RoomserverInternalAPI struct {
 	ServerName             spec.ServerName
 	KeyRing                gomatrixserverlib.JSONVerifier
 	ServerACLs             *acls.ServerACLs
+	PolicyLists            *policy.PolicyLists
+	SpamChecker            spamcheck.Checker
 	fsAPI                  fsAPI.RoomserverFederationAPI
 	asAPI                  asAPI.AppServiceInternalAPI
 	NATSClient             *nats.Conn
@@ -66,7 +71,8 @@ type RoomserverInternalAPI struct {
 
 func NewRoomserverAPI(
 	processContext *process.ProcessContext, dendriteCfg *config.Dendrite, roomserverDB storage.Database,
-	js nats.JetStreamContext, nc *nats.Conn, caches caching.RoomServerCaches, enableMetrics bool,
+	js nats.JetStreamContext, nc *nats.Conn, caches caching.RoomServerCaches, spamChecker spamcheck.Checker,
+	enableMetrics bool,
 ) *RoomserverInternalAPI {
 	var perspectiveServerNames []spec.ServerName
 	for _, kp := range dendriteCfg.FederationAPI.KeyPerspectives {
@@ -74,10 +80,15 @@ func NewRoomserverAPI(
 	}
 
 	serverACLs := acls.NewServerACLs(roomserverDB)
+	policyLists := policy.NewPolicyLists(roomserverDB, dendriteCfg.RoomServer.PolicyRooms)
+	if len(dendriteCfg.RoomServer.PolicyRooms) > 0 {
+		serverACLs.SetServerBans(policyLists)
+	}
 	producer := &producers.RoomEventProducer{
-		Topic:     string(dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputRoomEvent)),
-		JetStream: js,
-		ACLs:      serverACLs,
+		Topic:       string(dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputRoomEvent)),
+		JetStream:   js,
+		ACLs:        serverACLs,
+		PolicyLists: policyLists,
 	}
 	a := &RoomserverInternalAPI{
 		ProcessContext:         processContext,
@@ -92,6 +103,8 @@ func NewRoomserverAPI(
 		NATSClient:             nc,
 		Durable:                dendriteCfg.Global.JetStream.Durable("RoomserverInputConsumer"),
 		ServerACLs:             serverACLs,
+		PolicyLists:            policyLists,
+		SpamChecker:            spamChecker,
 		enableMetrics:          enableMetrics,
 		defaultRoomVersion:     dendriteCfg.RoomServer.DefaultRoomVersion,
 		// perform-er structs + queryer struct get initialised when we have a federation sender to use
@@ -130,17 +143,31 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		RSAPI:               r,
 		KeyRing:             keyRing,
 		ACLs:                r.ServerACLs,
+		PolicyLists:         r.PolicyLists,
+		SpamChecker:         r.SpamChecker,
 		Queryer:             r.Queryer,
 		EnableMetrics:       r.enableMetrics,
 	}
 	r.Inviter = &perform.Inviter{
-		DB:      r.DB,
-		Cfg:     &r.Cfg.RoomServer,
-		FSAPI:   r.fsAPI,
-		RSAPI:   r,
-		Inputer: r.Inputer,
+		DB:          r.DB,
+		Cfg:         &r.Cfg.RoomServer,
+		FSAPI:       r.fsAPI,
+		RSAPI:       r,
+		Inputer:     r.Inputer,
+		PolicyLists: r.PolicyLists,
+		SpamChecker: r.SpamChecker,
 	}
 	r.Joiner = &perform.Joiner{
+		Cfg:         &r.Cfg.RoomServer,
+		DB:          r.DB,
+		FSAPI:       r.fsAPI,
+		RSAPI:       r,
+		Inputer:     r.Inputer,
+		Queryer:     r.Queryer,
+		PolicyLists: r.PolicyLists,
+		SpamChecker: r.SpamChecker,
+	}
+	r.Knocker = &perform.Knocker{
 		Cfg:     &r.Cfg.RoomServer,
 		DB:      r.DB,
 		FSAPI:   r.fsAPI,
@@ -194,11 +221,13 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		URSAPI: r,
 	}
 	r.Admin = &perform.Admin{
-		DB:      r.DB,
-		Cfg:     &r.Cfg.RoomServer,
-		Inputer: r.Inputer,
-		Queryer: r.Queryer,
-		Leaver:  r.Leaver,
+		ProcessContext: r.ProcessContext,
+		DB:             r.DB,
+		Cfg:            &r.Cfg.RoomServer,
+		Inputer:        r.Inputer,
+		Queryer:        r.Queryer,
+		Leaver:         r.Leaver,
+		RSAPI:          r,
 	}
 	r.Creator = &perform.Creator{
 		DB:    r.DB,
@@ -255,6 +284,21 @@ func (r *RoomserverInternalAPI) PerformInvite(
 	return r.Inviter.PerformInvite(ctx, req)
 }
 
+func (r *RoomserverInternalAPI) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) (string, error) {
+	roomID, outputEvents, err := r.Knocker.PerformKnock(ctx, req)
+	if err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+	if len(outputEvents) == 0 {
+		return roomID, nil
+	}
+	return roomID, r.OutputProducer.ProduceRoomEvents(roomID, outputEvents)
+}
+
 func (r *RoomserverInternalAPI) PerformLeave(
 	ctx context.Context,
 	req *api.PerformLeaveRequest,
@@ -279,6 +323,10 @@ func (r *RoomserverInternalAPI) PerformForget(
 	return r.Forgetter.PerformForget(ctx, req, resp)
 }
 
+func (r *RoomserverInternalAPI) QueryPolicyRules(ctx context.Context, policyRoomID string) ([]api.PolicyRule, error) {
+	return r.PolicyLists.Rules(policyRoomID), nil
+}
+
 // GetOrCreateUserRoomPrivateKey gets the user room key for the specified user. If no key exists yet, a new one is created.
 func (r *RoomserverInternalAPI) GetOrCreateUserRoomPrivateKey(ctx context.Context, userID spec.UserID, roomID spec.RoomID) (ed25519.PrivateKey, error) {
 	key, err := r.DB.SelectUserRoomPrivateKey(ctx, userID, roomID)
@@ -26,10 +26,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
+	"github.com/ike20013/dendrite/external/spamcheck"
 	fedapi "github.com/ike20013/dendrite/federationapi/api"
 	"github.com/ike20013/dendrite/roomserver/acls"
 	"github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/roomserver/internal/query"
+	"github.com/ike20013/dendrite/roomserver/policy"
 	"github.com/ike20013/dendrite/roomserver/producers"
 	"github.com/ike20013/dendrite/roomserver/storage"
 	"github.com/ike20013/dendrite/roomserver/types"
@@ -78,6 +80,8 @@ type Inputer struct {
 	RSAPI               api.RoomserverInternalAPI
 	KeyRing             gomatrixserverlib.JSONVerifier
 	ACLs                *acls.ServerACLs
+	PolicyLists         *policy.PolicyLists
+	SpamChecker         spamcheck.Checker
 	InputRoomEventTopic string
 	OutputProducer      *producers.RoomEventProducer
 	workers             sync.Map // room ID -> *worker
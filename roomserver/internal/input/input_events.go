@@ -338,6 +338,15 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
+	// Events which the spam checkers or the policy lists deny are soft-failed,
+	// so that they are stored but never become part of the room for our users.
+	var moderationErr error
+	if input.Kind == api.KindNew && !isCreateEvent && !softfail {
+		if moderationErr = r.checkModeration(ctx, event); moderationErr != nil {
+			softfail = true
+		}
+	}
+
 	// Get the state before the event so that we can work out if the event was
 	// allowed at the time, and also to get the history visibility. We won't
 	// bother doing this if the event was already rejected as it just ends up
@@ -437,6 +446,9 @@ func (r *Inputer) processRoomEvent(
 		if rejectionErr != nil {
 			return types.RejectedError(rejectionErr.Error())
 		}
+		if moderationErr != nil {
+			return types.RejectedError(moderationErr.Error())
+		}
 		return nil
 	}
 
@@ -510,6 +522,12 @@ func (r *Inputer) processRoomEvent(
 					}
 					r.ACLs.OnServerACLUpdate(strippedEvent)
 				}
+				// Likewise we need the rules of policy rooms that we have just joined.
+				if r.PolicyLists != nil {
+					if err = r.PolicyLists.Reload(ctx, event.RoomID().String()); err != nil {
+						logrus.WithError(err).Error("failed to load policy rules")
+					}
+				}
 			}
 		}
 	}
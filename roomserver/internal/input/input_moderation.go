@@ -0,0 +1,48 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// checkModeration returns why the policy lists or the spam checkers deny a new
+// event, or nil if they allow it.
+func (r *Inputer) checkModeration(ctx context.Context, event gomatrixserverlib.PDU) error {
+	if r.PolicyLists != nil && event.Type() == spec.MRoomMember && event.StateKey() != nil {
+		membership, err := event.Membership()
+		if err != nil {
+			return nil
+		}
+		// Banned users can't join or knock, and can't invite anyone.
+		var userID *spec.UserID
+		switch membership {
+		case spec.Join, spec.Knock:
+			userID, err = r.Queryer.QueryUserIDForSender(ctx, event.RoomID(), spec.SenderID(*event.StateKey()))
+		case spec.Invite:
+			userID, err = r.Queryer.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID())
+		}
+		if err == nil && userID != nil {
+			if rule := r.PolicyLists.MatchUser(*userID); rule != nil {
+				return fmt.Errorf("%s is banned by the policy list in %s", userID, rule.PolicyRoomID)
+			}
+		}
+	}
+
+	if r.SpamChecker != nil {
+		sender, err := r.Queryer.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID())
+		if err == nil && sender != nil {
+			if denied := r.SpamChecker.CheckEventForSpam(ctx, event, *sender); denied != nil {
+				return denied
+			}
+		}
+	}
+	return nil
+}
@@ -26,7 +26,7 @@ func TestSingleTransactionOnInput(t *testing.T) {
 		natsInstance := &jetstream.NATSInstance{}
 		js, jc := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
 		caches := caching.NewRistrettoCache(8*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 
 		deadline, _ := t.Deadline()
@@ -11,6 +11,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/ike20013/dendrite/external/eventutil"
@@ -20,6 +21,7 @@ import (
 	"github.com/ike20013/dendrite/roomserver/storage"
 	"github.com/ike20013/dendrite/roomserver/types"
 	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -27,11 +29,16 @@ import (
 )
 
 type Admin struct {
-	DB      storage.Database
-	Cfg     *config.RoomServer
-	Queryer *query.Queryer
-	Inputer *input.Inputer
-	Leaver  *Leaver
+	ProcessContext *process.ProcessContext
+	DB             storage.Database
+	Cfg            *config.RoomServer
+	Queryer        *query.Queryer
+	Inputer        *input.Inputer
+	Leaver         *Leaver
+	RSAPI          api.RoomserverInternalAPI
+
+	// Jobs started by PerformAdminRedactUser, by job ID
+	redactJobs sync.Map // string -> *redactUserJob
 }
 
 // PerformAdminEvacuateRoom will remove all local users from the given room.
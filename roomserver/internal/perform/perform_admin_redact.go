@@ -0,0 +1,309 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/external/eventutil"
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/roomserver/types"
+)
+
+const (
+	// redactBatchSize is how many events of a room are looked at in one go.
+	redactBatchSize = 100
+	// redactJobRetention is how long finished jobs can still be queried for.
+	redactJobRetention = 24 * time.Hour
+)
+
+// redactUserJob tracks the progress of a PerformAdminRedactUser job.
+type redactUserJob struct {
+	mu  sync.Mutex
+	job api.AdminRedactUserJob
+}
+
+func (j *redactUserJob) redacted() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Redacted++
+}
+
+func (j *redactUserJob) failed(eventID string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.FailedRedactions[eventID] = err.Error()
+}
+
+func (j *redactUserJob) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err != nil {
+		j.job.Status = api.AdminRedactUserJobFailed
+		j.job.Error = err.Error()
+	} else {
+		j.job.Status = api.AdminRedactUserJobCompleted
+	}
+}
+
+// PerformAdminRedactUser starts redacting the events sent by the user in the
+// background. The progress of the job can be polled with QueryAdminRedactUserJob.
+// Jobs are kept in memory, so they are forgotten when the server restarts, and
+// finished jobs are forgotten after redactJobRetention.
+func (r *Admin) PerformAdminRedactUser(
+	ctx context.Context,
+	req *api.PerformAdminRedactUserRequest,
+) (string, error) {
+	roomIDs := req.RoomIDs
+	if len(roomIDs) == 0 {
+		// Leave also covers rooms which the user was banned from.
+		for _, membership := range []string{spec.Join, spec.Leave} {
+			memberRoomIDs, err := r.DB.GetRoomsByMembership(ctx, req.UserID, membership)
+			if err != nil {
+				return "", fmt.Errorf("r.DB.GetRoomsByMembership: %w", err)
+			}
+			roomIDs = append(roomIDs, memberRoomIDs...)
+		}
+	}
+
+	jobID := util.RandomString(16)
+	job := &redactUserJob{
+		job: api.AdminRedactUserJob{
+			Status:           api.AdminRedactUserJobActive,
+			FailedRedactions: map[string]string{},
+		},
+	}
+	r.redactJobs.Store(jobID, job)
+
+	logger := logrus.WithFields(logrus.Fields{
+		"job_id":  jobID,
+		"user_id": req.UserID.String(),
+	})
+	logger.Infof("Redacting events from %d rooms", len(roomIDs))
+	go func() {
+		ctx := r.ProcessContext.Context()
+		var err error
+		for _, roomID := range roomIDs {
+			if err = r.redactUserInRoom(ctx, job, req, roomID); err != nil {
+				err = fmt.Errorf("failed to redact events in %s: %w", roomID, err)
+				break
+			}
+		}
+		job.finish(err)
+		time.AfterFunc(redactJobRetention, func() {
+			r.redactJobs.Delete(jobID)
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to redact events")
+		} else {
+			logger.Info("Finished redacting events")
+		}
+	}()
+	return jobID, nil
+}
+
+// QueryAdminRedactUserJob returns the progress of a PerformAdminRedactUser job,
+// or nil if there is no such job.
+func (r *Admin) QueryAdminRedactUserJob(ctx context.Context, jobID string) (*api.AdminRedactUserJob, error) {
+	v, ok := r.redactJobs.Load(jobID)
+	if !ok {
+		return nil, nil
+	}
+	job := v.(*redactUserJob)
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	res := job.job
+	res.FailedRedactions = make(map[string]string, len(job.job.FailedRedactions))
+	for eventID, reason := range job.job.FailedRedactions {
+		res.FailedRedactions[eventID] = reason
+	}
+	return &res, nil
+}
+
+// redactUserInRoom redacts the events which the user sent in the room. Events
+// which can't be redacted are recorded in the job rather than returned as errors.
+func (r *Admin) redactUserInRoom(
+	ctx context.Context, job *redactUserJob, req *api.PerformAdminRedactUserRequest, roomID string,
+) error {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return err
+	}
+	senderID, err := r.Queryer.QuerySenderIDForUser(ctx, *validRoomID, req.UserID)
+	if err != nil {
+		return err
+	}
+	if senderID == nil {
+		return nil
+	}
+
+	var redactor *spec.UserID
+	var redactorErr error
+	after := types.EventNID(0)
+	for {
+		eventNIDs, err := r.DB.EventNIDsInRoom(ctx, roomInfo.RoomNID, *senderID, after, req.Since, req.Until, redactBatchSize)
+		if err != nil {
+			return fmt.Errorf("r.DB.EventNIDsInRoom: %w", err)
+		}
+		if len(eventNIDs) == 0 {
+			return nil
+		}
+		after = eventNIDs[len(eventNIDs)-1]
+		events, err := r.DB.Events(ctx, roomInfo.RoomVersion, eventNIDs)
+		if err != nil {
+			return fmt.Errorf("r.DB.Events: %w", err)
+		}
+		for _, event := range events {
+			if event.Redacted() || !redactable(event.PDU) {
+				continue
+			}
+			// Only look for someone to send the redactions once there is something to redact.
+			if redactor == nil && redactorErr == nil {
+				redactor, redactorErr = r.redactorForRoom(ctx, *validRoomID, req.AdminUserID, *senderID)
+				if redactorErr != nil {
+					logrus.WithError(redactorErr).WithField("room_id", roomID).Warn("Can't redact events in room")
+				}
+			}
+			if redactorErr != nil {
+				job.failed(event.EventID(), redactorErr)
+				continue
+			}
+			if err = r.sendRedaction(ctx, *validRoomID, *redactor, event.EventID(), req.Reason); err != nil {
+				job.failed(event.EventID(), err)
+				continue
+			}
+			job.redacted()
+		}
+	}
+}
+
+// redactable returns whether the event should be redacted when removing everything
+// a user has sent. Redacting other state events could break the room, but redacting
+// memberships removes the display names and avatars that the user set.
+func redactable(event gomatrixserverlib.PDU) bool {
+	if event.Type() == spec.MRoomRedaction {
+		return false
+	}
+	return event.StateKey() == nil || event.Type() == spec.MRoomMember
+}
+
+// redactorForRoom picks the local user to send redactions in the room: the admin
+// if they are joined to it, otherwise the local member with the most power. Returns
+// an error if neither has enough power to redact other users' events.
+func (r *Admin) redactorForRoom(
+	ctx context.Context, roomID spec.RoomID, adminUserID spec.UserID, exclude spec.SenderID,
+) (*spec.UserID, error) {
+	plEvent, err := r.DB.GetStateEvent(ctx, roomID.String(), spec.MRoomPowerLevels, "")
+	if err != nil {
+		return nil, err
+	}
+	if plEvent == nil {
+		return nil, fmt.Errorf("room has no power levels")
+	}
+	pl, err := plEvent.PowerLevels()
+	if err != nil {
+		return nil, err
+	}
+
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+	if err != nil {
+		return nil, err
+	}
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, err
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *spec.UserID
+	var bestLevel int64
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil || spec.SenderID(*memberEvent.StateKey()) == exclude {
+			continue
+		}
+		memberSenderID := spec.SenderID(*memberEvent.StateKey())
+		userID, err := r.Queryer.QueryUserIDForSender(ctx, roomID, memberSenderID)
+		if err != nil || userID == nil {
+			continue
+		}
+		level := pl.UserLevel(memberSenderID)
+		if userID.String() == adminUserID.String() && level >= pl.Redact {
+			return userID, nil
+		}
+		if best == nil || level > bestLevel {
+			best, bestLevel = userID, level
+		}
+	}
+	if best == nil || bestLevel < pl.Redact {
+		return nil, fmt.Errorf("no local user in the room has the power to redact events")
+	}
+	return best, nil
+}
+
+// sendRedaction sends a redaction of the event from the given user.
+func (r *Admin) sendRedaction(
+	ctx context.Context, roomID spec.RoomID, redactor spec.UserID, eventID, reason string,
+) error {
+	senderID, err := r.Queryer.QuerySenderIDForUser(ctx, roomID, redactor)
+	if err != nil {
+		return err
+	}
+	if senderID == nil {
+		return fmt.Errorf("no sender ID for %s", redactor.String())
+	}
+	proto := &gomatrixserverlib.ProtoEvent{
+		SenderID: string(*senderID),
+		RoomID:   roomID.String(),
+		Type:     spec.MRoomRedaction,
+		Redacts:  eventID,
+	}
+	// Room version 11 expects "redacts" in the content too.
+	content := map[string]string{"redacts": eventID}
+	if reason != "" {
+		content["reason"] = reason
+	}
+	if err = proto.SetContent(content); err != nil {
+		return err
+	}
+	identity, err := r.RSAPI.SigningIdentityFor(ctx, roomID, redactor)
+	if err != nil {
+		return err
+	}
+	event, err := eventutil.QueryAndBuildEvent(ctx, proto, &identity, time.Now(), r.Queryer, nil)
+	if err != nil {
+		return err
+	}
+
+	inputReq := &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{
+			Kind:         api.KindNew,
+			Event:        event,
+			Origin:       redactor.Domain(),
+			SendAsServer: string(redactor.Domain()),
+		}},
+	}
+	inputRes := &api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, inputReq, inputRes)
+	return inputRes.Err()
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/external/eventutil"
+	"github.com/ike20013/dendrite/roomserver/api"
+)
+
+// QueryAdminRoomIDs returns the IDs of all the rooms known to the server.
+func (r *Admin) QueryAdminRoomIDs(ctx context.Context) ([]string, error) {
+	return r.DB.RoomIDs(ctx)
+}
+
+// PerformAdminBlockRoom blocks or unblocks local users from joining the room.
+// Rooms can be blocked before the server knows about them.
+func (r *Admin) PerformAdminBlockRoom(ctx context.Context, roomID spec.RoomID, blockedBy spec.UserID, block bool) error {
+	logrus.WithFields(logrus.Fields{
+		"room_id": roomID.String(),
+		"user_id": blockedBy.String(),
+		"block":   block,
+	}).Info("Setting room block")
+	return r.DB.SetRoomBlocked(ctx, roomID.String(), blockedBy.String(), block)
+}
+
+// QueryAdminRoomBlocked returns whether local users are blocked from joining the
+// room, and which admin blocked it.
+func (r *Admin) QueryAdminRoomBlocked(ctx context.Context, roomID spec.RoomID) (blockedBy string, blocked bool, err error) {
+	return r.DB.GetRoomBlocked(ctx, roomID.String())
+}
+
+// PerformAdminMakeRoomAdmin gives the local user the highest power level held by
+// a local member of the room. The power levels are changed by that member, who is
+// returned so that the caller can invite the user if they aren't in the room.
+func (r *Admin) PerformAdminMakeRoomAdmin(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.UserID, error) {
+	if !r.Cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return nil, fmt.Errorf("can only make local users room admins")
+	}
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, eventutil.ErrRoomNoExists{}
+	}
+
+	plEvent, err := r.DB.GetStateEvent(ctx, roomID.String(), spec.MRoomPowerLevels, "")
+	if err != nil {
+		return nil, err
+	}
+	if plEvent == nil {
+		return nil, fmt.Errorf("room has no power levels")
+	}
+	pl, err := plEvent.PowerLevels()
+	if err != nil {
+		return nil, err
+	}
+
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, err
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, err
+	}
+	var granter *spec.UserID
+	var granterID spec.SenderID
+	var granterLevel int64
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		memberSenderID := spec.SenderID(*memberEvent.StateKey())
+		memberUserID, err := r.Queryer.QueryUserIDForSender(ctx, roomID, memberSenderID)
+		if err != nil || memberUserID == nil {
+			continue
+		}
+		if level := pl.UserLevel(memberSenderID); granter == nil || level > granterLevel {
+			granter, granterID, granterLevel = memberUserID, memberSenderID, level
+		}
+	}
+	if granter == nil || granterLevel < pl.EventLevel(spec.MRoomPowerLevels, true) {
+		return nil, fmt.Errorf("no local user in the room has the power to change the power levels")
+	}
+
+	senderID, err := r.Queryer.QuerySenderIDForUser(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if senderID == nil {
+		return nil, fmt.Errorf("%s has no sender ID in the room", userID.String())
+	}
+	if pl.UserLevel(*senderID) >= granterLevel {
+		return granter, nil
+	}
+
+	// Change the users in the existing content so that other keys are kept as they are.
+	var content map[string]interface{}
+	if err = json.Unmarshal(plEvent.Content(), &content); err != nil {
+		return nil, err
+	}
+	users, _ := content["users"].(map[string]interface{})
+	if users == nil {
+		users = map[string]interface{}{}
+	}
+	users[string(*senderID)] = granterLevel
+	content["users"] = users
+
+	stateKey := ""
+	proto := &gomatrixserverlib.ProtoEvent{
+		SenderID: string(granterID),
+		RoomID:   roomID.String(),
+		Type:     spec.MRoomPowerLevels,
+		StateKey: &stateKey,
+	}
+	if err = proto.SetContent(content); err != nil {
+		return nil, err
+	}
+	identity, err := r.RSAPI.SigningIdentityFor(ctx, roomID, *granter)
+	if err != nil {
+		return nil, err
+	}
+	event, err := eventutil.QueryAndBuildEvent(ctx, proto, &identity, time.Now(), r.Queryer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	inputReq := &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{
+			Kind:         api.KindNew,
+			Event:        event,
+			Origin:       granter.Domain(),
+			SendAsServer: string(granter.Domain()),
+		}},
+	}
+	inputRes := &api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, inputReq, inputRes)
+	if err = inputRes.Err(); err != nil {
+		return nil, err
+	}
+	return granter, nil
+}
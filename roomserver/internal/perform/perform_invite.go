@@ -11,10 +11,12 @@ import (
 	"crypto/ed25519"
 	"fmt"
 
+	"github.com/ike20013/dendrite/external/spamcheck"
 	federationAPI "github.com/ike20013/dendrite/federationapi/api"
 	"github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/roomserver/internal/helpers"
 	"github.com/ike20013/dendrite/roomserver/internal/input"
+	"github.com/ike20013/dendrite/roomserver/policy"
 	"github.com/ike20013/dendrite/roomserver/state"
 	"github.com/ike20013/dendrite/roomserver/storage"
 	"github.com/ike20013/dendrite/roomserver/storage/shared"
@@ -67,11 +69,13 @@ func (q *QueryState) GetState(ctx context.Context, roomID spec.RoomID, stateWant
 }
 
 type Inviter struct {
-	DB      storage.Database
-	Cfg     *config.RoomServer
-	FSAPI   federationAPI.RoomserverFederationAPI
-	RSAPI   api.RoomserverInternalAPI
-	Inputer *input.Inputer
+	DB          storage.Database
+	Cfg         *config.RoomServer
+	FSAPI       federationAPI.RoomserverFederationAPI
+	RSAPI       api.RoomserverInternalAPI
+	Inputer     *input.Inputer
+	PolicyLists *policy.PolicyLists
+	SpamChecker spamcheck.Checker
 }
 
 func (r *Inviter) IsKnownRoom(ctx context.Context, roomID spec.RoomID) (bool, error) {
@@ -96,6 +100,11 @@ func (r *Inviter) ProcessInviteMembership(
 	if err != nil {
 		return nil, api.ErrInvalidID{Err: fmt.Errorf("the user ID %s is invalid", *inviteEvent.StateKey())}
 	}
+	if inviter, inviterErr := r.RSAPI.QueryUserIDForSender(ctx, inviteEvent.RoomID(), inviteEvent.SenderID()); inviterErr == nil && inviter != nil {
+		if err = r.checkInvitePolicy(*inviter, inviteEvent.RoomID()); err != nil {
+			return nil, err
+		}
+	}
 	isTargetLocal := r.Cfg.Matrix.IsLocalServerName(userID.Domain())
 	if updater, err = r.DB.MembershipUpdater(ctx, inviteEvent.RoomID().String(), *inviteEvent.StateKey(), isTargetLocal, inviteEvent.Version()); err != nil {
 		return nil, fmt.Errorf("r.DB.MembershipUpdater: %w", err)
@@ -113,6 +122,20 @@ func (r *Inviter) ProcessInviteMembership(
 	return outputUpdates, nil
 }
 
+// checkInvitePolicy returns an error if the policy lists ban the inviter or the room.
+func (r *Inviter) checkInvitePolicy(inviter spec.UserID, roomID spec.RoomID) error {
+	if r.PolicyLists == nil {
+		return nil
+	}
+	if rule := r.PolicyLists.MatchUser(inviter); rule != nil {
+		return api.ErrNotAllowed{Err: fmt.Errorf("%s is banned by the policy list in %s", inviter.String(), rule.PolicyRoomID)}
+	}
+	if rule := r.PolicyLists.MatchRoom(roomID); rule != nil {
+		return api.ErrNotAllowed{Err: fmt.Errorf("%s is banned by the policy list in %s", roomID.String(), rule.PolicyRoomID)}
+	}
+	return nil
+}
+
 // nolint:gocyclo
 func (r *Inviter) PerformInvite(
 	ctx context.Context,
@@ -149,6 +172,15 @@ func (r *Inviter) PerformInvite(
 		return api.ErrInvalidID{Err: fmt.Errorf("the invite must be from a local user")}
 	}
 
+	if err = r.checkInvitePolicy(req.InviteInput.Inviter, req.InviteInput.RoomID); err != nil {
+		return err
+	}
+	if r.SpamChecker != nil {
+		if denied := r.SpamChecker.UserMayInvite(ctx, req.InviteInput.Inviter, req.InviteInput.Invitee, req.InviteInput.RoomID); denied != nil {
+			return api.ErrNotAllowed{Err: *denied}
+		}
+	}
+
 	isTargetLocal := r.Cfg.Matrix.IsLocalServerName(req.InviteInput.Invitee.Domain())
 
 	signingKey := req.InviteInput.PrivateKey
@@ -24,12 +24,14 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/ike20013/dendrite/external/eventutil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	fsAPI "github.com/ike20013/dendrite/federationapi/api"
 	"github.com/ike20013/dendrite/roomserver/api"
 	rsAPI "github.com/ike20013/dendrite/roomserver/api"
 	"github.com/ike20013/dendrite/roomserver/internal/helpers"
 	"github.com/ike20013/dendrite/roomserver/internal/input"
 	"github.com/ike20013/dendrite/roomserver/internal/query"
+	"github.com/ike20013/dendrite/roomserver/policy"
 	"github.com/ike20013/dendrite/roomserver/storage"
 	"github.com/ike20013/dendrite/roomserver/types"
 	"github.com/ike20013/dendrite/setup/config"
@@ -41,8 +43,10 @@ type Joiner struct {
 	RSAPI rsAPI.RoomserverInternalAPI
 	DB    storage.Database
 
-	Inputer *input.Inputer
-	Queryer *query.Queryer
+	Inputer     *input.Inputer
+	Queryer     *query.Queryer
+	PolicyLists *policy.PolicyLists
+	SpamChecker spamcheck.Checker
 }
 
 // PerformJoin handles joining matrix rooms, including over federation by talking to the federationapi.
@@ -218,9 +222,11 @@ func (r *Joiner) performJoinRoomByID(
 
 	// Force a federated join if we're dealing with a pending invite
 	// and we aren't in the room.
+	isInvited := false
 	if checkInvitePending {
 		isInvitePending, inviteSender, _, inviteEvent, inviteErr := helpers.IsInvitePending(ctx, r.DB, req.RoomIDOrAlias, senderID)
-		if inviteErr == nil && !serverInRoom && isInvitePending {
+		isInvited = inviteErr == nil && isInvitePending
+		if isInvited && !serverInRoom {
 			inviter, queryErr := r.RSAPI.QueryUserIDForSender(ctx, *roomID, inviteSender)
 			if queryErr != nil {
 				return "", "", fmt.Errorf("r.RSAPI.QueryUserIDForSender: %w", queryErr)
@@ -265,6 +271,27 @@ func (r *Joiner) performJoinRoomByID(
 		}
 	}
 
+	if _, blocked, blockedErr := r.DB.GetRoomBlocked(ctx, roomID.String()); blockedErr != nil {
+		return "", "", fmt.Errorf("r.DB.GetRoomBlocked: %w", blockedErr)
+	} else if blocked {
+		return "", "", rsAPI.ErrNotAllowed{Err: fmt.Errorf("this room has been blocked on this server")}
+	}
+
+	if r.PolicyLists != nil {
+		if rule := r.PolicyLists.MatchUser(*userID); rule != nil {
+			return "", "", rsAPI.ErrNotAllowed{Err: fmt.Errorf("%s is banned by the policy list in %s", userID.String(), rule.PolicyRoomID)}
+		}
+		if rule := r.PolicyLists.MatchRoom(*roomID); rule != nil {
+			return "", "", rsAPI.ErrNotAllowed{Err: fmt.Errorf("%s is banned by the policy list in %s", roomID.String(), rule.PolicyRoomID)}
+		}
+	}
+
+	if r.SpamChecker != nil {
+		if denied := r.SpamChecker.UserMayJoinRoom(ctx, *userID, *roomID, isInvited); denied != nil {
+			return "", "", rsAPI.ErrNotAllowed{Err: *denied}
+		}
+	}
+
 	// If we should do a forced federated join then do that.
 	var joinedVia spec.ServerName
 	if forceFederatedJoin {
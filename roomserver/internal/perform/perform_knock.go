@@ -0,0 +1,331 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/external/eventutil"
+	fsAPI "github.com/ike20013/dendrite/federationapi/api"
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/roomserver/internal/input"
+	"github.com/ike20013/dendrite/roomserver/internal/query"
+	"github.com/ike20013/dendrite/roomserver/storage"
+	"github.com/ike20013/dendrite/roomserver/storage/tables"
+	"github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+type Knocker struct {
+	Cfg   *config.RoomServer
+	FSAPI fsAPI.RoomserverFederationAPI
+	RSAPI api.RoomserverInternalAPI
+	DB    storage.Database
+
+	Inputer *input.Inputer
+	Queryer *query.Queryer
+}
+
+// PerformKnock handles knocking on matrix rooms, including over federation by talking to the federationapi.
+// Any output events that need to be sent to downstream components are returned to the caller.
+func (r *Knocker) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) (string, []api.OutputEvent, error) {
+	logger := logrus.WithContext(ctx).WithFields(logrus.Fields{
+		"room_id": req.RoomIDOrAlias,
+		"user_id": req.UserID,
+		"servers": req.ServerNames,
+	})
+	logger.Info("User requested to knock on room")
+	roomID, outputEvents, err := r.performKnock(context.Background(), req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to knock on room")
+		return "", nil, err
+	}
+	logger.Info("User knocked on room successfully")
+	return roomID, outputEvents, nil
+}
+
+func (r *Knocker) performKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) (string, []api.OutputEvent, error) {
+	userID, err := spec.NewUserID(req.UserID, true)
+	if err != nil {
+		return "", nil, api.ErrInvalidID{Err: fmt.Errorf("supplied user ID %q in incorrect format", req.UserID)}
+	}
+	if !r.Cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return "", nil, api.ErrInvalidID{Err: fmt.Errorf("user %q does not belong to this homeserver", req.UserID)}
+	}
+	if strings.HasPrefix(req.RoomIDOrAlias, "#") {
+		if err = r.resolveRoomAlias(ctx, req); err != nil {
+			return "", nil, err
+		}
+	}
+	if !strings.HasPrefix(req.RoomIDOrAlias, "!") {
+		return "", nil, api.ErrInvalidID{Err: fmt.Errorf("room ID or alias %q is invalid", req.RoomIDOrAlias)}
+	}
+	return r.performKnockRoomByID(ctx, req, *userID)
+}
+
+// resolveRoomAlias replaces the alias in the request with the room ID that
+// it points to, adding any servers that are known to be in the room.
+func (r *Knocker) resolveRoomAlias(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) error {
+	_, domain, err := gomatrixserverlib.SplitID('#', req.RoomIDOrAlias)
+	if err != nil {
+		return api.ErrInvalidID{Err: fmt.Errorf("alias %q is not in the correct format", req.RoomIDOrAlias)}
+	}
+	req.ServerNames = append(req.ServerNames, domain)
+
+	var roomID string
+	if !r.Cfg.Matrix.IsLocalServerName(domain) {
+		dirReq := fsAPI.PerformDirectoryLookupRequest{
+			RoomAlias:  req.RoomIDOrAlias,
+			ServerName: domain,
+		}
+		dirRes := fsAPI.PerformDirectoryLookupResponse{}
+		if err = r.FSAPI.PerformDirectoryLookup(ctx, &dirReq, &dirRes); err != nil {
+			return fmt.Errorf("looking up alias %q over federation failed: %w", req.RoomIDOrAlias, err)
+		}
+		roomID = dirRes.RoomID
+		req.ServerNames = append(req.ServerNames, dirRes.ServerNames...)
+	} else {
+		getRoomReq := api.GetRoomIDForAliasRequest{
+			Alias:              req.RoomIDOrAlias,
+			IncludeAppservices: true,
+		}
+		getRoomRes := api.GetRoomIDForAliasResponse{}
+		if err = r.RSAPI.GetRoomIDForAlias(ctx, &getRoomReq, &getRoomRes); err != nil {
+			return fmt.Errorf("lookup room alias %q failed: %w", req.RoomIDOrAlias, err)
+		}
+		roomID = getRoomRes.RoomID
+	}
+	if roomID == "" {
+		return fmt.Errorf("alias %q not found", req.RoomIDOrAlias)
+	}
+	req.RoomIDOrAlias = roomID
+	return nil
+}
+
+func (r *Knocker) performKnockRoomByID(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+	userID spec.UserID,
+) (string, []api.OutputEvent, error) {
+	roomID, err := spec.NewRoomID(req.RoomIDOrAlias)
+	if err != nil {
+		return "", nil, api.ErrInvalidID{Err: fmt.Errorf("room ID %q is invalid: %w", req.RoomIDOrAlias, err)}
+	}
+
+	// The client may have included our own server name in the list of
+	// servers to try, so filter that out so that we don't try to make_knock
+	// with ourselves.
+	serverNames := make([]spec.ServerName, 0, len(req.ServerNames)+1)
+	for _, serverName := range req.ServerNames {
+		if !r.Cfg.Matrix.IsLocalServerName(serverName) {
+			serverNames = append(serverNames, serverName)
+		}
+	}
+	if !r.Cfg.Matrix.IsLocalServerName(roomID.Domain()) {
+		serverNames = append(serverNames, roomID.Domain())
+	}
+	req.ServerNames = serverNames
+
+	inRoomReq := &api.QueryServerJoinedToRoomRequest{
+		RoomID: roomID.String(),
+	}
+	inRoomRes := &api.QueryServerJoinedToRoomResponse{}
+	if err = r.Queryer.QueryServerJoinedToRoom(ctx, inRoomReq, inRoomRes); err != nil {
+		return "", nil, fmt.Errorf("r.Queryer.QueryServerJoinedToRoom: %w", err)
+	}
+
+	// If we aren't in the room then the only way to knock is through a
+	// server that is.
+	if !inRoomRes.IsInRoom {
+		if len(req.ServerNames) == 0 {
+			return "", nil, eventutil.ErrRoomNoExists{}
+		}
+		outputEvents, ferr := r.performFederatedKnockRoomByID(ctx, req)
+		return roomID.String(), outputEvents, ferr
+	}
+
+	// Knocking is not supported in rooms that use pseudo IDs, since the
+	// knocking user has no sender key in the room until they are let in.
+	if inRoomRes.RoomVersion == gomatrixserverlib.RoomVersionPseudoIDs {
+		return "", nil, api.ErrNotAllowed{Err: fmt.Errorf("knocking is not supported in room version %q", inRoomRes.RoomVersion)}
+	}
+
+	senderIDString := userID.String()
+	proto := gomatrixserverlib.ProtoEvent{
+		Type:     spec.MRoomMember,
+		SenderID: senderIDString,
+		StateKey: &senderIDString,
+		RoomID:   roomID.String(),
+	}
+	content := gomatrixserverlib.MemberContent{
+		Membership: spec.Knock,
+		Reason:     req.Reason,
+	}
+	if err = proto.SetContent(content); err != nil {
+		return "", nil, fmt.Errorf("eb.SetContent: %w", err)
+	}
+	if err = proto.SetUnsigned(struct{}{}); err != nil {
+		return "", nil, fmt.Errorf("eb.SetUnsigned: %w", err)
+	}
+
+	identity, err := r.RSAPI.SigningIdentityFor(ctx, *roomID, userID)
+	if err != nil {
+		return "", nil, fmt.Errorf("SigningIdentityFor: %w", err)
+	}
+	var buildRes api.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(ctx, &proto, &identity, time.Now(), r.RSAPI, &buildRes)
+	if err != nil {
+		return "", nil, fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+
+	// Attach the same stripped state that a remote server would give us in
+	// the send_knock response, so that the sync API can treat both alike.
+	knockRoomState, err := gomatrixserverlib.GenerateStrippedState(ctx, *roomID, r.RSAPI.StateQuerier())
+	if err != nil {
+		return "", nil, fmt.Errorf("gomatrixserverlib.GenerateStrippedState: %w", err)
+	}
+	if err = event.SetUnsignedField("knock_room_state", knockRoomState); err != nil {
+		return "", nil, fmt.Errorf("event.SetUnsignedField: %w", err)
+	}
+
+	// The room is local, so send the knock into the roomserver. The event
+	// auth checks will reject the knock if the join rules don't allow it.
+	inputReq := api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event,
+				Origin:       userID.Domain(),
+				SendAsServer: string(userID.Domain()),
+			},
+		},
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, &inputReq, &inputRes)
+	if err = inputRes.Err(); err != nil {
+		return "", nil, api.ErrNotAllowed{Err: err}
+	}
+	return roomID.String(), nil, nil
+}
+
+func (r *Knocker) performFederatedKnockRoomByID(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) ([]api.OutputEvent, error) {
+	fedReq := fsAPI.PerformKnockRequest{
+		RoomID:      req.RoomIDOrAlias,
+		UserID:      req.UserID,
+		Reason:      req.Reason,
+		ServerNames: req.ServerNames,
+	}
+	fedRes := fsAPI.PerformKnockResponse{}
+	if err := r.FSAPI.PerformKnock(ctx, &fedReq, &fedRes); err != nil {
+		if fedRes.LastError != nil {
+			return nil, fedRes.LastError
+		}
+		return nil, err
+	}
+
+	// Keep hold of the stripped state that the remote server gave us so
+	// that the sync API can tell the client what room it knocked on.
+	knockState := fedRes.KnockRoomState
+	if knockState == nil {
+		knockState = []gomatrixserverlib.InviteStrippedState{}
+	}
+	if err := fedRes.Event.SetUnsignedField("knock_room_state", knockState); err != nil {
+		return nil, fmt.Errorf("event.SetUnsignedField: %w", err)
+	}
+	return storeOutOfRoomMembership(
+		ctx, r.DB, fedRes.Event, tables.MembershipStateKnock,
+		knockServers(fedRes.KnockedVia, req.ServerNames, knockState),
+	)
+}
+
+// knockServers returns the servers to ask when withdrawing the knock: the
+// server that accepted it first, then the other servers that we know of in
+// the room, from the servers we tried and the senders of the stripped state.
+func knockServers(
+	knockedVia spec.ServerName, serverNames []spec.ServerName,
+	knockState []gomatrixserverlib.InviteStrippedState,
+) []spec.ServerName {
+	servers := []spec.ServerName{knockedVia}
+	seen := map[spec.ServerName]struct{}{knockedVia: {}}
+	add := func(serverName spec.ServerName) {
+		if _, ok := seen[serverName]; ok || serverName == "" {
+			return
+		}
+		seen[serverName] = struct{}{}
+		servers = append(servers, serverName)
+	}
+	for _, serverName := range serverNames {
+		add(serverName)
+	}
+	for _, state := range knockState {
+		if _, domain, err := gomatrixserverlib.SplitID('@', state.Sender()); err == nil {
+			add(domain)
+		}
+	}
+	return servers
+}
+
+// storeOutOfRoomMembership records a membership event for a local user in
+// a room that we aren't joined to, such as a knock that was sent over
+// federation, along with the servers to ask to withdraw a knock. Since the
+// event won't pass through the roomserver input, the returned output event
+// is used to tell downstream components about it.
+func storeOutOfRoomMembership(
+	ctx context.Context, db storage.Database,
+	event *types.HeaderedEvent, membership tables.MembershipState,
+	knockServers []spec.ServerName,
+) ([]api.OutputEvent, error) {
+	updater, err := db.MembershipUpdater(ctx, event.RoomID().String(), *event.StateKey(), true, event.Version())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.MembershipUpdater: %w", err)
+	}
+	if _, _, err = updater.Update(membership, &types.Event{
+		EventNID: 0,
+		PDU:      event.PDU,
+	}); err != nil {
+		_ = updater.Rollback()
+		return nil, fmt.Errorf("updater.Update: %w", err)
+	}
+	if membership == tables.MembershipStateKnock {
+		if err = updater.SetKnockServers(knockServers); err != nil {
+			_ = updater.Rollback()
+			return nil, fmt.Errorf("updater.SetKnockServers: %w", err)
+		}
+	}
+	if err = updater.Commit(); err != nil {
+		return nil, fmt.Errorf("updater.Commit: %w", err)
+	}
+	return []api.OutputEvent{
+		{
+			Type: api.OutputTypeNewRoomEvent,
+			NewRoomEvent: &api.OutputNewRoomEvent{
+				Event:             event,
+				AddsStateEventIDs: []string{event.EventID()},
+				SendAsServer:      api.DoNotSendToOtherServers,
+				HistoryVisibility: gomatrixserverlib.HistoryVisibilityShared,
+			},
+		},
+	}, nil
+}
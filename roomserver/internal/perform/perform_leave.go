@@ -26,6 +26,7 @@ import (
 	"github.com/ike20013/dendrite/roomserver/internal/helpers"
 	"github.com/ike20013/dendrite/roomserver/internal/input"
 	"github.com/ike20013/dendrite/roomserver/storage"
+	"github.com/ike20013/dendrite/roomserver/storage/tables"
 	"github.com/ike20013/dendrite/setup/config"
 	userapi "github.com/ike20013/dendrite/userapi/api"
 )
@@ -144,6 +145,11 @@ func (r *Leaver) performLeaveRoomByID(
 		return nil, err
 	}
 	if !latestRes.RoomExists {
+		// If we knocked on the room over federation then we won't know
+		// about the room, so the knock has to be rescinded remotely.
+		if r.isKnockPending(ctx, req.RoomID, *leaver) {
+			return r.performFederatedRescindKnock(ctx, req, *roomID, *leaver)
+		}
 		return nil, fmt.Errorf("room %q does not exist", req.RoomID)
 	}
 
@@ -155,7 +161,7 @@ func (r *Leaver) performLeaveRoomByID(
 	if err != nil {
 		return nil, fmt.Errorf("error getting membership: %w", err)
 	}
-	if membership != spec.Join && membership != spec.Invite {
+	if membership != spec.Join && membership != spec.Invite && membership != spec.Knock {
 		return nil, fmt.Errorf("user %q is not joined to the room (membership is %q)", req.Leaver.String(), membership)
 	}
 
@@ -217,6 +223,86 @@ func (r *Leaver) performLeaveRoomByID(
 	return nil, nil
 }
 
+func (r *Leaver) isKnockPending(
+	ctx context.Context, roomID string, leaver spec.SenderID,
+) bool {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil || info == nil {
+		return false
+	}
+	updater, err := r.DB.MembershipUpdater(ctx, roomID, string(leaver), true, info.RoomVersion)
+	if err != nil {
+		return false
+	}
+	defer updater.Rollback() // nolint:errcheck
+	return updater.IsKnock()
+}
+
+// knockServers returns the servers to ask to withdraw a knock: those stored
+// when the knock was accepted, falling back to the server that created the room.
+func (r *Leaver) knockServers(
+	ctx context.Context, roomID spec.RoomID, leaver spec.SenderID,
+) ([]spec.ServerName, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID.String())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("room %q does not exist", roomID.String())
+	}
+	updater, err := r.DB.MembershipUpdater(ctx, roomID.String(), string(leaver), true, info.RoomVersion)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.MembershipUpdater: %w", err)
+	}
+	defer updater.Rollback() // nolint:errcheck
+	servers, err := updater.KnockServers()
+	if err != nil {
+		return nil, fmt.Errorf("updater.KnockServers: %w", err)
+	}
+	for _, serverName := range servers {
+		if serverName == roomID.Domain() {
+			return servers, nil
+		}
+	}
+	return append(servers, roomID.Domain()), nil
+}
+
+func (r *Leaver) performFederatedRescindKnock(
+	ctx context.Context,
+	req *api.PerformLeaveRequest,
+	roomID spec.RoomID,
+	leaver spec.SenderID,
+) ([]api.OutputEvent, error) {
+	servers, err := r.knockServers(ctx, roomID, leaver)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask the server that accepted the knock first, since it is the most
+	// likely to still be in the room, then the others that we know of.
+	leaveRes := fsAPI.PerformLeaveResponse{}
+	for _, serverNames := range [][]spec.ServerName{servers[:1], servers[1:]} {
+		if len(serverNames) == 0 {
+			continue
+		}
+		leaveReq := fsAPI.PerformLeaveRequest{
+			RoomID:      req.RoomID,
+			UserID:      req.Leaver.String(),
+			ServerNames: serverNames,
+		}
+		if err = r.FSAPI.PerformLeave(ctx, &leaveReq, &leaveRes); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("r.FSAPI.PerformLeave: %w", err)
+	}
+	if leaveRes.Event == nil {
+		return nil, fmt.Errorf("no leave event returned for room %q", req.RoomID)
+	}
+	return storeOutOfRoomMembership(ctx, r.DB, leaveRes.Event, tables.MembershipStateLeaveOrBan, nil)
+}
+
 func (r *Leaver) performFederatedRejectInvite(
 	ctx context.Context,
 	req *api.PerformLeaveRequest,
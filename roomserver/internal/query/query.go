@@ -1043,6 +1043,82 @@ func (r *Queryer) QueryRestrictedJoinAllowed(ctx context.Context, roomID spec.Ro
 	return verImpl.CheckRestrictedJoin(ctx, r.Cfg.Global.ServerName, &api.JoinRoomQuerier{Roomserver: r}, roomID, senderID)
 }
 
+func (r *Queryer) QueryTimestampToEvent(
+	ctx context.Context, roomID spec.RoomID, ts spec.Timestamp, backwards bool,
+) (*api.QueryTimestampToEventResponse, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, nil
+	}
+	eventID, originServerTS, err := r.DB.EventClosestToTimestamp(ctx, roomInfo.RoomNID, ts, backwards)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("r.DB.EventClosestToTimestamp: %w", err)
+	}
+	res := &api.QueryTimestampToEventResponse{
+		EventID:        eventID,
+		OriginServerTS: originServerTS,
+	}
+	// Any events we are missing would be between the timestamp and the event,
+	// so look for a gap on the side of the event facing the timestamp.
+	if backwards {
+		res.NextToGap, err = r.isNextToForwardGap(ctx, roomInfo, eventID)
+	} else {
+		res.NextToGap, err = r.isNextToBackwardGap(ctx, roomInfo, eventID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// isNextToBackwardGap returns true if we don't have all of the prev events of
+// the event, or the state at them.
+func (r *Queryer) isNextToBackwardGap(ctx context.Context, roomInfo *types.RoomInfo, eventID string) (bool, error) {
+	events, err := r.DB.EventsFromIDs(ctx, roomInfo, []string{eventID})
+	if err != nil {
+		return false, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	if len(events) == 0 {
+		return false, fmt.Errorf("event %s not found", eventID)
+	}
+	prevEventIDs := events[0].PrevEventIDs()
+	if len(prevEventIDs) == 0 {
+		return false, nil
+	}
+	if _, err = r.DB.StateAtEventIDs(ctx, prevEventIDs); err != nil {
+		var missingErr types.MissingEventError
+		if errors.As(err, &missingErr) {
+			return true, nil
+		}
+		return false, fmt.Errorf("r.DB.StateAtEventIDs: %w", err)
+	}
+	return false, nil
+}
+
+// isNextToForwardGap returns true if the event isn't one of the latest events
+// in the room, but we don't know of any event which follows it.
+func (r *Queryer) isNextToForwardGap(ctx context.Context, roomInfo *types.RoomInfo, eventID string) (bool, error) {
+	latestEventIDs, _, _, err := r.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return false, fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	for _, latestEventID := range latestEventIDs {
+		if latestEventID == eventID {
+			return false, nil
+		}
+	}
+	referenced, err := r.DB.IsEventReferenced(ctx, eventID)
+	if err != nil {
+		return false, err
+	}
+	return !referenced, nil
+}
+
 func (r *Queryer) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
 	version, err := r.DB.GetRoomVersion(ctx, roomID.String())
 	if err != nil {
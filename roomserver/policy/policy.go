@@ -0,0 +1,260 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package policy enforces the moderation policy lists published in policy rooms,
+// see https://spec.matrix.org/v1.11/client-server-api/#moderation-policy-lists
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/roomserver/storage/tables"
+)
+
+const (
+	MPolicyRuleUser   = "m.policy.rule.user"
+	MPolicyRuleRoom   = "m.policy.rule.room"
+	MPolicyRuleServer = "m.policy.rule.server"
+
+	RecommendationBan = "m.ban"
+	// Used by policy lists which predate the spec
+	recommendationBanUnstable = "org.matrix.mjolnir.ban"
+)
+
+// IsPolicyRuleType returns whether events of the given type are policy rules.
+func IsPolicyRuleType(eventType string) bool {
+	switch eventType {
+	case MPolicyRuleUser, MPolicyRuleRoom, MPolicyRuleServer:
+		return true
+	}
+	return false
+}
+
+type Database interface {
+	// GetBulkStateContent returns all state events which match a given room ID and a given state key tuple.
+	GetBulkStateContent(ctx context.Context, roomIDs []string, tuples []gomatrixserverlib.StateKeyTuple, allowWildcards bool) ([]tables.StrippedEvent, error)
+}
+
+var ruleTuples = []gomatrixserverlib.StateKeyTuple{
+	{EventType: MPolicyRuleUser, StateKey: "*"},
+	{EventType: MPolicyRuleRoom, StateKey: "*"},
+	{EventType: MPolicyRuleServer, StateKey: "*"},
+}
+
+type ruleKey struct {
+	roomID    string
+	eventType string
+	stateKey  string
+}
+
+type rule struct {
+	api.PolicyRule
+	// nil if the entity doesn't contain any wildcards
+	entity *regexp.Regexp
+}
+
+func (r *rule) matches(s string) bool {
+	if r.entity == nil {
+		return r.Entity == s
+	}
+	return r.entity.MatchString(s)
+}
+
+// PolicyLists holds the ban rules of the policy rooms that the server watches.
+type PolicyLists struct {
+	db          Database
+	policyRooms map[string]struct{}
+	rules       map[ruleKey]*rule
+	rulesMutex  sync.RWMutex // protects the above
+}
+
+func NewPolicyLists(db Database, policyRooms []string) *PolicyLists {
+	p := &PolicyLists{
+		db:          db,
+		policyRooms: make(map[string]struct{}, len(policyRooms)),
+		rules:       make(map[ruleKey]*rule),
+	}
+	if len(policyRooms) == 0 {
+		return p
+	}
+	for _, roomID := range policyRooms {
+		p.policyRooms[roomID] = struct{}{}
+	}
+
+	logrus.Infof("Loading policy lists...")
+	start := time.Now()
+	events, err := db.GetBulkStateContent(context.TODO(), policyRooms, ruleTuples, true)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to get policy rules for all policy rooms")
+	}
+	for _, event := range events {
+		p.OnPolicyUpdate(event)
+	}
+	logrus.WithFields(logrus.Fields{
+		"duration": time.Since(start),
+		"rules":    len(events),
+	}).Info("Finished loading policy lists")
+	return p
+}
+
+// IsPolicyRoom returns whether the server watches the rules in the given room.
+func (p *PolicyLists) IsPolicyRoom(roomID string) bool {
+	_, ok := p.policyRooms[roomID]
+	return ok
+}
+
+// Reload replaces the rules of a policy room with those in its current state,
+// e.g. once the server has joined the room.
+func (p *PolicyLists) Reload(ctx context.Context, roomID string) error {
+	if !p.IsPolicyRoom(roomID) {
+		return nil
+	}
+	events, err := p.db.GetBulkStateContent(ctx, []string{roomID}, ruleTuples, true)
+	if err != nil {
+		return err
+	}
+	p.rulesMutex.Lock()
+	for key := range p.rules {
+		if key.roomID == roomID {
+			delete(p.rules, key)
+		}
+	}
+	p.rulesMutex.Unlock()
+	for _, event := range events {
+		p.OnPolicyUpdate(event)
+	}
+	return nil
+}
+
+// OnPolicyUpdate adds, replaces or removes the rule set by a policy rule
+// state event. Events which aren't in a policy room are ignored.
+func (p *PolicyLists) OnPolicyUpdate(strippedEvent tables.StrippedEvent) {
+	if !p.IsPolicyRoom(strippedEvent.RoomID) || !IsPolicyRuleType(strippedEvent.EventType) {
+		return
+	}
+	key := ruleKey{
+		roomID:    strippedEvent.RoomID,
+		eventType: strippedEvent.EventType,
+		stateKey:  strippedEvent.StateKey,
+	}
+	var content struct {
+		Entity         string `json:"entity"`
+		Reason         string `json:"reason"`
+		Recommendation string `json:"recommendation"`
+	}
+	// Rules are removed by replacing them with an event with empty content, and
+	// rules with recommendations other than bans have no effect.
+	if err := json.Unmarshal([]byte(strippedEvent.ContentValue), &content); err != nil ||
+		content.Entity == "" ||
+		(content.Recommendation != RecommendationBan && content.Recommendation != recommendationBanUnstable) {
+		p.rulesMutex.Lock()
+		delete(p.rules, key)
+		p.rulesMutex.Unlock()
+		return
+	}
+	r := &rule{
+		PolicyRule: api.PolicyRule{
+			PolicyRoomID:   strippedEvent.RoomID,
+			Type:           strippedEvent.EventType,
+			StateKey:       strippedEvent.StateKey,
+			Entity:         content.Entity,
+			Recommendation: content.Recommendation,
+			Reason:         content.Reason,
+		},
+	}
+	if strings.ContainsAny(content.Entity, "*?") {
+		expr, err := compileGlob(content.Entity)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to compile policy rule %q in %q", content.Entity, strippedEvent.RoomID)
+			return
+		}
+		r.entity = expr
+	}
+	p.rulesMutex.Lock()
+	p.rules[key] = r
+	p.rulesMutex.Unlock()
+}
+
+// compileGlob turns an entity with * (zero or more characters) and ? (exactly
+// one character) wildcards into a regular expression matching the whole string.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	escaped := regexp.QuoteMeta(glob)
+	escaped = strings.Replace(escaped, "\\?", ".", -1)
+	escaped = strings.Replace(escaped, "\\*", ".*", -1)
+	return regexp.Compile("^" + escaped + "$")
+}
+
+func (p *PolicyLists) match(eventType, entity string) *api.PolicyRule {
+	p.rulesMutex.RLock()
+	defer p.rulesMutex.RUnlock()
+	for key, r := range p.rules {
+		if key.eventType == eventType && r.matches(entity) {
+			matched := r.PolicyRule
+			return &matched
+		}
+	}
+	return nil
+}
+
+// MatchServer returns the rule which bans the server, if any.
+func (p *PolicyLists) MatchServer(serverName spec.ServerName) *api.PolicyRule {
+	// Like server ACLs, rules apply to the hostname without the port.
+	if host, _, err := net.SplitHostPort(string(serverName)); err == nil {
+		serverName = spec.ServerName(host)
+	}
+	return p.match(MPolicyRuleServer, string(serverName))
+}
+
+// MatchUser returns the rule which bans the user or their server, if any.
+func (p *PolicyLists) MatchUser(userID spec.UserID) *api.PolicyRule {
+	if matched := p.match(MPolicyRuleUser, userID.String()); matched != nil {
+		return matched
+	}
+	return p.MatchServer(userID.Domain())
+}
+
+// MatchRoom returns the rule which bans the room, if any.
+func (p *PolicyLists) MatchRoom(roomID spec.RoomID) *api.PolicyRule {
+	return p.match(MPolicyRuleRoom, roomID.String())
+}
+
+// IsServerBanned implements acls.ServerBans.
+func (p *PolicyLists) IsServerBanned(serverName spec.ServerName) bool {
+	return p.MatchServer(serverName) != nil
+}
+
+// Rules returns the active rules, optionally only those from one policy room.
+func (p *PolicyLists) Rules(policyRoomID string) []api.PolicyRule {
+	p.rulesMutex.RLock()
+	rules := make([]api.PolicyRule, 0, len(p.rules))
+	for key, r := range p.rules {
+		if policyRoomID == "" || key.roomID == policyRoomID {
+			rules = append(rules, r.PolicyRule)
+		}
+	}
+	p.rulesMutex.RUnlock()
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].PolicyRoomID != rules[j].PolicyRoomID {
+			return rules[i].PolicyRoomID < rules[j].PolicyRoomID
+		}
+		if rules[i].Type != rules[j].Type {
+			return rules[i].Type < rules[j].Type
+		}
+		return rules[i].StateKey < rules[j].StateKey
+	})
+	return rules
+}
@@ -0,0 +1,126 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/ike20013/dendrite/roomserver/storage/tables"
+)
+
+const policyRoomID = "!policy:test"
+
+type dummyPolicyDB struct {
+	events []tables.StrippedEvent
+}
+
+func (d *dummyPolicyDB) GetBulkStateContent(_ context.Context, roomIDs []string, _ []gomatrixserverlib.StateKeyTuple, _ bool) ([]tables.StrippedEvent, error) {
+	var events []tables.StrippedEvent
+	for _, event := range d.events {
+		for _, roomID := range roomIDs {
+			if event.RoomID == roomID {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+func ruleEvent(t *testing.T, roomID, eventType, stateKey string, content map[string]string) tables.StrippedEvent {
+	t.Helper()
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tables.StrippedEvent{
+		RoomID:       roomID,
+		EventType:    eventType,
+		StateKey:     stateKey,
+		ContentValue: string(contentJSON),
+	}
+}
+
+func banRule(t *testing.T, eventType, stateKey, entity string) tables.StrippedEvent {
+	return ruleEvent(t, policyRoomID, eventType, stateKey, map[string]string{
+		"entity":         entity,
+		"recommendation": RecommendationBan,
+		"reason":         "spam",
+	})
+}
+
+func TestPolicyLists(t *testing.T) {
+	db := &dummyPolicyDB{events: []tables.StrippedEvent{
+		banRule(t, MPolicyRuleUser, "rule1", "@spammer:test"),
+		banRule(t, MPolicyRuleUser, "rule2", "@bot*:example.com"),
+		banRule(t, MPolicyRuleRoom, "rule3", "!spam:test"),
+		banRule(t, MPolicyRuleServer, "rule4", "*.evil.com"),
+		ruleEvent(t, policyRoomID, MPolicyRuleUser, "rule5", map[string]string{
+			"entity":         "@alice:test",
+			"recommendation": "org.example.mute",
+		}),
+		// Not a watched policy room
+		ruleEvent(t, "!other:test", MPolicyRuleUser, "rule1", map[string]string{
+			"entity":         "@bob:test",
+			"recommendation": RecommendationBan,
+		}),
+	}}
+	p := NewPolicyLists(db, []string{policyRoomID})
+
+	users := map[string]bool{
+		"@spammer:test":        true,
+		"@spammer2:test":       false,
+		"@bot123:example.com":  true,
+		"@robot:example.com":   false,
+		"@alice:test":          false,
+		"@bob:test":            false,
+		"@anyone:a.evil.com":   true,
+		"@anyone:evil.com":     false,
+		"@anyone:a.evil.com.x": false,
+	}
+	for userID, wantBanned := range users {
+		if banned := p.MatchUser(spec.NewUserIDOrPanic(userID, true)) != nil; banned != wantBanned {
+			t.Errorf("expected %s banned=%v, got %v", userID, wantBanned, banned)
+		}
+	}
+
+	if !p.IsServerBanned("matrix.evil.com:8448") {
+		t.Errorf("expected matrix.evil.com:8448 to be banned")
+	}
+	if p.IsServerBanned("good.com") {
+		t.Errorf("expected good.com not to be banned")
+	}
+
+	spamRoom, err := spec.NewRoomID("!spam:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := p.MatchRoom(*spamRoom); rule == nil || rule.PolicyRoomID != policyRoomID || rule.Reason != "spam" {
+		t.Errorf("expected !spam:test to be banned by %s, got %+v", policyRoomID, rule)
+	}
+
+	if rules := p.Rules(""); len(rules) != 4 {
+		t.Fatalf("expected 4 rules, got %+v", rules)
+	}
+	if rules := p.Rules("!other:test"); len(rules) != 0 {
+		t.Fatalf("expected no rules for !other:test, got %+v", rules)
+	}
+
+	// Rules are removed by replacing them with empty content.
+	p.OnPolicyUpdate(ruleEvent(t, policyRoomID, MPolicyRuleUser, "rule1", map[string]string{}))
+	if p.MatchUser(spec.NewUserIDOrPanic("@spammer:test", true)) != nil {
+		t.Errorf("expected @spammer:test not to be banned after the rule was removed")
+	}
+
+	// Reloading replaces the rules with those in the room state.
+	db.events = []tables.StrippedEvent{banRule(t, MPolicyRuleUser, "rule6", "@new:test")}
+	if err = p.Reload(context.Background(), policyRoomID); err != nil {
+		t.Fatal(err)
+	}
+	rules := p.Rules(policyRoomID)
+	if len(rules) != 1 || rules[0].Entity != "@new:test" {
+		t.Fatalf("expected only the rule for @new:test, got %+v", rules)
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/ike20013/dendrite/roomserver/acls"
 	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/roomserver/policy"
 	"github.com/ike20013/dendrite/setup/jetstream"
 )
 
@@ -26,9 +27,10 @@ var keyContentFields = map[string]string{
 }
 
 type RoomEventProducer struct {
-	Topic     string
-	ACLs      *acls.ServerACLs
-	JetStream nats.JetStreamContext
+	Topic       string
+	ACLs        *acls.ServerACLs
+	PolicyLists *policy.PolicyLists
+	JetStream   nats.JetStreamContext
 }
 
 func (r *RoomEventProducer) ProduceRoomEvents(roomID string, updates []api.OutputEvent) error {
@@ -76,6 +78,17 @@ func (r *RoomEventProducer) ProduceRoomEvents(roomID string, updates []api.Outpu
 				}
 				defer r.ACLs.OnServerACLUpdate(strippedEvent)
 			}
+
+			if r.PolicyLists != nil && policy.IsPolicyRuleType(eventType) && update.NewRoomEvent.Event.StateKey() != nil {
+				ev := update.NewRoomEvent.Event.PDU
+				strippedEvent := tables.StrippedEvent{
+					RoomID:       ev.RoomID().String(),
+					EventType:    ev.Type(),
+					StateKey:     *ev.StateKey(),
+					ContentValue: string(ev.Content()),
+				}
+				defer r.PolicyLists.OnPolicyUpdate(strippedEvent)
+			}
 		}
 		logger.Tracef("Producing to topic '%s'", r.Topic)
 		if _, err := r.JetStream.PublishMsg(msg); err != nil {
@@ -8,6 +8,7 @@ package roomserver
 
 import (
 	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/jetstream"
@@ -23,12 +24,14 @@ import (
 //
 // Many of the methods provided by this API depend on access to a federation API, and so
 // you may wish to call `SetFederationAPI` on the returned struct to avoid nil-dereference errors.
+// The spam checker, which may be nil, is consulted for new events, joins and invites.
 func NewInternalAPI(
 	processContext *process.ProcessContext,
 	cfg *config.Dendrite,
 	cm *sqlutil.Connections,
 	natsInstance *jetstream.NATSInstance,
 	caches caching.RoomServerCaches,
+	spamChecker spamcheck.Checker,
 	enableMetrics bool,
 ) api.RoomserverInternalAPI {
 	roomserverDB, err := storage.Open(processContext.Context(), cm, &cfg.RoomServer.Database, caches)
@@ -39,6 +42,6 @@ func NewInternalAPI(
 	js, nc := natsInstance.Prepare(processContext, &cfg.Global.JetStream)
 
 	return internal.NewRoomserverAPI(
-		processContext, cfg, roomserverDB, js, nc, caches, enableMetrics,
+		processContext, cfg, roomserverDB, js, nc, caches, spamChecker, enableMetrics,
 	)
 }
@@ -3,6 +3,7 @@ package roomserver_test
 import (
 	"context"
 	"crypto/ed25519"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/ike20013/dendrite/external/caching"
 	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/external/httputil"
+	"github.com/ike20013/dendrite/external/spamcheck"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/federationapi/statistics"
 	"github.com/ike20013/dendrite/roomserver/internal/input"
@@ -28,6 +30,8 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/ike20013/dendrite/federationapi"
+	fsAPI "github.com/ike20013/dendrite/federationapi/api"
+	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/setup/jetstream"
 	"github.com/ike20013/dendrite/syncapi"
 
@@ -57,7 +61,7 @@ func TestUsers(t *testing.T) {
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
 		natsInstance := jetstream.NATSInstance{}
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		// SetFederationAPI starts the room event input consumer
 		rsAPI.SetFederationAPI(nil, nil)
 
@@ -198,7 +202,7 @@ func Test_QueryLeftUsers(t *testing.T) {
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
 		natsInstance := jetstream.NATSInstance{}
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		// SetFederationAPI starts the room event input consumer
 		rsAPI.SetFederationAPI(nil, nil)
 		// Create the room
@@ -260,7 +264,7 @@ func TestPurgeRoom(t *testing.T) {
 		jsCtx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
 		defer jetstream.DeleteAllStreams(jsCtx, &cfg.Global.JetStream)
 
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 
 		// this starts the JetStream consumers
 		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, rsAPI, caches, nil, true)
@@ -544,7 +548,7 @@ func TestRedaction(t *testing.T) {
 		}
 
 		natsInstance := &jetstream.NATSInstance{}
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, nil, caching.DisableMetrics)
 
 		for _, tc := range testCases {
 			t.Run(tc.name, func(t *testing.T) {
@@ -732,7 +736,7 @@ func TestQueryRestrictedJoinAllowed(t *testing.T) {
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
 
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 
 		for _, tc := range testCases {
@@ -1056,7 +1060,7 @@ func TestUpgrade(t *testing.T) {
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
 
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		rsAPI.SetUserAPI(userAPI)
@@ -1108,7 +1112,7 @@ func TestStateReset(t *testing.T) {
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		natsInstance := jetstream.NATSInstance{}
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 
 		// create a new room
@@ -1214,7 +1218,7 @@ func TestNewServerACLs(t *testing.T) {
 		natsInstance := &jetstream.NATSInstance{}
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
 		// start JetStream listeners
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 
 		// let the RS create the events
@@ -1269,7 +1273,7 @@ func TestRoomConsumerRecreation(t *testing.T) {
 
 	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
 	// start JetStream listeners
-	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, nil, caching.DisableMetrics)
 	rsAPI.SetFederationAPI(nil, nil)
 
 	// let the RS create the events, this also recreates the Consumers
@@ -1304,7 +1308,7 @@ func TestRoomsWithACLs(t *testing.T) {
 		natsInstance := &jetstream.NATSInstance{}
 		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
 		// start JetStream listeners
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 
 		for _, room := range []*test.Room{noACLRoom, aclRoom} {
@@ -1319,3 +1323,289 @@ func TestRoomsWithACLs(t *testing.T) {
 		assert.Equal(t, []string{aclRoom.ID}, roomsWithACLs)
 	})
 }
+
+func TestQueryTimestampToEvent(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	base := time.Now().Add(time.Hour)
+	first := room.CreateAndInsert(t, alice, "m.room.message", map[string]any{"body": "first"}, test.WithTimestamp(base))
+	second := room.CreateAndInsert(t, alice, "m.room.message", map[string]any{"body": "second"}, test.WithTimestamp(base.Add(time.Minute)))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false)
+		assert.NoError(t, err)
+
+		roomID, err := spec.NewRoomID(room.ID)
+		assert.NoError(t, err)
+		ts := spec.AsTimestamp(base)
+
+		testCases := []struct {
+			name      string
+			ts        spec.Timestamp
+			backwards bool
+			want      *types.HeaderedEvent
+		}{
+			{name: "forwards before the first message", ts: ts - 1, want: first},
+			{name: "forwards between messages", ts: ts + 1, want: second},
+			{name: "forwards after the last message", ts: ts + 120000},
+			{name: "backwards between messages", ts: ts + 1, backwards: true, want: first},
+			{name: "backwards after the last message", ts: ts + 120000, backwards: true, want: second},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				res, err := rsAPI.QueryTimestampToEvent(ctx, *roomID, tc.ts, tc.backwards)
+				assert.NoError(t, err)
+				if tc.want == nil {
+					assert.Nil(t, res)
+					return
+				}
+				assert.NotNil(t, res)
+				assert.Equal(t, tc.want.EventID(), res.EventID)
+				assert.Equal(t, tc.want.OriginServerTS(), res.OriginServerTS)
+				assert.False(t, res.NextToGap)
+			})
+		}
+
+		unknownRoomID, err := spec.NewRoomID("!unknown:test")
+		assert.NoError(t, err)
+		res, err := rsAPI.QueryTimestampToEvent(ctx, *unknownRoomID, ts, false)
+		assert.NoError(t, err)
+		assert.Nil(t, res)
+	})
+}
+
+// knockFederationAPI pretends to knock and leave through remote servers.
+type knockFederationAPI struct {
+	fsAPI.RoomserverFederationAPI
+	knockEvent  *types.HeaderedEvent
+	knockState  []gomatrixserverlib.InviteStrippedState
+	leaveEvent  *types.HeaderedEvent
+	unreachable spec.ServerName
+	knockedWith []spec.ServerName
+	leftWith    [][]spec.ServerName
+}
+
+func (f *knockFederationAPI) PerformKnock(ctx context.Context, req *fsAPI.PerformKnockRequest, res *fsAPI.PerformKnockResponse) error {
+	f.knockedWith = req.ServerNames
+	res.KnockedVia = req.ServerNames[0]
+	res.Event = f.knockEvent
+	res.KnockRoomState = f.knockState
+	return nil
+}
+
+func (f *knockFederationAPI) PerformLeave(ctx context.Context, req *fsAPI.PerformLeaveRequest, res *fsAPI.PerformLeaveResponse) error {
+	f.leftWith = append(f.leftWith, req.ServerNames)
+	for _, serverName := range req.ServerNames {
+		if serverName != f.unreachable {
+			res.Event = f.leaveEvent
+			return nil
+		}
+	}
+	return fmt.Errorf("server %s is unreachable", f.unreachable)
+}
+
+func TestPerformKnock(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	bobID, err := spec.NewUserID(bob.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knockRoom := test.NewRoom(t, alice)
+	knockRoom.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": spec.Knock,
+	}, test.WithStateKey(""))
+	publicRoom := test.NewRoom(t, alice)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		for _, room := range []*test.Room{knockRoom, publicRoom} {
+			if err = api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		t.Run("knock on a local room", func(t *testing.T) {
+			roomID, err := rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+				RoomIDOrAlias: knockRoom.ID,
+				UserID:        bob.ID,
+				Reason:        "let me in",
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, knockRoom.ID, roomID)
+
+			res := api.QueryMembershipForUserResponse{}
+			err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+				RoomID: knockRoom.ID,
+				UserID: *bobID,
+			}, &res)
+			assert.NoError(t, err)
+			assert.Equal(t, spec.Knock, res.Membership)
+		})
+
+		t.Run("knock on a local room which doesn't allow knocking", func(t *testing.T) {
+			_, err := rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+				RoomIDOrAlias: publicRoom.ID,
+				UserID:        bob.ID,
+			})
+			assert.Error(t, err)
+		})
+
+		t.Run("knock as a remote user", func(t *testing.T) {
+			_, err := rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+				RoomIDOrAlias: knockRoom.ID,
+				UserID:        "@someone:remote",
+			})
+			assert.Error(t, err)
+		})
+	})
+}
+
+func TestPerformFederatedKnock(t *testing.T) {
+	charlie := test.NewUser(t, test.WithSigningServer("remote", "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t)
+	bobID, err := spec.NewUserID(bob.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := test.NewRoom(t, charlie)
+	room.CreateAndInsert(t, charlie, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": spec.Knock,
+	}, test.WithStateKey(""))
+	knock := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Knock,
+	}, test.WithStateKey(bob.ID))
+	leave := room.CreateEvent(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Leave,
+	}, test.WithStateKey(bob.ID))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		db, err := storage.Open(processCtx.Context(), cm, &cfg.RoomServer.Database, caches)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
+
+		// The room's own server is gone, so the knock can only be withdrawn
+		// through the server that accepted it.
+		fedAPI := &knockFederationAPI{
+			knockEvent:  knock,
+			knockState:  []gomatrixserverlib.InviteStrippedState{gomatrixserverlib.NewInviteStrippedState(room.Events()[0].PDU)},
+			leaveEvent:  leave,
+			unreachable: "remote",
+		}
+		rsAPI.SetFederationAPI(fedAPI, nil)
+
+		roomID, err := rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+			RoomIDOrAlias: room.ID,
+			UserID:        bob.ID,
+			ServerNames:   []spec.ServerName{"via", "test"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, room.ID, roomID)
+		assert.Equal(t, []spec.ServerName{"via", "remote"}, fedAPI.knockedWith)
+
+		updater, err := db.MembershipUpdater(ctx, room.ID, bob.ID, true, room.Version)
+		assert.NoError(t, err)
+		assert.True(t, updater.IsKnock())
+		servers, err := updater.KnockServers()
+		assert.NoError(t, err)
+		assert.Equal(t, []spec.ServerName{"via", "remote"}, servers)
+		assert.NoError(t, updater.Rollback())
+
+		err = rsAPI.PerformLeave(ctx, &api.PerformLeaveRequest{
+			RoomID: room.ID,
+			Leaver: *bobID,
+		}, &api.PerformLeaveResponse{})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]spec.ServerName{{"via"}}, fedAPI.leftWith)
+
+		updater, err = db.MembershipUpdater(ctx, room.ID, bob.ID, true, room.Version)
+		assert.NoError(t, err)
+		assert.True(t, updater.IsLeave())
+		servers, err = updater.KnockServers()
+		assert.NoError(t, err)
+		assert.Nil(t, servers)
+		assert.NoError(t, updater.Rollback())
+	})
+}
+
+func TestSpamChecker(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	checker, err := spamcheck.New(&config.SpamChecker{
+		Enabled:           true,
+		BlockedUsers:      []string{"^" + bob.ID + "$"},
+		EventBodyPatterns: []string{"(?i)buy cheap"},
+	})
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, checker, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false)
+		assert.NoError(t, err)
+
+		latestEvents := func(t *testing.T) []string {
+			t.Helper()
+			res := &api.QueryLatestEventsAndStateResponse{}
+			err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: room.ID}, res)
+			assert.NoError(t, err)
+			return res.LatestEvents
+		}
+
+		t.Run("new events are checked", func(t *testing.T) {
+			hello := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"msgtype": "m.text", "body": "hello"})
+			err := api.SendEvents(ctx, rsAPI, api.KindNew, []*types.HeaderedEvent{hello}, "test", "test", "test", nil, false)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{hello.EventID()}, latestEvents(t))
+
+			// Denied events are soft-failed, so they don't become part of the room.
+			spam := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"msgtype": "m.text", "body": "Buy cheap watches"})
+			err = api.SendEvents(ctx, rsAPI, api.KindNew, []*types.HeaderedEvent{spam}, "test", "test", "test", nil, false)
+			assert.ErrorContains(t, err, "probable spam")
+			assert.Equal(t, []string{hello.EventID()}, latestEvents(t))
+		})
+
+		t.Run("joins are checked", func(t *testing.T) {
+			_, _, err := rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{RoomIDOrAlias: room.ID, UserID: bob.ID})
+			var notAllowed api.ErrNotAllowed
+			assert.ErrorAs(t, err, &notAllowed)
+		})
+	})
+}
@@ -142,6 +142,12 @@ type Database interface {
 	GetPublishedRooms(ctx context.Context, networkID string, includeAllNetworks bool) ([]string, error)
 	// Returns whether a given room is published or not.
 	GetPublishedRoom(ctx context.Context, roomID string) (bool, error)
+	// SetRoomBlocked blocks or unblocks local users from joining a room.
+	SetRoomBlocked(ctx context.Context, roomID, blockedBy string, blocked bool) error
+	// GetRoomBlocked returns whether local users are blocked from joining a room, and by whom.
+	GetRoomBlocked(ctx context.Context, roomID string) (blockedBy string, blocked bool, err error)
+	// RoomIDs returns the IDs of all the rooms which the server has the create event of.
+	RoomIDs(ctx context.Context) ([]string, error)
 
 	// TODO: factor out - from currentstateserver
 
@@ -187,6 +193,15 @@ type Database interface {
 
 	// RoomsWithACLs returns all room IDs for rooms with ACLs
 	RoomsWithACLs(ctx context.Context) ([]string, error)
+	// EventClosestToTimestamp returns the ID and timestamp of the event in the room which is closest
+	// to the given timestamp, at or after it, or at or before it if backwards is true.
+	// Returns sql.ErrNoRows if there is no such event.
+	EventClosestToTimestamp(ctx context.Context, roomNID types.RoomNID, ts spec.Timestamp, backwards bool) (string, spec.Timestamp, error)
+	// EventNIDsInRoom returns up to `limit` NIDs of the events which the sender sent in the room's timeline
+	// after the given NID, at or after `from` and before `to`, where a `to` of 0 means no upper bound.
+	EventNIDsInRoom(ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID, afterNID types.EventNID, from, to spec.Timestamp, limit int) ([]types.EventNID, error)
+	// IsEventReferenced returns true if we know of an event which has the given event as a prev event.
+	IsEventReferenced(ctx context.Context, eventID string) (bool, error)
 	// GetBulkStateACLs returns all server ACLs for the given rooms.
 	GetBulkStateACLs(ctx context.Context, roomIDs []string) ([]tables.StrippedEvent, error)
 	QueryAdminEventReports(ctx context.Context, from uint64, limit uint64, backwards bool, userID string, roomID string) ([]api.QueryAdminEventReportsResponse, int64, error)
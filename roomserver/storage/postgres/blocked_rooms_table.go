@@ -0,0 +1,86 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const blockedRoomsSchema = `
+-- Stores which rooms local users can't join, as set by server admins
+CREATE TABLE IF NOT EXISTS roomserver_blocked_rooms (
+    -- The room ID of the room
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- The admin who blocked the room
+    blocked_by TEXT NOT NULL,
+    -- When the room was blocked
+    blocked_ts BIGINT NOT NULL
+);
+`
+
+const upsertBlockedRoomSQL = "" +
+	"INSERT INTO roomserver_blocked_rooms (room_id, blocked_by, blocked_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_id) DO UPDATE SET blocked_by = $2, blocked_ts = $3"
+
+const deleteBlockedRoomSQL = "" +
+	"DELETE FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+const selectBlockedRoomSQL = "" +
+	"SELECT blocked_by FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+type blockedRoomsStatements struct {
+	upsertBlockedRoomStmt *sql.Stmt
+	deleteBlockedRoomStmt *sql.Stmt
+	selectBlockedRoomStmt *sql.Stmt
+}
+
+func CreateBlockedRoomsTable(db *sql.DB) error {
+	_, err := db.Exec(blockedRoomsSchema)
+	return err
+}
+
+func PrepareBlockedRoomsTable(db *sql.DB) (tables.BlockedRooms, error) {
+	s := &blockedRoomsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertBlockedRoomStmt, upsertBlockedRoomSQL},
+		{&s.deleteBlockedRoomStmt, deleteBlockedRoomSQL},
+		{&s.selectBlockedRoomStmt, selectBlockedRoomSQL},
+	}.Prepare(db)
+}
+
+func (s *blockedRoomsStatements) UpsertBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID, blockedBy string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertBlockedRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID, blockedBy, spec.AsTimestamp(time.Now()))
+	return err
+}
+
+func (s *blockedRoomsStatements) DeleteBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteBlockedRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) SelectBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (blockedBy string, blocked bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectBlockedRoomStmt)
+	err = stmt.QueryRowContext(ctx, roomID).Scan(&blockedBy)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return blockedBy, err == nil, err
+}
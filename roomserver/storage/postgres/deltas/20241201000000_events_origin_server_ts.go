@@ -0,0 +1,39 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// UpAddEventsOriginServerTS adds the origin_server_ts column to the events
+// table, filling it in from the JSON of the events already stored.
+func UpAddEventsOriginServerTS(ctx context.Context, tx *sql.Tx) error {
+	// Tables created with the column already have it filled in, and the
+	// event JSON table may not exist yet, so only backfill when adding it.
+	var cName string
+	err := tx.QueryRowContext(ctx, "SELECT column_name FROM information_schema.columns WHERE table_name = 'roomserver_events' AND column_name = 'origin_server_ts'").Scan(&cName)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.ExecContext(ctx, `
+ALTER TABLE roomserver_events ADD COLUMN origin_server_ts BIGINT NOT NULL DEFAULT 0;
+UPDATE roomserver_events AS e SET origin_server_ts = COALESCE((j.event_json::jsonb->>'origin_server_ts')::BIGINT, 0)
+	FROM roomserver_event_json AS j WHERE j.event_nid = e.event_nid;`)
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to check for origin_server_ts: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS roomserver_events_origin_server_ts_idx ON roomserver_events (room_nid, origin_server_ts);")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
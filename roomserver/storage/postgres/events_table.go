@@ -19,6 +19,7 @@ import (
 	"github.com/ike20013/dendrite/roomserver/storage/tables"
 	"github.com/ike20013/dendrite/roomserver/types"
 	"github.com/lib/pq"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const eventsSchema = `
@@ -55,7 +56,11 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     event_id TEXT NOT NULL CONSTRAINT roomserver_event_id_unique UNIQUE,
     -- A list of numeric IDs for events that can authenticate this event.
 	auth_event_nids BIGINT[] NOT NULL,
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	-- The origin_server_ts of the event, used to find events by timestamp.
+	origin_server_ts BIGINT NOT NULL DEFAULT 0,
+	-- The sender ID of the event, used to find the events a user sent.
+	sender TEXT NOT NULL DEFAULT ''
 );
 
 -- Create an index which helps in resolving membership events (event_type_nid = 5) - (used for history visibility)
@@ -67,8 +72,8 @@ CREATE INDEX IF NOT EXISTS roomserver_event_state_key_nid_idx ON roomserver_even
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events AS e (room_nid, event_type_nid, event_state_key_nid, event_id, auth_event_nids, depth, is_rejected)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	"INSERT INTO roomserver_events AS e (room_nid, event_type_nid, event_state_key_nid, event_id, auth_event_nids, depth, is_rejected, origin_server_ts, sender)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
 	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique DO UPDATE" +
 	" SET is_rejected = $7 WHERE e.event_id = $4 AND e.is_rejected = TRUE" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -145,6 +150,23 @@ const selectEventRejectedSQL = "" +
 
 const selectRoomsWithEventTypeNIDSQL = `SELECT DISTINCT room_nid FROM roomserver_events WHERE event_type_nid = $1`
 
+// Events without state are outliers, which aren't part of the room timeline.
+const selectEventAfterTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts >= $2 AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT 1"
+
+const selectEventBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts <= $2 AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY origin_server_ts DESC, event_nid DESC LIMIT 1"
+
+const selectEventNIDsInRoomSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND sender = $2 AND event_nid > $3 AND origin_server_ts >= $4 AND ($5 = 0 OR origin_server_ts < $5)" +
+	" AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY event_nid ASC LIMIT $6"
+
 type eventStatements struct {
 	insertEventStmt                               *sql.Stmt
 	selectEventStmt                               *sql.Stmt
@@ -165,6 +187,9 @@ type eventStatements struct {
 	selectRoomNIDsForEventNIDsStmt                *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
 	selectRoomsWithEventTypeNIDStmt               *sql.Stmt
+	selectEventAfterTimestampStmt                 *sql.Stmt
+	selectEventBeforeTimestampStmt                *sql.Stmt
+	selectEventNIDsInRoomStmt                     *sql.Stmt
 }
 
 func CreateEventsTable(db *sql.DB) error {
@@ -179,6 +204,14 @@ func CreateEventsTable(db *sql.DB) error {
 			Version: "roomserver: drop column reference_sha from roomserver_events",
 			Up:      deltas.UpDropEventReferenceSHAEvents,
 		},
+		{
+			Version: "roomserver: add origin_server_ts to roomserver_events",
+			Up:      deltas.UpAddEventsOriginServerTS,
+		},
+		{
+			Version: "roomserver: add sender to roomserver_events",
+			Up:      deltas.UpAddEventsSender,
+		},
 	}...)
 	return m.Up(context.Background())
 }
@@ -206,6 +239,9 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
 		{&s.selectRoomsWithEventTypeNIDStmt, selectRoomsWithEventTypeNIDSQL},
+		{&s.selectEventAfterTimestampStmt, selectEventAfterTimestampSQL},
+		{&s.selectEventBeforeTimestampStmt, selectEventBeforeTimestampSQL},
+		{&s.selectEventNIDsInRoomStmt, selectEventNIDsInRoomSQL},
 	}.Prepare(db)
 }
 
@@ -219,6 +255,8 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	originServerTS spec.Timestamp,
+	senderID spec.SenderID,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
@@ -226,7 +264,7 @@ func (s *eventStatements) InsertEvent(
 	err := stmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
 		eventID, eventNIDsAsArray(authEventNIDs), depth,
-		isRejected,
+		isRejected, originServerTS, senderID,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -604,3 +642,36 @@ func (s *eventStatements) SelectRoomsWithEventTypeNID(
 
 	return roomNIDs, rows.Err()
 }
+
+// SelectEventClosestToTimestamp returns the event in the room whose timestamp is
+// closest to the given one, at or after it or, if backwards is true, at or
+// before it. Returns sql.ErrNoRows if there is no such event.
+func (s *eventStatements) SelectEventClosestToTimestamp(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts spec.Timestamp, backwards bool,
+) (eventID string, originServerTS spec.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventAfterTimestampStmt)
+	if backwards {
+		stmt = sqlutil.TxStmt(txn, s.selectEventBeforeTimestampStmt)
+	}
+	err = stmt.QueryRowContext(ctx, roomNID, ts).Scan(&eventID, &originServerTS)
+	return
+}
+
+func (s *eventStatements) SelectEventNIDsInRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, senderID spec.SenderID, afterNID types.EventNID, from, to spec.Timestamp, limit int,
+) ([]types.EventNID, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventNIDsInRoomStmt).QueryContext(ctx, roomNID, senderID, afterNID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectEventNIDsInRoom: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID types.EventNID
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, rows.Err()
+}
@@ -25,6 +25,9 @@ const purgeEventsSQL = "" +
 const purgeInvitesSQL = "" +
 	"DELETE FROM roomserver_invites WHERE room_nid = $1"
 
+const purgeKnocksSQL = "" +
+	"DELETE FROM roomserver_knocks WHERE room_nid = $1"
+
 const purgeMembershipsSQL = "" +
 	"DELETE FROM roomserver_membership WHERE room_nid = $1"
 
@@ -64,6 +67,7 @@ type purgeStatements struct {
 	purgeEventJSONStmt            *sql.Stmt
 	purgeEventsStmt               *sql.Stmt
 	purgeInvitesStmt              *sql.Stmt
+	purgeKnocksStmt               *sql.Stmt
 	purgeMembershipsStmt          *sql.Stmt
 	purgePreviousEventsStmt       *sql.Stmt
 	purgePreviousEvents2Stmt      *sql.Stmt
@@ -82,6 +86,7 @@ func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
 		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeKnocksStmt, purgeKnocksSQL},
 		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
 		{&s.purgePublishedStmt, purgePublishedSQL},
 		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
@@ -115,6 +120,7 @@ func (s *purgeStatements) PurgeRoom(
 		s.purgeStateBlockEntriesStmt,
 		s.purgeStateSnapshotEntriesStmt,
 		s.purgeInvitesStmt,
+		s.purgeKnocksStmt,
 		s.purgeMembershipsStmt,
 		s.purgePreviousEvents2Stmt, // Fast purge the majority of events
 		s.purgePreviousEventsStmt,  // Slow purge the remaining events
@@ -114,12 +114,18 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateInvitesTable(db); err != nil {
 		return err
 	}
+	if err := CreateKnocksTable(db); err != nil {
+		return err
+	}
 	if err := CreateMembershipTable(db); err != nil {
 		return err
 	}
 	if err := CreatePublishedTable(db); err != nil {
 		return err
 	}
+	if err := CreateBlockedRoomsTable(db); err != nil {
+		return err
+	}
 	if err := CreateRedactionsTable(db); err != nil {
 		return err
 	}
@@ -174,6 +180,10 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	knocks, err := PrepareKnocksTable(db)
+	if err != nil {
+		return err
+	}
 	membership, err := PrepareMembershipTable(db)
 	if err != nil {
 		return err
@@ -182,6 +192,10 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	blockedRooms, err := PrepareBlockedRoomsTable(db)
+	if err != nil {
+		return err
+	}
 	redactions, err := PrepareRedactionsTable(db)
 	if err != nil {
 		return err
@@ -220,8 +234,10 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 		StateSnapshotTable: stateSnapshot,
 		RoomAliasesTable:   roomAliases,
 		InvitesTable:       invites,
+		KnocksTable:        knocks,
 		MembershipTable:    membership,
 		PublishedTable:     published,
+		BlockedRoomsTable:  blockedRooms,
 		Purge:              purge,
 		UserRoomKeyTable:   userRoomKeys,
 	}
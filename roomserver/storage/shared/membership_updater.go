@@ -8,6 +8,7 @@ import (
 	"github.com/ike20013/dendrite/roomserver/storage/tables"
 	"github.com/ike20013/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 type MembershipUpdater struct {
@@ -90,10 +91,26 @@ func (u *MembershipUpdater) IsKnock() bool {
 	return u.oldMembership == tables.MembershipStateKnock
 }
 
+// SetKnockServers stores the servers to ask when withdrawing a knock that was
+// sent over federation, starting with the server that accepted it.
+func (u *MembershipUpdater) SetKnockServers(serverNames []spec.ServerName) error {
+	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		return u.d.KnocksTable.UpsertKnock(u.ctx, txn, u.roomNID, u.targetUserNID, serverNames)
+	})
+}
+
+// KnockServers returns the servers stored by SetKnockServers, or nil if there are none.
+func (u *MembershipUpdater) KnockServers() ([]spec.ServerName, error) {
+	return u.d.KnocksTable.SelectKnockServers(u.ctx, u.txn, u.roomNID, u.targetUserNID)
+}
+
 func (u *MembershipUpdater) Delete() error {
 	if _, err := u.d.InvitesTable.UpdateInviteRetired(u.ctx, u.txn, u.roomNID, u.targetUserNID); err != nil {
 		return err
 	}
+	if err := u.d.KnocksTable.DeleteKnock(u.ctx, u.txn, u.roomNID, u.targetUserNID); err != nil {
+		return err
+	}
 	return u.d.MembershipTable.DeleteMembership(u.ctx, u.txn, u.roomNID, u.targetUserNID)
 }
 
@@ -128,6 +145,11 @@ func (u *MembershipUpdater) Update(newMembership tables.MembershipState, event *
 				return fmt.Errorf("u.d.InvitesTables.UpdateInviteRetired: %w", err)
 			}
 		}
+		if u.oldMembership == tables.MembershipStateKnock && newMembership != tables.MembershipStateKnock {
+			if err = u.d.KnocksTable.DeleteKnock(u.ctx, u.txn, u.roomNID, u.targetUserNID); err != nil {
+				return fmt.Errorf("u.d.KnocksTable.DeleteKnock: %w", err)
+			}
+		}
 		return nil
 	})
 }
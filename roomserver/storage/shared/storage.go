@@ -43,8 +43,10 @@ type Database struct {
 	StateBlockTable    tables.StateBlock
 	RoomAliasesTable   tables.RoomAliases
 	InvitesTable       tables.Invites
+	KnocksTable        tables.Knocks
 	MembershipTable    tables.Membership
 	PublishedTable     tables.Published
+	BlockedRoomsTable  tables.BlockedRooms
 	Purge              tables.Purge
 	UserRoomKeyTable   tables.UserRoomKeys
 	GetRoomUpdaterFn   func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
@@ -789,6 +791,8 @@ func (d *EventDatabase) StoreEvent(
 			authEventNIDs,
 			event.Depth(),
 			isRejected,
+			event.OriginServerTS(),
+			event.SenderID(),
 		); err != nil {
 			if err == sql.ErrNoRows {
 				// We've already inserted the event so select the numeric event ID
@@ -858,6 +862,27 @@ func (d *Database) GetPublishedRooms(ctx context.Context, networkID string, incl
 	return d.PublishedTable.SelectAllPublishedRooms(ctx, nil, networkID, true, includeAllNetworks)
 }
 
+func (d *Database) SetRoomBlocked(ctx context.Context, roomID, blockedBy string, blocked bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if blocked {
+			return d.BlockedRoomsTable.UpsertBlockedRoom(ctx, txn, roomID, blockedBy)
+		}
+		return d.BlockedRoomsTable.DeleteBlockedRoom(ctx, txn, roomID)
+	})
+}
+
+func (d *Database) GetRoomBlocked(ctx context.Context, roomID string) (blockedBy string, blocked bool, err error) {
+	return d.BlockedRoomsTable.SelectBlockedRoom(ctx, nil, roomID)
+}
+
+func (d *Database) RoomIDs(ctx context.Context) ([]string, error) {
+	roomNIDs, err := d.EventsTable.SelectRoomsWithEventTypeNID(ctx, nil, types.MRoomCreateNID)
+	if err != nil {
+		return nil, err
+	}
+	return d.RoomsTable.BulkSelectRoomIDs(ctx, nil, roomNIDs)
+}
+
 func (d *Database) MissingAuthPrevEvents(
 	ctx context.Context, e gomatrixserverlib.PDU,
 ) (missingAuth, missingPrev []string, err error) {
@@ -1706,6 +1731,30 @@ func (d *Database) RoomsWithACLs(ctx context.Context) ([]string, error) {
 	return roomIDs, nil
 }
 
+func (d *Database) EventClosestToTimestamp(
+	ctx context.Context, roomNID types.RoomNID, ts spec.Timestamp, backwards bool,
+) (string, spec.Timestamp, error) {
+	return d.EventsTable.SelectEventClosestToTimestamp(ctx, nil, roomNID, ts, backwards)
+}
+
+func (d *Database) EventNIDsInRoom(
+	ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID, afterNID types.EventNID, from, to spec.Timestamp, limit int,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectEventNIDsInRoom(ctx, nil, roomNID, senderID, afterNID, from, to, limit)
+}
+
+func (d *Database) IsEventReferenced(ctx context.Context, eventID string) (bool, error) {
+	err := d.PrevEventsTable.SelectPreviousEventExists(ctx, nil, eventID)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	default:
+		return false, fmt.Errorf("d.PrevEventsTable.SelectPreviousEventExists: %w", err)
+	}
+}
+
 // ForgetRoom sets a users room to forgotten
 func (d *Database) ForgetRoom(ctx context.Context, userID, roomID string, forget bool) error {
 	roomNIDs, err := d.RoomsTable.BulkSelectRoomNIDs(ctx, nil, []string{roomID})
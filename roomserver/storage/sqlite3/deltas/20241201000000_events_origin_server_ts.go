@@ -0,0 +1,36 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddEventsOriginServerTS adds the origin_server_ts column to the events
+// table, filling it in from the JSON of the events already stored.
+func UpAddEventsOriginServerTS(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists" for columns, so only add it if
+	// selecting it fails, i.e. the table was created before it existed.
+	// Tables created with the column already have it filled in, and the
+	// event JSON table may not exist yet, so only backfill when adding it.
+	if _, err := tx.ExecContext(ctx, "SELECT origin_server_ts FROM roomserver_events LIMIT 1"); err != nil {
+		_, err = tx.ExecContext(ctx, `
+ALTER TABLE roomserver_events ADD COLUMN origin_server_ts INTEGER NOT NULL DEFAULT 0;
+UPDATE roomserver_events SET origin_server_ts = COALESCE((
+	SELECT json_extract(j.event_json, '$.origin_server_ts') FROM roomserver_event_json AS j WHERE j.event_nid = roomserver_events.event_nid
+), 0);`)
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS roomserver_events_origin_server_ts_idx ON roomserver_events (room_nid, origin_server_ts);")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddEventsSender adds the sender column to the events table, filling it
+// in from the JSON of the events already stored.
+func UpAddEventsSender(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists" for columns, so only add it if
+	// selecting it fails, i.e. the table was created before it existed.
+	if _, err := tx.ExecContext(ctx, "SELECT sender FROM roomserver_events LIMIT 1"); err != nil {
+		_, err = tx.ExecContext(ctx, `
+ALTER TABLE roomserver_events ADD COLUMN sender TEXT NOT NULL DEFAULT '';
+UPDATE roomserver_events SET sender = COALESCE((
+	SELECT json_extract(j.event_json, '$.sender') FROM roomserver_event_json AS j WHERE j.event_nid = roomserver_events.event_nid
+), '');`)
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS roomserver_events_sender_idx ON roomserver_events (room_nid, sender, event_nid);")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/ike20013/dendrite/roomserver/storage/sqlite3/deltas"
 	"github.com/ike20013/dendrite/roomserver/storage/tables"
 	"github.com/ike20013/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const eventsSchema = `
@@ -34,7 +35,9 @@ const eventsSchema = `
     depth INTEGER NOT NULL,
     event_id TEXT NOT NULL UNIQUE,
 	auth_event_nids TEXT NOT NULL DEFAULT '[]',
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	origin_server_ts INTEGER NOT NULL DEFAULT 0,
+	sender TEXT NOT NULL DEFAULT ''
   );
 
 -- Create an index which helps in resolving membership events (event_type_nid = 5) - (used for history visibility)
@@ -47,8 +50,8 @@ CREATE INDEX IF NOT EXISTS roomserver_event_state_key_nid_idx ON roomserver_even
 `
 
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, auth_event_nids, depth, is_rejected)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, auth_event_nids, depth, is_rejected, origin_server_ts, sender)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	  ON CONFLICT DO UPDATE
 	  SET is_rejected = $7 WHERE is_rejected = 1
 	  RETURNING event_nid, state_snapshot_nid;
@@ -122,6 +125,23 @@ const selectEventRejectedSQL = "" +
 
 const selectRoomsWithEventTypeNIDSQL = `SELECT DISTINCT room_nid FROM roomserver_events WHERE event_type_nid = $1`
 
+// Events without state are outliers, which aren't part of the room timeline.
+const selectEventAfterTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts >= $2 AND state_snapshot_nid != 0 AND is_rejected = 0" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT 1"
+
+const selectEventBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts <= $2 AND state_snapshot_nid != 0 AND is_rejected = 0" +
+	" ORDER BY origin_server_ts DESC, event_nid DESC LIMIT 1"
+
+const selectEventNIDsInRoomSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND sender = $2 AND event_nid > $3 AND origin_server_ts >= $4 AND ($5 = 0 OR origin_server_ts < $5)" +
+	" AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY event_nid ASC LIMIT $6"
+
 type eventStatements struct {
 	db                                            *sql.DB
 	insertEventStmt                               *sql.Stmt
@@ -138,6 +158,9 @@ type eventStatements struct {
 	bulkSelectEventIDStmt                         *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
 	selectRoomsWithEventTypeNIDStmt               *sql.Stmt
+	selectEventAfterTimestampStmt                 *sql.Stmt
+	selectEventBeforeTimestampStmt                *sql.Stmt
+	selectEventNIDsInRoomStmt                     *sql.Stmt
 	//bulkSelectEventNIDStmt               *sql.Stmt
 	//bulkSelectUnsentEventNIDStmt         *sql.Stmt
 	//selectRoomNIDsForEventNIDsStmt       *sql.Stmt
@@ -149,27 +172,33 @@ func CreateEventsTable(db *sql.DB) error {
 		return err
 	}
 
+	m := sqlutil.NewMigrator(db)
+
 	// check if the column exists
 	var cName string
 	migrationName := "roomserver: drop column reference_sha from roomserver_events"
 	err = db.QueryRowContext(context.Background(), `SELECT p.name FROM sqlite_master AS m JOIN pragma_table_info(m.name) AS p WHERE m.name = 'roomserver_events' AND p.name = 'reference_sha256'`).Scan(&cName)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) { // migration was already executed, as the column was removed
-			if err = sqlutil.InsertMigration(context.Background(), db, migrationName); err != nil {
-				return fmt.Errorf("unable to manually insert migration '%s': %w", migrationName, err)
-			}
-			return nil
+	switch {
+	case errors.Is(err, sql.ErrNoRows): // migration was already executed, as the column was removed
+		if err = sqlutil.InsertMigration(context.Background(), db, migrationName); err != nil {
+			return fmt.Errorf("unable to manually insert migration '%s': %w", migrationName, err)
 		}
+	case err != nil:
 		return err
-	}
-
-	m := sqlutil.NewMigrator(db)
-	m.AddMigrations([]sqlutil.Migration{
-		{
+	default:
+		m.AddMigrations(sqlutil.Migration{
 			Version: migrationName,
 			Up:      deltas.UpDropEventReferenceSHA,
-		},
-	}...)
+		})
+	}
+
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: add origin_server_ts to roomserver_events",
+		Up:      deltas.UpAddEventsOriginServerTS,
+	}, sqlutil.Migration{
+		Version: "roomserver: add sender to roomserver_events",
+		Up:      deltas.UpAddEventsSender,
+	})
 	return m.Up(context.Background())
 }
 
@@ -196,6 +225,9 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
 		{&s.selectRoomsWithEventTypeNIDStmt, selectRoomsWithEventTypeNIDSQL},
+		{&s.selectEventAfterTimestampStmt, selectEventAfterTimestampSQL},
+		{&s.selectEventBeforeTimestampStmt, selectEventBeforeTimestampSQL},
+		{&s.selectEventNIDsInRoomStmt, selectEventNIDsInRoomSQL},
 	}.Prepare(db)
 }
 
@@ -209,6 +241,8 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	originServerTS spec.Timestamp,
+	senderID spec.SenderID,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	var eventNID int64
@@ -216,7 +250,7 @@ func (s *eventStatements) InsertEvent(
 	insertStmt := sqlutil.TxStmt(txn, s.insertEventStmt)
 	err := insertStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, eventNIDsAsArray(authEventNIDs), depth, isRejected,
+		eventID, eventNIDsAsArray(authEventNIDs), depth, isRejected, originServerTS, senderID,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -708,3 +742,36 @@ func (s *eventStatements) SelectRoomsWithEventTypeNID(
 
 	return roomNIDs, rows.Err()
 }
+
+// SelectEventClosestToTimestamp returns the event in the room whose timestamp is
+// closest to the given one, at or after it or, if backwards is true, at or
+// before it. Returns sql.ErrNoRows if there is no such event.
+func (s *eventStatements) SelectEventClosestToTimestamp(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts spec.Timestamp, backwards bool,
+) (eventID string, originServerTS spec.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventAfterTimestampStmt)
+	if backwards {
+		stmt = sqlutil.TxStmt(txn, s.selectEventBeforeTimestampStmt)
+	}
+	err = stmt.QueryRowContext(ctx, roomNID, ts).Scan(&eventID, &originServerTS)
+	return
+}
+
+func (s *eventStatements) SelectEventNIDsInRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, senderID spec.SenderID, afterNID types.EventNID, from, to spec.Timestamp, limit int,
+) ([]types.EventNID, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventNIDsInRoomStmt).QueryContext(ctx, roomNID, senderID, afterNID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectEventNIDsInRoom: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID types.EventNID
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, rows.Err()
+}
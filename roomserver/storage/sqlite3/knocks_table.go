@@ -0,0 +1,104 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/roomserver/storage/tables"
+	"github.com/ike20013/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const knocksSchema = `
+-- Stores the servers to ask when withdrawing a knock that a local user sent
+-- over federation, since we aren't in the room to know its servers ourselves.
+CREATE TABLE IF NOT EXISTS roomserver_knocks (
+    -- The numeric ID of the room knocked on
+    room_nid INTEGER NOT NULL,
+    -- The numeric ID for the state key of the knocking user
+    target_nid INTEGER NOT NULL,
+    -- A JSON array of server names, starting with the server that accepted
+    -- the knock
+    server_names TEXT NOT NULL,
+    PRIMARY KEY (room_nid, target_nid)
+);
+`
+
+const upsertKnockSQL = "" +
+	"INSERT INTO roomserver_knocks (room_nid, target_nid, server_names) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_nid, target_nid) DO UPDATE SET server_names = $3"
+
+const selectKnockServersSQL = "" +
+	"SELECT server_names FROM roomserver_knocks WHERE room_nid = $1 AND target_nid = $2"
+
+const deleteKnockSQL = "" +
+	"DELETE FROM roomserver_knocks WHERE room_nid = $1 AND target_nid = $2"
+
+type knocksStatements struct {
+	upsertKnockStmt        *sql.Stmt
+	selectKnockServersStmt *sql.Stmt
+	deleteKnockStmt        *sql.Stmt
+}
+
+func CreateKnocksTable(db *sql.DB) error {
+	_, err := db.Exec(knocksSchema)
+	return err
+}
+
+func PrepareKnocksTable(db *sql.DB) (tables.Knocks, error) {
+	s := &knocksStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertKnockStmt, upsertKnockSQL},
+		{&s.selectKnockServersStmt, selectKnockServersSQL},
+		{&s.deleteKnockStmt, deleteKnockSQL},
+	}.Prepare(db)
+}
+
+func (s *knocksStatements) UpsertKnock(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
+	serverNames []spec.ServerName,
+) error {
+	serverNamesJSON, err := json.Marshal(serverNames)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.upsertKnockStmt)
+	_, err = stmt.ExecContext(ctx, roomNID, targetUserNID, string(serverNamesJSON))
+	return err
+}
+
+func (s *knocksStatements) SelectKnockServers(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
+) ([]spec.ServerName, error) {
+	var serverNamesJSON string
+	stmt := sqlutil.TxStmt(txn, s.selectKnockServersStmt)
+	err := stmt.QueryRowContext(ctx, roomNID, targetUserNID).Scan(&serverNamesJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var serverNames []spec.ServerName
+	err = json.Unmarshal([]byte(serverNamesJSON), &serverNames)
+	return serverNames, err
+}
+
+func (s *knocksStatements) DeleteKnock(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteKnockStmt)
+	_, err := stmt.ExecContext(ctx, roomNID, targetUserNID)
+	return err
+}
@@ -2,6 +2,7 @@ package tables_test
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"testing"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/ike20013/dendrite/roomserver/types"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,7 +52,7 @@ func Test_EventsTable(t *testing.T) {
 		wantStateAtEvent := make([]types.StateAtEvent, 0, len(room.Events()))
 		wantStateAtEventAndRefs := make([]types.StateAtEventAndReference, 0, len(room.Events()))
 		for _, ev := range room.Events() {
-			eventNID, snapNID, err := tab.InsertEvent(ctx, nil, 1, 1, 1, ev.EventID(), nil, ev.Depth(), false)
+			eventNID, snapNID, err := tab.InsertEvent(ctx, nil, 1, 1, 1, ev.EventID(), nil, ev.Depth(), false, ev.OriginServerTS(), ev.SenderID())
 			assert.NoError(t, err)
 			gotEventNID, gotSnapNID, err := tab.SelectEvent(ctx, nil, ev.EventID())
 			assert.NoError(t, err)
@@ -167,14 +169,14 @@ func TestRoomsWithACL(t *testing.T) {
 		// Create ACL'd rooms
 		var wantRoomNIDs []types.RoomNID
 		for i := 0; i < 10; i++ {
-			_, _, err = eventsTable.InsertEvent(ctx, nil, types.RoomNID(i), eventTypeNID, types.EmptyStateKeyNID, fmt.Sprintf("$1337+%d", i), nil, 0, false)
+			_, _, err = eventsTable.InsertEvent(ctx, nil, types.RoomNID(i), eventTypeNID, types.EmptyStateKeyNID, fmt.Sprintf("$1337+%d", i), nil, 0, false, 0, "")
 			assert.Nil(t, err)
 			wantRoomNIDs = append(wantRoomNIDs, types.RoomNID(i))
 		}
 
 		// Create non-ACL'd rooms (eventTypeNID+1)
 		for i := 10; i < 20; i++ {
-			_, _, err = eventsTable.InsertEvent(ctx, nil, types.RoomNID(i), eventTypeNID+1, types.EmptyStateKeyNID, fmt.Sprintf("$1337+%d", i), nil, 0, false)
+			_, _, err = eventsTable.InsertEvent(ctx, nil, types.RoomNID(i), eventTypeNID+1, types.EmptyStateKeyNID, fmt.Sprintf("$1337+%d", i), nil, 0, false, 0, "")
 			assert.Nil(t, err)
 		}
 
@@ -183,3 +185,91 @@ func TestRoomsWithACL(t *testing.T) {
 		assert.Equal(t, wantRoomNIDs, gotRoomNIDs)
 	})
 }
+
+func TestSelectEventClosestToTimestamp(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateEventsTable(t, dbType)
+		defer close()
+
+		// Events with state at 1000, 2000 and 3000, an outlier at 2500 and a rejected event at 1500.
+		for i, ts := range []spec.Timestamp{1000, 2000, 3000, 2500, 1500} {
+			eventNID, _, err := tab.InsertEvent(ctx, nil, 1, 1, 1, fmt.Sprintf("$event%d", ts), nil, int64(i), ts == 1500, ts, "")
+			assert.NoError(t, err)
+			if ts != 2500 {
+				assert.NoError(t, tab.UpdateEventState(ctx, nil, eventNID, 1))
+			}
+		}
+
+		tests := []struct {
+			ts        spec.Timestamp
+			backwards bool
+			wantID    string
+		}{
+			{ts: 0, wantID: "$event1000"},
+			{ts: 1000, wantID: "$event1000"},
+			{ts: 1001, wantID: "$event2000"},
+			{ts: 2001, wantID: "$event3000"},
+			{ts: 5000, backwards: true, wantID: "$event3000"},
+			{ts: 2999, backwards: true, wantID: "$event2000"},
+			{ts: 1999, backwards: true, wantID: "$event1000"},
+		}
+		for _, tc := range tests {
+			eventID, ts, err := tab.SelectEventClosestToTimestamp(ctx, nil, 1, tc.ts, tc.backwards)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantID, eventID)
+			assert.Equal(t, tc.wantID, fmt.Sprintf("$event%d", ts))
+		}
+
+		_, _, err := tab.SelectEventClosestToTimestamp(ctx, nil, 1, 3001, false)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, _, err = tab.SelectEventClosestToTimestamp(ctx, nil, 1, 999, true)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, _, err = tab.SelectEventClosestToTimestamp(ctx, nil, 2, 1000, false)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestSelectEventNIDsInRoom(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateEventsTable(t, dbType)
+		defer close()
+
+		// Events from alice and bob, an outlier from alice at 2500 and a rejected event from alice at 1500.
+		var aliceNIDs []types.EventNID
+		for i, ts := range []spec.Timestamp{1000, 2000, 3000, 4000, 2500, 1500} {
+			sender := spec.SenderID("@alice:test")
+			if ts == 2000 {
+				sender = "@bob:test"
+			}
+			eventNID, _, err := tab.InsertEvent(ctx, nil, 1, 1, 1, fmt.Sprintf("$event%d", ts), nil, int64(i), ts == 1500, ts, sender)
+			assert.NoError(t, err)
+			if ts != 2500 {
+				assert.NoError(t, tab.UpdateEventState(ctx, nil, eventNID, 1))
+			}
+			if sender == "@alice:test" && ts != 2500 && ts != 1500 {
+				aliceNIDs = append(aliceNIDs, eventNID)
+			}
+		}
+
+		eventNIDs, err := tab.SelectEventNIDsInRoom(ctx, nil, 1, "@alice:test", 0, 0, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, aliceNIDs, eventNIDs)
+
+		// Paginating and filtering by timestamp.
+		eventNIDs, err = tab.SelectEventNIDsInRoom(ctx, nil, 1, "@alice:test", 0, 0, 0, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, aliceNIDs[:1], eventNIDs)
+		eventNIDs, err = tab.SelectEventNIDsInRoom(ctx, nil, 1, "@alice:test", eventNIDs[0], 0, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, aliceNIDs[1:], eventNIDs)
+		eventNIDs, err = tab.SelectEventNIDsInRoom(ctx, nil, 1, "@alice:test", 0, 2000, 4000, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, aliceNIDs[1:2], eventNIDs)
+
+		eventNIDs, err = tab.SelectEventNIDsInRoom(ctx, nil, 1, "@charlie:test", 0, 0, 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, eventNIDs)
+	})
+}
@@ -44,7 +44,7 @@ type Events interface {
 	InsertEvent(
 		ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventTypeNID types.EventTypeNID,
 		eventStateKeyNID types.EventStateKeyNID, eventID string,
-		authEventNIDs []types.EventNID, depth int64, isRejected bool,
+		authEventNIDs []types.EventNID, depth int64, isRejected bool, originServerTS spec.Timestamp, senderID spec.SenderID,
 	) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	BulkSelectSnapshotsFromEventIDs(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[types.StateSnapshotNID][]string, error)
@@ -72,6 +72,14 @@ type Events interface {
 	SelectEventRejected(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) (rejected bool, err error)
 
 	SelectRoomsWithEventTypeNID(ctx context.Context, txn *sql.Tx, eventTypeNID types.EventTypeNID) ([]types.RoomNID, error)
+	// SelectEventClosestToTimestamp returns the non-outlier event in the room closest to the
+	// timestamp, at or after it, or at or before it if backwards is true. Rejected events are
+	// ignored. Returns sql.ErrNoRows if there is no such event.
+	SelectEventClosestToTimestamp(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts spec.Timestamp, backwards bool) (eventID string, originServerTS spec.Timestamp, err error)
+	// SelectEventNIDsInRoom returns up to `limit` NIDs of the non-outlier, non-rejected events which the
+	// sender sent in the room after the given NID, in ascending order. Only events sent at or after `from`
+	// and before `to` are returned, where a `to` of 0 means no upper bound.
+	SelectEventNIDsInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, senderID spec.SenderID, afterNID types.EventNID, from, to spec.Timestamp, limit int) ([]types.EventNID, error)
 }
 
 type Rooms interface {
@@ -128,6 +136,14 @@ type Invites interface {
 	SelectInviteActiveForUserInRoom(ctx context.Context, txn *sql.Tx, targetUserNID types.EventStateKeyNID, roomNID types.RoomNID) ([]types.EventStateKeyNID, []string, []byte, error)
 }
 
+// Knocks stores the servers to ask when withdrawing a knock sent over federation.
+type Knocks interface {
+	UpsertKnock(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, serverNames []spec.ServerName) error
+	// SelectKnockServers returns nil if no servers are stored for the knock.
+	SelectKnockServers(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) ([]spec.ServerName, error)
+	DeleteKnock(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) error
+}
+
 type ReportedEvents interface {
 	InsertReportedEvent(
 		ctx context.Context,
@@ -188,6 +204,12 @@ type Published interface {
 	SelectAllPublishedRooms(ctx context.Context, txn *sql.Tx, networkdID string, published, includeAllNetworks bool) ([]string, error)
 }
 
+type BlockedRooms interface {
+	UpsertBlockedRoom(ctx context.Context, txn *sql.Tx, roomID, blockedBy string) error
+	DeleteBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	SelectBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) (blockedBy string, blocked bool, err error)
+}
+
 type RedactionInfo struct {
 	// whether this redaction is validated (we have both events)
 	Validated bool
@@ -268,6 +290,9 @@ func ExtractContentValue(ev *types.HeaderedEvent) string {
 		// We need the entire content and not only one key, so we can use it
 		// on startup to generate the ACLs. This is merely a workaround.
 		return string(content)
+	case "m.policy.rule.user", "m.policy.rule.room", "m.policy.rule.server":
+		// Likewise for the rules of policy lists.
+		return string(content)
 	}
 	result := gjson.GetBytes(content, key)
 	if !result.Exists() {
@@ -275,7 +275,6 @@ func (config *Dendrite) Derive() error {
 
 	config.Derived.Registration.Params = make(map[string]interface{})
 
-	// TODO: Add email auth type
 	// TODO: Add MSISDN auth type
 
 	if config.ClientAPI.RecaptchaEnabled {
@@ -283,6 +282,13 @@ func (config *Dendrite) Derive() error {
 		config.Derived.Registration.Flows = []authtypes.Flow{
 			{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}},
 		}
+		if config.ClientAPI.RegistrationRequiresEmail {
+			config.Derived.Registration.Flows[0].Stages = append(config.Derived.Registration.Flows[0].Stages, authtypes.LoginTypeEmail)
+		}
+	} else if config.ClientAPI.RegistrationRequiresEmail {
+		config.Derived.Registration.Flows = []authtypes.Flow{
+			{Stages: []authtypes.LoginType{authtypes.LoginTypeEmail}},
+		}
 	} else {
 		config.Derived.Registration.Flows = []authtypes.Flow{
 			{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
@@ -2,6 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -17,6 +21,10 @@ type ClientAPI struct {
 	// Tokens can be managed using admin API.
 	RegistrationRequiresToken bool `yaml:"registration_requires_token"`
 
+	// If set, requires users to validate an email address during registration,
+	// which is then associated with their account. Requires email to be enabled.
+	RegistrationRequiresEmail bool `yaml:"registration_requires_email"`
+
 	// Enable registration without captcha verification or shared secret.
 	// This option is populated by the -really-enable-open-registration
 	// command line parameter as it is not recommended.
@@ -55,6 +63,12 @@ type ClientAPI struct {
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Options for logging in
+	Login Login `yaml:"login"`
+
+	// Options for sending emails to validate email addresses
+	Email Email `yaml:"email"`
+
 	MSCs *MSCs `yaml:"-"`
 }
 
@@ -69,11 +83,17 @@ func (c *ClientAPI) Defaults(opts DefaultOpts) {
 	c.RegistrationDisabled = true
 	c.OpenRegistrationWithoutVerificationEnabled = false
 	c.RateLimiting.Defaults()
+	c.Email.Defaults()
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors) {
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.Login.Verify(configErrs)
+	c.Email.Verify(configErrs, c.Matrix)
+	if c.RegistrationRequiresEmail && !c.Email.Enabled {
+		configErrs.Add("invalid value for config key \"client_api.registration_requires_email\": email is not enabled")
+	}
 	if c.RecaptchaEnabled {
 		if c.RecaptchaSiteVerifyAPI == "" {
 			c.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
@@ -93,7 +113,7 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors) {
 		checkNotEmpty(configErrs, "client_api.recaptcha_sitekey_class", c.RecaptchaSitekeyClass)
 	}
 	// Ensure there is any spam counter measure when enabling registration
-	if !c.RegistrationDisabled && !c.OpenRegistrationWithoutVerificationEnabled && !c.RecaptchaEnabled {
+	if !c.RegistrationDisabled && !c.OpenRegistrationWithoutVerificationEnabled && !c.RecaptchaEnabled && !c.RegistrationRequiresEmail {
 		configErrs.Add(
 			"You have tried to enable open registration without any secondary verification methods " +
 				"(such as reCAPTCHA). By enabling open registration, you are SIGNIFICANTLY " +
@@ -105,6 +125,191 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors) {
 	}
 }
 
+type Login struct {
+	// Single sign-on through OpenID Connect identity providers
+	SSO SSO `yaml:"sso"`
+}
+
+func (c *Login) Verify(configErrs *ConfigErrors) {
+	c.SSO.Verify(configErrs)
+}
+
+type SSO struct {
+	// Whether users can log in through the identity providers
+	Enabled bool `yaml:"enabled"`
+	// The URL that identity providers send users back to after they logged in, which
+	// must lead to /_matrix/client/v3/login/sso/callback on this server. It has to be
+	// registered as a redirect URI with the identity providers.
+	CallbackURL string `yaml:"callback_url"`
+	// The ID of the identity provider that /login/sso/redirect uses, which defaults
+	// to the first provider
+	DefaultProviderID string `yaml:"default_provider"`
+	// The identity providers that users can log in with
+	Providers []IdentityProvider `yaml:"providers"`
+	// The URL prefixes of clients that may be sent a login token after logging in.
+	// A client redirect URL must have the scheme and host of one of these, and a
+	// path starting with its path.
+	ClientRedirectURLs []string `yaml:"client_redirect_urls"`
+}
+
+// identityProviderIDRegex matches the identity provider IDs allowed by the spec.
+var identityProviderIDRegex = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,255}$`)
+
+func (c *SSO) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.login.sso.callback_url", c.CallbackURL)
+	if _, err := url.Parse(c.CallbackURL); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.login.sso.callback_url", c.CallbackURL))
+	}
+	if len(c.Providers) == 0 {
+		configErrs.Add(fmt.Sprintf("missing config key %q", "client_api.login.sso.providers"))
+		return
+	}
+	if c.DefaultProviderID == "" {
+		c.DefaultProviderID = c.Providers[0].ID
+	}
+	ids := map[string]bool{}
+	for i := range c.Providers {
+		p := &c.Providers[i]
+		p.Verify(configErrs, fmt.Sprintf("client_api.login.sso.providers[%d]", i))
+		if ids[p.ID] {
+			configErrs.Add(fmt.Sprintf("duplicate value for config key %q: %s", fmt.Sprintf("client_api.login.sso.providers[%d].id", i), p.ID))
+		}
+		ids[p.ID] = true
+	}
+	if !ids[c.DefaultProviderID] {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.login.sso.default_provider", c.DefaultProviderID))
+	}
+	if len(c.ClientRedirectURLs) == 0 {
+		configErrs.Add(fmt.Sprintf("missing config key %q", "client_api.login.sso.client_redirect_urls"))
+	}
+	for i, prefix := range c.ClientRedirectURLs {
+		if u, err := url.Parse(prefix); err != nil || !u.IsAbs() || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("client_api.login.sso.client_redirect_urls[%d]", i), prefix))
+		}
+	}
+}
+
+// IsClientRedirectAllowed returns whether users may be sent back to the client at
+// the given URL with a login token.
+func (c *SSO) IsClientRedirectAllowed(redirectURL *url.URL) bool {
+	for _, prefix := range c.ClientRedirectURLs {
+		allowed, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(redirectURL.Scheme, allowed.Scheme) &&
+			strings.EqualFold(redirectURL.Host, allowed.Host) &&
+			strings.HasPrefix(redirectURL.Path, allowed.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+type IdentityProvider struct {
+	// An identifier for the provider, which clients use to pick it. Changing it
+	// disconnects the accounts of users who logged in through the provider.
+	ID string `yaml:"id"`
+	// The name of the provider to show to users
+	Name string `yaml:"name"`
+	// An optional mxc:// URI of an icon to show to users
+	Icon string `yaml:"icon"`
+	// The OpenID Connect issuer, whose configuration is discovered from its
+	// /.well-known/openid-configuration
+	Issuer string `yaml:"issuer"`
+	// The credentials of this server at the provider. The secret may be left empty
+	// for public clients.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// The scopes to request, which default to openid, profile and email
+	Scopes []string `yaml:"scopes"`
+	// The claims that new users get their localpart and display name from
+	LocalpartClaim   string `yaml:"localpart_claim"`
+	DisplayNameClaim string `yaml:"display_name_claim"`
+	// Whether users of the provider may log into existing accounts with the same
+	// localpart. Otherwise only accounts created through the provider can be used.
+	AllowExistingUsers bool `yaml:"allow_existing_users"`
+}
+
+func (c *IdentityProvider) Verify(configErrs *ConfigErrors, key string) {
+	if !identityProviderIDRegex.MatchString(c.ID) {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".id", c.ID))
+	}
+	checkNotEmpty(configErrs, key+".issuer", c.Issuer)
+	checkNotEmpty(configErrs, key+".client_id", c.ClientID)
+	if c.Name == "" {
+		c.Name = c.ID
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	if c.LocalpartClaim == "" {
+		c.LocalpartClaim = "preferred_username"
+	}
+	if c.DisplayNameClaim == "" {
+		c.DisplayNameClaim = "name"
+	}
+}
+
+type Email struct {
+	// Whether this server sends emails to validate email addresses itself, rather
+	// than delegating that to identity servers
+	Enabled bool `yaml:"enabled"`
+	// The SMTP server that emails are sent through
+	SMTPHost string `yaml:"smtp_host"`
+	SMTPPort int    `yaml:"smtp_port"`
+	// The credentials for the SMTP server, if it requires authentication
+	SMTPUser     string `yaml:"smtp_user"`
+	SMTPPassword string `yaml:"smtp_pass"`
+	// Whether to refuse to send emails if the SMTP server doesn't support StartTLS
+	RequireTransportSecurity bool `yaml:"require_transport_security"`
+	// The sender of the emails, e.g. "Example <noreply@example.com>"
+	From string `yaml:"notif_from"`
+	// The name of the service in the emails
+	AppName string `yaml:"app_name"`
+	// A directory with templates which replace the built-in ones with the same name
+	TemplateDir string `yaml:"template_dir"`
+	// The public URL of the client API that links in emails lead to. Defaults to
+	// the well_known_client_name.
+	ClientBaseURL string `yaml:"client_base_url"`
+	// How long users have to validate their email address
+	ValidationTokenLifetime time.Duration `yaml:"validation_token_lifetime"`
+}
+
+func (c *Email) Defaults() {
+	c.SMTPPort = 25
+	c.AppName = "Matrix"
+	c.ValidationTokenLifetime = time.Hour
+}
+
+func (c *Email) Verify(configErrs *ConfigErrors, global *Global) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.email.smtp_host", c.SMTPHost)
+	if c.SMTPPort <= 0 || c.SMTPPort > 65535 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "client_api.email.smtp_port", c.SMTPPort))
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.email.notif_from", err))
+	}
+	if c.ClientBaseURL == "" && global != nil {
+		c.ClientBaseURL = global.WellKnownClientName
+	}
+	if u, err := url.Parse(c.ClientBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: must be an http:// or https:// URL", "client_api.email.client_base_url"))
+	}
+	if c.AppName == "" {
+		c.AppName = "Matrix"
+	}
+	if c.ValidationTokenLifetime <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.email.validation_token_lifetime", c.ValidationTokenLifetime))
+	}
+}
+
 type TURN struct {
 	// TODO Guest Support
 	// Whether or not guests can request TURN credentials
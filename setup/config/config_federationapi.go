@@ -1,6 +1,9 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
@@ -47,9 +50,115 @@ type FederationAPI struct {
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
 
+	// How we answer other servers asking us for the keys of third servers.
+	Notary Notary `yaml:"notary"`
+
 	// Deny/Allow lists used for restricting request scopes.
 	DenyNetworkCIDRs  []string `yaml:"deny_networks"`
 	AllowNetworkCIDRs []string `yaml:"allow_networks"`
+
+	// If not empty, only federate with servers whose names match one of these
+	// patterns. Patterns may contain * and ? wildcards and are matched against
+	// the server name without the port.
+	AllowedServerNames []string `yaml:"allowed_server_names"`
+	// Never federate with servers whose names match one of these patterns,
+	// even if they are also allowed.
+	DeniedServerNames []string `yaml:"denied_server_names"`
+
+	// Splits the servers we send to between several federation sender processes.
+	SenderSharding SenderSharding `yaml:"sender_sharding"`
+
+	// Limits of the queues of PDUs and EDUs waiting to be sent to each server.
+	DestinationQueue DestinationQueue `yaml:"destination_queue"`
+}
+
+// DestinationQueue limits how much is sent to a server at once, and how much is
+// held in memory for it. Whatever doesn't fit in memory waits in the database.
+type DestinationQueue struct {
+	// The most PDUs to send in a transaction. The spec allows up to 50.
+	MaxPDUsPerTransaction int `yaml:"max_pdus_per_transaction"`
+	// The most EDUs to send in a transaction. The spec allows up to 100.
+	MaxEDUsPerTransaction int `yaml:"max_edus_per_transaction"`
+	// The most PDUs to hold in memory for a server.
+	MaxPDUsInMemory int `yaml:"max_pdus_in_memory"`
+	// The most EDUs to hold in memory for a server.
+	MaxEDUsInMemory int `yaml:"max_edus_in_memory"`
+}
+
+func (c *DestinationQueue) Defaults() {
+	c.MaxPDUsPerTransaction = 50
+	c.MaxEDUsPerTransaction = 100
+	c.MaxPDUsInMemory = 128
+	c.MaxEDUsInMemory = 128
+}
+
+func (c *DestinationQueue) Verify(configErrs *ConfigErrors) {
+	checkBetween := func(key string, value, min, max int) {
+		if value < min || value > max {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be between %d and %d)", key, value, min, max))
+		}
+	}
+	checkBetween("federation_api.destination_queue.max_pdus_per_transaction", c.MaxPDUsPerTransaction, 1, 50)
+	checkBetween("federation_api.destination_queue.max_edus_per_transaction", c.MaxEDUsPerTransaction, 1, 100)
+	if c.MaxPDUsInMemory < c.MaxPDUsPerTransaction {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least max_pdus_per_transaction)", "federation_api.destination_queue.max_pdus_in_memory", c.MaxPDUsInMemory))
+	}
+	if c.MaxEDUsInMemory < c.MaxEDUsPerTransaction {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least max_edus_per_transaction)", "federation_api.destination_queue.max_edus_in_memory", c.MaxEDUsInMemory))
+	}
+}
+
+// Notary configures serving the keys of other servers on /_matrix/key/v2/query,
+// vouching for them with our own signature. Our own keys are always served.
+type Notary struct {
+	// Whether to serve the keys of other servers at all.
+	Enabled bool `yaml:"enabled"`
+	// If not empty, only vouch for the keys of servers whose names match one
+	// of these patterns. Patterns may contain * and ? wildcards.
+	AllowedServerNames []string `yaml:"allowed_server_names"`
+	// Never vouch for the keys of servers whose names match one of these
+	// patterns, even if they are also allowed.
+	DeniedServerNames []string `yaml:"denied_server_names"`
+}
+
+func (c *Notary) Defaults() {
+	c.Enabled = true
+}
+
+func (c *Notary) Verify(configErrs *ConfigErrors) {
+	for _, pattern := range c.AllowedServerNames {
+		checkNotEmpty(configErrs, "federation_api.notary.allowed_server_names", strings.TrimSpace(pattern))
+	}
+	for _, pattern := range c.DeniedServerNames {
+		checkNotEmpty(configErrs, "federation_api.notary.denied_server_names", strings.TrimSpace(pattern))
+	}
+}
+
+// SenderSharding assigns each remote server to one of a number of federation
+// senders, based on a consistent hash of its name.
+type SenderSharding struct {
+	// The number of federation senders. 1 disables sharding.
+	Shards int `yaml:"shards"`
+	// Which shard this process sends for, from 0 to shards - 1.
+	Index int `yaml:"index"`
+}
+
+func (c *SenderSharding) Defaults() {
+	c.Shards = 1
+	c.Index = 0
+}
+
+func (c *SenderSharding) Verify(configErrs *ConfigErrors, jetStream *JetStream) {
+	if c.Shards < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.sender_sharding.shards", c.Shards))
+		return
+	}
+	if c.Index < 0 || c.Index >= c.Shards {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be between 0 and %d)", "federation_api.sender_sharding.index", c.Index, c.Shards-1))
+	}
+	if c.Shards > 1 && len(jetStream.Addresses) == 0 {
+		configErrs.Add("federation_api.sender_sharding needs the federation senders to share a NATS server, set global.jetstream.addresses")
+	}
 }
 
 func (c *FederationAPI) Defaults(opts DefaultOpts) {
@@ -57,6 +166,9 @@ func (c *FederationAPI) Defaults(opts DefaultOpts) {
 	c.P2PFederationRetriesUntilAssumedOffline = 1
 	c.DisableTLSValidation = false
 	c.DisableHTTPKeepalives = false
+	c.Notary.Defaults()
+	c.SenderSharding.Defaults()
+	c.DestinationQueue.Defaults()
 	c.DenyNetworkCIDRs = []string{
 		"127.0.0.1/8",
 		"10.0.0.0/8",
@@ -97,6 +209,15 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "federation_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	for _, pattern := range c.AllowedServerNames {
+		checkNotEmpty(configErrs, "federation_api.allowed_server_names", strings.TrimSpace(pattern))
+	}
+	for _, pattern := range c.DeniedServerNames {
+		checkNotEmpty(configErrs, "federation_api.denied_server_names", strings.TrimSpace(pattern))
+	}
+	c.Notary.Verify(configErrs)
+	c.SenderSharding.Verify(configErrs, &c.Matrix.JetStream)
+	c.DestinationQueue.Verify(configErrs)
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"math/rand"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -84,6 +85,9 @@ type Global struct {
 
 	// Configuration for the caches.
 	Cache Cache `yaml:"cache"`
+
+	// Configuration for the built-in spam checker.
+	SpamChecker SpamChecker `yaml:"spam_checker"`
 }
 
 func (c *Global) Defaults(opts DefaultOpts) {
@@ -130,6 +134,7 @@ func (c *Global) Verify(configErrs *ConfigErrors) {
 	c.ServerNotices.Verify(configErrs)
 	c.ReportStats.Verify(configErrs)
 	c.Cache.Verify(configErrs)
+	c.SpamChecker.Verify(configErrs)
 }
 
 func (c *Global) IsLocalServerName(serverName spec.ServerName) bool {
@@ -344,6 +349,43 @@ func (c *ReportStats) Verify(configErrs *ConfigErrors) {
 	}
 }
 
+// SpamChecker configures the built-in spam checker, which denies what users do
+// based on block lists and regular expressions.
+type SpamChecker struct {
+	Enabled bool `yaml:"enabled"`
+	// Users whose ID matches one of these can't send events, invite users, join or
+	// create rooms, or upload media.
+	BlockedUsers []string `yaml:"blocked_users"`
+	// IDs of the rooms which users can't join or be invited to.
+	BlockedRooms []string `yaml:"blocked_rooms"`
+	// Events with a "body" matching one of these are denied.
+	EventBodyPatterns []string `yaml:"event_body_patterns"`
+	// Users whose ID or display name matches one of these are hidden from the user directory.
+	UsernamePatterns []string `yaml:"username_patterns"`
+	// Content types of media which can't be uploaded, e.g. "application/x-msdownload".
+	// A trailing "/*" matches all subtypes, e.g. "video/*".
+	BlockedMediaTypes []string `yaml:"blocked_media_types"`
+	// Media with a file name matching one of these can't be uploaded.
+	MediaFilenamePatterns []string `yaml:"media_filename_patterns"`
+}
+
+func (c *SpamChecker) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkRegexps := func(key string, patterns []string) {
+		for _, pattern := range patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid regular expression %q for config key %q: %s", pattern, key, err))
+			}
+		}
+	}
+	checkRegexps("global.spam_checker.blocked_users", c.BlockedUsers)
+	checkRegexps("global.spam_checker.event_body_patterns", c.EventBodyPatterns)
+	checkRegexps("global.spam_checker.username_patterns", c.UsernamePatterns)
+	checkRegexps("global.spam_checker.media_filename_patterns", c.MediaFilenamePatterns)
+}
+
 // The configuration to use for Sentry error reporting
 type Sentry struct {
 	Enabled bool `yaml:"enabled"`
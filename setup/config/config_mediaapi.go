@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"time"
 )
 
 type MediaAPI struct {
@@ -12,6 +14,7 @@ type MediaAPI struct {
 	Database DatabaseOptions `yaml:"database,omitempty"`
 
 	// The base path to where the media files will be stored. May be relative or absolute.
+	// Temporary files are written here even when media is stored elsewhere.
 	BasePath Path `yaml:"base_path"`
 
 	// The absolute base path to where media files will be stored.
@@ -30,6 +33,170 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// Configuration for generating previews of URLs for clients
+	URLPreviews URLPreviews `yaml:"url_previews"`
+
+	// Configuration for removing media which hasn't been accessed in a while
+	Retention MediaRetention `yaml:"retention"`
+
+	// Where the content of media files and thumbnails is stored
+	Storage MediaStorage `yaml:"storage"`
+
+	// Configuration for creating media IDs before the content is uploaded
+	AsyncUploads AsyncUploads `yaml:"async_uploads"`
+}
+
+type URLPreviews struct {
+	// Whether clients can ask this server to fetch and preview URLs
+	Enabled bool `yaml:"enabled"`
+	// How long a preview should be cached for before the URL is fetched again
+	CacheLifetime time.Duration `yaml:"cache_lifetime"`
+	// The maximum size of a page or preview image that will be downloaded
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+	// Deny/Allow lists of networks that previews can be fetched from. These
+	// stop clients from using the server to make requests to internal hosts.
+	// The deny list is checked first, and an empty allow list allows everything.
+	DenyNetworkCIDRs  []string `yaml:"deny_networks"`
+	AllowNetworkCIDRs []string `yaml:"allow_networks"`
+}
+
+func (c *URLPreviews) Defaults() {
+	c.Enabled = false
+	c.CacheLifetime = time.Hour
+	c.MaxPageSizeBytes = DefaultMaxFileSizeBytes
+	c.DenyNetworkCIDRs = []string{
+		"127.0.0.1/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"100.64.0.0/10",
+		"169.254.0.0/16",
+		"::1/128",
+		"fe80::/64",
+		"fc00::/7",
+	}
+	c.AllowNetworkCIDRs = []string{
+		"0.0.0.0/0",
+	}
+}
+
+func (c *URLPreviews) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkPositive(configErrs, "media_api.url_previews.cache_lifetime", int64(c.CacheLifetime))
+	checkPositive(configErrs, "media_api.url_previews.max_page_size_bytes", int64(c.MaxPageSizeBytes))
+	checkCIDRs(configErrs, "media_api.url_previews.deny_networks", c.DenyNetworkCIDRs)
+	checkCIDRs(configErrs, "media_api.url_previews.allow_networks", c.AllowNetworkCIDRs)
+}
+
+// checkCIDRs verifies that every network in the list is in CIDR notation.
+func checkCIDRs(configErrs *ConfigErrors, key string, cidrs []string) {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key, cidr))
+		}
+	}
+}
+
+type MediaRetention struct {
+	// How long media uploaded by local users is kept after it was last accessed. 0 keeps it forever.
+	LocalMediaMaxAge time.Duration `yaml:"local_media_max_age"`
+	// How long media cached from other servers is kept after it was last accessed. 0 keeps it forever.
+	RemoteMediaMaxAge time.Duration `yaml:"remote_media_max_age"`
+	// How often to look for media to remove
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+func (c *MediaRetention) Defaults() {
+	c.LocalMediaMaxAge = 0
+	c.RemoteMediaMaxAge = 0
+	c.PurgeInterval = time.Hour
+}
+
+func (c *MediaRetention) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "media_api.retention.local_media_max_age", int64(c.LocalMediaMaxAge))
+	checkPositive(configErrs, "media_api.retention.remote_media_max_age", int64(c.RemoteMediaMaxAge))
+	if (c.LocalMediaMaxAge > 0 || c.RemoteMediaMaxAge > 0) && c.PurgeInterval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.retention.purge_interval", c.PurgeInterval))
+	}
+}
+
+const (
+	// MediaStorageFilesystem stores media in the base path
+	MediaStorageFilesystem = "filesystem"
+	// MediaStorageS3 stores media in an S3-compatible object store
+	MediaStorageS3 = "s3"
+)
+
+type MediaStorage struct {
+	// Which backend to store media in, either "filesystem" or "s3"
+	Backend string `yaml:"backend"`
+	// Configuration for the "s3" backend
+	S3 S3MediaStorage `yaml:"s3"`
+}
+
+type S3MediaStorage struct {
+	// The URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint string `yaml:"endpoint"`
+	// The region that the bucket is in
+	Region string `yaml:"region"`
+	// The bucket to store media in
+	Bucket string `yaml:"bucket"`
+	// A prefix for the keys of all stored objects, so that the bucket can be shared
+	Prefix string `yaml:"prefix"`
+	// The credentials to access the bucket with. If not set, the credentials are
+	// taken from the AWS environment variables, the shared AWS credentials file
+	// or the IAM role of the instance instead.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// The session token for temporary credentials, if any
+	SessionToken string `yaml:"session_token"`
+	// Whether to always address the bucket in the path of requests rather than
+	// the hostname, which most self-hosted implementations such as MinIO require.
+	// Otherwise the hostname is used for endpoints known to support it.
+	ForcePathStyle bool `yaml:"force_path_style"`
+}
+
+func (c *MediaStorage) Defaults() {
+	c.Backend = MediaStorageFilesystem
+	c.S3.Region = "us-east-1"
+}
+
+func (c *MediaStorage) Verify(configErrs *ConfigErrors) {
+	switch c.Backend {
+	case MediaStorageFilesystem:
+	case MediaStorageS3:
+		checkNotEmpty(configErrs, "media_api.storage.s3.endpoint", c.S3.Endpoint)
+		checkNotEmpty(configErrs, "media_api.storage.s3.region", c.S3.Region)
+		checkNotEmpty(configErrs, "media_api.storage.s3.bucket", c.S3.Bucket)
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.storage.backend", c.Backend))
+	}
+}
+
+type AsyncUploads struct {
+	// How long a media ID created with /create can be uploaded to
+	PendingExpiry time.Duration `yaml:"pending_expiry"`
+	// The maximum number of media IDs a user may have waiting for uploads. 0 is unlimited.
+	MaxPendingPerUser int `yaml:"max_pending_per_user"`
+	// The longest that downloads wait for media that hasn't been uploaded yet
+	MaxDownloadWait time.Duration `yaml:"max_download_wait"`
+}
+
+func (c *AsyncUploads) Defaults() {
+	c.PendingExpiry = 24 * time.Hour
+	c.MaxPendingPerUser = 10
+	c.MaxDownloadWait = time.Minute
+}
+
+func (c *AsyncUploads) Verify(configErrs *ConfigErrors) {
+	if c.PendingExpiry <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.async_uploads.pending_expiry", c.PendingExpiry))
+	}
+	checkPositive(configErrs, "media_api.async_uploads.max_pending_per_user", int64(c.MaxPendingPerUser))
+	checkPositive(configErrs, "media_api.async_uploads.max_download_wait", int64(c.MaxDownloadWait))
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
@@ -38,6 +205,10 @@ var DefaultMaxFileSizeBytes = FileSizeBytes(10485760)
 func (c *MediaAPI) Defaults(opts DefaultOpts) {
 	c.MaxFileSizeBytes = DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.URLPreviews.Defaults()
+	c.Retention.Defaults()
+	c.Storage.Defaults()
+	c.AsyncUploads.Defaults()
 	if opts.Generate {
 		c.ThumbnailSizes = []ThumbnailSize{
 			{
@@ -72,6 +243,10 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors) {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+	c.URLPreviews.Verify(configErrs)
+	c.Retention.Verify(configErrs)
+	c.Storage.Verify(configErrs)
+	c.AsyncUploads.Verify(configErrs)
 
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "media_api.database.connection_string", string(c.Database.ConnectionString))
@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,6 +15,13 @@ type RoomServer struct {
 	DefaultRoomVersion gomatrixserverlib.RoomVersion `yaml:"default_room_version,omitempty"`
 
 	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	// Message retention policies, which rooms can set with m.room.retention
+	Retention RoomRetention `yaml:"retention"`
+
+	// The IDs of rooms with moderation policy lists whose bans to enforce. The
+	// server must be joined to these rooms to see their rules.
+	PolicyRooms []string `yaml:"policy_rooms"`
 }
 
 func (c *RoomServer) Defaults(opts DefaultOpts) {
@@ -22,6 +31,7 @@ func (c *RoomServer) Defaults(opts DefaultOpts) {
 			c.Database.ConnectionString = "file:roomserver.db"
 		}
 	}
+	c.Retention.Defaults()
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors) {
@@ -34,4 +44,65 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors) {
 	} else if !gomatrixserverlib.StableRoomVersion(c.DefaultRoomVersion) {
 		log.Warnf("WARNING: Provided default room version %q is unstable", c.DefaultRoomVersion)
 	}
+	c.Retention.Verify(configErrs)
+	for _, roomID := range c.PolicyRooms {
+		if _, err := spec.NewRoomID(roomID); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.policy_rooms': %q is not a room ID", roomID))
+		}
+	}
+}
+
+type RoomRetention struct {
+	// Whether to remove events once they are older than the max_lifetime of their room
+	Enabled bool `yaml:"enabled"`
+	// The max_lifetime of rooms without one in their m.room.retention event. 0 keeps events forever.
+	DefaultMaxLifetime time.Duration `yaml:"default_max_lifetime"`
+	// The range that the max_lifetime of rooms is clamped to. 0 leaves that end unbounded.
+	AllowedLifetimeMin time.Duration `yaml:"allowed_lifetime_min"`
+	AllowedLifetimeMax time.Duration `yaml:"allowed_lifetime_max"`
+	// How often to look for expired events
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+func (c *RoomRetention) Defaults() {
+	c.Enabled = false
+	c.DefaultMaxLifetime = 0
+	c.AllowedLifetimeMin = 0
+	c.AllowedLifetimeMax = 0
+	c.PurgeInterval = time.Hour
+}
+
+func (c *RoomRetention) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkPositive(configErrs, "room_server.retention.default_max_lifetime", int64(c.DefaultMaxLifetime))
+	checkPositive(configErrs, "room_server.retention.allowed_lifetime_min", int64(c.AllowedLifetimeMin))
+	checkPositive(configErrs, "room_server.retention.allowed_lifetime_max", int64(c.AllowedLifetimeMax))
+	if c.AllowedLifetimeMax > 0 && c.AllowedLifetimeMin > c.AllowedLifetimeMax {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s is less than allowed_lifetime_min", "room_server.retention.allowed_lifetime_max", c.AllowedLifetimeMax))
+	}
+	if c.PurgeInterval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.retention.purge_interval", c.PurgeInterval))
+	}
+}
+
+// MaxLifetime returns how long events are kept in a room whose m.room.retention
+// event has the given max_lifetime, or 0 if they are kept forever. A nil
+// max_lifetime means that the room doesn't have one.
+func (c *RoomRetention) MaxLifetime(maxLifetime *time.Duration) time.Duration {
+	if !c.Enabled {
+		return 0
+	}
+	if maxLifetime == nil {
+		return c.DefaultMaxLifetime
+	}
+	lifetime := *maxLifetime
+	if c.AllowedLifetimeMin > 0 && lifetime < c.AllowedLifetimeMin {
+		lifetime = c.AllowedLifetimeMin
+	}
+	if c.AllowedLifetimeMax > 0 && lifetime > c.AllowedLifetimeMax {
+		lifetime = c.AllowedLifetimeMax
+	}
+	return lifetime
 }
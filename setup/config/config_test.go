@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -314,3 +315,117 @@ func Test_SigningIdentityFor(t *testing.T) {
 		})
 	}
 }
+
+func TestRoomRetentionMaxLifetime(t *testing.T) {
+	lifetime := func(d time.Duration) *time.Duration { return &d }
+	cfg := RoomRetention{
+		Enabled:            true,
+		DefaultMaxLifetime: 90 * 24 * time.Hour,
+		AllowedLifetimeMin: time.Hour,
+		AllowedLifetimeMax: 365 * 24 * time.Hour,
+	}
+	tests := []struct {
+		name        string
+		maxLifetime *time.Duration
+		want        time.Duration
+	}{
+		{name: "no policy uses the default", want: 90 * 24 * time.Hour},
+		{name: "policy within bounds", maxLifetime: lifetime(7 * 24 * time.Hour), want: 7 * 24 * time.Hour},
+		{name: "policy below minimum", maxLifetime: lifetime(time.Minute), want: time.Hour},
+		{name: "policy above maximum", maxLifetime: lifetime(1000 * 24 * time.Hour), want: 365 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.MaxLifetime(tt.maxLifetime); got != tt.want {
+				t.Errorf("MaxLifetime() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	cfg.Enabled = false
+	if got := cfg.MaxLifetime(lifetime(time.Hour)); got != 0 {
+		t.Errorf("MaxLifetime() with retention disabled = %s, want 0", got)
+	}
+}
+
+func TestSenderShardingVerify(t *testing.T) {
+	withNATS := JetStream{Addresses: []string{"nats://localhost:4222"}}
+	tests := []struct {
+		name      string
+		sharding  SenderSharding
+		jetStream JetStream
+		wantErr   bool
+	}{
+		{name: "defaults", sharding: SenderSharding{Shards: 1}},
+		{name: "sharded", sharding: SenderSharding{Shards: 4, Index: 3}, jetStream: withNATS},
+		{name: "no shards", sharding: SenderSharding{Shards: 0}, wantErr: true},
+		{name: "index too large", sharding: SenderSharding{Shards: 2, Index: 2}, jetStream: withNATS, wantErr: true},
+		{name: "negative index", sharding: SenderSharding{Shards: 2, Index: -1}, jetStream: withNATS, wantErr: true},
+		{name: "sharded without NATS server", sharding: SenderSharding{Shards: 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configErrs := &ConfigErrors{}
+			tt.sharding.Verify(configErrs, &tt.jetStream)
+			if gotErr := len(*configErrs) > 0; gotErr != tt.wantErr {
+				t.Errorf("Verify() errors = %v, wantErr %v", *configErrs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDestinationQueueVerify(t *testing.T) {
+	defaults := DestinationQueue{}
+	defaults.Defaults()
+	tests := []struct {
+		name    string
+		modify  func(c *DestinationQueue)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(c *DestinationQueue) {}},
+		{name: "smaller transactions", modify: func(c *DestinationQueue) { c.MaxPDUsPerTransaction, c.MaxEDUsPerTransaction = 10, 20 }},
+		{name: "too many PDUs per transaction", modify: func(c *DestinationQueue) { c.MaxPDUsPerTransaction = 51 }, wantErr: true},
+		{name: "too many EDUs per transaction", modify: func(c *DestinationQueue) { c.MaxEDUsPerTransaction = 101 }, wantErr: true},
+		{name: "no EDUs per transaction", modify: func(c *DestinationQueue) { c.MaxEDUsPerTransaction = 0 }, wantErr: true},
+		{name: "fewer PDUs in memory than a transaction", modify: func(c *DestinationQueue) { c.MaxPDUsInMemory = 20 }, wantErr: true},
+		{name: "fewer EDUs in memory than a transaction", modify: func(c *DestinationQueue) { c.MaxEDUsInMemory = 50 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaults
+			tt.modify(&c)
+			configErrs := &ConfigErrors{}
+			c.Verify(configErrs)
+			if gotErr := len(*configErrs) > 0; gotErr != tt.wantErr {
+				t.Errorf("Verify() errors = %v, wantErr %v", *configErrs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestURLPreviewsVerify(t *testing.T) {
+	defaults := URLPreviews{}
+	defaults.Defaults()
+	defaults.Enabled = true
+	tests := []struct {
+		name    string
+		modify  func(c *URLPreviews)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(c *URLPreviews) {}},
+		{name: "empty allow list", modify: func(c *URLPreviews) { c.AllowNetworkCIDRs = nil }},
+		{name: "invalid denied network", modify: func(c *URLPreviews) { c.DenyNetworkCIDRs = []string{"127.0.0.1"} }, wantErr: true},
+		{name: "invalid allowed network", modify: func(c *URLPreviews) { c.AllowNetworkCIDRs = []string{"everything"} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaults
+			tt.modify(&c)
+			configErrs := &ConfigErrors{}
+			c.Verify(configErrs)
+			if gotErr := len(*configErrs) > 0; gotErr != tt.wantErr {
+				t.Errorf("Verify() errors = %v, wantErr %v", *configErrs, tt.wantErr)
+			}
+		})
+	}
+}
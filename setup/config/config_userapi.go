@@ -1,6 +1,13 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -11,6 +18,10 @@ type UserAPI struct {
 	// The length of time an OpenID token is condidered valid in milliseconds
 	OpenIDTokenLifetimeMS int64 `yaml:"openid_token_lifetime_ms"`
 
+	// The length of time an access token is considered valid in milliseconds,
+	// if the client asked for a refresh token to renew it with
+	AccessTokenLifetimeMS int64 `yaml:"access_token_lifetime_ms"`
+
 	// Disable TLS validation on HTTPS calls to push gatways. NOT RECOMMENDED!
 	PushGatewayDisableTLSValidation bool `yaml:"push_gateway_disable_tls_validation"`
 
@@ -25,14 +36,96 @@ type UserAPI struct {
 	// The number of workers to start for the DeviceListUpdater. Defaults to 8.
 	// This only needs updating if the "InputDeviceListUpdate" stream keeps growing indefinitely.
 	WorkerCount int `yaml:"worker_count"`
+
+	// Where passwords are checked when users log in.
+	PasswordAuth PasswordAuth `yaml:"password_auth"`
+
+	// How long accounts are valid for before they have to be renewed.
+	AccountValidity AccountValidity `yaml:"account_validity"`
+}
+
+type AccountValidity struct {
+	// How long accounts are valid for after being registered, or after startup
+	// for accounts registered before this was set. Admin accounts never expire.
+	// Accounts don't expire if this is 0, which is the default.
+	Period time.Duration `yaml:"period"`
+	// How long before their account expires users are sent a server notice
+	// warning them about it. Server notices must be enabled for this.
+	RenewAt time.Duration `yaml:"renew_at"`
+	// The body of the warning. "%s" is replaced with the expiry date.
+	NoticeMessage string `yaml:"notice_message"`
+}
+
+const DefaultAccountValidityNoticeMessage = "Your account will expire on %s. Please contact the server administrator to renew it."
+
+// Enabled returns whether accounts expire.
+func (c *AccountValidity) Enabled() bool {
+	return c.Period > 0
+}
+
+type PasswordAuth struct {
+	// Whether passwords are checked against the accounts database if none of
+	// the providers accepted them. Defaults to true.
+	LocalDatabase bool `yaml:"local_database"`
+	// External providers, which passwords are checked against in order.
+	Providers []PasswordProvider `yaml:"providers"`
+}
+
+type PasswordProvider struct {
+	// The type of the provider. Only "ldap" is supported.
+	Type string `yaml:"type"`
+	// The configuration of an "ldap" provider.
+	LDAP LDAPPasswordProvider `yaml:"ldap"`
+}
+
+const PasswordProviderLDAP = "ldap"
+
+type LDAPPasswordProvider struct {
+	// The ldap:// or ldaps:// URI of the server.
+	URI string `yaml:"uri"`
+	// Whether to upgrade ldap:// connections with StartTLS.
+	StartTLS bool `yaml:"start_tls"`
+	// Where users are searched for.
+	BaseDN string `yaml:"base_dn"`
+	// The account used to search for users. If empty, users are bound as
+	// <uid attribute>=<localpart>,<base_dn> directly and searched for with
+	// their own credentials.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	// An optional filter which users must match, e.g. (objectClass=person).
+	Filter string `yaml:"filter"`
+	// The attributes holding the details of users.
+	Attributes LDAPAttributes `yaml:"attributes"`
+	// Whether to create accounts for users who don't have one yet. Otherwise only
+	// users with an existing account can log in through this provider.
+	AutoProvision bool `yaml:"auto_provision"`
+	// How long to wait for the server. Defaults to 10 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type LDAPAttributes struct {
+	// The attribute matching the localpart, defaults to "uid".
+	UID string `yaml:"uid"`
+	// The attribute with the display name, defaults to "cn". The display name of
+	// the account is updated on every login.
+	DisplayName string `yaml:"display_name"`
+	// The attribute with the email address, defaults to "mail". The address is
+	// associated to the account on every login.
+	Email string `yaml:"email"`
 }
 
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
 
+const DefaultAccessTokenLifetimeMS = 300000 // 5 minutes
+
 func (c *UserAPI) Defaults(opts DefaultOpts) {
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.AccessTokenLifetimeMS = DefaultAccessTokenLifetimeMS
 	c.WorkerCount = 8
+	c.PasswordAuth.LocalDatabase = true
+	c.AccountValidity.RenewAt = 7 * 24 * time.Hour
+	c.AccountValidity.NoticeMessage = DefaultAccountValidityNoticeMessage
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
@@ -42,7 +135,70 @@ func (c *UserAPI) Defaults(opts DefaultOpts) {
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors) {
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.access_token_lifetime_ms", c.AccessTokenLifetimeMS)
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
+	c.PasswordAuth.Verify(configErrs)
+	c.AccountValidity.Verify(configErrs)
+}
+
+func (c *AccountValidity) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "user_api.account_validity.period", int64(c.Period))
+	if !c.Enabled() {
+		return
+	}
+	checkPositive(configErrs, "user_api.account_validity.renew_at", int64(c.RenewAt))
+	if c.RenewAt >= c.Period {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s is not less than the period", "user_api.account_validity.renew_at", c.RenewAt))
+	}
+	if c.NoticeMessage == "" {
+		c.NoticeMessage = DefaultAccountValidityNoticeMessage
+	}
+}
+
+func (c *PasswordAuth) Verify(configErrs *ConfigErrors) {
+	for i := range c.Providers {
+		c.Providers[i].Verify(configErrs, fmt.Sprintf("user_api.password_auth.providers[%d]", i))
+	}
+	if !c.LocalDatabase && len(c.Providers) == 0 {
+		configErrs.Add("invalid value for config key \"user_api.password_auth.local_database\": nobody could log in with a password without any providers")
+	}
+}
+
+func (c *PasswordProvider) Verify(configErrs *ConfigErrors, key string) {
+	switch c.Type {
+	case PasswordProviderLDAP:
+		c.LDAP.Verify(configErrs, key+".ldap")
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: unknown provider type %q", key+".type", c.Type))
+	}
+}
+
+func (c *LDAPPasswordProvider) Verify(configErrs *ConfigErrors, key string) {
+	if u, err := url.Parse(c.URI); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: must be an ldap:// or ldaps:// URI", key+".uri"))
+	}
+	checkNotEmpty(configErrs, key+".base_dn", c.BaseDN)
+	if c.BindDN != "" {
+		checkNotEmpty(configErrs, key+".bind_password", c.BindPassword)
+	}
+	if c.Filter != "" {
+		if _, err := ldap.CompileFilter(c.Filter); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".filter", err))
+		}
+	}
+	if c.Attributes.UID == "" {
+		c.Attributes.UID = "uid"
+	}
+	if c.Attributes.DisplayName == "" {
+		c.Attributes.DisplayName = "cn"
+	}
+	if c.Attributes.Email == "" {
+		c.Attributes.Email = "mail"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	checkPositive(configErrs, key+".timeout", int64(c.Timeout))
 }
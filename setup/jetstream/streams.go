@@ -32,6 +32,7 @@ var (
 	RequestPresence         = "GetPresence"
 	OutputPresenceEvent     = "OutputPresenceEvent"
 	InputFulltextReindex    = "InputFulltextReindex"
+	OutputFederationShard   = "OutputFederationShard"
 )
 
 var safeCharacters = regexp.MustCompile("[^A-Za-z0-9$]+")
@@ -108,4 +109,13 @@ var streams = []*nats.StreamConfig{
 		Storage:   nats.MemoryStorage,
 		MaxAge:    time.Minute * 5,
 	},
+	{
+		// Each federation sender consumes its own subject, so messages are
+		// kept until the sender they were handed over to is there to consume
+		// them, rather than dropped if its consumer doesn't exist yet.
+		Name:      OutputFederationShard,
+		Retention: nats.WorkQueuePolicy,
+		Storage:   nats.FileStorage,
+		MaxAge:    time.Hour * 24,
+	},
 }
@@ -0,0 +1,107 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/sjson"
+
+	"github.com/ike20013/dendrite/roomserver/api"
+	"github.com/ike20013/dendrite/syncapi/storage"
+	"github.com/ike20013/dendrite/syncapi/synctypes"
+)
+
+// threadAggregation is the m.thread bundled aggregation of a thread root.
+// https://spec.matrix.org/v1.12/client-server-api/#server-side-aggregation-of-mthread-relationships
+type threadAggregation struct {
+	LatestEvent             synctypes.ClientEvent `json:"latest_event"`
+	Count                   int                   `json:"count"`
+	CurrentUserParticipated bool                  `json:"current_user_participated"`
+}
+
+// BundleThreadAggregations adds the m.thread bundled aggregation to the unsigned
+// data of those events which are thread roots. The events must all be in the room.
+func BundleThreadAggregations(
+	ctx context.Context, syncDB storage.DatabaseTransaction, rsAPI api.SyncRoomserverAPI,
+	userID spec.UserID, roomID spec.RoomID, events []synctypes.ClientEvent, format synctypes.ClientEventFormat,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(events))
+	for i := range events {
+		eventIDs = append(eventIDs, events[i].EventID)
+	}
+	var senderID string
+	if id, err := rsAPI.QuerySenderIDForUser(ctx, roomID, userID); err != nil {
+		return fmt.Errorf("rsAPI.QuerySenderIDForUser: %w", err)
+	} else if id != nil {
+		senderID = string(*id)
+	}
+	summaries, err := syncDB.ThreadSummaries(ctx, roomID.String(), senderID, eventIDs)
+	if err != nil {
+		return fmt.Errorf("syncDB.ThreadSummaries: %w", err)
+	}
+	if len(summaries) == 0 {
+		return nil
+	}
+
+	latestIDs := make([]string, 0, len(summaries))
+	for _, summary := range summaries {
+		latestIDs = append(latestIDs, summary.LatestEventID)
+	}
+	latestEvents, err := syncDB.Events(ctx, latestIDs)
+	if err != nil {
+		return fmt.Errorf("syncDB.Events: %w", err)
+	}
+	latestEvents, err = ApplyHistoryVisibilityFilter(ctx, syncDB, rsAPI, latestEvents, nil, userID, "threads")
+	if err != nil {
+		return err
+	}
+	latest := make(map[string]*synctypes.ClientEvent, len(latestEvents))
+	for _, ev := range latestEvents {
+		clientEvent, err := synctypes.ToClientEvent(ev.PDU, format, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+		})
+		if err != nil {
+			return fmt.Errorf("synctypes.ToClientEvent: %w", err)
+		}
+		latest[ev.EventID()] = clientEvent
+	}
+
+	for i := range events {
+		summary, ok := summaries[events[i].EventID]
+		if !ok {
+			continue
+		}
+		// Leave the aggregation out if the user can't see the latest reply.
+		latestEvent, ok := latest[summary.LatestEventID]
+		if !ok {
+			continue
+		}
+		aggregation, err := json.Marshal(threadAggregation{
+			LatestEvent:             *latestEvent,
+			Count:                   summary.Count,
+			CurrentUserParticipated: summary.Participated,
+		})
+		if err != nil {
+			return err
+		}
+		unsigned := []byte(events[i].Unsigned)
+		if len(unsigned) == 0 {
+			unsigned = []byte("{}")
+		}
+		if unsigned, err = sjson.SetRawBytes(unsigned, `m\.relations.m\.thread`, aggregation); err != nil {
+			return err
+		}
+		events[i].Unsigned = unsigned
+	}
+	return nil
+}
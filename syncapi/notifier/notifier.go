@@ -113,7 +113,7 @@ func (n *Notifier) OnNewEvent(
 				} else {
 					// Keep the joined user map up-to-date
 					switch membership {
-					case spec.Invite:
+					case spec.Invite, spec.Knock:
 						usersToNotify = append(usersToNotify, targetUserID.String())
 					case spec.Join:
 						// Manually append the new user's ID so they get notified
@@ -123,6 +123,9 @@ func (n *Notifier) OnNewEvent(
 					case spec.Leave:
 						fallthrough
 					case spec.Ban:
+						// The target may not have been joined, e.g. when a knock
+						// is rescinded or an invite is rejected, so wake them too.
+						usersToNotify = append(usersToNotify, targetUserID.String())
 						n._removeJoinedUser(ev.RoomID().String(), targetUserID.String())
 					}
 				}
@@ -0,0 +1,175 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/external/fulltext"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/setup/process"
+	"github.com/ike20013/dendrite/syncapi/storage"
+)
+
+// MRoomRetention is the state event that rooms set their retention policy with.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/1763
+const MRoomRetention = "m.room.retention"
+
+// purgeBatchSize is how many events are removed from a room in one transaction.
+const purgeBatchSize = 100
+
+// Purger removes events from the sync API once they are older than the
+// retention policy of their room allows. The roomserver keeps the events,
+// so the room DAG stays intact and the room can still be federated.
+type Purger struct {
+	cfg *config.RoomRetention
+	db  storage.Database
+	fts fulltext.Indexer
+}
+
+func NewPurger(cfg *config.RoomRetention, db storage.Database, fts *fulltext.Search) *Purger {
+	p := &Purger{
+		cfg: cfg,
+		db:  db,
+	}
+	// Only set the indexer if there is one, as a nil *fulltext.Search
+	// would otherwise make a non-nil interface.
+	if fts != nil {
+		p.fts = fts
+	}
+	return p
+}
+
+// Start periodically purges the events that have expired, until the process
+// is shut down. Does nothing if retention is disabled.
+func (p *Purger) Start(processCtx *process.ProcessContext) {
+	if !p.cfg.Enabled {
+		return
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"default_max_lifetime": p.cfg.DefaultMaxLifetime,
+		"allowed_lifetime_min": p.cfg.AllowedLifetimeMin,
+		"allowed_lifetime_max": p.cfg.AllowedLifetimeMax,
+	})
+	logger.Info("Message retention enabled")
+
+	go func() {
+		ticker := time.NewTicker(p.cfg.PurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-processCtx.WaitForShutdown():
+				return
+			case <-ticker.C:
+			}
+			count, err := p.PurgeExpiredEvents(processCtx.Context(), time.Now())
+			if err != nil {
+				logger.WithError(err).Error("Failed to purge expired events")
+			} else if count > 0 {
+				logger.Infof("Purged %d expired events", count)
+			}
+		}
+	}()
+}
+
+// PurgeExpiredEvents purges the events in all rooms which have expired by the
+// given time. Returns how many were purged.
+func (p *Purger) PurgeExpiredEvents(ctx context.Context, now time.Time) (int, error) {
+	roomIDs, err := p.db.RoomIDsWithEvents(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("p.db.RoomIDsWithEvents: %w", err)
+	}
+	lifetimes, err := p.maxLifetimes(ctx, roomIDs)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for roomID, lifetime := range lifetimes {
+		count, err := p.PurgeRoom(ctx, roomID, spec.AsTimestamp(now.Add(-lifetime)))
+		purged += count
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// PurgeRoom removes the events in the room which were sent before the given
+// time, apart from state events, from the sync API and the fulltext index.
+// Returns how many were purged.
+func (p *Purger) PurgeRoom(ctx context.Context, roomID string, before spec.Timestamp) (int, error) {
+	purged := 0
+	for {
+		eventIDs, err := p.db.PurgeExpiredEvents(ctx, roomID, before, purgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("p.db.PurgeExpiredEvents: %w", err)
+		}
+		purged += len(eventIDs)
+		if p.fts != nil {
+			for _, eventID := range eventIDs {
+				if err = p.fts.Delete(eventID); err != nil {
+					return purged, fmt.Errorf("failed to delete entry from fulltext index: %w", err)
+				}
+			}
+		}
+		if len(eventIDs) < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// maxLifetimes returns how long events are kept in each of the rooms, leaving
+// out the rooms which keep them forever.
+func (p *Purger) maxLifetimes(ctx context.Context, roomIDs []string) (lifetimes map[string]time.Duration, err error) {
+	snapshot, err := p.db.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	lifetimes = make(map[string]time.Duration, len(roomIDs))
+	for _, roomID := range roomIDs {
+		ev, err := snapshot.GetStateEvent(ctx, roomID, MRoomRetention, "")
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.GetStateEvent: %w", err)
+		}
+		var maxLifetime *time.Duration
+		if ev != nil {
+			maxLifetime = parseMaxLifetime(ev.Content())
+		}
+		if lifetime := p.cfg.MaxLifetime(maxLifetime); lifetime > 0 {
+			lifetimes[roomID] = lifetime
+		}
+	}
+	succeeded = true
+	return lifetimes, nil
+}
+
+// parseMaxLifetime returns the max_lifetime of an m.room.retention event, or
+// nil if it doesn't have a valid one.
+func parseMaxLifetime(content []byte) *time.Duration {
+	var policy struct {
+		MaxLifetime *int64 `json:"max_lifetime"`
+	}
+	if err := json.Unmarshal(content, &policy); err != nil || policy.MaxLifetime == nil || *policy.MaxLifetime <= 0 {
+		return nil
+	}
+	ms := *policy.MaxLifetime
+	if ms > math.MaxInt64/int64(time.Millisecond) {
+		ms = math.MaxInt64 / int64(time.Millisecond)
+	}
+	lifetime := time.Duration(ms) * time.Millisecond
+	return &lifetime
+}
@@ -0,0 +1,88 @@
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	rstypes "github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/syncapi/storage"
+	"github.com/ike20013/dendrite/test"
+)
+
+func TestPurgeExpiredEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewSyncServerDatasource(context.Background(), cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		ctx := context.Background()
+		now := time.Now()
+
+		// The room keeps events for a day, the other room forever.
+		room := test.NewRoom(t, alice)
+		oldTopic := room.CreateAndInsert(t, alice, spec.MRoomTopic, map[string]string{"topic": "old"}, test.WithStateKey(""), test.WithTimestamp(now.Add(-48*time.Hour)))
+		oldMessage := room.CreateAndInsert(t, alice, "m.room.message", map[string]string{"body": "old"}, test.WithTimestamp(now.Add(-48*time.Hour)))
+		recentMessage := room.CreateAndInsert(t, alice, "m.room.message", map[string]string{"body": "recent"}, test.WithTimestamp(now.Add(-time.Hour)))
+		room.CreateAndInsert(t, alice, MRoomRetention, map[string]int64{"max_lifetime": 24 * time.Hour.Milliseconds()}, test.WithStateKey(""))
+		otherRoom := test.NewRoom(t, alice)
+		otherMessage := otherRoom.CreateAndInsert(t, alice, "m.room.message", map[string]string{"body": "old"}, test.WithTimestamp(now.Add(-48*time.Hour)))
+
+		for _, ev := range append(room.Events(), otherRoom.Events()...) {
+			var addStateEvents []*rstypes.HeaderedEvent
+			var addStateEventIDs []string
+			if ev.StateKey() != nil {
+				ev.StateKeyResolved = ev.StateKey()
+				addStateEvents = append(addStateEvents, ev)
+				addStateEventIDs = append(addStateEventIDs, ev.EventID())
+			}
+			if _, err = db.WriteEvent(ctx, ev, addStateEvents, addStateEventIDs, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared); err != nil {
+				t.Fatalf("failed to write event: %v", err)
+			}
+		}
+
+		p := NewPurger(&config.RoomRetention{Enabled: true}, db, nil)
+		purged, err := p.PurgeExpiredEvents(ctx, now)
+		if err != nil {
+			t.Fatalf("PurgeExpiredEvents failed: %v", err)
+		}
+		if purged != 1 {
+			t.Fatalf("expected 1 event to be purged, got %d", purged)
+		}
+
+		events, err := db.Events(ctx, []string{oldTopic.EventID(), oldMessage.EventID(), recentMessage.EventID(), otherMessage.EventID()})
+		if err != nil {
+			t.Fatalf("failed to get events: %v", err)
+		}
+		remaining := map[string]bool{}
+		for _, ev := range events {
+			remaining[ev.EventID()] = true
+		}
+		if remaining[oldMessage.EventID()] {
+			t.Errorf("expired message was not purged")
+		}
+		for _, ev := range []*rstypes.HeaderedEvent{oldTopic, recentMessage, otherMessage} {
+			if !remaining[ev.EventID()] {
+				t.Errorf("event %s was purged but shouldn't have been", ev.EventID())
+			}
+		}
+
+		// Nothing else has expired yet.
+		if purged, err = p.PurgeExpiredEvents(ctx, now); err != nil {
+			t.Fatalf("PurgeExpiredEvents failed: %v", err)
+		} else if purged != 0 {
+			t.Errorf("expected no events to be purged, got %d", purged)
+		}
+	})
+}
@@ -234,6 +234,20 @@ func Context(
 		}),
 	}
 
+	// Bundle the thread aggregations of the requested event along with
+	// those of the events around it.
+	if parsedRoomID, roomErr := spec.NewRoomID(roomID); roomErr == nil {
+		clientEvents := append([]synctypes.ClientEvent{ev}, eventsBeforeClient...)
+		clientEvents = append(clientEvents, eventsAfterClient...)
+		if err = internal.BundleThreadAggregations(ctx, snapshot, rsAPI, *userID, *parsedRoomID, clientEvents, synctypes.FormatAll); err != nil {
+			logrus.WithError(err).Warn("unable to bundle thread aggregations")
+		} else {
+			ev = clientEvents[0]
+			copy(response.EventsBefore, clientEvents[1:1+len(eventsBeforeClient)])
+			copy(response.EventsAfter, clientEvents[1+len(eventsBeforeClient):])
+		}
+	}
+
 	if len(response.State) > filter.Limit {
 		response.State = response.State[len(response.State)-filter.Limit:]
 	}
@@ -121,9 +121,13 @@ func GetEvent(
 			JSON: spec.Unknown("external server error"),
 		}
 	}
+	clientEvents := []synctypes.ClientEvent{*clientEvent}
+	if err = internal.BundleThreadAggregations(ctx, db, rsAPI, *userID, *roomID, clientEvents, synctypes.FormatAll); err != nil {
+		logger.WithError(err).Warn("GetEvent: failed to bundle thread aggregations")
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: *clientEvent,
+		JSON: clientEvents[0],
 	}
 }
@@ -417,9 +417,15 @@ func (r *messagesReq) retrieveEvents(ctx context.Context, rsAPI api.SyncRoomserv
 
 	start = *r.from
 
-	return synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	clientEvents = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
-	}), start, end, nil
+	})
+	if roomID, roomErr := spec.NewRoomID(r.roomID); roomErr == nil {
+		if err = internal.BundleThreadAggregations(r.ctx, r.snapshot, r.rsAPI, r.deviceUserID, *roomID, clientEvents, synctypes.FormatAll); err != nil {
+			logrus.WithError(err).Warn("Failed to bundle thread aggregations")
+		}
+	}
+	return clientEvents, start, end, nil
 }
 
 func (r *messagesReq) getStartEnd(events []*rstypes.HeaderedEvent) (start, end types.TopologyToken, err error) {
@@ -135,6 +135,10 @@ func Relations(
 		)
 	}
 
+	if err = internal.BundleThreadAggregations(req.Context(), snapshot, rsAPI, *userID, *roomID, res.Chunk, synctypes.FormatAll); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Warn("Failed to bundle thread aggregations")
+	}
+
 	succeeded = true
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -0,0 +1,155 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/roomserver/api"
+	rstypes "github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/syncapi/internal"
+	"github.com/ike20013/dendrite/syncapi/storage"
+	"github.com/ike20013/dendrite/syncapi/synctypes"
+	"github.com/ike20013/dendrite/syncapi/types"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+)
+
+type ThreadsResponse struct {
+	Chunk     []synctypes.ClientEvent `json:"chunk"`
+	NextBatch string                  `json:"next_batch,omitempty"`
+}
+
+// Threads implements GET /rooms/{roomId}/threads
+// https://spec.matrix.org/v1.12/client-server-api/#get_matrixclientv1roomsroomidthreads
+func Threads(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database,
+	rsAPI api.SyncRoomserverAPI,
+	rawRoomID string,
+) util.JSONResponse {
+	roomID, err := spec.NewRoomID(rawRoomID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid room ID"),
+		}
+	}
+
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("device.UserID invalid")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.Unknown("internal server error"),
+		}
+	}
+
+	var from types.StreamPosition
+	var limit int
+	include := req.URL.Query().Get("include")
+	if f := req.URL.Query().Get("from"); f != "" {
+		if from, err = types.NewStreamPositionFromString(f); err != nil {
+			return util.ErrorResponse(err)
+		}
+	}
+	if l := req.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			return util.ErrorResponse(err)
+		}
+	}
+	if limit <= 0 || limit > 50 {
+		limit = 50
+	}
+	if include == "" {
+		include = "all"
+	}
+	if include != "all" && include != "participated" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Bad include query parameter (should be either 'all' or 'participated')"),
+		}
+	}
+
+	// Only threads the user participated in are wanted, which we find by
+	// the sender ID the user has in the room.
+	var senderID string
+	if include == "participated" {
+		id, queryErr := rsAPI.QuerySenderIDForUser(req.Context(), *roomID, *userID)
+		if queryErr != nil {
+			util.GetLogger(req.Context()).WithError(queryErr).Error("rsAPI.QuerySenderIDForUser failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if id == nil {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: ThreadsResponse{Chunk: []synctypes.ClientEvent{}},
+			}
+		}
+		senderID = string(*id)
+	}
+
+	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get snapshot for threads")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	res := &ThreadsResponse{
+		Chunk: []synctypes.ClientEvent{},
+	}
+	var events []types.StreamEvent
+	events, res.NextBatch, err = snapshot.ThreadsFor(req.Context(), roomID.String(), senderID, from, limit)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	headeredEvents := make([]*rstypes.HeaderedEvent, 0, len(events))
+	for _, event := range events {
+		headeredEvents = append(headeredEvents, event.HeaderedEvent)
+	}
+
+	// Apply history visibility to the thread roots.
+	filteredEvents, err := internal.ApplyHistoryVisibilityFilter(req.Context(), snapshot, rsAPI, headeredEvents, nil, *userID, "threads")
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	res.Chunk = make([]synctypes.ClientEvent, 0, len(filteredEvents))
+	for _, event := range filteredEvents {
+		clientEvent, err := synctypes.ToClientEvent(event.PDU, synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
+		})
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("eventID", event.EventID()).Error("Failed converting to ClientEvent")
+			continue
+		}
+		res.Chunk = append(res.Chunk, *clientEvent)
+	}
+
+	if err = internal.BundleThreadAggregations(req.Context(), snapshot, rsAPI, *userID, *roomID, res.Chunk, synctypes.FormatAll); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	succeeded = true
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -105,6 +105,12 @@ type DatabaseTransaction interface {
 	GetPresences(ctx context.Context, userID []string) ([]*types.PresenceInternal, error)
 	PresenceAfter(ctx context.Context, after types.StreamPosition, filter synctypes.EventFilter) (map[string]*types.PresenceInternal, error)
 	RelationsFor(ctx context.Context, roomID, eventID, relType, eventType string, from, to types.StreamPosition, backwards bool, limit int) (events []types.StreamEvent, prevBatch, nextBatch string, err error)
+	// ThreadsFor returns the roots of the threads in the room, most recently replied to first. If the
+	// sender ID is not empty, only threads which the sender participated in are returned.
+	ThreadsFor(ctx context.Context, roomID, senderID string, from types.StreamPosition, limit int) (events []types.StreamEvent, nextBatch string, err error)
+	// ThreadSummaries returns a map of root event ID -> summary for those of the given events which are
+	// thread roots. The sender ID is used to work out whether the sender participated in the threads.
+	ThreadSummaries(ctx context.Context, roomID, senderID string, eventIDs []string) (map[string]types.ThreadSummary, error)
 }
 
 type Database interface {
@@ -132,6 +138,11 @@ type Database interface {
 	PurgeRoomState(ctx context.Context, roomID string) error
 	// PurgeRoom entirely eliminates a room from the sync API, timeline, state and all.
 	PurgeRoom(ctx context.Context, roomID string) error
+	// RoomIDsWithEvents returns the IDs of all the rooms that have events in the sync API.
+	RoomIDsWithEvents(ctx context.Context) ([]string, error)
+	// PurgeExpiredEvents removes up to `limit` events in the room which were sent before the given
+	// time from the sync API, leaving state events in place. Returns the IDs of the removed events.
+	PurgeExpiredEvents(ctx context.Context, roomID string, before spec.Timestamp, limit int) ([]string, error)
 	// UpsertAccountData keeps track of new or updated account data, by saving the type
 	// of the new/updated data, and the user ID and room ID the data is related to (empty)
 	// room ID means the data isn't specific to any room)
@@ -170,8 +181,9 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *synctypes.Filter) (string, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *rstypes.HeaderedEvent, querier api.QuerySenderIDAPI) error
-	// StoreReceipt stores new receipt events
-	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
+	// StoreReceipt stores new receipt events. Receipts for different threads are stored separately,
+	// with an empty thread ID for receipts which apply to the whole room.
+	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId, threadID string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
 	UpdateIgnoresForUser(ctx context.Context, userID string, ignores *types.IgnoredUsers) error
 	ReIndex(ctx context.Context, limit, afterID int64) (map[int64]rstypes.HeaderedEvent, error)
 	UpdateRelations(ctx context.Context, event *rstypes.HeaderedEvent) error
@@ -195,5 +207,6 @@ type SharedUsers interface {
 
 type Notifications interface {
 	// UpsertRoomUnreadNotificationCounts updates the notification statistics about a (user, room) key.
-	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	// The thread counts are by thread root event ID, and are included in the room counts.
+	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 }
@@ -0,0 +1,25 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddReceiptThreadID adds the thread ID to receipts, so that users can have
+// a receipt for each thread in a room.
+func UpAddReceiptThreadID(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE syncapi_receipts ADD COLUMN IF NOT EXISTS thread_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE syncapi_receipts DROP CONSTRAINT IF EXISTS syncapi_receipts_unique;
+ALTER TABLE syncapi_receipts ADD CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id, thread_id);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
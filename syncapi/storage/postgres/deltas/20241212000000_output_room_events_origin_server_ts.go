@@ -0,0 +1,26 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddOutputRoomEventsOriginServerTS adds the origin_server_ts column to the
+// output room events, so that expired events can be found without parsing them.
+func UpAddOutputRoomEventsOriginServerTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE syncapi_output_room_events ADD COLUMN IF NOT EXISTS origin_server_ts BIGINT NOT NULL DEFAULT 0;
+UPDATE syncapi_output_room_events SET origin_server_ts = COALESCE((headered_event_json::jsonb->>'origin_server_ts')::BIGINT, 0)
+	WHERE origin_server_ts = 0;
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_origin_server_ts_idx ON syncapi_output_room_events (room_id, origin_server_ts);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/ike20013/dendrite/syncapi/types"
 	"github.com/lib/pq"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const outputRoomEventsSchema = `
@@ -63,7 +64,9 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
   -- were emitted.
   exclude_from_sync BOOL DEFAULT FALSE,
   -- The history visibility before this event (1 - world_readable; 2 - shared; 3 - invited; 4 - joined)
-  history_visibility SMALLINT NOT NULL DEFAULT 2
+  history_visibility SMALLINT NOT NULL DEFAULT 2,
+  -- The 'origin_server_ts' property of the event, used to find expired events.
+  origin_server_ts BIGINT NOT NULL DEFAULT 0
 );
 
 CREATE INDEX IF NOT EXISTS syncapi_output_room_events_type_idx ON syncapi_output_room_events (type);
@@ -79,8 +82,8 @@ CREATE INDEX IF NOT EXISTS syncapi_output_room_events_recent_events_idx ON synca
 
 const insertEventSQL = "" +
 	"INSERT INTO syncapi_output_room_events (" +
-	"room_id, event_id, headered_event_json, type, sender, contains_url, add_state_ids, remove_state_ids, session_id, transaction_id, exclude_from_sync, history_visibility" +
-	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) " +
+	"room_id, event_id, headered_event_json, type, sender, contains_url, add_state_ids, remove_state_ids, session_id, transaction_id, exclude_from_sync, history_visibility, origin_server_ts" +
+	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) " +
 	"ON CONFLICT ON CONSTRAINT syncapi_output_room_event_id_idx DO UPDATE SET exclude_from_sync = (excluded.exclude_from_sync AND $11) " +
 	"RETURNING id"
 
@@ -183,6 +186,17 @@ const purgeEventsSQL = "" +
 
 const selectSearchSQL = "SELECT id, event_id, headered_event_json FROM syncapi_output_room_events WHERE id > $1 AND type = ANY($2) ORDER BY id ASC LIMIT $3"
 
+const selectRoomIDsSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_output_room_events"
+
+const selectExpiredEventIDsSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts < $2 AND NOT (headered_event_json::jsonb ? 'state_key')" +
+	" LIMIT $3"
+
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = ANY($1)"
+
 type outputRoomEventsStatements struct {
 	insertEventStmt                *sql.Stmt
 	selectEventsStmt               *sql.Stmt
@@ -199,6 +213,9 @@ type outputRoomEventsStatements struct {
 	selectContextAfterEventStmt    *sql.Stmt
 	purgeEventsStmt                *sql.Stmt
 	selectSearchStmt               *sql.Stmt
+	selectRoomIDsStmt              *sql.Stmt
+	selectExpiredEventIDsStmt      *sql.Stmt
+	deleteEventsStmt               *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -232,6 +249,10 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 			Version: migrationName,
 			Up:      deltas.UpRenameOutputRoomEventsIndex,
 		},
+		sqlutil.Migration{
+			Version: "syncapi: add origin_server_ts column (output_room_events)",
+			Up:      deltas.UpAddOutputRoomEventsOriginServerTS,
+		},
 	)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -254,6 +275,9 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectContextAfterEventStmt, selectContextAfterEventSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.selectSearchStmt, selectSearchSQL},
+		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
+		{&s.selectExpiredEventIDsStmt, selectExpiredEventIDsSQL},
+		{&s.deleteEventsStmt, deleteEventsSQL},
 	}.Prepare(db)
 }
 
@@ -407,6 +431,7 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		txnID,
 		excludeFromSync,
 		historyVisibility,
+		event.OriginServerTS(),
 	).Scan(&streamPos)
 	return
 }
@@ -702,6 +727,47 @@ func (s *outputRoomEventsStatements) PurgeEvents(
 	return err
 }
 
+func (s *outputRoomEventsStatements) SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomIDsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectRoomIDs: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) SelectExpiredEventIDs(
+	ctx context.Context, txn *sql.Tx, roomID string, before spec.Timestamp, limit int,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectExpiredEventIDsStmt).QueryContext(ctx, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectExpiredEventIDs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) DeleteEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEventsStmt).ExecContext(ctx, pq.StringArray(eventIDs))
+	return err
+}
+
 func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, limit, afterID int64, types []string) (map[int64]rstypes.HeaderedEvent, error) {
 	rows, err := sqlutil.TxStmt(txn, s.selectSearchStmt).QueryContext(ctx, afterID, pq.StringArray(types), limit)
 	if err != nil {
@@ -14,6 +14,7 @@ import (
 	rstypes "github.com/ike20013/dendrite/roomserver/types"
 	"github.com/ike20013/dendrite/syncapi/storage/tables"
 	"github.com/ike20013/dendrite/syncapi/types"
+	"github.com/lib/pq"
 )
 
 const outputRoomEventsTopologySchema = `
@@ -65,6 +66,9 @@ const selectStreamToTopologicalPositionDescSQL = "" +
 const purgeEventsTopologySQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
+const deleteEventsTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE event_id = ANY($1)"
+
 type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt                 *sql.Stmt
 	selectEventIDsInRangeASCStmt              *sql.Stmt
@@ -73,6 +77,7 @@ type outputRoomEventsTopologyStatements struct {
 	selectStreamToTopologicalPositionAscStmt  *sql.Stmt
 	selectStreamToTopologicalPositionDescStmt *sql.Stmt
 	purgeEventsTopologyStmt                   *sql.Stmt
+	deleteEventsTopologyStmt                  *sql.Stmt
 }
 
 func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -89,6 +94,7 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 		{&s.selectStreamToTopologicalPositionAscStmt, selectStreamToTopologicalPositionAscSQL},
 		{&s.selectStreamToTopologicalPositionDescStmt, selectStreamToTopologicalPositionDescSQL},
 		{&s.purgeEventsTopologyStmt, purgeEventsTopologySQL},
+		{&s.deleteEventsTopologyStmt, deleteEventsTopologySQL},
 	}.Prepare(db)
 }
 
@@ -179,3 +185,10 @@ func (s *outputRoomEventsTopologyStatements) PurgeEventsTopology(
 	_, err := sqlutil.TxStmt(txn, s.purgeEventsTopologyStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) DeleteEventsTopology(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEventsTopologyStmt).ExecContext(ctx, pq.StringArray(eventIDs))
+	return err
+}
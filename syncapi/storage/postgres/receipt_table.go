@@ -33,21 +33,23 @@ CREATE TABLE IF NOT EXISTS syncapi_receipts (
 	user_id TEXT NOT NULL,
 	event_id TEXT NOT NULL,
 	receipt_ts BIGINT NOT NULL,
-	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id)
+	-- The thread the receipt is for, or empty if it is for the whole room.
+	thread_id TEXT NOT NULL DEFAULT '',
+	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id, thread_id)
 );
 CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id ON syncapi_receipts(room_id);
 `
 
 const upsertReceipt = "" +
 	"INSERT INTO syncapi_receipts" +
-	" (room_id, receipt_type, user_id, event_id, receipt_ts)" +
-	" VALUES ($1, $2, $3, $4, $5)" +
-	" ON CONFLICT (room_id, receipt_type, user_id)" +
+	" (room_id, receipt_type, user_id, event_id, receipt_ts, thread_id)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (room_id, receipt_type, user_id, thread_id)" +
 	" DO UPDATE SET id = nextval('syncapi_receipt_id'), event_id = $4, receipt_ts = $5" +
 	" RETURNING id"
 
 const selectRoomReceipts = "" +
-	"SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts" +
+	"SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts, thread_id" +
 	" FROM syncapi_receipts" +
 	" WHERE room_id = ANY($1) AND id > $2"
 
@@ -74,6 +76,9 @@ func NewPostgresReceiptsTable(db *sql.DB) (tables.Receipts, error) {
 	m.AddMigrations(sqlutil.Migration{
 		Version: "syncapi: fix sequences",
 		Up:      deltas.UpFixSequences,
+	}, sqlutil.Migration{
+		Version: "syncapi: add thread_id to receipts",
+		Up:      deltas.UpAddReceiptThreadID,
 	})
 	err = m.Up(context.Background())
 	if err != nil {
@@ -90,9 +95,9 @@ func NewPostgresReceiptsTable(db *sql.DB) (tables.Receipts, error) {
 	}.Prepare(db)
 }
 
-func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error) {
+func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId, threadID string, timestamp spec.Timestamp) (pos types.StreamPosition, err error) {
 	stmt := sqlutil.TxStmt(txn, r.upsertReceipt)
-	err = stmt.QueryRowContext(ctx, roomId, receiptType, userId, eventId, timestamp).Scan(&pos)
+	err = stmt.QueryRowContext(ctx, roomId, receiptType, userId, eventId, timestamp, threadID).Scan(&pos)
 	return
 }
 
@@ -107,7 +112,7 @@ func (r *receiptStatements) SelectRoomReceiptsAfter(ctx context.Context, txn *sq
 	for rows.Next() {
 		r := types.OutputReceiptEvent{}
 		var id types.StreamPosition
-		err = rows.Scan(&id, &r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.Timestamp)
+		err = rows.Scan(&id, &r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.Timestamp, &r.ThreadID)
 		if err != nil {
 			return 0, res, fmt.Errorf("unable to scan row to api.Receipts: %w", err)
 		}
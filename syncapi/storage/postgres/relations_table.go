@@ -14,6 +14,7 @@ import (
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/syncapi/storage/tables"
 	"github.com/ike20013/dendrite/syncapi/types"
+	"github.com/lib/pq"
 )
 
 const relationsSchema = `
@@ -28,6 +29,9 @@ CREATE TABLE IF NOT EXISTS syncapi_relations (
 	rel_type TEXT NOT NULL,
 	CONSTRAINT syncapi_relations_unique UNIQUE (room_id, event_id, child_event_id, rel_type)
 );
+
+-- Used to find the threads in a room and summarise them.
+CREATE INDEX IF NOT EXISTS syncapi_relations_thread_idx ON syncapi_relations(room_id, rel_type, event_id, id);
 `
 
 const insertRelationSQL = "" +
@@ -39,6 +43,9 @@ const insertRelationSQL = "" +
 const deleteRelationSQL = "" +
 	"DELETE FROM syncapi_relations WHERE room_id = $1 AND child_event_id = $2"
 
+const deleteRelationsForEventsSQL = "" +
+	"DELETE FROM syncapi_relations WHERE room_id = $1 AND (event_id = ANY($2) OR child_event_id = ANY($2))"
+
 const selectRelationsInRangeAscSQL = "" +
 	"SELECT id, child_event_id, rel_type FROM syncapi_relations" +
 	" WHERE room_id = $1 AND event_id = $2" +
@@ -58,12 +65,38 @@ const selectRelationsInRangeDescSQL = "" +
 const selectMaxRelationIDSQL = "" +
 	"SELECT COALESCE(MAX(id), 0) FROM syncapi_relations"
 
+// The user participated in a thread if they sent the thread root or any of the replies.
+const threadParticipatedSQL = "" +
+	"EXISTS (SELECT 1 FROM syncapi_output_room_events e WHERE e.event_id = r.event_id AND e.sender = $2)" +
+	" OR EXISTS (" +
+	"  SELECT 1 FROM syncapi_relations r2 JOIN syncapi_output_room_events e ON e.event_id = r2.child_event_id" +
+	"  WHERE r2.room_id = $1 AND r2.event_id = r.event_id AND r2.rel_type = 'm.thread' AND e.sender = $2" +
+	")"
+
+const selectThreadsSQL = "" +
+	"SELECT r.event_id, MAX(r.id) FROM syncapi_relations r" +
+	" WHERE r.room_id = $1 AND r.rel_type = 'm.thread'" +
+	" GROUP BY r.event_id" +
+	" HAVING ( $3 = 0 OR MAX(r.id) < $3 )" +
+	" AND ( $2 = '' OR " + threadParticipatedSQL + " )" +
+	" ORDER BY MAX(r.id) DESC LIMIT $4"
+
+const selectThreadSummariesSQL = "" +
+	"SELECT r.event_id, t.count, r.child_event_id, ( " + threadParticipatedSQL + " ) FROM (" +
+	"  SELECT event_id, COUNT(*) AS count, MAX(id) AS latest_id FROM syncapi_relations" +
+	"  WHERE room_id = $1 AND rel_type = 'm.thread' AND event_id = ANY($3)" +
+	"  GROUP BY event_id" +
+	") t JOIN syncapi_relations r ON r.id = t.latest_id"
+
 type relationsStatements struct {
 	insertRelationStmt             *sql.Stmt
 	selectRelationsInRangeAscStmt  *sql.Stmt
 	selectRelationsInRangeDescStmt *sql.Stmt
 	deleteRelationStmt             *sql.Stmt
+	deleteRelationsForEventsStmt   *sql.Stmt
 	selectMaxRelationIDStmt        *sql.Stmt
+	selectThreadsStmt              *sql.Stmt
+	selectThreadSummariesStmt      *sql.Stmt
 }
 
 func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
@@ -77,7 +110,10 @@ func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
 		{&s.selectRelationsInRangeAscStmt, selectRelationsInRangeAscSQL},
 		{&s.selectRelationsInRangeDescStmt, selectRelationsInRangeDescSQL},
 		{&s.deleteRelationStmt, deleteRelationSQL},
+		{&s.deleteRelationsForEventsStmt, deleteRelationsForEventsSQL},
 		{&s.selectMaxRelationIDStmt, selectMaxRelationIDSQL},
+		{&s.selectThreadsStmt, selectThreadsSQL},
+		{&s.selectThreadSummariesStmt, selectThreadSummariesSQL},
 	}.Prepare(db)
 }
 
@@ -100,6 +136,13 @@ func (s *relationsStatements) DeleteRelation(
 	return err
 }
 
+func (s *relationsStatements) DeleteRelationsForEvents(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRelationsForEventsStmt).ExecContext(ctx, roomID, pq.StringArray(eventIDs))
+	return err
+}
+
 // SelectRelationsInRange returns a map rel_type -> []child_event_id
 func (s *relationsStatements) SelectRelationsInRange(
 	ctx context.Context, txn *sql.Tx, roomID, eventID, relType, eventType string,
@@ -148,3 +191,45 @@ func (s *relationsStatements) SelectMaxRelationID(
 	err = stmt.QueryRowContext(ctx).Scan(&id)
 	return
 }
+
+func (s *relationsStatements) SelectThreads(
+	ctx context.Context, txn *sql.Tx, roomID, senderID string, from types.StreamPosition, limit int,
+) ([]types.RelationEntry, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectThreadsStmt).QueryContext(ctx, roomID, senderID, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "selectThreads: rows.close() failed")
+	var result []types.RelationEntry
+	for rows.Next() {
+		var entry types.RelationEntry
+		if err = rows.Scan(&entry.EventID, &entry.Position); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+func (s *relationsStatements) SelectThreadSummaries(
+	ctx context.Context, txn *sql.Tx, roomID, senderID string, eventIDs []string,
+) (map[string]types.ThreadSummary, error) {
+	result := make(map[string]types.ThreadSummary)
+	if len(eventIDs) == 0 {
+		return result, nil
+	}
+	rows, err := sqlutil.TxStmt(txn, s.selectThreadSummariesStmt).QueryContext(ctx, roomID, senderID, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "selectThreadSummaries: rows.close() failed")
+	for rows.Next() {
+		var eventID string
+		var summary types.ThreadSummary
+		if err = rows.Scan(&eventID, &summary.Count, &summary.LatestEventID, &summary.Participated); err != nil {
+			return nil, err
+		}
+		result[eventID] = summary
+	}
+	return result, rows.Err()
+}
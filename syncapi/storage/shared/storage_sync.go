@@ -695,6 +695,32 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 	})
 }
 
+func (d *Database) RoomIDsWithEvents(ctx context.Context) ([]string, error) {
+	return d.OutputEvents.SelectRoomIDs(ctx, nil)
+}
+
+func (d *Database) PurgeExpiredEvents(
+	ctx context.Context, roomID string, before spec.Timestamp, limit int,
+) (eventIDs []string, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		eventIDs, err = d.OutputEvents.SelectExpiredEventIDs(ctx, txn, roomID, before, limit)
+		if err != nil || len(eventIDs) == 0 {
+			return err
+		}
+		if err = d.OutputEvents.DeleteEvents(ctx, txn, eventIDs); err != nil {
+			return fmt.Errorf("failed to delete events: %w", err)
+		}
+		if err = d.Topology.DeleteEventsTopology(ctx, txn, eventIDs); err != nil {
+			return fmt.Errorf("failed to delete events topology: %w", err)
+		}
+		if err = d.Relations.DeleteRelationsForEvents(ctx, txn, roomID, eventIDs); err != nil {
+			return fmt.Errorf("failed to delete relations: %w", err)
+		}
+		return nil
+	})
+	return
+}
+
 func (d *Database) PurgeRoomState(
 	ctx context.Context, roomID string,
 ) error {
@@ -811,3 +837,35 @@ func (d *DatabaseTransaction) RelationsFor(ctx context.Context, roomID, eventID,
 
 	return events, prevBatch, nextBatch, nil
 }
+
+func (d *DatabaseTransaction) ThreadsFor(ctx context.Context, roomID, senderID string, from types.StreamPosition, limit int) (
+	events []types.StreamEvent, nextBatch string, err error,
+) {
+	// Ask for one more thread than we need, so that we know whether to set the
+	// "next_batch" in the response.
+	threads, err := d.Relations.SelectThreads(ctx, d.txn, roomID, senderID, from, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("d.Relations.SelectThreads: %w", err)
+	}
+	if len(threads) == 0 {
+		return nil, "", nil
+	}
+	if len(threads) > limit {
+		threads = threads[:limit]
+		nextBatch = fmt.Sprintf("%d", threads[len(threads)-1].Position)
+	}
+
+	eventIDs := make([]string, 0, len(threads))
+	for _, thread := range threads {
+		eventIDs = append(eventIDs, thread.EventID)
+	}
+	events, err = d.OutputEvents.SelectEvents(ctx, d.txn, eventIDs, nil, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+	return events, nextBatch, nil
+}
+
+func (d *DatabaseTransaction) ThreadSummaries(ctx context.Context, roomID, senderID string, eventIDs []string) (map[string]types.ThreadSummary, error) {
+	return d.Relations.SelectThreadSummaries(ctx, d.txn, roomID, senderID, eventIDs)
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddReceiptThreadID adds the thread ID to receipts, so that users can have
+// a receipt for each thread in a room. SQLite can't change the unique constraint
+// of an existing table, so the table is recreated.
+func UpAddReceiptThreadID(ctx context.Context, tx *sql.Tx) error {
+	// If the column exists, the table was already created with the new constraint.
+	if _, err := tx.ExecContext(ctx, "SELECT thread_id FROM syncapi_receipts LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE syncapi_receipts RENAME TO syncapi_receipts_tmp;
+CREATE TABLE syncapi_receipts (
+	id BIGINT,
+	room_id TEXT NOT NULL,
+	receipt_type TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	receipt_ts BIGINT NOT NULL,
+	thread_id TEXT NOT NULL DEFAULT '',
+	CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id, thread_id)
+);
+INSERT INTO syncapi_receipts (id, room_id, receipt_type, user_id, event_id, receipt_ts)
+	SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts FROM syncapi_receipts_tmp;
+DROP TABLE syncapi_receipts_tmp;
+CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id_idx ON syncapi_receipts(room_id);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
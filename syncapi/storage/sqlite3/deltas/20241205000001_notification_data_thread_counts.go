@@ -0,0 +1,26 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddNotificationDataThreadCounts adds the unread notification counts of
+// each thread, which are sent to clients that ask for them in /sync.
+func UpAddNotificationDataThreadCounts(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists", so check whether the column is there already.
+	if _, err := tx.ExecContext(ctx, "SELECT thread_counts FROM syncapi_notification_data LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `ALTER TABLE syncapi_notification_data ADD COLUMN thread_counts TEXT NOT NULL DEFAULT '{}';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddOutputRoomEventsOriginServerTS adds the origin_server_ts column to the
+// output room events, so that expired events can be found without parsing them.
+func UpAddOutputRoomEventsOriginServerTS(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists" for columns, so only add it if
+	// selecting it fails, i.e. the table was created before it existed.
+	if _, err := tx.ExecContext(ctx, "SELECT origin_server_ts FROM syncapi_output_room_events LIMIT 1"); err != nil {
+		_, err = tx.ExecContext(ctx, "ALTER TABLE syncapi_output_room_events ADD COLUMN origin_server_ts BIGINT NOT NULL DEFAULT 0;")
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	_, err := tx.ExecContext(ctx, `
+UPDATE syncapi_output_room_events SET origin_server_ts = COALESCE(json_extract(headered_event_json, '$.origin_server_ts'), 0)
+	WHERE origin_server_ts = 0;
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_origin_server_ts_idx ON syncapi_output_room_events (room_id, origin_server_ts);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
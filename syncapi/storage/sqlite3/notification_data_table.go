@@ -9,11 +9,13 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"strings"
 
 	"github.com/ike20013/dendrite/external"
 	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/syncapi/storage/sqlite3/deltas"
 	"github.com/ike20013/dendrite/syncapi/storage/tables"
 	"github.com/ike20013/dendrite/syncapi/types"
 )
@@ -23,6 +25,14 @@ func NewSqliteNotificationDataTable(db *sql.DB, streamID *StreamIDStatements) (t
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "syncapi: add thread counts to notification data",
+		Up:      deltas.UpAddNotificationDataThreadCounts,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	r := &notificationDataStatements{
 		streamIDStatements: streamID,
 		db:                 db,
@@ -51,16 +61,18 @@ CREATE TABLE IF NOT EXISTS syncapi_notification_data (
 	room_id TEXT NOT NULL,
 	notification_count BIGINT NOT NULL DEFAULT 0,
 	highlight_count BIGINT NOT NULL DEFAULT 0,
+	-- The counts of each thread as JSON, which are included in the counts above.
+	thread_counts TEXT NOT NULL DEFAULT '{}',
 	CONSTRAINT syncapi_notifications_unique UNIQUE (user_id, room_id)
 );`
 
 const upsertRoomUnreadNotificationCountsSQL = `INSERT INTO syncapi_notification_data
-  (user_id, room_id, notification_count, highlight_count)
-  VALUES ($1, $2, $3, $4)
+  (user_id, room_id, notification_count, highlight_count, thread_counts)
+  VALUES ($1, $2, $3, $4, $5)
   ON CONFLICT (user_id, room_id)
-  DO UPDATE SET id = $5, notification_count = $6, highlight_count = $7`
+  DO UPDATE SET id = $6, notification_count = $7, highlight_count = $8, thread_counts = $9`
 
-const selectUserUnreadNotificationsForRooms = `SELECT room_id, notification_count, highlight_count
+const selectUserUnreadNotificationsForRooms = `SELECT room_id, notification_count, highlight_count, thread_counts
 	FROM syncapi_notification_data
 	WHERE user_id = $1 AND
 	      room_id IN ($2)`
@@ -70,12 +82,19 @@ const selectMaxNotificationIDSQL = `SELECT CASE COUNT(*) WHEN 0 THEN 0 ELSE MAX(
 const purgeNotificationDataSQL = "" +
 	"DELETE FROM syncapi_notification_data WHERE room_id = $1"
 
-func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error) {
+func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (pos types.StreamPosition, err error) {
+	if threadCounts == nil {
+		threadCounts = map[string]eventutil.ThreadNotificationData{}
+	}
+	threadCountsJSON, err := json.Marshal(threadCounts)
+	if err != nil {
+		return
+	}
 	pos, err = r.streamIDStatements.nextNotificationID(ctx, nil)
 	if err != nil {
 		return
 	}
-	_, err = r.upsertRoomUnreadCounts.ExecContext(ctx, userID, roomID, notificationCount, highlightCount, pos, notificationCount, highlightCount)
+	_, err = r.upsertRoomUnreadCounts.ExecContext(ctx, userID, roomID, notificationCount, highlightCount, string(threadCountsJSON), pos, notificationCount, highlightCount, string(threadCountsJSON))
 	return
 }
 
@@ -102,16 +121,21 @@ func (r *notificationDataStatements) SelectUserUnreadCountsForRooms(
 	roomCounts := map[string]*eventutil.NotificationData{}
 	var roomID string
 	var notificationCount, highlightCount int
+	var threadCountsJSON string
 	for rows.Next() {
-		if err = rows.Scan(&roomID, &notificationCount, &highlightCount); err != nil {
+		if err = rows.Scan(&roomID, &notificationCount, &highlightCount, &threadCountsJSON); err != nil {
 			return nil, err
 		}
 
-		roomCounts[roomID] = &eventutil.NotificationData{
+		data := &eventutil.NotificationData{
 			RoomID:                  roomID,
 			UnreadNotificationCount: notificationCount,
 			UnreadHighlightCount:    highlightCount,
 		}
+		if err = json.Unmarshal([]byte(threadCountsJSON), &data.UnreadThreadNotifications); err != nil {
+			return nil, err
+		}
+		roomCounts[roomID] = data
 	}
 	return roomCounts, rows.Err()
 }
@@ -23,6 +23,7 @@ import (
 	"github.com/ike20013/dendrite/syncapi/synctypes"
 	"github.com/ike20013/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 
 	"github.com/ike20013/dendrite/external/sqlutil"
 )
@@ -42,7 +43,8 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
   session_id BIGINT,
   transaction_id TEXT,
   exclude_from_sync BOOL NOT NULL DEFAULT FALSE,
-  history_visibility SMALLINT NOT NULL DEFAULT 2 -- The history visibility before this event (1 - world_readable; 2 - shared; 3 - invited; 4 - joined)
+  history_visibility SMALLINT NOT NULL DEFAULT 2, -- The history visibility before this event (1 - world_readable; 2 - shared; 3 - invited; 4 - joined)
+  origin_server_ts BIGINT NOT NULL DEFAULT 0
 );
 
 CREATE INDEX IF NOT EXISTS syncapi_output_room_events_type_idx ON syncapi_output_room_events (type);
@@ -55,9 +57,9 @@ CREATE INDEX IF NOT EXISTS syncapi_output_room_events_remove_state_ids_idx ON sy
 
 const insertEventSQL = "" +
 	"INSERT INTO syncapi_output_room_events (" +
-	"id, room_id, event_id, headered_event_json, type, sender, contains_url, add_state_ids, remove_state_ids, session_id, transaction_id, exclude_from_sync, history_visibility" +
-	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) " +
-	"ON CONFLICT (event_id) DO UPDATE SET exclude_from_sync = (excluded.exclude_from_sync AND $14)"
+	"id, room_id, event_id, headered_event_json, type, sender, contains_url, add_state_ids, remove_state_ids, session_id, transaction_id, exclude_from_sync, history_visibility, origin_server_ts" +
+	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) " +
+	"ON CONFLICT (event_id) DO UPDATE SET exclude_from_sync = (excluded.exclude_from_sync AND $15)"
 
 const selectEventsSQL = "" +
 	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events WHERE event_id IN ($1)"
@@ -110,6 +112,17 @@ const selectSearchSQL = "SELECT id, event_id, headered_event_json FROM syncapi_o
 const purgeEventsSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const selectRoomIDsSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_output_room_events"
+
+const selectExpiredEventIDsSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts < $2 AND json_type(headered_event_json, '$.state_key') IS NULL" +
+	" LIMIT $3"
+
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id IN ($1)"
+
 type outputRoomEventsStatements struct {
 	db                           *sql.DB
 	streamIDStatements           *StreamIDStatements
@@ -121,6 +134,8 @@ type outputRoomEventsStatements struct {
 	selectContextBeforeEventStmt *sql.Stmt
 	selectContextAfterEventStmt  *sql.Stmt
 	purgeEventsStmt              *sql.Stmt
+	selectRoomIDsStmt            *sql.Stmt
+	selectExpiredEventIDsStmt    *sql.Stmt
 	//selectSearchStmt             *sql.Stmt - prepared at runtime
 }
 
@@ -140,6 +155,10 @@ func NewSqliteEventsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Even
 			Version: "syncapi: add history visibility column (output_room_events)",
 			Up:      deltas.UpAddHistoryVisibilityColumnOutputRoomEvents,
 		},
+		sqlutil.Migration{
+			Version: "syncapi: add origin_server_ts column (output_room_events)",
+			Up:      deltas.UpAddOutputRoomEventsOriginServerTS,
+		},
 	)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -155,6 +174,8 @@ func NewSqliteEventsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Even
 		{&s.selectContextBeforeEventStmt, selectContextBeforeEventSQL},
 		{&s.selectContextAfterEventStmt, selectContextAfterEventSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
+		{&s.selectExpiredEventIDsStmt, selectExpiredEventIDsSQL},
 		//{&s.selectSearchStmt, selectSearchSQL}, - prepared at runtime
 	}.Prepare(db)
 }
@@ -348,6 +369,7 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		txnID,
 		excludeFromSync,
 		historyVisibility,
+		event.OriginServerTS(),
 		excludeFromSync,
 	)
 	return streamPos, err
@@ -635,6 +657,56 @@ func (s *outputRoomEventsStatements) PurgeEvents(
 	return err
 }
 
+func (s *outputRoomEventsStatements) SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomIDsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectRoomIDs: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) SelectExpiredEventIDs(
+	ctx context.Context, txn *sql.Tx, roomID string, before spec.Timestamp, limit int,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectExpiredEventIDsStmt).QueryContext(ctx, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectExpiredEventIDs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) DeleteEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) error {
+	params := make([]interface{}, len(eventIDs))
+	for i := range eventIDs {
+		params[i] = eventIDs[i]
+	}
+	stmt, err := s.db.Prepare(strings.Replace(deleteEventsSQL, "($1)", sqlutil.QueryVariadic(len(eventIDs)), 1))
+	if err != nil {
+		return err
+	}
+	defer external.CloseAndLogIfError(ctx, stmt, "DeleteEvents: stmt.close() failed")
+	_, err = sqlutil.TxStmt(txn, stmt).ExecContext(ctx, params...)
+	return err
+}
+
 func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, limit, afterID int64, types []string) (map[int64]rstypes.HeaderedEvent, error) {
 	params := make([]interface{}, len(types)+1)
 	params[0] = afterID
@@ -8,6 +8,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"strings"
 
 	"github.com/ike20013/dendrite/external"
 	"github.com/ike20013/dendrite/external/sqlutil"
@@ -62,6 +63,9 @@ const selectStreamToTopologicalPositionDescSQL = "" +
 const purgeEventsTopologySQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
+const deleteEventsTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE event_id IN ($1)"
+
 type outputRoomEventsTopologyStatements struct {
 	db                                        *sql.DB
 	insertEventInTopologyStmt                 *sql.Stmt
@@ -181,3 +185,19 @@ func (s *outputRoomEventsTopologyStatements) PurgeEventsTopology(
 	_, err := sqlutil.TxStmt(txn, s.purgeEventsTopologyStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) DeleteEventsTopology(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) error {
+	params := make([]interface{}, len(eventIDs))
+	for i := range eventIDs {
+		params[i] = eventIDs[i]
+	}
+	stmt, err := s.db.Prepare(strings.Replace(deleteEventsTopologySQL, "($1)", sqlutil.QueryVariadic(len(eventIDs)), 1))
+	if err != nil {
+		return err
+	}
+	defer external.CloseAndLogIfError(ctx, stmt, "DeleteEventsTopology: stmt.close() failed")
+	_, err = sqlutil.TxStmt(txn, stmt).ExecContext(ctx, params...)
+	return err
+}
@@ -72,6 +72,12 @@ type Events interface {
 	SelectContextAfterEvent(ctx context.Context, txn *sql.Tx, id int, roomID string, filter *synctypes.RoomEventFilter) (int, []*rstypes.HeaderedEvent, error)
 
 	PurgeEvents(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectRoomIDs returns the IDs of all the rooms that have events.
+	SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]string, error)
+	// SelectExpiredEventIDs returns the IDs of up to `limit` events in the room that were sent
+	// before the given time, leaving out state events.
+	SelectExpiredEventIDs(ctx context.Context, txn *sql.Tx, roomID string, before spec.Timestamp, limit int) ([]string, error)
+	DeleteEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) error
 	ReIndex(ctx context.Context, txn *sql.Tx, limit, offset int64, types []string) (map[int64]rstypes.HeaderedEvent, error)
 }
 
@@ -91,6 +97,7 @@ type Topology interface {
 	// SelectStreamToTopologicalPosition converts a stream position to a topological position by finding the nearest topological position in the room.
 	SelectStreamToTopologicalPosition(ctx context.Context, txn *sql.Tx, roomID string, streamPos types.StreamPosition, forward bool) (topoPos types.StreamPosition, err error)
 	PurgeEventsTopology(ctx context.Context, txn *sql.Tx, roomID string) error
+	DeleteEventsTopology(ctx context.Context, txn *sql.Tx, eventIDs []string) error
 }
 
 type CurrentRoomState interface {
@@ -177,7 +184,7 @@ type Filter interface {
 }
 
 type Receipts interface {
-	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
+	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId, threadID string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
 	SelectRoomReceiptsAfter(ctx context.Context, txn *sql.Tx, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []types.OutputReceiptEvent, error)
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 	PurgeReceipts(ctx context.Context, txn *sql.Tx, roomID string) error
@@ -196,7 +203,7 @@ type Memberships interface {
 }
 
 type NotificationData interface {
-	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 	SelectUserUnreadCountsForRooms(ctx context.Context, txn *sql.Tx, userID string, roomIDs []string) (map[string]*eventutil.NotificationData, error)
 	SelectMaxID(ctx context.Context, txn *sql.Tx) (int64, error)
 	PurgeNotificationData(ctx context.Context, txn *sql.Tx, roomID string) error
@@ -221,6 +228,8 @@ type Relations interface {
 	// Deletes a relation which already exists as the result of an event redaction. If the relation
 	// does not exist then this function will do nothing and return no error.
 	DeleteRelation(ctx context.Context, txn *sql.Tx, roomID, childEventID string) error
+	// Deletes the relations from or to any of the given events in the room.
+	DeleteRelationsForEvents(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string) error
 	// SelectRelationsInRange will return relations grouped by relation type within the given range.
 	// The map is relType -> []entry. If a relType parameter is specified then the results will only
 	// contain relations of that type, otherwise if "" is specified then all relations in the range
@@ -231,4 +240,12 @@ type Relations interface {
 	// should be if there are no boundaries supplied (i.e. we want to work backwards but don't have a
 	// "from" or want to work forwards and don't have a "to").
 	SelectMaxRelationID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectThreads returns the roots of the threads in the room, most recently replied to first.
+	// The position of each entry is that of the latest reply, and only threads with an earlier
+	// latest reply than "from" are returned, unless it is 0. If the sender ID is not empty, only
+	// threads which the sender participated in are returned.
+	SelectThreads(ctx context.Context, txn *sql.Tx, roomID, senderID string, from types.StreamPosition, limit int) ([]types.RelationEntry, error)
+	// SelectThreadSummaries returns a map of root event ID -> summary for those of the given
+	// events which are thread roots.
+	SelectThreadSummaries(ctx context.Context, txn *sql.Tx, roomID, senderID string, eventIDs []string) (map[string]types.ThreadSummary, error)
 }
@@ -3,6 +3,7 @@ package tables_test
 import (
 	"context"
 	"database/sql"
+	"reflect"
 	"testing"
 
 	"github.com/ike20013/dendrite/external/sqlutil"
@@ -12,9 +13,11 @@ import (
 	"github.com/ike20013/dendrite/syncapi/storage/tables"
 	"github.com/ike20013/dendrite/syncapi/types"
 	"github.com/ike20013/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
-func newRelationsTable(t *testing.T, dbType test.DBType) (tables.Relations, *sql.DB, func()) {
+func newRelationsTable(t *testing.T, dbType test.DBType) (tables.Relations, tables.Events, *sql.DB, func()) {
 	t.Helper()
 	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
@@ -24,21 +27,27 @@ func newRelationsTable(t *testing.T, dbType test.DBType) (tables.Relations, *sql
 		t.Fatalf("failed to open db: %s", err)
 	}
 
+	// The events table is needed to find out who participated in threads.
 	var tab tables.Relations
+	var events tables.Events
 	switch dbType {
 	case test.DBTypePostgres:
-		tab, err = postgres.NewPostgresRelationsTable(db)
+		if events, err = postgres.NewPostgresEventsTable(db); err == nil {
+			tab, err = postgres.NewPostgresRelationsTable(db)
+		}
 	case test.DBTypeSQLite:
 		var stream sqlite3.StreamIDStatements
 		if err = stream.Prepare(db); err != nil {
 			t.Fatalf("failed to prepare stream stmts: %s", err)
 		}
-		tab, err = sqlite3.NewSqliteRelationsTable(db, &stream)
+		if events, err = sqlite3.NewSqliteEventsTable(db, &stream); err == nil {
+			tab, err = sqlite3.NewSqliteRelationsTable(db, &stream)
+		}
 	}
 	if err != nil {
 		t.Fatalf("failed to make new table: %s", err)
 	}
-	return tab, db, close
+	return tab, events, db, close
 }
 
 func compareRelationsToExpected(t *testing.T, tab tables.Relations, r types.Range, expected []types.RelationEntry) {
@@ -66,7 +75,7 @@ const relType = "m.reaction"
 func TestRelationsTable(t *testing.T) {
 	ctx := context.Background()
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
-		tab, _, close := newRelationsTable(t, dbType)
+		tab, _, _, close := newRelationsTable(t, dbType)
 		defer close()
 
 		// Insert some relations
@@ -184,3 +193,98 @@ func TestRelationsTable(t *testing.T) {
 		}
 	})
 }
+
+func TestRelationsThreads(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+
+	rootA := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "root A"})
+	rootB := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "root B"})
+	replyA1 := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "reply A1"})
+	replyB1 := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "reply B1"})
+	replyA2 := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "reply A2"})
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, events, db, close := newRelationsTable(t, dbType)
+		defer close()
+
+		err := sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+			for _, ev := range room.Events() {
+				// The sender is needed to find out who participated in threads.
+				userID, err := spec.NewUserID(string(ev.SenderID()), true)
+				if err != nil {
+					return err
+				}
+				ev.UserID = *userID
+				if _, err := events.InsertEvent(ctx, txn, ev, nil, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to insert events: %s", err)
+		}
+		for _, reply := range []struct{ root, child string }{
+			{rootA.EventID(), replyA1.EventID()},
+			{rootB.EventID(), replyB1.EventID()},
+			{rootA.EventID(), replyA2.EventID()},
+		} {
+			if err := tab.InsertRelation(ctx, nil, room.ID, reply.root, reply.child, "m.room.message", "m.thread"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Reactions aren't thread replies, so this shouldn't make a thread.
+		if err := tab.InsertRelation(ctx, nil, room.ID, replyA1.EventID(), "$reaction", "m.reaction", "m.annotation"); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, tc := range map[string]struct {
+			senderID string
+			from     types.StreamPosition
+			limit    int
+			want     []types.RelationEntry
+		}{
+			"all": {limit: 10, want: []types.RelationEntry{
+				{Position: 3, EventID: rootA.EventID()},
+				{Position: 2, EventID: rootB.EventID()},
+			}},
+			"limited": {limit: 1, want: []types.RelationEntry{
+				{Position: 3, EventID: rootA.EventID()},
+			}},
+			"from": {from: 3, limit: 10, want: []types.RelationEntry{
+				{Position: 2, EventID: rootB.EventID()},
+			}},
+			"participated by root": {senderID: alice.ID, limit: 10, want: []types.RelationEntry{
+				{Position: 3, EventID: rootA.EventID()},
+			}},
+			"participated by reply": {senderID: bob.ID, limit: 10, want: []types.RelationEntry{
+				{Position: 3, EventID: rootA.EventID()},
+				{Position: 2, EventID: rootB.EventID()},
+			}},
+		} {
+			got, err := tab.SelectThreads(ctx, nil, room.ID, tc.senderID, tc.from, tc.limit)
+			if err != nil {
+				t.Fatalf("%s: failed to select threads: %s", name, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("%s: got threads %+v, want %+v", name, got, tc.want)
+			}
+		}
+
+		summaries, err := tab.SelectThreadSummaries(ctx, nil, room.ID, alice.ID, []string{rootA.EventID(), rootB.EventID(), replyA1.EventID()})
+		if err != nil {
+			t.Fatalf("failed to select thread summaries: %s", err)
+		}
+		want := map[string]types.ThreadSummary{
+			rootA.EventID(): {Count: 2, LatestEventID: replyA2.EventID(), Participated: true},
+			rootB.EventID(): {Count: 1, LatestEventID: replyB1.EventID(), Participated: false},
+		}
+		if !reflect.DeepEqual(summaries, want) {
+			t.Fatalf("got thread summaries %+v, want %+v", summaries, want)
+		}
+	})
+}
@@ -60,6 +60,19 @@ func (p *NotificationDataStreamProvider) IncrementalSync(
 			HighlightCount:    counts.UnreadHighlightCount,
 			NotificationCount: counts.UnreadNotificationCount,
 		}
+		// If the client wants the counts of each thread separately, the room
+		// counts are only those of the main timeline.
+		if req.Filter.Room.Timeline.UnreadThreadNotifications && len(counts.UnreadThreadNotifications) > 0 {
+			jr.UnreadThreadNotifications = make(map[string]*types.UnreadNotifications, len(counts.UnreadThreadNotifications))
+			for threadID, thread := range counts.UnreadThreadNotifications {
+				jr.UnreadThreadNotifications[threadID] = &types.UnreadNotifications{
+					HighlightCount:    thread.UnreadHighlightCount,
+					NotificationCount: thread.UnreadNotificationCount,
+				}
+				jr.UnreadNotifications.HighlightCount -= thread.UnreadHighlightCount
+				jr.UnreadNotifications.NotificationCount -= thread.UnreadNotificationCount
+			}
+		}
 		req.Response.Rooms.Join[roomID] = jr
 	}
 
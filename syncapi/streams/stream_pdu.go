@@ -157,6 +157,21 @@ func (p *PDUStreamProvider) CompleteSync(
 		}
 	}
 
+	// Add rooms that the user has knocked on.
+	knockedRoomIDs, err := snapshot.RoomIDsWithMembership(ctx, req.Device.UserID, spec.Knock)
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.RoomIDsWithMembership failed")
+		return from
+	}
+	for _, roomID := range knockedRoomIDs {
+		if err = p.addKnockToResponse(ctx, snapshot, req, roomID, eventFormat); err != nil {
+			req.Log.WithError(err).Error("p.addKnockToResponse failed")
+			if ctxErr := req.Context.Err(); ctxErr != nil || err == sql.ErrTxDone {
+				return from
+			}
+		}
+	}
+
 	return to
 }
 
@@ -443,6 +458,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		jr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		})
+		p.bundleThreadAggregations(ctx, snapshot, device, delta.RoomID, jr.Timeline.Events, eventFormat)
 		// If we are limited by the filter AND the history visibility filter
 		// didn't "remove" events, return that the response is limited.
 		jr.Timeline.Limited = (limited && len(events) == len(recentEvents)) || delta.NewlyJoined
@@ -480,11 +496,43 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 			return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		})
 		req.Response.Rooms.Leave[delta.RoomID] = lr
+
+	case spec.Knock:
+		if err = p.addKnockToResponse(ctx, snapshot, req, delta.RoomID, eventFormat); err != nil {
+			return r.From, fmt.Errorf("p.addKnockToResponse: %w", err)
+		}
 	}
 
 	return latestPosition, nil
 }
 
+// addKnockToResponse adds a room to the "knock" section of the response if
+// the user's current membership in the room is still a knock.
+func (p *PDUStreamProvider) addKnockToResponse(
+	ctx context.Context,
+	snapshot storage.DatabaseTransaction,
+	req *types.SyncRequest,
+	roomID string,
+	eventFormat synctypes.ClientEventFormat,
+) error {
+	knockEvent, err := snapshot.GetStateEvent(ctx, roomID, spec.MRoomMember, req.Device.UserID)
+	if err != nil {
+		return err
+	}
+	if knockEvent == nil {
+		return nil
+	}
+	if membership, _ := knockEvent.Membership(); membership != spec.Knock {
+		return nil
+	}
+	kr, err := types.NewKnockResponse(ctx, p.rsAPI, knockEvent, eventFormat)
+	if err != nil {
+		return err
+	}
+	req.Response.Rooms.Knock[roomID] = kr
+	return nil
+}
+
 // applyHistoryVisibilityFilter gets the current room state and supplies it to ApplyHistoryVisibilityFilter, to make
 // sure we always return the required events in the timeline.
 func applyHistoryVisibilityFilter(
@@ -638,6 +686,9 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	jr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 	})
+	if !isPeek {
+		p.bundleThreadAggregations(ctx, snapshot, device, roomID, jr.Timeline.Events, eventFormat)
+	}
 	// If we are limited by the filter AND the history visibility filter
 	// didn't "remove" events, return that the response is limited.
 	jr.Timeline.Limited = limited && len(events) == len(recentEvents)
@@ -647,6 +698,28 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	return jr, nil
 }
 
+// bundleThreadAggregations adds the m.thread bundled aggregations to the timeline
+// of a room. The timeline is still usable without them, so errors are only logged.
+func (p *PDUStreamProvider) bundleThreadAggregations(
+	ctx context.Context, snapshot storage.DatabaseTransaction, device *userapi.Device,
+	roomID string, events []synctypes.ClientEvent, eventFormat synctypes.ClientEventFormat,
+) {
+	if len(events) == 0 {
+		return
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return
+	}
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return
+	}
+	if err = internal.BundleThreadAggregations(ctx, snapshot, p.rsAPI, *userID, *validRoomID, events, eventFormat); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn("failed to bundle thread aggregations")
+	}
+}
+
 func (p *PDUStreamProvider) lazyLoadMembers(
 	ctx context.Context, snapshot storage.DatabaseTransaction, roomID string,
 	incremental, limited bool, stateFilter *synctypes.StateFilter,
@@ -45,6 +45,8 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+	// The state of the sliding sync connections of each device
+	slidingSyncConns *slidingSyncConnections
 }
 
 type PresencePublisher interface {
@@ -79,9 +81,12 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+
+		slidingSyncConns: newSlidingSyncConnections(),
 	}
 	go rp.cleanLastSeen()
 	go rp.cleanPresence(db, time.Minute*5)
+	go rp.cleanSlidingSyncConnections()
 	return rp
 }
 
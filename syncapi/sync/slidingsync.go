@@ -0,0 +1,1125 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/ike20013/dendrite/clientapi/httputil"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	rstypes "github.com/ike20013/dendrite/roomserver/types"
+	"github.com/ike20013/dendrite/syncapi/internal"
+	"github.com/ike20013/dendrite/syncapi/storage"
+	"github.com/ike20013/dendrite/syncapi/streams"
+	"github.com/ike20013/dendrite/syncapi/synctypes"
+	"github.com/ike20013/dendrite/syncapi/types"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+)
+
+// How long a sliding sync connection is remembered for after it was last used.
+// Clients start a new connection when they get M_UNKNOWN_POS.
+const slidingSyncConnectionTimeout = time.Minute * 30
+
+// The number of connections remembered for each device. Starting another one
+// forgets the connection which was used least recently.
+const slidingSyncMaxConnectionsPerDevice = 10
+
+// The number of positions remembered for each connection after the one the
+// client synced from, in case it keeps syncing from that rather than the latest.
+const slidingSyncMaxPositions = 10
+
+// The number of events looked at to find the leave event of a room the user left.
+const leftRoomTimelineLimit = 10
+
+var errUnknownPos = errors.New("unknown pos")
+
+// slidingSyncConnection is what we remember about a sliding sync connection, so that
+// responses only contain what the client hasn't seen yet.
+type slidingSyncConnection struct {
+	mu        sync.Mutex
+	lastUsed  time.Time
+	counter   int64
+	positions map[int64]*slidingSyncPosition
+}
+
+// slidingSyncPosition is the state of the connection after a response was sent.
+type slidingSyncPosition struct {
+	id    int64
+	token types.StreamingToken
+	// Rooms the client has seen on this connection.
+	rooms map[string]slidingSyncRoomState
+	// The number of rooms in each list.
+	lists map[string]int
+}
+
+func (p *slidingSyncPosition) String() string {
+	return strconv.FormatInt(p.id, 10) + "_" + p.token.String()
+}
+
+// slidingSyncRoomState is what the client knows about a room.
+type slidingSyncRoomState struct {
+	// The PDU position the timeline was sent up to.
+	pos        types.StreamPosition
+	membership string
+	// The required state the room was sent with.
+	config            string
+	notificationCount int
+	highlightCount    int
+}
+
+// load returns the position with the given pos token.
+func (c *slidingSyncConnection) load(pos string) (*slidingSyncPosition, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUsed = time.Now()
+	idStr, _, _ := strings.Cut(pos, "_")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, errUnknownPos
+	}
+	p, ok := c.positions[id]
+	if !ok || p.String() != pos {
+		return nil, errUnknownPos
+	}
+	return p, nil
+}
+
+// store remembers a new position. Positions from before the one the client
+// synced from are forgotten, as the client won't use them again, and so are
+// the oldest ones after it once there are too many.
+func (c *slidingSyncConnection) store(base, next *slidingSyncPosition) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUsed = time.Now()
+	c.counter++
+	next.id = c.counter
+	var baseID int64
+	if base != nil {
+		baseID = base.id
+	}
+	for id := range c.positions {
+		if id < baseID || (id != baseID && id <= next.id-slidingSyncMaxPositions) {
+			delete(c.positions, id)
+		}
+	}
+	c.positions[next.id] = next
+	return next.String()
+}
+
+func (c *slidingSyncConnection) lastUsedAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastUsed
+}
+
+// slidingSyncConnections are the connections of each device.
+type slidingSyncConnections struct {
+	mu sync.Mutex
+	// user ID|device ID -> conn ID -> connection
+	devices map[string]map[string]*slidingSyncConnection
+}
+
+func newSlidingSyncConnections() *slidingSyncConnections {
+	return &slidingSyncConnections{
+		devices: make(map[string]map[string]*slidingSyncConnection),
+	}
+}
+
+// start starts a new connection, replacing any existing one with the same ID.
+func (s *slidingSyncConnections) start(device *userapi.Device, connID string) *slidingSyncConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := device.UserID + "|" + device.ID
+	conns := s.devices[key]
+	if conns == nil {
+		conns = make(map[string]*slidingSyncConnection)
+		s.devices[key] = conns
+	}
+	if _, ok := conns[connID]; !ok && len(conns) >= slidingSyncMaxConnectionsPerDevice {
+		var oldestID string
+		var oldest time.Time
+		for id, conn := range conns {
+			if lastUsed := conn.lastUsedAt(); oldestID == "" || lastUsed.Before(oldest) {
+				oldestID, oldest = id, lastUsed
+			}
+		}
+		delete(conns, oldestID)
+	}
+	conn := &slidingSyncConnection{
+		lastUsed:  time.Now(),
+		positions: make(map[int64]*slidingSyncPosition),
+	}
+	conns[connID] = conn
+	return conn
+}
+
+// get returns an existing connection, or nil if there isn't one.
+func (s *slidingSyncConnections) get(device *userapi.Device, connID string) *slidingSyncConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[device.UserID+"|"+device.ID][connID]
+}
+
+// expire forgets the connections which haven't been used for the timeout.
+func (s *slidingSyncConnections) expire(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, conns := range s.devices {
+		for connID, conn := range conns {
+			if time.Since(conn.lastUsedAt()) > timeout {
+				delete(conns, connID)
+			}
+		}
+		if len(conns) == 0 {
+			delete(s.devices, key)
+		}
+	}
+}
+
+func (rp *RequestPool) cleanSlidingSyncConnections() {
+	for {
+		rp.slidingSyncConns.expire(slidingSyncConnectionTimeout)
+		time.Sleep(time.Minute)
+	}
+}
+
+// slidingSyncConnection returns the connection and the position the client is syncing
+// from. A request without a pos starts a new connection.
+func (rp *RequestPool) slidingSyncConnection(device *userapi.Device, connID, pos string) (*slidingSyncConnection, *slidingSyncPosition, error) {
+	if pos == "" {
+		return rp.slidingSyncConns.start(device, connID), nil, nil
+	}
+	conn := rp.slidingSyncConns.get(device, connID)
+	if conn == nil {
+		return nil, nil, errUnknownPos
+	}
+	base, err := conn.load(pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, base, nil
+}
+
+// OnIncomingSlidingSyncRequest is called when a client makes a simplified sliding sync
+// request. Like /sync, it blocks until there is something new for the client, or until
+// the timeout is reached.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4186
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var body types.SlidingSyncRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	for name, list := range body.Lists {
+		for _, r := range list.Ranges {
+			if r[0] < 0 || r[1] < r[0] {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam(fmt.Sprintf("invalid range in list %q", name)),
+				}
+			}
+		}
+	}
+	var toDeviceSince types.StreamPosition
+	if toDevice := body.Extensions.ToDevice; toDevice != nil && toDevice.Enabled && toDevice.Since != "" {
+		var err error
+		if toDeviceSince, err = types.NewStreamPositionFromString(toDevice.Since); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("invalid to_device since"),
+			}
+		}
+	}
+
+	conn, base, err := rp.slidingSyncConnection(device, body.ConnID, req.URL.Query().Get("pos"))
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{ErrCode: "M_UNKNOWN_POS", Err: "Unknown pos, the connection must be restarted"},
+		}
+	}
+
+	timeout := getTimeout(req.URL.Query().Get("timeout"))
+	logger := util.GetLogger(req.Context()).WithFields(logrus.Fields{
+		"user_id":   device.UserID,
+		"device_id": device.ID,
+		"conn_id":   body.ConnID,
+		"pos":       req.URL.Query().Get("pos"),
+		"timeout":   timeout,
+	})
+
+	activeSyncRequests.Inc()
+	defer activeSyncRequests.Dec()
+
+	rp.updateLastSeen(req, device)
+	rp.updatePresence(rp.db, req.FormValue("set_presence"), device.UserID)
+
+	// Clean up the send-to-device messages which the client has seen.
+	if toDeviceSince > 0 {
+		if err = rp.db.CleanSendToDeviceUpdates(req.Context(), device.UserID, device.ID, toDeviceSince); err != nil {
+			logger.WithError(err).Error("p.DB.CleanSendToDeviceUpdates failed")
+		}
+	}
+
+	waitingSyncRequests.Inc()
+	defer waitingSyncRequests.Dec()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		currentPos := rp.Notifier.CurrentPosition()
+		s := &slidingSync{
+			rp:            rp,
+			ctx:           req.Context(),
+			log:           logger,
+			device:        device,
+			req:           &body,
+			base:          base,
+			to:            currentPos,
+			toDeviceSince: toDeviceSince,
+		}
+		res, next, err := s.run()
+		if err != nil {
+			logger.WithError(err).Error("Failed to process sliding sync request")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+
+		// Wait for something new if there is nothing for a client which is up to date.
+		if base != nil && timeout > 0 && res.IsEmpty() && !listsChanged(base, next) {
+			if rp.waitForSlidingSyncUpdates(req.Context(), device, currentPos, timer) {
+				logger.Debugln("Processing sliding sync after wake-up")
+				continue
+			}
+		}
+		res.Pos = conn.store(base, next)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+}
+
+// waitForSlidingSyncUpdates waits until there may be something new for the device after
+// the given position. Returns false if the client gave up or the timeout was reached.
+func (rp *RequestPool) waitForSlidingSyncUpdates(ctx context.Context, device *userapi.Device, since types.StreamingToken, timer *time.Timer) bool {
+	userStreamListener := rp.Notifier.GetListener(types.SyncRequest{Context: ctx, Device: device})
+	defer userStreamListener.Close()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return false
+	case <-userStreamListener.GetNotifyChannel(since):
+		return true
+	}
+}
+
+func listsChanged(base, next *slidingSyncPosition) bool {
+	if len(base.lists) != len(next.lists) {
+		return true
+	}
+	for name, count := range next.lists {
+		if baseCount, ok := base.lists[name]; !ok || baseCount != count {
+			return true
+		}
+	}
+	return false
+}
+
+// slidingSyncRoom is a room the user is joined or invited to.
+type slidingSyncRoom struct {
+	roomID     string
+	membership string
+	bumpStamp  types.StreamPosition
+	invite     *types.InviteResponse
+	// The room type, loaded when a list filters on it.
+	roomType       *string
+	roomTypeLoaded bool
+}
+
+// slidingSyncWant is a room which is in the range of a list, or subscribed to.
+type slidingSyncWant struct {
+	room          *slidingSyncRoom
+	requiredState [][2]string
+	timelineLimit int
+	lists         []string
+	subscribed    bool
+}
+
+func (w *slidingSyncWant) add(config types.SlidingSyncRoomConfig) {
+	for _, rs := range config.RequiredState {
+		if !containsRequiredState(w.requiredState, rs) {
+			w.requiredState = append(w.requiredState, rs)
+		}
+	}
+	if config.TimelineLimit > w.timelineLimit {
+		w.timelineLimit = config.TimelineLimit
+	}
+}
+
+// config returns a key for the required state of the room, so that we know when the
+// client wants a different set of state for a room it has seen before.
+func (w *slidingSyncWant) config() string {
+	keys := make([]string, 0, len(w.requiredState))
+	for _, rs := range w.requiredState {
+		keys = append(keys, rs[0]+"\x00"+rs[1])
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\x01")
+}
+
+// inScope returns whether an extension applies to the room.
+func (w *slidingSyncWant) inScope(ext *types.SlidingSyncExtensionRequest) bool {
+	if w.subscribed && matchesScope(ext.Rooms, w.room.roomID) {
+		return true
+	}
+	for _, list := range w.lists {
+		if matchesScope(ext.Lists, list) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesScope(scope []string, name string) bool {
+	if scope == nil {
+		return true
+	}
+	for _, s := range scope {
+		if s == "*" || s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRequiredState(requiredState [][2]string, rs [2]string) bool {
+	for _, existing := range requiredState {
+		if existing == rs {
+			return true
+		}
+	}
+	return false
+}
+
+// slidingSync works out a single sliding sync response.
+type slidingSync struct {
+	rp            *RequestPool
+	ctx           context.Context
+	log           *logrus.Entry
+	device        *userapi.Device
+	req           *types.SlidingSyncRequest
+	base          *slidingSyncPosition
+	to            types.StreamingToken
+	toDeviceSince types.StreamPosition
+
+	snapshot    storage.DatabaseTransaction
+	userID      spec.UserID
+	ignored     types.IgnoredUsers
+	rooms       map[string]*slidingSyncRoom
+	sorted      []*slidingSyncRoom
+	wanted      map[string]*slidingSyncWant
+	directRooms map[string]bool
+
+	res  *types.SlidingSyncResponse
+	next *slidingSyncPosition
+}
+
+func (s *slidingSync) run() (res *types.SlidingSyncResponse, next *slidingSyncPosition, err error) {
+	userID, err := spec.NewUserID(s.device.UserID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.userID = *userID
+
+	snapshot, err := s.rp.db.NewDatabaseSnapshot(s.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+	s.snapshot = snapshot
+
+	s.res = &types.SlidingSyncResponse{
+		Lists: make(map[string]types.SlidingSyncListResponse),
+		Rooms: make(map[string]*types.SlidingSyncRoom),
+	}
+	s.next = &slidingSyncPosition{
+		token: s.to,
+		rooms: make(map[string]slidingSyncRoomState),
+		lists: make(map[string]int),
+	}
+
+	if err = s.loadRooms(); err != nil {
+		return nil, nil, err
+	}
+	if err = s.loadDirectRooms(); err != nil {
+		return nil, nil, err
+	}
+	if err = s.applyLists(); err != nil {
+		return nil, nil, err
+	}
+	if err = s.addRooms(); err != nil {
+		return nil, nil, err
+	}
+	if err = s.addLeftRooms(); err != nil {
+		return nil, nil, err
+	}
+	s.addExtensions()
+
+	succeeded = true
+	return s.res, s.next, nil
+}
+
+func (s *slidingSync) newSyncRequest(rooms map[string]string) *types.SyncRequest {
+	filter := synctypes.DefaultFilter()
+	filter.AccountData.Limit = math.MaxInt32
+	filter.Room.AccountData.Limit = math.MaxInt32
+	if rooms == nil {
+		rooms = make(map[string]string)
+	}
+	return &types.SyncRequest{
+		Context:           s.ctx,
+		Log:               s.log,
+		Device:            s.device,
+		Response:          types.NewResponse(),
+		Filter:            filter,
+		Rooms:             rooms,
+		MembershipChanges: make(map[string]struct{}),
+		IgnoredUsers:      s.ignored,
+	}
+}
+
+func (s *slidingSync) userIDForSender(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return s.rp.rsAPI.QueryUserIDForSender(s.ctx, roomID, senderID)
+}
+
+// loadRooms finds the rooms the user is joined or invited to, sorted by recency.
+func (s *slidingSync) loadRooms() error {
+	ignores, err := s.snapshot.IgnoresForUser(s.ctx, s.device.UserID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("IgnoresForUser: %w", err)
+	}
+	if ignores != nil {
+		s.ignored = *ignores
+	}
+
+	joined, err := s.snapshot.RoomIDsWithMembership(s.ctx, s.device.UserID, spec.Join)
+	if err != nil {
+		return fmt.Errorf("RoomIDsWithMembership: %w", err)
+	}
+	s.rooms = make(map[string]*slidingSyncRoom, len(joined))
+	for _, roomID := range joined {
+		s.rooms[roomID] = &slidingSyncRoom{roomID: roomID, membership: spec.Join}
+	}
+
+	invites := s.newSyncRequest(nil)
+	s.rp.streams.InviteStreamProvider.CompleteSync(s.ctx, s.snapshot, invites)
+	for roomID, invite := range invites.Response.Rooms.Invite {
+		if _, ok := s.rooms[roomID]; !ok {
+			s.rooms[roomID] = &slidingSyncRoom{roomID: roomID, membership: spec.Invite, invite: invite}
+		}
+	}
+
+	roomIDs := make([]string, 0, len(s.rooms))
+	for roomID := range s.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	filter := synctypes.DefaultRoomEventFilter()
+	filter.Limit = 1
+	latest, err := s.snapshot.RecentEvents(s.ctx, roomIDs, types.Range{From: s.to.PDUPosition, Backwards: true}, &filter, true, true)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("RecentEvents: %w", err)
+	}
+	s.sorted = make([]*slidingSyncRoom, 0, len(s.rooms))
+	for roomID, room := range s.rooms {
+		if events := latest[roomID].Events; len(events) > 0 {
+			room.bumpStamp = events[len(events)-1].StreamPosition
+		}
+		s.sorted = append(s.sorted, room)
+	}
+	sort.Slice(s.sorted, func(i, j int) bool {
+		if s.sorted[i].bumpStamp != s.sorted[j].bumpStamp {
+			return s.sorted[i].bumpStamp > s.sorted[j].bumpStamp
+		}
+		return s.sorted[i].roomID < s.sorted[j].roomID
+	})
+	return nil
+}
+
+// loadDirectRooms finds the direct message rooms of the user from their m.direct account data.
+func (s *slidingSync) loadDirectRooms() error {
+	s.directRooms = make(map[string]bool)
+	var res userapi.QueryAccountDataResponse
+	if err := s.rp.userAPI.QueryAccountData(s.ctx, &userapi.QueryAccountDataRequest{
+		UserID:   s.device.UserID,
+		DataType: "m.direct",
+	}, &res); err != nil {
+		return fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	var direct map[string][]string
+	if data, ok := res.GlobalAccountData["m.direct"]; ok {
+		if err := json.Unmarshal(data, &direct); err != nil {
+			s.log.WithError(err).Warn("Invalid m.direct account data")
+		}
+	}
+	for _, roomIDs := range direct {
+		for _, roomID := range roomIDs {
+			s.directRooms[roomID] = true
+		}
+	}
+	return nil
+}
+
+// applyLists works out the rooms in the ranges of the lists and the room subscriptions.
+func (s *slidingSync) applyLists() error {
+	s.wanted = make(map[string]*slidingSyncWant)
+	want := func(room *slidingSyncRoom) *slidingSyncWant {
+		w, ok := s.wanted[room.roomID]
+		if !ok {
+			w = &slidingSyncWant{room: room}
+			s.wanted[room.roomID] = w
+		}
+		return w
+	}
+
+	for name, list := range s.req.Lists {
+		rooms := make([]*slidingSyncRoom, 0, len(s.sorted))
+		for _, room := range s.sorted {
+			ok, err := s.matchesFilters(room, list.Filters)
+			if err != nil {
+				return err
+			}
+			if ok {
+				rooms = append(rooms, room)
+			}
+		}
+		s.res.Lists[name] = types.SlidingSyncListResponse{Count: len(rooms)}
+		s.next.lists[name] = len(rooms)
+		for _, r := range list.Ranges {
+			for i := r[0]; i <= r[1] && i < len(rooms); i++ {
+				w := want(rooms[i])
+				w.add(list.SlidingSyncRoomConfig)
+				w.lists = append(w.lists, name)
+			}
+		}
+	}
+
+	for roomID, config := range s.req.RoomSubscriptions {
+		room, ok := s.rooms[roomID]
+		if !ok {
+			continue
+		}
+		w := want(room)
+		w.add(config)
+		w.subscribed = true
+	}
+	return nil
+}
+
+func (s *slidingSync) matchesFilters(room *slidingSyncRoom, filters *types.SlidingSyncFilters) (bool, error) {
+	if filters == nil {
+		return true, nil
+	}
+	if filters.IsInvite != nil && *filters.IsInvite != (room.membership == spec.Invite) {
+		return false, nil
+	}
+	if filters.IsDM != nil && *filters.IsDM != s.directRooms[room.roomID] {
+		return false, nil
+	}
+	if filters.IsEncrypted != nil {
+		ev, err := s.snapshot.GetStateEvent(s.ctx, room.roomID, spec.MRoomEncryption, "")
+		if err != nil {
+			return false, fmt.Errorf("GetStateEvent: %w", err)
+		}
+		if *filters.IsEncrypted != (ev != nil) {
+			return false, nil
+		}
+	}
+	if filters.RoomTypes != nil || filters.NotRoomTypes != nil {
+		if !room.roomTypeLoaded {
+			ev, err := s.snapshot.GetStateEvent(s.ctx, room.roomID, spec.MRoomCreate, "")
+			if err != nil {
+				return false, fmt.Errorf("GetStateEvent: %w", err)
+			}
+			if ev != nil {
+				if roomType := gjson.GetBytes(ev.Content(), "type"); roomType.Type == gjson.String {
+					room.roomType = &roomType.Str
+				}
+			}
+			room.roomTypeLoaded = true
+		}
+		if filters.RoomTypes != nil && !containsRoomType(filters.RoomTypes, room.roomType) {
+			return false, nil
+		}
+		if containsRoomType(filters.NotRoomTypes, room.roomType) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func containsRoomType(roomTypes []*string, roomType *string) bool {
+	for _, t := range roomTypes {
+		if (t == nil && roomType == nil) || (t != nil && roomType != nil && *t == *roomType) {
+			return true
+		}
+	}
+	return false
+}
+
+// addRooms adds the rooms in the lists and room subscriptions to the response, if the
+// client hasn't seen them or there is something new in them.
+func (s *slidingSync) addRooms() error {
+	// Rooms the client has seen stay known, even when they are out of range.
+	if s.base != nil {
+		for roomID, state := range s.base.rooms {
+			if _, ok := s.rooms[roomID]; ok {
+				s.next.rooms[roomID] = state
+			}
+		}
+	}
+
+	joinedRooms := make(map[string]string, len(s.wanted))
+	for roomID, w := range s.wanted {
+		if w.room.membership == spec.Join {
+			joinedRooms[roomID] = spec.Join
+		}
+	}
+	counts, err := s.snapshot.GetUserUnreadNotificationCountsForRooms(s.ctx, s.device.UserID, joinedRooms)
+	if err != nil {
+		return fmt.Errorf("GetUserUnreadNotificationCountsForRooms: %w", err)
+	}
+
+	for roomID, w := range s.wanted {
+		var known *slidingSyncRoomState
+		if s.base != nil {
+			if state, ok := s.base.rooms[roomID]; ok && state.membership == w.room.membership {
+				known = &state
+			}
+		}
+
+		if w.room.membership == spec.Invite {
+			if known != nil {
+				continue
+			}
+			s.res.Rooms[roomID] = &types.SlidingSyncRoom{
+				Initial:     true,
+				IsDM:        s.directRooms[roomID],
+				InviteState: w.room.invite.InviteState.Events,
+				BumpStamp:   w.room.bumpStamp,
+			}
+			s.next.rooms[roomID] = slidingSyncRoomState{
+				pos:        s.to.PDUPosition,
+				membership: spec.Invite,
+			}
+			continue
+		}
+
+		state := slidingSyncRoomState{
+			pos:        s.to.PDUPosition,
+			membership: spec.Join,
+			config:     w.config(),
+		}
+		if count, ok := counts[roomID]; ok {
+			state.notificationCount = count.UnreadNotificationCount
+			state.highlightCount = count.UnreadHighlightCount
+		}
+		room, err := s.joinedRoom(w, known, state)
+		if err != nil {
+			s.log.WithError(err).WithField("room_id", roomID).Error("Failed to add room to sliding sync response")
+			if ctxErr := s.ctx.Err(); ctxErr != nil || errors.Is(err, sql.ErrTxDone) {
+				return err
+			}
+			continue
+		}
+		if room != nil {
+			s.res.Rooms[roomID] = room
+		}
+		s.next.rooms[roomID] = state
+	}
+	return nil
+}
+
+// joinedRoom returns the response for a joined room, or nil if the client has seen
+// the room before and there is nothing new in it.
+func (s *slidingSync) joinedRoom(w *slidingSyncWant, known *slidingSyncRoomState, state slidingSyncRoomState) (*types.SlidingSyncRoom, error) {
+	roomID, err := spec.NewRoomID(w.room.roomID)
+	if err != nil {
+		return nil, err
+	}
+	initial := known == nil
+	r := types.Range{From: s.to.PDUPosition, Backwards: true}
+	if !initial {
+		r = types.Range{From: known.pos, To: s.to.PDUPosition}
+	}
+
+	var recent types.RecentEvents
+	if initial || known.pos < s.to.PDUPosition {
+		filter := synctypes.DefaultRoomEventFilter()
+		filter.Limit = w.timelineLimit
+		if len(s.ignored.List) > 0 {
+			notSenders := make([]string, 0, len(s.ignored.List))
+			for userID := range s.ignored.List {
+				notSenders = append(notSenders, userID)
+			}
+			filter.NotSenders = &notSenders
+		}
+		events, err := s.snapshot.RecentEvents(s.ctx, []string{roomID.String()}, r, &filter, true, true)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("RecentEvents: %w", err)
+		}
+		recent = events[roomID.String()]
+	}
+	configChanged := !initial && known.config != state.config
+	if !initial && !configChanged && len(recent.Events) == 0 &&
+		known.notificationCount == state.notificationCount && known.highlightCount == state.highlightCount {
+		return nil, nil
+	}
+
+	recentEvents := s.snapshot.StreamEventsToEvents(s.ctx, s.device, recent.Events, s.rp.rsAPI)
+	events, err := internal.ApplyHistoryVisibilityFilter(s.ctx, s.snapshot, s.rp.rsAPI, recentEvents, nil, s.userID, "sync")
+	if err != nil {
+		return nil, err
+	}
+	limited := recent.Limited && len(events) == len(recentEvents)
+
+	room := &types.SlidingSyncRoom{
+		Initial:           initial,
+		IsDM:              s.directRooms[roomID.String()],
+		Limited:           limited,
+		NotificationCount: state.notificationCount,
+		HighlightCount:    state.highlightCount,
+		BumpStamp:         w.room.bumpStamp,
+	}
+	room.Timeline = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), synctypes.FormatSync, s.userIDForSender)
+	if err = internal.BundleThreadAggregations(s.ctx, s.snapshot, s.rp.rsAPI, s.userID, *roomID, room.Timeline, synctypes.FormatSync); err != nil {
+		s.log.WithError(err).WithField("room_id", roomID.String()).Warn("Failed to bundle thread aggregations")
+	}
+	if !initial {
+		room.NumLive = len(room.Timeline)
+	}
+	if len(events) > 0 {
+		event := events[0]
+		// If this is the beginning of the room, we can't go back further.
+		if event.Type() == spec.MRoomCreate && event.StateKeyEquals("") {
+			event = events[len(events)-1]
+		}
+		depth, streamPos, err := s.snapshot.PositionInTopology(s.ctx, event.EventID())
+		if err != nil {
+			return nil, fmt.Errorf("PositionInTopology: %w", err)
+		}
+		prevBatch := types.TopologyToken{Depth: depth, PDUPosition: streamPos}
+		prevBatch.Decrement()
+		room.PrevBatch = prevBatch.String()
+	}
+
+	// The state in the timeline is enough for the client to keep up with rooms it has seen
+	// before, unless there is a gap in the timeline or it wants different state now.
+	lazyOnly := !initial && !configChanged && !limited
+	if room.RequiredState, err = s.requiredState(*roomID, w.requiredState, events, lazyOnly); err != nil {
+		return nil, err
+	}
+	if err = s.addRoomSummary(*roomID, room); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// requiredState returns the current state of the room matching the required state. If lazyOnly
+// is set, only the members who sent events in the timeline are returned, if asked for.
+func (s *slidingSync) requiredState(roomID spec.RoomID, requiredState [][2]string, timeline []*rstypes.HeaderedEvent, lazyOnly bool) ([]synctypes.ClientEvent, error) {
+	var wantTypes []string
+	allTypes := false
+	for _, rs := range requiredState {
+		if lazyOnly && (rs[0] != spec.MRoomMember || rs[1] != "$LAZY") {
+			continue
+		}
+		if rs[0] == "*" {
+			allTypes = true
+		}
+		wantTypes = append(wantTypes, rs[0])
+	}
+	if len(wantTypes) == 0 {
+		return nil, nil
+	}
+
+	var ownSenderID string
+	if senderID, err := s.rp.rsAPI.QuerySenderIDForUser(s.ctx, roomID, s.userID); err != nil {
+		return nil, fmt.Errorf("rsAPI.QuerySenderIDForUser: %w", err)
+	} else if senderID != nil {
+		ownSenderID = string(*senderID)
+	}
+	timelineSenders := make(map[string]bool, len(timeline))
+	for _, ev := range timeline {
+		timelineSenders[string(ev.SenderID())] = true
+	}
+	matchesStateKey := func(want, stateKey string) bool {
+		switch want {
+		case "*":
+			return true
+		case "$ME":
+			return stateKey == ownSenderID
+		case "$LAZY":
+			return timelineSenders[stateKey]
+		default:
+			return want == stateKey
+		}
+	}
+
+	stateFilter := synctypes.DefaultStateFilter()
+	if !allTypes {
+		// Event types are matched with LIKE, so the results are checked again below.
+		stateFilter.Types = &wantTypes
+	}
+	stateEvents, err := s.snapshot.CurrentState(s.ctx, roomID.String(), &stateFilter, nil)
+	if err != nil {
+		return nil, fmt.Errorf("CurrentState: %w", err)
+	}
+	matched := make([]*rstypes.HeaderedEvent, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		if ev.StateKey() == nil {
+			continue
+		}
+		for _, rs := range requiredState {
+			if lazyOnly && (rs[0] != spec.MRoomMember || rs[1] != "$LAZY") {
+				continue
+			}
+			if (rs[0] == "*" || rs[0] == ev.Type()) && matchesStateKey(rs[1], *ev.StateKey()) {
+				matched = append(matched, ev)
+				break
+			}
+		}
+	}
+	return synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(matched), synctypes.FormatSync, s.userIDForSender), nil
+}
+
+// addRoomSummary adds the name, avatar, heroes and member counts of the room.
+func (s *slidingSync) addRoomSummary(roomID spec.RoomID, room *types.SlidingSyncRoom) error {
+	if ev, err := s.snapshot.GetStateEvent(s.ctx, roomID.String(), spec.MRoomName, ""); err != nil {
+		return fmt.Errorf("GetStateEvent: %w", err)
+	} else if ev != nil {
+		room.Name = gjson.GetBytes(ev.Content(), "name").Str
+	}
+	if ev, err := s.snapshot.GetStateEvent(s.ctx, roomID.String(), spec.MRoomAvatar, ""); err != nil {
+		return fmt.Errorf("GetStateEvent: %w", err)
+	} else if ev != nil {
+		room.Avatar = gjson.GetBytes(ev.Content(), "url").Str
+	}
+
+	summary, err := s.snapshot.GetRoomSummary(s.ctx, roomID.String(), s.device.UserID)
+	if err != nil {
+		return fmt.Errorf("GetRoomSummary: %w", err)
+	}
+	room.JoinedCount = summary.JoinedMemberCount
+	room.InvitedCount = summary.InvitedMemberCount
+	for _, hero := range summary.Heroes {
+		h := types.SlidingSyncHero{UserID: hero}
+		if userID, err := s.userIDForSender(roomID, spec.SenderID(hero)); err == nil && userID != nil {
+			h.UserID = userID.String()
+		}
+		ev, err := s.snapshot.GetStateEvent(s.ctx, roomID.String(), spec.MRoomMember, hero)
+		if err != nil {
+			return fmt.Errorf("GetStateEvent: %w", err)
+		}
+		if ev != nil {
+			h.DisplayName = gjson.GetBytes(ev.Content(), "displayname").Str
+			h.AvatarURL = gjson.GetBytes(ev.Content(), "avatar_url").Str
+		}
+		room.Heroes = append(room.Heroes, h)
+	}
+	return nil
+}
+
+// addLeftRooms tells the client about rooms it has seen which the user has since left,
+// by sending the timeline up to the point the user left. The rooms are then forgotten.
+func (s *slidingSync) addLeftRooms() error {
+	if s.base == nil {
+		return nil
+	}
+	for roomID, known := range s.base.rooms {
+		if _, ok := s.rooms[roomID]; ok {
+			continue
+		}
+		validRoomID, err := spec.NewRoomID(roomID)
+		if err != nil {
+			continue
+		}
+		filter := synctypes.DefaultRoomEventFilter()
+		filter.Limit = leftRoomTimelineLimit
+		recent, err := s.snapshot.RecentEvents(s.ctx, []string{roomID}, types.Range{From: known.pos, To: s.to.PDUPosition}, &filter, true, true)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("RecentEvents: %w", err)
+		}
+		recentEvents := s.snapshot.StreamEventsToEvents(s.ctx, s.device, recent[roomID].Events, s.rp.rsAPI)
+		events, err := internal.ApplyHistoryVisibilityFilter(s.ctx, s.snapshot, s.rp.rsAPI, recentEvents, nil, s.userID, "sync")
+		if err != nil {
+			return err
+		}
+		room := &types.SlidingSyncRoom{
+			Timeline: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), synctypes.FormatSync, s.userIDForSender),
+			Limited:  recent[roomID].Limited && len(events) == len(recentEvents),
+		}
+		room.NumLive = len(room.Timeline)
+		// Always include the membership of the user, in case it isn't in the timeline.
+		if room.RequiredState, err = s.requiredState(*validRoomID, [][2]string{{spec.MRoomMember, "$ME"}}, nil, false); err != nil {
+			return err
+		}
+		s.res.Rooms[roomID] = room
+	}
+	return nil
+}
+
+// addExtensions fills in the extensions the client asked for, using the stream providers
+// of /sync. Errors are logged by the stream providers, leaving out what failed.
+func (s *slidingSync) addExtensions() {
+	ext := s.req.Extensions
+	p := s.rp.streams
+
+	if ext.ToDevice != nil && ext.ToDevice.Enabled {
+		req := s.newSyncRequest(nil)
+		pos := p.SendToDeviceStreamProvider.IncrementalSync(s.ctx, s.snapshot, req, s.toDeviceSince, s.to.SendToDevicePosition)
+		s.res.Extensions.ToDevice = &types.SlidingSyncToDeviceResponse{
+			NextBatch: strconv.FormatInt(int64(pos), 10),
+			Events:    req.Response.ToDevice.Events,
+		}
+		if s.res.Extensions.ToDevice.Events == nil {
+			s.res.Extensions.ToDevice.Events = []gomatrixserverlib.SendToDeviceEvent{}
+		}
+	}
+
+	if ext.E2EE != nil && ext.E2EE.Enabled {
+		req := s.newSyncRequest(nil)
+		if s.base == nil {
+			if err := internal.DeviceOTKCounts(s.ctx, s.rp.userAPI, s.device.UserID, s.device.ID, req.Response); err != nil {
+				s.log.WithError(err).Error("internal.DeviceOTKCounts failed")
+			}
+		} else {
+			// The device list catch up looks at the rooms joined and left in the
+			// response, which come from the PDU stream.
+			if s.base.token.PDUPosition < s.to.PDUPosition {
+				p.PDUStreamProvider.IncrementalSync(s.ctx, s.snapshot, req, s.base.token.PDUPosition, s.to.PDUPosition)
+			}
+			p.DeviceListStreamProvider.IncrementalSync(s.ctx, s.snapshot, req, s.base.token.DeviceListPosition, s.to.DeviceListPosition)
+		}
+		s.res.Extensions.E2EE = &types.SlidingSyncE2EEResponse{
+			DeviceLists:                  req.Response.DeviceLists,
+			DeviceOneTimeKeysCount:       req.Response.DeviceListsOTKCount,
+			DeviceUnusedFallbackKeyTypes: req.Response.DeviceListsUnusedFallbackAlgorithms,
+		}
+	}
+
+	if ext.AccountData != nil && ext.AccountData.Enabled {
+		global, rooms := s.streamRooms(p.AccountDataStreamProvider, ext.AccountData, func(t types.StreamingToken) types.StreamPosition {
+			return t.AccountDataPosition
+		})
+		res := &types.SlidingSyncAccountDataResponse{
+			Global: global.AccountData.Events,
+			Rooms:  make(map[string][]synctypes.ClientEvent),
+		}
+		for roomID, jr := range rooms {
+			if len(jr.AccountData.Events) > 0 {
+				res.Rooms[roomID] = jr.AccountData.Events
+			}
+		}
+		s.res.Extensions.AccountData = res
+	}
+
+	if ext.Receipts != nil && ext.Receipts.Enabled {
+		_, rooms := s.streamRooms(p.ReceiptStreamProvider, ext.Receipts, func(t types.StreamingToken) types.StreamPosition {
+			return t.ReceiptPosition
+		})
+		s.res.Extensions.Receipts = ephemeralResponse(rooms, spec.MReceipt)
+	}
+
+	if ext.Typing != nil && ext.Typing.Enabled {
+		_, rooms := s.streamRooms(p.TypingStreamProvider, ext.Typing, func(t types.StreamingToken) types.StreamPosition {
+			return t.TypingPosition
+		})
+		s.res.Extensions.Typing = ephemeralResponse(rooms, spec.MTyping)
+	}
+}
+
+// streamRooms runs a stream provider for the joined rooms the extension applies to. Rooms
+// the client has seen before get what changed since the last response, and new rooms get
+// everything. Returns the response with the global data, and the data of each room.
+func (s *slidingSync) streamRooms(
+	provider streams.StreamProvider, ext *types.SlidingSyncExtensionRequest,
+	position func(types.StreamingToken) types.StreamPosition,
+) (*types.Response, map[string]*types.JoinResponse) {
+	knownRooms := make(map[string]string)
+	newRooms := make(map[string]string)
+	for roomID, w := range s.wanted {
+		if w.room.membership != spec.Join || !w.inScope(ext) {
+			continue
+		}
+		if room, ok := s.res.Rooms[roomID]; ok && room.Initial {
+			newRooms[roomID] = spec.Join
+		} else {
+			knownRooms[roomID] = spec.Join
+		}
+	}
+
+	var global *types.Response
+	rooms := make(map[string]*types.JoinResponse)
+	if s.base != nil {
+		req := s.newSyncRequest(knownRooms)
+		provider.IncrementalSync(s.ctx, s.snapshot, req, position(s.base.token), position(s.to))
+		global = req.Response
+		for roomID, jr := range req.Response.Rooms.Join {
+			if _, ok := knownRooms[roomID]; ok {
+				rooms[roomID] = jr
+			}
+		}
+	}
+	if s.base == nil || len(newRooms) > 0 {
+		req := s.newSyncRequest(newRooms)
+		provider.CompleteSync(s.ctx, s.snapshot, req)
+		if global == nil {
+			global = req.Response
+		}
+		for roomID, jr := range req.Response.Rooms.Join {
+			if _, ok := newRooms[roomID]; ok {
+				rooms[roomID] = jr
+			}
+		}
+	}
+	return global, rooms
+}
+
+// ephemeralResponse picks the events of the given type out of the ephemeral events of the rooms.
+func ephemeralResponse(rooms map[string]*types.JoinResponse, eventType string) *types.SlidingSyncEphemeralResponse {
+	res := &types.SlidingSyncEphemeralResponse{
+		Rooms: make(map[string]synctypes.ClientEvent),
+	}
+	for roomID, jr := range rooms {
+		for _, ev := range jr.Ephemeral.Events {
+			if ev.Type == eventType {
+				res.Rooms[roomID] = ev
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ike20013/dendrite/syncapi/types"
+	userapi "github.com/ike20013/dendrite/userapi/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlidingSyncConnections(t *testing.T) {
+	alice := &userapi.Device{UserID: "@alice:test", ID: "ALICE"}
+	bob := &userapi.Device{UserID: "@bob:test", ID: "BOB"}
+
+	t.Run("connections are capped per device", func(t *testing.T) {
+		conns := newSlidingSyncConnections()
+		for i := 0; i <= slidingSyncMaxConnectionsPerDevice; i++ {
+			conns.start(alice, strconv.Itoa(i)).lastUsed = time.Now().Add(time.Duration(i) * time.Second)
+		}
+		bobConn := conns.start(bob, "0")
+		// The least recently used connection was forgotten.
+		assert.Nil(t, conns.get(alice, "0"))
+		for i := 1; i <= slidingSyncMaxConnectionsPerDevice; i++ {
+			assert.NotNil(t, conns.get(alice, strconv.Itoa(i)))
+		}
+		assert.Same(t, bobConn, conns.get(bob, "0"))
+
+		// Restarting a connection replaces it without forgetting others.
+		restarted := conns.start(alice, "1")
+		assert.Same(t, restarted, conns.get(alice, "1"))
+		assert.NotNil(t, conns.get(alice, "2"))
+	})
+
+	t.Run("idle connections expire", func(t *testing.T) {
+		conns := newSlidingSyncConnections()
+		conns.start(alice, "idle").lastUsed = time.Now().Add(-time.Hour)
+		conns.start(alice, "active")
+		conns.start(bob, "idle").lastUsed = time.Now().Add(-time.Hour)
+		conns.expire(slidingSyncConnectionTimeout)
+		assert.Nil(t, conns.get(alice, "idle"))
+		assert.NotNil(t, conns.get(alice, "active"))
+		assert.Nil(t, conns.get(bob, "idle"))
+		assert.NotContains(t, conns.devices, bob.UserID+"|"+bob.ID)
+	})
+
+	t.Run("positions are capped per connection", func(t *testing.T) {
+		conn := newSlidingSyncConnections().start(alice, "")
+		first := conn.store(nil, &slidingSyncPosition{token: types.StreamingToken{}})
+		// The client keeps syncing from the first position.
+		base, err := conn.load(first)
+		assert.NoError(t, err)
+		second := conn.store(base, &slidingSyncPosition{token: types.StreamingToken{}})
+		for i := 0; i < slidingSyncMaxPositions; i++ {
+			conn.store(base, &slidingSyncPosition{token: types.StreamingToken{}})
+		}
+		assert.Len(t, conn.positions, slidingSyncMaxPositions+1)
+		_, err = conn.load(first)
+		assert.NoError(t, err)
+		_, err = conn.load(second)
+		assert.ErrorIs(t, err, errUnknownPos)
+	})
+}
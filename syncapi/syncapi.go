@@ -25,6 +25,7 @@ import (
 	"github.com/ike20013/dendrite/syncapi/consumers"
 	"github.com/ike20013/dendrite/syncapi/notifier"
 	"github.com/ike20013/dendrite/syncapi/producers"
+	"github.com/ike20013/dendrite/syncapi/retention"
 	"github.com/ike20013/dendrite/syncapi/routing"
 	"github.com/ike20013/dendrite/syncapi/storage"
 	"github.com/ike20013/dendrite/syncapi/streams"
@@ -143,6 +144,8 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start receipts consumer")
 	}
 
+	retention.NewPurger(&dendriteCfg.RoomServer.Retention, syncDB, fts).Start(processContext)
+
 	rateLimits := httputil.NewRateLimits(&dendriteCfg.ClientAPI.RateLimiting)
 
 	routing.Setup(
@@ -8,11 +8,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ike20013/dendrite/external/caching"
+	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/external/httputil"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/setup/config"
@@ -94,6 +96,8 @@ func (s *syncRoomserverAPI) QueryMembershipAtEvent(
 type syncUserAPI struct {
 	userapi.SyncUserAPI
 	accounts []userapi.Device
+	// room ID, or "" for global account data -> type -> content
+	accountData map[string]map[string]json.RawMessage
 }
 
 func (s *syncUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
@@ -115,6 +119,19 @@ func (s *syncUserAPI) QueryOneTimeKeys(ctx context.Context, req *userapi.QueryOn
 	return nil
 }
 
+func (s *syncUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	data, ok := s.accountData[req.RoomID][req.DataType]
+	if !ok {
+		return nil
+	}
+	if req.RoomID == "" {
+		res.GlobalAccountData = map[string]json.RawMessage{req.DataType: data}
+	} else {
+		res.RoomAccountData = map[string]map[string]json.RawMessage{req.RoomID: {req.DataType: data}}
+	}
+	return nil
+}
+
 func (s *syncUserAPI) PerformLastSeenUpdate(ctx context.Context, req *userapi.PerformLastSeenUpdateRequest, res *userapi.PerformLastSeenUpdateResponse) error {
 	return nil
 }
@@ -516,6 +533,115 @@ func testSyncAPIUpdatePresenceImmediately(t *testing.T, dbType test.DBType) {
 
 }
 
+func TestSyncAPIKnock(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testSyncAPIKnock(t, dbType)
+	})
+}
+
+func testSyncAPIKnock(t *testing.T, dbType test.DBType) {
+	alice := test.NewUser(t)
+	user := test.NewUser(t)
+	bob := userapi.Device{
+		ID:          "BOBID",
+		UserID:      user.ID,
+		AccessToken: "BOB_BEARER_TOKEN",
+		DisplayName: "Bob",
+		AccountType: userapi.AccountTypeUser,
+	}
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": spec.Knock,
+	}, test.WithStateKey(""))
+
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	defer close()
+	natsInstance := jetstream.NATSInstance{}
+
+	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{bob}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, caches, caching.DisableMetrics)
+
+	knock := room.CreateAndInsert(t, user, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Knock,
+		"reason":     "let me in",
+	}, test.WithStateKey(user.ID))
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, room.Events()...)...)
+
+	// the knock should come down sync in the knock section
+	syncUntil(t, routers, bob.AccessToken, false, func(syncBody string) bool {
+		path := fmt.Sprintf(`rooms.knock.%s.knock_state.events.#(event_id=="%s")`, room.ID, knock.EventID())
+		return gjson.Get(syncBody, path).Exists()
+	})
+	w := httptest.NewRecorder()
+	routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+		"access_token": bob.AccessToken,
+		"timeout":      "0",
+	})))
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want 200", w.Code)
+	}
+	body := w.Body.String()
+	var res types.Response
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("failed to decode response body: %s", err)
+	}
+	if _, ok := res.Rooms.Join[room.ID]; ok {
+		t.Errorf("knocked room is in the join section")
+	}
+	reason := gjson.Get(body, fmt.Sprintf(`rooms.knock.%s.knock_state.events.#(event_id=="%s").content.reason`, room.ID, knock.EventID()))
+	if reason.Str != "let me in" {
+		t.Errorf("knock reason: got %q want %q", reason.Str, "let me in")
+	}
+	since := res.NextBatch.String()
+
+	// rescinding the knock moves the room to the leave section
+	leave := room.CreateAndInsert(t, user, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Leave,
+	}, test.WithStateKey(user.ID))
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, leave)...)
+
+	// wait for the leave to come down an incremental sync
+	w = httptest.NewRecorder()
+	routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+		"access_token": bob.AccessToken,
+		"timeout":      "5000",
+		"since":        since,
+	})))
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want 200", w.Code)
+	}
+	res = types.Response{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response body: %s", err)
+	}
+	if res.Rooms == nil {
+		t.Fatalf("incremental sync has no rooms")
+	}
+	if _, ok := res.Rooms.Knock[room.ID]; ok {
+		t.Errorf("rescinded knock is still in the knock section")
+	}
+	if _, ok := res.Rooms.Leave[room.ID]; !ok {
+		t.Errorf("rescinded knock is not in the leave section")
+	}
+
+	// and the knock is gone from a full sync
+	w = httptest.NewRecorder()
+	routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+		"access_token": bob.AccessToken,
+		"timeout":      "0",
+	})))
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want 200", w.Code)
+	}
+	if gjson.Get(w.Body.String(), fmt.Sprintf(`rooms.knock.%s`, room.ID)).Exists() {
+		t.Errorf("rescinded knock is still in the knock section of a full sync")
+	}
+}
+
 // This is mainly what Sytest is doing in "test_history_visibility"
 func TestMessageHistoryVisibility(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
@@ -607,7 +733,7 @@ func testHistoryVisibility(t *testing.T, dbType test.DBType) {
 		defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
 
 		// Use the actual external roomserver API
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, caches, caching.DisableMetrics)
 
@@ -876,7 +1002,7 @@ func TestGetMembership(t *testing.T) {
 		defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
 
 		// Use an actual roomserver for this
-		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 
 		AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, caches, caching.DisableMetrics)
@@ -1169,7 +1295,7 @@ func testContext(t *testing.T, dbType test.DBType) {
 
 	// Use an actual roomserver for this
 	natsInstance := jetstream.NATSInstance{}
-	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 	rsAPI.SetFederationAPI(nil, nil)
 
 	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, rsAPI, caches, caching.DisableMetrics)
@@ -1349,7 +1475,7 @@ func TestRemoveEditedEventFromSearchIndex(t *testing.T) {
 	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
 
-	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, nil, caching.DisableMetrics)
 	rsAPI.SetFederationAPI(nil, nil)
 
 	room := test.NewRoom(t, user)
@@ -1416,6 +1542,316 @@ func searchRequest(t *testing.T, router *mux.Router, accessToken, searchTerm str
 	assert.NoError(t, err)
 	return body
 }
+
+func TestSlidingSync(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testSlidingSync(t, dbType)
+	})
+}
+
+func testSlidingSync(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	room := test.NewRoom(t, user)
+	room2 := test.NewRoom(t, user)
+	room3 := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	natsInstance := jetstream.NATSInstance{}
+	defer close()
+
+	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+	userAPI := &syncUserAPI{
+		accounts: []userapi.Device{alice},
+		accountData: map[string]map[string]json.RawMessage{
+			"":      {"m.test": json.RawMessage(`{"global":true}`)},
+			room.ID: {"m.test": json.RawMessage(`{"room":true}`)},
+		},
+	}
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, userAPI, &syncRoomserverAPI{rooms: []*test.Room{room, room2, room3}}, caches, caching.DisableMetrics)
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, room.Events()...)...)
+
+	syncUntil(t, routers, alice.AccessToken, false, func(syncBody string) bool {
+		path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, room.Events()[len(room.Events())-1].EventID())
+		return gjson.Get(syncBody, path).Exists()
+	})
+
+	slidingSync := func(pos string, body map[string]interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		routers.Client.ServeHTTP(w, test.NewRequest(t, "POST", "/_matrix/client/unstable/org.matrix.simplified_msc3575/sync",
+			test.WithJSONBody(t, body),
+			test.WithQueryParams(map[string]string{
+				"access_token": alice.AccessToken,
+				"timeout":      "0",
+				"pos":          pos,
+			}),
+		))
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) types.SlidingSyncResponse {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+		}
+		var res types.SlidingSyncResponse
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response body: %s", err)
+		}
+		return res
+	}
+	// slidingSyncUntil repeats the request until the response passes the check,
+	// as what is sent to the sync API is processed asynchronously.
+	slidingSyncUntil := func(pos string, body map[string]interface{}, check func(res types.SlidingSyncResponse) bool) types.SlidingSyncResponse {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			if res := decode(slidingSync(pos, body)); check(res) {
+				return res
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for the sliding sync response")
+		return types.SlidingSyncResponse{}
+	}
+	roomIDs := func(res types.SlidingSyncResponse) []string {
+		ids := make([]string, 0, len(res.Rooms))
+		for roomID := range res.Rooms {
+			ids = append(ids, roomID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	body := map[string]interface{}{
+		"lists": map[string]interface{}{
+			"all": map[string]interface{}{
+				"ranges":         [][2]int{{0, 10}},
+				"required_state": [][2]string{{spec.MRoomCreate, ""}},
+				"timeline_limit": 1,
+			},
+		},
+	}
+
+	// The first request of a connection gets everything in the room.
+	w := slidingSync("", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+	}
+	var res types.SlidingSyncResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response body: %s", err)
+	}
+	if res.Lists["all"].Count != 1 {
+		t.Fatalf("expected 1 room in the list, got %d", res.Lists["all"].Count)
+	}
+	r, ok := res.Rooms[room.ID]
+	if !ok {
+		t.Fatalf("expected the room in the response, got %+v", res.Rooms)
+	}
+	if !r.Initial {
+		t.Errorf("expected the room to be initial")
+	}
+	if len(r.Timeline) != 1 || r.Timeline[0].EventID != room.Events()[len(room.Events())-1].EventID() || !r.Limited {
+		t.Errorf("expected a limited timeline with the last event, got %+v", r.Timeline)
+	}
+	if len(r.RequiredState) != 1 || r.RequiredState[0].Type != spec.MRoomCreate {
+		t.Errorf("expected the create event as required state, got %+v", r.RequiredState)
+	}
+
+	// Nothing changed since the last response.
+	w = slidingSync(res.Pos, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+	}
+	var next types.SlidingSyncResponse
+	if err := json.NewDecoder(w.Body).Decode(&next); err != nil {
+		t.Fatalf("failed to decode response body: %s", err)
+	}
+	if len(next.Rooms) != 0 {
+		t.Errorf("expected no rooms, got %+v", next.Rooms)
+	}
+
+	// New events in the room are sent to the client.
+	ev := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, ev)...)
+	var found bool
+	for i := 0; i < 50 && !found; i++ {
+		w = slidingSync(res.Pos, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+		}
+		found = gjson.Get(w.Body.String(), fmt.Sprintf(`rooms.%s.timeline.#(event_id=="%s")`, gjson.Escape(room.ID), ev.EventID())).Exists()
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !found {
+		t.Fatalf("expected the new event in the timeline")
+	}
+	if gjson.Get(w.Body.String(), fmt.Sprintf("rooms.%s.initial", gjson.Escape(room.ID))).Bool() {
+		t.Errorf("expected the room not to be initial")
+	}
+
+	// Unknown positions make the client start a new connection.
+	w = slidingSync("100_s1_0_0_0_0_0_0_0_0", body)
+	if w.Code != http.StatusBadRequest || gjson.Get(w.Body.String(), "errcode").Str != "M_UNKNOWN_POS" {
+		t.Errorf("expected M_UNKNOWN_POS, got HTTP %d: %s", w.Code, w.Body.String())
+	}
+
+	// Lists only send the rooms in their ranges, with the most recent rooms first.
+	for _, r := range []*test.Room{room2, room3} {
+		testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, r.Events()...)...)
+		syncUntil(t, routers, alice.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, r.ID, r.Events()[len(r.Events())-1].EventID())
+			return gjson.Get(syncBody, path).Exists()
+		})
+	}
+	windowed := func(end int) map[string]interface{} {
+		return map[string]interface{}{
+			"conn_id": "windowed",
+			"lists": map[string]interface{}{
+				"recent": map[string]interface{}{
+					"ranges":         [][2]int{{0, end}},
+					"timeline_limit": 1,
+				},
+			},
+		}
+	}
+	res = decode(slidingSync("", windowed(0)))
+	assert.Equal(t, 3, res.Lists["recent"].Count)
+	assert.Equal(t, []string{room3.ID}, roomIDs(res))
+
+	// Growing the range only sends the rooms the client hasn't seen yet.
+	res = decode(slidingSync(res.Pos, windowed(1)))
+	assert.Equal(t, []string{room2.ID}, roomIDs(res))
+	assert.True(t, res.Rooms[room2.ID].Initial)
+
+	// A new event moves its room to the top of the list. The client hasn't seen
+	// the room on this connection yet, so it gets everything.
+	ev = room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "moved", "msgtype": "m.text"})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, ev)...)
+	res = slidingSyncUntil(res.Pos, windowed(0), func(res types.SlidingSyncResponse) bool {
+		return res.Rooms[room.ID] != nil
+	})
+	assert.Equal(t, []string{room.ID}, roomIDs(res))
+	assert.True(t, res.Rooms[room.ID].Initial)
+	assert.Equal(t, ev.EventID(), res.Rooms[room.ID].Timeline[0].EventID)
+
+	// Afterwards only what changed in the room is sent.
+	ev = room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "delta", "msgtype": "m.text"})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, ev)...)
+	res = slidingSyncUntil(res.Pos, windowed(0), func(res types.SlidingSyncResponse) bool {
+		return res.Rooms[room.ID] != nil
+	})
+	assert.False(t, res.Rooms[room.ID].Initial)
+	assert.Len(t, res.Rooms[room.ID].Timeline, 1)
+	assert.Equal(t, ev.EventID(), res.Rooms[room.ID].Timeline[0].EventID)
+	assert.Empty(t, res.Rooms[room.ID].RequiredState)
+
+	// Room subscriptions send the room regardless of the lists.
+	subscription := map[string]interface{}{
+		"conn_id": "subscriptions",
+		"room_subscriptions": map[string]interface{}{
+			room2.ID: map[string]interface{}{
+				"required_state": [][2]string{{spec.MRoomCreate, ""}},
+				"timeline_limit": 1,
+			},
+		},
+	}
+	res = decode(slidingSync("", subscription))
+	assert.Empty(t, res.Lists)
+	assert.Equal(t, []string{room2.ID}, roomIDs(res))
+	assert.True(t, res.Rooms[room2.ID].Initial)
+	if assert.Len(t, res.Rooms[room2.ID].RequiredState, 1) {
+		assert.Equal(t, spec.MRoomCreate, res.Rooms[room2.ID].RequiredState[0].Type)
+	}
+	res = decode(slidingSync(res.Pos, subscription))
+	assert.Empty(t, res.Rooms)
+	ev = room2.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "subscribed", "msgtype": "m.text"})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, ev)...)
+	res = slidingSyncUntil(res.Pos, subscription, func(res types.SlidingSyncResponse) bool {
+		return res.Rooms[room2.ID] != nil
+	})
+	assert.False(t, res.Rooms[room2.ID].Initial)
+	assert.Equal(t, ev.EventID(), res.Rooms[room2.ID].Timeline[0].EventID)
+
+	// Extensions send the data of the rooms in the lists, and what isn't about rooms.
+	ctx := context.Background()
+	producer := producers.SyncAPIProducer{
+		TopicReceiptEvent:      cfg.Global.JetStream.Prefixed(jetstream.OutputReceiptEvent),
+		TopicSendToDeviceEvent: cfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
+		TopicTypingEvent:       cfg.Global.JetStream.Prefixed(jetstream.OutputTypingEvent),
+		JetStream:              jsctx,
+	}
+	if err := producer.SendToDevice(ctx, user.ID, user.ID, alice.ID, "m.dendrite.test", json.RawMessage(`{"dummy":"sliding"}`)); err != nil {
+		t.Fatalf("failed to send to-device message: %s", err)
+	}
+	for _, roomID := range []string{"", room.ID} {
+		msg := nats.NewMsg(cfg.Global.JetStream.Prefixed(jetstream.OutputClientData))
+		msg.Header.Set(jetstream.UserID, user.ID)
+		msg.Data, _ = json.Marshal(eventutil.AccountData{RoomID: roomID, Type: "m.test"})
+		testrig.MustPublishMsgs(t, jsctx, msg)
+	}
+	if err := producer.SendReceipt(ctx, user.ID, room.ID, ev.EventID(), "m.read", "", spec.AsTimestamp(time.Now())); err != nil {
+		t.Fatalf("failed to send receipt: %s", err)
+	}
+	if err := producer.SendTyping(ctx, user.ID, room3.ID, true, 30000); err != nil {
+		t.Fatalf("failed to send typing: %s", err)
+	}
+	extensions := func(toDeviceSince string) map[string]interface{} {
+		return map[string]interface{}{
+			"conn_id": "extensions",
+			"lists": map[string]interface{}{
+				"all": map[string]interface{}{
+					"ranges":         [][2]int{{0, 2}},
+					"timeline_limit": 1,
+				},
+			},
+			"extensions": map[string]interface{}{
+				"to_device":    map[string]interface{}{"enabled": true, "since": toDeviceSince},
+				"e2ee":         map[string]interface{}{"enabled": true},
+				"account_data": map[string]interface{}{"enabled": true},
+				"receipts":     map[string]interface{}{"enabled": true},
+				"typing":       map[string]interface{}{"enabled": true},
+			},
+		}
+	}
+	res = slidingSyncUntil("", extensions(""), func(res types.SlidingSyncResponse) bool {
+		ext := res.Extensions
+		return ext.ToDevice != nil && len(ext.ToDevice.Events) == 1 &&
+			ext.AccountData != nil && len(ext.AccountData.Global) == 1 && len(ext.AccountData.Rooms[room.ID]) == 1 &&
+			ext.Receipts != nil && ext.Receipts.Rooms[room.ID].Type == spec.MReceipt &&
+			ext.Typing != nil && ext.Typing.Rooms[room3.ID].Type == spec.MTyping
+	})
+	assert.Equal(t, "sliding", gjson.GetBytes(res.Extensions.ToDevice.Events[0].Content, "dummy").Str)
+	assert.NotNil(t, res.Extensions.E2EE)
+	assert.JSONEq(t, `{"global":true}`, string(res.Extensions.AccountData.Global[0].Content))
+	assert.JSONEq(t, `{"room":true}`, string(res.Extensions.AccountData.Rooms[room.ID][0].Content))
+	assert.Contains(t, string(res.Extensions.Receipts.Rooms[room.ID].Content), ev.EventID())
+	assert.Equal(t, user.ID, gjson.GetBytes(res.Extensions.Typing.Rooms[room3.ID].Content, "user_ids.0").Str)
+
+	// Afterwards the extensions only send what changed.
+	toDeviceSince := res.Extensions.ToDevice.NextBatch
+	if err := producer.SendReceipt(ctx, user.ID, room2.ID, ev.EventID(), "m.read", "", spec.AsTimestamp(time.Now())); err != nil {
+		t.Fatalf("failed to send receipt: %s", err)
+	}
+	res = slidingSyncUntil(res.Pos, extensions(toDeviceSince), func(res types.SlidingSyncResponse) bool {
+		return res.Extensions.Receipts != nil && res.Extensions.Receipts.Rooms[room2.ID].Type == spec.MReceipt
+	})
+	assert.Empty(t, res.Extensions.ToDevice.Events)
+	assert.NotNil(t, res.Extensions.E2EE)
+	assert.Empty(t, res.Extensions.AccountData.Global)
+	assert.Empty(t, res.Extensions.AccountData.Rooms)
+	assert.NotContains(t, res.Extensions.Receipts.Rooms, room.ID)
+	assert.Empty(t, res.Extensions.Typing.Rooms)
+}
+
 func syncUntil(t *testing.T,
 	routers httputil.Routers, accessToken string,
 	skip bool,
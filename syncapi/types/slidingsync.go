@@ -0,0 +1,163 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/ike20013/dendrite/syncapi/synctypes"
+)
+
+// SlidingSyncRequest is the body of a simplified sliding sync request.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4186
+type SlidingSyncRequest struct {
+	ConnID            string                           `json:"conn_id"`
+	Lists             map[string]SlidingSyncList       `json:"lists"`
+	RoomSubscriptions map[string]SlidingSyncRoomConfig `json:"room_subscriptions"`
+	Extensions        SlidingSyncExtensionsRequest     `json:"extensions"`
+}
+
+// SlidingSyncRoomConfig is the data wanted for each room in a list or room subscription.
+type SlidingSyncRoomConfig struct {
+	// RequiredState is a list of [event type, state key] pairs. Either may be "*",
+	// and the state key may also be "$ME", or "$LAZY" for the members who sent
+	// events in the timeline.
+	RequiredState [][2]string `json:"required_state"`
+	TimelineLimit int         `json:"timeline_limit"`
+}
+
+// SlidingSyncList is a list of rooms, sorted by recency, of which the client
+// wants to see the rooms in the given ranges.
+type SlidingSyncList struct {
+	SlidingSyncRoomConfig
+	// Ranges are the inclusive [start, end] indexes of the rooms in the list.
+	Ranges  [][2]int            `json:"ranges"`
+	Filters *SlidingSyncFilters `json:"filters,omitempty"`
+}
+
+// SlidingSyncFilters restricts the rooms in a list. Unset filters match all rooms.
+type SlidingSyncFilters struct {
+	IsDM        *bool `json:"is_dm,omitempty"`
+	IsEncrypted *bool `json:"is_encrypted,omitempty"`
+	IsInvite    *bool `json:"is_invite,omitempty"`
+	// RoomTypes may contain nil to match rooms without a type.
+	RoomTypes    []*string `json:"room_types,omitempty"`
+	NotRoomTypes []*string `json:"not_room_types,omitempty"`
+}
+
+type SlidingSyncExtensionsRequest struct {
+	ToDevice    *SlidingSyncToDeviceRequest  `json:"to_device,omitempty"`
+	E2EE        *SlidingSyncExtensionRequest `json:"e2ee,omitempty"`
+	AccountData *SlidingSyncExtensionRequest `json:"account_data,omitempty"`
+	Receipts    *SlidingSyncExtensionRequest `json:"receipts,omitempty"`
+	Typing      *SlidingSyncExtensionRequest `json:"typing,omitempty"`
+}
+
+// SlidingSyncExtensionRequest enables an extension. Extensions with room data
+// apply to the rooms in the given lists and room subscriptions, which default
+// to all of them. "*" also means all of them.
+type SlidingSyncExtensionRequest struct {
+	Enabled bool     `json:"enabled"`
+	Lists   []string `json:"lists,omitempty"`
+	Rooms   []string `json:"rooms,omitempty"`
+}
+
+type SlidingSyncToDeviceRequest struct {
+	SlidingSyncExtensionRequest
+	// Since is the next_batch of the previous to-device response.
+	Since string `json:"since,omitempty"`
+}
+
+type SlidingSyncResponse struct {
+	Pos        string                             `json:"pos"`
+	Lists      map[string]SlidingSyncListResponse `json:"lists"`
+	Rooms      map[string]*SlidingSyncRoom        `json:"rooms"`
+	Extensions SlidingSyncExtensionsResponse      `json:"extensions"`
+}
+
+type SlidingSyncListResponse struct {
+	Count int `json:"count"`
+}
+
+// SlidingSyncRoom is a room in a sliding sync response. Rooms which the client has
+// seen before on the connection only contain what changed, unless Initial is set.
+type SlidingSyncRoom struct {
+	Name              string                  `json:"name,omitempty"`
+	Avatar            string                  `json:"avatar,omitempty"`
+	Heroes            []SlidingSyncHero       `json:"heroes,omitempty"`
+	Initial           bool                    `json:"initial,omitempty"`
+	IsDM              bool                    `json:"is_dm,omitempty"`
+	InviteState       []json.RawMessage       `json:"invite_state,omitempty"`
+	RequiredState     []synctypes.ClientEvent `json:"required_state,omitempty"`
+	Timeline          []synctypes.ClientEvent `json:"timeline,omitempty"`
+	PrevBatch         string                  `json:"prev_batch,omitempty"`
+	Limited           bool                    `json:"limited,omitempty"`
+	NumLive           int                     `json:"num_live,omitempty"`
+	JoinedCount       *int                    `json:"joined_count,omitempty"`
+	InvitedCount      *int                    `json:"invited_count,omitempty"`
+	NotificationCount int                     `json:"notification_count"`
+	HighlightCount    int                     `json:"highlight_count"`
+	BumpStamp         StreamPosition          `json:"bump_stamp,omitempty"`
+}
+
+type SlidingSyncHero struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type SlidingSyncExtensionsResponse struct {
+	ToDevice    *SlidingSyncToDeviceResponse    `json:"to_device,omitempty"`
+	E2EE        *SlidingSyncE2EEResponse        `json:"e2ee,omitempty"`
+	AccountData *SlidingSyncAccountDataResponse `json:"account_data,omitempty"`
+	Receipts    *SlidingSyncEphemeralResponse   `json:"receipts,omitempty"`
+	Typing      *SlidingSyncEphemeralResponse   `json:"typing,omitempty"`
+}
+
+type SlidingSyncToDeviceResponse struct {
+	NextBatch string                                `json:"next_batch"`
+	Events    []gomatrixserverlib.SendToDeviceEvent `json:"events"`
+}
+
+type SlidingSyncE2EEResponse struct {
+	DeviceLists                  *DeviceLists   `json:"device_lists,omitempty"`
+	DeviceOneTimeKeysCount       map[string]int `json:"device_one_time_keys_count,omitempty"`
+	DeviceUnusedFallbackKeyTypes []string       `json:"device_unused_fallback_key_types"`
+}
+
+type SlidingSyncAccountDataResponse struct {
+	Global []synctypes.ClientEvent            `json:"global,omitempty"`
+	Rooms  map[string][]synctypes.ClientEvent `json:"rooms,omitempty"`
+}
+
+// SlidingSyncEphemeralResponse holds the m.receipt or m.typing event of each room.
+type SlidingSyncEphemeralResponse struct {
+	Rooms map[string]synctypes.ClientEvent `json:"rooms,omitempty"`
+}
+
+// IsEmpty returns whether the response has nothing new for the client, in which
+// case the request can wait for new data to arrive.
+func (r *SlidingSyncResponse) IsEmpty() bool {
+	if len(r.Rooms) > 0 {
+		return false
+	}
+	ext := r.Extensions
+	switch {
+	case ext.ToDevice != nil && len(ext.ToDevice.Events) > 0:
+		return false
+	case ext.E2EE != nil && ext.E2EE.DeviceLists != nil && (len(ext.E2EE.DeviceLists.Changed) > 0 || len(ext.E2EE.DeviceLists.Left) > 0):
+		return false
+	case ext.AccountData != nil && (len(ext.AccountData.Global) > 0 || len(ext.AccountData.Rooms) > 0):
+		return false
+	case ext.Receipts != nil && len(ext.Receipts.Rooms) > 0:
+		return false
+	case ext.Typing != nil && len(ext.Typing.Rooms) > 0:
+		return false
+	}
+	return true
+}
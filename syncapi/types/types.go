@@ -341,6 +341,7 @@ type RoomsResponse struct {
 	Join   map[string]*JoinResponse   `json:"join,omitempty"`
 	Peek   map[string]*JoinResponse   `json:"peek,omitempty"`
 	Invite map[string]*InviteResponse `json:"invite,omitempty"`
+	Knock  map[string]*KnockResponse  `json:"knock,omitempty"`
 	Leave  map[string]*LeaveResponse  `json:"leave,omitempty"`
 }
 
@@ -376,7 +377,8 @@ func (r Response) MarshalJSON() ([]byte, error) {
 	}
 	if r.Rooms != nil {
 		if len(r.Rooms.Join) == 0 && len(r.Rooms.Peek) == 0 &&
-			len(r.Rooms.Invite) == 0 && len(r.Rooms.Leave) == 0 {
+			len(r.Rooms.Invite) == 0 && len(r.Rooms.Knock) == 0 &&
+			len(r.Rooms.Leave) == 0 {
 			a.Rooms = nil
 		}
 	}
@@ -391,6 +393,7 @@ func (r *Response) HasUpdates() bool {
 	return (len(r.AccountData.Events) > 0 ||
 		len(r.Presence.Events) > 0 ||
 		len(r.Rooms.Invite) > 0 ||
+		len(r.Rooms.Knock) > 0 ||
 		len(r.Rooms.Join) > 0 ||
 		len(r.Rooms.Leave) > 0 ||
 		len(r.Rooms.Peek) > 0 ||
@@ -408,6 +411,7 @@ func NewResponse() *Response {
 		Join:   map[string]*JoinResponse{},
 		Peek:   map[string]*JoinResponse{},
 		Invite: map[string]*InviteResponse{},
+		Knock:  map[string]*KnockResponse{},
 		Leave:  map[string]*LeaveResponse{},
 	}
 
@@ -430,6 +434,7 @@ func NewResponse() *Response {
 func (r *Response) IsEmpty() bool {
 	return len(r.Rooms.Join) == 0 &&
 		len(r.Rooms.Invite) == 0 &&
+		len(r.Rooms.Knock) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
 		len(r.Presence.Events) == 0 &&
@@ -465,6 +470,9 @@ type JoinResponse struct {
 	Ephemeral            *ClientEvents `json:"ephemeral,omitempty"`
 	AccountData          *ClientEvents `json:"account_data,omitempty"`
 	*UnreadNotifications `json:"unread_notifications,omitempty"`
+	// UnreadThreadNotifications are the counts of each thread, by thread root event ID.
+	// They are only sent to clients which ask for them in their filter.
+	UnreadThreadNotifications map[string]*UnreadNotifications `json:"unread_thread_notifications,omitempty"`
 }
 
 func (jr JoinResponse) MarshalJSON() ([]byte, error) {
@@ -502,6 +510,7 @@ func (jr JoinResponse) MarshalJSON() ([]byte, error) {
 		// if everything else is nil, also remove UnreadNotifications
 		if a.State == nil && a.Ephemeral == nil && a.AccountData == nil && a.Timeline == nil && a.Summary == nil {
 			a.UnreadNotifications = nil
+			a.UnreadThreadNotifications = nil
 		}
 	}
 	return json.Marshal(a)
@@ -573,6 +582,44 @@ func NewInviteResponse(ctx context.Context, rsAPI api.QuerySenderIDAPI, event *t
 	return &res, nil
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type KnockResponse struct {
+	KnockState struct {
+		Events []json.RawMessage `json:"events"`
+	} `json:"knock_state"`
+}
+
+// NewKnockResponse creates a response containing the stripped state of the
+// room, followed by the knock event itself.
+func NewKnockResponse(ctx context.Context, rsAPI api.QuerySenderIDAPI, event *types.HeaderedEvent, eventFormat synctypes.ClientEventFormat) (*KnockResponse, error) {
+	res := KnockResponse{}
+	res.KnockState.Events = []json.RawMessage{}
+
+	// The knock_room_state is either given to us by the remote server that
+	// accepted the knock or generated by the roomserver for local rooms.
+	if knockRoomState := gjson.GetBytes(event.Unsigned(), "knock_room_state"); knockRoomState.IsArray() {
+		_ = json.Unmarshal([]byte(knockRoomState.Raw), &res.KnockState.Events)
+	}
+
+	eventNoUnsigned, err := event.SetUnsigned(nil)
+	if err != nil {
+		return nil, err
+	}
+	knockEvent, err := synctypes.ToClientEvent(eventNoUnsigned, eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	knockEvent.Unsigned = nil
+
+	if ev, err := json.Marshal(*knockEvent); err == nil {
+		res.KnockState.Events = append(res.KnockState.Events, ev)
+	}
+
+	return &res, nil
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type LeaveResponse struct {
 	State    *ClientEvents `json:"state,omitempty"`
@@ -625,6 +672,7 @@ type OutputReceiptEvent struct {
 	EventID   string         `json:"event_id"`
 	Type      string         `json:"type"`
 	Timestamp spec.Timestamp `json:"timestamp"`
+	ThreadID  string         `json:"thread_id,omitempty"`
 }
 
 // OutputSendToDeviceEvent is an entry in the send-to-device output kafka log.
@@ -644,3 +692,12 @@ type RelationEntry struct {
 	Position StreamPosition
 	EventID  string
 }
+
+// ThreadSummary is what is known about a thread, as needed for the m.thread
+// bundled aggregation of its root.
+type ThreadSummary struct {
+	Count         int
+	LatestEventID string
+	// Participated is whether the user sent the root or any of the replies.
+	Participated bool
+}
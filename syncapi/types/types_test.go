@@ -105,6 +105,30 @@ func TestNewInviteResponse(t *testing.T) {
 	}
 }
 
+func TestNewKnockResponse(t *testing.T) {
+	event := `{"auth_events":["$Xn2F3FqtPPN7WThkKM3ZOwgLfXutqrl0SEvRKWw2nm8","$r3S5MtDPvY8TjrUkbfDzs9LTkc6n_TlPx66BMP3H9Sk"],"content":{"membership":"knock","reason":"let me in"},"depth":7,"hashes":{"sha256":"wq4LQcmzRSYZ30wNH2Uwa9mZdU3DxsN3mMGzPZu3D4o"},"origin":"dendrite.test","origin_server_ts":1700000000000,"prev_events":["$r3S5MtDPvY8TjrUkbfDzs9LTkc6n_TlPx66BMP3H9Sk"],"room_id":"!knock:remote.test","sender":"@alice:dendrite.test","signatures":{"dendrite.test":{"ed25519:auto":"ZPeBuR0bZvPeT/4yH6wCQBI6LgDYdkfy0DBFq3TIV1Y1DXzy3oWctBsRvPwVRgQvm4T3vUXqj0Emqy2tUcvGAw"}},"state_key":"@alice:dendrite.test","type":"m.room.member","unsigned":{"knock_room_state":[{"content":{"join_rule":"knock"},"sender":"@bob:remote.test","state_key":"","type":"m.room.join_rules"},{"content":{"name":"Knock room"},"sender":"@bob:remote.test","state_key":"","type":"m.room.name"}]}}`
+	expected := `{"knock_state":{"events":[{"content":{"join_rule":"knock"},"sender":"@bob:remote.test","state_key":"","type":"m.room.join_rules"},{"content":{"name":"Knock room"},"sender":"@bob:remote.test","state_key":"","type":"m.room.name"},{"content":{"membership":"knock","reason":"let me in"},"event_id":"$JeegMIsL4Sg8W7JidxR56chMPe7emSixQRSbFQFjqnU","origin_server_ts":1700000000000,"sender":"@alice:dendrite.test","state_key":"@alice:dendrite.test","type":"m.room.member"}]}}`
+
+	ev, err := gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV7).NewEventFromTrustedJSON([]byte(event), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsAPI := FakeRoomserverAPI{}
+	res, err := NewKnockResponse(context.Background(), &rsAPI, &types.HeaderedEvent{PDU: ev}, synctypes.FormatSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(j) != expected {
+		t.Fatalf("Knock response didn't contain correct info, \nexpected: %s \ngot: %s", expected, string(j))
+	}
+}
+
 func TestJoinResponse_MarshalJSON(t *testing.T) {
 	type fields struct {
 		Summary             *Summary
@@ -236,6 +236,18 @@ func (d *InMemoryFederationDatabase) GetPendingEDUCount(
 	return count, nil
 }
 
+func (d *InMemoryFederationDatabase) PurgeDestinationQueue(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	delete(d.associatedPDUs, serverName)
+	delete(d.associatedEDUs, serverName)
+	return nil
+}
+
 func (d *InMemoryFederationDatabase) GetPendingPDUServerNames(
 	ctx context.Context,
 ) ([]spec.ServerName, error) {
@@ -496,6 +508,14 @@ func (d *InMemoryFederationDatabase) GetNotaryKeys(ctx context.Context, serverNa
 	return nil, nil
 }
 
+func (d *InMemoryFederationDatabase) GetServerSigningKeys(ctx context.Context, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return nil, nil
+}
+
+func (d *InMemoryFederationDatabase) DeleteServerSigningKeys(ctx context.Context, serverName spec.ServerName) error {
+	return nil
+}
+
 func (d *InMemoryFederationDatabase) DeleteExpiredEDUs(ctx context.Context) error {
 	return nil
 }
@@ -0,0 +1,82 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/ike20013/dendrite/mediaapi/mediastore"
+)
+
+// InMemoryMediaStore is a mediastore.Store keeping media in memory.
+type InMemoryMediaStore struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+}
+
+func NewInMemoryMediaStore() *InMemoryMediaStore {
+	return &InMemoryMediaStore{
+		objects: map[string][]byte{},
+	}
+}
+
+func (s *InMemoryMediaStore) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes but expected %d", len(data), size)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *InMemoryMediaStore) Open(ctx context.Context, key string) (mediastore.Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, mediastore.ErrNotFound
+	}
+	return &memoryObject{Reader: bytes.NewReader(data)}, nil
+}
+
+func (s *InMemoryMediaStore) Stat(ctx context.Context, key string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return 0, mediastore.ErrNotFound
+	}
+	return int64(len(data)), nil
+}
+
+func (s *InMemoryMediaStore) DeleteAll(ctx context.Context, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.objects, key)
+		}
+	}
+	return nil
+}
+
+type memoryObject struct {
+	*bytes.Reader
+}
+
+func (o *memoryObject) Close() error {
+	return nil
+}
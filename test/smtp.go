@@ -0,0 +1,148 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package test
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// SMTPMessage is an email received by an SMTPServer.
+type SMTPMessage struct {
+	From string
+	To   []string
+	// The message including its headers, with the line endings and dot-stuffing
+	// of the SMTP transaction removed
+	Data string
+}
+
+// SMTPServer is an SMTP server which keeps the emails it receives, which tests
+// can send emails to. It supports neither StartTLS nor authentication.
+type SMTPServer struct {
+	Host string
+	Port int
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	messages []SMTPMessage
+}
+
+// NewSMTPServer starts a server on a random local port, which is stopped when
+// the test finishes.
+func NewSMTPServer(t *testing.T) *SMTPServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start SMTP server: %s", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	s := &SMTPServer{
+		Host:     addr.IP.String(),
+		Port:     addr.Port,
+		listener: l,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(func() {
+		_ = l.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+// Messages returns the emails received so far.
+func (s *SMTPServer) Messages() []SMTPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SMTPMessage(nil), s.messages...)
+}
+
+func (s *SMTPServer) serve() {
+	defer s.wg.Done()
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer conn.Close() // nolint: errcheck
+			s.handle(textproto.NewConn(conn))
+		}()
+	}
+}
+
+func (s *SMTPServer) handle(conn *textproto.Conn) {
+	reply := func(code int, msg string) bool {
+		return conn.PrintfLine("%d %s", code, msg) == nil
+	}
+	if !reply(220, "localhost ESMTP test server") {
+		return
+	}
+	var msg SMTPMessage
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		ok := true
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ok = reply(250, "localhost")
+		case "MAIL":
+			msg = SMTPMessage{From: trimPath(arg, "FROM:")}
+			ok = reply(250, "OK")
+		case "RCPT":
+			msg.To = append(msg.To, trimPath(arg, "TO:"))
+			ok = reply(250, "OK")
+		case "DATA":
+			if !reply(354, "End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			lines, err := conn.ReadDotLines()
+			if err != nil {
+				return
+			}
+			msg.Data = strings.Join(lines, "\n")
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			ok = reply(250, "OK: queued as "+strconv.Itoa(len(s.Messages())))
+		case "RSET":
+			msg = SMTPMessage{}
+			ok = reply(250, "OK")
+		case "NOOP":
+			ok = reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			ok = reply(502, "Command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// trimPath returns the address in a MAIL FROM:<address> or RCPT TO:<address> argument.
+func trimPath(arg, prefix string) string {
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = arg[len(prefix):]
+	}
+	arg, _, _ = strings.Cut(arg, " ")
+	return strings.Trim(arg, "<>")
+}
@@ -94,6 +94,7 @@ type ClientUserAPI interface {
 	PerformAdminUpdateRegistrationToken(ctx context.Context, tokenString string, newAttributes map[string]interface{}) (*clientapi.RegistrationToken, error)
 	PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
 	PerformPasswordUpdate(ctx context.Context, req *PerformPasswordUpdateRequest, res *PerformPasswordUpdateResponse) error
@@ -101,6 +102,12 @@ type ClientUserAPI interface {
 	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *struct{}) error
 	PerformPushRulesPut(ctx context.Context, userID string, ruleSets *pushrules.AccountRuleSets) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
+	PerformAccountShadowBan(ctx context.Context, req *PerformAccountShadowBanRequest, res *struct{}) error
+	PerformAdminAccountUpdate(ctx context.Context, req *PerformAdminAccountUpdateRequest, res *struct{}) error
+	QueryAdminAccounts(ctx context.Context, req *QueryAdminAccountsRequest, res *QueryAdminAccountsResponse) error
+	PerformAccountValidityRenewal(ctx context.Context, req *PerformAccountValidityRenewalRequest, res *PerformAccountValidityRenewalResponse) error
+	QueryExpiringAccounts(ctx context.Context, req *QueryExpiringAccountsRequest, res *QueryExpiringAccountsResponse) error
+	PerformAccountExpiryNoticeSent(ctx context.Context, req *PerformAccountExpiryNoticeSentRequest, res *struct{}) error
 	PerformOpenIDTokenCreation(ctx context.Context, req *PerformOpenIDTokenCreationRequest, res *PerformOpenIDTokenCreationResponse) error
 	QueryNotifications(ctx context.Context, req *QueryNotificationsRequest, res *QueryNotificationsResponse) error
 	InputAccountData(ctx context.Context, req *InputAccountDataRequest, res *InputAccountDataResponse) error
@@ -109,6 +116,9 @@ type ClientUserAPI interface {
 	QueryLocalpartForThreePID(ctx context.Context, req *QueryLocalpartForThreePIDRequest, res *QueryLocalpartForThreePIDResponse) error
 	PerformForgetThreePID(ctx context.Context, req *PerformForgetThreePIDRequest, res *struct{}) error
 	PerformSaveThreePIDAssociation(ctx context.Context, req *PerformSaveThreePIDAssociationRequest, res *struct{}) error
+
+	QueryLocalpartForSSO(ctx context.Context, req *QueryLocalpartForSSORequest, res *QueryLocalpartForSSOResponse) error
+	PerformSaveSSOAssociation(ctx context.Context, req *PerformSaveSSOAssociationRequest, res *struct{}) error
 }
 
 type KeyBackupAPI interface {
@@ -270,6 +280,12 @@ type QueryAccessTokenRequest struct {
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    string // e.g ErrorForbidden
+	// Expired is true if the access token was valid but has expired, in which
+	// case Device is nil. The client can get a new one with its refresh token.
+	Expired bool
+	// AccountExpired is true if the account has expired, in which case Device is
+	// nil. Only an admin can renew the account.
+	AccountExpired bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -375,12 +391,34 @@ type PerformDeviceCreationRequest struct {
 	// FromRegistration determines if this request comes from registering a new account
 	// and is in most cases false.
 	FromRegistration bool
+
+	// RefreshToken determines whether the access token expires and a refresh
+	// token is issued to renew it.
+	RefreshToken bool
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
 type PerformDeviceCreationResponse struct {
 	DeviceCreated bool
 	Device        *Device
+	// Only set if a refresh token was requested.
+	RefreshToken string
+	ExpiresInMS  int64
+}
+
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	RefreshToken string
+	// The access token which replaces the current one of the device.
+	AccessToken string
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// The refresh token which replaces the one in the request, empty if that
+	// refresh token is unknown or was already used.
+	RefreshToken string
+	ExpiresInMS  int64
 }
 
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
@@ -394,6 +432,72 @@ type PerformAccountDeactivationResponse struct {
 	AccountDeactivated bool
 }
 
+// PerformAccountShadowBanRequest is the request for PerformAccountShadowBan
+type PerformAccountShadowBanRequest struct {
+	Localpart    string
+	ServerName   spec.ServerName
+	ShadowBanned bool
+}
+
+// PerformAdminAccountUpdateRequest is the request for PerformAdminAccountUpdate
+type PerformAdminAccountUpdateRequest struct {
+	Localpart  string
+	ServerName spec.ServerName
+	// optional: the new account type, e.g. to make the account an admin
+	AccountType AccountType
+	// optional: let a deactivated account log in again
+	Reactivate bool
+}
+
+// QueryAdminAccountsRequest is the request for QueryAdminAccounts
+type QueryAdminAccountsRequest struct {
+	ServerName         spec.ServerName // optional: only return accounts on this server
+	Localpart          string          // optional: only return the account with this localpart
+	Search             string          // optional: only return accounts whose localpart or display name contain this
+	IncludeDeactivated bool
+	IncludeGuests      bool
+	From               int
+	Limit              int
+}
+
+// QueryAdminAccountsResponse is the response for QueryAdminAccounts
+type QueryAdminAccountsResponse struct {
+	Accounts []AdminAccount
+	// The number of matching accounts, including those which aren't on this page
+	Total int64
+}
+
+// PerformAccountValidityRenewalRequest is the request for PerformAccountValidityRenewal
+type PerformAccountValidityRenewalRequest struct {
+	Localpart  string
+	ServerName spec.ServerName
+	// optional: when the account expires. If 0, the account is valid for the
+	// configured period from now.
+	ExpirationTS spec.Timestamp
+}
+
+// PerformAccountValidityRenewalResponse is the response for PerformAccountValidityRenewal
+type PerformAccountValidityRenewalResponse struct {
+	ExpirationTS spec.Timestamp
+}
+
+// QueryExpiringAccountsRequest is the request for QueryExpiringAccounts
+type QueryExpiringAccountsRequest struct {
+	// Accounts expiring before this whose users haven't been warned yet are returned.
+	Before spec.Timestamp
+}
+
+// QueryExpiringAccountsResponse is the response for QueryExpiringAccounts
+type QueryExpiringAccountsResponse struct {
+	Accounts []AccountValidity
+}
+
+// PerformAccountExpiryNoticeSentRequest is the request for PerformAccountExpiryNoticeSent
+type PerformAccountExpiryNoticeSentRequest struct {
+	Localpart  string
+	ServerName spec.ServerName
+}
+
 // PerformOpenIDTokenCreationRequest is the request for PerformOpenIDTokenCreation
 type PerformOpenIDTokenCreationRequest struct {
 	UserID string
@@ -422,6 +526,9 @@ type Device struct {
 	// The access_token granted to this device.
 	// This uniquely identifies the device from all other devices and clients.
 	AccessToken string
+	// When the access token expires, or zero if it doesn't. Only set when
+	// the device is looked up by its access token.
+	AccessTokenExpiresTS spec.Timestamp
 	// The unique ID of the session identified by the access token.
 	// Can be used as a secure substitution in places where data needs to be
 	// associated with access tokens.
@@ -434,6 +541,9 @@ type Device struct {
 	// this is the appservice ID.
 	AppserviceID string
 	AccountType  AccountType
+	// Whether the account is shadow-banned, in which case the events sent
+	// by the device must not reach the roomserver.
+	ShadowBanned bool
 }
 
 func (d *Device) UserDomain() spec.ServerName {
@@ -455,9 +565,26 @@ type Account struct {
 	ServerName   spec.ServerName
 	AppServiceID string
 	AccountType  AccountType
+	ShadowBanned bool
 	// TODO: Associations (e.g. with application services)
 }
 
+// AdminAccount is an account with its profile and status, as shown to server admins.
+type AdminAccount struct {
+	Account
+	DisplayName string
+	AvatarURL   string
+	CreatedTS   int64 // milliseconds since the epoch
+	Deactivated bool
+}
+
+// AccountValidity is when a local account expires.
+type AccountValidity struct {
+	Localpart    string
+	ServerName   spec.ServerName
+	ExpirationTS spec.Timestamp
+}
+
 // OpenIDToken represents an OpenID token
 type OpenIDToken struct {
 	Token       string
@@ -579,6 +706,9 @@ type Notification struct {
 	Read       bool                  `json:"read"`        // Required.
 	RoomID     string                `json:"room_id"`     // Required.
 	TS         spec.Timestamp        `json:"ts"`          // Required.
+	// ThreadID is the root of the thread the event is in, or "main" if it
+	// isn't in a thread. It isn't part of the client API.
+	ThreadID string `json:"-"`
 }
 
 type QueryNumericLocalpartRequest struct {
@@ -636,6 +766,23 @@ type PerformSaveThreePIDAssociationRequest struct {
 	Medium     string
 }
 
+type QueryLocalpartForSSORequest struct {
+	// The ID of the identity provider in the config and the user's identifier there
+	IDPID, Subject string
+}
+
+type QueryLocalpartForSSOResponse struct {
+	Localpart  string
+	ServerName spec.ServerName
+}
+
+type PerformSaveSSOAssociationRequest struct {
+	IDPID      string
+	Subject    string
+	Localpart  string
+	ServerName spec.ServerName
+}
+
 type QueryAccountByLocalpartRequest struct {
 	Localpart  string
 	ServerName spec.ServerName
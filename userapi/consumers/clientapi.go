@@ -73,6 +73,7 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msgs []*nats
 	roomID := msg.Header.Get(jetstream.RoomID)
 	readPos := msg.Header.Get(jetstream.EventID)
 	evType := msg.Header.Get("type")
+	threadID := msg.Header.Get("thread_id")
 
 	if readPos == "" || (evType != "m.read" && evType != "m.read.private") {
 		return true
@@ -97,7 +98,7 @@ func (s *OutputReceiptEventConsumer) onMessage(ctx context.Context, msgs []*nats
 		return false
 	}
 
-	updated, err := s.db.SetNotificationsRead(ctx, localpart, domain, roomID, uint64(spec.AsTimestamp(metadata.Timestamp)), true)
+	updated, err := s.db.SetNotificationsRead(ctx, localpart, domain, roomID, threadID, uint64(spec.AsTimestamp(metadata.Timestamp)), true)
 	if err != nil {
 		log.WithError(err).Error("userapi EDU consumer")
 		return false
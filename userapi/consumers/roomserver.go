@@ -529,6 +529,16 @@ func unmarshalCanonicalAlias(event *rstypes.HeaderedEvent) (string, error) {
 }
 
 // notifyLocal finds the right push actions for a local user, given an event.
+// threadID returns the root of the thread the event is in, or "main" if it
+// isn't in a thread.
+func threadID(event *rstypes.HeaderedEvent) string {
+	relatesTo := gjson.GetBytes(event.Content(), `m\.relates_to`)
+	if relatesTo.Get("rel_type").Str == "m.thread" && relatesTo.Get("event_id").Str != "" {
+		return relatesTo.Get("event_id").Str
+	}
+	return "main"
+}
+
 func (s *OutputRoomEventConsumer) notifyLocal(ctx context.Context, event *rstypes.HeaderedEvent, mem *localMembership, roomSize int, roomName string, streamPos uint64) error {
 	actions, err := s.evaluatePushRules(ctx, event, mem, roomSize)
 	if err != nil {
@@ -572,6 +582,7 @@ func (s *OutputRoomEventConsumer) notifyLocal(ctx context.Context, event *rstype
 		ProfileTag: profileTag,
 		RoomID:     event.RoomID().String(),
 		TS:         spec.AsTimestamp(time.Now()),
+		ThreadID:   threadID(event),
 	}
 	if err = s.db.InsertNotification(ctx, mem.Localpart, mem.Domain, event.EventID(), streamPos, tweaks, n); err != nil {
 		return fmt.Errorf("s.db.InsertNotification: %w", err)
@@ -0,0 +1,123 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ike20013/dendrite/setup/config"
+)
+
+// LDAPPasswordProvider checks passwords by binding to an LDAP directory as the user.
+type LDAPPasswordProvider struct {
+	cfg *config.LDAPPasswordProvider
+}
+
+func NewLDAPPasswordProvider(cfg *config.LDAPPasswordProvider) (*LDAPPasswordProvider, error) {
+	if cfg.Filter != "" {
+		if _, err := ldap.CompileFilter(cfg.Filter); err != nil {
+			return nil, fmt.Errorf("invalid LDAP filter %q: %w", cfg.Filter, err)
+		}
+	}
+	return &LDAPPasswordProvider{cfg: cfg}, nil
+}
+
+func (p *LDAPPasswordProvider) AutoProvision() bool {
+	return p.cfg.AutoProvision
+}
+
+func (p *LDAPPasswordProvider) CheckPassword(ctx context.Context, localpart, password string) (*ExternalUser, error) {
+	if password == "" {
+		return nil, nil
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint: errcheck
+
+	filter := "(" + p.cfg.Attributes.UID + "=" + ldap.EscapeFilter(localpart) + ")"
+	if p.cfg.Filter != "" {
+		filter = "(&" + p.cfg.Filter + filter + ")"
+	}
+	attributes := []string{p.cfg.Attributes.DisplayName, p.cfg.Attributes.Email}
+
+	var entries []*ldap.Entry
+	if p.cfg.BindDN != "" {
+		// Find the user with the service account, then check their password.
+		if err = conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("failed to bind as %q: %w", p.cfg.BindDN, err)
+		}
+		if entries, err = p.search(conn, p.cfg.BaseDN, ldap.ScopeWholeSubtree, filter, attributes); err != nil {
+			return nil, fmt.Errorf("failed to search for user: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil, nil
+		} else if len(entries) > 1 {
+			return nil, fmt.Errorf("found %d LDAP entries for %q", len(entries), localpart)
+		}
+		if err = conn.Bind(entries[0].DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	} else {
+		// Bind as the user directly, then check that they match the filter.
+		dn := p.cfg.Attributes.UID + "=" + ldap.EscapeDN(localpart) + "," + p.cfg.BaseDN
+		if err = conn.Bind(dn, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries, err = p.search(conn, dn, ldap.ScopeBaseObject, filter, attributes)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && len(entries) != 1) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to search for user: %w", err)
+		}
+	}
+
+	return &ExternalUser{
+		DisplayName: entries[0].GetEqualFoldAttributeValue(p.cfg.Attributes.DisplayName),
+		Email:       entries[0].GetEqualFoldAttributeValue(p.cfg.Attributes.Email),
+	}, nil
+}
+
+// dial connects to the server, upgrading the connection with StartTLS if
+// configured. The timeout applies to connecting and to each request.
+func (p *LDAPPasswordProvider) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(p.cfg.URI, ldap.DialWithDialer(&net.Dialer{Timeout: p.cfg.Timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(p.cfg.Timeout)
+	if p.cfg.StartTLS {
+		u, err := url.Parse(p.cfg.URI)
+		if err == nil {
+			err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		}
+		if err != nil {
+			conn.Close() // nolint: errcheck
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p *LDAPPasswordProvider) search(conn *ldap.Conn, baseDN string, scope int, filter string, attributes []string) ([]*ldap.Entry, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		baseDN, scope, ldap.NeverDerefAliases, 0, 0, false, filter, attributes, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
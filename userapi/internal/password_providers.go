@@ -0,0 +1,142 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/ike20013/dendrite/external"
+	"github.com/ike20013/dendrite/setup/config"
+	"github.com/ike20013/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// PasswordProvider checks passwords against an external source of users, such
+// as an LDAP directory.
+type PasswordProvider interface {
+	// CheckPassword returns the details of the user if the password is correct.
+	// Returns nil if the provider doesn't know the user or the password is wrong.
+	CheckPassword(ctx context.Context, localpart, password string) (*ExternalUser, error)
+	// AutoProvision returns whether accounts should be created for users who
+	// don't have one yet.
+	AutoProvision() bool
+}
+
+// ExternalUser is a user as known by a password provider. Empty fields are
+// not known to the provider.
+type ExternalUser struct {
+	DisplayName string
+	Email       string
+}
+
+// NewPasswordProviders returns the password providers in the config, in order.
+func NewPasswordProviders(cfg *config.PasswordAuth) ([]PasswordProvider, error) {
+	providers := make([]PasswordProvider, 0, len(cfg.Providers))
+	for i := range cfg.Providers {
+		switch p := &cfg.Providers[i]; p.Type {
+		case config.PasswordProviderLDAP:
+			provider, err := NewLDAPPasswordProvider(&p.LDAP)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		default:
+			return nil, fmt.Errorf("unknown password provider type %q", p.Type)
+		}
+	}
+	return providers, nil
+}
+
+// queryAccountByExternalPassword checks the password against the password
+// providers in turn, and returns the account of the user if one of them
+// accepts it. Returns nil if none of them do.
+func (a *UserInternalAPI) queryAccountByExternalPassword(
+	ctx context.Context, localpart string, serverName spec.ServerName, password string,
+) (*api.Account, error) {
+	for _, provider := range a.PasswordProviders {
+		user, err := provider.CheckPassword(ctx, localpart, password)
+		if err != nil {
+			// Carry on with the next provider, so that users can still log in
+			// with a local password if a provider is unavailable.
+			util.GetLogger(ctx).WithError(err).Error("Failed to check password with password provider")
+			continue
+		}
+		if user == nil {
+			continue
+		}
+		acc, err := a.accountForExternalUser(ctx, provider, localpart, serverName, user)
+		if err != nil {
+			return nil, err
+		}
+		if acc != nil {
+			return acc, nil
+		}
+	}
+	return nil, nil
+}
+
+// accountForExternalUser returns the account of a user that was authenticated by
+// a password provider, creating it if the provider allows that, and updates its
+// profile from the provider. Returns nil if there is no usable account.
+func (a *UserInternalAPI) accountForExternalUser(
+	ctx context.Context, provider PasswordProvider,
+	localpart string, serverName spec.ServerName, user *ExternalUser,
+) (*api.Account, error) {
+	acc, err := a.DB.GetAccountByLocalpart(ctx, localpart, serverName)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if !provider.AutoProvision() || external.ValidateUsername(localpart, serverName) != nil {
+			return nil, nil
+		}
+		var res api.PerformAccountCreationResponse
+		if err = a.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			AccountType: api.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			OnConflict:  api.ConflictAbort,
+		}, &res); err != nil {
+			return nil, fmt.Errorf("failed to create account for external user: %w", err)
+		}
+		acc = res.Account
+	case err != nil:
+		return nil, err
+	default:
+		deactivated, err := a.DB.IsAccountDeactivated(ctx, acc.Localpart, acc.ServerName)
+		if err != nil {
+			return nil, err
+		}
+		if deactivated || acc.AccountType == api.AccountTypeAppService {
+			return nil, nil
+		}
+	}
+
+	logger := util.GetLogger(ctx).WithField("user_id", acc.UserID)
+	// Only the profile is updated here, so rooms the user is in will show the new
+	// display name once it is changed through the client API.
+	if user.DisplayName != "" {
+		if _, _, err = a.DB.SetDisplayName(ctx, acc.Localpart, acc.ServerName, user.DisplayName); err != nil {
+			logger.WithError(err).Warn("Failed to update display name from password provider")
+		}
+	}
+	if user.Email != "" {
+		owner, _, err := a.DB.GetLocalpartForThreePID(ctx, user.Email, "email")
+		switch {
+		case err != nil:
+			logger.WithError(err).Warn("Failed to look up email address from password provider")
+		case owner == "":
+			if err = a.DB.SaveThreePIDAssociation(ctx, user.Email, acc.Localpart, acc.ServerName, "email"); err != nil {
+				logger.WithError(err).Warn("Failed to save email address from password provider")
+			}
+		case owner != acc.Localpart:
+			logger.Warn("Email address from password provider belongs to another user")
+		}
+	}
+	return acc, nil
+}
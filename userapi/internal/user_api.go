@@ -54,6 +54,9 @@ type UserInternalAPI struct {
 	PgClient    pushgateway.Client
 	FedClient   fedsenderapi.KeyserverFederationAPI
 	Updater     *DeviceListUpdater
+	// PasswordProviders are checked in order before the local database when
+	// querying accounts by password.
+	PasswordProviders []PasswordProvider
 }
 
 func (a *UserInternalAPI) PerformAdminCreateRegistrationToken(ctx context.Context, registrationToken *clientapi.RegistrationToken) (bool, error) {
@@ -232,6 +235,18 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		return nil
 	}
 
+	// Accounts of appservices and of the server notices user are used by the
+	// server itself, so they never expire. Neither do admin accounts, so that
+	// admins can always renew accounts.
+	validity := &a.Config.AccountValidity
+	if validity.Enabled() && req.AppServiceID == "" && req.AccountType != api.AccountTypeAdmin &&
+		req.Localpart != a.Config.Matrix.ServerNotices.LocalPart {
+		expirationTS := spec.AsTimestamp(time.Now().Add(validity.Period))
+		if err = a.DB.SetAccountExpiry(ctx, req.Localpart, serverName, expirationTS); err != nil {
+			return fmt.Errorf("a.DB.SetAccountExpiry: %w", err)
+		}
+	}
+
 	// Inform the SyncAPI about the newly created push_rules
 	if err = a.SyncProducer.SendAccountData(acc.UserID, eventutil.AccountData{
 		Type: "m.push_rules",
@@ -304,6 +319,14 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	}
 	res.DeviceCreated = true
 	res.Device = dev
+	if req.RefreshToken {
+		expiresTS := spec.AsTimestamp(time.Now().Add(a.accessTokenLifetime()))
+		res.RefreshToken, err = a.DB.CreateRefreshToken(ctx, req.Localpart, serverName, dev.ID, dev.AccessToken, expiresTS)
+		if err != nil {
+			return err
+		}
+		res.ExpiresInMS = a.Config.AccessTokenLifetimeMS
+	}
 	if req.NoDeviceListUpdate || isExisting {
 		return nil
 	}
@@ -311,6 +334,24 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID}, req.FromRegistration)
 }
 
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	expiresTS := spec.AsTimestamp(time.Now().Add(a.accessTokenLifetime()))
+	refreshToken, err := a.DB.RefreshAccessToken(ctx, req.RefreshToken, req.AccessToken, expiresTS)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	res.RefreshToken = refreshToken
+	res.ExpiresInMS = a.Config.AccessTokenLifetimeMS
+	return nil
+}
+
+func (a *UserInternalAPI) accessTokenLifetime() time.Duration {
+	return time.Duration(a.Config.AccessTokenLifetimeMS) * time.Millisecond
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -580,11 +621,28 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 	if !a.Config.Matrix.IsLocalServerName(domain) {
 		return nil
 	}
+	if device.AccessTokenExpiresTS != 0 && device.AccessTokenExpiresTS.Time().Before(time.Now()) {
+		res.Expired = true
+		return nil
+	}
 	acc, err := a.DB.GetAccountByLocalpart(ctx, localPart, domain)
 	if err != nil {
 		return err
 	}
+	// Admins are let in even if their account was given an expiry, as they
+	// would otherwise have no way to renew it.
+	if a.Config.AccountValidity.Enabled() && acc.AccountType != api.AccountTypeAdmin {
+		accountExpiresTS, err := a.DB.GetAccountExpiry(ctx, localPart, domain)
+		if err != nil {
+			return err
+		}
+		if accountExpiresTS != 0 && accountExpiresTS.Time().Before(time.Now()) {
+			res.AccountExpired = true
+			return nil
+		}
+	}
 	device.AccountType = acc.AccountType
+	device.ShadowBanned = acc.ShadowBanned
 	res.Device = device
 	return nil
 }
@@ -678,6 +736,80 @@ func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *a
 	return err
 }
 
+// PerformAccountShadowBan sets or clears the shadow-ban of a local account.
+func (a *UserInternalAPI) PerformAccountShadowBan(ctx context.Context, req *api.PerformAccountShadowBanRequest, res *struct{}) error {
+	if !a.Config.Matrix.IsLocalServerName(req.ServerName) {
+		return fmt.Errorf("server name %q not locally configured", req.ServerName)
+	}
+	return a.DB.SetAccountShadowBanned(ctx, req.Localpart, req.ServerName, req.ShadowBanned)
+}
+
+// PerformAdminAccountUpdate changes the type of a local account, or reactivates it.
+func (a *UserInternalAPI) PerformAdminAccountUpdate(ctx context.Context, req *api.PerformAdminAccountUpdateRequest, res *struct{}) error {
+	if !a.Config.Matrix.IsLocalServerName(req.ServerName) {
+		return fmt.Errorf("server name %q not locally configured", req.ServerName)
+	}
+	if req.AccountType != 0 {
+		if err := a.DB.SetAccountType(ctx, req.Localpart, req.ServerName, req.AccountType); err != nil {
+			return err
+		}
+	}
+	if req.Reactivate {
+		return a.DB.ReactivateAccount(ctx, req.Localpart, req.ServerName)
+	}
+	return nil
+}
+
+// QueryAdminAccounts lists the local accounts matching the request.
+func (a *UserInternalAPI) QueryAdminAccounts(ctx context.Context, req *api.QueryAdminAccountsRequest, res *api.QueryAdminAccountsResponse) error {
+	var err error
+	res.Accounts, res.Total, err = a.DB.GetAccounts(ctx, tables.AccountFilter{
+		ServerName:         req.ServerName,
+		Localpart:          req.Localpart,
+		Search:             req.Search,
+		IncludeDeactivated: req.IncludeDeactivated,
+		IncludeGuests:      req.IncludeGuests,
+		From:               req.From,
+		Limit:              req.Limit,
+	})
+	return err
+}
+
+// ErrAccountValidityDisabled is returned when renewing an account for the
+// configured period while accounts don't expire.
+var ErrAccountValidityDisabled = errors.New("account validity is not enabled")
+
+// PerformAccountValidityRenewal sets when a local account expires.
+func (a *UserInternalAPI) PerformAccountValidityRenewal(ctx context.Context, req *api.PerformAccountValidityRenewalRequest, res *api.PerformAccountValidityRenewalResponse) error {
+	if !a.Config.Matrix.IsLocalServerName(req.ServerName) {
+		return fmt.Errorf("server name %q not locally configured", req.ServerName)
+	}
+	expirationTS := req.ExpirationTS
+	if expirationTS == 0 {
+		if !a.Config.AccountValidity.Enabled() {
+			return ErrAccountValidityDisabled
+		}
+		expirationTS = spec.AsTimestamp(time.Now().Add(a.Config.AccountValidity.Period))
+	}
+	if err := a.DB.SetAccountExpiry(ctx, req.Localpart, req.ServerName, expirationTS); err != nil {
+		return err
+	}
+	res.ExpirationTS = expirationTS
+	return nil
+}
+
+// QueryExpiringAccounts returns the accounts which are about to expire and whose users haven't been warned yet.
+func (a *UserInternalAPI) QueryExpiringAccounts(ctx context.Context, req *api.QueryExpiringAccountsRequest, res *api.QueryExpiringAccountsResponse) error {
+	var err error
+	res.Accounts, err = a.DB.GetAccountsExpiring(ctx, spec.AsTimestamp(time.Now()), req.Before)
+	return err
+}
+
+// PerformAccountExpiryNoticeSent records that the user was warned that their account is about to expire.
+func (a *UserInternalAPI) PerformAccountExpiryNoticeSent(ctx context.Context, req *api.PerformAccountExpiryNoticeSentRequest, res *struct{}) error {
+	return a.DB.SetAccountExpiryNoticeSent(ctx, req.Localpart, req.ServerName)
+}
+
 // PerformOpenIDTokenCreation creates a new token that a relying party uses to authenticate a user
 func (a *UserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, req *api.PerformOpenIDTokenCreationRequest, res *api.PerformOpenIDTokenCreationResponse) error {
 	token := util.RandomString(24)
@@ -923,7 +1055,20 @@ func (a *UserInternalAPI) QueryAccountAvailability(ctx context.Context, req *api
 }
 
 func (a *UserInternalAPI) QueryAccountByPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
-	acc, err := a.DB.GetAccountByPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
+	acc, err := a.queryAccountByExternalPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
+	if err != nil {
+		return err
+	}
+	if acc != nil {
+		res.Exists = true
+		res.Account = acc
+		return nil
+	}
+	if !a.Config.PasswordAuth.LocalDatabase {
+		return nil
+	}
+
+	acc, err = a.DB.GetAccountByPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
 	switch err {
 	case sql.ErrNoRows: // user does not exist
 		return nil
@@ -970,4 +1115,18 @@ func (a *UserInternalAPI) PerformSaveThreePIDAssociation(ctx context.Context, re
 	return a.DB.SaveThreePIDAssociation(ctx, req.ThreePID, req.Localpart, req.ServerName, req.Medium)
 }
 
+func (a *UserInternalAPI) QueryLocalpartForSSO(ctx context.Context, req *api.QueryLocalpartForSSORequest, res *api.QueryLocalpartForSSOResponse) error {
+	localpart, domain, err := a.DB.GetLocalpartForSSO(ctx, req.IDPID, req.Subject)
+	if err != nil {
+		return err
+	}
+	res.Localpart = localpart
+	res.ServerName = domain
+	return nil
+}
+
+func (a *UserInternalAPI) PerformSaveSSOAssociation(ctx context.Context, req *api.PerformSaveSSOAssociationRequest, res *struct{}) error {
+	return a.DB.SaveSSOAssociation(ctx, req.IDPID, req.Subject, req.Localpart, req.ServerName)
+}
+
 const pushRulesAccountDataType = "m.push_rules"
@@ -0,0 +1,232 @@
+package userapi_test
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapEntry is an entry in the directory of an ldapServer.
+type ldapEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapServer is an in-memory directory, which tests can authenticate against.
+// It supports simple binds and searches by connections which have bound, but
+// not StartTLS.
+type ldapServer struct {
+	uri      string
+	listener net.Listener
+	entries  []ldapEntry
+	wg       sync.WaitGroup
+}
+
+// newLDAPServer starts a server on a random local port, which is stopped when
+// the test finishes.
+func newLDAPServer(t *testing.T, entries ...ldapEntry) *ldapServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start LDAP server: %s", err)
+	}
+	s := &ldapServer{
+		uri:      "ldap://" + l.Addr().String(),
+		listener: l,
+		entries:  entries,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(func() {
+		_ = l.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+func (s *ldapServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close() // nolint: errcheck
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *ldapServer) handle(conn net.Conn) {
+	bound := false
+	for {
+		msg, err := ber.ReadPacket(conn)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id, op := msg.Children[0].Value, msg.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			bound = s.bind(op)
+			code := ldap.LDAPResultSuccess
+			if !bound {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			responses = append(responses, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if !bound {
+				responses = append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				break
+			}
+			responses = append(responses, s.search(op)...)
+			responses = append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationExtendedRequest:
+			responses = append(responses, ldapResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform))
+		default: // including unbind
+			return
+		}
+		for _, res := range responses {
+			packet := ber.NewSequence("")
+			packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+			packet.AppendChild(res)
+			if _, err = conn.Write(packet.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *ldapServer) bind(op *ber.Packet) bool {
+	if len(op.Children) != 3 {
+		return false
+	}
+	dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.dn, dn) {
+			return entry.password != "" && entry.password == password
+		}
+	}
+	return false
+}
+
+func (s *ldapServer) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) != 8 {
+		return nil
+	}
+	baseDN := strings.ToLower(op.Children[0].Data.String())
+	scope, _ := op.Children[1].Value.(int64)
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, a.Data.String())
+	}
+	var results []*ber.Packet
+	for _, entry := range s.entries {
+		if !inScope(strings.ToLower(entry.dn), baseDN, scope) || !matchesFilter(entry, op.Children[6]) {
+			continue
+		}
+		attrs := ber.NewSequence("")
+		for name, values := range entry.attributes {
+			if !wantAttribute(name, attributes) {
+				continue
+			}
+			attr := ber.NewSequence("")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range values {
+				vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+			}
+			attr.AppendChild(vals)
+			attrs.AppendChild(attr)
+		}
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+		result.AppendChild(attrs)
+		results = append(results, result)
+	}
+	return results
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return res
+}
+
+func inScope(dn, baseDN string, scope int64) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == baseDN
+	case ldap.ScopeSingleLevel:
+		rdn, ok := strings.CutSuffix(dn, ","+baseDN)
+		return ok && !strings.Contains(rdn, ",")
+	default:
+		return dn == baseDN || baseDN == "" || strings.HasSuffix(dn, ","+baseDN)
+	}
+}
+
+// matchesFilter supports the filters which are needed by the tests: and, or,
+// not, equality and presence.
+func matchesFilter(entry ldapEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, c := range filter.Children {
+			if !matchesFilter(entry, c) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range filter.Children {
+			if matchesFilter(entry, c) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !matchesFilter(entry, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		for _, v := range attributeValues(entry, filter.Children[0].Data.String()) {
+			if strings.EqualFold(v, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attributeValues(entry, filter.Data.String())) > 0
+	}
+	return false
+}
+
+func attributeValues(entry ldapEntry, attr string) []string {
+	for name, values := range entry.attributes {
+		if strings.EqualFold(name, attr) {
+			return values
+		}
+	}
+	return nil
+}
+
+func wantAttribute(name string, attributes []string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+	for _, a := range attributes {
+		if a == "*" || strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
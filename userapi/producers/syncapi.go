@@ -70,11 +70,16 @@ func (p *SyncAPI) GetAndSendNotificationData(ctx context.Context, userID, roomID
 	if err != nil {
 		return err
 	}
+	threads, err := p.db.GetRoomThreadNotificationCounts(ctx, localpart, domain, roomID)
+	if err != nil {
+		return err
+	}
 
 	return p.sendNotificationData(userID, &eventutil.NotificationData{
-		RoomID:                  roomID,
-		UnreadHighlightCount:    int(nhighlight),
-		UnreadNotificationCount: int(ntotal),
+		RoomID:                    roomID,
+		UnreadHighlightCount:      int(nhighlight),
+		UnreadNotificationCount:   int(ntotal),
+		UnreadThreadNotifications: threads,
 	})
 }
 
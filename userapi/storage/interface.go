@@ -9,7 +9,6 @@ package storage
 import (
 	"context"
 	"encoding/json"
-	"errors"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -17,8 +16,10 @@ import (
 
 	clientapi "github.com/ike20013/dendrite/clientapi/api"
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
+	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/external/pushrules"
 	"github.com/ike20013/dendrite/userapi/api"
+	"github.com/ike20013/dendrite/userapi/storage/shared"
 	"github.com/ike20013/dendrite/userapi/storage/tables"
 	"github.com/ike20013/dendrite/userapi/types"
 )
@@ -49,7 +50,25 @@ type Account interface {
 	CheckAccountAvailability(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*api.Account, error)
 	DeactivateAccount(ctx context.Context, localpart string, serverName spec.ServerName) (err error)
+	IsAccountDeactivated(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error)
+	// SetAccountShadowBanned sets whether the account is shadow-banned, in which case the events
+	// it sends are dropped by the client API.
+	SetAccountShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error
 	SetPassword(ctx context.Context, localpart string, serverName spec.ServerName, plaintextPassword string) error
+	// ReactivateAccount lets a deactivated account log in again.
+	ReactivateAccount(ctx context.Context, localpart string, serverName spec.ServerName) error
+	SetAccountType(ctx context.Context, localpart string, serverName spec.ServerName, accountType api.AccountType) error
+	// GetAccounts returns a page of the accounts matching the filter, and the total number of matching accounts.
+	GetAccounts(ctx context.Context, filter tables.AccountFilter) ([]api.AdminAccount, int64, error)
+	// SetAccountExpiry sets when the account expires, and that its user hasn't been warned about it yet.
+	SetAccountExpiry(ctx context.Context, localpart string, serverName spec.ServerName, expirationTS spec.Timestamp) error
+	// GetAccountExpiry returns when the account expires, or 0 if it doesn't.
+	GetAccountExpiry(ctx context.Context, localpart string, serverName spec.ServerName) (spec.Timestamp, error)
+	// SetMissingAccountExpiry sets when the active user accounts which don't expire yet, other than
+	// the one with the given localpart, expire. It returns the number of accounts which were updated.
+	SetMissingAccountExpiry(ctx context.Context, expirationTS spec.Timestamp, exceptLocalpart string) (int64, error)
+	GetAccountsExpiring(ctx context.Context, after, before spec.Timestamp) ([]api.AccountValidity, error)
+	SetAccountExpiryNoticeSent(ctx context.Context, localpart string, serverName spec.ServerName) error
 }
 
 type AccountData interface {
@@ -105,6 +124,18 @@ type LoginToken interface {
 	GetLoginTokenDataByToken(ctx context.Context, token string) (*api.LoginTokenData, error)
 }
 
+type RefreshToken interface {
+	// CreateRefreshToken generates a refresh token for the device with the given
+	// access token, which expires at the given time. Any previous refresh tokens
+	// of the device are removed.
+	CreateRefreshToken(ctx context.Context, localpart string, serverName spec.ServerName, deviceID, accessToken string, accessTokenExpiresTS spec.Timestamp) (string, error)
+
+	// RefreshAccessToken replaces the access token of the device the refresh
+	// token belongs to, and returns the next refresh token. The refresh token
+	// can only be used once. Returns sql.ErrNoRows if the refresh token is unknown.
+	RefreshAccessToken(ctx context.Context, refreshToken, newAccessToken string, accessTokenExpiresTS spec.Timestamp) (string, error)
+}
+
 type OpenID interface {
 	CreateOpenIDToken(ctx context.Context, token, userID string) (exp int64, err error)
 	GetOpenIDTokenAttributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
@@ -124,13 +155,22 @@ type ThreePID interface {
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (threepids []authtypes.ThreePID, err error)
 }
 
+type SSO interface {
+	SaveSSOAssociation(ctx context.Context, idpID, subject, localpart string, serverName spec.ServerName) (err error)
+	RemoveSSOAssociation(ctx context.Context, idpID, subject string) (err error)
+	GetLocalpartForSSO(ctx context.Context, idpID, subject string) (localpart string, serverName spec.ServerName, err error)
+}
+
 type Notification interface {
 	InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error
 	DeleteNotificationsUpTo(ctx context.Context, localpart string, serverName spec.ServerName, roomID string, pos uint64) (affected bool, err error)
-	SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID string, pos uint64, read bool) (affected bool, err error)
+	// SetNotificationsRead marks the notifications up to the position as read or unread. If the
+	// thread ID isn't empty, only the notifications in that thread are marked.
+	SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID, threadID string, pos uint64, read bool) (affected bool, err error)
 	GetNotifications(ctx context.Context, localpart string, serverName spec.ServerName, fromID int64, limit int, filter tables.NotificationFilter) ([]*api.Notification, int64, error)
 	GetNotificationCount(ctx context.Context, localpart string, serverName spec.ServerName, filter tables.NotificationFilter) (int64, error)
 	GetRoomNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (total int64, highlight int64, _ error)
+	GetRoomThreadNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (map[string]eventutil.ThreadNotificationData, error)
 	DeleteOldNotifications(ctx context.Context) error
 }
 
@@ -144,8 +184,10 @@ type UserDatabase interface {
 	OpenID
 	Profile
 	Pusher
+	RefreshToken
 	Statistics
 	ThreePID
+	SSO
 	RegistrationTokens
 }
 
@@ -238,4 +280,4 @@ type Statistics interface {
 
 // Err3PIDInUse is the error returned when trying to save an association involving
 // a third-party identifier which is already associated to a local user.
-var Err3PIDInUse = errors.New("this third-party identifier is already in use")
+var Err3PIDInUse = shared.Err3PIDInUse
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/ike20013/dendrite/clientapi/userutil"
+	"github.com/ike20013/dendrite/external"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/userapi/api"
 	"github.com/ike20013/dendrite/userapi/storage/postgres/deltas"
@@ -37,7 +38,9 @@ CREATE TABLE IF NOT EXISTS userapi_accounts (
     -- If the account is currently active
     is_deactivated BOOLEAN DEFAULT FALSE,
 	-- The account_type (user = 1, guest = 2, admin = 3, appservice = 4)
-	account_type SMALLINT NOT NULL
+	account_type SMALLINT NOT NULL,
+    -- Whether an admin has shadow-banned the account
+    is_shadow_banned BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO:
     -- upgraded_ts, devices, any email reset stuff?
 );
@@ -54,12 +57,44 @@ const updatePasswordSQL = "" +
 const deactivateAccountSQL = "" +
 	"UPDATE userapi_accounts SET is_deactivated = TRUE WHERE localpart = $1 AND server_name = $2"
 
+const updateAccountShadowBannedSQL = "" +
+	"UPDATE userapi_accounts SET is_shadow_banned = $1 WHERE localpart = $2 AND server_name = $3"
+
+const reactivateAccountSQL = "" +
+	"UPDATE userapi_accounts SET is_deactivated = FALSE WHERE localpart = $1 AND server_name = $2"
+
+const updateAccountTypeSQL = "" +
+	"UPDATE userapi_accounts SET account_type = $1 WHERE localpart = $2 AND server_name = $3"
+
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, server_name, appservice_id, account_type FROM userapi_accounts WHERE localpart = $1 AND server_name = $2"
+	"SELECT localpart, server_name, appservice_id, account_type, is_shadow_banned FROM userapi_accounts WHERE localpart = $1 AND server_name = $2"
 
 const selectPasswordHashSQL = "" +
 	"SELECT password_hash FROM userapi_accounts WHERE localpart = $1 AND server_name = $2 AND is_deactivated = FALSE"
 
+const selectAccountDeactivatedSQL = "" +
+	"SELECT is_deactivated FROM userapi_accounts WHERE localpart = $1 AND server_name = $2"
+
+// Filters the accounts by server name, localpart, a search term matching the localpart
+// or the display name, whether deactivated accounts are included and whether accounts
+// of the given type are included.
+const accountsFilterSQL = "" +
+	" FROM userapi_accounts a LEFT JOIN userapi_profiles p ON a.localpart = p.localpart AND a.server_name = p.server_name" +
+	" WHERE ($1 = '' OR a.server_name = $1)" +
+	" AND ($2 = '' OR a.localpart = $2)" +
+	" AND ($3 = '' OR a.localpart ILIKE $3 OR p.display_name ILIKE $3)" +
+	" AND ($4 OR a.is_deactivated = FALSE)" +
+	" AND ($5 OR a.account_type <> $6)"
+
+const selectAccountsSQL = "" +
+	"SELECT a.localpart, a.server_name, a.created_ts, a.appservice_id, a.account_type, a.is_deactivated, a.is_shadow_banned," +
+	" COALESCE(p.display_name, ''), COALESCE(p.avatar_url, '')" +
+	accountsFilterSQL +
+	" ORDER BY a.localpart, a.server_name LIMIT $7 OFFSET $8"
+
+const selectAccountsCountSQL = "" +
+	"SELECT COUNT(*)" + accountsFilterSQL
+
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT COALESCE(MAX(localpart::bigint), 0) FROM userapi_accounts WHERE localpart ~ '^[0-9]{1,}$' AND server_name = $1"
 
@@ -67,9 +102,15 @@ type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	updatePasswordStmt            *sql.Stmt
 	deactivateAccountStmt         *sql.Stmt
+	updateAccountShadowBannedStmt *sql.Stmt
+	reactivateAccountStmt         *sql.Stmt
+	updateAccountTypeStmt         *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
+	selectAccountDeactivatedStmt  *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
+	selectAccountsStmt            *sql.Stmt
+	selectAccountsCountStmt       *sql.Stmt
 	serverName                    spec.ServerName
 }
 
@@ -93,6 +134,10 @@ func NewPostgresAccountsTable(db *sql.DB, serverName spec.ServerName) (tables.Ac
 			Up:      deltas.UpAddAccountType,
 			Down:    deltas.DownAddAccountType,
 		},
+		{
+			Version: "userapi: add is_shadow_banned (accounts)",
+			Up:      deltas.UpAddShadowBanned,
+		},
 	}...)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -102,9 +147,15 @@ func NewPostgresAccountsTable(db *sql.DB, serverName spec.ServerName) (tables.Ac
 		{&s.insertAccountStmt, insertAccountSQL},
 		{&s.updatePasswordStmt, updatePasswordSQL},
 		{&s.deactivateAccountStmt, deactivateAccountSQL},
+		{&s.updateAccountShadowBannedStmt, updateAccountShadowBannedSQL},
+		{&s.reactivateAccountStmt, reactivateAccountSQL},
+		{&s.updateAccountTypeStmt, updateAccountTypeSQL},
 		{&s.selectAccountByLocalpartStmt, selectAccountByLocalpartSQL},
 		{&s.selectPasswordHashStmt, selectPasswordHashSQL},
+		{&s.selectAccountDeactivatedStmt, selectAccountDeactivatedSQL},
 		{&s.selectNewNumericLocalpartStmt, selectNewNumericLocalpartSQL},
+		{&s.selectAccountsStmt, selectAccountsSQL},
+		{&s.selectAccountsCountStmt, selectAccountsCountSQL},
 	}.Prepare(db)
 }
 
@@ -153,6 +204,27 @@ func (s *accountsStatements) DeactivateAccount(
 	return
 }
 
+func (s *accountsStatements) UpdateAccountShadowBanned(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, shadowBanned bool,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.updateAccountShadowBannedStmt).ExecContext(ctx, shadowBanned, localpart, serverName)
+	return
+}
+
+func (s *accountsStatements) ReactivateAccount(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.reactivateAccountStmt).ExecContext(ctx, localpart, serverName)
+	return
+}
+
+func (s *accountsStatements) UpdateAccountType(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, accountType api.AccountType,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.updateAccountTypeStmt).ExecContext(ctx, accountType, localpart, serverName)
+	return
+}
+
 func (s *accountsStatements) SelectPasswordHash(
 	ctx context.Context, localpart string, serverName spec.ServerName,
 ) (hash string, err error) {
@@ -160,6 +232,13 @@ func (s *accountsStatements) SelectPasswordHash(
 	return
 }
 
+func (s *accountsStatements) SelectAccountDeactivated(
+	ctx context.Context, localpart string, serverName spec.ServerName,
+) (deactivated bool, err error) {
+	err = s.selectAccountDeactivatedStmt.QueryRowContext(ctx, localpart, serverName).Scan(&deactivated)
+	return
+}
+
 func (s *accountsStatements) SelectAccountByLocalpart(
 	ctx context.Context, localpart string, serverName spec.ServerName,
 ) (*api.Account, error) {
@@ -167,7 +246,7 @@ func (s *accountsStatements) SelectAccountByLocalpart(
 	var acc api.Account
 
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart, serverName).Scan(&acc.Localpart, &acc.ServerName, &appserviceIDPtr, &acc.AccountType)
+	err := stmt.QueryRowContext(ctx, localpart, serverName).Scan(&acc.Localpart, &acc.ServerName, &appserviceIDPtr, &acc.AccountType, &acc.ShadowBanned)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
@@ -192,3 +271,38 @@ func (s *accountsStatements) SelectNewNumericLocalpart(
 	err = stmt.QueryRowContext(ctx, serverName).Scan(&id)
 	return id + 1, err
 }
+
+func (s *accountsStatements) SelectAccounts(
+	ctx context.Context, txn *sql.Tx, filter tables.AccountFilter,
+) (accounts []api.AdminAccount, total int64, err error) {
+	search := ""
+	if filter.Search != "" {
+		search = "%" + filter.Search + "%"
+	}
+	params := []interface{}{
+		filter.ServerName, filter.Localpart, search,
+		filter.IncludeDeactivated, filter.IncludeGuests, api.AccountTypeGuest,
+	}
+	if err = sqlutil.TxStmt(txn, s.selectAccountsCountStmt).QueryRowContext(ctx, params...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := sqlutil.TxStmt(txn, s.selectAccountsStmt).QueryContext(ctx, append(params, filter.Limit, filter.From)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectAccounts: rows.close() failed")
+	for rows.Next() {
+		var acc api.AdminAccount
+		var appserviceID sql.NullString
+		if err = rows.Scan(
+			&acc.Localpart, &acc.ServerName, &acc.CreatedTS, &appserviceID, &acc.AccountType,
+			&acc.Deactivated, &acc.ShadowBanned, &acc.DisplayName, &acc.AvatarURL,
+		); err != nil {
+			return nil, 0, err
+		}
+		acc.AppServiceID = appserviceID.String
+		acc.UserID = userutil.MakeUserID(acc.Localpart, acc.ServerName)
+		accounts = append(accounts, acc)
+	}
+	return accounts, total, rows.Err()
+}
@@ -49,6 +49,11 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresRegistrationsTokenTable: %w", err)
 	}
+	// The accounts table queries join the profiles table, so it must exist first.
+	profilesTable, err := NewPostgresProfilesTable(db, serverNoticesLocalpart)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresProfilesTable: %w", err)
+	}
 	accountsTable, err := NewPostgresAccountsTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresAccountsTable: %w", err)
@@ -57,6 +62,12 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresAccountDataTable: %w", err)
 	}
+	// The refresh tokens table must exist before the devices table, which
+	// looks up when access tokens expire in it.
+	refreshTokensTable, err := NewPostgresRefreshTokensTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresRefreshTokensTable: %w", err)
+	}
 	devicesTable, err := NewPostgresDevicesTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresDevicesTable: %w", err)
@@ -77,14 +88,18 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresOpenIDTable: %w", err)
 	}
-	profilesTable, err := NewPostgresProfilesTable(db, serverNoticesLocalpart)
-	if err != nil {
-		return nil, fmt.Errorf("NewPostgresProfilesTable: %w", err)
-	}
 	threePIDTable, err := NewPostgresThreePIDTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresThreePIDTable: %w", err)
 	}
+	accountValidityTable, err := NewPostgresAccountValidityTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresAccountValidityTable: %w", err)
+	}
+	ssoTable, err := NewPostgresSSOTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresSSOTable: %w", err)
+	}
 	pusherTable, err := NewPostgresPusherTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresPusherTable: %w", err)
@@ -116,9 +131,12 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		KeyBackups:            keyBackupTable,
 		KeyBackupVersions:     keyBackupVersionTable,
 		LoginTokens:           loginTokenTable,
+		RefreshTokens:         refreshTokensTable,
 		OpenIDTokens:          openIDTable,
 		Profiles:              profilesTable,
 		ThreePIDs:             threePIDTable,
+		SSOAssociations:       ssoTable,
+		AccountValidity:       accountValidityTable,
 		Pushers:               pusherTable,
 		Notifications:         notificationsTable,
 		RegistrationTokens:    registationTokensTable,
@@ -25,6 +25,7 @@ import (
 
 	clientapi "github.com/ike20013/dendrite/clientapi/api"
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
+	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/external/pushrules"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/userapi/api"
@@ -41,11 +42,14 @@ type Database struct {
 	Profiles              tables.ProfileTable
 	AccountDatas          tables.AccountDataTable
 	ThreePIDs             tables.ThreePIDTable
+	SSOAssociations       tables.SSOTable
+	AccountValidity       tables.AccountValidityTable
 	OpenIDTokens          tables.OpenIDTable
 	KeyBackups            tables.KeyBackupTable
 	KeyBackupVersions     tables.KeyBackupVersionTable
 	Devices               tables.DevicesTable
 	LoginTokens           tables.LoginTokenTable
+	RefreshTokens         tables.RefreshTokensTable
 	Notifications         tables.NotificationTable
 	Pushers               tables.PusherTable
 	Stats                 tables.StatsTable
@@ -386,6 +390,52 @@ func (d *Database) GetThreePIDsForLocalpart(
 	return d.ThreePIDs.SelectThreePIDsForLocalpart(ctx, localpart, serverName)
 }
 
+// ErrSSOInUse is the error returned when trying to save an association involving
+// an account at an identity provider which is already associated to a local user.
+var ErrSSOInUse = errors.New("this identity provider account is already in use")
+
+// SaveSSOAssociation saves the association between an account at a single sign-on
+// identity provider and a local Matrix user.
+// If the identity provider account is already part of an association, returns ErrSSOInUse.
+// Returns an error if there was a problem talking to the database.
+func (d *Database) SaveSSOAssociation(
+	ctx context.Context, idpID, subject string,
+	localpart string, serverName spec.ServerName,
+) (err error) {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		user, _, err := d.SSOAssociations.SelectLocalpartForSSO(ctx, txn, idpID, subject)
+		if err != nil {
+			return err
+		}
+
+		if len(user) > 0 {
+			return ErrSSOInUse
+		}
+
+		return d.SSOAssociations.InsertSSOAssociation(ctx, txn, idpID, subject, localpart, serverName)
+	})
+}
+
+// RemoveSSOAssociation removes the association involving the given account at an
+// identity provider.
+// If no such association exists, returns nothing.
+func (d *Database) RemoveSSOAssociation(
+	ctx context.Context, idpID, subject string,
+) (err error) {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.SSOAssociations.DeleteSSOAssociation(ctx, txn, idpID, subject)
+	})
+}
+
+// GetLocalpartForSSO looks up the localpart associated with the given account at
+// an identity provider.
+// If no association involves the account, returns an empty string.
+func (d *Database) GetLocalpartForSSO(
+	ctx context.Context, idpID, subject string,
+) (localpart string, serverName spec.ServerName, err error) {
+	return d.SSOAssociations.SelectLocalpartForSSO(ctx, nil, idpID, subject)
+}
+
 // CheckAccountAvailability checks if the username/localpart is already present
 // in the database.
 // If the DB returns sql.ErrNoRows the Localpart isn't taken.
@@ -424,6 +474,74 @@ func (d *Database) DeactivateAccount(ctx context.Context, localpart string, serv
 	})
 }
 
+// SetAccountShadowBanned sets whether the account is shadow-banned.
+func (d *Database) SetAccountShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Accounts.UpdateAccountShadowBanned(ctx, txn, localpart, serverName, shadowBanned)
+	})
+}
+
+// ReactivateAccount lets a deactivated account log in again.
+func (d *Database) ReactivateAccount(ctx context.Context, localpart string, serverName spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Accounts.ReactivateAccount(ctx, txn, localpart, serverName)
+	})
+}
+
+// SetAccountType changes the type of the account, e.g. to make it an admin.
+func (d *Database) SetAccountType(ctx context.Context, localpart string, serverName spec.ServerName, accountType api.AccountType) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Accounts.UpdateAccountType(ctx, txn, localpart, serverName, accountType)
+	})
+}
+
+// GetAccounts returns a page of the accounts matching the filter, and the total number of matching accounts.
+func (d *Database) GetAccounts(ctx context.Context, filter tables.AccountFilter) ([]api.AdminAccount, int64, error) {
+	return d.Accounts.SelectAccounts(ctx, nil, filter)
+}
+
+// SetAccountExpiry sets when the account expires. Its user will be warned again
+// before the new expiry.
+func (d *Database) SetAccountExpiry(ctx context.Context, localpart string, serverName spec.ServerName, expirationTS spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.AccountValidity.UpsertAccountValidity(ctx, txn, localpart, serverName, expirationTS)
+	})
+}
+
+// GetAccountExpiry returns when the account expires, or 0 if it doesn't.
+func (d *Database) GetAccountExpiry(ctx context.Context, localpart string, serverName spec.ServerName) (spec.Timestamp, error) {
+	return d.AccountValidity.SelectAccountValidity(ctx, nil, localpart, serverName)
+}
+
+// SetMissingAccountExpiry sets when the active user accounts which don't expire
+// yet, such as those created before accounts started to expire, expire.
+func (d *Database) SetMissingAccountExpiry(ctx context.Context, expirationTS spec.Timestamp, exceptLocalpart string) (count int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		count, err = d.AccountValidity.InsertMissingAccountValidity(ctx, txn, expirationTS, exceptLocalpart)
+		return err
+	})
+	return
+}
+
+// GetAccountsExpiring returns the accounts expiring in the time range whose users
+// haven't been warned about it yet.
+func (d *Database) GetAccountsExpiring(ctx context.Context, after, before spec.Timestamp) ([]api.AccountValidity, error) {
+	return d.AccountValidity.SelectAccountsExpiring(ctx, nil, after, before)
+}
+
+// SetAccountExpiryNoticeSent records that the user was warned that the account is about to expire.
+func (d *Database) SetAccountExpiryNoticeSent(ctx context.Context, localpart string, serverName spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.AccountValidity.UpdateAccountValidityNoticeSent(ctx, txn, localpart, serverName)
+	})
+}
+
+// IsAccountDeactivated returns whether the account has been deactivated.
+// Returns sql.ErrNoRows if no account exists which matches the given localpart.
+func (d *Database) IsAccountDeactivated(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error) {
+	return d.Accounts.SelectAccountDeactivated(ctx, localpart, serverName)
+}
+
 // CreateOpenIDToken persists a new token that was issued for OpenID Connect
 func (d *Database) CreateOpenIDToken(
 	ctx context.Context,
@@ -652,6 +770,9 @@ func (d *Database) CreateDevice(
 				if err = d.Devices.DeleteDevice(ctx, txn, *deviceID, localpart, serverName); err != nil {
 					return err
 				}
+				if err = d.RefreshTokens.DeleteRefreshTokensForDevice(ctx, txn, localpart, serverName, *deviceID); err != nil {
+					return err
+				}
 				// Create a new device with the session ID incremented
 				dev, err = d.Devices.InsertDeviceWithSessionID(ctx, txn, *deviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent, sessionID)
 				return err
@@ -663,6 +784,9 @@ func (d *Database) CreateDevice(
 				if err = d.Devices.DeleteDevice(ctx, txn, *deviceID, localpart, serverName); err != nil {
 					return err
 				}
+				if err = d.RefreshTokens.DeleteRefreshTokensForDevice(ctx, txn, localpart, serverName, *deviceID); err != nil {
+					return err
+				}
 
 				dev, err = d.Devices.InsertDevice(ctx, txn, *deviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent)
 				return err
@@ -725,9 +849,14 @@ func (d *Database) RemoveDevices(
 	devices []string,
 ) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != nil && err != sql.ErrNoRows {
 			return err
 		}
+		for _, deviceID := range devices {
+			if err := d.RefreshTokens.DeleteRefreshTokensForDevice(ctx, txn, localpart, serverName, deviceID); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
@@ -745,9 +874,14 @@ func (d *Database) RemoveAllDevices(
 		if err != nil {
 			return err
 		}
-		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != nil && err != sql.ErrNoRows {
 			return err
 		}
+		for i := range devices {
+			if err := d.RefreshTokens.DeleteRefreshTokensForDevice(ctx, txn, localpart, serverName, devices[i].ID); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	return
@@ -804,6 +938,63 @@ func (d *Database) GetLoginTokenDataByToken(ctx context.Context, token string) (
 	return d.LoginTokens.SelectLoginToken(ctx, token)
 }
 
+// CreateRefreshToken generates a refresh token for the device with the given
+// access token, which expires at the given time. Any previous refresh tokens of
+// the device are removed.
+func (d *Database) CreateRefreshToken(
+	ctx context.Context, localpart string, serverName spec.ServerName,
+	deviceID, accessToken string, accessTokenExpiresTS spec.Timestamp,
+) (string, error) {
+	refreshToken, err := generateLoginToken()
+	if err != nil {
+		return "", err
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.RefreshTokens.DeleteRefreshTokensForDevice(ctx, txn, localpart, serverName, deviceID); err != nil {
+			return err
+		}
+		return d.RefreshTokens.InsertRefreshToken(ctx, txn, refreshToken, accessToken, localpart, serverName, deviceID, accessTokenExpiresTS)
+	})
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// RefreshAccessToken replaces the access token of the device the refresh token
+// belongs to, and returns the next refresh token. The refresh token can only be
+// used once. Returns sql.ErrNoRows if the refresh token is unknown.
+func (d *Database) RefreshAccessToken(
+	ctx context.Context, refreshToken, newAccessToken string, accessTokenExpiresTS spec.Timestamp,
+) (string, error) {
+	newRefreshToken, err := generateLoginToken()
+	if err != nil {
+		return "", err
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		accessToken, localpart, serverName, deviceID, err := d.RefreshTokens.SelectRefreshToken(ctx, txn, refreshToken)
+		if err != nil {
+			return err
+		}
+		if err = d.RefreshTokens.DeleteRefreshToken(ctx, txn, refreshToken); err != nil {
+			return err
+		}
+		updated, err := d.Devices.UpdateDeviceAccessToken(ctx, txn, accessToken, newAccessToken)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			// The device has logged out since the refresh token was issued.
+			return sql.ErrNoRows
+		}
+		return d.RefreshTokens.InsertRefreshToken(ctx, txn, newRefreshToken, newAccessToken, localpart, serverName, deviceID, accessTokenExpiresTS)
+	})
+	if err != nil {
+		return "", err
+	}
+	return newRefreshToken, nil
+}
+
 func (d *Database) InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.Notifications.Insert(ctx, txn, localpart, serverName, eventID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
@@ -818,9 +1009,9 @@ func (d *Database) DeleteNotificationsUpTo(ctx context.Context, localpart string
 	return
 }
 
-func (d *Database) SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID string, pos uint64, b bool) (affected bool, err error) {
+func (d *Database) SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID, threadID string, pos uint64, b bool) (affected bool, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, serverName, roomID, pos, b)
+		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, serverName, roomID, threadID, pos, b)
 		return err
 	})
 	return
@@ -838,6 +1029,10 @@ func (d *Database) GetRoomNotificationCounts(ctx context.Context, localpart stri
 	return d.Notifications.SelectRoomCounts(ctx, nil, localpart, serverName, roomID)
 }
 
+func (d *Database) GetRoomThreadNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (map[string]eventutil.ThreadNotificationData, error) {
+	return d.Notifications.SelectRoomThreadCounts(ctx, nil, localpart, serverName, roomID)
+}
+
 func (d *Database) DeleteOldNotifications(ctx context.Context) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.Notifications.Clean(ctx, txn)
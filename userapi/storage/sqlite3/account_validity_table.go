@@ -0,0 +1,138 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ike20013/dendrite/external"
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/userapi/api"
+	"github.com/ike20013/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const accountValiditySchema = `
+-- Stores when local accounts expire
+CREATE TABLE IF NOT EXISTS userapi_account_validity (
+	-- The localpart of the Matrix user ID associated to this account
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	-- When the account expires, in milliseconds since the epoch
+	expiration_ts BIGINT NOT NULL,
+	-- Whether the user has been warned that the account is about to expire
+	notice_sent BOOLEAN NOT NULL DEFAULT 0,
+
+	PRIMARY KEY(localpart, server_name)
+);
+
+CREATE INDEX IF NOT EXISTS userapi_account_validity_expiration_ts_idx ON userapi_account_validity(expiration_ts);
+`
+
+const upsertAccountValiditySQL = "" +
+	"INSERT INTO userapi_account_validity (localpart, server_name, expiration_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart, server_name) DO UPDATE SET expiration_ts = $3, notice_sent = 0"
+
+const selectAccountValiditySQL = "" +
+	"SELECT expiration_ts FROM userapi_account_validity WHERE localpart = $1 AND server_name = $2"
+
+const selectAccountsExpiringSQL = "" +
+	"SELECT localpart, server_name, expiration_ts FROM userapi_account_validity" +
+	" WHERE notice_sent = 0 AND expiration_ts > $1 AND expiration_ts <= $2" +
+	" ORDER BY expiration_ts ASC"
+
+// Accounts of appservices and admins (account_type 3) never expire.
+const insertMissingAccountValiditySQL = "" +
+	"INSERT INTO userapi_account_validity (localpart, server_name, expiration_ts)" +
+	" SELECT localpart, server_name, $1 FROM userapi_accounts" +
+	" WHERE (appservice_id IS NULL OR appservice_id = '') AND account_type != 3 AND is_deactivated = 0 AND localpart != $2" +
+	" ON CONFLICT (localpart, server_name) DO NOTHING"
+
+const updateAccountValidityNoticeSentSQL = "" +
+	"UPDATE userapi_account_validity SET notice_sent = 1 WHERE localpart = $1 AND server_name = $2"
+
+type accountValidityStatements struct {
+	upsertAccountValidityStmt           *sql.Stmt
+	selectAccountValidityStmt           *sql.Stmt
+	selectAccountsExpiringStmt          *sql.Stmt
+	insertMissingAccountValidityStmt    *sql.Stmt
+	updateAccountValidityNoticeSentStmt *sql.Stmt
+}
+
+func NewSQLiteAccountValidityTable(db *sql.DB) (tables.AccountValidityTable, error) {
+	s := &accountValidityStatements{}
+	_, err := db.Exec(accountValiditySchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertAccountValidityStmt, upsertAccountValiditySQL},
+		{&s.selectAccountValidityStmt, selectAccountValiditySQL},
+		{&s.selectAccountsExpiringStmt, selectAccountsExpiringSQL},
+		{&s.insertMissingAccountValidityStmt, insertMissingAccountValiditySQL},
+		{&s.updateAccountValidityNoticeSentStmt, updateAccountValidityNoticeSentSQL},
+	}.Prepare(db)
+}
+
+func (s *accountValidityStatements) UpsertAccountValidity(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, expirationTS spec.Timestamp,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertAccountValidityStmt)
+	_, err = stmt.ExecContext(ctx, localpart, serverName, expirationTS)
+	return
+}
+
+func (s *accountValidityStatements) SelectAccountValidity(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) (expirationTS spec.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAccountValidityStmt)
+	err = stmt.QueryRowContext(ctx, localpart, serverName).Scan(&expirationTS)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+func (s *accountValidityStatements) SelectAccountsExpiring(
+	ctx context.Context, txn *sql.Tx, after, before spec.Timestamp,
+) ([]api.AccountValidity, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAccountsExpiringStmt)
+	rows, err := stmt.QueryContext(ctx, after, before)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "SelectAccountsExpiring: rows.close() failed")
+
+	var accounts []api.AccountValidity
+	for rows.Next() {
+		var account api.AccountValidity
+		if err = rows.Scan(&account.Localpart, &account.ServerName, &account.ExpirationTS); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *accountValidityStatements) InsertMissingAccountValidity(
+	ctx context.Context, txn *sql.Tx, expirationTS spec.Timestamp, exceptLocalpart string,
+) (int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.insertMissingAccountValidityStmt)
+	res, err := stmt.ExecContext(ctx, expirationTS, exceptLocalpart)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *accountValidityStatements) UpdateAccountValidityNoticeSent(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.updateAccountValidityNoticeSentStmt)
+	_, err = stmt.ExecContext(ctx, localpart, serverName)
+	return
+}
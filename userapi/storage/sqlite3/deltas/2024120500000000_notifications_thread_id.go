@@ -0,0 +1,26 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddNotificationsThreadID records which thread a notification is in, so that
+// threads can be marked as read separately.
+func UpAddNotificationsThreadID(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists", so check whether the column is there already.
+	if _, err := tx.ExecContext(ctx, "SELECT thread_id FROM userapi_notifications LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_notifications ADD COLUMN thread_id TEXT NOT NULL DEFAULT 'main';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
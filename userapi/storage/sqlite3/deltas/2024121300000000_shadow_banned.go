@@ -0,0 +1,25 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddShadowBanned adds a flag to accounts which are shadow-banned by an admin.
+func UpAddShadowBanned(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists", so check whether the column is there already.
+	if _, err := tx.ExecContext(ctx, "SELECT is_shadow_banned FROM userapi_accounts LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_accounts ADD COLUMN is_shadow_banned BOOLEAN NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
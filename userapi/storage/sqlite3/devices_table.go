@@ -50,8 +50,11 @@ const insertDeviceSQL = "" +
 const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM userapi_devices"
 
+// The access token only expires if it can be refreshed.
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices WHERE access_token = $1"
+	"SELECT d.session_id, d.device_id, d.localpart, d.server_name, COALESCE(r.access_token_expires_ts, 0)" +
+	" FROM userapi_devices d LEFT JOIN userapi_refresh_tokens r ON r.access_token = d.access_token" +
+	" WHERE d.access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name, last_seen_ts, ip FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
@@ -77,6 +80,9 @@ const selectDevicesByIDSQL = "" +
 const updateDeviceLastSeen = "" +
 	"UPDATE userapi_devices SET last_seen_ts = $1, ip = $2, user_agent = $3 WHERE localpart = $4 AND server_name = $5 AND device_id = $6"
 
+const updateDeviceAccessTokenSQL = "" +
+	"UPDATE userapi_devices SET access_token = $1 WHERE access_token = $2"
+
 type devicesStatements struct {
 	db                           *sql.DB
 	insertDeviceStmt             *sql.Stmt
@@ -87,6 +93,7 @@ type devicesStatements struct {
 	selectDevicesByLocalpartStmt *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
 	updateDeviceLastSeenStmt     *sql.Stmt
+	updateDeviceAccessTokenStmt  *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	serverName                   spec.ServerName
@@ -121,6 +128,7 @@ func NewSQLiteDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.Devic
 		{&s.deleteDevicesByLocalpartStmt, deleteDevicesByLocalpartSQL},
 		{&s.selectDevicesByIDStmt, selectDevicesByIDSQL},
 		{&s.updateDeviceLastSeenStmt, updateDeviceLastSeen},
+		{&s.updateDeviceAccessTokenStmt, updateDeviceAccessTokenSQL},
 	}.Prepare(db)
 }
 
@@ -241,7 +249,7 @@ func (s *devicesStatements) SelectDeviceByToken(
 	var localpart string
 	var serverName spec.ServerName
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName, &dev.AccessTokenExpiresTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, serverName)
 		dev.AccessToken = accessToken
@@ -361,3 +369,15 @@ func (s *devicesStatements) UpdateDeviceLastSeen(ctx context.Context, txn *sql.T
 	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, userAgent, localpart, serverName, deviceID)
 	return err
 }
+
+// UpdateDeviceAccessToken replaces the access token of a device. Returns false
+// if there is no device with the old access token.
+func (s *devicesStatements) UpdateDeviceAccessToken(ctx context.Context, txn *sql.Tx, oldAccessToken, newAccessToken string) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceAccessTokenStmt)
+	res, err := stmt.ExecContext(ctx, newAccessToken, oldAccessToken)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
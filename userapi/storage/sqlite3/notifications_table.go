@@ -15,20 +15,23 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ike20013/dendrite/external"
+	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/external/sqlutil"
 	"github.com/ike20013/dendrite/userapi/api"
+	"github.com/ike20013/dendrite/userapi/storage/sqlite3/deltas"
 	"github.com/ike20013/dendrite/userapi/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 type notificationsStatements struct {
-	insertStmt             *sql.Stmt
-	deleteUpToStmt         *sql.Stmt
-	updateReadStmt         *sql.Stmt
-	selectStmt             *sql.Stmt
-	selectCountStmt        *sql.Stmt
-	selectRoomCountsStmt   *sql.Stmt
-	cleanNotificationsStmt *sql.Stmt
+	insertStmt                 *sql.Stmt
+	deleteUpToStmt             *sql.Stmt
+	updateReadStmt             *sql.Stmt
+	selectStmt                 *sql.Stmt
+	selectCountStmt            *sql.Stmt
+	selectRoomCountsStmt       *sql.Stmt
+	selectRoomThreadCountsStmt *sql.Stmt
+	cleanNotificationsStmt     *sql.Stmt
 }
 
 const notificationSchema = `
@@ -42,7 +45,9 @@ CREATE TABLE IF NOT EXISTS userapi_notifications (
     ts_ms BIGINT NOT NULL,
     highlight BOOLEAN NOT NULL,
     notification_json TEXT NOT NULL,
-    read BOOLEAN NOT NULL DEFAULT FALSE
+    read BOOLEAN NOT NULL DEFAULT FALSE,
+	-- The root of the thread the event is in, or 'main' if it isn't in one.
+	thread_id TEXT NOT NULL DEFAULT 'main'
 );
 
 CREATE INDEX IF NOT EXISTS userapi_notification_localpart_room_id_event_id_idx ON userapi_notifications(localpart, server_name, room_id, event_id);
@@ -51,13 +56,14 @@ CREATE INDEX IF NOT EXISTS userapi_notification_localpart_id_idx ON userapi_noti
 `
 
 const insertNotificationSQL = "" +
-	"INSERT INTO userapi_notifications (localpart, server_name, room_id, event_id, stream_pos, ts_ms, highlight, notification_json) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	"INSERT INTO userapi_notifications (localpart, server_name, room_id, event_id, stream_pos, ts_ms, highlight, notification_json, thread_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
 
 const deleteNotificationsUpToSQL = "" +
 	"DELETE FROM userapi_notifications WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND stream_pos <= $4"
 
 const updateNotificationReadSQL = "" +
-	"UPDATE userapi_notifications SET read = $1 WHERE localpart = $2 AND server_name = $3 AND room_id = $4 AND stream_pos <= $5 AND read <> $1"
+	"UPDATE userapi_notifications SET read = $1 WHERE localpart = $2 AND server_name = $3 AND room_id = $4 AND stream_pos <= $5 AND read <> $1" +
+	" AND ($6 = '' OR thread_id = $6)"
 
 const selectNotificationSQL = "" +
 	"SELECT id, room_id, ts_ms, read, notification_json FROM userapi_notifications WHERE localpart = $1 AND server_name = $2 AND id > $3 AND (" +
@@ -73,6 +79,11 @@ const selectRoomNotificationCountsSQL = "" +
 	"SELECT COUNT(*), COUNT(*) FILTER (WHERE highlight) FROM userapi_notifications " +
 	"WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND NOT read"
 
+const selectRoomThreadNotificationCountsSQL = "" +
+	"SELECT thread_id, COUNT(*), COUNT(*) FILTER (WHERE highlight) FROM userapi_notifications " +
+	"WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND NOT read AND thread_id <> 'main' " +
+	"GROUP BY thread_id"
+
 const cleanNotificationsSQL = "" +
 	"DELETE FROM userapi_notifications WHERE" +
 	" (highlight = FALSE AND ts_ms < $1) OR (highlight = TRUE AND ts_ms < $2)"
@@ -83,6 +94,14 @@ func NewSQLiteNotificationTable(db *sql.DB) (tables.NotificationTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add thread_id to notifications",
+		Up:      deltas.UpAddNotificationsThreadID,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertStmt, insertNotificationSQL},
 		{&s.deleteUpToStmt, deleteNotificationsUpToSQL},
@@ -90,6 +109,7 @@ func NewSQLiteNotificationTable(db *sql.DB) (tables.NotificationTable, error) {
 		{&s.selectStmt, selectNotificationSQL},
 		{&s.selectCountStmt, selectNotificationCountSQL},
 		{&s.selectRoomCountsStmt, selectRoomNotificationCountsSQL},
+		{&s.selectRoomThreadCountsStmt, selectRoomThreadNotificationCountsSQL},
 		{&s.cleanNotificationsStmt, cleanNotificationsSQL},
 	}.Prepare(db)
 }
@@ -105,7 +125,10 @@ func (s *notificationsStatements) Clean(ctx context.Context, txn *sql.Tx) error
 
 // Insert inserts a notification into the database.
 func (s *notificationsStatements) Insert(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, eventID string, pos uint64, highlight bool, n *api.Notification) error {
-	roomID, tsMS := n.RoomID, n.TS
+	roomID, tsMS, threadID := n.RoomID, n.TS, n.ThreadID
+	if threadID == "" {
+		threadID = "main"
+	}
 	nn := *n
 	// Clears out fields that have their own columns to (1) shrink the
 	// data and (2) avoid difficult-to-debug inconsistency bugs.
@@ -115,7 +138,7 @@ func (s *notificationsStatements) Insert(ctx context.Context, txn *sql.Tx, local
 	if err != nil {
 		return err
 	}
-	_, err = sqlutil.TxStmt(txn, s.insertStmt).ExecContext(ctx, localpart, serverName, roomID, eventID, pos, tsMS, highlight, string(bs))
+	_, err = sqlutil.TxStmt(txn, s.insertStmt).ExecContext(ctx, localpart, serverName, roomID, eventID, pos, tsMS, highlight, string(bs), threadID)
 	return err
 }
 
@@ -133,9 +156,10 @@ func (s *notificationsStatements) DeleteUpTo(ctx context.Context, txn *sql.Tx, l
 	return nrows > 0, nil
 }
 
-// UpdateRead updates the "read" value for an event.
-func (s *notificationsStatements) UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64, v bool) (affected bool, _ error) {
-	res, err := sqlutil.TxStmt(txn, s.updateReadStmt).ExecContext(ctx, v, localpart, serverName, roomID, pos)
+// UpdateRead updates the "read" value for an event. If the thread ID isn't empty,
+// only notifications in that thread are updated.
+func (s *notificationsStatements) UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID, threadID string, pos uint64, v bool) (affected bool, _ error) {
+	res, err := sqlutil.TxStmt(txn, s.updateReadStmt).ExecContext(ctx, v, localpart, serverName, roomID, pos, threadID)
 	if err != nil {
 		return false, err
 	}
@@ -199,3 +223,21 @@ func (s *notificationsStatements) SelectRoomCounts(ctx context.Context, txn *sql
 	err = sqlutil.TxStmt(txn, s.selectRoomCountsStmt).QueryRowContext(ctx, localpart, serverName, roomID).Scan(&total, &highlight)
 	return
 }
+
+func (s *notificationsStatements) SelectRoomThreadCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (map[string]eventutil.ThreadNotificationData, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomThreadCountsStmt).QueryContext(ctx, localpart, serverName, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer external.CloseAndLogIfError(ctx, rows, "notifications.SelectRoomThreadCounts: rows.Close() failed")
+	counts := map[string]eventutil.ThreadNotificationData{}
+	for rows.Next() {
+		var threadID string
+		var data eventutil.ThreadNotificationData
+		if err = rows.Scan(&threadID, &data.UnreadNotificationCount, &data.UnreadHighlightCount); err != nil {
+			return nil, err
+		}
+		counts[threadID] = data
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const refreshTokensSchema = `
+-- Stores the refresh tokens of devices. The access token of a device with a
+-- refresh token expires, after which the device has to refresh it.
+CREATE TABLE IF NOT EXISTS userapi_refresh_tokens (
+	-- The random value of the refresh token
+	refresh_token TEXT NOT NULL PRIMARY KEY,
+	-- The access token which is replaced when using the refresh token
+	access_token TEXT NOT NULL,
+	-- The device the tokens belong to
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	-- When the access token expires, as a unix timestamp (ms resolution)
+	access_token_expires_ts BIGINT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_refresh_tokens_access_token_idx ON userapi_refresh_tokens(access_token);
+CREATE INDEX IF NOT EXISTS userapi_refresh_tokens_device_idx ON userapi_refresh_tokens(localpart, server_name, device_id);
+`
+
+const insertRefreshTokenSQL = "" +
+	"INSERT INTO userapi_refresh_tokens (refresh_token, access_token, localpart, server_name, device_id, access_token_expires_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectRefreshTokenSQL = "" +
+	"SELECT access_token, localpart, server_name, device_id FROM userapi_refresh_tokens WHERE refresh_token = $1"
+
+const deleteRefreshTokenSQL = "" +
+	"DELETE FROM userapi_refresh_tokens WHERE refresh_token = $1"
+
+const deleteRefreshTokensForDeviceSQL = "" +
+	"DELETE FROM userapi_refresh_tokens WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
+
+type refreshTokensStatements struct {
+	insertRefreshTokenStmt           *sql.Stmt
+	selectRefreshTokenStmt           *sql.Stmt
+	deleteRefreshTokenStmt           *sql.Stmt
+	deleteRefreshTokensForDeviceStmt *sql.Stmt
+}
+
+func NewSQLiteRefreshTokensTable(db *sql.DB) (tables.RefreshTokensTable, error) {
+	s := &refreshTokensStatements{}
+	_, err := db.Exec(refreshTokensSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertRefreshTokenStmt, insertRefreshTokenSQL},
+		{&s.selectRefreshTokenStmt, selectRefreshTokenSQL},
+		{&s.deleteRefreshTokenStmt, deleteRefreshTokenSQL},
+		{&s.deleteRefreshTokensForDeviceStmt, deleteRefreshTokensForDeviceSQL},
+	}.Prepare(db)
+}
+
+func (s *refreshTokensStatements) InsertRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken, accessToken string,
+	localpart string, serverName spec.ServerName, deviceID string,
+	accessTokenExpiresTS spec.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, accessToken, localpart, serverName, deviceID, accessTokenExpiresTS)
+	return err
+}
+
+// SelectRefreshToken returns the access token and device that the refresh token
+// belongs to. Returns sql.ErrNoRows if the refresh token is unknown.
+func (s *refreshTokensStatements) SelectRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (accessToken, localpart string, serverName spec.ServerName, deviceID string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRefreshTokenStmt)
+	err = stmt.QueryRowContext(ctx, refreshToken).Scan(&accessToken, &localpart, &serverName, &deviceID)
+	return
+}
+
+func (s *refreshTokensStatements) DeleteRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken)
+	return err
+}
+
+func (s *refreshTokensStatements) DeleteRefreshTokensForDevice(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRefreshTokensForDeviceStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, deviceID)
+	return err
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ike20013/dendrite/external/sqlutil"
+	"github.com/ike20013/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const ssoSchema = `
+-- Stores which local users the accounts at single sign-on identity providers belong to
+CREATE TABLE IF NOT EXISTS userapi_sso_associations (
+	-- The ID of the identity provider in the config
+	idp_id TEXT NOT NULL,
+	-- The identifier of the user at the identity provider
+	subject TEXT NOT NULL,
+	-- The localpart of the Matrix user ID associated to this account
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+
+	PRIMARY KEY(idp_id, subject)
+);
+
+CREATE INDEX IF NOT EXISTS userapi_sso_associations_localpart_idx ON userapi_sso_associations(localpart, server_name);
+`
+
+const selectLocalpartForSSOSQL = "" +
+	"SELECT localpart, server_name FROM userapi_sso_associations WHERE idp_id = $1 AND subject = $2"
+
+const insertSSOAssociationSQL = "" +
+	"INSERT INTO userapi_sso_associations (idp_id, subject, localpart, server_name) VALUES ($1, $2, $3, $4)"
+
+const deleteSSOAssociationSQL = "" +
+	"DELETE FROM userapi_sso_associations WHERE idp_id = $1 AND subject = $2"
+
+type ssoStatements struct {
+	selectLocalpartForSSOStmt *sql.Stmt
+	insertSSOAssociationStmt  *sql.Stmt
+	deleteSSOAssociationStmt  *sql.Stmt
+}
+
+func NewSQLiteSSOTable(db *sql.DB) (tables.SSOTable, error) {
+	s := &ssoStatements{}
+	_, err := db.Exec(ssoSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.selectLocalpartForSSOStmt, selectLocalpartForSSOSQL},
+		{&s.insertSSOAssociationStmt, insertSSOAssociationSQL},
+		{&s.deleteSSOAssociationStmt, deleteSSOAssociationSQL},
+	}.Prepare(db)
+}
+
+func (s *ssoStatements) SelectLocalpartForSSO(
+	ctx context.Context, txn *sql.Tx, idpID, subject string,
+) (localpart string, serverName spec.ServerName, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectLocalpartForSSOStmt)
+	err = stmt.QueryRowContext(ctx, idpID, subject).Scan(&localpart, &serverName)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return
+}
+
+func (s *ssoStatements) InsertSSOAssociation(
+	ctx context.Context, txn *sql.Tx, idpID, subject,
+	localpart string, serverName spec.ServerName,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.insertSSOAssociationStmt)
+	_, err = stmt.ExecContext(ctx, idpID, subject, localpart, serverName)
+	return
+}
+
+func (s *ssoStatements) DeleteSSOAssociation(
+	ctx context.Context, txn *sql.Tx, idpID, subject string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteSSOAssociationStmt)
+	_, err = stmt.ExecContext(ctx, idpID, subject)
+	return
+}
@@ -46,6 +46,11 @@ func NewUserDatabase(ctx context.Context, conMan *sqlutil.Connections, dbPropert
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteRegistrationsTokenTable: %w", err)
 	}
+	// The accounts table queries join the profiles table, so it must exist first.
+	profilesTable, err := NewSQLiteProfilesTable(db, serverNoticesLocalpart)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteProfilesTable: %w", err)
+	}
 	accountsTable, err := NewSQLiteAccountsTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteAccountsTable: %w", err)
@@ -54,6 +59,12 @@ func NewUserDatabase(ctx context.Context, conMan *sqlutil.Connections, dbPropert
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteAccountDataTable: %w", err)
 	}
+	// The refresh tokens table must exist before the devices table, which
+	// looks up when access tokens expire in it.
+	refreshTokensTable, err := NewSQLiteRefreshTokensTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteRefreshTokensTable: %w", err)
+	}
 	devicesTable, err := NewSQLiteDevicesTable(db, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteDevicesTable: %w", err)
@@ -74,14 +85,18 @@ func NewUserDatabase(ctx context.Context, conMan *sqlutil.Connections, dbPropert
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteOpenIDTable: %w", err)
 	}
-	profilesTable, err := NewSQLiteProfilesTable(db, serverNoticesLocalpart)
-	if err != nil {
-		return nil, fmt.Errorf("NewSQLiteProfilesTable: %w", err)
-	}
 	threePIDTable, err := NewSQLiteThreePIDTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteThreePIDTable: %w", err)
 	}
+	accountValidityTable, err := NewSQLiteAccountValidityTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteAccountValidityTable: %w", err)
+	}
+	ssoTable, err := NewSQLiteSSOTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteSSOTable: %w", err)
+	}
 	pusherTable, err := NewSQLitePusherTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresPusherTable: %w", err)
@@ -113,9 +128,12 @@ func NewUserDatabase(ctx context.Context, conMan *sqlutil.Connections, dbPropert
 		KeyBackups:            keyBackupTable,
 		KeyBackupVersions:     keyBackupVersionTable,
 		LoginTokens:           loginTokenTable,
+		RefreshTokens:         refreshTokensTable,
 		OpenIDTokens:          openIDTable,
 		Profiles:              profilesTable,
 		ThreePIDs:             threePIDTable,
+		SSOAssociations:       ssoTable,
+		AccountValidity:       accountValidityTable,
 		Pushers:               pusherTable,
 		Notifications:         notificationsTable,
 		Stats:                 statsTable,
@@ -3,6 +3,7 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -20,6 +21,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
+	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/external/pushrules"
 	"github.com/ike20013/dendrite/setup/config"
 	"github.com/ike20013/dendrite/test"
@@ -128,8 +130,14 @@ func Test_Accounts(t *testing.T) {
 		assert.Equal(t, accAlice, accGet)
 
 		// deactivate account
+		deactivated, err := db.IsAccountDeactivated(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err)
+		assert.False(t, deactivated, "expected account to be active")
 		err = db.DeactivateAccount(ctx, aliceLocalpart, aliceDomain)
 		assert.NoError(t, err, "failed to deactivate account")
+		deactivated, err = db.IsAccountDeactivated(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err)
+		assert.True(t, deactivated, "expected account to be deactivated")
 		// This should fail now, as the account is deactivated
 		_, err = db.GetAccountByPassword(ctx, aliceLocalpart, aliceDomain, "newPassword")
 		assert.Error(t, err, "expected an error, got none")
@@ -156,6 +164,51 @@ func Test_Accounts(t *testing.T) {
 	})
 }
 
+func Test_GetAccounts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		serverName := spec.ServerName("test")
+
+		_, err := db.CreateAccount(ctx, "alice", serverName, "", "", api.AccountTypeUser)
+		assert.NoError(t, err)
+		_, err = db.CreateAccount(ctx, "bob", serverName, "", "", api.AccountTypeUser)
+		assert.NoError(t, err)
+		_, _, err = db.SetDisplayName(ctx, "bob", serverName, "Robert")
+		assert.NoError(t, err)
+		_, err = db.CreateAccount(ctx, "guest", serverName, "", "", api.AccountTypeGuest)
+		assert.NoError(t, err)
+		assert.NoError(t, db.DeactivateAccount(ctx, "alice", serverName))
+
+		accounts, total, err := db.GetAccounts(ctx, tables.AccountFilter{IncludeGuests: true, Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), total)
+		assert.Equal(t, 2, len(accounts))
+
+		accounts, total, err = db.GetAccounts(ctx, tables.AccountFilter{IncludeDeactivated: true, Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), total)
+		assert.Equal(t, 1, len(accounts))
+		assert.Equal(t, "alice", accounts[0].Localpart)
+		assert.True(t, accounts[0].Deactivated)
+
+		accounts, _, err = db.GetAccounts(ctx, tables.AccountFilter{Search: "rob", Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(accounts))
+		assert.Equal(t, "@bob:test", accounts[0].UserID)
+		assert.Equal(t, "Robert", accounts[0].DisplayName)
+
+		// Reactivate alice and make her an admin
+		assert.NoError(t, db.ReactivateAccount(ctx, "alice", serverName))
+		assert.NoError(t, db.SetAccountType(ctx, "alice", serverName, api.AccountTypeAdmin))
+		accounts, _, err = db.GetAccounts(ctx, tables.AccountFilter{ServerName: serverName, Localpart: "alice", Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(accounts))
+		assert.False(t, accounts[0].Deactivated)
+		assert.Equal(t, api.AccountTypeAdmin, accounts[0].AccountType)
+	})
+}
+
 func Test_Devices(t *testing.T) {
 	alice := test.NewUser(t)
 	localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -348,6 +401,149 @@ func Test_LoginToken(t *testing.T) {
 	})
 }
 
+func Test_RefreshTokens(t *testing.T) {
+	alice := test.NewUser(t)
+	localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+	deviceID := util.RandomString(8)
+	accessToken := util.RandomString(16)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		_, err = db.CreateDevice(ctx, localpart, domain, &deviceID, accessToken, nil, "", "")
+		assert.NoError(t, err, "unable to create device")
+
+		// access tokens without refresh tokens don't expire
+		dev, err := db.GetDeviceByAccessToken(ctx, accessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, spec.Timestamp(0), dev.AccessTokenExpiresTS)
+
+		wantExpiresTS := spec.AsTimestamp(time.Now().Add(time.Minute))
+		refreshToken, err := db.CreateRefreshToken(ctx, localpart, domain, deviceID, accessToken, wantExpiresTS)
+		assert.NoError(t, err, "unable to create refresh token")
+		dev, err = db.GetDeviceByAccessToken(ctx, accessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, wantExpiresTS, dev.AccessTokenExpiresTS)
+
+		// refreshing replaces the access token of the device
+		newAccessToken := util.RandomString(16)
+		newRefreshToken, err := db.RefreshAccessToken(ctx, refreshToken, newAccessToken, wantExpiresTS)
+		assert.NoError(t, err, "unable to refresh access token")
+		assert.NotEqual(t, refreshToken, newRefreshToken)
+		_, err = db.GetDeviceByAccessToken(ctx, accessToken)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		dev, err = db.GetDeviceByAccessToken(ctx, newAccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, deviceID, dev.ID)
+		assert.Equal(t, wantExpiresTS, dev.AccessTokenExpiresTS)
+
+		// refresh tokens can only be used once
+		_, err = db.RefreshAccessToken(ctx, refreshToken, util.RandomString(16), wantExpiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// logging out removes the refresh token, even if the access token is reused
+		err = db.RemoveDevices(ctx, localpart, domain, []string{deviceID})
+		assert.NoError(t, err, "unable to remove device")
+		_, err = db.CreateDevice(ctx, localpart, domain, nil, newAccessToken, nil, "", "")
+		assert.NoError(t, err, "unable to create device")
+		_, err = db.RefreshAccessToken(ctx, newRefreshToken, util.RandomString(16), wantExpiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// logging out all devices removes their refresh tokens
+		_, err = db.CreateDevice(ctx, localpart, domain, &deviceID, accessToken, nil, "", "")
+		assert.NoError(t, err, "unable to create device")
+		refreshToken, err = db.CreateRefreshToken(ctx, localpart, domain, deviceID, accessToken, wantExpiresTS)
+		assert.NoError(t, err, "unable to create refresh token")
+		_, err = db.RemoveAllDevices(ctx, localpart, domain, "")
+		assert.NoError(t, err, "unable to remove devices")
+		_, err = db.CreateDevice(ctx, localpart, domain, nil, accessToken, nil, "", "")
+		assert.NoError(t, err, "unable to create device")
+		_, err = db.RefreshAccessToken(ctx, refreshToken, util.RandomString(16), wantExpiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func Test_AccountValidity(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		domain := spec.ServerName("localhost")
+
+		for _, localpart := range []string{"expiring", "existing", "deactivated", "_server"} {
+			_, err := db.CreateAccount(ctx, localpart, domain, "", "", api.AccountTypeUser)
+			assert.NoError(t, err, "failed to create account")
+		}
+		_, err := db.CreateAccount(ctx, "appservice", domain, "", "as", api.AccountTypeAppService)
+		assert.NoError(t, err, "failed to create account")
+		_, err = db.CreateAccount(ctx, "admin", domain, "", "", api.AccountTypeAdmin)
+		assert.NoError(t, err, "failed to create account")
+		assert.NoError(t, db.DeactivateAccount(ctx, "deactivated", domain))
+
+		expiringTS := spec.AsTimestamp(time.Now().Add(time.Hour))
+		assert.NoError(t, db.SetAccountExpiry(ctx, "expiring", domain, expiringTS))
+
+		// Only the active user accounts without an expiry get one.
+		wantTS := spec.AsTimestamp(time.Now().Add(time.Hour * 24))
+		count, err := db.SetMissingAccountExpiry(ctx, wantTS, "_server")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+		for localpart, want := range map[string]spec.Timestamp{
+			"expiring":    expiringTS,
+			"existing":    wantTS,
+			"deactivated": 0,
+			"_server":     0,
+			"appservice":  0,
+			"admin":       0,
+		} {
+			expiry, err := db.GetAccountExpiry(ctx, localpart, domain)
+			assert.NoError(t, err)
+			assert.Equal(t, want, expiry, localpart)
+		}
+
+		// Doing it again doesn't change anything.
+		count, err = db.SetMissingAccountExpiry(ctx, spec.AsTimestamp(time.Now()), "_server")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+		expiry, err := db.GetAccountExpiry(ctx, "existing", domain)
+		assert.NoError(t, err)
+		assert.Equal(t, wantTS, expiry)
+	})
+}
+
+func Test_SSOAssociations(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		localpart, domain, err := db.GetLocalpartForSSO(ctx, "oidc", "subject")
+		assert.NoError(t, err)
+		assert.Equal(t, "", localpart, "expected no association yet")
+
+		err = db.SaveSSOAssociation(ctx, "oidc", "subject", "alice", "localhost")
+		assert.NoError(t, err, "unable to save SSO association")
+		localpart, domain, err = db.GetLocalpartForSSO(ctx, "oidc", "subject")
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", localpart)
+		assert.Equal(t, spec.ServerName("localhost"), domain)
+
+		// the same subject at another identity provider is a different account
+		localpart, _, err = db.GetLocalpartForSSO(ctx, "other", "subject")
+		assert.NoError(t, err)
+		assert.Equal(t, "", localpart)
+
+		err = db.SaveSSOAssociation(ctx, "oidc", "subject", "bob", "localhost")
+		assert.Error(t, err, "expected saving an association twice to fail")
+
+		err = db.RemoveSSOAssociation(ctx, "oidc", "subject")
+		assert.NoError(t, err, "unable to remove SSO association")
+		localpart, _, err = db.GetLocalpartForSSO(ctx, "oidc", "subject")
+		assert.NoError(t, err)
+		assert.Equal(t, "", localpart, "expected association to be removed")
+	})
+}
+
 func Test_OpenID(t *testing.T) {
 	alice := test.NewUser(t)
 	token := util.RandomString(24)
@@ -554,7 +750,7 @@ func Test_Notification(t *testing.T) {
 		assert.Equal(t, int64(4), total)
 
 		// mark notification as read
-		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room2.ID, 7, true)
+		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room2.ID, "", 7, true)
 		assert.NoError(t, err, "unable to set notifications read")
 		assert.True(t, affected)
 
@@ -578,6 +774,54 @@ func Test_Notification(t *testing.T) {
 	})
 }
 
+func Test_ThreadNotification(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+	room := test.NewRoom(t, alice)
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		// two notifications in the main timeline, then two in each of two threads
+		for i, threadID := range []string{"", "main", "$thread1", "$thread2", "$thread1", "$thread2"} {
+			notification := &api.Notification{
+				Event: synctypes.ClientEvent{
+					Content: spec.RawJSON("{}"),
+				},
+				RoomID:   room.ID,
+				TS:       spec.AsTimestamp(time.Now()),
+				ThreadID: threadID,
+			}
+			err = db.InsertNotification(ctx, aliceLocalpart, aliceDomain, util.RandomString(16), uint64(i+1), nil, notification)
+			assert.NoError(t, err, "unable to insert notification")
+		}
+
+		threads, err := db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, aliceDomain, room.ID)
+		assert.NoError(t, err, "unable to get thread notification counts")
+		assert.Equal(t, map[string]eventutil.ThreadNotificationData{
+			"$thread1": {UnreadNotificationCount: 2},
+			"$thread2": {UnreadNotificationCount: 2},
+		}, threads)
+
+		// reading a thread shouldn't affect the others
+		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room.ID, "$thread1", 6, true)
+		assert.NoError(t, err, "unable to set notifications read")
+		assert.True(t, affected)
+		threads, err = db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, aliceDomain, room.ID)
+		assert.NoError(t, err, "unable to get thread notification counts")
+		assert.Equal(t, map[string]eventutil.ThreadNotificationData{
+			"$thread2": {UnreadNotificationCount: 2},
+		}, threads)
+
+		// nor should reading the main timeline
+		_, err = db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room.ID, "main", 6, true)
+		assert.NoError(t, err, "unable to set notifications read")
+		total, _, err := db.GetRoomNotificationCounts(ctx, aliceLocalpart, aliceDomain, room.ID)
+		assert.NoError(t, err, "unable to get notifications for room")
+		assert.Equal(t, int64(2), total)
+	})
+}
+
 func mustCreateKeyDatabase(t *testing.T, dbType test.DBType) (storage.KeyDatabase, func()) {
 	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
 	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
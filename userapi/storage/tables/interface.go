@@ -19,6 +19,7 @@ import (
 
 	clientapi "github.com/ike20013/dendrite/clientapi/api"
 	"github.com/ike20013/dendrite/clientapi/auth/authtypes"
+	"github.com/ike20013/dendrite/external/eventutil"
 	"github.com/ike20013/dendrite/userapi/types"
 )
 
@@ -41,9 +42,15 @@ type AccountsTable interface {
 	InsertAccount(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, hash, appserviceID string, accountType api.AccountType) (*api.Account, error)
 	UpdatePassword(ctx context.Context, localpart string, serverName spec.ServerName, passwordHash string) (err error)
 	DeactivateAccount(ctx context.Context, localpart string, serverName spec.ServerName) (err error)
+	UpdateAccountShadowBanned(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, shadowBanned bool) (err error)
 	SelectPasswordHash(ctx context.Context, localpart string, serverName spec.ServerName) (hash string, err error)
+	SelectAccountDeactivated(ctx context.Context, localpart string, serverName spec.ServerName) (deactivated bool, err error)
 	SelectAccountByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*api.Account, error)
 	SelectNewNumericLocalpart(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (id int64, err error)
+	ReactivateAccount(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) (err error)
+	UpdateAccountType(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, accountType api.AccountType) (err error)
+	// SelectAccounts returns a page of the accounts matching the filter, and the total number of matching accounts.
+	SelectAccounts(ctx context.Context, txn *sql.Tx, filter AccountFilter) (accounts []api.AdminAccount, total int64, err error)
 }
 
 type DevicesTable interface {
@@ -58,6 +65,7 @@ type DevicesTable interface {
 	SelectDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) ([]api.Device, error)
 	SelectDevicesByID(ctx context.Context, deviceIDs []string) ([]api.Device, error)
 	UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error
+	UpdateDeviceAccessToken(ctx context.Context, txn *sql.Tx, oldAccessToken, newAccessToken string) (bool, error)
 }
 
 type KeyBackupTable interface {
@@ -83,6 +91,13 @@ type LoginTokenTable interface {
 	SelectLoginToken(ctx context.Context, token string) (*api.LoginTokenData, error)
 }
 
+type RefreshTokensTable interface {
+	InsertRefreshToken(ctx context.Context, txn *sql.Tx, refreshToken, accessToken, localpart string, serverName spec.ServerName, deviceID string, accessTokenExpiresTS spec.Timestamp) error
+	SelectRefreshToken(ctx context.Context, txn *sql.Tx, refreshToken string) (accessToken, localpart string, serverName spec.ServerName, deviceID string, err error)
+	DeleteRefreshToken(ctx context.Context, txn *sql.Tx, refreshToken string) error
+	DeleteRefreshTokensForDevice(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string) error
+}
+
 type OpenIDTable interface {
 	InsertOpenIDToken(ctx context.Context, txn *sql.Tx, token, localpart string, serverName spec.ServerName, expiresAtMS int64) (err error)
 	SelectOpenIDTokenAtrributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
@@ -96,6 +111,23 @@ type ProfileTable interface {
 	SelectProfilesBySearch(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
 }
 
+type AccountValidityTable interface {
+	UpsertAccountValidity(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, expirationTS spec.Timestamp) (err error)
+	// SelectAccountValidity returns when the account expires, or 0 if it doesn't.
+	SelectAccountValidity(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) (expirationTS spec.Timestamp, err error)
+	// SelectAccountsExpiring returns the accounts expiring in the time range whose users haven't been warned yet.
+	SelectAccountsExpiring(ctx context.Context, txn *sql.Tx, after, before spec.Timestamp) ([]api.AccountValidity, error)
+	// InsertMissingAccountValidity sets when the active user accounts without an expiry expire, returning how many there were.
+	InsertMissingAccountValidity(ctx context.Context, txn *sql.Tx, expirationTS spec.Timestamp, exceptLocalpart string) (int64, error)
+	UpdateAccountValidityNoticeSent(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) (err error)
+}
+
+type SSOTable interface {
+	SelectLocalpartForSSO(ctx context.Context, txn *sql.Tx, idpID, subject string) (localpart string, serverName spec.ServerName, err error)
+	InsertSSOAssociation(ctx context.Context, txn *sql.Tx, idpID, subject, localpart string, serverName spec.ServerName) (err error)
+	DeleteSSOAssociation(ctx context.Context, txn *sql.Tx, idpID, subject string) (err error)
+}
+
 type ThreePIDTable interface {
 	SelectLocalpartForThreePID(ctx context.Context, txn *sql.Tx, threepid string, medium string) (localpart string, serverName spec.ServerName, err error)
 	SelectThreePIDsForLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (threepids []authtypes.ThreePID, err error)
@@ -114,10 +146,12 @@ type NotificationTable interface {
 	Clean(ctx context.Context, txn *sql.Tx) error
 	Insert(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, eventID string, pos uint64, highlight bool, n *api.Notification) error
 	DeleteUpTo(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64) (affected bool, _ error)
-	UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64, v bool) (affected bool, _ error)
+	UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID, threadID string, pos uint64, v bool) (affected bool, _ error)
 	Select(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, fromID int64, limit int, filter NotificationFilter) ([]*api.Notification, int64, error)
 	SelectCount(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, filter NotificationFilter) (int64, error)
 	SelectRoomCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (total int64, highlight int64, _ error)
+	// SelectRoomThreadCounts returns the unread notification counts of the threads in the room, by thread root event ID.
+	SelectRoomThreadCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (map[string]eventutil.ThreadNotificationData, error)
 }
 
 type StatsTable interface {
@@ -127,6 +161,17 @@ type StatsTable interface {
 	UpsertDailyStats(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, stats types.MessageStats, activeRooms, activeE2EERooms int64) error
 }
 
+// AccountFilter selects accounts for SelectAccounts. Empty strings match everything.
+type AccountFilter struct {
+	ServerName         spec.ServerName
+	Localpart          string
+	Search             string // matched against the localpart and display name
+	IncludeDeactivated bool
+	IncludeGuests      bool
+	From               int
+	Limit              int
+}
+
 type NotificationFilter uint32
 
 const (
@@ -43,10 +43,18 @@ func mustMakeDBs(t *testing.T, dbType test.DBType) (
 
 	switch dbType {
 	case test.DBTypeSQLite:
+		// The accounts table joins the profiles table.
+		if _, err = sqlite3.NewSQLiteProfilesTable(db, "notice"); err != nil {
+			t.Fatalf("unable to create profiles db: %v", err)
+		}
 		accTable, err = sqlite3.NewSQLiteAccountsTable(db, "localhost")
 		if err != nil {
 			t.Fatalf("unable to create acc db: %v", err)
 		}
+		// The devices table joins the refresh tokens table.
+		if _, err = sqlite3.NewSQLiteRefreshTokensTable(db); err != nil {
+			t.Fatalf("unable to create refresh tokens db: %v", err)
+		}
 		devTable, err = sqlite3.NewSQLiteDevicesTable(db, "localhost")
 		if err != nil {
 			t.Fatalf("unable to open device db: %v", err)
@@ -56,10 +64,18 @@ func mustMakeDBs(t *testing.T, dbType test.DBType) (
 			t.Fatalf("unable to open stats db: %v", err)
 		}
 	case test.DBTypePostgres:
+		// The accounts table joins the profiles table.
+		if _, err = postgres.NewPostgresProfilesTable(db, "notice"); err != nil {
+			t.Fatalf("unable to create profiles db: %v", err)
+		}
 		accTable, err = postgres.NewPostgresAccountsTable(db, "localhost")
 		if err != nil {
 			t.Fatalf("unable to create acc db: %v", err)
 		}
+		// The devices table joins the refresh tokens table.
+		if _, err = postgres.NewPostgresRefreshTokensTable(db); err != nil {
+			t.Fatalf("unable to create refresh tokens db: %v", err)
+		}
 		devTable, err = postgres.NewPostgresDevicesTable(db, "localhost")
 		if err != nil {
 			t.Fatalf("unable to open device db: %v", err)
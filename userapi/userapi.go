@@ -62,6 +62,18 @@ func NewInternalAPI(
 		logrus.WithError(err).Panicf("failed to connect to accounts db")
 	}
 
+	// Accounts which were created before accounts started to expire get the
+	// full period from now.
+	if validity := &dendriteCfg.UserAPI.AccountValidity; validity.Enabled() {
+		expirationTS := spec.AsTimestamp(time.Now().Add(validity.Period))
+		count, err := db.SetMissingAccountExpiry(processContext.Context(), expirationTS, dendriteCfg.Global.ServerNotices.LocalPart)
+		if err != nil {
+			logrus.WithError(err).Error("failed to set the expiry of existing accounts")
+		} else if count > 0 {
+			logrus.Infof("Existing accounts without an expiry expire at %s", expirationTS.Time().UTC())
+		}
+	}
+
 	keyDB, err := storage.NewKeyDatabase(cm, &dendriteCfg.KeyServer.Database)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to key db")
@@ -82,6 +94,11 @@ func NewInternalAPI(
 		DB:        keyDB,
 	}
 
+	passwordProviders, err := internal.NewPasswordProviders(&dendriteCfg.UserAPI.PasswordAuth)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up password providers")
+	}
+
 	userAPI := &internal.UserInternalAPI{
 		DB:                   db,
 		KeyDatabase:          keyDB,
@@ -93,6 +110,7 @@ func NewInternalAPI(
 		DisableTLSValidation: dendriteCfg.UserAPI.PushGatewayDisableTLSValidation,
 		PgClient:             pgClient,
 		FedClient:            fedClient,
+		PasswordProviders:    passwordProviders,
 	}
 
 	updater := internal.NewDeviceListUpdater(processContext, keyDB, userAPI, keyChangeProducer, fedClient, dendriteCfg.UserAPI.WorkerCount, rsAPI, dendriteCfg.Global.ServerName, enableMetrics, blacklistedOrBackingOffFn)
@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -40,6 +41,7 @@ const (
 type apiTestOpts struct {
 	loginTokenLifetime time.Duration
 	serverName         string
+	passwordProviders  []internal.PasswordProvider
 }
 
 type dummyProducer struct {
@@ -97,6 +99,7 @@ func MustMakeInternalAPI(t *testing.T, opts apiTestOpts, dbType test.DBType, pub
 			Config:            &cfg.UserAPI,
 			SyncProducer:      syncProducer,
 			KeyChangeProducer: keyChangeProducer,
+			PasswordProviders: opts.passwordProviders,
 		}, accountDB, func() {
 			close()
 		}
@@ -193,6 +196,125 @@ func TestPasswordlessLoginFails(t *testing.T) {
 	})
 }
 
+func TestLDAPPasswordProvider(t *testing.T) {
+	ctx := context.Background()
+	entries := []ldapEntry{{dn: "cn=dendrite,dc=example,dc=com", password: "servicepass"}}
+	for _, uid := range []string{"alice", "bob", "carol"} {
+		objectClass := "person"
+		if uid == "carol" {
+			objectClass = "device"
+		}
+		entries = append(entries, ldapEntry{
+			dn:       "uid=" + uid + ",ou=users,dc=example,dc=com",
+			password: uid + "-ldap",
+			attributes: map[string][]string{
+				"objectClass": {objectClass},
+				"uid":         {uid},
+				"cn":          {strings.ToUpper(uid[:1]) + uid[1:] + " LDAP"},
+				"mail":        {uid + "@example.com"},
+			},
+		})
+	}
+	srv := newLDAPServer(t, entries...)
+
+	newProvider := func(cfg config.LDAPPasswordProvider) internal.PasswordProvider {
+		cfg.URI = srv.uri
+		cfg.BaseDN = "ou=users,dc=example,dc=com"
+		cfg.Filter = "(objectClass=person)"
+		configErrs := &config.ConfigErrors{}
+		cfg.Verify(configErrs, "ldap")
+		if len(*configErrs) > 0 {
+			t.Fatalf("invalid LDAP config: %v", *configErrs)
+		}
+		provider, err := internal.NewLDAPPasswordProvider(&cfg)
+		if err != nil {
+			t.Fatalf("failed to create LDAP provider: %s", err)
+		}
+		return provider
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		userAPI, accountDB, close := MustMakeInternalAPI(t, apiTestOpts{
+			passwordProviders: []internal.PasswordProvider{
+				// Only checks users who already have an account, binding as them directly.
+				newProvider(config.LDAPPasswordProvider{}),
+				newProvider(config.LDAPPasswordProvider{
+					BindDN:        "cn=dendrite,dc=example,dc=com",
+					BindPassword:  "servicepass",
+					AutoProvision: true,
+				}),
+			},
+		}, dbType, nil)
+		defer close()
+		if _, err := accountDB.CreateAccount(ctx, "bob", serverName, "", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+		if _, err := accountDB.CreateAccount(ctx, "dave", serverName, "dave-local", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+
+		login := func(localpart, password string) bool {
+			res := &api.QueryAccountByPasswordResponse{}
+			if err := userAPI.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+				Localpart:         localpart,
+				ServerName:        serverName,
+				PlaintextPassword: password,
+			}, res); err != nil {
+				t.Fatalf("QueryAccountByPassword failed: %s", err)
+			}
+			if res.Exists && res.Account.Localpart != localpart {
+				t.Fatalf("logged in as %s instead of %s", res.Account.Localpart, localpart)
+			}
+			return res.Exists
+		}
+
+		tests := []struct {
+			localpart, password string
+			want                bool
+		}{
+			{"alice", "alice-ldap", true}, // provisioned on first login
+			{"alice", "wrong", false},
+			{"alice", "", false},
+			{"bob", "bob-ldap", true},      // existing account
+			{"carol", "carol-ldap", false}, // doesn't match the filter
+			{"dave", "dave-local", true},   // only in the local database
+			{"dave", "wrong", false},
+		}
+		for _, tc := range tests {
+			if got := login(tc.localpart, tc.password); got != tc.want {
+				t.Errorf("login as %s with password %q: expected %v, got %v", tc.localpart, tc.password, tc.want, got)
+			}
+		}
+
+		profile, err := accountDB.GetProfileByLocalpart(ctx, "alice", serverName)
+		if err != nil {
+			t.Fatalf("failed to get profile: %s", err)
+		}
+		if profile.DisplayName != "Alice LDAP" {
+			t.Errorf("expected display name to be synced from LDAP, got %q", profile.DisplayName)
+		}
+		owner, _, err := accountDB.GetLocalpartForThreePID(ctx, "alice@example.com", "email")
+		if err != nil || owner != "alice" {
+			t.Errorf("expected email to be associated to alice, got %q (err %v)", owner, err)
+		}
+		if _, err = accountDB.GetAccountByLocalpart(ctx, "carol", serverName); err == nil {
+			t.Errorf("expected no account to be created for carol")
+		}
+
+		if err = accountDB.DeactivateAccount(ctx, "bob", serverName); err != nil {
+			t.Fatalf("failed to deactivate account: %s", err)
+		}
+		if login("bob", "bob-ldap") {
+			t.Errorf("expected deactivated account not to be able to log in")
+		}
+
+		userAPI.(*internal.UserInternalAPI).Config.PasswordAuth.LocalDatabase = false
+		if login("dave", "dave-local") {
+			t.Errorf("expected local passwords to be ignored")
+		}
+	})
+}
+
 func TestLoginToken(t *testing.T) {
 	ctx := context.Background()
 